@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	"github.com/jrockway/ekglue/pkg/cds"
 	"github.com/jrockway/ekglue/pkg/glue"
 	"github.com/jrockway/ekglue/pkg/k8s"
@@ -19,15 +20,16 @@ var (
 	kubeconfig string
 	config     = flag.String("config", "", "path to the ekglue config")
 	verbose    = flag.Bool("verbose", false, "true to dump cluster YAML with defaults listed")
+	dir        = flag.String("dir", "", "if set, read services, endpoints, endpointslices, and nodes from yaml files in this directory instead of connecting to a cluster")
+	format     = flag.String("format", "yaml", `output format: "yaml" for the localities, endpoints, and clusters that would be served, or "bootstrap" for an envoy bootstrap config with the clusters as static_resources`)
 )
 
 func main() {
 	flag.StringVar(&kubeconfig, "kubeconfig", filepath.Join(os.Getenv("HOME"), ".kube", "config"), "path to the kubeconfig for the cluster you want to run again")
 	klog.InitFlags(nil)
 	flag.Parse()
-	w, err := k8s.ConnectOutOfCluster(kubeconfig, "")
-	if err != nil {
-		klog.Fatalf("connect to k8s cluster: %v", err)
+	if *format != "yaml" && *format != "bootstrap" {
+		klog.Exitf("unknown format %q", *format)
 	}
 
 	var cfg *glue.Config
@@ -43,8 +45,50 @@ func main() {
 	}
 
 	server := cds.NewServer("ekglue-dump-config", nil)
-
 	nodes := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	if *dir != "" {
+		dw := &k8s.DirectoryWatcher{Dir: *dir}
+		if err := dw.LoadInto(cfg.ClusterConfig.Store(server), cfg.EndpointConfig.Store(nodes, server), nodes); err != nil {
+			klog.Fatalf("load directory %q: %v", *dir, err)
+		}
+	} else {
+		listCluster(cfg, server, nodes)
+	}
+	// Validators aren't installed on the server, so that clusters that break the rules are still
+	// dumped; they are reported here instead.
+	var violations int
+	validators := cfg.Validation.ClusterValidators()
+	for _, r := range server.Clusters.List() {
+		for _, v := range validators {
+			if err := v(r); err != nil {
+				klog.Errorf("cluster %q: %v", r.(*envoy_config_cluster_v3.Cluster).GetName(), err)
+				violations++
+			}
+		}
+	}
+	if *format == "bootstrap" {
+		bBytes, err := server.BootstrapAsYAML(*verbose)
+		if err != nil {
+			klog.Fatalf("dump bootstrap yaml: %v", err)
+		}
+		fmt.Printf("%s\n", bytes.TrimSpace(bBytes))
+	} else {
+		dumpYAML(cfg, server, nodes)
+	}
+	if violations > 0 {
+		klog.Exitf("%d validation rule violations", violations)
+	}
+}
+
+// listCluster connects to the cluster and lists the objects that ekglue would watch into server.
+func listCluster(cfg *glue.Config, server *cds.Server, nodes cache.Store) {
+	w, err := k8s.ConnectOutOfCluster(kubeconfig, "")
+	if err != nil {
+		klog.Fatalf("connect to k8s cluster: %v", err)
+	}
+	if wc := cfg.Watch; wc != nil {
+		w.Namespaces, w.ServiceLabelSelector, w.ServiceFieldSelector = wc.Namespaces, wc.LabelSelector, wc.FieldSelector
+	}
 	if err := w.ListNodes(nodes); err != nil {
 		klog.Fatalf("list nodes: %v", err)
 	}
@@ -54,6 +98,10 @@ func main() {
 	if err := w.ListServices(cfg.ClusterConfig.Store(server)); err != nil {
 		klog.Fatalf("list services: %v", err)
 	}
+}
+
+// dumpYAML prints the localities, endpoints, and clusters that would be served.
+func dumpYAML(cfg *glue.Config, server *cds.Server, nodes cache.Store) {
 	lBytes, err := cfg.EndpointConfig.Locality.LocalitiesAsYAML(nodes)
 	if err != nil {
 		klog.Fatalf("dump locality yaml: %v", err)
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+type bootstrapChannelCreds struct {
+	Type string `json:"type"`
+}
+
+type bootstrapServer struct {
+	ServerURI      string                   `json:"server_uri"`
+	ChannelCreds   []*bootstrapChannelCreds `json:"channel_creds"`
+	ServerFeatures []string                 `json:"server_features"`
+}
+
+type bootstrapLocality struct {
+	Zone string `json:"zone,omitempty"`
+}
+
+type bootstrapNode struct {
+	ID       string             `json:"id"`
+	Locality *bootstrapLocality `json:"locality,omitempty"`
+}
+
+// grpcBootstrap is a gRPC xDS bootstrap file.
+type grpcBootstrap struct {
+	XDSServers []*bootstrapServer `json:"xds_servers"`
+	Node       *bootstrapNode     `json:"node"`
+}
+
+// bootstrap implements "ekglue grpc-bootstrap", which writes an xDS bootstrap file that points a
+// proxyless gRPC client at ekglue.  Point the client at the file with the GRPC_XDS_BOOTSTRAP
+// environment variable, and dial "xds:///<listener name>".  It returns the process's exit code.
+func bootstrap(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("ekglue grpc-bootstrap", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var server, nodeID, zone, output string
+	fs.StringVar(&server, "server", "ekglue.ekglue.svc.cluster.local:9000", "address of the ekglue gRPC server")
+	fs.StringVar(&nodeID, "node_id", "", "the node id to identify this client as; defaults to the hostname")
+	fs.StringVar(&zone, "zone", "", "the zone to report as this client's locality")
+	fs.StringVar(&output, "output", "", "where to write the bootstrap file; defaults to stdout")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if nodeID == "" {
+		var err error
+		nodeID, err = os.Hostname()
+		if err != nil {
+			fmt.Fprintf(stderr, "ekglue grpc-bootstrap: get hostname for node id: %v\n", err)
+			return 1
+		}
+	}
+	b := &grpcBootstrap{
+		XDSServers: []*bootstrapServer{{
+			ServerURI:      server,
+			ChannelCreds:   []*bootstrapChannelCreds{{Type: "insecure"}},
+			ServerFeatures: []string{"xds_v3"},
+		}},
+		Node: &bootstrapNode{ID: nodeID},
+	}
+	if zone != "" {
+		b.Node.Locality = &bootstrapLocality{Zone: zone}
+	}
+	js, err := json.MarshalIndent(b, "", "    ")
+	if err != nil {
+		fmt.Fprintf(stderr, "ekglue grpc-bootstrap: marshal bootstrap: %v\n", err)
+		return 1
+	}
+	js = append(js, '\n')
+	if output == "" {
+		stdout.Write(js)
+		return 0
+	}
+	if err := os.WriteFile(output, js, 0o644); err != nil {
+		fmt.Fprintf(stderr, "ekglue grpc-bootstrap: write bootstrap: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jrockway/ekglue/pkg/glue"
+	"github.com/jrockway/ekglue/pkg/k8s"
+	runtimeschema "k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// requirement is an API resource that ekglue watches.
+type requirement struct {
+	resource   runtimeschema.GroupVersionResource
+	namespaced bool // watched in the configured namespaces, rather than cluster-wide
+	optional   bool // ekglue carries on without it, if the API isn't served
+	why        string
+}
+
+// requirements returns the resources that ekglue needs to watch to run with cfg.
+func requirements(cfg *glue.Config) []requirement {
+	result := []requirement{
+		{resource: k8s.ServiceResource, namespaced: true, why: "services are translated into clusters"},
+		{resource: k8s.EndpointSliceResource, namespaced: true, why: "endpointslices are translated into load assignments"},
+		{resource: k8s.NodeResource, why: "nodes provide endpoint localities"},
+	}
+	if cfg.EndpointConfig.PodStore() != nil {
+		result = append(result, requirement{resource: k8s.PodResource, why: "tracks, pod weights, or readiness health checks are configured"})
+	}
+	if cfg.EndpointConfig.IdentityStore() != nil {
+		result = append(result, requirement{resource: k8s.CiliumEndpointResource, why: "endpoint_config.cilium_identity_metadata is set"})
+	}
+	if cfg.OpenShiftRoutes != nil {
+		result = append(result, requirement{resource: k8s.OpenShiftRouteResource, optional: true, why: "openshift_routes is configured"})
+	}
+	if cfg.EnvoyClusters != nil {
+		result = append(result, requirement{resource: k8s.EnvoyClusterResource, optional: true, why: "envoy_clusters is configured"})
+	}
+	if cfg.Ingresses != nil {
+		result = append(result, requirement{resource: k8s.IngressResource, why: "ingresses is configured"})
+	}
+	return result
+}
+
+// doctor implements "ekglue doctor", which checks everything that commonly keeps ekglue from
+// working (an invalid config, an unreachable API server, missing APIs, and missing RBAC
+// permissions) and explains how to fix each problem it finds.  It returns the process's exit code.
+func doctor(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("ekglue doctor", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var config, kubeconfig, master string
+	fs.StringVar(&config, "c", "", "config file to check; if unset, the default config is checked")
+	fs.StringVar(&config, "config", "", "config file to check; if unset, the default config is checked")
+	fs.StringVar(&kubeconfig, "kubeconfig", "", "kubeconfig to connect with; if neither it nor -master is set, the in-cluster config is used")
+	fs.StringVar(&master, "master", "", "url of the kubernetes api server")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	failed := false
+	report := func(ok bool, msg, hint string) {
+		if ok {
+			fmt.Fprintf(stdout, "ok    %s\n", msg)
+			return
+		}
+		failed = true
+		fmt.Fprintf(stdout, "FAIL  %s\n", msg)
+		if hint != "" {
+			fmt.Fprintf(stdout, "      %s\n", hint)
+		}
+	}
+	warn := func(msg, hint string) {
+		fmt.Fprintf(stdout, "warn  %s\n      %s\n", msg, hint)
+	}
+
+	cfg := glue.DefaultConfig()
+	if config != "" {
+		var err error
+		if cfg, err = glue.LoadConfig(config); err != nil {
+			report(false, fmt.Sprintf("config %s: %v", config, err), "fix the config; \"ekglue schema\" prints its JSON schema")
+			return 1
+		}
+	}
+	if err := cfg.Check(glue.ExampleServices()); err != nil {
+		report(false, fmt.Sprintf("config: %v", err), "\"ekglue validate -c <config> -services <dir>\" checks the config against your own services")
+	} else {
+		report(true, "config is valid", "")
+	}
+
+	var watcher *k8s.ClusterWatcher
+	var err error
+	if kubeconfig != "" || master != "" {
+		watcher, err = k8s.ConnectOutOfCluster(kubeconfig, master)
+	} else {
+		watcher, err = k8s.ConnectInCluster()
+	}
+	if err != nil {
+		report(false, fmt.Sprintf("kubernetes client: %v", err), "outside of a cluster, pass -kubeconfig or -master")
+		return 1
+	}
+	version, err := watcher.ServerVersion()
+	if err != nil {
+		report(false, fmt.Sprintf("api server: %v", err), "check the api server address, network policies between ekglue and the api server, and the credentials in use")
+		return 1
+	}
+	report(true, fmt.Sprintf("connected to api server %s", version), "")
+
+	namespaces := []string{""}
+	if cfg.Watch != nil && len(cfg.Watch.Namespaces) > 0 {
+		namespaces = cfg.Watch.Namespaces
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, r := range requirements(cfg) {
+		name := r.resource.GroupResource().String()
+		ok, err := watcher.HasResource(r.resource)
+		switch {
+		case err != nil:
+			report(false, fmt.Sprintf("discover %s: %v", name, err), "")
+			continue
+		case !ok && r.optional:
+			warn(fmt.Sprintf("%s api (%s) is not served; ekglue will ignore it", name, r.resource.GroupVersion()), r.why+", but the api is missing")
+			continue
+		case !ok:
+			report(false, fmt.Sprintf("%s api (%s) is not served", name, r.resource.GroupVersion()), r.why+"; install the api, or change the config so that it isn't needed")
+			continue
+		}
+		for _, ns := range namespaces {
+			if !r.namespaced {
+				ns = ""
+			}
+			where := "in all namespaces"
+			if ns != "" {
+				where = "in namespace " + ns
+			}
+			for _, verb := range []string{"list", "watch"} {
+				allowed, reason, err := watcher.CanI(ctx, verb, r.resource, ns)
+				if err != nil {
+					report(false, fmt.Sprintf("check permission to %s %s: %v", verb, name, err), "")
+					continue
+				}
+				msg := fmt.Sprintf("%s %s %s", verb, name, where)
+				if reason != "" && !allowed {
+					msg += ": " + reason
+				}
+				report(allowed, msg, fmt.Sprintf("%s; grant %q on %q in api group %q to ekglue's service account (see deploy/base/clusterrole.yaml)", r.why, verb, r.resource.Resource, r.resource.Group))
+			}
+			if !r.namespaced {
+				break
+			}
+		}
+	}
+	if failed {
+		fmt.Fprintln(stderr, "ekglue doctor: problems found")
+		return 1
+	}
+	return 0
+}
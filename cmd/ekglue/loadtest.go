@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// loadTest configures a load test; see loadtest.
+type loadTest struct {
+	typeURL  string
+	subsetOf int
+	nackRate float64
+	churn    time.Duration
+	verbose  io.Writer // where to report stream errors, or nil
+}
+
+// recorder collects latency observations from every client.
+type recorder struct {
+	sync.Mutex
+	initial                  []time.Duration
+	fanout                   []time.Duration
+	firstSeen                map[string]time.Time
+	responses, nacks, errors int
+}
+
+func (r *recorder) recordInitial(d time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	r.initial = append(r.initial, d)
+}
+
+func (r *recorder) recordVersion(version string, at time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	r.responses++
+	first, ok := r.firstSeen[version]
+	if !ok {
+		r.firstSeen[version] = at
+		return
+	}
+	r.fanout = append(r.fanout, at.Sub(first))
+}
+
+func (r *recorder) count(nack bool, err error) {
+	r.Lock()
+	defer r.Unlock()
+	if nack {
+		r.nacks++
+	}
+	if err != nil {
+		r.errors++
+	}
+}
+
+// percentiles formats the 50th, 90th, 99th, and 100th percentiles of ds.
+func percentiles(ds []time.Duration) string {
+	if len(ds) == 0 {
+		return "no samples"
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	p := func(q float64) time.Duration {
+		return ds[int(q*float64(len(ds)-1))]
+	}
+	return fmt.Sprintf("p50=%v p90=%v p99=%v max=%v (n=%d)", p(0.5), p(0.9), p(0.99), p(1), len(ds))
+}
+
+// subscription returns the resource names that a client should subscribe to.
+func (lt *loadTest) subscription(all []string) []string {
+	if lt.subsetOf <= 0 || lt.subsetOf >= len(all) {
+		return all
+	}
+	perm := rand.Perm(len(all))
+	var result []string
+	for _, i := range perm[:lt.subsetOf] {
+		result = append(result, all[i])
+	}
+	return result
+}
+
+// runStream runs one xDS stream until it fails or ctx is done.
+func (lt *loadTest) runStream(ctx context.Context, conn *grpc.ClientConn, id int, subscription []string, r *recorder) error {
+	stream, err := discovery_v3.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx)
+	if err != nil {
+		return fmt.Errorf("start stream: %w", err)
+	}
+	node := &envoy_config_core_v3.Node{Id: fmt.Sprintf("ekglue-loadtest-%d", id), Cluster: "ekglue-loadtest"}
+	start := time.Now()
+	if err := stream.Send(&discovery_v3.DiscoveryRequest{Node: node, TypeUrl: lt.typeURL, ResourceNames: subscription}); err != nil {
+		return fmt.Errorf("send initial request: %w", err)
+	}
+	var acked string
+	for first := true; ; first = false {
+		res, err := stream.Recv()
+		if err != nil {
+			return fmt.Errorf("recv: %w", err)
+		}
+		now := time.Now()
+		if first {
+			r.recordInitial(now.Sub(start))
+		}
+		r.recordVersion(res.GetVersionInfo(), now)
+		req := &discovery_v3.DiscoveryRequest{TypeUrl: lt.typeURL, ResourceNames: subscription, ResponseNonce: res.GetNonce()}
+		nack := rand.Float64() < lt.nackRate
+		if nack {
+			req.VersionInfo = acked
+			req.ErrorDetail = &status.Status{Message: "simulated rejection"}
+		} else {
+			req.VersionInfo = res.GetVersionInfo()
+			acked = req.VersionInfo
+		}
+		r.count(nack, nil)
+		if err := stream.Send(req); err != nil {
+			return fmt.Errorf("send ack: %w", err)
+		}
+	}
+}
+
+// runClient runs a simulated client, reconnecting on errors and churn, until ctx is done.
+func (lt *loadTest) runClient(ctx context.Context, conn *grpc.ClientConn, id int, all []string, r *recorder) {
+	for ctx.Err() == nil {
+		sctx, cancel := context.WithCancel(ctx)
+		if lt.churn > 0 {
+			sctx, cancel = context.WithTimeout(ctx, time.Duration(rand.Int63n(int64(lt.churn))+1))
+		}
+		err := lt.runStream(sctx, conn, id, lt.subscription(all), r)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if sctx.Err() == nil {
+			r.count(false, err)
+			if lt.verbose != nil {
+				fmt.Fprintf(lt.verbose, "client %d: %v\n", id, err)
+			}
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// loadtest implements "ekglue loadtest", which simulates a fleet of Envoy xDS clients against a
+// running ekglue, and reports how long it takes for configuration pushes to reach them.
+//
+// Two latencies are reported: "initial" is the time from a client sending its first request to
+// receiving its first response, and "fanout" is, for each version of the configuration, the time
+// between the first simulated client and each other client receiving it.  Fanout is a lower bound
+// on push latency, since the simulator can't see when ekglue learned about the change.  It returns
+// the process's exit code.
+func loadtest(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("ekglue loadtest", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	lt := new(loadTest)
+	var address, resources string
+	var clients int
+	var duration time.Duration
+	var verbose bool
+	fs.StringVar(&address, "address", "localhost:9000", "address of the ekglue grpc server")
+	fs.IntVar(&clients, "clients", 100, "number of simulated clients")
+	fs.StringVar(&lt.typeURL, "type", "type.googleapis.com/envoy.config.cluster.v3.Cluster", "resource type to subscribe to")
+	fs.StringVar(&resources, "resources", "", "comma-separated resource names to subscribe to; empty for a wildcard subscription")
+	fs.IntVar(&lt.subsetOf, "subset", 0, "if non-zero, each client subscribes to a random subset of this many of -resources")
+	fs.Float64Var(&lt.nackRate, "nack_rate", 0, "fraction of responses to reject, between 0 and 1")
+	fs.DurationVar(&lt.churn, "churn", 0, "if non-zero, each client reconnects after a random duration up to this long")
+	fs.DurationVar(&duration, "duration", time.Minute, "how long to run the test")
+	fs.BoolVar(&verbose, "v", false, "report every stream error")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if lt.nackRate < 0 || lt.nackRate > 1 {
+		fmt.Fprintln(stderr, "ekglue loadtest: -nack_rate must be between 0 and 1")
+		return 2
+	}
+	if verbose {
+		lt.verbose = stderr
+	}
+	var all []string
+	if resources != "" {
+		all = strings.Split(resources, ",")
+	}
+
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		fmt.Fprintf(stderr, "ekglue loadtest: dial %s: %v\n", address, err)
+		return 1
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+	r := &recorder{firstSeen: make(map[string]time.Time)}
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			lt.runClient(ctx, conn, id, all, r)
+		}(i)
+	}
+	wg.Wait()
+
+	r.Lock()
+	defer r.Unlock()
+	fmt.Fprintf(stdout, "clients=%d responses=%d nacks=%d stream_errors=%d versions=%d\n", clients, r.responses, r.nacks, r.errors, len(r.firstSeen))
+	fmt.Fprintf(stdout, "initial: %s\n", percentiles(r.initial))
+	fmt.Fprintf(stdout, "fanout:  %s\n", percentiles(r.fanout))
+	return 0
+}
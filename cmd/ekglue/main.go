@@ -1,72 +1,213 @@
-// Command "ekglue" runs a gRPC server that serves an Envoy CDS and EDS server.
+// Command "ekglue" runs a gRPC server that serves an Envoy CDS and EDS server.  It also serves LDS,
+// RDS, and ADS, for proxyless gRPC clients.
 package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"math"
 	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
 	"github.com/jrockway/ekglue/pkg/cds"
 	"github.com/jrockway/ekglue/pkg/glue"
 	"github.com/jrockway/ekglue/pkg/k8s"
+	"github.com/jrockway/ekglue/pkg/nomad"
+	"github.com/jrockway/ekglue/pkg/xds"
 	"github.com/jrockway/opinionated-server/server"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 	"k8s.io/client-go/tools/cache"
 
 	envoy_api_v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
+	discoveryservice "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	listenerservice "github.com/envoyproxy/go-control-plane/envoy/service/listener/v3"
+	loadstatsservice "github.com/envoyproxy/go-control-plane/envoy/service/load_stats/v3"
+	routeservice "github.com/envoyproxy/go-control-plane/envoy/service/route/v3"
 )
 
 type kflags struct {
-	Kubeconfig string `long:"kubeconfig" env:"KUBECONFIG" description:"kubeconfig to use to connect to the cluster, when running outside of the cluster"`
-	Master     string `long:"master" env:"KUBE_MASTER" description:"url of the kubernetes master, only necessary when running outside of the cluster and when it's not specified in the provided kubeconfig"`
+	Kubeconfig            string   `long:"kubeconfig" env:"KUBECONFIG" description:"kubeconfig to use to connect to the cluster, when running outside of the cluster"`
+	Master                string   `long:"master" env:"KUBE_MASTER" description:"url of the kubernetes master, only necessary when running outside of the cluster and when it's not specified in the provided kubeconfig"`
+	ClusterNamesConfigMap string   `long:"cluster_names_configmap" description:"if set, a configmap (as namespace/name) to keep up to date with the generated cluster names and their service DNS names; requires permission to get, create, and update it"`
+	Namespaces            []string `long:"namespace" description:"a namespace to watch services and endpointslices in; may be repeated.  overrides the config file's watch.namespaces; if neither is set, all namespaces are watched"`
+	ServiceLabelSelector  string   `long:"service_label_selector" description:"a label selector restricting the services (and endpointslices) to watch; overrides the config file's watch.label_selector"`
+	ServiceFieldSelector  string   `long:"service_field_selector" description:"a field selector restricting the services to watch; overrides the config file's watch.field_selector"`
+	RolloutConfigMap      string   `long:"rollout_status_configmap" description:"if set, a configmap (as namespace/name) to keep up to date with how many connected clients have accepted, rejected, or not yet responded to the current version of each resource type; requires permission to get, create, and update it"`
+	DNSEndpoint           string   `long:"dns_endpoint" description:"if set, an external-dns DNSEndpoint (as namespace/name) to keep up to date with a TXT record for each hostname in a service's external-dns hostname annotation, listing the clusters that serve it; requires the DNSEndpoint CRD and permission to get, create, and update it"`
+	DNSRecordPrefix       string   `long:"dns_record_prefix" default:"_ekglue." description:"the prefix added to a hostname to name its TXT record in the --dns_endpoint"`
+	RemoteClusters        []string `long:"remote_cluster" description:"an additional kubernetes cluster to publish the services of, as prefix,kubeconfig or prefix,kubeconfig,context; may be repeated.  the names of the clusters and load assignments generated from it start with the prefix, like \"east:\"; listeners, routes, and aggregates are only generated from the main cluster"`
+	SnapshotConfigMap     string   `long:"snapshot_configmap" description:"if set, a configmap (as namespace/name) to save the served resources to after every change, and to serve them from at startup until kubernetes has been read; requires permission to get, create, and update it.  limited to 1MiB of config; see --snapshot_dir"`
+}
+
+type nflags struct {
+	Address   string `long:"nomad_address" env:"NOMAD_ADDR" description:"address of the nomad http api; if set, services registered with nomad are also published"`
+	Namespace string `long:"nomad_namespace" env:"NOMAD_NAMESPACE" default:"*" description:"nomad namespace to publish services from"`
+	Token     string `long:"nomad_token" env:"NOMAD_TOKEN" description:"nomad acl token"`
 }
 
 type flags struct {
-	Config        string `short:"c" long:"config" env:"EKGLUE_CONFIG_FILE" description:"config file to read"`
-	VersionPrefix string `long:"version_prefix" env:"VERSION_PREFIX" description:"a string to prepend to the version number that we use to identify the generated configuration to envoy and in metrics"`
+	Config            string        `short:"c" long:"config" env:"EKGLUE_CONFIG_FILE" description:"config file to read"`
+	ConfigInterval    time.Duration `long:"config_reload_interval" env:"CONFIG_RELOAD_INTERVAL" default:"10s" description:"how often to check the config file for changes, which are applied to every generated resource without restarting; 0 to disable"`
+	DevDirectory      string        `long:"dev_directory" description:"development mode: instead of connecting to kubernetes, read services, endpoints, endpointslices, and nodes from yaml files in this directory, reloading when they change"`
+	VersionPrefix     string        `long:"version_prefix" env:"VERSION_PREFIX" description:"a string to prepend to the version number that we use to identify the generated configuration to envoy and in metrics"`
+	DrainTimeout      time.Duration `long:"drain_timeout" env:"DRAIN_TIMEOUT" default:"10s" description:"on shutdown, how long xds streams stop pushing changes and wait for their clients to acknowledge responses already sent before closing, so that clients reconnect to another replica between pushes instead of in the middle of one; keep it below --shutdown_grace_period.  progress is reported at /drain"`
+	MaxStreamAge      time.Duration `long:"max_stream_age" env:"MAX_STREAM_AGE" description:"if set, close xds streams after roughly this long so that clients reconnect and spread out across replicas; only effective when something in front of ekglue balances individual streams"`
+	DigestVersions    bool          `long:"digest_versions" env:"DIGEST_VERSIONS" description:"version responses with a digest of their content, instead of the version prefix and a counter, so that versions are the same across replicas and restarts"`
+	MinPushInterval   time.Duration `long:"min_push_interval" env:"MIN_PUSH_INTERVAL" description:"if set, push changes to each xds client at most this often, merging changes that happen in between"`
+	MarshalWorkers    int           `long:"marshal_workers" env:"MARSHAL_WORKERS" default:"4" description:"the number of goroutines that marshal the resources of large responses, like the first response to a client subscribed to thousands of clusters; 1 to marshal serially"`
+	MaxResponseBytes  int           `long:"max_response_bytes" env:"MAX_RESPONSE_BYTES" default:"4194304" description:"the size of the largest xds response that clients can receive; larger endpoint and route responses are split, and larger cluster and listener responses are logged as errors and counted in ekglue_xds_oversized_responses.  0 to disable"`
+	RollbackThreshold float64       `long:"rollback_threshold" env:"ROLLBACK_THRESHOLD" description:"if set, the fraction of connected clients that must reject a version for ekglue to go back to serving the last version that every client accepted; 0 to disable"`
+	StrictXDS         bool          `long:"strict_xds" env:"STRICT_XDS" description:"follow the xds protocol specification exactly, ignoring stale requests and ending streams that violate it, instead of being lenient; for checking client interoperability"`
+	ContextParams     bool          `long:"context_params" env:"CONTEXT_PARAMS" description:"serve variants of resources, stored with names like foo?shard=1, to clients that ask for them with xdstp:// names or node dynamic parameters"`
+	HistorySize       int           `long:"history_size" env:"HISTORY_SIZE" default:"1000" description:"the number of resource changes and client acks/nacks to remember in memory and serve at /history; 0 to disable"`
+	HistoryFile       string        `long:"history_file" env:"HISTORY_FILE" description:"if set, record history to this file instead of memory, so that it survives restarts"`
+	HistoryMaxBytes   int64         `long:"history_max_bytes" env:"HISTORY_MAX_BYTES" default:"10485760" description:"the size at which the history file is rotated; one old file is kept"`
+	ArchiveSize       int           `long:"config_archive_size" env:"CONFIG_ARCHIVE_SIZE" default:"50" description:"the number of past versions of each resource type to keep, compressed, in memory, and serve at /config_dump?at=<time or version>; 0 to disable"`
+	ArchiveMaxAge     time.Duration `long:"config_archive_max_age" env:"CONFIG_ARCHIVE_MAX_AGE" default:"24h" description:"how long to keep past versions in the config archive after they stop being served; 0 for no limit"`
+	CaptureAfterNacks int           `long:"capture_admin_after_nacks" env:"CAPTURE_ADMIN_AFTER_NACKS" description:"if set, when a client rejects this many versions in a row, fetch /config_dump and /stats from the admin interface address in its node metadata (see --admin_address_metadata) and record them in the history; at most once every 10 minutes per client.  only for trusted clients"`
+	AdminAddressKey   string        `long:"admin_address_metadata" env:"ADMIN_ADDRESS_METADATA" default:"admin_address" description:"the node metadata field holding the address of a client's admin interface, like 10.1.2.3:9901, for --capture_admin_after_nacks"`
+	SnapshotDir       string        `long:"snapshot_dir" env:"SNAPSHOT_DIR" description:"if set, a directory to save the served resources to after every change, and to serve them from at startup until the real sources have been read"`
+	WaitForSync       bool          `long:"wait_for_sync" env:"WAIT_FOR_SYNC" description:"hold new xds streams until every watch has received its initial list, so that a freshly started ekglue never serves an incomplete config; /readyz reports the sync status either way"`
+	Disable           []string      `long:"disable" description:"a resource type (clusters, endpoints, listeners, or routes) not to serve; may be repeated.  types can also be enabled and disabled at runtime by POSTing name and enabled to /managers"`
+	InjectTokenFile   string        `long:"inject_token_file" env:"INJECT_TOKEN_FILE" description:"if set, serve an api at /inject for adding and removing clusters and load assignments named \"external:...\", like temporary clusters for draining traffic, to clients that present one of the bearer tokens in this file (one per line)"`
+	ImportFrom        string        `long:"import_from" env:"IMPORT_FROM" description:"blue/green cutover: at startup, copy the resources and per-client ack ledger of the ekglue grpc server at this address, which this one is replacing, and serve them until this one's own sources catch up; then POST to /handoff on the old server to move its clients here gradually.  use --digest_versions on both so that clients see the versions they already have"`
+	FollowSnapshot    bool          `long:"follow_snapshot" env:"FOLLOW_SNAPSHOT" description:"shared snapshot mode: instead of reading kubernetes, nomad, or config changes, serve the snapshot that another ekglue (the writer) saves to the shared --snapshot_dir or --snapshot_configmap, so that every replica serves exactly the same resources.  use --digest_versions on every replica, including the writer, to keep versions the same"`
+	FollowInterval    time.Duration `long:"follow_interval" env:"FOLLOW_INTERVAL" default:"2s" description:"how often a --follow_snapshot replica checks the shared snapshot for changes"`
+	ReplicateFrom     string        `long:"replicate_from" env:"REPLICATE_FROM" description:"warm standby mode: instead of reading kubernetes, nomad, or config changes, mirror every resource served by the ekglue grpc server at this address, so that its clients can fail over to this one without waiting for anything to be relearned.  use --digest_versions on both to keep versions the same; scoping is not applied"`
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "schema" {
+		os.Exit(schema(os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "webhook" {
+		os.Exit(webhook(os.Args[2:], os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		os.Exit(doctor(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "loadtest" {
+		os.Exit(loadtest(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "grpc-bootstrap" {
+		os.Exit(bootstrap(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	server.AppName = "ekglue"
 
 	f := new(flags)
 	server.AddFlagGroup("ekglue", f)
 	kf := new(kflags)
 	server.AddFlagGroup("Kubernetes", kf)
+	nf := new(nflags)
+	server.AddFlagGroup("Nomad", nf)
 
 	drainCh := make(chan struct{})
 	server.AddDrainHandler(func() { close(drainCh) })
 
 	server.Setup()
 
+	var history xds.HistoryStore
+	switch {
+	case f.HistoryFile != "":
+		history = xds.NewFileHistory(f.HistoryFile, f.HistoryMaxBytes)
+	case f.HistorySize > 0:
+		history = xds.NewRingHistory(f.HistorySize)
+	}
+	if history != nil {
+		http.Handle("/history", xds.HistoryHandler(history))
+	}
+
+	var archive *xds.Archive
+	if f.ArchiveSize > 0 {
+		archive = xds.NewArchive(f.ArchiveSize, f.ArchiveMaxAge)
+		http.Handle("/config_dump", archive)
+	}
+
+	var capture *xds.AdminCapture
+	if f.CaptureAfterNacks > 0 {
+		if history == nil {
+			zap.L().Fatal("--capture_admin_after_nacks records captures in the history; set --history_size or --history_file")
+		}
+		capture = &xds.AdminCapture{Threshold: f.CaptureAfterNacks, AddressKey: f.AdminAddressKey}
+	}
+
 	svc := cds.NewServer(f.VersionPrefix, drainCh)
+	for _, m := range []*xds.Manager{svc.Clusters, svc.Endpoints, svc.Listeners, svc.Routes} {
+		m.MaxStreamAge = f.MaxStreamAge
+		m.DrainTimeout = f.DrainTimeout
+		m.Strict = f.StrictXDS
+		m.ContextParams = f.ContextParams
+		m.MinPushInterval = f.MinPushInterval
+		m.DigestVersions = f.DigestVersions
+		m.MarshalWorkers = f.MarshalWorkers
+		m.MaxResponseBytes = f.MaxResponseBytes
+		m.RollbackThreshold = f.RollbackThreshold
+		m.History = history
+		m.AdminCapture = capture
+		m.Archive = archive
+	}
+	// Standby servers serve another server's resources, instead of generating their own.
+	standby := f.ReplicateFrom != "" || f.FollowSnapshot
+	if dir := f.SnapshotDir; dir != "" && !f.FollowSnapshot {
+		restoreSnapshots(svc, xds.NewFileSnapshot(dir))
+	}
+	for _, name := range f.Disable {
+		if err := svc.SetEnabled(name, false); err != nil {
+			zap.L().Fatal("problem disabling resource type", zap.Error(err))
+		}
+	}
+	var imported bool
+	if addr := f.ImportFrom; addr != "" {
+		imported = importFrom(addr, f.VersionPrefix, svc)
+	}
 	server.AddService(func(s *grpc.Server) {
 		clusterservice.RegisterClusterDiscoveryServiceServer(s, svc)
 		endpointservice.RegisterEndpointDiscoveryServiceServer(s, svc)
+		listenerservice.RegisterListenerDiscoveryServiceServer(s, svc)
+		routeservice.RegisterRouteDiscoveryServiceServer(s, svc)
+		discoveryservice.RegisterAggregatedDiscoveryServiceServer(s, svc)
+		cds.RegisterReplicationServer(s, svc)
+		loadstatsservice.RegisterLoadReportingServiceServer(s, svc)
 		envoy_api_v2.RegisterClusterDiscoveryServiceServer(s, &envoy_api_v2.UnimplementedClusterDiscoveryServiceServer{})
 		envoy_api_v2.RegisterEndpointDiscoveryServiceServer(s, &envoy_api_v2.UnimplementedEndpointDiscoveryServiceServer{})
 	})
 	http.Handle("/clusters", svc.Clusters)
 	http.Handle("/endpoints", svc.Endpoints)
-
-	var watcher *k8s.ClusterWatcher
-	if kf.Kubeconfig != "" || kf.Master != "" {
-		var err error
-		zap.L().Info("connecting to kubernetes, outside of cluster")
-		watcher, err = k8s.ConnectOutOfCluster(kf.Kubeconfig, kf.Master)
-		if err != nil {
-			zap.L().Fatal("problem connecting to cluster via kubeconfig", zap.String("kubeconfig", kf.Kubeconfig), zap.String("master", kf.Master), zap.Error(err))
-		}
-	} else {
-		var err error
-		zap.L().Info("connecting to kubernetes, running in-cluster")
-		watcher, err = k8s.ConnectInCluster()
+	http.Handle("/listeners", svc.Listeners)
+	http.Handle("/routes", svc.Routes)
+	for _, name := range []string{"clusters", "endpoints", "listeners", "routes"} {
+		http.Handle(cds.RESTPathPrefix+name, http.HandlerFunc(svc.ServeREST))
+	}
+	http.Handle("/managers", http.HandlerFunc(svc.ServeManagers))
+	http.Handle("/config-diff", http.HandlerFunc(svc.ServeConfigDiff))
+	http.Handle("/resources/", http.StripPrefix("/resources", http.HandlerFunc(svc.ServeResources)))
+	http.Handle("/sessions", http.HandlerFunc(svc.ServeSessions))
+	http.Handle("/pins", http.HandlerFunc(svc.ServePins))
+	http.Handle("/handoff", http.HandlerFunc(svc.ServeHandOff))
+	http.Handle("/drain", http.HandlerFunc(svc.ServeDrain))
+	http.Handle("/rollout", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ya, err := svc.RolloutStatusAsYAML()
 		if err != nil {
-			zap.L().Fatal("problem connecting to cluster", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-	}
+		w.Write(ya)
+	}))
+
 	cfg := glue.DefaultConfig()
 	if filename := f.Config; filename != "" {
 		zap.L().Info("reading config", zap.String("filename", filename))
@@ -78,16 +219,312 @@ func main() {
 	} else {
 		zap.L().Info("using default config")
 	}
+	cfg.Limits.Apply(svc)
+	cfg.Validation.Apply(svc)
+	if lt := cfg.EndpointConfig.LoadTracker(); lt != nil {
+		svc.LoadReports = &cds.LoadReports{Interval: cfg.EndpointConfig.LoadWeights.ReportInterval(), Record: lt.Record}
+	}
+	var current atomic.Pointer[glue.Config]
+	current.Store(cfg)
+
+	tracker := k8s.NewSyncTracker()
+	http.Handle("/readyz", tracker)
+	if f.WaitForSync && !imported {
+		// Imported resources are complete enough to serve while the watches sync.
+		svc.Ready = tracker.Done()
+	}
 
+	cs := cfg.ClusterConfig.Store(svc)
+	clusterStores := []*glue.ClusterStore{cs}
+	http.Handle("/cluster-names", cs)
+	http.Handle("/invalid-clusters", http.HandlerFunc(cs.ServeInvalidClusters))
+	go cs.RetryInvalid(context.Background())
 	ns := cache.NewStore(cache.DeletionHandlingMetaNamespaceKeyFunc)
+	stores := &glue.Stores{Clusters: cs, Endpoints: cfg.EndpointConfig.Store(ns, svc)}
+	stores.Link()
+	if svc.LoadReports != nil {
+		go stores.Endpoints.BalanceLoad(context.Background())
+	}
+	if filename := f.InjectTokenFile; filename != "" && !standby {
+		tokens, err := readTokens(filename)
+		if err != nil {
+			zap.L().Fatal("problem reading inject tokens", zap.String("filename", filename), zap.Error(err))
+		}
+		stores.Exclude(cds.ExternalPrefix)
+		http.Handle("/inject", &cds.Injector{Server: svc, Tokens: tokens})
+	}
+	var src *nomad.Source
+	if nf.Address != "" && !standby {
+		src = &nomad.Source{Address: nf.Address, Namespace: nf.Namespace, Token: nf.Token}
+		stores.Exclude(src.Name() + ":")
+	}
+	if !standby {
+		stores.AddStatic(glue.NewStaticStore(svc))
+		if err := stores.Static.Reconfigure(context.Background(), cfg.Static); err != nil {
+			zap.L().Fatal("problem serving static resources", zap.Error(err))
+		}
+	}
+	http.Handle("/topology", glue.TopologyHandler(svc, stores))
+	tenants := glue.NewTenantTracker(stores.ClusterNamespace)
+	tenants.Watch(svc)
+	http.Handle("/tenants", tenants)
 	http.Handle("/localities", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		yaml, err := cfg.EndpointConfig.Locality.LocalitiesAsYAML(ns)
+		yaml, err := current.Load().EndpointConfig.Locality.LocalitiesAsYAML(ns)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		w.Write(yaml)
 	}))
+	if addr := f.ReplicateFrom; addr != "" {
+		zap.L().Info("standby mode: mirroring another ekglue instead of reading kubernetes", zap.String("address", addr))
+		go replicate(addr, f.VersionPrefix, svc)
+	} else if f.FollowSnapshot {
+		var store xds.SnapshotStore
+		if dir := f.SnapshotDir; dir != "" {
+			store = xds.NewFileSnapshot(dir)
+		} else if name := kf.SnapshotConfigMap; name != "" {
+			store = configMapSnapshot(connect(kf), name)
+		} else {
+			zap.L().Fatal("--follow_snapshot requires --snapshot_dir or --snapshot_configmap")
+		}
+		zap.L().Info("shared snapshot mode: serving another ekglue's snapshot instead of reading kubernetes")
+		follow(svc, store, f.FollowInterval)
+	} else if dir := f.DevDirectory; dir != "" {
+		zap.L().Info("development mode: reading objects from a directory instead of kubernetes", zap.String("dir", dir))
+		dw := &k8s.DirectoryWatcher{Dir: dir}
+		services := tracker.Track("services", cs)
+		endpointSlices := tracker.Track("endpointslices", stores.Endpoints)
+		nodes := tracker.Track("nodes", ns)
+		go func() {
+			ctx := ctxzap.ToContext(context.Background(), zap.L().Named("dev"))
+			if err := dw.Watch(ctx, services, endpointSlices, nodes); err != nil {
+				zap.L().Fatal("directory watch unexpectedly exited", zap.Error(err))
+			}
+		}()
+	} else if pc := cfg.EDSProxy; pc != nil {
+		proxyEndpoints(connect(kf), pc, svc, ns, tracker)
+	} else {
+		watcher := connect(kf)
+		if name := kf.SnapshotConfigMap; name != "" {
+			restoreSnapshots(svc, configMapSnapshot(watcher, name))
+		}
+		restrictWatches(watcher, cfg.Watch, kf)
+		var remotes []*remoteCluster
+		for _, spec := range kf.RemoteClusters {
+			r := connectRemote(spec, cfg, svc, stores, kf)
+			r.services = tracker.Track(r.prefix+" services", r.stores.Clusters)
+			r.endpointSlices = tracker.Track(r.prefix+" endpointslices", r.stores.Endpoints)
+			remotes = append(remotes, r)
+			clusterStores = append(clusterStores, r.stores.Clusters)
+		}
+		watchCluster(watcher, cfg, svc, stores, ns, tracker, tracker.Track("services", cs), tracker.Track("endpointslices", stores.Endpoints))
+		for _, r := range remotes {
+			watchCluster(r.watcher, r.cfg, svc, r.stores, r.nodes, tracker, r.services, r.endpointSlices)
+		}
+		if name := kf.ClusterNamesConfigMap; name != "" {
+			go publishConfigMap(watcher, name, "clusters.yaml", 30*time.Second, cs.DirectoryAsYAML)
+		}
+		if name := kf.RolloutConfigMap; name != "" {
+			go publishConfigMap(watcher, name, "rollout.yaml", 10*time.Second, svc.RolloutStatusAsYAML)
+		}
+		if name := kf.DNSEndpoint; name != "" {
+			go publishDNSEndpoint(watcher, name, 30*time.Second, func() []*glue.DNSRecord { return cs.DNSRecords(kf.DNSRecordPrefix) })
+		}
+	}
+
+	cfg.Scoping.Apply(svc, clusterStores...)
+
+	if filename := f.Config; filename != "" && f.ConfigInterval > 0 && !standby {
+		go watchConfig(filename, f.ConfigInterval, cfg, &current, stores)
+	}
+
+	if src != nil {
+		go func() {
+			ctx := ctxzap.ToContext(context.Background(), zap.L().Named("nomad"))
+			if err := cfg.RunSource(ctx, src, svc); err != nil {
+				zap.L().Fatal("nomad watch unexpectedly exited", zap.Error(err))
+			}
+		}()
+	}
+
+	server.ListenAndServe()
+}
+
+// readTokens reads the non-empty lines of a file of bearer tokens.
+func readTokens(filename string) ([]string, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if token := strings.TrimSpace(line); token != "" {
+			result = append(result, token)
+		}
+	}
+	if len(result) == 0 {
+		return nil, errors.New("no tokens")
+	}
+	return result, nil
+}
+
+// replicate mirrors the resources of the ekglue at addr into svc's managers, reconnecting whenever
+// the stream fails, until the program exits.  The mirrored resources keep being served while the
+// primary is unreachable.
+func replicate(addr, id string, svc *cds.Server) {
+	l := zap.L().Named("replicate")
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(math.MaxInt32)))
+	if err != nil {
+		l.Fatal("problem dialing primary", zap.String("address", addr), zap.Error(err))
+	}
+	if id == "" {
+		id = "ekglue-standby"
+	}
+	node := &envoy_config_core_v3.Node{Id: id, Cluster: "ekglue"}
+	client := discoveryservice.NewAggregatedDiscoveryServiceClient(conn)
+	delay := time.Second
+	for {
+		start := time.Now()
+		err := xds.Mirror(ctxzap.ToContext(context.Background(), l), client, node, svc.Clusters, svc.Endpoints, svc.Listeners, svc.Routes)
+		if time.Since(start) > time.Minute {
+			delay = time.Second
+		}
+		l.Warn("mirror stream ended; reconnecting", zap.Error(err), zap.Duration("delay", delay))
+		time.Sleep(delay)
+		if delay < 30*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// importFrom imports the resources and ack ledger of the ekglue at addr, returning true if it
+// succeeded.  A failed import is logged, and ekglue starts from its own sources as usual.
+func importFrom(addr, id string, svc *cds.Server) bool {
+	l := zap.L().Named("import")
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(math.MaxInt32)))
+	if err != nil {
+		l.Error("problem dialing old server", zap.String("address", addr), zap.Error(err))
+		return false
+	}
+	defer conn.Close()
+	if id == "" {
+		id = "ekglue-import"
+	}
+	ctx, cancel := context.WithTimeout(ctxzap.ToContext(context.Background(), l), time.Minute)
+	defer cancel()
+	if err := svc.Import(ctx, conn, &envoy_config_core_v3.Node{Id: id, Cluster: "ekglue"}); err != nil {
+		l.Error("problem importing from old server; starting fresh", zap.String("address", addr), zap.Error(err))
+		return false
+	}
+	l.Info("imported resources and ack ledger from old server", zap.String("address", addr))
+	return true
+}
+
+// connect connects to the Kubernetes API server.
+func connect(kf *kflags) *k8s.ClusterWatcher {
+	var watcher *k8s.ClusterWatcher
+	if kf.Kubeconfig != "" || kf.Master != "" {
+		var err error
+		zap.L().Info("connecting to kubernetes, outside of cluster")
+		watcher, err = k8s.ConnectOutOfCluster(kf.Kubeconfig, kf.Master)
+		if err != nil {
+			zap.L().Fatal("problem connecting to cluster via kubeconfig", zap.String("kubeconfig", kf.Kubeconfig), zap.String("master", kf.Master), zap.Error(err))
+		}
+	} else {
+		var err error
+		zap.L().Info("connecting to kubernetes, running in-cluster")
+		watcher, err = k8s.ConnectInCluster()
+		if err != nil {
+			zap.L().Fatal("problem connecting to cluster", zap.Error(err))
+		}
+	}
+	return watcher
+}
+
+// restoreSnapshots makes each manager save its resources to store, and serves whatever was saved
+// there by a previous run until the real sources replace it.  A snapshot that can't be restored
+// only costs the warm start, so problems are logged rather than fatal.  When the server drains,
+// the last changes are saved before it exits.
+func restoreSnapshots(svc *cds.Server, store xds.SnapshotStore) {
+	ctx, c := context.WithTimeout(context.Background(), 30*time.Second)
+	defer c()
+	managers := []*xds.Manager{svc.Clusters, svc.Endpoints, svc.Listeners, svc.Routes}
+	for _, m := range managers {
+		m.Snapshot = store
+		if err := m.Restore(ctx); err != nil {
+			zap.L().Error("problem restoring snapshot", zap.Error(err))
+		}
+	}
+	server.AddDrainHandler(func() {
+		for _, m := range managers {
+			m.Close()
+		}
+	})
+}
+
+// configMapSnapshot returns a snapshot store backed by the named (namespace/name) ConfigMap.
+func configMapSnapshot(watcher *k8s.ClusterWatcher, configMap string) *k8s.ConfigMapSnapshot {
+	namespace, name, ok := strings.Cut(configMap, "/")
+	if !ok {
+		zap.L().Fatal("configmap must be in the form namespace/name", zap.String("configmap", configMap))
+	}
+	return &k8s.ConfigMapSnapshot{Watcher: watcher, Namespace: namespace, Name: name}
+}
+
+// follow makes every manager serve the snapshots that another ekglue saves to store.
+func follow(svc *cds.Server, store xds.SnapshotStore, interval time.Duration) {
+	ctx := ctxzap.ToContext(context.Background(), zap.L().Named("follow"))
+	for _, m := range []*xds.Manager{svc.Clusters, svc.Endpoints, svc.Listeners, svc.Routes} {
+		go m.Follow(ctx, store, interval)
+	}
+}
+
+// restrictWatches applies the watch restrictions from the config file, and then the flags, to the
+// watcher.
+func restrictWatches(watcher *k8s.ClusterWatcher, wc *glue.WatchConfig, kf *kflags) {
+	if wc != nil {
+		watcher.Namespaces = wc.Namespaces
+		watcher.ServiceLabelSelector = wc.LabelSelector
+		watcher.ServiceFieldSelector = wc.FieldSelector
+	}
+	if len(kf.Namespaces) > 0 {
+		watcher.Namespaces = kf.Namespaces
+	}
+	if kf.ServiceLabelSelector != "" {
+		watcher.ServiceLabelSelector = kf.ServiceLabelSelector
+	}
+	if kf.ServiceFieldSelector != "" {
+		watcher.ServiceFieldSelector = kf.ServiceFieldSelector
+	}
+	if len(watcher.Namespaces) > 0 || watcher.ServiceLabelSelector != "" || watcher.ServiceFieldSelector != "" {
+		zap.L().Info("restricting watched services", zap.Strings("namespaces", watcher.Namespaces), zap.String("label_selector", watcher.ServiceLabelSelector), zap.String("field_selector", watcher.ServiceFieldSelector))
+	}
+}
+
+// proxyEndpoints serves load assignments, and nothing else, for the clusters defined elsewhere that
+// clients subscribe to, watching only the services they name; see glue.EDSProxyConfig.
+func proxyEndpoints(watcher *k8s.ClusterWatcher, pc *glue.EDSProxyConfig, svc *cds.Server, ns cache.Store, tracker *k8s.SyncTracker) {
+	zap.L().Info("eds proxy mode: serving load assignments on demand for clusters defined elsewhere", zap.String("cluster_name_pattern", pc.ClusterNamePattern))
+	for _, name := range []string{"clusters", "listeners", "routes"} {
+		if err := svc.SetEnabled(name, false); err != nil {
+			zap.L().Fatal("problem disabling resource type", zap.Error(err))
+		}
+	}
+	nodes := tracker.Track("nodes", ns)
+	go func() {
+		if err := watcher.WatchNodes(context.Background(), nodes); err != nil {
+			zap.L().Fatal("node watch unexpectedly exited", zap.Error(err))
+		}
+	}()
+	svc.Endpoints.OnSubscribe = pc.Proxy(context.Background(), ns, svc, watcher.WatchServiceEndpointSlices).Subscribe
+}
+
+// watchCluster watches the Kubernetes cluster, sending updates to the xDS server.  services and
+// endpointSlices are stores.Clusters and stores.Endpoints, tracked by tracker; every cluster's
+// stores must be tracked before any watch starts, or the first to sync could leave nothing
+// pending.
+func watchCluster(watcher *k8s.ClusterWatcher, cfg *glue.Config, svc *cds.Server, stores *glue.Stores, ns cache.Store, tracker *k8s.SyncTracker, services, endpointSlices cache.Store) {
 	zap.L().Info("pre-filling node store")
 	if err := watcher.ListNodes(ns); err != nil {
 		zap.L().Fatal("problem listing nodes", zap.Error(err))
@@ -97,16 +534,193 @@ func main() {
 			zap.L().Fatal("node watch unexpectedly exited", zap.Error(err))
 		}
 	}()
+	if ids := cfg.EndpointConfig.IdentityStore(); ids != nil {
+		zap.L().Info("pre-filling cilium identity store")
+		idStore := stores.Endpoints.IdentityStore(ids)
+		if err := watcher.ListCiliumEndpoints(idStore); err != nil {
+			zap.L().Fatal("problem listing cilium endpoints", zap.Error(err))
+		}
+		go func() {
+			if err := watcher.WatchCiliumEndpoints(context.Background(), idStore); err != nil {
+				zap.L().Fatal("cilium endpoint watch unexpectedly exited", zap.Error(err))
+			}
+		}()
+	}
+	if ps := cfg.EndpointConfig.PodStore(); ps != nil {
+		zap.L().Info("pre-filling pod store")
+		ps = stores.Endpoints.PodStore(stores.Clusters.PodStore(ps))
+		selector := cfg.PodLabelSelector()
+		if err := watcher.ListPods(ps, selector); err != nil {
+			zap.L().Fatal("problem listing pods", zap.Error(err))
+		}
+		go func() {
+			if err := watcher.WatchPods(context.Background(), ps, selector); err != nil {
+				zap.L().Fatal("pod watch unexpectedly exited", zap.Error(err))
+			}
+		}()
+	}
+	if rc := cfg.OpenShiftRoutes; rc != nil {
+		ok, err := watcher.HasResource(k8s.OpenShiftRouteResource)
+		if err != nil {
+			zap.L().Fatal("problem checking for the openshift route api", zap.Error(err))
+		}
+		if ok {
+			stores.OpenShiftRoutes = rc.Store(svc)
+			routes := tracker.Track("openshift routes", stores.OpenShiftRoutes)
+			go func() {
+				if err := watcher.WatchOpenShiftRoutes(context.Background(), routes); err != nil {
+					zap.L().Fatal("openshift route watch unexpectedly exited", zap.Error(err))
+				}
+			}()
+		} else {
+			zap.L().Info("openshift routes are configured, but the route api is not available; ignoring")
+		}
+	}
+	if ec := cfg.EnvoyClusters; ec != nil {
+		ok, err := watcher.HasResource(k8s.EnvoyClusterResource)
+		if err != nil {
+			zap.L().Fatal("problem checking for the envoycluster api", zap.Error(err))
+		}
+		if ok {
+			stores.Exclude(ec.ClusterPrefix())
+			es := ec.Store(svc)
+			http.Handle("/invalid-envoy-clusters", http.HandlerFunc(es.ServeInvalid))
+			envoyClusters := tracker.Track("envoyclusters", es)
+			go func() {
+				if err := watcher.WatchEnvoyClusters(context.Background(), envoyClusters); err != nil {
+					zap.L().Fatal("envoycluster watch unexpectedly exited", zap.Error(err))
+				}
+			}()
+		} else {
+			zap.L().Info("envoy_clusters is configured, but the envoycluster crd is not installed; ignoring")
+		}
+	}
+	if ic := cfg.Ingresses; ic != nil {
+		stores.Ingresses = ic.Store(svc)
+		stores.Link()
+		ingresses := tracker.Track("ingresses", stores.Ingresses)
+		go func() {
+			if err := watcher.WatchIngresses(context.Background(), ingresses); err != nil {
+				zap.L().Fatal("ingress watch unexpectedly exited", zap.Error(err))
+			}
+		}()
+	}
 	go func() {
-		if err := watcher.WatchServices(context.Background(), cfg.ClusterConfig.Store(svc)); err != nil {
+		if err := watcher.WatchServices(context.Background(), services); err != nil {
 			zap.L().Fatal("service watch unexpectedly exited", zap.Error(err))
 		}
 	}()
 	go func() {
-		if err := watcher.WatchEndpointSlices(context.Background(), cfg.EndpointConfig.Store(ns, svc)); err != nil {
+		if err := watcher.WatchEndpointSlices(context.Background(), endpointSlices); err != nil {
 			zap.L().Fatal("endpointslice watch unexpectedly exited", zap.Error(err))
 		}
 	}()
+}
 
-	server.ListenAndServe()
+// remoteCluster is an additional Kubernetes cluster to publish the services of.
+type remoteCluster struct {
+	prefix                   string
+	watcher                  *k8s.ClusterWatcher
+	cfg                      *glue.Config
+	stores                   *glue.Stores
+	nodes                    cache.Store
+	services, endpointSlices cache.Store // stores, tracked
+}
+
+// connectRemote connects to the additional Kubernetes cluster described by spec, in the form of the
+// --remote_cluster flag, and adds stores for its objects to the main cluster's stores.
+func connectRemote(spec string, cfg *glue.Config, svc *cds.Server, stores *glue.Stores, kf *kflags) *remoteCluster {
+	prefix, rest, _ := strings.Cut(spec, ",")
+	kubeconfig, kubeContext, _ := strings.Cut(rest, ",")
+	if kubeconfig == "" {
+		zap.L().Fatal("remote cluster must be in the form prefix,kubeconfig or prefix,kubeconfig,context", zap.String("remote_cluster", spec))
+	}
+	rcfg, err := cfg.ForCluster(prefix)
+	if err != nil {
+		zap.L().Fatal("problem configuring remote cluster", zap.String("remote_cluster", spec), zap.Error(err))
+	}
+	zap.L().Info("connecting to remote kubernetes cluster", zap.String("prefix", prefix), zap.String("kubeconfig", kubeconfig), zap.String("context", kubeContext))
+	watcher, err := k8s.ConnectContext(kubeconfig, kubeContext)
+	if err != nil {
+		zap.L().Fatal("problem connecting to remote cluster", zap.String("remote_cluster", spec), zap.Error(err))
+	}
+	restrictWatches(watcher, rcfg.Watch, kf)
+	nodes := cache.NewStore(cache.DeletionHandlingMetaNamespaceKeyFunc)
+	rs := &glue.Stores{Clusters: rcfg.ClusterConfig.Store(svc), Endpoints: rcfg.EndpointConfig.Store(nodes, svc)}
+	rs.Link()
+	if err := stores.AddRemote(prefix, rs); err != nil {
+		zap.L().Fatal("problem adding remote cluster", zap.String("remote_cluster", spec), zap.Error(err))
+	}
+	go rs.Clusters.RetryInvalid(context.Background())
+	if svc.LoadReports != nil {
+		go rs.Endpoints.BalanceLoad(context.Background())
+	}
+	return &remoteCluster{prefix: prefix, watcher: watcher, cfg: rcfg, stores: rs, nodes: nodes}
+}
+
+// watchConfig applies changes to the config file to the stores, until the program exits.  Changes
+// that can't be applied without restarting are logged.
+func watchConfig(filename string, interval time.Duration, startup *glue.Config, current *atomic.Pointer[glue.Config], stores *glue.Stores) {
+	err := glue.WatchConfigFile(context.Background(), filename, startup, interval, func(cfg *glue.Config) error {
+		if sections := startup.RestartRequired(cfg); len(sections) > 0 {
+			zap.L().Warn("some config changes only take effect after a restart", zap.Strings("sections", sections))
+		}
+		ctx, c := context.WithTimeout(context.Background(), time.Minute)
+		defer c()
+		if err := stores.Reconfigure(ctx, cfg); err != nil {
+			return err
+		}
+		current.Store(cfg)
+		return nil
+	})
+	zap.L().Error("config watch unexpectedly exited", zap.Error(err))
+}
+
+// publishConfigMap periodically copies the output of get into the named key of a configmap, named
+// as namespace/name, whenever it changes.
+func publishConfigMap(watcher *k8s.ClusterWatcher, configMap, key string, interval time.Duration, get func() ([]byte, error)) {
+	namespace, name, ok := strings.Cut(configMap, "/")
+	if !ok {
+		zap.L().Fatal("configmap must be in the form namespace/name", zap.String("configmap", configMap))
+	}
+	publish("configmap", namespace, name, interval, get, func(ctx context.Context, data []byte) error {
+		return watcher.PublishConfigMap(ctx, namespace, name, map[string]string{key: string(data)})
+	})
+}
+
+// publishDNSEndpoint periodically copies the output of get into the endpoints of a DNSEndpoint,
+// named as namespace/name, whenever it changes.
+func publishDNSEndpoint(watcher *k8s.ClusterWatcher, dnsEndpoint string, interval time.Duration, get func() []*glue.DNSRecord) {
+	namespace, name, ok := strings.Cut(dnsEndpoint, "/")
+	if !ok {
+		zap.L().Fatal("dnsendpoint must be in the form namespace/name", zap.String("dnsendpoint", dnsEndpoint))
+	}
+	publish("dnsendpoint", namespace, name, interval, func() ([]byte, error) {
+		return json.Marshal(get())
+	}, func(ctx context.Context, data []byte) error {
+		return watcher.PublishDNSEndpoint(ctx, namespace, name, json.RawMessage(data))
+	})
+}
+
+// publish periodically calls put with the output of get, whenever it changes.
+func publish(kind, namespace, name string, interval time.Duration, get func() ([]byte, error), put func(ctx context.Context, data []byte) error) {
+	var last string
+	for ; ; time.Sleep(interval) {
+		data, err := get()
+		if err != nil {
+			zap.L().Error("problem marshaling "+kind+" data", zap.String("namespace", namespace), zap.String("name", name), zap.Error(err))
+			continue
+		}
+		if string(data) == last {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = put(ctx, data)
+		cancel()
+		if err != nil {
+			zap.L().Error("problem publishing "+kind, zap.String("namespace", namespace), zap.String("name", name), zap.Error(err))
+			continue
+		}
+		last = string(data)
+	}
 }
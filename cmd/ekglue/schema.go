@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/jrockway/ekglue/pkg/glue"
+)
+
+// schema implements "ekglue schema", which prints a JSON Schema for the config file, for editors
+// that can validate and complete YAML against one.  It returns the process's exit code.
+func schema(stdout, stderr io.Writer) int {
+	js, err := glue.JSONSchema()
+	if err != nil {
+		fmt.Fprintf(stderr, "ekglue schema: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s\n", js)
+	return 0
+}
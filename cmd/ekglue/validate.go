@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jrockway/ekglue/pkg/glue"
+	"github.com/jrockway/ekglue/pkg/k8s"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+)
+
+// validate implements "ekglue validate", which checks a config file against example services, so
+// that a bad config is caught before it's deployed instead of by Envoy rejecting what it generates.
+// It returns the process's exit code.
+func validate(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("ekglue validate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var config, services string
+	fs.StringVar(&config, "c", "", "config file to validate")
+	fs.StringVar(&config, "config", "", "config file to validate")
+	fs.StringVar(&services, "services", "", "a yaml file, or directory of yaml files, of services and endpoints or endpointslices to generate resources from; if unset, an example service with http, https, grpc, and dns ports is used")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if config == "" {
+		fmt.Fprintln(stderr, "ekglue validate: -c is required")
+		return 2
+	}
+	cfg, err := glue.LoadConfig(config)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", config, err)
+		return 1
+	}
+	var svcs []*v1.Service
+	var slices []*discoveryv1.EndpointSlice
+	if services == "" {
+		svcs, slices = glue.ExampleServices()
+	} else {
+		var contents *k8s.DirectoryContents
+		if info, err := os.Stat(services); err == nil && info.IsDir() {
+			contents, err = (&k8s.DirectoryWatcher{Dir: services}).Load()
+		} else {
+			contents, err = k8s.LoadFile(services)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", services, err)
+			return 1
+		}
+		for _, w := range contents.Warnings {
+			fmt.Fprintf(stderr, "%s: warning: %s\n", services, w)
+		}
+		svcs, slices = contents.Services, contents.EndpointSlices
+	}
+	if err := cfg.Check(svcs, slices); err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", config, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s: ok (checked against %d services)\n", config, len(svcs))
+	return 0
+}
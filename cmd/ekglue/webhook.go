@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/jrockway/ekglue/pkg/glue"
+)
+
+// webhook implements "ekglue webhook", which serves a validating admission webhook at /validate
+// that rejects services the config file can't translate; see glue.AdmissionHandler.  The API
+// server only calls webhooks over TLS, so -tls_cert and -tls_key are needed unless something in
+// front of it terminates TLS.  It returns the process's exit code.
+func webhook(args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("ekglue webhook", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var config, listen, cert, key string
+	var interval time.Duration
+	fs.StringVar(&config, "c", "", "config file to check services against")
+	fs.StringVar(&config, "config", "", "config file to check services against")
+	fs.StringVar(&listen, "listen", ":8443", "address to serve the webhook on")
+	fs.StringVar(&cert, "tls_cert", "", "tls certificate file; if unset, plain http is served")
+	fs.StringVar(&key, "tls_key", "", "tls private key file")
+	fs.DurationVar(&interval, "config_reload_interval", 10*time.Second, "how often to check the config file for changes; 0 to disable")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if config == "" {
+		fmt.Fprintln(stderr, "ekglue webhook: -c is required")
+		return 2
+	}
+	if (cert == "") != (key == "") {
+		fmt.Fprintln(stderr, "ekglue webhook: -tls_cert and -tls_key must be set together")
+		return 2
+	}
+	cfg, err := glue.LoadConfig(config)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", config, err)
+		return 1
+	}
+	var current atomic.Pointer[glue.Config]
+	current.Store(cfg)
+	if interval > 0 {
+		go glue.WatchConfigFile(context.Background(), config, cfg, interval, func(cfg *glue.Config) error {
+			current.Store(cfg)
+			return nil
+		})
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/validate", glue.AdmissionHandler(current.Load))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	s := &http.Server{Addr: listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	if cert != "" {
+		err = s.ListenAndServeTLS(cert, key)
+	} else {
+		err = s.ListenAndServe()
+	}
+	fmt.Fprintf(stderr, "ekglue webhook: %v\n", err)
+	return 1
+}
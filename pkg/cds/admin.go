@@ -0,0 +1,177 @@
+package cds
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jrockway/ekglue/pkg/xds"
+	"google.golang.org/protobuf/encoding/protojson"
+	"sigs.k8s.io/yaml"
+)
+
+// manager returns the manager with the provided name, or nil if there is no such manager.
+func (s *Server) manager(name string) *xds.Manager {
+	for _, m := range s.managers() {
+		if m.Name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// writeYAML marshals v as YAML and writes it to w.
+func writeYAML(w http.ResponseWriter, v interface{}) {
+	ya, err := yaml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(ya)
+}
+
+// ServeResources is an http.Handler for introspecting the resources being served.  It expects the
+// path to be "/<type>" or "/<type>/<name>", so it's meant to be mounted with http.StripPrefix; the
+// type is the name of a manager ("clusters", "endpoints", "listeners", or "routes").  The first
+// form lists the name and version of every resource of that type, and the second returns a single
+// resource, as YAML, or as JSON with "?format=json".  Defaults are omitted unless "?verbose" is
+// set.
+func (s *Server) ServeResources(w http.ResponseWriter, req *http.Request) {
+	typ, name, single := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	m := s.manager(typ)
+	if m == nil {
+		http.Error(w, fmt.Sprintf("no resource type %q; expected one of clusters, endpoints, listeners, or routes", typ), http.StatusNotFound)
+		return
+	}
+	if !single || name == "" {
+		versions, err := m.Versions()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeYAML(w, versions)
+		return
+	}
+	r := m.Get(name)
+	if r == nil {
+		http.Error(w, fmt.Sprintf("no %s named %q", typ, name), http.StatusNotFound)
+		return
+	}
+	_, verbose := req.URL.Query()["verbose"]
+	js, err := protojson.MarshalOptions{EmitUnpopulated: verbose, Indent: "  "}.Marshal(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	switch format := req.FormValue("format"); format {
+	case "json":
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	case "", "yaml":
+		ya, err := yaml.JSONToYAML(js)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(ya)
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q; expected json or yaml", format), http.StatusBadRequest)
+	}
+}
+
+// Sessions returns the status of every open stream of each resource type, keyed by manager name.
+// Aggregated streams appear once for each type they have requested.
+func (s *Server) Sessions() map[string][]*xds.SessionStatus {
+	result := make(map[string][]*xds.SessionStatus)
+	for _, m := range s.managers() {
+		result[m.Name] = m.Sessions()
+	}
+	return result
+}
+
+// ServeSessions is an http.Handler that lists the open streams of each resource type, with the
+// resources each client subscribed to and the last version it accepted, as YAML.  A "node" query
+// parameter limits the list to the streams of that node.
+func (s *Server) ServeSessions(w http.ResponseWriter, req *http.Request) {
+	sessions := s.Sessions()
+	if node := req.FormValue("node"); node != "" {
+		for typ, ss := range sessions {
+			var matched []*xds.SessionStatus
+			for _, x := range ss {
+				if x.Node == node {
+					matched = append(matched, x)
+				}
+			}
+			sessions[typ] = matched
+		}
+	}
+	writeYAML(w, sessions)
+}
+
+// DrainStatus returns the progress of each resource type's streams towards closing while the
+// server drains, keyed by manager name.
+func (s *Server) DrainStatus() map[string]*xds.DrainStatus {
+	result := make(map[string]*xds.DrainStatus)
+	for _, m := range s.managers() {
+		result[m.Name] = m.DrainStatus()
+	}
+	return result
+}
+
+// ServeDrain is an http.Handler that reports, as YAML, whether the server is draining, and how
+// many streams of each resource type are still open or waiting for their client to acknowledge a
+// response before closing.
+func (s *Server) ServeDrain(w http.ResponseWriter, req *http.Request) {
+	writeYAML(w, s.DrainStatus())
+}
+
+// Pins returns the pinned resources of each resource type, keyed by manager name.
+func (s *Server) Pins() map[string][]*xds.PinStatus {
+	result := make(map[string][]*xds.PinStatus)
+	for _, m := range s.managers() {
+		result[m.Name] = m.Pins()
+	}
+	return result
+}
+
+// ServePins is an http.Handler that lists the pinned resources of each type as YAML.  A POST with
+// "type" (a manager name), "name", and "ttl" (like "30m") form values pins a resource at its
+// current value, with an optional "reason"; with "unpin=true" instead of a ttl, it removes the pin
+// and applies any change that was held back.
+func (s *Server) ServePins(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		typ, name := req.FormValue("type"), req.FormValue("name")
+		m := s.manager(typ)
+		if m == nil {
+			http.Error(w, fmt.Sprintf("no resource type %q; expected one of clusters, endpoints, listeners, or routes", typ), http.StatusBadRequest)
+			return
+		}
+		if unpin, _ := strconv.ParseBool(req.FormValue("unpin")); unpin {
+			if err := m.Unpin(req.Context(), name); err != nil {
+				code := http.StatusBadRequest
+				if errors.Is(err, xds.ErrNotPinned) {
+					code = http.StatusNotFound
+				}
+				http.Error(w, err.Error(), code)
+				return
+			}
+		} else {
+			ttl, err := time.ParseDuration(req.FormValue("ttl"))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("parse ttl: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := m.Pin(name, ttl, req.FormValue("reason")); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	writeYAML(w, s.Pins())
+}
@@ -0,0 +1,54 @@
+package cds
+
+import (
+	envoy_config_bootstrap_v3 "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v3"
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"sigs.k8s.io/yaml"
+)
+
+// StaticResources returns the clusters being served as an Envoy bootstrap's static_resources, for
+// Envoys that are configured from a file instead of by xDS.  EDS clusters become STATIC clusters
+// with their current endpoints inlined, since there is no EDS server to ask; an EDS cluster without
+// endpoints gets an empty load assignment.
+func (s *Server) StaticResources() *envoy_config_bootstrap_v3.Bootstrap_StaticResources {
+	assignments := make(map[string]*envoy_config_endpoint_v3.ClusterLoadAssignment)
+	for _, cla := range s.ListEndpoints() {
+		assignments[cla.GetClusterName()] = cla
+	}
+	result := new(envoy_config_bootstrap_v3.Bootstrap_StaticResources)
+	for _, cl := range s.ListClusters() {
+		if cl.GetType() != envoy_config_cluster_v3.Cluster_EDS {
+			result.Clusters = append(result.Clusters, cl)
+			continue
+		}
+		static := proto.Clone(cl).(*envoy_config_cluster_v3.Cluster)
+		static.ClusterDiscoveryType = &envoy_config_cluster_v3.Cluster_Type{Type: envoy_config_cluster_v3.Cluster_STATIC}
+		static.EdsClusterConfig = nil
+		name := cl.GetName()
+		if sn := cl.GetEdsClusterConfig().GetServiceName(); sn != "" {
+			name = sn
+		}
+		if cla, ok := assignments[name]; ok {
+			static.LoadAssignment = proto.Clone(cla).(*envoy_config_endpoint_v3.ClusterLoadAssignment)
+			static.LoadAssignment.ClusterName = cl.GetName()
+		} else {
+			static.LoadAssignment = &envoy_config_endpoint_v3.ClusterLoadAssignment{ClusterName: cl.GetName()}
+		}
+		result.Clusters = append(result.Clusters, static)
+	}
+	return result
+}
+
+// BootstrapAsYAML returns StaticResources as the YAML of an Envoy bootstrap config.  If verbose is
+// true, fields with default values are included.
+func (s *Server) BootstrapAsYAML(verbose bool) ([]byte, error) {
+	jsonm := &protojson.MarshalOptions{EmitUnpopulated: verbose, UseProtoNames: true}
+	js, err := jsonm.Marshal(&envoy_config_bootstrap_v3.Bootstrap{StaticResources: s.StaticResources()})
+	if err != nil {
+		return nil, err
+	}
+	return yaml.JSONToYAML(js)
+}
@@ -1,16 +1,31 @@
-// Package cds implements a CDS/EDS server.
+// Package cds implements a CDS/EDS server, along with LDS, RDS, and ADS for clients (like gRPC)
+// that need a complete set of resources.
 package cds
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 
 	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	envoy_config_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	envoy_config_route_v3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
+	discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	listenerservice "github.com/envoyproxy/go-control-plane/envoy/service/listener/v3"
+	loadstatsservice "github.com/envoyproxy/go-control-plane/envoy/service/load_stats/v3"
+	routeservice "github.com/envoyproxy/go-control-plane/envoy/service/route/v3"
 	"github.com/jrockway/ekglue/pkg/xds"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sigs.k8s.io/yaml"
 )
 
 var (
@@ -23,16 +38,44 @@ var (
 		Name: "ekglue_eds_active_stream_count",
 		Help: "The number of clients connected and streaming endpoint updates.",
 	})
+	ldsClientsStreaming = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ekglue_lds_active_stream_count",
+		Help: "The number of clients connected and streaming listener updates.",
+	})
+	rdsClientsStreaming = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ekglue_rds_active_stream_count",
+		Help: "The number of clients connected and streaming route updates.",
+	})
+	adsClientsStreaming = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ekglue_ads_active_stream_count",
+		Help: "The number of clients connected and streaming aggregated updates.",
+	})
 )
 
-// Server is a CDS and EDS server.
+// Server is a CDS and EDS server.  It also serves LDS and RDS, and all four types over ADS, and
+// receives load reports over LRS.
 type Server struct {
-	// We do not implement the GRPC_DELTA or REST protocols.  We include this to pick up stubs
-	// for those methods, and any future protocols that are added.
+	// We include these to pick up stubs for any future methods that are added.
 	clusterservice.UnimplementedClusterDiscoveryServiceServer
 	endpointservice.UnimplementedEndpointDiscoveryServiceServer
+	listenerservice.UnimplementedListenerDiscoveryServiceServer
+	routeservice.UnimplementedRouteDiscoveryServiceServer
+	discovery_v3.UnimplementedAggregatedDiscoveryServiceServer
+	loadstatsservice.UnimplementedLoadReportingServiceServer
+
+	Clusters, Endpoints, Listeners, Routes *xds.Manager
+
+	// Ready, if non-nil, is closed once the managed resources are complete, like after the
+	// Kubernetes reflectors' initial lists.  Until then, new streams wait instead of being served
+	// a partial (or empty) config, which would make clients delete everything that's missing.
+	Ready <-chan struct{}
 
-	Clusters, Endpoints *xds.Manager
+	// LoadReports, if non-nil, receives the load that clients report over LRS.  It must be set
+	// before the server starts serving.
+	LoadReports *LoadReports
+
+	txnMu      sync.Mutex  // serializes Txn.Commit
+	handingOff atomic.Bool // see HandOff
 }
 
 // NewServer returns a new server that is ready to serve.
@@ -40,9 +83,69 @@ func NewServer(versionPrefix string, drainCh chan struct{}) *Server {
 	return &Server{
 		Clusters:  xds.NewManager("clusters", versionPrefix, &envoy_config_cluster_v3.Cluster{}, drainCh),
 		Endpoints: xds.NewManager("endpoints", versionPrefix, &envoy_config_endpoint_v3.ClusterLoadAssignment{}, drainCh),
+		Listeners: xds.NewManager("listeners", versionPrefix, &envoy_config_listener_v3.Listener{}, drainCh),
+		Routes:    xds.NewManager("routes", versionPrefix, &envoy_config_route_v3.RouteConfiguration{}, drainCh),
 	}
 }
 
+// managers returns every manager, in a stable order.
+func (s *Server) managers() []*xds.Manager {
+	return []*xds.Manager{s.Clusters, s.Endpoints, s.Listeners, s.Routes}
+}
+
+// SetEnabled enables or disables the named manager ("clusters", "endpoints", "listeners", or
+// "routes").
+func (s *Server) SetEnabled(name string, enabled bool) error {
+	for _, m := range s.managers() {
+		if m.Name == name {
+			m.SetEnabled(enabled)
+			return nil
+		}
+	}
+	return fmt.Errorf("no manager named %q", name)
+}
+
+// ServeManagers is an http.Handler that reports whether each manager is enabled.  A POST with
+// "name" and "enabled" form values enables or disables a manager.
+func (s *Server) ServeManagers(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		enabled, err := strconv.ParseBool(req.FormValue("enabled"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("parse enabled: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := s.SetEnabled(req.FormValue("name"), enabled); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	enabled := make(map[string]bool)
+	for _, m := range s.managers() {
+		enabled[m.Name] = m.Enabled()
+	}
+	ya, err := yaml.Marshal(enabled)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(ya)
+}
+
+// RolloutStatus returns the rollout status of each resource type, keyed by manager name.
+func (s *Server) RolloutStatus() map[string]*xds.RolloutStatus {
+	result := make(map[string]*xds.RolloutStatus)
+	for _, m := range s.managers() {
+		result[m.Name] = m.RolloutStatus()
+	}
+	return result
+}
+
+// RolloutStatusAsYAML returns the rollout status of each resource type, marshaled as YAML.
+func (s *Server) RolloutStatusAsYAML() ([]byte, error) {
+	return yaml.Marshal(s.RolloutStatus())
+}
+
 func resourcesToClusters(rs []xds.Resource) []*envoy_config_cluster_v3.Cluster {
 	result := make([]*envoy_config_cluster_v3.Cluster, len(rs))
 	for i, r := range rs {
@@ -118,8 +221,28 @@ func (s *Server) ReplaceEndpoints(ctx context.Context, es []*envoy_config_endpoi
 	return s.Endpoints.Replace(ctx, loadAssignmentsToResources(es))
 }
 
+// waitReady blocks until the server is ready, or the stream's context is done.  It fails once the
+// server is handing its clients off to another one.
+func (s *Server) waitReady(ctx context.Context) error {
+	if s.handingOff.Load() {
+		return status.Error(codes.Unavailable, "this server is handing its clients off to another one")
+	}
+	if s.Ready == nil {
+		return nil
+	}
+	select {
+	case <-s.Ready:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("wait for initial sync: %w", ctx.Err())
+	}
+}
+
 // StreamClusters implements CDS.
 func (s *Server) StreamClusters(stream clusterservice.ClusterDiscoveryService_StreamClustersServer) error {
+	if err := s.waitReady(stream.Context()); err != nil {
+		return err
+	}
 	cdsClientsStreaming.Inc()
 	defer cdsClientsStreaming.Dec()
 	return s.Clusters.StreamGRPC(stream)
@@ -127,7 +250,130 @@ func (s *Server) StreamClusters(stream clusterservice.ClusterDiscoveryService_St
 
 // StreamEndpoints implements EDS.
 func (s *Server) StreamEndpoints(stream endpointservice.EndpointDiscoveryService_StreamEndpointsServer) error {
+	if err := s.waitReady(stream.Context()); err != nil {
+		return err
+	}
 	edsClientsStreaming.Inc()
 	defer edsClientsStreaming.Dec()
 	return s.Endpoints.StreamGRPC(stream)
 }
+
+// StreamListeners implements LDS.
+func (s *Server) StreamListeners(stream listenerservice.ListenerDiscoveryService_StreamListenersServer) error {
+	if err := s.waitReady(stream.Context()); err != nil {
+		return err
+	}
+	ldsClientsStreaming.Inc()
+	defer ldsClientsStreaming.Dec()
+	return s.Listeners.StreamGRPC(stream)
+}
+
+// StreamRoutes implements RDS.
+func (s *Server) StreamRoutes(stream routeservice.RouteDiscoveryService_StreamRoutesServer) error {
+	if err := s.waitReady(stream.Context()); err != nil {
+		return err
+	}
+	rdsClientsStreaming.Inc()
+	defer rdsClientsStreaming.Dec()
+	return s.Routes.StreamGRPC(stream)
+}
+
+// StreamAggregatedResources implements ADS.
+func (s *Server) StreamAggregatedResources(stream discovery_v3.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
+	if err := s.waitReady(stream.Context()); err != nil {
+		return err
+	}
+	adsClientsStreaming.Inc()
+	defer adsClientsStreaming.Dec()
+	return xds.StreamAggregated(stream, s.Listeners, s.Routes, s.Clusters, s.Endpoints)
+}
+
+// DeltaClusters implements incremental CDS.
+func (s *Server) DeltaClusters(stream clusterservice.ClusterDiscoveryService_DeltaClustersServer) error {
+	if err := s.waitReady(stream.Context()); err != nil {
+		return err
+	}
+	cdsClientsStreaming.Inc()
+	defer cdsClientsStreaming.Dec()
+	return s.Clusters.DeltaStreamGRPC(stream)
+}
+
+// DeltaEndpoints implements incremental EDS.
+func (s *Server) DeltaEndpoints(stream endpointservice.EndpointDiscoveryService_DeltaEndpointsServer) error {
+	if err := s.waitReady(stream.Context()); err != nil {
+		return err
+	}
+	edsClientsStreaming.Inc()
+	defer edsClientsStreaming.Dec()
+	return s.Endpoints.DeltaStreamGRPC(stream)
+}
+
+// DeltaListeners implements incremental LDS.
+func (s *Server) DeltaListeners(stream listenerservice.ListenerDiscoveryService_DeltaListenersServer) error {
+	if err := s.waitReady(stream.Context()); err != nil {
+		return err
+	}
+	ldsClientsStreaming.Inc()
+	defer ldsClientsStreaming.Dec()
+	return s.Listeners.DeltaStreamGRPC(stream)
+}
+
+// DeltaRoutes implements incremental RDS.
+func (s *Server) DeltaRoutes(stream routeservice.RouteDiscoveryService_DeltaRoutesServer) error {
+	if err := s.waitReady(stream.Context()); err != nil {
+		return err
+	}
+	rdsClientsStreaming.Inc()
+	defer rdsClientsStreaming.Dec()
+	return s.Routes.DeltaStreamGRPC(stream)
+}
+
+// DeltaAggregatedResources implements incremental ADS.
+func (s *Server) DeltaAggregatedResources(stream discovery_v3.AggregatedDiscoveryService_DeltaAggregatedResourcesServer) error {
+	if err := s.waitReady(stream.Context()); err != nil {
+		return err
+	}
+	adsClientsStreaming.Inc()
+	defer adsClientsStreaming.Dec()
+	return xds.StreamDeltaAggregated(stream, s.Listeners, s.Routes, s.Clusters, s.Endpoints)
+}
+
+// toResources converts a slice of concrete resources to a slice of xds.Resource.
+func toResources[T xds.Resource](rs []T) []xds.Resource {
+	result := make([]xds.Resource, len(rs))
+	for i, r := range rs {
+		result[i] = r
+	}
+	return result
+}
+
+// AddListeners adds or updates listeners, and notifies all connected clients of the change.
+func (s *Server) AddListeners(ctx context.Context, ls []*envoy_config_listener_v3.Listener) error {
+	return s.Listeners.Add(ctx, toResources(ls))
+}
+
+// DeleteListener deletes a listener by name, and notifies all connected clients of the change.
+func (s *Server) DeleteListener(ctx context.Context, name string) {
+	s.Listeners.Delete(ctx, name)
+}
+
+// ReplaceListeners replaces all tracked listeners with a new list of listeners.
+func (s *Server) ReplaceListeners(ctx context.Context, ls []*envoy_config_listener_v3.Listener) error {
+	return s.Listeners.Replace(ctx, toResources(ls))
+}
+
+// AddRoutes adds or updates route configurations, and notifies all connected clients of the change.
+func (s *Server) AddRoutes(ctx context.Context, rs []*envoy_config_route_v3.RouteConfiguration) error {
+	return s.Routes.Add(ctx, toResources(rs))
+}
+
+// DeleteRoute deletes a route configuration by name, and notifies all connected clients of the
+// change.
+func (s *Server) DeleteRoute(ctx context.Context, name string) {
+	s.Routes.Delete(ctx, name)
+}
+
+// ReplaceRoutes replaces all tracked route configurations with a new list.
+func (s *Server) ReplaceRoutes(ctx context.Context, rs []*envoy_config_route_v3.RouteConfiguration) error {
+	return s.Routes.Replace(ctx, toResources(rs))
+}
@@ -3,14 +3,29 @@ package cds
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	envoy_config_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
 	discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	listenerservice "github.com/envoyproxy/go-control-plane/envoy/service/listener/v3"
+	loadstatsservice "github.com/envoyproxy/go-control-plane/envoy/service/load_stats/v3"
+	routeservice "github.com/envoyproxy/go-control-plane/envoy/service/route/v3"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
@@ -18,6 +33,16 @@ import (
 	"github.com/jrockway/ekglue/pkg/cds/internal/fakexds"
 	"github.com/jrockway/ekglue/pkg/xds"
 	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"sigs.k8s.io/yaml"
 )
 
 func requestClusters(version, nonce string, err *status.Status) *discovery_v3.DiscoveryRequest {
@@ -119,3 +144,797 @@ func TestCDSFlow(t *testing.T) {
 		t.Fatalf("server stopped for an unexpected reason: %v", err)
 	}
 }
+
+func TestReady(t *testing.T) {
+	s := NewServer("test", nil)
+	ready := make(chan struct{})
+	s.Ready = ready
+
+	ctx, done := context.WithTimeout(context.Background(), 5*time.Second)
+	defer done()
+	ctx = ctxzap.ToContext(ctx, zaptest.NewLogger(t))
+	stream := fakexds.NewStream(ctx)
+	go s.StreamClusters(stream)
+
+	type result struct {
+		res *discovery_v3.DiscoveryResponse
+		err error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		res, err := stream.RequestAndWait(requestClusters("", "", nil))
+		resCh <- result{res, err}
+	}()
+	select {
+	case r := <-resCh:
+		t.Fatalf("got response before ready: %v, %v", r.res, r.err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := s.AddClusters(ctx, []*envoy_config_cluster_v3.Cluster{{Name: "a"}}); err != nil {
+		t.Fatalf("adding cluster 'a': %v", err)
+	}
+	close(ready)
+	r := <-resCh
+	if r.err != nil {
+		t.Fatalf("initial cluster fetch: %v", r.err)
+	}
+	got, err := clustersFromResponse(r.res)
+	if err != nil {
+		t.Fatalf("read clusters from response: %v", err)
+	}
+	if got, want := got, []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("initial cluster fetch: cluster names:\n  got: %v\n want: %v", got, want)
+	}
+}
+
+func TestADSFlow(t *testing.T) {
+	s := NewServer("test", nil)
+	ctx, done := context.WithTimeout(context.Background(), 5*time.Second)
+	defer done()
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.DebugLevel))
+	ctx = ctxzap.ToContext(ctx, logger)
+
+	if err := s.AddClusters(ctx, []*envoy_config_cluster_v3.Cluster{{Name: "a"}}); err != nil {
+		t.Fatalf("adding cluster 'a': %v", err)
+	}
+	if err := s.AddListeners(ctx, []*envoy_config_listener_v3.Listener{{Name: "l"}}); err != nil {
+		t.Fatalf("adding listener 'l': %v", err)
+	}
+
+	doneCh := make(chan error)
+	stream := fakexds.NewStream(ctx)
+	go func() {
+		doneCh <- s.StreamAggregatedResources(stream)
+	}()
+
+	// gRPC clients request listeners first, by name, then the resources they refer to.
+	res, err := stream.RequestAndWait(&discovery_v3.DiscoveryRequest{
+		TypeUrl:       "type.googleapis.com/envoy.config.listener.v3.Listener",
+		ResourceNames: []string{"l"},
+		Node:          &envoy_config_core_v3.Node{Id: "unit-tests"},
+	})
+	if err != nil {
+		t.Fatalf("listener fetch: %v", err)
+	}
+	if got, want := len(res.GetResources()), 1; got != want {
+		t.Errorf("listener fetch: resource count:\n  got: %v\n want: %v", got, want)
+	}
+
+	// The node is only sent on the first request.
+	res, err = stream.RequestAndWait(&discovery_v3.DiscoveryRequest{
+		TypeUrl:       "type.googleapis.com/envoy.config.cluster.v3.Cluster",
+		ResourceNames: []string{"a"},
+	})
+	if err != nil {
+		t.Fatalf("cluster fetch: %v", err)
+	}
+	got, err := clustersFromResponse(res)
+	if err != nil {
+		t.Fatalf("read clusters from response: %v", err)
+	}
+	if got, want := got, []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cluster fetch: cluster names:\n  got: %v\n want: %v", got, want)
+	}
+
+	if err := stream.Request(&discovery_v3.DiscoveryRequest{TypeUrl: "type.googleapis.com/unknown"}); err != nil {
+		t.Fatalf("request unknown type: %v", err)
+	}
+	if err := <-doneCh; err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected an error for an unknown type, got %v", err)
+	}
+}
+
+func TestDisabledManagers(t *testing.T) {
+	s := NewServer("test", nil)
+	ctx, done := context.WithTimeout(context.Background(), 5*time.Second)
+	defer done()
+	ctx = ctxzap.ToContext(ctx, zaptest.NewLogger(t))
+	if err := s.AddClusters(ctx, []*envoy_config_cluster_v3.Cluster{{Name: "a"}}); err != nil {
+		t.Fatalf("adding cluster 'a': %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeManagers(w, httptest.NewRequest("POST", "/managers?name=listeners&enabled=false", nil))
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("disable listeners: status:\n  got: %v\n want: %v", got, want)
+	}
+	if got, want := w.Body.String(), "clusters: true\nendpoints: true\nlisteners: false\nroutes: true\n"; got != want {
+		t.Errorf("disable listeners: body:\n  got: %q\n want: %q", got, want)
+	}
+	w = httptest.NewRecorder()
+	s.ServeManagers(w, httptest.NewRequest("POST", "/managers?name=secrets&enabled=false", nil))
+	if got, want := w.Code, http.StatusBadRequest; got != want {
+		t.Errorf("disable unknown manager: status:\n  got: %v\n want: %v", got, want)
+	}
+
+	// Over ADS, requests for a disabled type are ignored, and the other types keep working.
+	doneCh := make(chan error)
+	stream := fakexds.NewStream(ctx)
+	go func() {
+		doneCh <- s.StreamAggregatedResources(stream)
+	}()
+	if err := stream.Request(&discovery_v3.DiscoveryRequest{
+		TypeUrl: "type.googleapis.com/envoy.config.listener.v3.Listener",
+		Node:    &envoy_config_core_v3.Node{Id: "unit-tests"},
+	}); err != nil {
+		t.Fatalf("request listeners: %v", err)
+	}
+	res, err := stream.RequestAndWait(requestClusters("", "", nil))
+	if err != nil {
+		t.Fatalf("cluster fetch: %v", err)
+	}
+	if got, want := res.GetTypeUrl(), s.Clusters.Type; got != want {
+		t.Errorf("response type:\n  got: %v\n want: %v", got, want)
+	}
+
+	// Disabling a type closes its own streams.
+	clusterStream := fakexds.NewStream(ctx)
+	clusterDoneCh := make(chan error)
+	go func() {
+		clusterDoneCh <- s.StreamClusters(clusterStream)
+	}()
+	if _, err := clusterStream.RequestAndWait(requestClusters("", "", nil)); err != nil {
+		t.Fatalf("cluster fetch: %v", err)
+	}
+	if err := s.SetEnabled("clusters", false); err != nil {
+		t.Fatalf("disable clusters: %v", err)
+	}
+	if err := <-clusterDoneCh; err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected an error from a disabled stream, got %v", err)
+	}
+	// ...but not aggregated streams, which ignore the type from then on.
+	select {
+	case err := <-doneCh:
+		t.Errorf("aggregated stream unexpectedly ended: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	done()
+	if err := <-doneCh; !errors.Is(err, context.Canceled) {
+		t.Errorf("aggregated stream ended for an unexpected reason: %v", err)
+	}
+}
+
+func TestConfigDiff(t *testing.T) {
+	s := NewServer("test", nil)
+	ctx, done := context.WithTimeout(context.Background(), 5*time.Second)
+	defer done()
+	ctx = ctxzap.ToContext(ctx, zaptest.NewLogger(t))
+	if err := s.AddClusters(ctx, []*envoy_config_cluster_v3.Cluster{
+		{Name: "a", ConnectTimeout: durationpb.New(time.Second)},
+		{Name: "b", ConnectTimeout: durationpb.New(time.Second)},
+		{Name: "c"},
+	}); err != nil {
+		t.Fatalf("add clusters: %v", err)
+	}
+	endpoint := func(addr string) *envoy_config_endpoint_v3.LbEndpoint {
+		return &envoy_config_endpoint_v3.LbEndpoint{
+			HostIdentifier: &envoy_config_endpoint_v3.LbEndpoint_Endpoint{
+				Endpoint: &envoy_config_endpoint_v3.Endpoint{
+					Address: &envoy_config_core_v3.Address{
+						Address: &envoy_config_core_v3.Address_SocketAddress{
+							SocketAddress: &envoy_config_core_v3.SocketAddress{
+								Address:       addr,
+								PortSpecifier: &envoy_config_core_v3.SocketAddress_PortValue{PortValue: 80},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+	if err := s.AddEndpoints(ctx, []*envoy_config_endpoint_v3.ClusterLoadAssignment{
+		{ClusterName: "a", Endpoints: []*envoy_config_endpoint_v3.LocalityLbEndpoints{{LbEndpoints: []*envoy_config_endpoint_v3.LbEndpoint{endpoint("10.0.0.1")}}}},
+		{ClusterName: "b", Endpoints: []*envoy_config_endpoint_v3.LocalityLbEndpoints{{LbEndpoints: []*envoy_config_endpoint_v3.LbEndpoint{endpoint("10.0.0.2")}}}},
+		{ClusterName: "c"},
+	}); err != nil {
+		t.Fatalf("add endpoints: %v", err)
+	}
+
+	// Envoy has an out-of-date "b", is missing "c", and has an extra "d".  Its endpoints for "b"
+	// are stale, and the health status it adds to "a" doesn't count as a difference.
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/config_dump" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write([]byte(`{"configs": [
+			{
+				"@type": "type.googleapis.com/envoy.admin.v3.ClustersConfigDump",
+				"static_clusters": [{"cluster": {"name": "xds"}}],
+				"dynamic_active_clusters": [
+					{"version_info": "test-1", "cluster": {"@type": "type.googleapis.com/envoy.config.cluster.v3.Cluster", "name": "a", "connect_timeout": "1s"}},
+					{"version_info": "test-1", "cluster": {"@type": "type.googleapis.com/envoy.config.cluster.v3.Cluster", "name": "b", "connect_timeout": "5s"}},
+					{"version_info": "test-1", "cluster": {"@type": "type.googleapis.com/envoy.config.cluster.v3.Cluster", "name": "d"}}
+				]
+			},
+			{
+				"@type": "type.googleapis.com/envoy.admin.v3.EndpointsConfigDump",
+				"dynamic_endpoint_configs": [
+					{"endpoint_config": {"cluster_name": "a", "endpoints": [{"lb_endpoints": [{"endpoint": {"address": {"socket_address": {"address": "10.0.0.1", "port_value": 80}}}, "health_status": "HEALTHY"}]}]}},
+					{"endpoint_config": {"cluster_name": "b", "endpoints": [{"lb_endpoints": [{"endpoint": {"address": {"socket_address": {"address": "10.0.0.9", "port_value": 80}}}}]}]}},
+					{"endpoint_config": {"cluster_name": "d"}}
+				]
+			}
+		]}`))
+	}))
+	defer admin.Close()
+
+	// Connect a node that advertises the admin server.
+	md, err := structpb.NewStruct(map[string]interface{}{AdminAddressMetadataKey: admin.URL})
+	if err != nil {
+		t.Fatalf("build metadata: %v", err)
+	}
+	stream := fakexds.NewStream(ctx)
+	go s.StreamClusters(stream)
+	req := requestClusters("", "", nil)
+	req.Node.Metadata = md
+	if _, err := stream.RequestAndWait(req); err != nil {
+		t.Fatalf("cluster fetch: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeConfigDiff(w, httptest.NewRequest("GET", "/config-diff?node=unit-tests", nil))
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("status:\n  got: %v\n want: %v\nbody: %s", got, want, w.Body.String())
+	}
+	got := make(map[string]*ResourceDiff)
+	if err := yaml.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("unmarshal diff: %v", err)
+	}
+	for _, d := range got {
+		for name := range d.Different {
+			d.Different[name] = "..."
+		}
+	}
+	want := map[string]*ResourceDiff{
+		"clusters": {
+			Missing:   []string{"c"},
+			Extra:     []string{"d"},
+			Different: map[string]string{"b": "..."},
+		},
+		"endpoints": {Different: map[string]string{"b": "..."}},
+		"listeners": {},
+		"routes":    {},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("diff:\n%s", diff)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeConfigDiff(w, httptest.NewRequest("GET", "/config-diff?node=not-connected", nil))
+	if got, want := w.Code, http.StatusNotFound; got != want {
+		t.Errorf("unknown node: status:\n  got: %v\n want: %v", got, want)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	s := NewServer("", nil)
+	ctx := ctxzap.ToContext(context.Background(), zaptest.NewLogger(t))
+	version := func(m *xds.Manager) string {
+		res, _, err := m.BuildDiscoveryResponse(nil)
+		if err != nil {
+			t.Fatalf("build response: %v", err)
+		}
+		return res.GetVersionInfo()
+	}
+
+	// An invalid load assignment prevents the whole transaction from applying.
+	txn := s.Begin()
+	txn.AddClusters(&envoy_config_cluster_v3.Cluster{Name: "a"})
+	txn.AddEndpoints(&envoy_config_endpoint_v3.ClusterLoadAssignment{})
+	if err := txn.Commit(ctx); err == nil {
+		t.Error("expected an error committing an invalid load assignment")
+	}
+	if got := s.Clusters.ListKeys(); len(got) != 0 {
+		t.Errorf("clusters after failed commit:\n  got: %v\n want: []", got)
+	}
+
+	txn = s.Begin()
+	txn.AddClusters(&envoy_config_cluster_v3.Cluster{Name: "a"}, &envoy_config_cluster_v3.Cluster{Name: "b"})
+	txn.AddEndpoints(&envoy_config_endpoint_v3.ClusterLoadAssignment{ClusterName: "a"}, &envoy_config_endpoint_v3.ClusterLoadAssignment{ClusterName: "b"})
+	if err := txn.Commit(ctx); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if got, want := s.Clusters.ListKeys(), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("clusters:\n  got: %v\n want: %v", got, want)
+	}
+	if got, want := s.Endpoints.ListKeys(), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("endpoints:\n  got: %v\n want: %v", got, want)
+	}
+	// Each manager produces one version per commit, not one per resource.
+	if got, want := version(s.Clusters), "1"; got != want {
+		t.Errorf("cluster version:\n  got: %v\n want: %v", got, want)
+	}
+	if got, want := version(s.Endpoints), "1"; got != want {
+		t.Errorf("endpoint version:\n  got: %v\n want: %v", got, want)
+	}
+
+	txn = s.Begin()
+	txn.DeleteCluster("a")
+	txn.DeleteEndpoints("a")
+	txn.AddClusters(&envoy_config_cluster_v3.Cluster{Name: "c"})
+	txn.AddEndpoints(&envoy_config_endpoint_v3.ClusterLoadAssignment{ClusterName: "c"})
+	if err := txn.Commit(ctx); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if got, want := s.Clusters.ListKeys(), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("clusters:\n  got: %v\n want: %v", got, want)
+	}
+	if got, want := s.Endpoints.ListKeys(), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("endpoints:\n  got: %v\n want: %v", got, want)
+	}
+	if got, want := version(s.Clusters), "2"; got != want {
+		t.Errorf("cluster version:\n  got: %v\n want: %v", got, want)
+	}
+	// Endpoint additions and deletions are sent separately, around the cluster change.
+	if got, want := version(s.Endpoints), "3"; got != want {
+		t.Errorf("endpoint version:\n  got: %v\n want: %v", got, want)
+	}
+
+	// Clusters over their quota don't leave their load assignments behind.
+	s.Clusters.MaxResources = 2
+	txn = s.Begin()
+	txn.AddClusters(&envoy_config_cluster_v3.Cluster{Name: "d"})
+	txn.AddEndpoints(&envoy_config_endpoint_v3.ClusterLoadAssignment{ClusterName: "d"})
+	if err := txn.Commit(ctx); !errors.Is(err, xds.ErrQuotaExceeded) {
+		t.Errorf("commit over quota:\n  got: %v\n want: %v", err, xds.ErrQuotaExceeded)
+	}
+	if got, want := s.Endpoints.ListKeys(), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("endpoints after commit over quota:\n  got: %v\n want: %v", got, want)
+	}
+	if got, want := version(s.Endpoints), "3"; got != want {
+		t.Errorf("endpoint version after commit over quota:\n  got: %v\n want: %v", got, want)
+	}
+}
+
+func TestInject(t *testing.T) {
+	s := NewServer("", nil)
+	ctx := ctxzap.ToContext(context.Background(), zaptest.NewLogger(t))
+	if err := s.AddClusters(ctx, []*envoy_config_cluster_v3.Cluster{{Name: "default:foo:http"}}); err != nil {
+		t.Fatalf("add generated cluster: %v", err)
+	}
+	srv := httptest.NewServer(&Injector{Server: s, Tokens: []string{"old", "secret"}})
+	defer srv.Close()
+	c := &InjectClient{URL: srv.URL, Token: "secret"}
+
+	got, err := c.Inject(ctx, &InjectRequest{
+		Clusters: []*envoy_config_cluster_v3.Cluster{{
+			Name:           "external:drain",
+			ConnectTimeout: durationpb.New(time.Second),
+		}},
+		Endpoints: []*envoy_config_endpoint_v3.ClusterLoadAssignment{{ClusterName: "external:drain"}},
+	})
+	if err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+	want := &InjectedResources{Clusters: []string{"external:drain"}, Endpoints: []string{"external:drain"}}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("injected resources:\n%s", diff)
+	}
+	if diff := cmp.Diff(s.Clusters.Get("external:drain"), &envoy_config_cluster_v3.Cluster{Name: "external:drain", ConnectTimeout: durationpb.New(time.Second)}, protocmp.Transform()); diff != "" {
+		t.Errorf("injected cluster:\n%s", diff)
+	}
+
+	// Generated resources can't be touched.
+	if _, err := c.Inject(ctx, &InjectRequest{DeleteClusters: []string{"default:foo:http"}}); err == nil {
+		t.Error("delete generated cluster: expected error")
+	}
+	if s.Clusters.Get("default:foo:http") == nil {
+		t.Error("generated cluster was deleted")
+	}
+	// Invalid resources are rejected.
+	if _, err := c.Inject(ctx, &InjectRequest{Clusters: []*envoy_config_cluster_v3.Cluster{{Name: "external:bad", ConnectTimeout: durationpb.New(-time.Second)}}}); err == nil {
+		t.Error("invalid cluster: expected error")
+	}
+
+	if _, err := (&InjectClient{URL: srv.URL, Token: "wrong"}).List(ctx); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("wrong token:\n  got: %v\n want: %v", err, ErrUnauthorized)
+	}
+	if _, err := (&InjectClient{URL: srv.URL}).List(ctx); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("no token:\n  got: %v\n want: %v", err, ErrUnauthorized)
+	}
+	if _, err := (&InjectClient{URL: srv.URL, Token: "old"}).List(ctx); err != nil {
+		t.Errorf("second token: %v", err)
+	}
+
+	got, err = c.Inject(ctx, &InjectRequest{DeleteClusters: []string{"external:drain"}, DeleteEndpoints: []string{"external:drain"}})
+	if err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	want = &InjectedResources{Clusters: []string{}, Endpoints: []string{}}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("injected resources after removal:\n%s", diff)
+	}
+	if got, want := s.Clusters.ListKeys(), []string{"default:foo:http"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("clusters:\n  got: %v\n want: %v", got, want)
+	}
+}
+
+func TestStaticResources(t *testing.T) {
+	ctx := context.Background()
+	s := NewServer("test", nil)
+	eds := func(name, serviceName string) *envoy_config_cluster_v3.Cluster {
+		return &envoy_config_cluster_v3.Cluster{
+			Name:                 name,
+			ConnectTimeout:       durationpb.New(time.Second),
+			ClusterDiscoveryType: &envoy_config_cluster_v3.Cluster_Type{Type: envoy_config_cluster_v3.Cluster_EDS},
+			EdsClusterConfig:     &envoy_config_cluster_v3.Cluster_EdsClusterConfig{ServiceName: serviceName},
+		}
+	}
+	dns := &envoy_config_cluster_v3.Cluster{
+		Name:                 "dns",
+		ConnectTimeout:       durationpb.New(time.Second),
+		ClusterDiscoveryType: &envoy_config_cluster_v3.Cluster_Type{Type: envoy_config_cluster_v3.Cluster_STRICT_DNS},
+	}
+	if err := s.AddClusters(ctx, []*envoy_config_cluster_v3.Cluster{eds("a", ""), eds("b", "b-endpoints"), eds("empty", ""), dns}); err != nil {
+		t.Fatalf("add clusters: %v", err)
+	}
+	cla := func(name string) *envoy_config_endpoint_v3.ClusterLoadAssignment {
+		return &envoy_config_endpoint_v3.ClusterLoadAssignment{
+			ClusterName: name,
+			Endpoints:   []*envoy_config_endpoint_v3.LocalityLbEndpoints{{}},
+		}
+	}
+	if err := s.AddEndpoints(ctx, []*envoy_config_endpoint_v3.ClusterLoadAssignment{cla("a"), cla("b-endpoints")}); err != nil {
+		t.Fatalf("add endpoints: %v", err)
+	}
+	type summary struct {
+		Name, Type  string
+		Assignment  string
+		HasEndpoint bool
+	}
+	var got []summary
+	for _, cl := range s.StaticResources().GetClusters() {
+		got = append(got, summary{
+			Name:        cl.GetName(),
+			Type:        cl.GetType().String(),
+			Assignment:  cl.GetLoadAssignment().GetClusterName(),
+			HasEndpoint: len(cl.GetLoadAssignment().GetEndpoints()) > 0,
+		})
+		if cl.GetEdsClusterConfig() != nil {
+			t.Errorf("cluster %q: eds config remains", cl.GetName())
+		}
+	}
+	want := []summary{
+		{Name: "a", Type: "STATIC", Assignment: "a", HasEndpoint: true},
+		{Name: "b", Type: "STATIC", Assignment: "b", HasEndpoint: true},
+		{Name: "dns", Type: "STRICT_DNS"},
+		{Name: "empty", Type: "STATIC", Assignment: "empty"},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("static clusters:\n%s", diff)
+	}
+	if got := s.ListClusters()[0].GetType(); got != envoy_config_cluster_v3.Cluster_EDS {
+		t.Errorf("served cluster was modified: type %v", got)
+	}
+	if _, err := s.BootstrapAsYAML(false); err != nil {
+		t.Errorf("bootstrap yaml: %v", err)
+	}
+}
+
+func TestREST(t *testing.T) {
+	s := NewServer("test", nil)
+	ctx, done := context.WithTimeout(context.Background(), 5*time.Second)
+	defer done()
+	ctx = ctxzap.ToContext(ctx, zaptest.NewLogger(t))
+	if err := s.AddClusters(ctx, []*envoy_config_cluster_v3.Cluster{{Name: "a"}, {Name: "b"}}); err != nil {
+		t.Fatalf("adding clusters: %v", err)
+	}
+
+	post := func(path, body string) (int, string) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, strings.NewReader(body)).WithContext(ctx)
+		s.ServeREST(w, req)
+		return w.Code, w.Body.String()
+	}
+	code, body := post("/v3/discovery:clusters", `{"node": {"id": "rest"}, "resource_names": ["b"]}`)
+	if code != http.StatusOK {
+		t.Fatalf("fetch clusters: status %v: %s", code, body)
+	}
+	res := new(discovery_v3.DiscoveryResponse)
+	if err := protojson.Unmarshal([]byte(body), res); err != nil {
+		t.Fatalf("fetch clusters: unmarshal: %v", err)
+	}
+	if got, want := mustClusterNames(t, res), []string{"b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("fetch clusters:\n  got: %v\n want: %v", got, want)
+	}
+	// The response is the same as the one a stream would get.
+	want, _, err := s.Clusters.BuildDiscoveryResponse([]string{"b"})
+	if err != nil {
+		t.Fatalf("build response: %v", err)
+	}
+	if diff := cmp.Diff(res, want, protocmp.Transform()); diff != "" {
+		t.Errorf("fetch clusters: response:\n%s", diff)
+	}
+
+	if code, body := post("/v3/discovery:clusters", fmt.Sprintf(`{"version_info": %q, "resource_names": ["b"]}`, res.GetVersionInfo())); code != http.StatusNotModified {
+		t.Errorf("fetch current version: status:\n  got: %v (%s)\n want: %v", code, body, http.StatusNotModified)
+	}
+	if code, _ := post("/v3/discovery:secrets", `{}`); code != http.StatusNotFound {
+		t.Errorf("fetch unknown type: status:\n  got: %v\n want: %v", code, http.StatusNotFound)
+	}
+	if code, _ := post("/v3/discovery:clusters", `{"type_url": "type.googleapis.com/envoy.config.listener.v3.Listener"}`); code != http.StatusBadRequest {
+		t.Errorf("fetch mismatched type: status:\n  got: %v\n want: %v", code, http.StatusBadRequest)
+	}
+	if code, _ := post("/v3/discovery:clusters", `not json`); code != http.StatusBadRequest {
+		t.Errorf("fetch garbage: status:\n  got: %v\n want: %v", code, http.StatusBadRequest)
+	}
+
+	// Wildcard requests over gRPC.
+	res, err = s.FetchClusters(ctx, &discovery_v3.DiscoveryRequest{Node: &envoy_config_core_v3.Node{Id: "grpc"}})
+	if err != nil {
+		t.Fatalf("grpc fetch: %v", err)
+	}
+	if got, want := mustClusterNames(t, res), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("grpc fetch:\n  got: %v\n want: %v", got, want)
+	}
+	if _, err := s.FetchClusters(ctx, &discovery_v3.DiscoveryRequest{VersionInfo: res.GetVersionInfo()}); !errors.Is(err, xds.ErrNotModified) {
+		t.Errorf("grpc fetch of current version:\n  got: %v\n want: %v", err, xds.ErrNotModified)
+	}
+
+	s.Clusters.SetEnabled(false)
+	if code, _ := post("/v3/discovery:clusters", `{}`); code != http.StatusServiceUnavailable {
+		t.Errorf("fetch disabled type: status:\n  got: %v\n want: %v", code, http.StatusServiceUnavailable)
+	}
+}
+
+func mustClusterNames(t *testing.T, res *discovery_v3.DiscoveryResponse) []string {
+	t.Helper()
+	names, err := clustersFromResponse(res)
+	if err != nil {
+		t.Fatalf("unmarshal clusters: %v", err)
+	}
+	return names
+}
+
+func TestAdminAPI(t *testing.T) {
+	s := NewServer("test", nil)
+	ctx, done := context.WithTimeout(context.Background(), 5*time.Second)
+	defer done()
+	ctx = ctxzap.ToContext(ctx, zaptest.NewLogger(t))
+	if err := s.AddClusters(ctx, []*envoy_config_cluster_v3.Cluster{{Name: "a"}, {Name: "b", ConnectTimeout: durationpb.New(time.Second)}}); err != nil {
+		t.Fatalf("adding clusters: %v", err)
+	}
+
+	get := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		http.StripPrefix("/resources", http.HandlerFunc(s.ServeResources)).ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code, w.Body.String()
+	}
+	code, body := get("/resources/clusters")
+	if got, want := code, http.StatusOK; got != want {
+		t.Fatalf("list clusters: status:\n  got: %v\n want: %v", got, want)
+	}
+	var versions []*xds.ResourceVersion
+	if err := yaml.Unmarshal([]byte(body), &versions); err != nil {
+		t.Fatalf("list clusters: unmarshal: %v", err)
+	}
+	if got, want := len(versions), 2; got != want {
+		t.Fatalf("list clusters: count:\n  got: %v\n want: %v", got, want)
+	}
+	if got, want := versions[0].Name, "a"; got != want {
+		t.Errorf("list clusters: first name:\n  got: %v\n want: %v", got, want)
+	}
+	if versions[0].Version == "" || versions[0].Version == versions[1].Version {
+		t.Errorf("list clusters: expected distinct versions, got %q and %q", versions[0].Version, versions[1].Version)
+	}
+
+	code, body = get("/resources/clusters/b")
+	if got, want := body, "connectTimeout: 1s\nname: b\n"; code != http.StatusOK || got != want {
+		t.Errorf("get cluster as yaml: status %v:\n  got: %q\n want: %q", code, got, want)
+	}
+	code, body = get("/resources/clusters/b?format=json")
+	if code != http.StatusOK {
+		t.Fatalf("get cluster as json: status %v: %s", code, body)
+	}
+	cluster := new(envoy_config_cluster_v3.Cluster)
+	if err := protojson.Unmarshal([]byte(body), cluster); err != nil {
+		t.Fatalf("get cluster as json: unmarshal: %v", err)
+	}
+	if diff := cmp.Diff(cluster, &envoy_config_cluster_v3.Cluster{Name: "b", ConnectTimeout: durationpb.New(time.Second)}, protocmp.Transform()); diff != "" {
+		t.Errorf("get cluster as json:\n%s", diff)
+	}
+	for _, path := range []string{"/resources/clusters/c", "/resources/secrets", "/resources/"} {
+		if code, _ := get(path); code != http.StatusNotFound {
+			t.Errorf("get %s: status:\n  got: %v\n want: %v", path, code, http.StatusNotFound)
+		}
+	}
+
+	doneCh := make(chan error)
+	stream := fakexds.NewStream(ctx)
+	go func() {
+		doneCh <- s.StreamClusters(stream)
+	}()
+	res, err := stream.RequestAndWait(&discovery_v3.DiscoveryRequest{
+		TypeUrl:       s.Clusters.Type,
+		ResourceNames: []string{"b", "a"},
+		Node:          &envoy_config_core_v3.Node{Id: "unit-tests"},
+	})
+	if err != nil {
+		t.Fatalf("cluster fetch: %v", err)
+	}
+	ack := requestClusters(res.GetVersionInfo(), res.GetNonce(), nil)
+	ack.ResourceNames = []string{"a", "b"}
+	if err := stream.Request(ack); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+	var sessions map[string][]*xds.SessionStatus
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		w := httptest.NewRecorder()
+		s.ServeSessions(w, httptest.NewRequest("GET", "/sessions?node=unit-tests", nil))
+		if err := yaml.Unmarshal(w.Body.Bytes(), &sessions); err != nil {
+			t.Fatalf("sessions: unmarshal: %v", err)
+		}
+		if len(sessions["clusters"]) == 1 && sessions["clusters"][0].Acked != "" {
+			break
+		}
+	}
+	if got, want := len(sessions["clusters"]), 1; got != want {
+		t.Fatalf("sessions: cluster streams:\n  got: %v\n want: %v", got, want)
+	}
+	want := &xds.SessionStatus{Node: "unit-tests", Subscribed: []string{"a", "b"}, Acked: res.GetVersionInfo()}
+	if diff := cmp.Diff(sessions["clusters"][0], want, cmpopts.IgnoreFields(xds.SessionStatus{}, "Connected")); diff != "" {
+		t.Errorf("sessions: cluster stream:\n%s", diff)
+	}
+	if got := len(sessions["endpoints"]); got != 0 {
+		t.Errorf("sessions: expected no endpoint streams, got %d", got)
+	}
+	w := httptest.NewRecorder()
+	s.ServeDrain(w, httptest.NewRequest("GET", "/drain", nil))
+	var drain map[string]*xds.DrainStatus
+	if err := yaml.Unmarshal(w.Body.Bytes(), &drain); err != nil {
+		t.Fatalf("drain: unmarshal: %v", err)
+	}
+	if diff := cmp.Diff(drain["clusters"], &xds.DrainStatus{OpenStreams: 1}); diff != "" {
+		t.Errorf("drain: clusters:\n%s", diff)
+	}
+	done()
+	<-doneCh
+}
+
+// lrsStream is a LoadReportingService_StreamLoadStatsServer that reads requests from a channel, and
+// writes responses to another.
+type lrsStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	reqs chan *loadstatsservice.LoadStatsRequest
+	ress chan *loadstatsservice.LoadStatsResponse
+}
+
+func (s *lrsStream) Context() context.Context { return s.ctx }
+
+func (s *lrsStream) Send(res *loadstatsservice.LoadStatsResponse) error {
+	s.ress <- res
+	return nil
+}
+
+func (s *lrsStream) Recv() (*loadstatsservice.LoadStatsRequest, error) {
+	select {
+	case req, ok := <-s.reqs:
+		if !ok {
+			return nil, io.EOF
+		}
+		return req, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+func TestLoadStats(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 5*time.Second)
+	defer done()
+	type report struct {
+		node  string
+		stats []*envoy_config_endpoint_v3.ClusterStats
+	}
+	reports := make(chan report, 1)
+	s := NewServer("test", nil)
+	s.LoadReports = &LoadReports{
+		Interval: 10 * time.Second,
+		Record: func(node *envoy_config_core_v3.Node, stats []*envoy_config_endpoint_v3.ClusterStats) {
+			reports <- report{node.GetId(), stats}
+		},
+	}
+	stream := &lrsStream{ctx: ctx, reqs: make(chan *loadstatsservice.LoadStatsRequest, 1), ress: make(chan *loadstatsservice.LoadStatsResponse, 1)}
+	doneCh := make(chan error)
+	go func() { doneCh <- s.StreamLoadStats(stream) }()
+
+	stream.reqs <- &loadstatsservice.LoadStatsRequest{Node: &envoy_config_core_v3.Node{Id: "unit-tests"}}
+	want := &loadstatsservice.LoadStatsResponse{SendAllClusters: true, LoadReportingInterval: durationpb.New(10 * time.Second)}
+	if diff := cmp.Diff(<-stream.ress, want, protocmp.Transform()); diff != "" {
+		t.Errorf("response:\n%s", diff)
+	}
+	stats := []*envoy_config_endpoint_v3.ClusterStats{{ClusterName: "a", TotalDroppedRequests: 1}}
+	stream.reqs <- &loadstatsservice.LoadStatsRequest{ClusterStats: stats}
+	select {
+	case got := <-reports:
+		if got.node != "unit-tests" {
+			t.Errorf("node:\n  got: %v\n want: unit-tests", got.node)
+		}
+		if diff := cmp.Diff(got.stats, stats, protocmp.Transform()); diff != "" {
+			t.Errorf("stats:\n%s", diff)
+		}
+	case <-ctx.Done():
+		t.Fatal("no report recorded")
+	}
+	close(stream.reqs)
+	if err := <-doneCh; err != nil {
+		t.Errorf("stream: %v", err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 5*time.Second)
+	defer done()
+	ctx = ctxzap.ToContext(ctx, zaptest.NewLogger(t))
+	old := NewServer("old", nil)
+	if err := old.AddClusters(ctx, []*envoy_config_cluster_v3.Cluster{{Name: "a"}, {Name: "b"}}); err != nil {
+		t.Fatalf("adding clusters: %v", err)
+	}
+	old.Routes.SetEnabled(false)
+	old.Clusters.ImportLedger([]*xds.LedgerEntry{{Node: "envoy", Accepted: "v1"}})
+
+	l := bufconn.Listen(1024 * 1024)
+	gs := grpc.NewServer()
+	clusterservice.RegisterClusterDiscoveryServiceServer(gs, old)
+	endpointservice.RegisterEndpointDiscoveryServiceServer(gs, old)
+	listenerservice.RegisterListenerDiscoveryServiceServer(gs, old)
+	routeservice.RegisterRouteDiscoveryServiceServer(gs, old)
+	RegisterReplicationServer(gs, old)
+	go gs.Serve(l)
+	defer gs.Stop()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return l.DialContext(ctx)
+	}), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s := NewServer("new", nil)
+	if err := s.Import(ctx, conn, &envoy_config_core_v3.Node{Id: "ekglue-import"}); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if got, want := s.Clusters.ListKeys(), []string{"a", "b"}; !cmp.Equal(got, want, cmpopts.SortSlices(func(a, b string) bool { return a < b })) {
+		t.Errorf("imported clusters:\n  got: %v\n want: %v", got, want)
+	}
+	if diff := cmp.Diff(s.Clusters.Ledger(), []*xds.LedgerEntry{{Node: "envoy", Accepted: "v1"}}); diff != "" {
+		t.Errorf("imported ledger:\n%s", diff)
+	}
+
+	// Handing off refuses new requests.
+	w := httptest.NewRecorder()
+	old.ServeHandOff(w, httptest.NewRequest("POST", "/handoff?batch=0", nil))
+	if got, want := w.Code, http.StatusBadRequest; got != want {
+		t.Errorf("hand off with invalid batch: status:\n  got: %v\n want: %v", got, want)
+	}
+	w = httptest.NewRecorder()
+	old.ServeHandOff(w, httptest.NewRequest("POST", "/handoff?batch=5&interval=10ms", nil))
+	if got, want := w.Body.String(), "handing_off: true\nopen_streams:\n  clusters: 0\n  endpoints: 0\n  listeners: 0\n  routes: 0\n"; got != want {
+		t.Errorf("hand off:\n  got: %v\n want: %v", got, want)
+	}
+	if _, err := old.FetchClusters(ctx, &discovery_v3.DiscoveryRequest{}); grpcstatus.Code(err) != codes.Unavailable {
+		t.Errorf("fetch while handing off:\n  got: %v\n want: code %v", err, codes.Unavailable)
+	}
+}
@@ -0,0 +1,304 @@
+package cds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jrockway/ekglue/pkg/xds"
+	"google.golang.org/protobuf/encoding/protojson"
+	"sigs.k8s.io/yaml"
+)
+
+// AdminAddressMetadataKey is the key in a node's metadata that ServeConfigDiff reads to find the
+// node's admin interface, like "http://10.0.0.1:9901".  Envoy doesn't report its admin address on
+// its own, so nodes that want to be diffed by ID need to set this in their bootstrap config.
+const AdminAddressMetadataKey = "ekglue.admin_address"
+
+// ResourceDiff describes how the resources of one type in an Envoy's config dump differ from the
+// resources that ekglue is serving.
+type ResourceDiff struct {
+	// Missing lists resources that ekglue is serving, but that Envoy does not have.
+	Missing []string `json:"missing,omitempty"`
+	// Extra lists resources that Envoy has, but that ekglue is not serving.
+	Extra []string `json:"extra,omitempty"`
+	// Different maps the names of resources that both sides have, but that differ, to a
+	// description of the difference ("-" is ekglue, "+" is Envoy).
+	Different map[string]string `json:"different,omitempty"`
+}
+
+// Empty returns true if there are no differences.
+func (d *ResourceDiff) Empty() bool {
+	return len(d.Missing) == 0 && len(d.Extra) == 0 && len(d.Different) == 0
+}
+
+// configDump is the subset of Envoy's admin.v3.ConfigDump that we compare.  We read it as plain
+// JSON, rather than as protos, because Envoy's dump contains typed configs for extensions that
+// aren't linked into ekglue.
+type configDump struct {
+	Configs []struct {
+		DynamicActiveClusters  []struct{ Cluster json.RawMessage } `json:"dynamic_active_clusters"`
+		DynamicWarmingClusters []struct{ Cluster json.RawMessage } `json:"dynamic_warming_clusters"`
+		DynamicEndpointConfigs []struct {
+			EndpointConfig json.RawMessage `json:"endpoint_config"`
+		} `json:"dynamic_endpoint_configs"`
+		DynamicListeners []struct {
+			ActiveState  *struct{ Listener json.RawMessage } `json:"active_state"`
+			WarmingState *struct{ Listener json.RawMessage } `json:"warming_state"`
+		} `json:"dynamic_listeners"`
+		DynamicRouteConfigs []struct {
+			RouteConfig json.RawMessage `json:"route_config"`
+		} `json:"dynamic_route_configs"`
+	} `json:"configs"`
+}
+
+// resources returns the resources in the dump, keyed by manager name and then resource name.
+func (d *configDump) resources() (map[string]map[string]interface{}, error) {
+	result := map[string]map[string]interface{}{
+		"clusters":  {},
+		"endpoints": {},
+		"listeners": {},
+		"routes":    {},
+	}
+	add := func(kind string, raw json.RawMessage) error {
+		if len(raw) == 0 {
+			return nil
+		}
+		var r map[string]interface{}
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return fmt.Errorf("unmarshal %s: %w", kind, err)
+		}
+		delete(r, "@type")
+		name, _ := r["name"].(string)
+		if kind == "endpoints" {
+			name, _ = r["cluster_name"].(string)
+		}
+		result[kind][name] = r
+		return nil
+	}
+	for _, c := range d.Configs {
+		for _, x := range c.DynamicWarmingClusters {
+			if err := add("clusters", x.Cluster); err != nil {
+				return nil, err
+			}
+		}
+		for _, x := range c.DynamicActiveClusters {
+			if err := add("clusters", x.Cluster); err != nil {
+				return nil, err
+			}
+		}
+		for _, x := range c.DynamicEndpointConfigs {
+			if err := add("endpoints", x.EndpointConfig); err != nil {
+				return nil, err
+			}
+		}
+		for _, x := range c.DynamicListeners {
+			if x.WarmingState != nil {
+				if err := add("listeners", x.WarmingState.Listener); err != nil {
+					return nil, err
+				}
+			}
+			if x.ActiveState != nil {
+				if err := add("listeners", x.ActiveState.Listener); err != nil {
+					return nil, err
+				}
+			}
+		}
+		for _, x := range c.DynamicRouteConfigs {
+			if err := add("routes", x.RouteConfig); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// endpointAddresses returns the sorted addresses in a JSON ClusterLoadAssignment.  Envoy rebuilds
+// the load assignments in its config dump from its own host sets, adding defaults and health
+// information along the way, so only the addresses are worth comparing.
+func endpointAddresses(cla interface{}) []string {
+	var result []string
+	m, _ := cla.(map[string]interface{})
+	localities, _ := m["endpoints"].([]interface{})
+	for _, l := range localities {
+		l, _ := l.(map[string]interface{})
+		lbEndpoints, _ := l["lb_endpoints"].([]interface{})
+		for _, e := range lbEndpoints {
+			e, _ := e.(map[string]interface{})
+			ep, _ := e["endpoint"].(map[string]interface{})
+			addr, _ := ep["address"].(map[string]interface{})
+			sa, _ := addr["socket_address"].(map[string]interface{})
+			result = append(result, fmt.Sprintf("%v:%v", sa["address"], sa["port_value"]))
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// nameOf returns the name of a resource.
+func nameOf(r xds.Resource) string {
+	if x, ok := r.(interface{ GetClusterName() string }); ok {
+		return x.GetClusterName()
+	}
+	return r.(interface{ GetName() string }).GetName()
+}
+
+// diffManager compares the resources served by m to the resources in an Envoy's config dump.
+//
+// Envoy asks for clusters and listeners by wildcard, so it should have exactly what we serve.  It
+// only asks for the endpoints and routes that its clusters and listeners refer to, and may get
+// some from other places, so those are only compared when both sides have them.
+func diffManager(m *xds.Manager, envoy map[string]interface{}) (*ResourceDiff, error) {
+	wildcard := m.Name == "clusters" || m.Name == "listeners"
+	jsonm := &protojson.MarshalOptions{UseProtoNames: true}
+	result := &ResourceDiff{Different: make(map[string]string)}
+	ours := make(map[string]bool)
+	for _, r := range m.List() {
+		name := nameOf(r)
+		ours[name] = true
+		theirs, ok := envoy[name]
+		if !ok {
+			if wildcard {
+				result.Missing = append(result.Missing, name)
+			}
+			continue
+		}
+		js, err := jsonm.Marshal(r)
+		if err != nil {
+			return nil, fmt.Errorf("marshal %s %q: %w", m.Name, name, err)
+		}
+		var want interface{}
+		if err := json.Unmarshal(js, &want); err != nil {
+			return nil, fmt.Errorf("unmarshal %s %q: %w", m.Name, name, err)
+		}
+		if m.Name == "endpoints" {
+			want, theirs = endpointAddresses(want), endpointAddresses(theirs)
+		}
+		if diff := cmp.Diff(want, theirs); diff != "" {
+			result.Different[name] = diff
+		}
+	}
+	if wildcard {
+		for name := range envoy {
+			if !ours[name] {
+				result.Extra = append(result.Extra, name)
+			}
+		}
+		sort.Strings(result.Extra)
+	}
+	return result, nil
+}
+
+// DiffConfigDump compares the JSON output of an Envoy's /config_dump admin endpoint to the
+// resources being served, returning a ResourceDiff for each manager, keyed by manager name.
+// Resources that Envoy got from somewhere other than xDS are not considered.
+func (s *Server) DiffConfigDump(dump []byte) (map[string]*ResourceDiff, error) {
+	d := new(configDump)
+	if err := json.Unmarshal(dump, d); err != nil {
+		return nil, fmt.Errorf("unmarshal config dump: %w", err)
+	}
+	envoy, err := d.resources()
+	if err != nil {
+		return nil, fmt.Errorf("read config dump: %w", err)
+	}
+	result := make(map[string]*ResourceDiff)
+	for _, m := range s.managers() {
+		diff, err := diffManager(m, envoy[m.Name])
+		if err != nil {
+			return nil, err
+		}
+		result[m.Name] = diff
+	}
+	return result, nil
+}
+
+// FetchConfigDump retrieves the config dump, including endpoints, from the Envoy admin interface
+// at the provided address.
+func FetchConfigDump(ctx context.Context, admin string) ([]byte, error) {
+	if !strings.Contains(admin, "://") {
+		admin = "http://" + admin
+	}
+	u, err := url.Parse(admin)
+	if err != nil {
+		return nil, fmt.Errorf("parse admin address: %w", err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/config_dump"
+	u.RawQuery = "include_eds"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch config dump: %w", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read config dump: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch config dump: unexpected status %s: %s", res.Status, body)
+	}
+	return body, nil
+}
+
+// adminAddress returns the admin address advertised by the connected node with the provided ID.
+func (s *Server) adminAddress(id string) (string, error) {
+	for _, m := range s.managers() {
+		n := m.Node(id)
+		if n == nil {
+			continue
+		}
+		if v, ok := n.GetMetadata().GetFields()[AdminAddressMetadataKey]; ok && v.GetStringValue() != "" {
+			return v.GetStringValue(), nil
+		}
+		return "", fmt.Errorf("node %q has no %q metadata", id, AdminAddressMetadataKey)
+	}
+	return "", fmt.Errorf("node %q is not connected", id)
+}
+
+// ServeConfigDiff is an http.Handler that fetches an Envoy's config dump and reports how it differs
+// from the resources being served, as YAML.  The Envoy is selected with either an "admin" query
+// parameter containing its admin address, or a "node" query parameter containing the ID of a
+// connected node that advertises its admin address in its metadata (see AdminAddressMetadataKey).
+func (s *Server) ServeConfigDiff(w http.ResponseWriter, req *http.Request) {
+	admin := req.FormValue("admin")
+	if node := req.FormValue("node"); admin == "" && node != "" {
+		var err error
+		if admin, err = s.adminAddress(node); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+	if admin == "" {
+		http.Error(w, "one of the admin or node parameters is required", http.StatusBadRequest)
+		return
+	}
+	ctx, c := context.WithTimeout(req.Context(), 10*time.Second)
+	defer c()
+	dump, err := FetchConfigDump(ctx, admin)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	diff, err := s.DiffConfigDump(dump)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	ya, err := yaml.Marshal(diff)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(ya)
+}
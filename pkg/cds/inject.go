@@ -0,0 +1,268 @@
+package cds
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// ExternalPrefix starts the name of every resource injected through an Injector, so that injected
+// resources can't collide with generated ones.  Stores that replace their resources wholesale must
+// be told to leave these alone; see glue.Stores.Exclude.
+const ExternalPrefix = "external:"
+
+// maxInjectRequestBytes limits the size of an inject request body.
+const maxInjectRequestBytes = 16 << 20
+
+// InjectRequest is a set of changes to injected resources, applied together like a Txn.  Every
+// name must start with ExternalPrefix.
+type InjectRequest struct {
+	// Clusters and Endpoints are added, or replace the injected resources of the same name.
+	Clusters  []*envoy_config_cluster_v3.Cluster
+	Endpoints []*envoy_config_endpoint_v3.ClusterLoadAssignment
+	// DeleteClusters and DeleteEndpoints name injected resources to remove.
+	DeleteClusters  []string
+	DeleteEndpoints []string
+}
+
+type rawInjectRequest struct {
+	Clusters        []json.RawMessage `json:"clusters,omitempty"`
+	Endpoints       []json.RawMessage `json:"endpoints,omitempty"`
+	DeleteClusters  []string          `json:"delete_clusters,omitempty"`
+	DeleteEndpoints []string          `json:"delete_endpoints,omitempty"`
+}
+
+func (r *InjectRequest) MarshalJSON() ([]byte, error) {
+	tmp := &rawInjectRequest{DeleteClusters: r.DeleteClusters, DeleteEndpoints: r.DeleteEndpoints}
+	for _, c := range r.Clusters {
+		js, err := protojson.Marshal(c)
+		if err != nil {
+			return nil, fmt.Errorf("InjectRequest: marshal cluster %q: %w", c.GetName(), err)
+		}
+		tmp.Clusters = append(tmp.Clusters, js)
+	}
+	for _, e := range r.Endpoints {
+		js, err := protojson.Marshal(e)
+		if err != nil {
+			return nil, fmt.Errorf("InjectRequest: marshal endpoints %q: %w", e.GetClusterName(), err)
+		}
+		tmp.Endpoints = append(tmp.Endpoints, js)
+	}
+	return json.Marshal(tmp)
+}
+
+func (r *InjectRequest) UnmarshalJSON(b []byte) error {
+	tmp := new(rawInjectRequest)
+	if err := json.Unmarshal(b, tmp); err != nil {
+		return fmt.Errorf("InjectRequest: unmarshal into temporary structure: %w", err)
+	}
+	*r = InjectRequest{DeleteClusters: tmp.DeleteClusters, DeleteEndpoints: tmp.DeleteEndpoints}
+	for i, js := range tmp.Clusters {
+		c := new(envoy_config_cluster_v3.Cluster)
+		if err := protojson.Unmarshal(js, c); err != nil {
+			return fmt.Errorf("InjectRequest: unmarshal cluster %d: %w", i, err)
+		}
+		r.Clusters = append(r.Clusters, c)
+	}
+	for i, js := range tmp.Endpoints {
+		e := new(envoy_config_endpoint_v3.ClusterLoadAssignment)
+		if err := protojson.Unmarshal(js, e); err != nil {
+			return fmt.Errorf("InjectRequest: unmarshal endpoints %d: %w", i, err)
+		}
+		r.Endpoints = append(r.Endpoints, e)
+	}
+	return nil
+}
+
+// names returns every name that the request touches.
+func (r *InjectRequest) names() []string {
+	var result []string
+	for _, c := range r.Clusters {
+		result = append(result, c.GetName())
+	}
+	for _, e := range r.Endpoints {
+		result = append(result, e.GetClusterName())
+	}
+	result = append(result, r.DeleteClusters...)
+	return append(result, r.DeleteEndpoints...)
+}
+
+// InjectedResources lists the names of the injected resources being served.
+type InjectedResources struct {
+	Clusters  []string `json:"clusters"`
+	Endpoints []string `json:"endpoints"`
+}
+
+// ErrUnauthorized is returned by an InjectClient when the server rejects its token.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Injector lets external systems add and remove clusters and load assignments, like temporary
+// clusters for draining traffic, without a config change or a Kubernetes object.  It serves an
+// HTTP API, authenticated with bearer tokens, that InjectClient talks to.
+type Injector struct {
+	// Server is the server to inject resources into.
+	Server *Server
+	// Tokens are the bearer tokens that may use the HTTP API.  If empty, every request is
+	// rejected.
+	Tokens []string
+}
+
+// Inject validates and applies the changes in req, all or nothing.
+func (i *Injector) Inject(ctx context.Context, req *InjectRequest) error {
+	for _, name := range req.names() {
+		if !strings.HasPrefix(name, ExternalPrefix) {
+			return fmt.Errorf("resource name %q: injected resource names must start with %q", name, ExternalPrefix)
+		}
+	}
+	txn := i.Server.Begin()
+	txn.AddClusters(req.Clusters...)
+	txn.AddEndpoints(req.Endpoints...)
+	for _, name := range req.DeleteClusters {
+		txn.DeleteCluster(name)
+	}
+	for _, name := range req.DeleteEndpoints {
+		txn.DeleteEndpoints(name)
+	}
+	return txn.Commit(ctx)
+}
+
+// Injected returns the names of the injected resources being served, sorted.
+func (i *Injector) Injected() *InjectedResources {
+	injected := func(names []string) []string {
+		result := []string{}
+		for _, name := range names {
+			if strings.HasPrefix(name, ExternalPrefix) {
+				result = append(result, name)
+			}
+		}
+		sort.Strings(result)
+		return result
+	}
+	return &InjectedResources{
+		Clusters:  injected(i.Server.Clusters.ListKeys()),
+		Endpoints: injected(i.Server.Endpoints.ListKeys()),
+	}
+}
+
+// authorized returns true if the request carries one of the tokens.
+func (i *Injector) authorized(req *http.Request) bool {
+	token, ok := strings.CutPrefix(req.Header.Get("authorization"), "Bearer ")
+	if !ok || token == "" {
+		return false
+	}
+	var match bool
+	for _, t := range i.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			match = true
+		}
+	}
+	return match
+}
+
+// ServeHTTP serves the inject API.  A GET returns the InjectedResources as JSON, and a POST applies
+// the InjectRequest in its JSON body.  Both require an "Authorization: Bearer <token>" header with
+// one of the Tokens.
+func (i *Injector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !i.authorized(req) {
+		w.Header().Set("www-authenticate", `Bearer realm="ekglue"`)
+		http.Error(w, "missing or invalid bearer token", http.StatusUnauthorized)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		r := new(InjectRequest)
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxInjectRequestBytes)).Decode(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := i.Inject(req.Context(), r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	js, err := json.Marshal(i.Injected())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+}
+
+// InjectClient is a client of an Injector's HTTP API.
+type InjectClient struct {
+	// URL is the URL that the Injector is served at, like "http://ekglue:8081/inject".
+	URL string
+	// Token is the bearer token to authenticate with.
+	Token string
+	// Client is the HTTP client to use; if nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// do sends a request with the JSON body and returns the injected resources in the response.
+func (c *InjectClient) do(ctx context.Context, method string, body []byte) (*InjectedResources, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Set("authorization", "Bearer "+c.Token)
+	if body != nil {
+		req.Header.Set("content-type", "application/json")
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+	switch {
+	case res.StatusCode == http.StatusUnauthorized:
+		return nil, ErrUnauthorized
+	case res.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("unexpected status %s: %s", res.Status, bytes.TrimSpace(b))
+	}
+	result := new(InjectedResources)
+	if err := json.Unmarshal(b, result); err != nil {
+		return nil, fmt.Errorf("unmarshal response: %w", err)
+	}
+	return result, nil
+}
+
+// Inject applies the changes in req, all or nothing, and returns the injected resources that are
+// being served afterwards.
+func (c *InjectClient) Inject(ctx context.Context, req *InjectRequest) (*InjectedResources, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+	return c.do(ctx, http.MethodPost, body)
+}
+
+// List returns the injected resources being served.
+func (c *InjectClient) List(ctx context.Context) (*InjectedResources, error) {
+	return c.do(ctx, http.MethodGet, nil)
+}
@@ -0,0 +1,71 @@
+package cds
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	loadstatsservice "github.com/envoyproxy/go-control-plane/envoy/service/load_stats/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+var (
+	lrsClientsStreaming = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ekglue_lrs_active_stream_count",
+		Help: "The number of clients connected and streaming load reports.",
+	})
+	lrsReports = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ekglue_lrs_reports",
+		Help: "The number of load reports received.",
+	})
+)
+
+// LoadReports configures the load reporting service (LRS).  Clients are asked to report the load
+// they send to every cluster, every Interval, and each report is passed to Record.
+type LoadReports struct {
+	Interval time.Duration
+	Record   func(node *envoy_config_core_v3.Node, stats []*envoy_config_endpoint_v3.ClusterStats)
+}
+
+// StreamLoadStats implements LRS.  If the server's LoadReports are not configured, clients are
+// told not to report anything.
+func (s *Server) StreamLoadStats(stream loadstatsservice.LoadReportingService_StreamLoadStatsServer) error {
+	lrsClientsStreaming.Inc()
+	defer lrsClientsStreaming.Dec()
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	node := req.GetNode()
+	lr := s.LoadReports
+	if lr == nil || lr.Record == nil {
+		// An empty response, with no clusters, stops the client from reporting.
+		if err := stream.Send(new(loadstatsservice.LoadStatsResponse)); err != nil {
+			return err
+		}
+	} else if err := stream.Send(&loadstatsservice.LoadStatsResponse{
+		SendAllClusters:       true,
+		LoadReportingInterval: durationpb.New(lr.Interval),
+	}); err != nil {
+		return err
+	}
+	for {
+		// The first request carries no stats; every later one does, and only the first carries
+		// the node.
+		if lr != nil && lr.Record != nil && len(req.GetClusterStats()) > 0 {
+			lrsReports.Inc()
+			lr.Record(node, req.GetClusterStats())
+		}
+		req, err = stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
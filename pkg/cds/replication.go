@@ -0,0 +1,210 @@
+package cds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
+	discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	listenerservice "github.com/envoyproxy/go-control-plane/envoy/service/listener/v3"
+	routeservice "github.com/envoyproxy/go-control-plane/envoy/service/route/v3"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"github.com/jrockway/ekglue/pkg/xds"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// ledgerMethod is the full name of the gRPC method that serves a server's ack ledger.  The service
+// is defined by hand, with well-known types as messages, so that it needs no generated code.
+const ledgerMethod = "/ekglue.Replication/Ledger"
+
+// replicationServiceDesc describes the ekglue.Replication gRPC service.  Its Ledger method takes a
+// google.protobuf.Empty and returns a google.protobuf.Struct mapping each manager name to a list
+// of xds.LedgerEntry objects.
+var replicationServiceDesc = grpc.ServiceDesc{
+	ServiceName: "ekglue.Replication",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Ledger",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := new(emptypb.Empty)
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			s := srv.(*Server)
+			if interceptor == nil {
+				return s.ledgerStruct()
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: ledgerMethod}
+			return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return s.ledgerStruct()
+			})
+		},
+	}},
+	Metadata: "ekglue",
+}
+
+// RegisterReplicationServer registers the ekglue.Replication service, which another ekglue taking
+// over from this one uses to import the ack ledger; see Import.
+func RegisterReplicationServer(g *grpc.Server, s *Server) {
+	g.RegisterService(&replicationServiceDesc, s)
+}
+
+// Ledger returns the ledger of each resource type, keyed by manager name.
+func (s *Server) Ledger() map[string][]*xds.LedgerEntry {
+	result := make(map[string][]*xds.LedgerEntry)
+	for _, m := range s.managers() {
+		result[m.Name] = m.Ledger()
+	}
+	return result
+}
+
+// ledgerStruct returns the ledger as a Struct, for the Ledger RPC.
+func (s *Server) ledgerStruct() (*structpb.Struct, error) {
+	js, err := json.Marshal(s.Ledger())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "marshal ledger: %v", err)
+	}
+	result := new(structpb.Struct)
+	if err := protojson.Unmarshal(js, result); err != nil {
+		return nil, status.Errorf(codes.Internal, "convert ledger: %v", err)
+	}
+	return result, nil
+}
+
+// FetchLedger fetches the ledger of the ekglue at the other end of cc, keyed by manager name.
+func FetchLedger(ctx context.Context, cc grpc.ClientConnInterface) (map[string][]*xds.LedgerEntry, error) {
+	out := new(structpb.Struct)
+	if err := cc.Invoke(ctx, ledgerMethod, new(emptypb.Empty), out); err != nil {
+		return nil, fmt.Errorf("fetch ledger: %w", err)
+	}
+	js, err := protojson.Marshal(out)
+	if err != nil {
+		return nil, fmt.Errorf("convert ledger: %w", err)
+	}
+	result := make(map[string][]*xds.LedgerEntry)
+	if err := json.Unmarshal(js, &result); err != nil {
+		return nil, fmt.Errorf("unmarshal ledger: %w", err)
+	}
+	return result, nil
+}
+
+// Import copies the resources and ack ledger of the ekglue at the other end of cc, which is being
+// replaced by this one, identifying itself as node.  Once the old server hands its clients off
+// (see HandOff), they reconnect here and find the same resources, so nothing in the fleet is reset
+// while this server's own sources catch up; the ledger tells RolloutStatus what each of them was
+// running.  Both servers should use DigestVersions, so that reconnecting clients see the versions
+// they already have.
+func (s *Server) Import(ctx context.Context, cc grpc.ClientConnInterface, node *envoy_config_core_v3.Node) error {
+	fetch := map[*xds.Manager]func(context.Context, *discovery_v3.DiscoveryRequest, ...grpc.CallOption) (*discovery_v3.DiscoveryResponse, error){
+		s.Clusters:  clusterservice.NewClusterDiscoveryServiceClient(cc).FetchClusters,
+		s.Endpoints: endpointservice.NewEndpointDiscoveryServiceClient(cc).FetchEndpoints,
+		s.Listeners: listenerservice.NewListenerDiscoveryServiceClient(cc).FetchListeners,
+		s.Routes:    routeservice.NewRouteDiscoveryServiceClient(cc).FetchRoutes,
+	}
+	for _, m := range s.managers() {
+		res, err := fetch[m](ctx, &discovery_v3.DiscoveryRequest{Node: node, TypeUrl: m.Type})
+		if status.Code(err) == codes.Unavailable {
+			// Not served by the old server; leave the manager alone.
+			ctxzap.Extract(ctx).Info("not importing disabled resource type", zap.String("manager", m.Name), zap.Error(err))
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("fetch %s: %w", m.Name, err)
+		}
+		if err := m.ReplaceWithResponse(ctx, res); err != nil {
+			return fmt.Errorf("import %s: %w", m.Name, err)
+		}
+	}
+	ledger, err := FetchLedger(ctx, cc)
+	if err != nil {
+		return err
+	}
+	for _, m := range s.managers() {
+		m.ImportLedger(ledger[m.Name])
+	}
+	return nil
+}
+
+// HandOff gradually closes every open stream, batch streams of each resource type every interval,
+// so that clients reconnect to the server taking over from this one, without all of them
+// reconnecting at once.  Once it starts, new streams are refused with UNAVAILABLE, so something
+// in front of the servers (or the client's own list of servers) must send reconnecting clients to
+// the new server.  It returns when no streams are left or the context is done.
+func (s *Server) HandOff(ctx context.Context, batch int, interval time.Duration) error {
+	if batch < 1 {
+		batch = 1
+	}
+	s.handingOff.Store(true)
+	l := ctxzap.Extract(ctx)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		var closed, open int
+		for _, m := range s.managers() {
+			closed += m.HandOff(batch)
+			open += m.OpenStreams()
+		}
+		l.Info("handing off clients", zap.Int("closed", closed), zap.Int("remaining", open))
+		if open == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// ServeHandOff is an http.Handler that reports the number of open streams of each resource type,
+// and whether the server is handing its clients off, as YAML.  A POST starts handing clients off
+// in the background, closing "batch" streams (default 10) of each type every "interval" (default
+// 1s).
+func (s *Server) ServeHandOff(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost && !s.handingOff.Load() {
+		batch, interval := 10, time.Second
+		if v := req.FormValue("batch"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				http.Error(w, fmt.Sprintf("invalid batch %q", v), http.StatusBadRequest)
+				return
+			}
+			batch = n
+		}
+		if v := req.FormValue("interval"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, fmt.Sprintf("invalid interval %q", v), http.StatusBadRequest)
+				return
+			}
+			interval = d
+		}
+		ctx := ctxzap.ToContext(context.Background(), zap.L().Named("handoff"))
+		s.handingOff.Store(true)
+		go func() {
+			if err := s.HandOff(ctx, batch, interval); err != nil {
+				ctxzap.Extract(ctx).Error("hand off ended early", zap.Error(err))
+			}
+		}()
+	}
+	open := make(map[string]int)
+	for _, m := range s.managers() {
+		open[m.Name] = m.OpenStreams()
+	}
+	writeYAML(w, map[string]interface{}{
+		"handing_off":  s.handingOff.Load(),
+		"open_streams": open,
+	})
+}
@@ -0,0 +1,102 @@
+package cds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/jrockway/ekglue/pkg/xds"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// RESTPathPrefix starts the path of each REST discovery endpoint, which ends with the name of a
+// manager, like "/v3/discovery:clusters".
+const RESTPathPrefix = "/v3/discovery:"
+
+// maxFetchRequestBytes limits the size of a REST discovery request body.
+const maxFetchRequestBytes = 4 << 20
+
+// fetch answers a unary discovery request for m, once the server is ready.
+func (s *Server) fetch(ctx context.Context, m *xds.Manager, req *discovery_v3.DiscoveryRequest) (*discovery_v3.DiscoveryResponse, error) {
+	if err := s.waitReady(ctx); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return m.Fetch(ctx, req)
+}
+
+// FetchClusters implements REST-style CDS over gRPC.
+func (s *Server) FetchClusters(ctx context.Context, req *discovery_v3.DiscoveryRequest) (*discovery_v3.DiscoveryResponse, error) {
+	return s.fetch(ctx, s.Clusters, req)
+}
+
+// FetchEndpoints implements REST-style EDS over gRPC.
+func (s *Server) FetchEndpoints(ctx context.Context, req *discovery_v3.DiscoveryRequest) (*discovery_v3.DiscoveryResponse, error) {
+	return s.fetch(ctx, s.Endpoints, req)
+}
+
+// FetchListeners implements REST-style LDS over gRPC.
+func (s *Server) FetchListeners(ctx context.Context, req *discovery_v3.DiscoveryRequest) (*discovery_v3.DiscoveryResponse, error) {
+	return s.fetch(ctx, s.Listeners, req)
+}
+
+// FetchRoutes implements REST-style RDS over gRPC.
+func (s *Server) FetchRoutes(ctx context.Context, req *discovery_v3.DiscoveryRequest) (*discovery_v3.DiscoveryResponse, error) {
+	return s.fetch(ctx, s.Routes, req)
+}
+
+// ServeREST is an http.Handler that implements the xDS REST protocol, for Envoy instances
+// configured with api_type REST and other clients that poll: a POST to RESTPathPrefix followed by
+// a manager name, like "/v3/discovery:clusters", with a JSON DiscoveryRequest body, returns a JSON
+// DiscoveryResponse, or 304 Not Modified if the request's version_info is current.
+func (s *Server) ServeREST(w http.ResponseWriter, req *http.Request) {
+	name, ok := strings.CutPrefix(req.URL.Path, RESTPathPrefix)
+	m := s.manager(name)
+	if !ok || m == nil {
+		http.Error(w, fmt.Sprintf("no discovery endpoint %q; expected %s followed by clusters, endpoints, listeners, or routes", req.URL.Path, RESTPathPrefix), http.StatusNotFound)
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.Header().Set("allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxFetchRequestBytes))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("read request: %v", err), http.StatusBadRequest)
+		return
+	}
+	dreq := new(discovery_v3.DiscoveryRequest)
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(body, dreq); err != nil {
+		http.Error(w, fmt.Sprintf("unmarshal request: %v", err), http.StatusBadRequest)
+		return
+	}
+	res, err := s.fetch(req.Context(), m, dreq)
+	if errors.Is(err, xds.ErrNotModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	} else if err != nil {
+		code := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.Unavailable:
+			code = http.StatusServiceUnavailable
+		case codes.InvalidArgument:
+			code = http.StatusBadRequest
+		}
+		http.Error(w, status.Convert(err).Message(), code)
+		return
+	}
+	js, err := protojson.Marshal(res)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("marshal response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+}
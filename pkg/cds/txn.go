@@ -0,0 +1,94 @@
+package cds
+
+import (
+	"context"
+	"fmt"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+)
+
+// Txn is a set of related cluster and endpoint changes that are applied together.  Create one with
+// Server.Begin, stage changes, then call Commit.  A Txn is not safe for concurrent use.
+type Txn struct {
+	s               *Server
+	clusters        []*envoy_config_cluster_v3.Cluster
+	deleteClusters  []string
+	endpoints       []*envoy_config_endpoint_v3.ClusterLoadAssignment
+	deleteEndpoints []string
+}
+
+// Begin starts a transaction.
+func (s *Server) Begin() *Txn {
+	return &Txn{s: s}
+}
+
+// AddClusters stages adding or updating clusters.
+func (t *Txn) AddClusters(cs ...*envoy_config_cluster_v3.Cluster) {
+	t.clusters = append(t.clusters, cs...)
+}
+
+// DeleteCluster stages deleting a cluster.
+func (t *Txn) DeleteCluster(name string) {
+	t.deleteClusters = append(t.deleteClusters, name)
+}
+
+// AddEndpoints stages adding or updating load assignments.
+func (t *Txn) AddEndpoints(es ...*envoy_config_endpoint_v3.ClusterLoadAssignment) {
+	t.endpoints = append(t.endpoints, es...)
+}
+
+// DeleteEndpoints stages deleting a load assignment.
+func (t *Txn) DeleteEndpoints(name string) {
+	t.deleteEndpoints = append(t.deleteEndpoints, name)
+}
+
+// Commit validates every staged change, and then, if they are all valid, applies them in an order
+// that never leaves a client with a cluster that can't get endpoints:
+//
+//  1. added or updated load assignments,
+//  2. added, updated, and deleted clusters,
+//  3. deleted load assignments.
+//
+// Each manager's changes are sent to clients as a single new version.  Commits are serialized, so
+// concurrent transactions don't interleave.  If validation fails, or the changes would exceed
+// either manager's MaxResources, nothing is changed.  The quotas are checked before anything is
+// applied, but changes made outside of transactions, like those of the glue stores, aren't
+// serialized with commits; if one of them uses up a quota in between, the clusters are rejected
+// after their load assignments have been applied, as if they had been applied separately.
+func (t *Txn) Commit(ctx context.Context) error {
+	clusters, endpoints := toResources(t.clusters), toResources(t.endpoints)
+	if err := t.s.Clusters.Validate(clusters); err != nil {
+		return fmt.Errorf("validate clusters: %w", err)
+	}
+	if err := t.s.Endpoints.Validate(endpoints); err != nil {
+		return fmt.Errorf("validate endpoints: %w", err)
+	}
+	t.s.txnMu.Lock()
+	defer t.s.txnMu.Unlock()
+	// Check both quotas before changing anything, so that clusters that don't fit don't leave
+	// their load assignments behind.  Load assignments are added before any are deleted, so the
+	// deletions don't make room for the additions.
+	if err := t.s.Endpoints.CheckQuota(endpoints, nil); err != nil {
+		return fmt.Errorf("apply endpoints: %w", err)
+	}
+	if err := t.s.Clusters.CheckQuota(clusters, t.deleteClusters); err != nil {
+		return fmt.Errorf("apply clusters: %w", err)
+	}
+	if len(endpoints) > 0 {
+		if err := t.s.Endpoints.Apply(ctx, endpoints, nil); err != nil {
+			return fmt.Errorf("apply endpoints: %w", err)
+		}
+	}
+	if len(clusters) > 0 || len(t.deleteClusters) > 0 {
+		if err := t.s.Clusters.Apply(ctx, clusters, t.deleteClusters); err != nil {
+			return fmt.Errorf("apply clusters: %w", err)
+		}
+	}
+	if len(t.deleteEndpoints) > 0 {
+		if err := t.s.Endpoints.Apply(ctx, nil, t.deleteEndpoints); err != nil {
+			return fmt.Errorf("delete endpoints: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package glue
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var admissionReviews = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ekglue_admission_reviews",
+	Help: "The number of admission reviews of services, by result.",
+}, []string{"result"})
+
+// AdmissionHandler returns a validating admission webhook that rejects services that the config
+// returned by config can't translate, like ones with malformed override annotations, so that a
+// mistake is reported to whoever applied the service instead of only appearing in ekglue's logs.
+// Objects other than services, and deletions, are always allowed.
+func AdmissionHandler(config func() *Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		review := new(admissionv1.AdmissionReview)
+		if err := json.NewDecoder(req.Body).Decode(review); err != nil {
+			admissionReviews.WithLabelValues("bad_request").Inc()
+			http.Error(w, fmt.Sprintf("decode admission review: %v", err), http.StatusBadRequest)
+			return
+		}
+		if review.Request == nil {
+			admissionReviews.WithLabelValues("bad_request").Inc()
+			http.Error(w, "admission review has no request", http.StatusBadRequest)
+			return
+		}
+		review.Response = &admissionv1.AdmissionResponse{UID: review.Request.UID, Allowed: true}
+		if err := reviewService(config(), review.Request); err != nil {
+			admissionReviews.WithLabelValues("denied").Inc()
+			Logger.Info("denying service", zap.String("namespace", review.Request.Namespace), zap.String("name", review.Request.Name), zap.Error(err))
+			review.Response.Allowed = false
+			review.Response.Result = &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Message: err.Error(),
+				Reason:  metav1.StatusReasonInvalid,
+				Code:    http.StatusUnprocessableEntity,
+			}
+		} else {
+			admissionReviews.WithLabelValues("allowed").Inc()
+		}
+		review.Request = nil
+		w.Header().Set("content-type", "application/json")
+		if err := json.NewEncoder(w).Encode(review); err != nil {
+			Logger.Debug("problem writing admission response", zap.Error(err))
+		}
+	})
+}
+
+// reviewService returns an error if the object in req is a service that cfg can't translate.
+func reviewService(cfg *Config, req *admissionv1.AdmissionRequest) error {
+	if req.Kind.Kind != "Service" || req.Operation == admissionv1.Delete {
+		return nil
+	}
+	svc := new(v1.Service)
+	if err := json.Unmarshal(req.Object.Raw, svc); err != nil {
+		return fmt.Errorf("decode service: %w", err)
+	}
+	if svc.Namespace == "" {
+		// The namespace is only sometimes filled in on create.
+		svc.Namespace = req.Namespace
+	}
+	if cfg.ClusterConfig == nil {
+		return nil
+	}
+	return cfg.CheckService(svc)
+}
@@ -0,0 +1,220 @@
+package glue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"golang.org/x/exp/maps"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Aggregate merges the endpoints of every service matching a label selector into a single EDS
+// cluster, for consumers that want one logical upstream spanning several services.  The
+// per-service clusters are still generated; suppress them with an override if they are unwanted.
+//
+// Endpoints are selected by the labels on their EndpointSlices, which Kubernetes copies from the
+// owning service.
+type Aggregate struct {
+	// Name is the name of the generated cluster.  It is used as-is.
+	Name string `json:"name"`
+	// Selector selects services by label.  It must not be empty.
+	Selector map[string]string `json:"selector"`
+	// Namespaces, if non-empty, limits the aggregate to services in these namespaces.
+	Namespaces []string `json:"namespaces"`
+	// PortName selects the ports of each service to include.  If empty, all ports are included.
+	PortName string `json:"port_name"`
+	// Override is merged into the cluster config's base to produce the aggregate cluster.  The
+	// cluster is always of type EDS; if no eds_cluster_config is provided, EDS over ADS is used.
+	Override *envoy_config_cluster_v3.Cluster `json:"override"`
+
+	selector labels.Selector
+}
+
+func (a *Aggregate) UnmarshalJSON(b []byte) error {
+	tmp := struct {
+		Name       string            `json:"name"`
+		Selector   map[string]string `json:"selector"`
+		Namespaces []string          `json:"namespaces"`
+		PortName   string            `json:"port_name"`
+		Override   json.RawMessage   `json:"override"`
+	}{}
+	if err := json.Unmarshal(b, &tmp); err != nil {
+		return fmt.Errorf("Aggregate: unmarshal into temporary structure: %w", err)
+	}
+	if tmp.Name == "" {
+		return fmt.Errorf("Aggregate: name is required")
+	}
+	if len(tmp.Selector) == 0 {
+		return fmt.Errorf("Aggregate %q: selector is required", tmp.Name)
+	}
+	selector, err := labels.ValidatedSelectorFromSet(tmp.Selector)
+	if err != nil {
+		return fmt.Errorf("Aggregate %q: selector: %w", tmp.Name, err)
+	}
+	a.Name, a.Selector, a.Namespaces, a.PortName = tmp.Name, tmp.Selector, tmp.Namespaces, tmp.PortName
+	a.selector = selector
+	if len(tmp.Override) > 0 {
+		o := &envoy_config_cluster_v3.Cluster{}
+		if err := protojson.Unmarshal(tmp.Override, o); err != nil {
+			return fmt.Errorf("Aggregate %q: unmarshal override: %w", tmp.Name, err)
+		}
+		a.Override = o
+	}
+	return nil
+}
+
+// matches returns true if an object with the provided namespace and labels belongs to the
+// aggregate.
+func (a *Aggregate) matches(namespace string, objLabels map[string]string) bool {
+	if len(a.Namespaces) > 0 {
+		var ok bool
+		for _, ns := range a.Namespaces {
+			if ns == namespace {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	s := a.selector
+	if s == nil {
+		s = labels.SelectorFromSet(a.Selector)
+	}
+	return s.Matches(labels.Set(objLabels))
+}
+
+// matchesPort returns true if the named port belongs to the aggregate.
+func (a *Aggregate) matchesPort(name string) bool {
+	return a.PortName == "" || a.PortName == name
+}
+
+// includesService returns true if svc contributes any ports to the aggregate.
+func (a *Aggregate) includesService(svc *v1.Service) bool {
+	if !a.matches(svc.GetNamespace(), svc.GetLabels()) {
+		return false
+	}
+	for _, port := range svc.Spec.Ports {
+		if a.matchesPort(port.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// cluster returns the aggregate cluster, built on top of base.
+func (a *Aggregate) cluster(base *envoy_config_cluster_v3.Cluster) *envoy_config_cluster_v3.Cluster {
+	cl := proto.Clone(base).(*envoy_config_cluster_v3.Cluster)
+	if a.Override != nil {
+		proto.Merge(cl, a.Override)
+	}
+	cl.Name = a.Name
+	return edsCluster(cl)
+}
+
+// loadAssignment returns the load assignment for the aggregate, built from every matching endpoint
+// slice.
+func (a *Aggregate) loadAssignment(c *EndpointConfig, nodeStore cache.Store, slices []*discoveryv1.EndpointSlice) *envoy_config_endpoint_v3.ClusterLoadAssignment {
+	result := c.loadAssignments(nodeStore, slices, func(es *discoveryv1.EndpointSlice, port discoveryv1.EndpointPort) (string, envoy_config_core_v3.SocketAddress_Protocol) {
+		if !a.matches(es.Namespace, es.Labels) || !a.matchesPort(withDefault(port.Name, "")) {
+			return "", 0
+		}
+		_, protocol := (*NamingConfig)(nil).nameCluster(es.Namespace, "", "", *port.Port, withDefault(port.Protocol, "TCP"))
+		return a.Name, protocol
+	})
+	if len(result) == 0 {
+		// Send an empty assignment rather than leaving stale endpoints in place.
+		return &envoy_config_endpoint_v3.ClusterLoadAssignment{ClusterName: a.Name}
+	}
+	return result[0]
+}
+
+// updateAggregates adds svc to or removes svc from each aggregate, adding aggregate clusters that
+// gain their first member and deleting those that lose their last.  Pass a nil svc to remove key
+// from every aggregate.  You must hold the lock.
+func (cs *ClusterStore) updateAggregates(ctx context.Context, key types.NamespacedName, svc *v1.Service) error {
+	var add []*envoy_config_cluster_v3.Cluster
+	for _, a := range cs.cfg.aggregates {
+		members := cs.aggregateMembers[a.Name]
+		had := len(members) > 0
+		if svc != nil && cs.cfg.IncludesService(svc) && a.includesService(svc) {
+			if members == nil {
+				members = make(map[types.NamespacedName]struct{})
+				cs.aggregateMembers[a.Name] = members
+			}
+			members[key] = struct{}{}
+		} else {
+			delete(members, key)
+		}
+		switch has := len(members) > 0; {
+		case has && !had:
+			add = append(add, a.cluster(cs.cfg.BaseConfig))
+		case !has && had:
+			delete(cs.aggregateMembers, a.Name)
+			cs.s.DeleteCluster(ctx, a.Name)
+		}
+	}
+	if err := cs.s.AddClusters(ctx, add); err != nil {
+		return fmt.Errorf("add aggregate clusters: %w", err)
+	}
+	return nil
+}
+
+// aggregateClusters returns the aggregate clusters that have at least one member among svcs, and
+// the members of each.
+func (c *ClusterConfig) aggregateClusters(svcs []*v1.Service) ([]*envoy_config_cluster_v3.Cluster, map[string]map[types.NamespacedName]struct{}) {
+	var result []*envoy_config_cluster_v3.Cluster
+	members := make(map[string]map[types.NamespacedName]struct{})
+	for _, a := range c.aggregates {
+		for _, svc := range svcs {
+			if !c.IncludesService(svc) || !a.includesService(svc) {
+				continue
+			}
+			if members[a.Name] == nil {
+				members[a.Name] = make(map[types.NamespacedName]struct{})
+				result = append(result, a.cluster(c.BaseConfig))
+			}
+			members[a.Name][serviceKey(svc)] = struct{}{}
+		}
+	}
+	return result, members
+}
+
+// aggregateLoadAssignments returns load assignments for every aggregate that any of the provided
+// slices belongs to.  You must hold the lock.
+func (s *EndpointStore) aggregateLoadAssignments(changed ...*discoveryv1.EndpointSlice) []*envoy_config_endpoint_v3.ClusterLoadAssignment {
+	var result []*envoy_config_endpoint_v3.ClusterLoadAssignment
+	var all []*discoveryv1.EndpointSlice
+	for _, a := range s.cfg.aggregates {
+		var affected bool
+		for _, es := range changed {
+			if es != nil && a.matches(es.Namespace, es.Labels) {
+				affected = true
+				break
+			}
+		}
+		if !affected {
+			continue
+		}
+		if all == nil {
+			for key, svcESs := range s.serverESs {
+				if !s.linkedAs(key).excluded {
+					all = append(all, maps.Values(svcESs)...)
+				}
+			}
+		}
+		result = append(result, a.loadAssignment(s.cfg, s.nodeStore, all))
+	}
+	return result
+}
@@ -0,0 +1,115 @@
+package glue
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	"google.golang.org/protobuf/types/known/structpb"
+	v1 "k8s.io/api/core/v1"
+)
+
+// AllowlistMetadataNamespace is the filter metadata namespace under which generated clusters and
+// routes record the source ranges allowed to reach them, as a list of CIDRs under
+// "source_ranges".  ekglue only publishes the ranges; enforcing them is up to the consumer, like a
+// Lua or RBAC filter that reads the metadata.
+const AllowlistMetadataNamespace = "ekglue.allowlist"
+
+// AllowlistRule attaches allowed source ranges to the clusters it selects, and to the routes that
+// send traffic to those clusters.  A resource selected by several rules gets the union of their
+// ranges.
+type AllowlistRule struct {
+	// Match selects clusters by cluster or port name; multiple items are OR'd.  A route is
+	// matched by the cluster, and the name of the port, that it sends traffic to.
+	Match []*Matcher `json:"match"`
+	// Namespaces selects every cluster generated from a service in one of these namespaces,
+	// and every route to them.
+	Namespaces []string `json:"namespaces"`
+	// SourceRanges are the CIDRs, like "10.0.0.0/8", that are allowed to connect.
+	SourceRanges []string `json:"source_ranges"`
+}
+
+func (r *AllowlistRule) UnmarshalJSON(b []byte) error {
+	tmp := struct {
+		Match        []*Matcher `json:"match"`
+		Namespaces   []string   `json:"namespaces"`
+		SourceRanges []string   `json:"source_ranges"`
+	}{}
+	if err := json.Unmarshal(b, &tmp); err != nil {
+		return fmt.Errorf("AllowlistRule: unmarshal into temporary structure: %w", err)
+	}
+	if len(tmp.Match) == 0 && len(tmp.Namespaces) == 0 {
+		return fmt.Errorf("AllowlistRule: no matching rules or namespaces provided")
+	}
+	if len(tmp.SourceRanges) == 0 {
+		return fmt.Errorf("AllowlistRule: no source ranges provided")
+	}
+	for _, cidr := range tmp.SourceRanges {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("AllowlistRule: source range: %w", err)
+		}
+	}
+	r.Match, r.Namespaces, r.SourceRanges = tmp.Match, tmp.Namespaces, tmp.SourceRanges
+	return nil
+}
+
+// selects returns true if the rule selects a cluster generated from port of a service in namespace.
+func (r *AllowlistRule) selects(namespace string, cluster *envoy_config_cluster_v3.Cluster, svc *v1.Service, port *v1.ServicePort) bool {
+	for _, ns := range r.Namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	for _, m := range r.Match {
+		if m.Evaluate(cluster, svc, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowlistTarget is a cluster that a route sends traffic to.
+type allowlistTarget struct {
+	namespace, cluster, portName string
+	portNumber                   int32
+}
+
+// allowedSources returns the sorted union of the source ranges of every rule that selects one of
+// the targets.
+func allowedSources(rules []*AllowlistRule, targets ...allowlistTarget) []string {
+	seen := make(map[string]struct{})
+	var result []string
+	for _, t := range targets {
+		cluster := &envoy_config_cluster_v3.Cluster{Name: t.cluster}
+		port := &v1.ServicePort{Name: t.portName, Port: t.portNumber}
+		for _, r := range rules {
+			if !r.selects(t.namespace, cluster, nil, port) {
+				continue
+			}
+			for _, cidr := range r.SourceRanges {
+				if _, ok := seen[cidr]; !ok {
+					seen[cidr] = struct{}{}
+					result = append(result, cidr)
+				}
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// allowlistMetadata returns the metadata recording ranges, or nil if there are none.
+func allowlistMetadata(ranges []string) *structpb.Struct {
+	if len(ranges) == 0 {
+		return nil
+	}
+	values := make([]*structpb.Value, len(ranges))
+	for i, cidr := range ranges {
+		values[i] = structpb.NewStringValue(cidr)
+	}
+	return &structpb.Struct{Fields: map[string]*structpb.Value{
+		"source_ranges": structpb.NewListValue(&structpb.ListValue{Values: values}),
+	}}
+}
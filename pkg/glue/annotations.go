@@ -0,0 +1,71 @@
+package glue
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"google.golang.org/protobuf/types/known/durationpb"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Annotations that service owners can set on their services to tune the generated clusters, when
+// ClusterConfig.ServiceAnnotations is enabled.
+const (
+	// ConnectTimeoutAnnotation sets the cluster's connect_timeout, as a Go duration like "250ms".
+	ConnectTimeoutAnnotation = "ekglue.io/connect-timeout"
+	// LbPolicyAnnotation sets the cluster's lb_policy, like "LEAST_REQUEST".  Case is ignored.
+	LbPolicyAnnotation = "ekglue.io/lb-policy"
+	// HTTP2Annotation, if "true", makes the cluster speak HTTP/2 to its endpoints; if "false", it
+	// removes any HTTP/2 options inherited from the rest of the config.
+	HTTP2Annotation = "ekglue.io/http2"
+)
+
+// EndpointWeightAnnotation is a pod annotation that sets the load balancing weight of the pod's
+// endpoints, when EndpointConfig.PodWeights is enabled.
+const EndpointWeightAnnotation = "ekglue.io/endpoint-weight"
+
+// applyAnnotations merges any cluster-tuning annotations from the service into the cluster.
+func applyAnnotations(cl *envoy_config_cluster_v3.Cluster, svc *v1.Service) error {
+	var errs []string
+	a := svc.GetAnnotations()
+	if v, ok := a[ConnectTimeoutAnnotation]; ok {
+		d, err := time.ParseDuration(v)
+		if err == nil && d <= 0 {
+			err = fmt.Errorf("must be positive")
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", ConnectTimeoutAnnotation, err))
+		} else {
+			cl.ConnectTimeout = durationpb.New(d)
+		}
+	}
+	if v, ok := a[LbPolicyAnnotation]; ok {
+		p, ok := envoy_config_cluster_v3.Cluster_LbPolicy_value[strings.ToUpper(v)]
+		if !ok || p == int32(envoy_config_cluster_v3.Cluster_LOAD_BALANCING_POLICY_CONFIG) {
+			errs = append(errs, fmt.Sprintf("%s: unknown policy %q", LbPolicyAnnotation, v))
+		} else {
+			cl.LbPolicy = envoy_config_cluster_v3.Cluster_LbPolicy(p)
+		}
+	}
+	if v, ok := a[HTTP2Annotation]; ok {
+		h2, err := strconv.ParseBool(v)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Sprintf("%s: %v", HTTP2Annotation, err))
+		case h2:
+			if cl.Http2ProtocolOptions == nil {
+				cl.Http2ProtocolOptions = &envoy_config_core_v3.Http2ProtocolOptions{}
+			}
+		default:
+			cl.Http2ProtocolOptions = nil
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid annotations: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package glue
+
+import (
+	"strconv"
+
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// CapacityConfig weights endpoints by the capacity of the pod or node they run on, read from an
+// annotation, so that Envoy sends less traffic to endpoints on smaller machines in heterogeneous
+// node pools.  Endpoints whose capacity is unknown get EndpointConfig.DefaultWeight, or Envoy's
+// default weight of 1, so weights should be chosen with that in mind.
+//
+// Pod annotations are read when endpoints or pods change, if pods are sent to
+// EndpointStore.PodStore.  Node annotations are only read when endpoints change; re-annotating a
+// node takes effect the next time the service's EndpointSlices change.
+type CapacityConfig struct {
+	// PodAnnotation is the pod annotation that holds an endpoint's capacity.  Setting it makes
+	// ekglue watch every pod in the cluster.
+	PodAnnotation string `json:"pod_annotation"`
+	// NodeAnnotation is the node annotation that holds the capacity of the endpoints running on
+	// the node.  The pod annotation takes precedence.
+	NodeAnnotation string `json:"node_annotation"`
+	// Classes maps annotation values, like "small" or "large", to weights.  If empty, the
+	// annotation's value is used as the weight directly.
+	Classes map[string]uint32 `json:"classes"`
+}
+
+// weight returns the load balancing weight of an endpoint, or 0 if it has no known capacity.
+func (c *CapacityConfig) weight(pods, nodes cache.Store, ep discoveryv1.Endpoint) uint32 {
+	if c == nil {
+		return 0
+	}
+	value, ok := "", false
+	if c.PodAnnotation != "" {
+		value, ok = podAnnotation(pods, ep.TargetRef, c.PodAnnotation)
+	}
+	if !ok && c.NodeAnnotation != "" && ep.NodeName != nil {
+		value, ok = nodeAnnotation(nodes, *ep.NodeName, c.NodeAnnotation)
+	}
+	if !ok {
+		return 0
+	}
+	if len(c.Classes) > 0 {
+		w, ok := c.Classes[value]
+		if !ok {
+			zap.L().Debug("unknown capacity class", zap.String("class", value))
+		}
+		return w
+	}
+	w, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		zap.L().Debug("invalid capacity", zap.String("capacity", value), zap.Error(err))
+		return 0
+	}
+	return uint32(w)
+}
+
+// podWeight returns the weight set by EndpointWeightAnnotation on the endpoint's pod, or 0.
+func podWeight(pods cache.Store, ep discoveryv1.Endpoint) uint32 {
+	value, ok := podAnnotation(pods, ep.TargetRef, EndpointWeightAnnotation)
+	if !ok {
+		return 0
+	}
+	w, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		zap.L().Debug("invalid endpoint weight", zap.String("weight", value), zap.Error(err))
+		return 0
+	}
+	return uint32(w)
+}
+
+// setWeight sets the load balancing weight of lbe from the pod annotation or the capacity of the
+// endpoint it was generated from, or the default weight.
+func (c *EndpointConfig) setWeight(lbe *envoy_config_endpoint_v3.LbEndpoint, nodes cache.Store, ep discoveryv1.Endpoint) {
+	var w uint32
+	if c.PodWeights {
+		w = podWeight(c.pods, ep)
+	}
+	if w == 0 {
+		w = c.Capacity.weight(c.pods, nodes, ep)
+	}
+	if w == 0 {
+		w = c.DefaultWeight
+	}
+	if w > 0 {
+		lbe.LoadBalancingWeight = wrapperspb.UInt32(w)
+	}
+}
+
+// needsAllPods returns true if endpoint weights are read from pod annotations, endpoint metadata
+// from pod labels, or health checks from readiness probes, which requires watching every pod.
+func (c *EndpointConfig) needsAllPods() bool {
+	return c.PodWeights || (c.Capacity != nil && c.Capacity.PodAnnotation != "") || len(c.PodLabelMetadata) > 0 || len(c.subsetLabels) > 0 || c.probes
+}
+
+// endpointPod returns the pod that ref refers to, if it's in podStore.
+func endpointPod(podStore cache.Store, ref *v1.ObjectReference) (*v1.Pod, bool) {
+	if podStore == nil || ref == nil || ref.Kind != "Pod" {
+		return nil, false
+	}
+	obj, ok, err := podStore.GetByKey(ref.Namespace + "/" + ref.Name)
+	if err != nil || !ok {
+		return nil, false
+	}
+	pod, ok := obj.(*v1.Pod)
+	return pod, ok
+}
+
+// podAnnotation returns the value of the named annotation on the pod that ref refers to.
+func podAnnotation(podStore cache.Store, ref *v1.ObjectReference, annotation string) (string, bool) {
+	pod, ok := endpointPod(podStore, ref)
+	if !ok {
+		return "", false
+	}
+	value, ok := pod.GetAnnotations()[annotation]
+	return value, ok
+}
+
+// nodeAnnotation returns the value of the named annotation on the named node.
+func nodeAnnotation(nodeStore cache.Store, name, annotation string) (string, bool) {
+	if nodeStore == nil {
+		return "", false
+	}
+	obj, ok, err := nodeStore.GetByKey(name)
+	if err != nil || !ok {
+		return "", false
+	}
+	node, ok := obj.(*v1.Node)
+	if !ok {
+		return "", false
+	}
+	value, ok := node.GetAnnotations()[annotation]
+	return value, ok
+}
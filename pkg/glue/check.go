@@ -0,0 +1,139 @@
+package glue
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jrockway/ekglue/pkg/cds"
+	"github.com/jrockway/ekglue/pkg/xds"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ExampleServices returns a service with commonly-used ports, and an EndpointSlice for it, to check
+// a config against when no real objects are available.
+func ExampleServices() ([]*v1.Service, []*discoveryv1.EndpointSlice) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "example", Labels: map[string]string{"app": "example"}},
+		Spec: v1.ServiceSpec{
+			Type: v1.ServiceTypeClusterIP,
+			Ports: []v1.ServicePort{
+				{Name: "http", Port: 80, Protocol: v1.ProtocolTCP},
+				{Name: "https", Port: 443, Protocol: v1.ProtocolTCP},
+				{Name: "grpc", Port: 9000, Protocol: v1.ProtocolTCP},
+				{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP},
+			},
+		},
+	}
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "example-abcde",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "example"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.1"}}},
+	}
+	for _, p := range svc.Spec.Ports {
+		p := p
+		slice.Ports = append(slice.Ports, discoveryv1.EndpointPort{Name: &p.Name, Port: &p.Port, Protocol: &p.Protocol})
+	}
+	return []*v1.Service{svc}, []*discoveryv1.EndpointSlice{slice}
+}
+
+// asResources converts a slice of a resource type to a slice of xds.Resource.
+func asResources[T xds.Resource](rs []T) []xds.Resource {
+	result := make([]xds.Resource, len(rs))
+	for i, r := range rs {
+		result[i] = r
+	}
+	return result
+}
+
+// checkService checks the annotations on svc, and validates everything the config generates from
+// it against server, as Check describes.  cs must be a store for server.
+func (c *Config) checkService(server *cds.Server, cs *ClusterStore, svc *v1.Service) []error {
+	var errs []error
+	key := serviceKey(svc)
+	if c.ClusterConfig.ServiceAnnotations {
+		if err := applyAnnotations(c.ClusterConfig.GetBaseConfig(), svc); err != nil {
+			errs = append(errs, fmt.Errorf("service %s: %w", key, err))
+		}
+	}
+	if v, ok := svc.GetAnnotations()[RequestTimeoutAnnotation]; ok {
+		if _, err := parseRequestTimeout(v); err != nil {
+			errs = append(errs, fmt.Errorf("service %s: %s: %w", key, RequestTimeoutAnnotation, err))
+		}
+	}
+	clusters, ports := c.ClusterConfig.clustersFromService(svc)
+	if err := server.Clusters.Validate(asResources(clusters)); err != nil {
+		errs = append(errs, fmt.Errorf("service %s: clusters: %w", key, err))
+	}
+	if c.ClusterConfig.GRPC != nil {
+		ls, rs, err := cs.grpcResources(svc, clusters, ports)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("service %s: grpc: %w", key, err))
+		} else if err := errors.Join(server.Listeners.Validate(asResources(ls)), server.Routes.Validate(asResources(rs))); err != nil {
+			errs = append(errs, fmt.Errorf("service %s: grpc: %w", key, err))
+		}
+	}
+	if len(c.ClusterConfig.Listeners) > 0 {
+		ls, err := c.ClusterConfig.templatedListeners(svc, clusters, ports)
+		if err == nil {
+			err = server.Listeners.Validate(asResources(ls))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("service %s: listeners: %w", key, err))
+		}
+	}
+	if c.ClusterConfig.TLSPassthrough != nil {
+		if _, err := c.ClusterConfig.TLSPassthrough.filterChain(svc, clusters, ports); err != nil {
+			errs = append(errs, fmt.Errorf("service %s: tls passthrough: %w", key, err))
+		}
+	}
+	return errs
+}
+
+// CheckService checks svc on its own, as Check does, so that a service that the config can't
+// translate can be rejected before it's created; see AdmissionHandler.
+func (c *Config) CheckService(svc *v1.Service) error {
+	server := cds.NewServer("", nil)
+	c.Validation.Apply(server)
+	return errors.Join(c.checkService(server, c.ClusterConfig.Store(server), svc)...)
+}
+
+// Check generates everything that the config would generate from services and endpointSlices, and
+// validates it as the xDS server would, including the config's own validation rules.  Each service
+// is checked on its own, so that every broken service is reported, and then all of them together,
+// which catches problems like name collisions.  Nil is returned if everything is valid.
+func (c *Config) Check(services []*v1.Service, endpointSlices []*discoveryv1.EndpointSlice) error {
+	server := cds.NewServer("", nil)
+	c.Validation.Apply(server)
+	cs := c.ClusterConfig.Store(server)
+	var errs []error
+	for _, svc := range services {
+		errs = append(errs, c.checkService(server, cs, svc)...)
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	objs := make([]interface{}, len(services))
+	for i, svc := range services {
+		objs[i] = svc
+	}
+	if err := cs.Replace(objs, ""); err != nil {
+		return err
+	}
+	objs = make([]interface{}, len(endpointSlices))
+	for i, es := range endpointSlices {
+		objs[i] = es
+	}
+	nodes := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	if err := c.EndpointConfig.Store(nodes, server).Replace(objs, ""); err != nil {
+		return err
+	}
+	return nil
+}
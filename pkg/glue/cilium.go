@@ -0,0 +1,330 @@
+package glue
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+)
+
+// CiliumMetadataNamespace is the filter metadata namespace that Cilium identity information is
+// stored under on each endpoint.
+const CiliumMetadataNamespace = "io.cilium"
+
+// CiliumIdentity is the security identity that Cilium assigned to a pod.
+type CiliumIdentity struct {
+	ID     int64
+	Labels map[string]string
+}
+
+// metadata returns the identity as endpoint metadata.
+func (id *CiliumIdentity) metadata() (*envoy_config_core_v3.Metadata, error) {
+	labels := make(map[string]interface{}, len(id.Labels))
+	for k, v := range id.Labels {
+		labels[k] = v
+	}
+	s, err := structpb.NewStruct(map[string]interface{}{
+		"identity": id.ID,
+		"labels":   labels,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &envoy_config_core_v3.Metadata{
+		FilterMetadata: map[string]*structpb.Struct{CiliumMetadataNamespace: s},
+	}, nil
+}
+
+// CiliumIdentityStore is a cache.Store that receives CiliumEndpoint objects (as
+// *unstructured.Unstructured) and indexes their identities by pod IP.  Cilium's identity labels are
+// often more useful than pod labels (they include the namespace and service account).  Only the
+// identities are used; the addresses of endpoints still come from EndpointSlices.
+//
+// The store only records identities; they are attached to endpoints the next time the endpoint's
+// load assignment is regenerated.  Send CiliumEndpoints to EndpointStore.IdentityStore to
+// regenerate the load assignments of the endpoints whose identity changes.
+type CiliumIdentityStore struct {
+	mu   sync.RWMutex
+	byIP map[string]*CiliumIdentity
+	ips  map[string][]string // CiliumEndpoint key -> IPs
+}
+
+// NewCiliumIdentityStore returns an empty CiliumIdentityStore.
+func NewCiliumIdentityStore() *CiliumIdentityStore {
+	return &CiliumIdentityStore{
+		byIP: make(map[string]*CiliumIdentity),
+		ips:  make(map[string][]string),
+	}
+}
+
+// parseCiliumEndpoint extracts the IPs and identity from a CiliumEndpoint.
+func parseCiliumEndpoint(obj interface{}) (string, []string, *CiliumIdentity, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return "", nil, nil, fmt.Errorf("got non-unstructured object %#v", obj)
+	}
+	key := u.GetNamespace() + "/" + u.GetName()
+	id := &CiliumIdentity{Labels: make(map[string]string)}
+	id.ID, _, _ = unstructured.NestedInt64(u.Object, "status", "identity", "id")
+	labels, _, _ := unstructured.NestedStringSlice(u.Object, "status", "identity", "labels")
+	for _, l := range labels {
+		// Cilium labels look like "source:key=value", e.g. "k8s:app=foo".
+		k, v, _ := strings.Cut(l, "=")
+		id.Labels[k] = v
+	}
+	var ips []string
+	addrs, _, _ := unstructured.NestedSlice(u.Object, "status", "networking", "addressing")
+	for _, raw := range addrs {
+		addr, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, family := range []string{"ipv4", "ipv6"} {
+			if ip, ok := addr[family].(string); ok && ip != "" {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return key, ips, id, nil
+}
+
+// set records the identity for the provided IPs, replacing anything previously recorded for key.
+// You must hold the lock.
+func (s *CiliumIdentityStore) set(key string, ips []string, id *CiliumIdentity) {
+	s.unset(key)
+	if len(ips) == 0 {
+		return
+	}
+	for _, ip := range ips {
+		s.byIP[ip] = id
+	}
+	s.ips[key] = ips
+}
+
+// unset forgets key.  You must hold the lock.
+func (s *CiliumIdentityStore) unset(key string) {
+	for _, ip := range s.ips[key] {
+		delete(s.byIP, ip)
+	}
+	delete(s.ips, key)
+}
+
+func (s *CiliumIdentityStore) Add(obj interface{}) error {
+	key, ips, id, err := parseCiliumEndpoint(obj)
+	if err != nil {
+		return fmt.Errorf("add cilium endpoint: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(key, ips, id)
+	return nil
+}
+
+func (s *CiliumIdentityStore) Update(obj interface{}) error {
+	key, ips, id, err := parseCiliumEndpoint(obj)
+	if err != nil {
+		return fmt.Errorf("update cilium endpoint: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(key, ips, id)
+	return nil
+}
+
+func (s *CiliumIdentityStore) Delete(obj interface{}) error {
+	key, _, _, err := parseCiliumEndpoint(obj)
+	if err != nil {
+		return fmt.Errorf("delete cilium endpoint: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unset(key)
+	return nil
+}
+
+func (s *CiliumIdentityStore) List() []interface{} {
+	return nil
+}
+
+// ListKeys returns the IPs with a known identity.
+func (s *CiliumIdentityStore) ListKeys() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var result []string
+	for ip := range s.byIP {
+		result = append(result, ip)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (s *CiliumIdentityStore) Get(obj interface{}) (item interface{}, exists bool, err error) {
+	return nil, false, errors.New("CiliumIdentityStore.Get unimplemented")
+}
+
+func (s *CiliumIdentityStore) GetByKey(key string) (item interface{}, exists bool, err error) {
+	return nil, false, errors.New("CiliumIdentityStore.GetByKey unimplemented")
+}
+
+func (s *CiliumIdentityStore) Replace(objs []interface{}, _ string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byIP = make(map[string]*CiliumIdentity)
+	s.ips = make(map[string][]string)
+	for _, obj := range objs {
+		key, ips, id, err := parseCiliumEndpoint(obj)
+		if err != nil {
+			return fmt.Errorf("replace cilium endpoints: %w", err)
+		}
+		s.set(key, ips, id)
+	}
+	return nil
+}
+
+func (s *CiliumIdentityStore) Resync() error {
+	// Nothing to do.
+	return nil
+}
+
+// identitiesOf returns the identity of each IP recorded for the CiliumEndpoint key.
+func (s *CiliumIdentityStore) identitiesOf(key string) map[string]*CiliumIdentity {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := make(map[string]*CiliumIdentity)
+	for _, ip := range s.ips[key] {
+		result[ip] = s.byIP[ip]
+	}
+	return result
+}
+
+// identityWatcher is a cache.Store of CiliumEndpoints that regenerates the load assignments of the
+// endpoints whose identity changes.
+type identityWatcher struct {
+	*CiliumIdentityStore
+	s *EndpointStore
+
+	mu sync.Mutex // serializes changes, so that the previous identities can be compared
+}
+
+// IdentityStore returns a cache.Store that sends CiliumEndpoints to ids, and keeps the identity
+// metadata of load assignments up to date.
+func (s *EndpointStore) IdentityStore(ids *CiliumIdentityStore) cache.Store {
+	return &identityWatcher{CiliumIdentityStore: ids, s: s}
+}
+
+// change applies fn, which changes the CiliumEndpoint obj, and regenerates the load assignments
+// of the endpoints whose identity it changed.
+func (w *identityWatcher) change(op string, obj interface{}, fn func(obj interface{}) error) error {
+	key, _, _, err := parseCiliumEndpoint(obj)
+	if err != nil {
+		return fmt.Errorf("%s cilium endpoint: %w", op, err)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	before := w.identitiesOf(key)
+	if err := fn(obj); err != nil {
+		return err
+	}
+	after := w.identitiesOf(key)
+	changed := make(map[string]struct{})
+	for ip, id := range before {
+		if !reflect.DeepEqual(after[ip], id) {
+			changed[ip] = struct{}{}
+		}
+	}
+	for ip, id := range after {
+		if !reflect.DeepEqual(before[ip], id) {
+			changed[ip] = struct{}{}
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	ctx, c := startOp("ciliumendpoints", op)
+	defer c()
+	if err := w.s.refresh(ctx, func(ep discoveryv1.Endpoint) bool {
+		for _, addr := range ep.Addresses {
+			if _, ok := changed[addr]; ok {
+				return true
+			}
+		}
+		return false
+	}); err != nil {
+		logError(ctx)
+		return fmt.Errorf("%s cilium endpoint: %w", op, err)
+	}
+	return nil
+}
+
+func (w *identityWatcher) Add(obj interface{}) error {
+	return w.change("add", obj, w.CiliumIdentityStore.Add)
+}
+
+func (w *identityWatcher) Update(obj interface{}) error {
+	return w.change("update", obj, w.CiliumIdentityStore.Update)
+}
+
+func (w *identityWatcher) Delete(obj interface{}) error {
+	return w.change("delete", obj, w.CiliumIdentityStore.Delete)
+}
+
+func (w *identityWatcher) Replace(objs []interface{}, resourceVersion string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.CiliumIdentityStore.Replace(objs, resourceVersion); err != nil {
+		return err
+	}
+	ctx, c := startOp("ciliumendpoints", "replace")
+	defer c()
+	if err := w.s.refresh(ctx, func(ep discoveryv1.Endpoint) bool { return len(ep.Addresses) > 0 }); err != nil {
+		logError(ctx)
+		return fmt.Errorf("replace cilium endpoints: %w", err)
+	}
+	return nil
+}
+
+// Lookup returns the identity of the pod with the provided IP, or nil if it is unknown.
+func (s *CiliumIdentityStore) Lookup(ip string) *CiliumIdentity {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byIP[ip]
+}
+
+// addIdentityMetadata adds the Cilium identity of addr, if known, to the endpoint's metadata.
+func (s *CiliumIdentityStore) addIdentityMetadata(ep *envoy_config_endpoint_v3.LbEndpoint, addr string) {
+	id := s.Lookup(addr)
+	if id == nil {
+		return
+	}
+	md, err := id.metadata()
+	if err != nil {
+		zap.L().Error("problem building cilium identity metadata", zap.String("address", addr), zap.Error(err))
+		return
+	}
+	setFilterMetadata(&ep.Metadata, CiliumMetadataNamespace, md.GetFilterMetadata()[CiliumMetadataNamespace])
+}
+
+// IdentityStore returns the store that Cilium identities should be sent to, if
+// cilium_identity_metadata is enabled, or nil otherwise.
+func (c *EndpointConfig) IdentityStore() *CiliumIdentityStore {
+	if !c.CiliumIdentityMetadata {
+		return nil
+	}
+	if c.identities == nil {
+		c.identities = NewCiliumIdentityStore()
+	}
+	return c.identities
+}
@@ -0,0 +1,230 @@
+package glue
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var clusterNameCollisions = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "ekglue_cluster_name_collisions",
+		Help: "A count of generated clusters whose name was already in use by another service.",
+	},
+	[]string{"policy"},
+)
+
+var listenerNameCollisions = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "ekglue_listener_name_collisions",
+		Help: "A count of generated gRPC or templated listeners whose name was already in use by another service.",
+	},
+)
+
+// CollisionPolicy determines how to handle two services that generate a cluster with the same name.
+// Whatever the policy, each collision is logged as a warning and counted by the
+// ekglue_cluster_name_collisions metric, by policy; no Kubernetes events are emitted, so alert on
+// the metric to find out about collisions.
+type CollisionPolicy string
+
+const (
+	// CollisionOverwrite lets the most recently updated service take over the cluster name.  This
+	// is the default, and matches the behavior of older versions of ekglue.
+	CollisionOverwrite CollisionPolicy = "overwrite"
+	// CollisionPreferFirst keeps the cluster generated by the service that claimed the name first,
+	// and ignores the later one.
+	CollisionPreferFirst CollisionPolicy = "prefer_first"
+	// CollisionReject ignores the later cluster like CollisionPreferFirst, but also returns an
+	// error to the caller of Add or Update.
+	CollisionReject CollisionPolicy = "reject"
+	// CollisionSuffix renames the later cluster by appending a suffix derived from the owning
+	// service's namespace and name.  The suffix is stable across restarts.  Load assignments are
+	// only renamed to match by an EndpointStore linked with Stores.Link.
+	CollisionSuffix CollisionPolicy = "suffix"
+)
+
+// Validate returns an error if the policy is not one of the known policies.
+func (p CollisionPolicy) Validate() error {
+	switch p {
+	case "", CollisionOverwrite, CollisionPreferFirst, CollisionReject, CollisionSuffix:
+		return nil
+	}
+	return fmt.Errorf("unknown collision_policy %q", p)
+}
+
+// collisionSuffix returns a short, stable suffix identifying the owner of a cluster.
+func collisionSuffix(owner types.NamespacedName) string {
+	h := fnv.New32a()
+	h.Write([]byte(owner.String()))
+	return fmt.Sprintf("-%08x", h.Sum32())
+}
+
+// serviceKey returns the key that identifies svc as the owner of the clusters generated from it.
+func serviceKey(svc *v1.Service) types.NamespacedName {
+	return types.NamespacedName{Namespace: svc.GetNamespace(), Name: svc.GetName()}
+}
+
+// sortServicesByAge sorts services oldest first, so that "first" in CollisionPreferFirst means the
+// same thing after a Replace as it does for a sequence of Adds.
+func sortServicesByAge(svcs []*v1.Service) {
+	sort.SliceStable(svcs, func(i, j int) bool {
+		a, b := svcs[i].GetCreationTimestamp(), svcs[j].GetCreationTimestamp()
+		if !a.Equal(&b) {
+			return a.Before(&b)
+		}
+		return serviceKey(svcs[i]).String() < serviceKey(svcs[j]).String()
+	})
+}
+
+// nameOwners tracks which service generated each cluster name.  It is not safe for concurrent use.
+type nameOwners struct {
+	owners map[string]types.NamespacedName
+	names  map[types.NamespacedName]map[string]struct{}
+}
+
+func newNameOwners() *nameOwners {
+	return &nameOwners{
+		owners: make(map[string]types.NamespacedName),
+		names:  make(map[types.NamespacedName]map[string]struct{}),
+	}
+}
+
+// claim resolves collisions between clusters generated by owner and clusters that already exist
+// according to the policy, and records owner as the owner of each returned cluster.  Names that
+// owner previously claimed but no longer generates are released and returned as stale.  If the
+// policy is CollisionReject and a collision occurred, an error is returned along with the clusters
+// that did not collide.
+func (o *nameOwners) claim(policy CollisionPolicy, owner types.NamespacedName, clusters []*envoy_config_cluster_v3.Cluster) (result []*envoy_config_cluster_v3.Cluster, stale []string, err error) {
+	if policy == "" {
+		policy = CollisionOverwrite
+	}
+	prev := o.release(owner)
+	owned := make(map[string]struct{})
+	var rejected []string
+	for _, cl := range clusters {
+		name := cl.GetName()
+		if cur, ok := o.owners[name]; ok && cur != owner {
+			clusterNameCollisions.WithLabelValues(string(policy)).Inc()
+			zap.L().Warn("cluster name collision", zap.String("cluster", name), zap.Stringer("owner", cur), zap.Stringer("service", owner), zap.String("policy", string(policy)))
+			switch policy {
+			case CollisionPreferFirst:
+				continue
+			case CollisionReject:
+				rejected = append(rejected, name)
+				continue
+			case CollisionSuffix:
+				cl.Name = name + collisionSuffix(owner)
+				if la := cl.GetLoadAssignment(); la != nil {
+					la.ClusterName = cl.Name
+				}
+				name = cl.Name
+			case CollisionOverwrite:
+				delete(o.names[cur], name)
+			}
+		}
+		o.owners[name] = owner
+		owned[name] = struct{}{}
+		delete(prev, name)
+		result = append(result, cl)
+	}
+	if len(owned) > 0 {
+		o.names[owner] = owned
+	}
+	for name := range prev {
+		stale = append(stale, name)
+	}
+	sort.Strings(stale)
+	if len(rejected) > 0 {
+		err = fmt.Errorf("cluster names %v are already in use by other services", rejected)
+	}
+	return result, stale, err
+}
+
+// displaced returns the services that would lose names to owner if it claimed clusters with the
+// given names according to the policy.
+func (o *nameOwners) displaced(policy CollisionPolicy, owner types.NamespacedName, names []string) []types.NamespacedName {
+	if policy != "" && policy != CollisionOverwrite {
+		return nil
+	}
+	var result []types.NamespacedName
+	seen := make(map[types.NamespacedName]struct{})
+	for _, name := range names {
+		cur, ok := o.owners[name]
+		if !ok || cur == owner {
+			continue
+		}
+		if _, ok := seen[cur]; !ok {
+			seen[cur] = struct{}{}
+			result = append(result, cur)
+		}
+	}
+	return result
+}
+
+// withoutOverwritten returns clusters without the ones that a later cluster with the same name
+// replaces, which only happens under CollisionOverwrite.
+func withoutOverwritten(clusters []*envoy_config_cluster_v3.Cluster) []*envoy_config_cluster_v3.Cluster {
+	last := make(map[string]int)
+	for i, cl := range clusters {
+		last[cl.GetName()] = i
+	}
+	result := make([]*envoy_config_cluster_v3.Cluster, 0, len(last))
+	for i, cl := range clusters {
+		if last[cl.GetName()] == i {
+			result = append(result, cl)
+		}
+	}
+	return result
+}
+
+// release forgets all names owned by owner, returning them.
+func (o *nameOwners) release(owner types.NamespacedName) map[string]struct{} {
+	result := o.names[owner]
+	if result == nil {
+		result = make(map[string]struct{})
+	}
+	for name := range result {
+		delete(o.owners, name)
+	}
+	delete(o.names, owner)
+	return result
+}
+
+// claimListeners returns the listeners generated by owner whose names aren't already used by a
+// listener of another service in any of the owned maps, which hold the names of the gRPC and
+// templated listeners that each service generated.  Listener names come from templates, which can
+// easily produce the same name for same-named services in different namespaces; rather than let
+// one service replace, and later delete, the other's listener, the service that generated the
+// name first keeps it.  Since Replace handles services oldest first, that is usually the older
+// service.  The newer service gets the name if it's updated after the older one stops using it.
+func claimListeners(owner types.NamespacedName, listeners []*envoy_config_listener_v3.Listener, owned ...map[types.NamespacedName][]string) []*envoy_config_listener_v3.Listener {
+	used := make(map[string]types.NamespacedName)
+	for _, m := range owned {
+		for key, names := range m {
+			if key == owner {
+				continue
+			}
+			for _, name := range names {
+				used[name] = key
+			}
+		}
+	}
+	var result []*envoy_config_listener_v3.Listener
+	for _, l := range listeners {
+		if cur, ok := used[l.GetName()]; ok {
+			listenerNameCollisions.Inc()
+			zap.L().Warn("listener name collision", zap.String("listener", l.GetName()), zap.Stringer("owner", cur), zap.Stringer("service", owner))
+			continue
+		}
+		result = append(result, l)
+	}
+	return result
+}
@@ -0,0 +1,40 @@
+package glue
+
+import (
+	"strings"
+
+	envoy_config_route_v3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	envoy_type_tracing_v3 "github.com/envoyproxy/go-control-plane/envoy/type/tracing/v3"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// DestinationMetadataNamespace is the filter metadata namespace under which generated routes
+// record the Kubernetes service they send traffic to, when destination metadata is enabled.  Its
+// "namespace" and "service" keys can be logged with, for example,
+// %METADATA(ROUTE:ekglue.destination:service)%.
+const DestinationMetadataNamespace = "ekglue.destination"
+
+// setDestination records the namespace and names of the services that r sends traffic to in the
+// route's metadata, and as custom tags on the spans that Envoy traces for it.  Several services
+// (from a weighted route) are joined with commas.
+func setDestination(r *envoy_config_route_v3.Route, namespace string, services []string) {
+	service := strings.Join(services, ",")
+	setFilterMetadata(&r.Metadata, DestinationMetadataNamespace, &structpb.Struct{Fields: map[string]*structpb.Value{
+		"namespace": structpb.NewStringValue(namespace),
+		"service":   structpb.NewStringValue(service),
+	}})
+	literal := func(tag, value string) *envoy_type_tracing_v3.CustomTag {
+		return &envoy_type_tracing_v3.CustomTag{
+			Tag: tag,
+			Type: &envoy_type_tracing_v3.CustomTag_Literal_{
+				Literal: &envoy_type_tracing_v3.CustomTag_Literal{Value: value},
+			},
+		}
+	}
+	r.Tracing = &envoy_config_route_v3.Tracing{
+		CustomTags: []*envoy_type_tracing_v3.CustomTag{
+			literal("k8s.namespace.name", namespace),
+			literal("k8s.service.name", service),
+		},
+	}
+}
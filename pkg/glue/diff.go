@@ -0,0 +1,163 @@
+package glue
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+)
+
+var k8sUnchangedEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ekglue_k8s_unchanged_events",
+	Help: "A count of events that Kubernetes notified us of that changed nothing ekglue generates resources from, and were skipped.",
+}, []string{"reflector"})
+
+// ServiceDiff describes how a service changed, in the terms that matter to the clusters generated
+// from it.  Ports are identified by name, or by number if they are unnamed.
+type ServiceDiff struct {
+	AddedPorts   []string
+	RemovedPorts []string
+	ChangedPorts []string
+	// Labels, Annotations, and Spec are true if the service's labels, annotations, or anything
+	// else in its spec changed.
+	Labels      bool
+	Annotations bool
+	Spec        bool
+}
+
+// Empty returns true if nothing changed.
+func (d ServiceDiff) Empty() bool {
+	return len(d.AddedPorts) == 0 && len(d.RemovedPorts) == 0 && len(d.ChangedPorts) == 0 && !d.Labels && !d.Annotations && !d.Spec
+}
+
+// DiffServices returns the difference between two versions of a service.  A nil service has no
+// ports, labels, or annotations.
+func DiffServices(prev, cur *v1.Service) ServiceDiff {
+	if prev == nil {
+		prev = new(v1.Service)
+	}
+	if cur == nil {
+		cur = new(v1.Service)
+	}
+	var d ServiceDiff
+	prevPorts, curPorts := make(map[string]v1.ServicePort), make(map[string]v1.ServicePort)
+	for _, p := range prev.Spec.Ports {
+		prevPorts[portKey(p.Name, p.Port)] = p
+	}
+	for _, p := range cur.Spec.Ports {
+		curPorts[portKey(p.Name, p.Port)] = p
+	}
+	d.AddedPorts, d.RemovedPorts, d.ChangedPorts = diffKeys(prevPorts, curPorts, func(a, b v1.ServicePort) bool {
+		return equality.Semantic.DeepEqual(a, b)
+	})
+	d.Labels = !equality.Semantic.DeepEqual(prev.GetLabels(), cur.GetLabels())
+	d.Annotations = !equality.Semantic.DeepEqual(prev.GetAnnotations(), cur.GetAnnotations())
+	prevSpec, curSpec := prev.Spec, cur.Spec
+	prevSpec.Ports, curSpec.Ports = nil, nil
+	d.Spec = !equality.Semantic.DeepEqual(prevSpec, curSpec)
+	return d
+}
+
+// EndpointSliceDiff describes how an endpoint slice changed, in the terms that matter to the load
+// assignments generated from it.  Endpoints are identified by their addresses, and ports by name,
+// or by number if they are unnamed.
+type EndpointSliceDiff struct {
+	AddedEndpoints   []string
+	RemovedEndpoints []string
+	// ChangedEndpoints are endpoints whose conditions, node, zone, or other details changed.
+	ChangedEndpoints []string
+	AddedPorts       []string
+	RemovedPorts     []string
+	ChangedPorts     []string
+	// Labels is true if the slice's labels changed.
+	Labels bool
+}
+
+// Empty returns true if nothing changed.
+func (d EndpointSliceDiff) Empty() bool {
+	return len(d.AddedEndpoints) == 0 && len(d.RemovedEndpoints) == 0 && len(d.ChangedEndpoints) == 0 && len(d.AddedPorts) == 0 && len(d.RemovedPorts) == 0 && len(d.ChangedPorts) == 0 && !d.Labels
+}
+
+// endpointsChanged returns true if any endpoint was added, removed, or changed.
+func (d EndpointSliceDiff) endpointsChanged() bool {
+	return len(d.AddedEndpoints) > 0 || len(d.RemovedEndpoints) > 0 || len(d.ChangedEndpoints) > 0
+}
+
+// DiffEndpointSlices returns the difference between two versions of an endpoint slice.  A nil
+// slice has no endpoints, ports, or labels.
+func DiffEndpointSlices(prev, cur *discoveryv1.EndpointSlice) EndpointSliceDiff {
+	if prev == nil {
+		prev = new(discoveryv1.EndpointSlice)
+	}
+	if cur == nil {
+		cur = new(discoveryv1.EndpointSlice)
+	}
+	var d EndpointSliceDiff
+	prevEndpoints, curEndpoints := make(map[string]discoveryv1.Endpoint), make(map[string]discoveryv1.Endpoint)
+	for _, e := range prev.Endpoints {
+		prevEndpoints[strings.Join(e.Addresses, ",")] = e
+	}
+	for _, e := range cur.Endpoints {
+		curEndpoints[strings.Join(e.Addresses, ",")] = e
+	}
+	d.AddedEndpoints, d.RemovedEndpoints, d.ChangedEndpoints = diffKeys(prevEndpoints, curEndpoints, func(a, b discoveryv1.Endpoint) bool {
+		return equality.Semantic.DeepEqual(a, b)
+	})
+	d.AddedPorts, d.RemovedPorts, d.ChangedPorts = diffKeys(slicePorts(prev), slicePorts(cur), func(a, b discoveryv1.EndpointPort) bool {
+		return equality.Semantic.DeepEqual(a, b)
+	})
+	d.Labels = !equality.Semantic.DeepEqual(prev.GetLabels(), cur.GetLabels())
+	return d
+}
+
+// slicePorts returns the ports of es, which may be nil, that load assignments are generated for, by portKey.
+func slicePorts(es *discoveryv1.EndpointSlice) map[string]discoveryv1.EndpointPort {
+	result := make(map[string]discoveryv1.EndpointPort)
+	if es == nil {
+		return result
+	}
+	for _, p := range es.Ports {
+		if p.Port == nil {
+			// Ignore unspecified ports, like LoadAssignmentsFromEndpointSlices does.
+			continue
+		}
+		result[portKey(withDefault(p.Name, ""), *p.Port)] = p
+	}
+	return result
+}
+
+// portKey identifies a port of a service or endpoint slice.
+func portKey(name string, number int32) string {
+	if name != "" {
+		return name
+	}
+	return strconv.Itoa(int(number))
+}
+
+// diffKeys returns the sorted keys that are only in cur, only in prev, and in both but with values
+// that aren't equal.
+func diffKeys[T any](prev, cur map[string]T, equal func(a, b T) bool) (added, removed, changed []string) {
+	for k, c := range cur {
+		p, ok := prev[k]
+		switch {
+		case !ok:
+			added = append(added, k)
+		case !equal(p, c):
+			changed = append(changed, k)
+		}
+	}
+	for k := range prev {
+		if _, ok := cur[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
@@ -0,0 +1,76 @@
+package glue
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// ClusterDirectoryEntry describes a cluster generated from a service, so that route authors can
+// find valid cluster names without reading a config dump.
+type ClusterDirectoryEntry struct {
+	// Cluster is the name of the generated cluster.
+	Cluster string `json:"cluster"`
+	// Namespace and Service identify the service the cluster was generated from.
+	Namespace string `json:"namespace"`
+	Service   string `json:"service"`
+	// Port is the service port, or 0 for clusters that aren't tied to a single port.
+	Port int32 `json:"port,omitempty"`
+	// DNSName is the service's cluster-internal DNS name.
+	DNSName string `json:"dns_name"`
+	// Hostnames are the public hostnames of the service, from its ExternalDNSHostnameAnnotation.
+	Hostnames []string `json:"hostnames,omitempty"`
+}
+
+// directoryEntries returns directory entries for the clusters generated from svc.
+func directoryEntries(svc *v1.Service, clusters []*envoy_config_cluster_v3.Cluster, ports map[*envoy_config_cluster_v3.Cluster]*v1.ServicePort) []*ClusterDirectoryEntry {
+	var result []*ClusterDirectoryEntry
+	hostnames := externalHostnames(svc)
+	for _, cl := range clusters {
+		e := &ClusterDirectoryEntry{
+			Cluster:   cl.GetName(),
+			Namespace: svc.GetNamespace(),
+			Service:   svc.GetName(),
+			DNSName:   fmt.Sprintf("%s.%s.svc.cluster.local", svc.GetName(), svc.GetNamespace()),
+			Hostnames: hostnames,
+		}
+		if p, ok := ports[cl]; ok {
+			e.Port = p.Port
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+// Directory returns an entry for every cluster generated from a service, sorted by cluster name.
+// Aggregate clusters, which don't correspond to a single service, are not included.
+func (cs *ClusterStore) Directory() []*ClusterDirectoryEntry {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	result := make([]*ClusterDirectoryEntry, 0, len(cs.directory))
+	for _, e := range cs.directory {
+		result = append(result, e)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Cluster < result[j].Cluster })
+	return result
+}
+
+// DirectoryAsYAML returns the directory as YAML.
+func (cs *ClusterStore) DirectoryAsYAML() ([]byte, error) {
+	return yaml.Marshal(cs.Directory())
+}
+
+// ServeHTTP serves the directory as YAML.
+func (cs *ClusterStore) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ya, err := cs.DirectoryAsYAML()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(ya)
+}
@@ -0,0 +1,333 @@
+package glue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/jrockway/ekglue/pkg/cds"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+var edsProxyWatches = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "ekglue_eds_proxy_watches",
+	Help: "The number of services whose EndpointSlices the EDS proxy is watching, because a client is subscribed to one of their clusters.",
+})
+
+// EDSProxyConfig configures the EDS proxy mode, in which ekglue serves only load assignments, for
+// clusters that are defined elsewhere, like by a CDS server that isn't ekglue.  Clusters aren't
+// generated from services; instead, when a client subscribes to the load assignment of a cluster
+// whose name matches ClusterNamePattern, the EndpointSlices of the service it names are watched
+// until no client is subscribed to any of its clusters.
+type EDSProxyConfig struct {
+	// ClusterNamePattern is a regular expression that matches the whole name of each cluster to
+	// serve.  Its named groups "namespace", "service", and "port" select the service and port
+	// whose endpoints the cluster receives; the namespace is "default" if there is no such group,
+	// and the port is a port name, or the number that the pods listen on for unnamed ports.  For
+	// example, "(?P<service>[^.]+)\.(?P<namespace>[^.]+)\.(?P<port>[^.]+)" matches names like
+	// "api.prod.grpc".
+	ClusterNamePattern string `json:"cluster_name_pattern"`
+
+	pattern   *regexp.Regexp  // compiled ClusterNamePattern
+	endpoints *EndpointConfig // from Config.EndpointConfig
+}
+
+func (c *EDSProxyConfig) UnmarshalJSON(b []byte) error {
+	tmp := struct {
+		ClusterNamePattern string `json:"cluster_name_pattern"`
+	}{}
+	if err := json.Unmarshal(b, &tmp); err != nil {
+		return fmt.Errorf("EDSProxyConfig: unmarshal into temporary structure: %w", err)
+	}
+	c.ClusterNamePattern, c.pattern = tmp.ClusterNamePattern, nil
+	if tmp.ClusterNamePattern != "" {
+		re, err := regexp.Compile("^(?:" + tmp.ClusterNamePattern + ")$")
+		if err != nil {
+			return fmt.Errorf("EDSProxyConfig: cluster_name_pattern: %w", err)
+		}
+		c.pattern = re
+	}
+	return nil
+}
+
+// Validate returns an error if ClusterNamePattern is missing or can't select a service and port.
+func (c *EDSProxyConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.pattern == nil {
+		return fmt.Errorf("cluster_name_pattern is required")
+	}
+	for _, group := range []string{"service", "port"} {
+		if c.pattern.SubexpIndex(group) < 0 {
+			return fmt.Errorf("cluster_name_pattern: no group named %q", group)
+		}
+	}
+	return nil
+}
+
+// proxyTarget is the service port that a proxied cluster receives the endpoints of.
+type proxyTarget struct {
+	service types.NamespacedName
+	port    string
+}
+
+// resolve returns the service port that the named cluster receives the endpoints of, or false if
+// the name doesn't match ClusterNamePattern.
+func (c *EDSProxyConfig) resolve(name string) (proxyTarget, bool) {
+	m := c.pattern.FindStringSubmatch(name)
+	if m == nil {
+		return proxyTarget{}, false
+	}
+	t := proxyTarget{service: types.NamespacedName{Namespace: v1.NamespaceDefault}}
+	if i := c.pattern.SubexpIndex("namespace"); i >= 0 && m[i] != "" {
+		t.service.Namespace = m[i]
+	}
+	t.service.Name, t.port = m[c.pattern.SubexpIndex("service")], m[c.pattern.SubexpIndex("port")]
+	if t.service.Name == "" || t.port == "" {
+		return proxyTarget{}, false
+	}
+	return t, true
+}
+
+// WatchServiceFunc watches the EndpointSlices of one service, sending changes to s, until ctx is
+// done, like k8s.ClusterWatcher.WatchServiceEndpointSlices.
+type WatchServiceFunc func(ctx context.Context, namespace, service string, s cache.Store) error
+
+// EDSProxy serves the load assignments of the clusters that clients subscribe to, as configured by
+// an EDSProxyConfig.  Pass its Subscribe method to the endpoint manager's OnSubscribe.
+type EDSProxy struct {
+	cfg       *EDSProxyConfig
+	srv       *cds.Server
+	nodeStore cache.Store
+	watch     WatchServiceFunc
+	ctx       context.Context
+
+	mu         sync.Mutex
+	subscribed map[string]proxyTarget // the matching names that clients are subscribed to
+	services   map[types.NamespacedName]*proxiedService
+}
+
+// proxiedService is a service whose EndpointSlices are being watched.
+type proxiedService struct {
+	cancel func()
+	synced bool // true once the watch has listed the service's slices
+	slices map[string]*discoveryv1.EndpointSlice
+}
+
+// Proxy returns an EDSProxy that starts watches with watch, which stop when ctx is done.
+func (c *EDSProxyConfig) Proxy(ctx context.Context, nodeStore cache.Store, s *cds.Server, watch WatchServiceFunc) *EDSProxy {
+	return &EDSProxy{
+		cfg:        c,
+		srv:        s,
+		nodeStore:  nodeStore,
+		watch:      watch,
+		ctx:        ctx,
+		subscribed: make(map[string]proxyTarget),
+		services:   make(map[types.NamespacedName]*proxiedService),
+	}
+}
+
+// Subscribe starts serving the load assignments of the named clusters that match the config's
+// pattern, and stops serving any others; names are every resource that clients are subscribed to.
+// The EndpointSlices of a service are only watched while one of its clusters is subscribed to.
+func (p *EDSProxy) Subscribe(names []string) {
+	ctx, c := startOp("edsproxy", "subscribe")
+	defer c()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	subscribed := make(map[string]proxyTarget)
+	for _, name := range names {
+		if t, ok := p.cfg.resolve(name); ok {
+			subscribed[name] = t
+		}
+	}
+	for name := range p.subscribed {
+		if _, ok := subscribed[name]; !ok {
+			p.srv.DeleteEndpoints(ctx, name)
+		}
+	}
+	p.subscribed = subscribed
+
+	needed := make(map[types.NamespacedName]struct{})
+	for _, t := range subscribed {
+		needed[t.service] = struct{}{}
+	}
+	for key, ps := range p.services {
+		if _, ok := needed[key]; !ok {
+			ps.cancel()
+			delete(p.services, key)
+		}
+	}
+	for key := range needed {
+		if _, ok := p.services[key]; ok {
+			continue
+		}
+		wctx, cancel := context.WithCancel(p.ctx)
+		ps := &proxiedService{cancel: cancel, slices: make(map[string]*discoveryv1.EndpointSlice)}
+		p.services[key] = ps
+		go func(key types.NamespacedName) {
+			if err := p.watch(wctx, key.Namespace, key.Name, &proxyStore{p: p, ps: ps}); err != nil {
+				zap.L().Error("eds proxy watch exited", zap.String("service", key.String()), zap.Error(err))
+			}
+		}(key)
+	}
+	edsProxyWatches.Set(float64(len(p.services)))
+	// Clusters of services that are already watched can be served right away.
+	if err := p.publish(ctx, nil); err != nil {
+		zap.L().Error("eds proxy: problem serving load assignments", zap.Error(err))
+	}
+}
+
+// publish serves the load assignments of every subscribed cluster of the synced service ps, or of
+// every synced service if ps is nil.  A cluster whose service has no endpoints for its port is
+// served with none, so that clients don't wait for it.  You must hold p.mu.
+func (p *EDSProxy) publish(ctx context.Context, ps *proxiedService) error {
+	var result []*envoy_config_endpoint_v3.ClusterLoadAssignment
+	for name, t := range p.subscribed {
+		svc, ok := p.services[t.service]
+		if !ok || !svc.synced || (ps != nil && svc != ps) {
+			continue
+		}
+		slices := make([]*discoveryv1.EndpointSlice, 0, len(svc.slices))
+		for _, es := range svc.slices {
+			slices = append(slices, es)
+		}
+		cla := &envoy_config_endpoint_v3.ClusterLoadAssignment{ClusterName: name}
+		if clas := p.cfg.endpoints.loadAssignments(p.nodeStore, slices, func(_ *discoveryv1.EndpointSlice, port discoveryv1.EndpointPort) (string, envoy_config_core_v3.SocketAddress_Protocol) {
+			if !t.matches(port) {
+				return "", 0
+			}
+			// The generated name is ignored, but tells us whether the protocol is supported.
+			if n, protocol := p.cfg.endpoints.naming.nameCluster(t.service.Namespace, t.service.Name, withDefault(port.Name, ""), *port.Port, withDefault(port.Protocol, "TCP")); n != "" {
+				return name, protocol
+			}
+			return "", 0
+		}); len(clas) > 0 {
+			cla = clas[0]
+		}
+		result = append(result, cla)
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	p.cfg.endpoints.weighLocalities(result)
+	return p.srv.AddEndpoints(ctx, result)
+}
+
+// matches returns true if port is the target's port, by name or by number.
+func (t proxyTarget) matches(port discoveryv1.EndpointPort) bool {
+	if name := withDefault(port.Name, ""); name != "" {
+		return name == t.port
+	}
+	return strconv.Itoa(int(*port.Port)) == t.port
+}
+
+// proxyStore is a cache.Store that receives the EndpointSlices of one proxied service.
+type proxyStore struct {
+	p  *EDSProxy
+	ps *proxiedService
+}
+
+func (s *proxyStore) Add(obj interface{}) error {
+	return s.update("add", func() error {
+		es, ok := obj.(*discoveryv1.EndpointSlice)
+		if !ok {
+			return fmt.Errorf("got non-endpointslice object: %#v", obj)
+		}
+		s.ps.slices[es.Name] = es
+		return nil
+	})
+}
+
+func (s *proxyStore) Update(obj interface{}) error {
+	return s.Add(obj)
+}
+
+func (s *proxyStore) Delete(obj interface{}) error {
+	return s.update("delete", func() error {
+		if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = d.Obj
+		}
+		es, ok := obj.(*discoveryv1.EndpointSlice)
+		if !ok {
+			return fmt.Errorf("got non-endpointslice object: %#v", obj)
+		}
+		delete(s.ps.slices, es.Name)
+		return nil
+	})
+}
+
+func (s *proxyStore) List() []interface{} {
+	return nil
+}
+
+func (s *proxyStore) ListKeys() []string {
+	return nil
+}
+
+func (s *proxyStore) Get(obj interface{}) (item interface{}, exists bool, err error) {
+	return nil, false, nil
+}
+
+func (s *proxyStore) GetByKey(key string) (item interface{}, exists bool, err error) {
+	return nil, false, nil
+}
+
+func (s *proxyStore) Replace(objs []interface{}, _ string) error {
+	return s.update("replace", func() error {
+		slices := make(map[string]*discoveryv1.EndpointSlice)
+		for _, obj := range objs {
+			es, ok := obj.(*discoveryv1.EndpointSlice)
+			if !ok {
+				return fmt.Errorf("got non-endpointslice object: %#v", obj)
+			}
+			slices[es.Name] = es
+		}
+		s.ps.slices, s.ps.synced = slices, true
+		return nil
+	})
+}
+
+func (s *proxyStore) Resync() error {
+	return nil
+}
+
+// update applies a change to the service's slices with fn, and serves the resulting load
+// assignments, unless the service is no longer proxied.
+func (s *proxyStore) update(op string, fn func() error) error {
+	ctx, c := startOp("edsproxy", op)
+	defer c()
+
+	s.p.mu.Lock()
+	defer s.p.mu.Unlock()
+	if err := fn(); err != nil {
+		logError(ctx)
+		return fmt.Errorf("%s endpointslice: %w", op, err)
+	}
+	if !s.ps.synced {
+		return nil
+	}
+	for _, ps := range s.p.services {
+		if ps == s.ps {
+			if err := s.p.publish(ctx, s.ps); err != nil {
+				logError(ctx)
+				return fmt.Errorf("%s endpoints: %w", op, err)
+			}
+			return nil
+		}
+	}
+	return nil
+}
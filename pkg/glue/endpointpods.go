@@ -0,0 +1,162 @@
+package glue
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+// refresh regenerates the load assignments of every service that has an endpoint that affects
+// returns true for, for changes to something other than the EndpointSlices, like the pods behind
+// them.  The set of load assignments doesn't change, only their contents.
+func (s *EndpointStore) refresh(ctx context.Context, affects func(ep discoveryv1.Endpoint) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []types.NamespacedName
+	for key, svcESs := range s.serverESs {
+		if slicesAffected(svcESs, affects) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	var changed []*discoveryv1.EndpointSlice
+	var loadAssignments []*envoy_config_endpoint_v3.ClusterLoadAssignment
+	for _, key := range keys {
+		slices := maps.Values(s.serverESs[key])
+		loadAssignments = append(loadAssignments, s.serviceLoadAssignments(key, slices)...)
+		changed = append(changed, slices...)
+	}
+	loadAssignments = append(loadAssignments, s.aggregateLoadAssignments(changed...)...)
+	if err := s.srv.AddEndpoints(ctx, loadAssignments); err != nil {
+		return fmt.Errorf("refresh endpoints: %w", err)
+	}
+	return nil
+}
+
+// slicesAffected returns true if any endpoint of slices is one that affects returns true for.
+func slicesAffected(slices map[string]*discoveryv1.EndpointSlice, affects func(ep discoveryv1.Endpoint) bool) bool {
+	for _, es := range slices {
+		for _, ep := range es.Endpoints {
+			if affects(ep) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// podWatcher is a cache.Store of pods that regenerates the load assignments of the services whose
+// endpoints refer to a pod whenever the pod appears, disappears, or changes its labels or
+// annotations, so that tracks, PodWeights, Capacity.PodAnnotation, and PodLabelMetadata follow
+// pods that are relabeled or re-annotated while they run.
+type podWatcher struct {
+	cache.Store
+	s *EndpointStore
+
+	mu sync.Mutex // serializes changes, so that the previous version of a pod can be compared
+}
+
+// PodStore returns a cache.Store that sends pods to pods, and keeps the load assignments generated
+// from them up to date.  It returns pods unchanged if load assignments don't depend on pods.
+func (s *EndpointStore) PodStore(pods cache.Store) cache.Store {
+	if len(s.cfg.tracks) == 0 && !s.cfg.PodWeights && (s.cfg.Capacity == nil || s.cfg.Capacity.PodAnnotation == "") && len(s.cfg.PodLabelMetadata) == 0 && len(s.cfg.subsetLabels) == 0 {
+		return pods
+	}
+	return &podWatcher{Store: pods, s: s}
+}
+
+// refresh regenerates the load assignments of the services with endpoints that refer to any of
+// pods.
+func (w *podWatcher) refresh(pods ...*v1.Pod) {
+	ctx, c := startOp("pods", "refresh endpoints")
+	defer c()
+	keys := make(map[types.NamespacedName]struct{})
+	for _, pod := range pods {
+		if pod != nil {
+			keys[types.NamespacedName{Namespace: pod.GetNamespace(), Name: pod.GetName()}] = struct{}{}
+		}
+	}
+	err := w.s.refresh(ctx, func(ep discoveryv1.Endpoint) bool {
+		if ep.TargetRef == nil || ep.TargetRef.Kind != "Pod" {
+			return false
+		}
+		_, ok := keys[types.NamespacedName{Namespace: ep.TargetRef.Namespace, Name: ep.TargetRef.Name}]
+		return ok
+	})
+	if err != nil {
+		logError(ctx)
+		zap.L().Warn("problem regenerating load assignments after a pod change", zap.Error(err))
+	}
+}
+
+// old returns the version of pod in the store, if any.
+func (w *podWatcher) old(pod *v1.Pod) *v1.Pod {
+	obj, ok, err := w.Store.Get(pod)
+	if err != nil || !ok {
+		return nil
+	}
+	old, _ := obj.(*v1.Pod)
+	return old
+}
+
+func (w *podWatcher) Add(obj interface{}) error {
+	return w.Update(obj)
+}
+
+func (w *podWatcher) Update(obj interface{}) error {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return w.Store.Update(obj)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	old := w.old(pod)
+	if err := w.Store.Update(pod); err != nil {
+		return err
+	}
+	if old != nil && equality.Semantic.DeepEqual(old.GetLabels(), pod.GetLabels()) && equality.Semantic.DeepEqual(old.GetAnnotations(), pod.GetAnnotations()) {
+		return nil
+	}
+	w.refresh(pod)
+	return nil
+}
+
+func (w *podWatcher) Delete(obj interface{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.Store.Delete(obj); err != nil {
+		return err
+	}
+	if pod, ok := obj.(*v1.Pod); ok {
+		w.refresh(pod)
+	}
+	return nil
+}
+
+func (w *podWatcher) Replace(objs []interface{}, resourceVersion string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.Store.Replace(objs, resourceVersion); err != nil {
+		return err
+	}
+	ctx, c := startOp("pods", "replace endpoints")
+	defer c()
+	if err := w.s.refresh(ctx, func(ep discoveryv1.Endpoint) bool { return ep.TargetRef != nil && ep.TargetRef.Kind == "Pod" }); err != nil {
+		logError(ctx)
+		zap.L().Warn("problem regenerating load assignments after listing pods", zap.Error(err))
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package glue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	"github.com/jrockway/ekglue/pkg/cds"
+	"github.com/jrockway/ekglue/pkg/xds"
+	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
+	"google.golang.org/protobuf/encoding/protojson"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+// DefaultEnvoyClusterPrefix starts the name of every cluster generated from an EnvoyCluster.
+const DefaultEnvoyClusterPrefix = "crd:"
+
+// EnvoyClusterConfig configures serving clusters that users declare with EnvoyCluster custom
+// resources (see k8s.EnvoyClusterResource), like external databases and partner APIs, alongside
+// the clusters generated from services.  An EnvoyCluster's spec is an Envoy Cluster, in the same
+// JSON form as cluster_config.base_config; its name is ignored, and replaced with the prefix
+// followed by the EnvoyCluster's namespace and name, like "crd:payments:stripe", so that teams
+// can't take over each other's clusters or generated ones.  An EDS cluster gets no endpoints from
+// ekglue, so EnvoyClusters should use inline load assignments.
+type EnvoyClusterConfig struct {
+	// Prefix starts the name of each cluster; it defaults to DefaultEnvoyClusterPrefix.  The
+	// stores that generate clusters from services leave clusters with this prefix alone.
+	Prefix string `json:"prefix"`
+	// Namespaces, if not empty, are the only namespaces whose EnvoyClusters are served; those in
+	// other namespaces are ignored.
+	Namespaces []string `json:"namespaces"`
+}
+
+// ClusterPrefix returns the prefix of the name of every cluster generated from an EnvoyCluster.
+func (c *EnvoyClusterConfig) ClusterPrefix() string {
+	if c.Prefix == "" {
+		return DefaultEnvoyClusterPrefix
+	}
+	return c.Prefix
+}
+
+// allowed returns true if EnvoyClusters in namespace are served.
+func (c *EnvoyClusterConfig) allowed(namespace string) bool {
+	return len(c.Namespaces) == 0 || slices.Contains(c.Namespaces, namespace)
+}
+
+// envoyCluster is an EnvoyCluster and the cluster translated from it.  If the EnvoyCluster can't
+// be served, cluster is nil and err says why.
+type envoyCluster struct {
+	key     string
+	cluster *envoy_config_cluster_v3.Cluster
+	err     error
+}
+
+// parseEnvoyCluster translates an unstructured EnvoyCluster into a cluster.
+func (c *EnvoyClusterConfig) parseEnvoyCluster(obj interface{}) (*envoyCluster, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("got non-unstructured object %#v", obj)
+	}
+	result := &envoyCluster{key: u.GetNamespace() + "/" + u.GetName()}
+	if !c.allowed(u.GetNamespace()) {
+		result.err = fmt.Errorf("namespace %q may not declare clusters", u.GetNamespace())
+		return result, nil
+	}
+	spec, _, _ := unstructured.NestedMap(u.Object, "spec")
+	js, err := json.Marshal(spec)
+	if err != nil {
+		result.err = fmt.Errorf("marshal spec: %w", err)
+		return result, nil
+	}
+	cluster := new(envoy_config_cluster_v3.Cluster)
+	if err := protojson.Unmarshal(js, cluster); err != nil {
+		result.err = fmt.Errorf("unmarshal spec: %w", err)
+		return result, nil
+	}
+	cluster.Name = c.ClusterPrefix() + u.GetNamespace() + ":" + u.GetName()
+	if err := cluster.ValidateAll(); err != nil {
+		result.err = fmt.Errorf("validate cluster: %w", err)
+		return result, nil
+	}
+	result.cluster = cluster
+	return result, nil
+}
+
+// EnvoyClusterStore is a cache.Store that receives EnvoyClusters (as *unstructured.Unstructured)
+// and keeps the clusters declared by them up to date on the xDS server.  EnvoyClusters that can't
+// be served are logged and skipped, and listed by Invalid.
+type EnvoyClusterStore struct {
+	cfg *EnvoyClusterConfig
+	s   *cds.Server
+
+	mu       sync.Mutex
+	clusters map[string]*envoyCluster
+}
+
+// Store returns a cache.Store that allows a Kubernetes reflector to sync EnvoyCluster changes to a
+// CDS server.
+func (c *EnvoyClusterConfig) Store(s *cds.Server) *EnvoyClusterStore {
+	return &EnvoyClusterStore{
+		cfg:      c,
+		s:        s,
+		clusters: make(map[string]*envoyCluster),
+	}
+}
+
+// owns returns true if the named cluster was generated from an EnvoyCluster.
+func (es *EnvoyClusterStore) owns(name string) bool {
+	return strings.HasPrefix(name, es.cfg.ClusterPrefix())
+}
+
+// push replaces the clusters generated from EnvoyClusters.  You must hold the lock.
+func (es *EnvoyClusterStore) push(ctx context.Context) error {
+	var clusters []xds.Resource
+	for _, ec := range es.clusters {
+		if ec.cluster != nil {
+			clusters = append(clusters, ec.cluster)
+		}
+	}
+	if err := es.s.Clusters.ReplaceMatching(ctx, clusters, es.owns); err != nil {
+		return fmt.Errorf("replace clusters: %w", err)
+	}
+	return nil
+}
+
+func (es *EnvoyClusterStore) update(op string, obj interface{}, updateFn func(ec *envoyCluster)) error {
+	ctx, c := startOp("envoy_clusters", op)
+	defer c()
+	ec, err := es.cfg.parseEnvoyCluster(obj)
+	if err != nil {
+		logError(ctx)
+		return fmt.Errorf("%s envoy cluster: %w", op, err)
+	}
+	if ec.err != nil && op != "delete" {
+		zap.L().Warn("skipping invalid envoy cluster", zap.String("envoy_cluster", ec.key), zap.Error(ec.err))
+	}
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	updateFn(ec)
+	if err := es.push(ctx); err != nil {
+		logError(ctx)
+		return fmt.Errorf("%s envoy cluster: %w", op, err)
+	}
+	return nil
+}
+
+func (es *EnvoyClusterStore) Add(obj interface{}) error {
+	return es.update("add", obj, func(ec *envoyCluster) { es.clusters[ec.key] = ec })
+}
+
+func (es *EnvoyClusterStore) Update(obj interface{}) error {
+	return es.update("update", obj, func(ec *envoyCluster) { es.clusters[ec.key] = ec })
+}
+
+func (es *EnvoyClusterStore) Delete(obj interface{}) error {
+	return es.update("delete", obj, func(ec *envoyCluster) { delete(es.clusters, ec.key) })
+}
+
+func (es *EnvoyClusterStore) List() []interface{} {
+	return nil
+}
+
+// ListKeys returns the namespace/name of every known EnvoyCluster.
+func (es *EnvoyClusterStore) ListKeys() []string {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	result := maps.Keys(es.clusters)
+	sort.Strings(result)
+	return result
+}
+
+// Invalid returns the reason that each EnvoyCluster that can't be served was skipped, by
+// namespace/name.
+func (es *EnvoyClusterStore) Invalid() map[string]string {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	result := make(map[string]string)
+	for key, ec := range es.clusters {
+		if ec.err != nil {
+			result[key] = ec.err.Error()
+		}
+	}
+	return result
+}
+
+// ServeInvalid is an http.Handler that serves Invalid as YAML.
+func (es *EnvoyClusterStore) ServeInvalid(w http.ResponseWriter, req *http.Request) {
+	ya, err := yaml.Marshal(es.Invalid())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(ya)
+}
+
+func (es *EnvoyClusterStore) Get(obj interface{}) (item interface{}, exists bool, err error) {
+	return nil, false, errors.New("EnvoyClusterStore.Get unimplemented")
+}
+
+func (es *EnvoyClusterStore) GetByKey(key string) (item interface{}, exists bool, err error) {
+	return nil, false, errors.New("EnvoyClusterStore.GetByKey unimplemented")
+}
+
+func (es *EnvoyClusterStore) Replace(objs []interface{}, _ string) error {
+	ctx, c := startOp("envoy_clusters", "replace")
+	defer c()
+	clusters := make(map[string]*envoyCluster)
+	for _, obj := range objs {
+		ec, err := es.cfg.parseEnvoyCluster(obj)
+		if err != nil {
+			logError(ctx)
+			return fmt.Errorf("replace envoy clusters: %w", err)
+		}
+		if ec.err != nil {
+			zap.L().Warn("skipping invalid envoy cluster", zap.String("envoy_cluster", ec.key), zap.Error(ec.err))
+		}
+		clusters[ec.key] = ec
+	}
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.clusters = clusters
+	if err := es.push(ctx); err != nil {
+		logError(ctx)
+		return fmt.Errorf("replace envoy clusters: %w", err)
+	}
+	return nil
+}
+
+func (es *EnvoyClusterStore) Resync() error {
+	// Nothing to do.
+	return nil
+}
@@ -0,0 +1,67 @@
+package glue
+
+import (
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// ExternalDNSHostnameAnnotation is the annotation that external-dns reads a service's public
+// hostnames from, as a comma-separated list.  ekglue records the same hostnames in the cluster
+// directory, so that other systems can find the Envoy clusters that serve a hostname.
+const ExternalDNSHostnameAnnotation = "external-dns.alpha.kubernetes.io/hostname"
+
+// DefaultDNSRecordPrefix is prepended to a hostname to name the TXT record that lists the clusters
+// serving it, so that the record doesn't collide with the hostname's own records or with
+// external-dns's TXT registry.
+const DefaultDNSRecordPrefix = "_ekglue."
+
+// DNSRecord is a DNS record, in the format of an endpoint of external-dns's DNSEndpoint resource.
+type DNSRecord struct {
+	DNSName    string   `json:"dnsName"`
+	RecordType string   `json:"recordType"`
+	Targets    []string `json:"targets"`
+}
+
+// externalHostnames returns the sorted, normalized hostnames in svc's
+// ExternalDNSHostnameAnnotation.
+func externalHostnames(svc *v1.Service) []string {
+	seen := make(map[string]struct{})
+	var result []string
+	for _, h := range strings.Split(svc.GetAnnotations()[ExternalDNSHostnameAnnotation], ",") {
+		h = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(h)), ".")
+		if h == "" {
+			continue
+		}
+		if _, ok := seen[h]; ok {
+			continue
+		}
+		seen[h] = struct{}{}
+		result = append(result, h)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// DNSRecords returns a TXT record for every hostname in the directory, named by prepending prefix
+// to the hostname, that lists the clusters serving it as "ekglue-cluster=<name>".  Records are
+// sorted by name.
+func (cs *ClusterStore) DNSRecords(prefix string) []*DNSRecord {
+	clusters := make(map[string][]string)
+	for _, e := range cs.Directory() {
+		for _, h := range e.Hostnames {
+			clusters[h] = append(clusters[h], "ekglue-cluster="+e.Cluster)
+		}
+	}
+	result := make([]*DNSRecord, 0, len(clusters))
+	for h, targets := range clusters {
+		result = append(result, &DNSRecord{
+			DNSName:    prefix + h,
+			RecordType: "TXT",
+			Targets:    targets, // Directory is sorted by cluster name.
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].DNSName < result[j].DNSName })
+	return result
+}
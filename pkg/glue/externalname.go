@@ -0,0 +1,47 @@
+package glue
+
+import (
+	"fmt"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	v1 "k8s.io/api/core/v1"
+)
+
+// ExternalNameConfig translates ExternalName services, which alias a hostname outside the cluster
+// and have no endpoints, into DNS clusters that resolve that hostname directly, so that apps that
+// reach external dependencies through such aliases keep working behind Envoy.  Like any other
+// service, an ExternalName service only generates clusters for the ports it lists.  To skip
+// ExternalName services entirely, list ExternalName in exclude_service_types.
+type ExternalNameConfig struct {
+	// DNSType is the type of the generated clusters: STRICT_DNS, the default, which balances
+	// across every address the hostname resolves to, or LOGICAL_DNS, which connects to one
+	// address at a time and suits large services behind DNS load balancing.
+	DNSType string `json:"dns_type"`
+}
+
+// Validate returns an error if the DNS type is unknown.
+func (c *ExternalNameConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	switch c.DNSType {
+	case "", "STRICT_DNS", "LOGICAL_DNS":
+		return nil
+	}
+	return fmt.Errorf("unknown dns_type %q; expected STRICT_DNS or LOGICAL_DNS", c.DNSType)
+}
+
+// isExternal returns true if the clusters of svc should resolve its external name.
+func (c *ExternalNameConfig) isExternal(svc *v1.Service) bool {
+	return c != nil && svc.Spec.Type == v1.ServiceTypeExternalName && svc.Spec.ExternalName != ""
+}
+
+// apply makes cl a DNS cluster that connects to port on the external name of svc.
+func (c *ExternalNameConfig) apply(cl *envoy_config_cluster_v3.Cluster, svc *v1.Service, port int32, protocol envoy_config_core_v3.SocketAddress_Protocol) {
+	t := envoy_config_cluster_v3.Cluster_STRICT_DNS
+	if c.DNSType == "LOGICAL_DNS" {
+		t = envoy_config_cluster_v3.Cluster_LOGICAL_DNS
+	}
+	dnsCluster(cl, t, svc.Spec.ExternalName, port, protocol)
+}
@@ -6,15 +6,19 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
+	"slices"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	envoy_config_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	envoy_config_route_v3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 	"golang.org/x/exp/maps"
 
 	// for config loading
@@ -30,6 +34,7 @@ import (
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
 	v1 "k8s.io/api/core/v1"
 	discoveryv1 "k8s.io/api/discovery/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -63,6 +68,10 @@ type Matcher struct {
 	//
 	// You cannot match an unnamed port with an empty port_name.
 	PortName string `json:"port_name"`
+	// Port matches the number of a service port (not its target port), for services whose ports
+	// aren't named consistently.  EndpointSlices only carry target ports, so an EndpointStore
+	// must be linked to its ClusterStore with Stores.Link to match load assignments by port.
+	Port int32 `json:"port"`
 }
 
 // Evaluate returns true if the matcher matches the provided objects.
@@ -79,28 +88,38 @@ func (m *Matcher) Evaluate(cluster *envoy_config_cluster_v3.Cluster, svc *v1.Ser
 	if m.PortName != "" {
 		return m.PortName == port.Name
 	}
+	if m.Port != 0 {
+		return m.Port == port.Port
+	}
 	return false
 }
 
 type ClusterOverride struct {
 	// Match specifies a cluster to match; multiple items are OR'd.
-	Match []*Matcher
+	Match []*Matcher `json:"match"`
 	// Configuration to override if a matcher matches.
-	Override *envoy_config_cluster_v3.Cluster
+	Override *envoy_config_cluster_v3.Cluster `json:"override"`
+	// Strategy is how Override is merged into the cluster: OverrideStrategyMerge (the default) or
+	// OverrideStrategyStrategic.
+	Strategy string `json:"strategy"`
 	// If true, suppress the cluster completely.
-	Suppress bool
+	Suppress bool `json:"suppress"`
+
+	fields *presence // the fields that Override mentions, for strategic merges
 }
 
 func (o *ClusterOverride) UnmarshalJSON(b []byte) error {
 	tmp := struct {
 		Match    []*Matcher      `json:"match"`
 		Override json.RawMessage `json:"override"`
+		Strategy string          `json:"strategy"`
 		Suppress bool            `json:"suppress"`
 	}{}
 	if err := json.Unmarshal(b, &tmp); err != nil {
 		return fmt.Errorf("ClusterOverride: unmarshal into temporary structure: %w", err)
 	}
 	o.Match = tmp.Match
+	o.Strategy = tmp.Strategy
 	o.Suppress = tmp.Suppress
 	if len(tmp.Override) > 0 {
 		base := &envoy_config_cluster_v3.Cluster{}
@@ -109,6 +128,19 @@ func (o *ClusterOverride) UnmarshalJSON(b []byte) error {
 		}
 		o.Override = base
 	}
+	switch o.Strategy {
+	case "", OverrideStrategyMerge:
+	case OverrideStrategyStrategic:
+		if o.Override != nil {
+			fields, err := parsePresence(o.Override.ProtoReflect().Descriptor(), tmp.Override)
+			if err != nil {
+				return fmt.Errorf("ClusterOverride: Override: %w", err)
+			}
+			o.fields = fields
+		}
+	default:
+		return fmt.Errorf("ClusterOverride: unknown strategy %q; expected %q or %q", o.Strategy, OverrideStrategyMerge, OverrideStrategyStrategic)
+	}
 	if len(o.Match) == 0 {
 		return fmt.Errorf("ClusterOverride: no matching rules provided")
 	}
@@ -121,23 +153,189 @@ func (o *ClusterOverride) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// NamespaceDefaults is configuration merged into the base config for every cluster generated from a
+// service in one of a set of namespaces, before any ClusterOverride is applied.  This lets a
+// platform team give a namespace its own defaults (mTLS, a load balancing policy, etc.) while
+// leaving per-service overrides to work as usual.
+type NamespaceDefaults struct {
+	// Namespaces are the namespaces to apply the defaults to.
+	Namespaces []string `json:"namespaces"`
+	// Defaults is merged into the base config.
+	Defaults *envoy_config_cluster_v3.Cluster `json:"defaults"`
+}
+
+func (d *NamespaceDefaults) UnmarshalJSON(b []byte) error {
+	tmp := struct {
+		Namespaces []string        `json:"namespaces"`
+		Defaults   json.RawMessage `json:"defaults"`
+	}{}
+	if err := json.Unmarshal(b, &tmp); err != nil {
+		return fmt.Errorf("NamespaceDefaults: unmarshal into temporary structure: %w", err)
+	}
+	if len(tmp.Namespaces) == 0 {
+		return fmt.Errorf("NamespaceDefaults: no namespaces provided")
+	}
+	if len(tmp.Defaults) == 0 {
+		return fmt.Errorf("NamespaceDefaults: no defaults provided")
+	}
+	d.Namespaces = tmp.Namespaces
+	d.Defaults = new(envoy_config_cluster_v3.Cluster)
+	if err := protojson.Unmarshal(tmp.Defaults, d.Defaults); err != nil {
+		return fmt.Errorf("NamespaceDefaults: unmarshal Defaults: %w", err)
+	}
+	return nil
+}
+
 // ClusterConfig configures creation of Envoy clusters from Kubernetes services.
 type ClusterConfig struct {
 	// The base configuration that should be used for all clusters.
 	BaseConfig *envoy_config_cluster_v3.Cluster `json:"base"`
+	// Per-namespace defaults, merged into the base config in order.
+	NamespaceDefaults []*NamespaceDefaults `json:"namespace_defaults"`
 	// Any rule-based overrides.
 	Overrides []*ClusterOverride `json:"overrides"`
+	// CollisionPolicy controls what happens when two services produce a cluster with the same
+	// name.  See the CollisionPolicy constants for the available values.
+	CollisionPolicy CollisionPolicy `json:"collision_policy"`
+	// AltStatName is a text/template that generates each cluster's alt_stat_name, so that stats
+	// keep a stable name even if the cluster naming scheme changes.  The template is executed
+	// with a TemplateData; '.' in the result is replaced with '_'.  An override that sets
+	// alt_stat_name takes precedence.
+	AltStatName string `json:"alt_stat_name"`
+	// GRPC, if set, additionally generates the listeners and routes needed by proxyless gRPC
+	// clients for matching ports.
+	GRPC *GRPCConfig `json:"grpc"`
+	// Listeners generates a listener for each matching port from a template.
+	Listeners []*ListenerTemplate `json:"listeners"`
+	// IncludeServiceTypes, if non-empty, limits translation to services of the listed types
+	// (ClusterIP, NodePort, LoadBalancer, ExternalName).  These filters also apply to the load
+	// assignments of an EndpointStore linked with Stores.Link.
+	IncludeServiceTypes []v1.ServiceType `json:"include_service_types"`
+	// ExcludeServiceTypes skips services of the listed types.  It is applied after
+	// IncludeServiceTypes.
+	ExcludeServiceTypes []v1.ServiceType `json:"exclude_service_types"`
+	// IncludeServices, if non-empty, limits translation to the services that one of the selectors
+	// selects, like those in "team-*" namespaces, or those that opt in with EnabledAnnotation.
+	IncludeServices []*ServiceSelector `json:"include_services"`
+	// ExcludeServices skips the services that any of the selectors selects.  It is applied after
+	// IncludeServices.
+	ExcludeServices []*ServiceSelector `json:"exclude_services"`
+	// ServiceAnnotations, if true, lets service owners tune their clusters with annotations like
+	// ekglue.io/connect-timeout (see the *Annotation constants).  Annotations are applied after
+	// overrides; invalid values are logged and ignored.
+	ServiceAnnotations bool `json:"service_annotations"`
+	// IgnoreAppProtocol, if true, stops ekglue from making clusters speak HTTP/2 to the ports whose
+	// appProtocol is "grpc" or "kubernetes.io/h2c".  Detected ports are configured before
+	// overrides and annotations, which can still turn HTTP/2 off.
+	IgnoreAppProtocol bool `json:"ignore_app_protocol"`
+	// TLSPassthrough, if set, generates a listener that routes raw TLS connections by SNI to the
+	// services that ask for it with the TLSPassthroughAnnotation.
+	TLSPassthrough *TLSPassthroughConfig `json:"tls_passthrough"`
+	// ExternalNames, if set, translates ExternalName services into DNS clusters for their
+	// external hostnames.  Otherwise, they are translated like any other service.
+	ExternalNames *ExternalNameConfig `json:"external_names"`
+	// HeadlessDNS matches the ports of headless services (clusterIP: None) whose clusters should
+	// resolve the service's DNS name, which returns the address of every ready pod, with
+	// STRICT_DNS, instead of getting their endpoints over EDS.  Workloads like StatefulSets that
+	// are addressed by DNS may need this.  Other ports are translated like any other service's.
+	HeadlessDNS []*Matcher `json:"headless_dns"`
+	// UpstreamTLS makes matching clusters connect to their endpoints over TLS.
+	UpstreamTLS []*UpstreamTLSConfig `json:"upstream_tls"`
+	// OutlierDetection is merged into the base config of every generated cluster, so that
+	// ejection of failing endpoints is configured in one place.  Namespace defaults and overrides
+	// can change individual fields.
+	OutlierDetection *envoy_config_cluster_v3.OutlierDetection `json:"outlier_detection"`
+	// CircuitBreakers is merged into the base config of every generated cluster.  Namespace
+	// defaults and overrides that set circuit_breakers change the thresholds of the same
+	// priority, rather than adding more thresholds.
+	CircuitBreakers *envoy_config_cluster_v3.CircuitBreakers `json:"circuit_breakers"`
+	// ReadinessHealthChecks, if set, generates active health checks from the readiness probes of
+	// the pods behind matching services.
+	ReadinessHealthChecks *ReadinessHealthCheckConfig `json:"readiness_health_checks"`
+
+	naming       *NamingConfig      // from Config.Naming
+	aggregates   []*Aggregate       // from Config.Aggregates
+	zoneClusters *ZoneClusterConfig // from Config.ZoneClusters
+	limits       *LimitsConfig      // from Config.Limits
+	tracks       []*TrackConfig     // from Config.Tracks
+	provenance   bool               // from Config.Provenance
+	allowlist    []*AllowlistRule   // from Config.Allowlist
+	loadWeights  bool               // from Config.EndpointConfig.LoadWeights
+	subsets      *SubsetConfig      // from Config.Subsets
+	pods         cache.Store        // from Config.EndpointConfig.PodStore, for ReadinessHealthChecks and subsets
+	altStatName  *template.Template
 }
 
 func (c *ClusterConfig) UnmarshalJSON(b []byte) error {
 	tmp := struct {
-		BaseConfig json.RawMessage    `json:"base"`
-		Overrides  []*ClusterOverride `json:"overrides"`
+		BaseConfig        json.RawMessage             `json:"base"`
+		NamespaceDefaults []*NamespaceDefaults        `json:"namespace_defaults"`
+		Overrides         []*ClusterOverride          `json:"overrides"`
+		CollisionPolicy   CollisionPolicy             `json:"collision_policy"`
+		AltStatName       string                      `json:"alt_stat_name"`
+		GRPC              *GRPCConfig                 `json:"grpc"`
+		Listeners         []*ListenerTemplate         `json:"listeners"`
+		IncludeTypes      []v1.ServiceType            `json:"include_service_types"`
+		ExcludeTypes      []v1.ServiceType            `json:"exclude_service_types"`
+		IncludeServices   []*ServiceSelector          `json:"include_services"`
+		ExcludeServices   []*ServiceSelector          `json:"exclude_services"`
+		Annotations       bool                        `json:"service_annotations"`
+		IgnoreAppProtocol bool                        `json:"ignore_app_protocol"`
+		TLSPassthrough    *TLSPassthroughConfig       `json:"tls_passthrough"`
+		ExternalNames     *ExternalNameConfig         `json:"external_names"`
+		HeadlessDNS       []*Matcher                  `json:"headless_dns"`
+		UpstreamTLS       []*UpstreamTLSConfig        `json:"upstream_tls"`
+		OutlierDetection  json.RawMessage             `json:"outlier_detection"`
+		CircuitBreakers   json.RawMessage             `json:"circuit_breakers"`
+		HealthChecks      *ReadinessHealthCheckConfig `json:"readiness_health_checks"`
 	}{}
 	if err := json.Unmarshal(b, &tmp); err != nil {
 		return fmt.Errorf("ClusterConfig: unmarshal into temporary structure: %w", err)
 	}
+	c.NamespaceDefaults = tmp.NamespaceDefaults
 	c.Overrides = tmp.Overrides
+	if err := tmp.CollisionPolicy.Validate(); err != nil {
+		return fmt.Errorf("ClusterConfig: %w", err)
+	}
+	c.CollisionPolicy = tmp.CollisionPolicy
+	c.GRPC = tmp.GRPC
+	c.Listeners = tmp.Listeners
+	for _, t := range append(tmp.IncludeTypes, tmp.ExcludeTypes...) {
+		if err := validateServiceType(t); err != nil {
+			return fmt.Errorf("ClusterConfig: %w", err)
+		}
+	}
+	c.IncludeServiceTypes, c.ExcludeServiceTypes = tmp.IncludeTypes, tmp.ExcludeTypes
+	c.IncludeServices, c.ExcludeServices = tmp.IncludeServices, tmp.ExcludeServices
+	c.ServiceAnnotations = tmp.Annotations
+	c.IgnoreAppProtocol = tmp.IgnoreAppProtocol
+	c.TLSPassthrough = tmp.TLSPassthrough
+	if err := tmp.ExternalNames.Validate(); err != nil {
+		return fmt.Errorf("ClusterConfig: external_names: %w", err)
+	}
+	c.ExternalNames = tmp.ExternalNames
+	c.HeadlessDNS = tmp.HeadlessDNS
+	c.UpstreamTLS = tmp.UpstreamTLS
+	c.ReadinessHealthChecks = tmp.HealthChecks
+	if len(tmp.OutlierDetection) > 0 {
+		c.OutlierDetection = new(envoy_config_cluster_v3.OutlierDetection)
+		if err := protojson.Unmarshal(tmp.OutlierDetection, c.OutlierDetection); err != nil {
+			return fmt.Errorf("ClusterConfig: unmarshal outlier_detection: %w", err)
+		}
+	}
+	if len(tmp.CircuitBreakers) > 0 {
+		c.CircuitBreakers = new(envoy_config_cluster_v3.CircuitBreakers)
+		if err := protojson.Unmarshal(tmp.CircuitBreakers, c.CircuitBreakers); err != nil {
+			return fmt.Errorf("ClusterConfig: unmarshal circuit_breakers: %w", err)
+		}
+	}
+	if tmp.AltStatName != "" {
+		t, err := template.New("alt_stat_name").Option("missingkey=error").Parse(tmp.AltStatName)
+		if err != nil {
+			return fmt.Errorf("ClusterConfig: parse alt_stat_name template: %w", err)
+		}
+		c.AltStatName, c.altStatName = tmp.AltStatName, t
+	}
 
 	base := &envoy_config_cluster_v3.Cluster{}
 	if err := protojson.Unmarshal(tmp.BaseConfig, base); err != nil {
@@ -161,17 +359,70 @@ type Field struct {
 	UseHostname bool   `json:"use_hostname"` // If true, use the hostname as the value of the field.
 }
 
-// LocalityConfig configures how to determine the locality of an endpoint.
+// LocalityConfig configures how to determine the locality of an endpoint.  The default derives the
+// region and zone from the well-known topology.kubernetes.io labels on the endpoint's node.  When
+// ZoneFrom is set but the zone can't be determined from the node, the zone that the EndpointSlice
+// reports for the endpoint is used.
 type LocalityConfig struct {
 	RegionFrom  *Field `json:"region_from"`
 	ZoneFrom    *Field `json:"zone_from"`
 	SubZoneFrom *Field `json:"sub_zone_from"`
 }
 
+// UnmarshalJSON replaces, rather than merges into, any existing configuration, so that a
+// configured locality doesn't inherit parts of the default.
+func (l *LocalityConfig) UnmarshalJSON(b []byte) error {
+	type plain LocalityConfig
+	tmp := new(plain)
+	if err := json.Unmarshal(b, tmp); err != nil {
+		return err
+	}
+	*l = LocalityConfig(*tmp)
+	return nil
+}
+
 // EndpointConfig configures creation of Envoy cluster load assignments from Kubernetes endpoints.
 type EndpointConfig struct {
+	// IncludeNotReady includes endpoints that are not ready, so that Envoy can use them when it
+	// panics, instead of leaving them out.  They are marked UNHEALTHY, or DRAINING if they are
+	// terminating; ready endpoints are always HEALTHY.
 	IncludeNotReady bool            `json:"include_not_ready"`
 	Locality        *LocalityConfig `json:"locality"`
+	// CiliumIdentityMetadata adds the Cilium security identity of each endpoint, read from
+	// CiliumEndpoint objects, to the endpoint's metadata under "io.cilium".
+	CiliumIdentityMetadata bool `json:"cilium_identity_metadata"`
+	// AddressRewrites rewrite endpoint addresses and ports before they are served.  The first
+	// matching rule applies.
+	AddressRewrites []*AddressRewrite `json:"address_rewrites"`
+	// Capacity, if set, weights endpoints by the capacity of their pod or node.
+	Capacity *CapacityConfig `json:"capacity"`
+	// PodWeights, if true, sets the load balancing weight of the endpoints of pods annotated with
+	// EndpointWeightAnnotation, overriding Capacity.  Setting it makes ekglue watch every pod in
+	// the cluster.
+	PodWeights bool `json:"pod_weights"`
+	// DefaultWeight, if non-zero, is the weight of endpoints that get no weight from PodWeights
+	// or Capacity; otherwise, Envoy gives them a weight of 1.  Raising it leaves room to give
+	// canary pods a reduced share of traffic: with a default of 100, a pod annotated with a
+	// weight of 10 gets a tenth of the traffic of its peers.
+	DefaultWeight uint32 `json:"default_weight"`
+	// LoadWeights, if set, adjusts the weights of localities by the load that clients report.
+	LoadWeights *LoadWeightConfig `json:"load_weights"`
+	// PodLabelMetadata lists pod labels, like "version", that are copied to the metadata of each
+	// endpoint under LbMetadataNamespace, so that clusters with an lb_subset_config can route by
+	// them, like to send a canary's traffic to the pods of one version.  Labels that a pod
+	// doesn't have are left out.  Setting it makes ekglue watch every pod in the cluster.
+	PodLabelMetadata []string `json:"pod_label_metadata"`
+
+	identities   *CiliumIdentityStore
+	pods         cache.Store
+	probes       bool     // from Config.ClusterConfig.ReadinessHealthChecks, which needs every pod
+	subsetLabels []string // from Config.Subsets
+	loads        *LoadTracker
+	naming       *NamingConfig      // from Config.Naming
+	aggregates   []*Aggregate       // from Config.Aggregates
+	zoneClusters *ZoneClusterConfig // from Config.ZoneClusters
+	tracks       []*TrackConfig     // from Config.Tracks
+	provenance   bool               // from Config.Provenance
 }
 
 // Config configures how to turn k8s resources into Envoy Clusters and ClusterLoadAssignments.
@@ -182,6 +433,94 @@ type Config struct {
 	ClusterConfig *ClusterConfig `json:"cluster_config"`
 	// Configuration for converting endpoints to cluster load assignments.
 	EndpointConfig *EndpointConfig `json:"endpoint_config"`
+	// Configuration for generated cluster names, shared by clusters and endpoints.
+	Naming *NamingConfig `json:"naming"`
+	// Rules that merge the endpoints of several services into one cluster.
+	Aggregates []*Aggregate `json:"aggregates"`
+	// Configuration for generating an additional cluster per zone for selected ports.
+	ZoneClusters *ZoneClusterConfig `json:"zone_clusters"`
+	// Configuration for translating OpenShift Routes; if nil, Routes are ignored.
+	OpenShiftRoutes *OpenShiftRouteConfig `json:"openshift_routes"`
+	// Configuration for translating Ingresses; if nil, Ingresses are ignored.
+	Ingresses *IngressConfig `json:"ingresses"`
+	// Configuration for serving clusters declared with EnvoyCluster custom resources; if nil,
+	// EnvoyClusters are ignored.
+	EnvoyClusters *EnvoyClusterConfig `json:"envoy_clusters"`
+	// Clusters and load assignments that aren't in Kubernetes, served alongside the generated
+	// ones.
+	Static *StaticConfig `json:"static"`
+	// Limits on the number of resources to publish.
+	Limits *LimitsConfig `json:"limits"`
+	// Restrictions on which services and endpoints are watched; if nil, everything is.
+	Watch *WatchConfig `json:"watch"`
+	// Additional rules that generated clusters must follow.
+	Validation *ValidationConfig `json:"validation"`
+	// Rules that restrict which clusters and load assignments each Envoy receives.
+	Scoping *ScopingConfig `json:"scoping"`
+	// Rules that split service ports into weighted tracks by pod label.
+	Tracks []*TrackConfig `json:"tracks"`
+	// Configuration for subset load balancing by pod label; if nil, clusters get no
+	// lb_subset_config unless their base config has one.
+	Subsets *SubsetConfig `json:"subsets"`
+	// Configuration for serving only load assignments, resolved on demand, for clusters defined
+	// elsewhere; if nil, clusters are generated from every service.
+	EDSProxy *EDSProxyConfig `json:"eds_proxy"`
+	// Provenance, if true, records the Kubernetes object (and ekglue build) that each cluster and
+	// endpoint was generated from in its metadata, under ProvenanceMetadataNamespace, so that
+	// config seen in Envoy's config_dump can be traced back to its source.  The metadata includes
+	// the generation time, so every regeneration is a change that is pushed to clients.
+	Provenance bool `json:"provenance"`
+	// Rules that record the source ranges allowed to reach generated clusters and routes in their
+	// metadata, under AllowlistMetadataNamespace.
+	Allowlist []*AllowlistRule `json:"allowlist"`
+	// AllowUnknownFields, if true, ignores fields that ekglue doesn't know about, instead of
+	// rejecting the config.  Fields in Envoy protos are always checked.  Top-level fields whose
+	// names start with "x-", which are handy for holding YAML anchors, are always ignored.
+	AllowUnknownFields bool `json:"allow_unknown_fields"`
+
+	source []byte // the merged JSON that LoadConfig parsed, for WatchConfigFile
+}
+
+// link shares config sections that are needed by more than one translator.
+func (c *Config) link() {
+	if c.ClusterConfig != nil {
+		c.ClusterConfig.naming = c.Naming
+		c.ClusterConfig.aggregates = c.Aggregates
+		c.ClusterConfig.zoneClusters = c.ZoneClusters
+		c.ClusterConfig.limits = c.Limits
+		c.ClusterConfig.tracks = c.Tracks
+		c.ClusterConfig.provenance = c.Provenance
+		c.ClusterConfig.allowlist = c.Allowlist
+		c.ClusterConfig.loadWeights = c.EndpointConfig != nil && c.EndpointConfig.LoadWeights != nil
+		c.ClusterConfig.subsets = c.Subsets
+		if c.EndpointConfig != nil && c.ClusterConfig.ReadinessHealthChecks != nil {
+			c.EndpointConfig.probes = true
+		}
+	}
+	if c.EndpointConfig != nil && c.Subsets != nil {
+		c.EndpointConfig.subsetLabels = c.Subsets.Labels
+	}
+	if c.ClusterConfig != nil && c.EndpointConfig != nil && (c.ClusterConfig.ReadinessHealthChecks != nil || c.Subsets != nil) {
+		c.ClusterConfig.pods = c.EndpointConfig.PodStore()
+	}
+	if c.EndpointConfig != nil {
+		c.EndpointConfig.naming = c.Naming
+		c.EndpointConfig.aggregates = c.Aggregates
+		c.EndpointConfig.zoneClusters = c.ZoneClusters
+		c.EndpointConfig.tracks = c.Tracks
+		c.EndpointConfig.provenance = c.Provenance
+	}
+	if c.EDSProxy != nil {
+		c.EDSProxy.endpoints = c.EndpointConfig
+	}
+	if c.OpenShiftRoutes != nil {
+		c.OpenShiftRoutes.naming = c.Naming
+		c.OpenShiftRoutes.allowlist = c.Allowlist
+	}
+	if c.Ingresses != nil {
+		c.Ingresses.naming = c.Naming
+		c.Ingresses.allowlist = c.Allowlist
+	}
 }
 
 func DefaultConfig() *Config {
@@ -192,21 +531,45 @@ func DefaultConfig() *Config {
 			},
 		},
 		EndpointConfig: &EndpointConfig{
-			Locality: &LocalityConfig{},
+			// Zone-aware load balancing works out of the box on clusters whose nodes have the
+			// well-known topology labels.
+			Locality: &LocalityConfig{
+				RegionFrom: &Field{Label: v1.LabelTopologyRegion},
+				ZoneFrom:   &Field{Label: v1.LabelTopologyZone},
+			},
 		},
 	}
 }
 
+// LoadConfig reads a config file, and the files it includes; see IncludeKey.
 func LoadConfig(filename string) (*Config, error) {
-	raw, err := os.ReadFile(filename)
+	doc, err := readConfigFile(filename, nil)
+	if err != nil {
+		return nil, err
+	}
+	js, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("marshal merged config: %w", err)
+	}
+	cfg, err := parseConfigJSON(js)
 	if err != nil {
 		return nil, err
 	}
+	cfg.source = js
+	return cfg, nil
+}
+
+// parseConfig parses and validates the contents of a single config file.
+func parseConfig(raw []byte) (*Config, error) {
 	js, err := yaml.YAMLToJSON(raw)
 	if err != nil {
 		return nil, fmt.Errorf("converting YAML to JSON: %w", err)
 	}
+	return parseConfigJSON(js)
+}
 
+// parseConfigJSON parses and validates a config that has been converted to JSON.
+func parseConfigJSON(js []byte) (*Config, error) {
 	cfg := DefaultConfig()
 	if err := json.Unmarshal(js, cfg); err != nil {
 		return nil, err
@@ -217,19 +580,126 @@ func LoadConfig(filename string) (*Config, error) {
 	if v := cfg.APIVersion; v != "v1alpha" {
 		return nil, fmt.Errorf("unknown config version %q; expected v1alpha", v)
 	}
+	if !cfg.AllowUnknownFields {
+		if err := checkUnknownFields(js); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.Naming.Validate(); err != nil {
+		return nil, fmt.Errorf("naming: %w", err)
+	}
+	if err := cfg.Limits.Validate(); err != nil {
+		return nil, fmt.Errorf("limits: %w", err)
+	}
+	if err := cfg.Watch.Validate(); err != nil {
+		return nil, fmt.Errorf("watch: %w", err)
+	}
+	if err := cfg.Validation.Validate(); err != nil {
+		return nil, fmt.Errorf("validation: %w", err)
+	}
+	if err := cfg.Scoping.Validate(); err != nil {
+		return nil, fmt.Errorf("scoping: %w", err)
+	}
+	if err := cfg.Static.Validate(); err != nil {
+		return nil, fmt.Errorf("static: %w", err)
+	}
+	if err := cfg.Subsets.Validate(); err != nil {
+		return nil, fmt.Errorf("subsets: %w", err)
+	}
+	if err := cfg.EDSProxy.Validate(); err != nil {
+		return nil, fmt.Errorf("eds_proxy: %w", err)
+	}
+	if cfg.EDSProxy != nil && cfg.EndpointConfig == nil {
+		return nil, fmt.Errorf("eds_proxy: endpoint_config is required")
+	}
+	if cfg.EndpointConfig != nil {
+		if err := cfg.EndpointConfig.LoadWeights.Validate(); err != nil {
+			return nil, fmt.Errorf("endpoint_config: load_weights: %w", err)
+		}
+		if err := validatePodLabelMetadata(cfg.EndpointConfig.PodLabelMetadata); err != nil {
+			return nil, fmt.Errorf("endpoint_config: pod_label_metadata: %w", err)
+		}
+	}
+	names := make(map[string]struct{})
+	for _, a := range cfg.Aggregates {
+		if _, ok := names[a.Name]; ok {
+			return nil, fmt.Errorf("aggregates: duplicate name %q", a.Name)
+		}
+		names[a.Name] = struct{}{}
+	}
+	cfg.link()
 	return cfg, nil
 }
 
-// Base returns a deep copy of the base cluster configuration.
+// Base returns a deep copy of the base cluster configuration, with OutlierDetection and
+// CircuitBreakers merged in.
 func (c *ClusterConfig) GetBaseConfig() *envoy_config_cluster_v3.Cluster {
 	raw := proto.Clone(c.BaseConfig)
 	cluster, ok := raw.(*envoy_config_cluster_v3.Cluster)
 	if !ok {
 		zap.L().Fatal("internal error: couldn't clone ClusterConfig.BaseConfig")
 	}
+	if c.OutlierDetection != nil || c.CircuitBreakers != nil {
+		mergeCluster(cluster, &envoy_config_cluster_v3.Cluster{OutlierDetection: c.OutlierDetection, CircuitBreakers: c.CircuitBreakers})
+	}
 	return cluster
 }
 
+// namespaceBaseConfig returns a deep copy of the base cluster configuration with the defaults for
+// namespace merged in.
+func (c *ClusterConfig) namespaceBaseConfig(namespace string) *envoy_config_cluster_v3.Cluster {
+	cluster := c.GetBaseConfig()
+	for _, d := range c.NamespaceDefaults {
+		if slices.Contains(d.Namespaces, namespace) {
+			mergeCluster(cluster, d.Defaults)
+		}
+	}
+	return cluster
+}
+
+// validateServiceType returns an error if t is not a known service type.
+func validateServiceType(t v1.ServiceType) error {
+	switch t {
+	case v1.ServiceTypeClusterIP, v1.ServiceTypeNodePort, v1.ServiceTypeLoadBalancer, v1.ServiceTypeExternalName:
+		return nil
+	}
+	return fmt.Errorf("unknown service type %q", t)
+}
+
+// IncludesService returns true if the service's type is selected by IncludeServiceTypes and
+// ExcludeServiceTypes, and the service itself by IncludeServices and ExcludeServices.  A service
+// with no type is a ClusterIP service.
+func (c *ClusterConfig) IncludesService(svc *v1.Service) bool {
+	t := svc.Spec.Type
+	if t == "" {
+		t = v1.ServiceTypeClusterIP
+	}
+	if len(c.IncludeServiceTypes) > 0 && !slices.Contains(c.IncludeServiceTypes, t) {
+		return false
+	}
+	if slices.Contains(c.ExcludeServiceTypes, t) {
+		return false
+	}
+	if len(c.IncludeServices) > 0 && !selectsAny(c.IncludeServices, svc) {
+		return false
+	}
+	return !selectsAny(c.ExcludeServices, svc)
+}
+
+// headlessDNS returns true if the cluster for port of svc should be a STRICT_DNS cluster, because
+// the service is headless and the port is matched by HeadlessDNS.
+func (c *ClusterConfig) headlessDNS(cluster *envoy_config_cluster_v3.Cluster, svc *v1.Service, port *v1.ServicePort) bool {
+	if svc.Spec.ClusterIP != v1.ClusterIPNone {
+		return false
+	}
+	for _, m := range c.HeadlessDNS {
+		if m.Evaluate(cluster, svc, port) {
+			return true
+		}
+	}
+	return false
+}
+
 // ApplyOverride returns the cluster after applying any configured overrides.  It will return nil if
 // the cluster is suppressed.
 func (c *ClusterConfig) ApplyOverride(cluster *envoy_config_cluster_v3.Cluster, svc *v1.Service, port *v1.ServicePort) *envoy_config_cluster_v3.Cluster {
@@ -242,8 +712,12 @@ func (c *ClusterConfig) ApplyOverride(cluster *envoy_config_cluster_v3.Cluster,
 			}
 		}
 		if match {
+			if o.fields != nil {
+				mergeStrategic(cluster, o.Override, o.fields)
+				continue
+			}
 			if o.Override != nil {
-				proto.Merge(cluster, o.Override)
+				mergeCluster(cluster, o.Override)
 				continue
 			}
 			if o.Suppress {
@@ -264,6 +738,14 @@ func singleTargetLoadAssignment(cluster, hostname string, port int32, protocol e
 	}
 }
 
+// dnsCluster makes cl a cluster of type t, which must be a DNS type, that connects to port on
+// hostname, even if the base config is for EDS clusters.
+func dnsCluster(cl *envoy_config_cluster_v3.Cluster, t envoy_config_cluster_v3.Cluster_DiscoveryType, hostname string, port int32, protocol envoy_config_core_v3.SocketAddress_Protocol) {
+	cl.ClusterDiscoveryType = &envoy_config_cluster_v3.Cluster_Type{Type: t}
+	cl.EdsClusterConfig = nil
+	cl.LoadAssignment = singleTargetLoadAssignment(cl.GetName(), hostname, port, protocol)
+}
+
 func lbEndpoint(hostname string, port int32, protocol envoy_config_core_v3.SocketAddress_Protocol, health envoy_config_core_v3.HealthStatus) *envoy_config_endpoint_v3.LbEndpoint {
 	return &envoy_config_endpoint_v3.LbEndpoint{
 		HealthStatus: health,
@@ -298,15 +780,19 @@ func (c *ClusterConfig) isEDS(cl *envoy_config_cluster_v3.Cluster) bool {
 // however, because you can have endpoints without services, and we never create a cluster for
 // those.  We also return the Envoy protocol of the port here, because it's convenient, not because
 // it's good design.
-func nameCluster(namespace, service, portName string, portNumber int32, portProtocol v1.Protocol) (string, envoy_config_core_v3.SocketAddress_Protocol) {
-	var protoSuffix string
+//
+// The name comes from the naming config's template, if it has one.  The resulting name is prefixed
+// as described in Config.ForCluster, and passed through the naming config, which may sanitize or
+// truncate it.
+func (n *NamingConfig) nameCluster(namespace, service, portName string, portNumber int32, portProtocol v1.Protocol) (string, envoy_config_core_v3.SocketAddress_Protocol) {
+	var protocol string
 	var envoyProtocol envoy_config_core_v3.SocketAddress_Protocol
 	switch portProtocol {
 	case v1.ProtocolTCP, "":
-		protoSuffix = ""
+		protocol = "tcp"
 		envoyProtocol = envoy_config_core_v3.SocketAddress_TCP
 	case v1.ProtocolUDP:
-		protoSuffix = ":udp"
+		protocol = "udp"
 		envoyProtocol = envoy_config_core_v3.SocketAddress_UDP
 	case v1.ProtocolSCTP:
 		// Envoy doesn't support SCTP, so neither do we.  See Envoy issue
@@ -318,39 +804,124 @@ func nameCluster(namespace, service, portName string, portNumber int32, portProt
 	if portName == "" {
 		portName = strconv.Itoa(int(portNumber))
 	}
-	return fmt.Sprintf("%s:%s:%s%s", namespace, service, portName, protoSuffix), envoyProtocol
+	d := &TemplateData{Namespace: namespace, Name: service, PortName: portName, PortNumber: portNumber, Protocol: protocol}
+	return n.Apply(n.clusterPrefix() + n.baseName(d)), envoyProtocol
 }
 
 // ClustersFromService translates a Kubernetes service into a set of Envoy clusters according to the
 // config (1 cluster per service port).
 func (c *ClusterConfig) ClustersFromService(svc *v1.Service) []*envoy_config_cluster_v3.Cluster {
+	result, _ := c.clustersFromService(svc)
+	return result
+}
+
+// clustersFromService implements ClustersFromService, additionally returning the service port that
+// each cluster was generated from.
+func (c *ClusterConfig) clustersFromService(svc *v1.Service) ([]*envoy_config_cluster_v3.Cluster, map[*envoy_config_cluster_v3.Cluster]*v1.ServicePort) {
 	var result []*envoy_config_cluster_v3.Cluster
-	if svc == nil {
-		return nil
+	ports := make(map[*envoy_config_cluster_v3.Cluster]*v1.ServicePort)
+	if svc == nil || !c.IncludesService(svc) {
+		return nil, ports
 	}
-	for _, port := range svc.Spec.Ports {
-		cl := c.GetBaseConfig()
+	for i := range svc.Spec.Ports {
+		port := svc.Spec.Ports[i]
+		cl := c.namespaceBaseConfig(svc.GetNamespace())
 		var protocol envoy_config_core_v3.SocketAddress_Protocol
-		cl.Name, protocol = nameCluster(svc.GetNamespace(), svc.GetName(), port.Name, port.Port, port.Protocol)
+		cl.Name, protocol = c.naming.nameCluster(svc.GetNamespace(), svc.GetName(), port.Name, port.Port, port.Protocol)
 		if cl.Name == "" {
 			// Ignore clusters that we can't name, probably because they use an unsupported protcol.
 			continue
 		}
+		if c.altStatName != nil {
+			name, err := executeTemplate(c.altStatName, newTemplateData(svc, &port))
+			if err != nil {
+				zap.L().Error("problem generating alt_stat_name", zap.String("cluster", cl.Name), zap.Error(err))
+			}
+			cl.AltStatName = strings.ReplaceAll(name, ".", "_")
+		}
+		if !c.IgnoreAppProtocol && speaksHTTP2(&port) && cl.Http2ProtocolOptions == nil {
+			cl.Http2ProtocolOptions = &envoy_config_core_v3.Http2ProtocolOptions{}
+		}
+		if len(cl.HealthChecks) == 0 {
+			hc, err := c.readinessHealthCheck(cl, svc, &port)
+			if err != nil {
+				zap.L().Debug("not generating a health check from readiness probe", zap.String("cluster", cl.Name), zap.Error(err))
+			}
+			if hc != nil {
+				cl.HealthChecks = []*envoy_config_core_v3.HealthCheck{hc}
+			}
+		}
+		if cl.LbSubsetConfig == nil {
+			cl.LbSubsetConfig = c.subsets.lbSubsetConfig(selectedPods(c.pods, svc))
+		}
+		if cl.TransportSocket == nil {
+			ts, err := c.upstreamTLS(cl, svc, &port)
+			if err != nil {
+				zap.L().Error("problem generating upstream tls config", zap.String("cluster", cl.Name), zap.Error(err))
+			}
+			cl.TransportSocket = ts
+		}
 		cl = c.ApplyOverride(cl, svc, &port)
 		if cl == nil {
 			continue
 		}
-		if !c.isEDS(cl) {
+		if c.ServiceAnnotations {
+			if err := applyAnnotations(cl, svc); err != nil {
+				zap.L().Error("problem applying service annotations", zap.String("cluster", cl.Name), zap.Error(err))
+			}
+		}
+		var trackClusters []*envoy_config_cluster_v3.Cluster
+		external := c.ExternalNames.isExternal(svc)
+		if external {
+			c.ExternalNames.apply(cl, svc, port.Port, protocol)
+		} else if c.headlessDNS(cl, svc, &port) {
+			dnsCluster(cl, envoy_config_cluster_v3.Cluster_STRICT_DNS, fmt.Sprintf("%s.%s.svc.cluster.local.", svc.GetName(), svc.GetNamespace()), port.Port, protocol)
+		} else if t := trackFor(c.tracks, cl.Name, &port); t != nil {
+			trackClusters = t.clusters(c.naming, cl)
+			cl, trackClusters = trackClusters[0], trackClusters[1:]
+		} else if !c.isEDS(cl) {
 			if cl.ClusterDiscoveryType == nil {
 				cl.ClusterDiscoveryType = &envoy_config_cluster_v3.Cluster_Type{
 					Type: envoy_config_cluster_v3.Cluster_STRICT_DNS,
 				}
 			}
 			cl.LoadAssignment = singleTargetLoadAssignment(cl.Name, fmt.Sprintf("%s.%s.svc.cluster.local.", svc.GetName(), svc.GetNamespace()), port.Port, protocol)
+		} else if c.loadWeights {
+			localityWeighted(cl)
+		}
+		var derived []*envoy_config_cluster_v3.Cluster
+		if !external {
+			// An external name has no endpoints to divide into zones.
+			derived = append(trackClusters, c.zoneClusters.clusters(c.naming, cl, &svc.Spec.Ports[i])...)
+		}
+		// Clusters derived from a port are reachable from the same places as the port's own.
+		if md := allowlistMetadata(allowedSources(c.allowlist, allowlistTarget{svc.GetNamespace(), cl.Name, port.Name, port.Port})); md != nil {
+			for _, x := range append([]*envoy_config_cluster_v3.Cluster{cl}, derived...) {
+				setFilterMetadata(&x.Metadata, AllowlistMetadataNamespace, md)
+			}
 		}
 		result = append(result, cl)
+		ports[cl] = &svc.Spec.Ports[i]
+		// Track and zone clusters are deliberately left out of ports, so that they are not
+		// matched by the gRPC config.
+		result = append(result, derived...)
+	}
+	if c.provenance {
+		p := provenance("Service", svc, time.Now())
+		for _, cl := range result {
+			setFilterMetadata(&cl.Metadata, ProvenanceMetadataNamespace, p)
+		}
 	}
-	return result
+	return result, ports
+}
+
+// speaksHTTP2 returns true if the port's appProtocol says that it speaks HTTP/2 without TLS.
+func speaksHTTP2(port *v1.ServicePort) bool {
+	switch withDefault(port.AppProtocol, "") {
+	case "grpc", "kubernetes.io/h2c":
+		return true
+	}
+	return false
 }
 
 // extractLabel extracts a label from a node.
@@ -408,6 +979,23 @@ func (l *LocalityConfig) LocalityFromHost(hosts cache.Store, hostname string) *e
 	return result
 }
 
+// endpointHost identifies where an endpoint runs: the name of its node, and the zone that its
+// EndpointSlice reports for it.
+type endpointHost struct {
+	node, zone string
+}
+
+// localityFromEndpointHost returns the locality of an endpoint host.  It is the locality of the
+// node, except that if the zone can't be determined from the node (perhaps because the node isn't
+// cached yet), the zone reported by the EndpointSlice is used instead.
+func (l *LocalityConfig) localityFromEndpointHost(hosts cache.Store, h endpointHost) *envoy_config_core_v3.Locality {
+	result := l.LocalityFromHost(hosts, h.node)
+	if result.GetZone() == "" && l != nil && l.ZoneFrom != nil {
+		result.Zone = h.zone
+	}
+	return result
+}
+
 type nodeLocalities struct {
 	Localities map[string]json.RawMessage `json:"localities"`
 }
@@ -443,42 +1031,113 @@ func (l *LocalityConfig) LocalitiesAsYAML(nodes cache.Store) ([]byte, error) {
 // LoadAssignmentFromEndpoints translates a Kubernetes endpoints object into a set of Envoy
 // ClusterLoadAssignments.
 func (c *EndpointConfig) LoadAssignmentsFromEndpointSlices(nodeStore cache.Store, endpointSlices []*discoveryv1.EndpointSlice) []*envoy_config_endpoint_v3.ClusterLoadAssignment {
+	return c.linkedLoadAssignments(nodeStore, endpointSlices, nil)
+}
+
+// linkedLoadAssignments implements LoadAssignmentsFromEndpointSlices for slices that all belong to
+// the service that l, if it's not nil, describes.  Matchers see the service's own ports, and load
+// assignments are renamed to match the service's clusters before localities are weighed; those
+// that the service doesn't get are dropped.
+func (c *EndpointConfig) linkedLoadAssignments(nodeStore cache.Store, endpointSlices []*discoveryv1.EndpointSlice, l *linkedService) []*envoy_config_endpoint_v3.ClusterLoadAssignment {
+	ports := make(map[string]*v1.ServicePort)
+	result := c.loadAssignments(nodeStore, endpointSlices, func(es *discoveryv1.EndpointSlice, port discoveryv1.EndpointPort) (string, envoy_config_core_v3.SocketAddress_Protocol) {
+		svc := esService(es)
+		name, protocol := c.naming.nameCluster(svc.Namespace, svc.Name, withDefault(port.Name, ""), *port.Port, withDefault(port.Protocol, "TCP"))
+		ports[name] = l.servicePort(port)
+		return name, protocol
+	})
+	if c.zoneClusters != nil || len(c.tracks) > 0 {
+		var extra []*envoy_config_endpoint_v3.ClusterLoadAssignment
+		for i, cla := range result {
+			port := ports[cla.GetClusterName()]
+			if t := trackFor(c.tracks, cla.GetClusterName(), port); t != nil {
+				split := t.loadAssignments(c, nodeStore, endpointSlices, cla.GetClusterName(), port)
+				result[i] = split[0]
+				extra = append(extra, split[1:]...)
+			}
+			extra = append(extra, c.zoneClusters.loadAssignments(c.naming, cla, port)...)
+		}
+		result = append(result, extra...)
+	}
+	if l != nil {
+		var renamed []*envoy_config_endpoint_v3.ClusterLoadAssignment
+		for _, cla := range result {
+			if cla.ClusterName = l.rename(cla.GetClusterName()); cla.ClusterName != "" {
+				renamed = append(renamed, cla)
+			}
+		}
+		result = renamed
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].GetClusterName() < result[j].GetClusterName()
+	})
+	c.weighLocalities(result)
+	return result
+}
+
+// healthStatus maps the conditions of an endpoint to an Envoy health status.  Ready endpoints are
+// HEALTHY, terminating endpoints are DRAINING, and any other endpoint is UNHEALTHY.
+func healthStatus(cond discoveryv1.EndpointConditions) envoy_config_core_v3.HealthStatus {
+	switch {
+	case withDefault(cond.Ready, true):
+		return envoy_config_core_v3.HealthStatus_HEALTHY
+	case withDefault(cond.Terminating, false):
+		return envoy_config_core_v3.HealthStatus_DRAINING
+	default:
+		return envoy_config_core_v3.HealthStatus_UNHEALTHY
+	}
+}
+
+// loadAssignments implements LoadAssignmentsFromEndpointSlices, calling name to determine which
+// cluster each port of each slice belongs to.  Ports that name returns "" for are ignored.
+func (c *EndpointConfig) loadAssignments(nodeStore cache.Store, endpointSlices []*discoveryv1.EndpointSlice, name func(es *discoveryv1.EndpointSlice, port discoveryv1.EndpointPort) (string, envoy_config_core_v3.SocketAddress_Protocol)) []*envoy_config_endpoint_v3.ClusterLoadAssignment {
 	if endpointSlices == nil {
 		return nil
 	}
 
-	endpointsByClusterByNode := make(map[string]map[string][]*envoy_config_endpoint_v3.LbEndpoint)
+	now := time.Now()
+	endpointsByClusterByNode := make(map[string]map[endpointHost][]*envoy_config_endpoint_v3.LbEndpoint)
 	for _, es := range endpointSlices {
-		svc := esService(es)
+		var p *structpb.Struct
+		if c.provenance {
+			p = provenance("EndpointSlice", es, now)
+		}
 		for _, port := range es.Ports {
 			if port.Port == nil {
 				// Ignore unspecified ports.
 				continue
 			}
 			portNum := *port.Port
-			portName := withDefault(port.Name, "")
-			portProto := withDefault(port.Protocol, "TCP")
-			cluster, protocol := nameCluster(svc.Namespace, svc.Name, portName, portNum, portProto)
+			cluster, protocol := name(es, port)
 			if cluster == "" {
 				// Ignore clusters that we can't name, probably because they use an unsupported protocol.
 				continue
 			}
 			endpointsByNode, ok := endpointsByClusterByNode[cluster]
 			if !ok {
-				endpointsByNode = make(map[string][]*envoy_config_endpoint_v3.LbEndpoint)
+				endpointsByNode = make(map[endpointHost][]*envoy_config_endpoint_v3.LbEndpoint)
 				endpointsByClusterByNode[cluster] = endpointsByNode
 			}
 			for _, ep := range es.Endpoints {
-				health := envoy_config_core_v3.HealthStatus_HEALTHY
-				if !withDefault(ep.Conditions.Ready, true) {
-					if !c.IncludeNotReady {
-						continue
-					}
-					health = envoy_config_core_v3.HealthStatus_DEGRADED
+				health := healthStatus(ep.Conditions)
+				if health != envoy_config_core_v3.HealthStatus_HEALTHY && !c.IncludeNotReady {
+					continue
 				}
-				node := withDefault(ep.NodeName, "")
+				node := endpointHost{node: withDefault(ep.NodeName, ""), zone: withDefault(ep.Zone, "")}
 				for _, addr := range ep.Addresses {
-					endpointsByNode[node] = append(endpointsByNode[node], lbEndpoint(addr, portNum, protocol, health))
+					rewritten, rewrittenPort, ok := rewriteAddress(c.AddressRewrites, addr, portNum)
+					if !ok {
+						continue
+					}
+					lbe := lbEndpoint(rewritten, rewrittenPort, protocol, health)
+					c.setWeight(lbe, nodeStore, ep)
+					c.addPodLabelMetadata(lbe, ep)
+					// Identities are looked up by the pod's own address.
+					c.identities.addIdentityMetadata(lbe, addr)
+					if p != nil {
+						setFilterMetadata(&lbe.Metadata, ProvenanceMetadataNamespace, p)
+					}
+					endpointsByNode[node] = append(endpointsByNode[node], lbe)
 				}
 			}
 		}
@@ -492,7 +1151,7 @@ func (c *EndpointConfig) LoadAssignmentsFromEndpointSlices(nodeStore cache.Store
 				return endpoints[i].String() < endpoints[j].String()
 			})
 			localityEndpoints = append(localityEndpoints, &envoy_config_endpoint_v3.LocalityLbEndpoints{
-				Locality:    c.Locality.LocalityFromHost(nodeStore, node),
+				Locality:    c.Locality.localityFromEndpointHost(nodeStore, node),
 				LbEndpoints: endpoints,
 			})
 		}
@@ -510,7 +1169,10 @@ func (c *EndpointConfig) LoadAssignmentsFromEndpointSlices(nodeStore cache.Store
 	return result
 }
 
-func clusterNames(slices map[string]*discoveryv1.EndpointSlice) map[string]struct{} {
+// clusterNames returns the names of every load assignment generated from slices, which belong to
+// the service that l, if it's not nil, describes, before they're renamed.
+func (c *EndpointConfig) clusterNames(slices map[string]*discoveryv1.EndpointSlice, l *linkedService) map[string]struct{} {
+	naming := c.naming
 	clusters := make(map[string]struct{})
 	for _, eps := range slices {
 		svc := esService(eps)
@@ -519,12 +1181,21 @@ func clusterNames(slices map[string]*discoveryv1.EndpointSlice) map[string]struc
 				// Ignore unspecified ports.
 				continue
 			}
-			cluster, _ := nameCluster(svc.Namespace, svc.Name, withDefault(port.Name, ""), *port.Port, withDefault(port.Protocol, "TCP"))
+			cluster, _ := naming.nameCluster(svc.Namespace, svc.Name, withDefault(port.Name, ""), *port.Port, withDefault(port.Protocol, "TCP"))
 			if cluster == "" {
 				// Ignore clusters that we can't name, probably because they use an unsupported protocol.
 				continue
 			}
 			clusters[cluster] = struct{}{}
+			sp := l.servicePort(port)
+			for _, name := range c.zoneClusters.names(naming, &envoy_config_cluster_v3.Cluster{Name: cluster}, sp) {
+				clusters[name] = struct{}{}
+			}
+			if t := trackFor(c.tracks, cluster, sp); t != nil {
+				for _, name := range t.names(naming, cluster) {
+					clusters[name] = struct{}{}
+				}
+			}
 		}
 	}
 	return clusters
@@ -536,6 +1207,25 @@ func clusterNames(slices map[string]*discoveryv1.EndpointSlice) map[string]struc
 type ClusterStore struct {
 	cfg *ClusterConfig
 	s   *cds.Server
+
+	mu               sync.Mutex
+	services         map[types.NamespacedName]*v1.Service // every service received, for Reconfigure
+	settled          map[types.NamespacedName]struct{}    // services that an unchanged update can skip
+	owners           *nameOwners
+	claimed          map[types.NamespacedName]map[string]string
+	grpcNames        map[types.NamespacedName][]string // names of generated gRPC listeners and routes
+	listenerNames    map[types.NamespacedName][]string // names of listeners generated from templates
+	passthrough      map[types.NamespacedName]*envoy_config_listener_v3.FilterChain
+	aggregateMembers map[string]map[types.NamespacedName]struct{}
+	directory        map[string]*ClusterDirectoryEntry // by cluster name; see setDirectory
+	invalid          map[string]*InvalidCluster        // by cluster name
+	exclude          []string                          // see Stores.AddRemote
+	static           *StaticStore                      // see Stores.AddStatic
+	endpoints        *EndpointStore                    // see Stores.Link
+	ingresses        *IngressStore                     // see Stores.Link
+
+	namespacesMu sync.Mutex
+	namespaces   map[string]string // the namespace of each cluster in directory, for Scope
 }
 
 func startOp(opSource, opName string) (context.Context, func()) {
@@ -566,8 +1256,19 @@ func logError(ctx context.Context) {
 // server.
 func (c *ClusterConfig) Store(s *cds.Server) *ClusterStore {
 	return &ClusterStore{
-		cfg: c,
-		s:   s,
+		cfg:              c,
+		s:                s,
+		services:         make(map[types.NamespacedName]*v1.Service),
+		settled:          make(map[types.NamespacedName]struct{}),
+		owners:           newNameOwners(),
+		claimed:          make(map[types.NamespacedName]map[string]string),
+		grpcNames:        make(map[types.NamespacedName][]string),
+		listenerNames:    make(map[types.NamespacedName][]string),
+		passthrough:      make(map[types.NamespacedName]*envoy_config_listener_v3.FilterChain),
+		aggregateMembers: make(map[string]map[types.NamespacedName]struct{}),
+		directory:        make(map[string]*ClusterDirectoryEntry),
+		invalid:          make(map[string]*InvalidCluster),
+		namespaces:       make(map[string]string),
 	}
 }
 
@@ -579,9 +1280,11 @@ func (cs *ClusterStore) Add(obj interface{}) error {
 		logError(ctx)
 		return fmt.Errorf("add service: got non-service object %#v", obj)
 	}
-	if err := cs.s.AddClusters(ctx, cs.cfg.ClustersFromService(svc)); err != nil {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if err := cs.update(ctx, svc); err != nil {
 		logError(ctx)
-		return fmt.Errorf("add service: clusters: %w", err)
+		return fmt.Errorf("add service: %w", err)
 	}
 	return nil
 }
@@ -594,9 +1297,256 @@ func (cs *ClusterStore) Update(obj interface{}) error {
 		logError(ctx)
 		return fmt.Errorf("update service: got non-service object %#v", obj)
 	}
-	if err := cs.s.AddClusters(ctx, cs.cfg.ClustersFromService(svc)); err != nil {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if err := cs.update(ctx, svc); err != nil {
 		logError(ctx)
-		return fmt.Errorf("update service: add clusters: %w", err)
+		return fmt.Errorf("update service: %w", err)
+	}
+	return nil
+}
+
+// update generates clusters for svc, resolves name collisions, and pushes the result to the server,
+// deleting any clusters that svc previously generated but no longer does.  Invalid clusters are
+// handled as described in InvalidCluster.  An update that doesn't change anything clusters are
+// generated from, like one to the status of a load balancer, is skipped, unless the last update
+// left something for another try to fix, like a collision or an invalid cluster.  You must hold
+// the lock.
+func (cs *ClusterStore) update(ctx context.Context, svc *v1.Service) (retErr error) {
+	key := serviceKey(svc)
+	prev := cs.services[key]
+	// Reflectors deliver a new object for every change, so the same object is a retry.
+	retrying := prev == svc
+	if !retrying && cs.unchanged(prev, svc) {
+		k8sUnchangedEvents.WithLabelValues("services").Inc()
+		cs.services[key] = svc
+		return nil
+	}
+	cs.services[key] = svc
+	// Anything that leaves svc's resources incomplete unsettles it.
+	cs.settled[key] = struct{}{}
+	defer func() {
+		if retErr != nil {
+			delete(cs.settled, key)
+		}
+	}()
+	generated, ports := cs.cfg.clustersFromService(svc)
+	if err := cs.cfg.limits.checkNamespace(serviceKey(svc), cs.owners.namespaceCount(svc.GetNamespace(), serviceKey(svc)), len(generated)); err != nil {
+		return err
+	}
+	names := generatedNames(generated)
+	displaced := cs.owners.displaced(cs.cfg.CollisionPolicy, key, names)
+	clusters, stale, collisionErr := cs.owners.claim(cs.cfg.CollisionPolicy, serviceKey(svc), generated)
+	cs.claimed[key] = claimedNames(names, generated)
+	for _, name := range stale {
+		cs.s.DeleteCluster(ctx, name)
+		cs.setDirectory(name, nil)
+		delete(cs.invalid, name)
+	}
+	clusters = cs.checkClusters(serviceKey(svc), clusters, ports, cs.invalid, retrying)
+	defer cs.countInvalid()
+	for _, e := range directoryEntries(svc, clusters, ports) {
+		cs.setDirectory(e.Cluster, e)
+	}
+	// The last valid versions of invalid clusters are already being served.
+	valid := make([]*envoy_config_cluster_v3.Cluster, 0, len(clusters))
+	for _, c := range clusters {
+		if _, ok := cs.invalid[c.GetName()]; !ok {
+			valid = append(valid, c)
+		}
+	}
+	if len(valid) < len(generated) {
+		// Some clusters collided or are invalid.
+		delete(cs.settled, key)
+	}
+	if err := cs.s.AddClusters(ctx, valid); err != nil {
+		return fmt.Errorf("add clusters: %w", err)
+	}
+	linked := map[types.NamespacedName]*linkedService{key: cs.linkedService(svc)}
+	for _, k := range displaced {
+		if other, ok := cs.services[k]; ok {
+			linked[k] = cs.linkedService(other)
+		}
+	}
+	if err := cs.link(ctx, linked); err != nil {
+		return fmt.Errorf("link: %w", err)
+	}
+	if cs.cfg.GRPC != nil {
+		if err := cs.updateGRPC(ctx, svc, clusters, ports); err != nil {
+			return fmt.Errorf("grpc: %w", err)
+		}
+	}
+	if len(cs.cfg.Listeners) > 0 {
+		if err := cs.updateListeners(ctx, svc, clusters, ports); err != nil {
+			return fmt.Errorf("listeners: %w", err)
+		}
+	}
+	if cs.cfg.TLSPassthrough != nil {
+		fc, err := cs.cfg.TLSPassthrough.filterChain(svc, clusters, ports)
+		if err != nil {
+			// Like in replace, this is one service's problem; its old chain would forward to
+			// clusters it may no longer have.
+			zap.L().Warn("problem generating tls passthrough filter chain", zap.Stringer("service", serviceKey(svc)), zap.Error(err))
+			fc = nil
+		}
+		if err := cs.updatePassthrough(ctx, serviceKey(svc), fc); err != nil {
+			return fmt.Errorf("tls passthrough: %w", err)
+		}
+	}
+	if err := cs.updateAggregates(ctx, serviceKey(svc), svc); err != nil {
+		return err
+	}
+	return collisionErr
+}
+
+// unchanged returns true if svc, which replaces prev, changes nothing that resources are generated
+// from, and prev's resources were generated completely.  You must hold the lock.
+func (cs *ClusterStore) unchanged(prev, svc *v1.Service) bool {
+	if prev == nil {
+		return false
+	}
+	if _, ok := cs.settled[serviceKey(svc)]; !ok {
+		return false
+	}
+	if cs.cfg.provenance && prev.GetResourceVersion() != svc.GetResourceVersion() {
+		// The resource version is part of the generated metadata.
+		return false
+	}
+	return DiffServices(prev, svc).Empty()
+}
+
+// grpcResources generates gRPC listeners and routes for the provided clusters.
+func (cs *ClusterStore) grpcResources(svc *v1.Service, clusters []*envoy_config_cluster_v3.Cluster, ports map[*envoy_config_cluster_v3.Cluster]*v1.ServicePort) ([]*envoy_config_listener_v3.Listener, []*envoy_config_route_v3.RouteConfiguration, error) {
+	var listeners []*envoy_config_listener_v3.Listener
+	var routes []*envoy_config_route_v3.RouteConfiguration
+	for _, cl := range clusters {
+		l, r, err := cs.cfg.GRPC.Resources(cl, svc, ports[cl])
+		if err != nil {
+			return nil, nil, fmt.Errorf("cluster %q: %w", cl.GetName(), err)
+		}
+		if l != nil {
+			listeners = append(listeners, l)
+			routes = append(routes, r)
+		}
+	}
+	return listeners, routes, nil
+}
+
+// grpcRoutes returns the routes generated by grpcResources for listeners, which may be fewer than
+// it generated.  Each gRPC route is named after its listener.
+func grpcRoutes(routes []*envoy_config_route_v3.RouteConfiguration, listeners []*envoy_config_listener_v3.Listener) []*envoy_config_route_v3.RouteConfiguration {
+	names := make(map[string]struct{}, len(listeners))
+	for _, l := range listeners {
+		names[l.GetName()] = struct{}{}
+	}
+	var result []*envoy_config_route_v3.RouteConfiguration
+	for _, r := range routes {
+		if _, ok := names[r.GetName()]; ok {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// updateGRPC pushes the gRPC listeners and routes for svc, deleting any that it no longer
+// generates.  You must hold the lock.
+func (cs *ClusterStore) updateGRPC(ctx context.Context, svc *v1.Service, clusters []*envoy_config_cluster_v3.Cluster, ports map[*envoy_config_cluster_v3.Cluster]*v1.ServicePort) error {
+	key := serviceKey(svc)
+	generated, routes, err := cs.grpcResources(svc, clusters, ports)
+	if err != nil {
+		return err
+	}
+	listeners := claimListeners(key, generated, cs.grpcNames, cs.listenerNames)
+	if len(listeners) < len(generated) {
+		// The names may be free the next time svc is updated; see claimListeners.
+		delete(cs.settled, key)
+	}
+	routes = grpcRoutes(routes, listeners)
+	stale := make(map[string]struct{})
+	for _, name := range cs.grpcNames[key] {
+		stale[name] = struct{}{}
+	}
+	var names []string
+	for _, l := range listeners {
+		names = append(names, l.GetName())
+		delete(stale, l.GetName())
+	}
+	for name := range stale {
+		cs.s.DeleteListener(ctx, name)
+		cs.s.DeleteRoute(ctx, name)
+	}
+	if len(names) > 0 {
+		cs.grpcNames[key] = names
+	} else {
+		delete(cs.grpcNames, key)
+	}
+	// Routes first, so that a client never sees a listener that refers to a missing route.
+	if err := cs.s.AddRoutes(ctx, routes); err != nil {
+		return fmt.Errorf("add routes: %w", err)
+	}
+	if err := cs.s.AddListeners(ctx, listeners); err != nil {
+		return fmt.Errorf("add listeners: %w", err)
+	}
+	return nil
+}
+
+// updateListeners pushes the templated listeners for svc, deleting any that it no longer
+// generates.  You must hold the lock.
+func (cs *ClusterStore) updateListeners(ctx context.Context, svc *v1.Service, clusters []*envoy_config_cluster_v3.Cluster, ports map[*envoy_config_cluster_v3.Cluster]*v1.ServicePort) error {
+	key := serviceKey(svc)
+	generated, err := cs.cfg.templatedListeners(svc, clusters, ports)
+	if err != nil {
+		return err
+	}
+	listeners := claimListeners(key, generated, cs.listenerNames, cs.grpcNames)
+	if len(listeners) < len(generated) {
+		delete(cs.settled, key)
+	}
+	stale := make(map[string]struct{})
+	for _, name := range cs.listenerNames[key] {
+		stale[name] = struct{}{}
+	}
+	var names []string
+	for _, l := range listeners {
+		names = append(names, l.GetName())
+		delete(stale, l.GetName())
+	}
+	for name := range stale {
+		cs.s.DeleteListener(ctx, name)
+	}
+	if len(names) > 0 {
+		cs.listenerNames[key] = names
+	} else {
+		delete(cs.listenerNames, key)
+	}
+	if err := cs.s.AddListeners(ctx, listeners); err != nil {
+		return fmt.Errorf("add listeners: %w", err)
+	}
+	return nil
+}
+
+// updatePassthrough records svc's TLS passthrough filter chain (nil for none) and pushes the
+// rebuilt passthrough listener, deleting it if no service asks for passthrough.  You must hold the
+// lock.
+func (cs *ClusterStore) updatePassthrough(ctx context.Context, key types.NamespacedName, fc *envoy_config_listener_v3.FilterChain) error {
+	_, had := cs.passthrough[key]
+	if fc != nil {
+		cs.passthrough[key] = fc
+	} else if had {
+		delete(cs.passthrough, key)
+	} else {
+		return nil
+	}
+	l, err := cs.cfg.TLSPassthrough.listener(cs.passthrough, cs.services)
+	if err != nil {
+		return err
+	}
+	if l == nil {
+		cs.s.DeleteListener(ctx, cs.cfg.TLSPassthrough.name())
+		return nil
+	}
+	if err := cs.s.AddListeners(ctx, []*envoy_config_listener_v3.Listener{l}); err != nil {
+		return fmt.Errorf("add listeners: %w", err)
 	}
 	return nil
 }
@@ -609,9 +1559,42 @@ func (cs *ClusterStore) Delete(obj interface{}) error {
 		logError(ctx)
 		return fmt.Errorf("delete service: got non-service object %#v", obj)
 	}
-	clusters := cs.cfg.ClustersFromService(svc)
-	for _, c := range clusters {
-		cs.s.DeleteCluster(ctx, c.GetName())
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	key := serviceKey(svc)
+	delete(cs.services, key)
+	delete(cs.settled, key)
+	for _, name := range cs.grpcNames[key] {
+		cs.s.DeleteListener(ctx, name)
+		cs.s.DeleteRoute(ctx, name)
+	}
+	delete(cs.grpcNames, key)
+	for _, name := range cs.listenerNames[key] {
+		cs.s.DeleteListener(ctx, name)
+	}
+	delete(cs.listenerNames, key)
+	if cs.cfg.TLSPassthrough != nil {
+		if err := cs.updatePassthrough(ctx, key, nil); err != nil {
+			logError(ctx)
+			return fmt.Errorf("delete service: tls passthrough: %w", err)
+		}
+	}
+	names := maps.Keys(cs.owners.release(key))
+	delete(cs.claimed, key)
+	sort.Strings(names)
+	for _, name := range names {
+		cs.s.DeleteCluster(ctx, name)
+		cs.setDirectory(name, nil)
+	}
+	cs.forgetInvalid(key)
+	cs.countInvalid()
+	if err := cs.updateAggregates(ctx, key, nil); err != nil {
+		logError(ctx)
+		return fmt.Errorf("delete service: %w", err)
+	}
+	if err := cs.link(ctx, map[types.NamespacedName]*linkedService{key: nil}); err != nil {
+		logError(ctx)
+		return fmt.Errorf("delete service: link: %w", err)
 	}
 	return nil
 }
@@ -649,18 +1632,156 @@ func (cs *ClusterStore) GetByKey(key string) (item interface{}, exists bool, err
 func (cs *ClusterStore) Replace(objs []interface{}, _ string) error {
 	ctx, c := startOp("services", "replace")
 	defer c()
-	var clusters []*envoy_config_cluster_v3.Cluster
+	svcs := make([]*v1.Service, 0, len(objs))
 	for _, obj := range objs {
 		svc, ok := obj.(*v1.Service)
 		if !ok {
 			logError(ctx)
 			return fmt.Errorf("replace services: got non-service object %#v", obj)
 		}
-		clusters = append(clusters, cs.cfg.ClustersFromService(svc)...)
+		svcs = append(svcs, svc)
 	}
-	if err := cs.s.ReplaceClusters(ctx, clusters); err != nil {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if err := cs.replace(ctx, svcs, false); err != nil {
 		logError(ctx)
-		return fmt.Errorf("replace services: replace clusters: %w", err)
+		return fmt.Errorf("replace services: %w", err)
+	}
+	return nil
+}
+
+// replace regenerates every resource from svcs, replacing everything that was previously
+// generated.  Invalid clusters are handled as described in InvalidCluster, unless strict is set, in
+// which case a cluster that is invalid but wasn't before fails the replace without changing
+// anything.  You must hold the lock.
+func (cs *ClusterStore) replace(ctx context.Context, svcs []*v1.Service, strict bool) error {
+	sortServicesByAge(svcs)
+	services := make(map[types.NamespacedName]*v1.Service, len(svcs))
+	for _, svc := range svcs {
+		services[serviceKey(svc)] = svc
+	}
+	previous := cs.services
+	cs.services = services
+	// Every service is regenerated by its next update, whether it changed or not.
+	cs.settled = make(map[types.NamespacedName]struct{})
+
+	owners := newNameOwners()
+	claimed := make(map[types.NamespacedName]map[string]string)
+	invalid := make(map[string]*InvalidCluster)
+	grpcNames := make(map[types.NamespacedName][]string)
+	listenerNames := make(map[types.NamespacedName][]string)
+	passthrough := make(map[types.NamespacedName]*envoy_config_listener_v3.FilterChain)
+	directory := make(map[string]*ClusterDirectoryEntry)
+	var clusters []*envoy_config_cluster_v3.Cluster
+	var listeners []*envoy_config_listener_v3.Listener
+	var routes []*envoy_config_route_v3.RouteConfiguration
+	for _, svc := range svcs {
+		// Rejected collisions and services over their namespace's quota are logged and
+		// counted; failing the entire replace because of one bad service would be worse.
+		generated, ports := cs.cfg.clustersFromService(svc)
+		if err := cs.cfg.limits.checkNamespace(serviceKey(svc), owners.namespaceCount(svc.GetNamespace(), serviceKey(svc)), len(generated)); err != nil {
+			continue
+		}
+		names := generatedNames(generated)
+		result, _, _ := owners.claim(cs.cfg.CollisionPolicy, serviceKey(svc), generated)
+		claimed[serviceKey(svc)] = claimedNames(names, generated)
+		result = cs.checkClusters(serviceKey(svc), result, ports, invalid, previous[serviceKey(svc)] == svc)
+		clusters = append(clusters, result...)
+		for _, e := range directoryEntries(svc, result, ports) {
+			directory[e.Cluster] = e
+		}
+		if cs.cfg.GRPC != nil {
+			ls, rs, err := cs.grpcResources(svc, result, ports)
+			if err != nil {
+				return fmt.Errorf("grpc: %w", err)
+			}
+			ls = claimListeners(serviceKey(svc), ls, grpcNames, listenerNames)
+			rs = grpcRoutes(rs, ls)
+			for _, l := range ls {
+				grpcNames[serviceKey(svc)] = append(grpcNames[serviceKey(svc)], l.GetName())
+			}
+			listeners = append(listeners, ls...)
+			routes = append(routes, rs...)
+		}
+		if len(cs.cfg.Listeners) > 0 {
+			ls, err := cs.cfg.templatedListeners(svc, result, ports)
+			if err != nil {
+				return fmt.Errorf("listeners: %w", err)
+			}
+			ls = claimListeners(serviceKey(svc), ls, listenerNames, grpcNames)
+			for _, l := range ls {
+				listenerNames[serviceKey(svc)] = append(listenerNames[serviceKey(svc)], l.GetName())
+			}
+			listeners = append(listeners, ls...)
+		}
+		if cs.cfg.TLSPassthrough != nil {
+			fc, err := cs.cfg.TLSPassthrough.filterChain(svc, result, ports)
+			if err != nil {
+				// Like a rejected collision, this is one service's problem.
+				zap.L().Warn("problem generating tls passthrough filter chain", zap.Error(err))
+			} else if fc != nil {
+				passthrough[serviceKey(svc)] = fc
+			}
+		}
+	}
+	if cs.cfg.TLSPassthrough != nil {
+		l, err := cs.cfg.TLSPassthrough.listener(passthrough, services)
+		if err != nil {
+			return fmt.Errorf("tls passthrough: %w", err)
+		}
+		if l != nil {
+			listeners = append(listeners, l)
+		}
+	}
+
+	if strict {
+		for name, e := range invalid {
+			if _, ok := cs.invalid[name]; !ok {
+				return fmt.Errorf("cluster %q: %w", name, e.err)
+			}
+		}
+	}
+
+	clusters = withoutOverwritten(clusters)
+	aggregates, members := cs.cfg.aggregateClusters(svcs)
+	clusters = append(clusters, aggregates...)
+
+	cs.aggregateMembers = members
+	// The directory is replaced first, so that the clusters' namespaces are known to Scope by
+	// the time clients are told about them.
+	oldDirectory := cs.directory
+	cs.replaceDirectory(directory)
+	clusters = withoutStatic(cs.static.ownsCluster, clusters)
+	if err := cs.s.Clusters.ReplaceMatching(ctx, asResources(clusters), cs.owns); err != nil {
+		cs.replaceDirectory(oldDirectory)
+		return fmt.Errorf("replace clusters: %w", err)
+	}
+	cs.owners = owners
+	cs.claimed = claimed
+	cs.invalid = invalid
+	cs.countInvalid()
+	linked := make(map[types.NamespacedName]*linkedService, len(services))
+	for key := range previous {
+		linked[key] = nil
+	}
+	for key, svc := range services {
+		linked[key] = cs.linkedService(svc)
+	}
+	if err := cs.link(ctx, linked); err != nil {
+		return fmt.Errorf("link: %w", err)
+	}
+	if cs.cfg.GRPC != nil {
+		if err := cs.s.ReplaceRoutes(ctx, routes); err != nil {
+			return fmt.Errorf("replace routes: %w", err)
+		}
+		cs.grpcNames = grpcNames
+	}
+	if cs.cfg.GRPC != nil || len(cs.cfg.Listeners) > 0 || cs.cfg.TLSPassthrough != nil {
+		if err := cs.s.ReplaceListeners(ctx, listeners); err != nil {
+			return fmt.Errorf("replace listeners: %w", err)
+		}
+		cs.listenerNames = listenerNames
+		cs.passthrough = passthrough
 	}
 	return nil
 }
@@ -679,6 +1800,9 @@ type EndpointStore struct {
 
 	mu        sync.Mutex
 	serverESs map[types.NamespacedName]map[string]*discoveryv1.EndpointSlice
+	exclude   []string                                // see Stores.AddRemote
+	static    *StaticStore                            // see Stores.AddStatic
+	linked    map[types.NamespacedName]*linkedService // see Stores.Link
 }
 
 // Store returns a cache.Store that allows a Kubernetes reflector to sync endpoint changes to an EDS
@@ -729,13 +1853,22 @@ func (s *EndpointStore) update(op string, obj any, updateFn func(svcESs map[stri
 		svcESs = make(map[string]*discoveryv1.EndpointSlice)
 		s.serverESs[svc] = svcESs
 	}
-	prevClusters := clusterNames(svcESs)
+	prevClusters := s.serviceClusterNames(svc, svcESs)
+	prevES := svcESs[es.Name]
 	updateFn(svcESs, es)
-	loadAssignments := s.cfg.LoadAssignmentsFromEndpointSlices(s.nodeStore, maps.Values(svcESs))
+	curES := svcESs[es.Name]
+	affected, ok := s.affectedPorts(prevES, curES)
+	if !ok {
+		k8sUnchangedEvents.WithLabelValues("endpointslice").Inc()
+		if len(svcESs) == 0 {
+			delete(s.serverESs, svc)
+		}
+		return nil
+	}
 
 	// Delete assignments for any clusters which no longer exist.
-	for _, ep := range loadAssignments {
-		delete(prevClusters, ep.ClusterName)
+	for cluster := range s.serviceClusterNames(svc, svcESs) {
+		delete(prevClusters, cluster)
 	}
 	for cluster := range prevClusters {
 		s.srv.DeleteEndpoints(ctx, cluster)
@@ -744,6 +1877,29 @@ func (s *EndpointStore) update(op string, obj any, updateFn func(svcESs map[stri
 		delete(s.serverESs, svc)
 	}
 
+	// Only the load assignments for the affected ports change, and only the slices that have
+	// those ports are needed to generate them.
+	changed := make(map[string]*discoveryv1.EndpointSlice)
+	for i, slice := range []*discoveryv1.EndpointSlice{withPorts(prevES, affected), withPorts(curES, affected)} {
+		if slice != nil {
+			changed[strconv.Itoa(i)] = slice
+		}
+	}
+	affectedClusters := s.serviceClusterNames(svc, changed)
+	var slices []*discoveryv1.EndpointSlice
+	for _, slice := range svcESs {
+		if withPorts(slice, affected) != nil {
+			slices = append(slices, slice)
+		}
+	}
+	var loadAssignments []*envoy_config_endpoint_v3.ClusterLoadAssignment
+	for _, cla := range s.serviceLoadAssignments(svc, slices) {
+		if _, ok := affectedClusters[cla.GetClusterName()]; ok {
+			loadAssignments = append(loadAssignments, cla)
+		}
+	}
+	loadAssignments = append(loadAssignments, s.aggregateLoadAssignments(prevES, es)...)
+
 	// Set new assignments.
 	if err := s.srv.AddEndpoints(ctx, loadAssignments); err != nil {
 		logError(ctx)
@@ -752,6 +1908,49 @@ func (s *EndpointStore) update(op string, obj any, updateFn func(svcESs map[stri
 	return nil
 }
 
+// affectedPorts returns the keys of the ports whose load assignments change when prev is replaced by
+// cur, either of which may be nil.  It returns false if nothing that load assignments are
+// generated from changed.
+func (s *EndpointStore) affectedPorts(prev, cur *discoveryv1.EndpointSlice) (map[string]struct{}, bool) {
+	d := DiffEndpointSlices(prev, cur)
+	// The resource version is part of the generated metadata.
+	versionChanged := s.cfg.provenance && prev != nil && cur != nil && prev.GetResourceVersion() != cur.GetResourceVersion()
+	if d.Empty() && !versionChanged {
+		return nil, false
+	}
+	affected := make(map[string]struct{})
+	if d.endpointsChanged() || d.Labels || versionChanged {
+		for _, es := range []*discoveryv1.EndpointSlice{prev, cur} {
+			for key := range slicePorts(es) {
+				affected[key] = struct{}{}
+			}
+		}
+		return affected, true
+	}
+	for _, keys := range [][]string{d.AddedPorts, d.RemovedPorts, d.ChangedPorts} {
+		for _, key := range keys {
+			affected[key] = struct{}{}
+		}
+	}
+	return affected, true
+}
+
+// withPorts returns a copy of es with only the ports in keys, or nil if it has none of them.
+func withPorts(es *discoveryv1.EndpointSlice, keys map[string]struct{}) *discoveryv1.EndpointSlice {
+	var ports []discoveryv1.EndpointPort
+	for key, p := range slicePorts(es) {
+		if _, ok := keys[key]; ok {
+			ports = append(ports, p)
+		}
+	}
+	if len(ports) == 0 {
+		return nil
+	}
+	result := *es
+	result.Ports = ports
+	return &result
+}
+
 func (s *EndpointStore) List() []interface{} {
 	Logger.Debug("List endpoints")
 	return nil
@@ -780,13 +1979,26 @@ func (s *EndpointStore) Replace(objs []interface{}, _ string) error {
 	defer s.mu.Unlock()
 
 	var endpoints []*discoveryv1.EndpointSlice
-	serviceEps := make(map[types.NamespacedName]map[string]*discoveryv1.EndpointSlice)
 	for _, obj := range objs {
 		slice, ok := obj.(*discoveryv1.EndpointSlice)
 		if !ok {
 			logError(ctx)
 			return fmt.Errorf("replace endpointslice: got non-endpointslice object: %#v", obj)
 		}
+		endpoints = append(endpoints, slice)
+	}
+	if err := s.replace(ctx, endpoints); err != nil {
+		logError(ctx)
+		return fmt.Errorf("replace endpoints: %w", err)
+	}
+	return nil
+}
+
+// replace regenerates every load assignment from endpoints, replacing everything that was
+// previously generated.  You must hold the lock.
+func (s *EndpointStore) replace(ctx context.Context, endpoints []*discoveryv1.EndpointSlice) error {
+	serviceEps := make(map[types.NamespacedName]map[string]*discoveryv1.EndpointSlice)
+	for _, slice := range endpoints {
 		svc := esService(slice)
 		svcESs, ok := serviceEps[svc]
 		if !ok {
@@ -794,12 +2006,22 @@ func (s *EndpointStore) Replace(objs []interface{}, _ string) error {
 			serviceEps[svc] = svcESs
 		}
 		svcESs[slice.Name] = slice
-		endpoints = append(endpoints, slice)
 	}
-	loadAssignments := s.cfg.LoadAssignmentsFromEndpointSlices(s.nodeStore, endpoints)
-	if err := s.srv.ReplaceEndpoints(ctx, loadAssignments); err != nil {
-		logError(ctx)
-		return fmt.Errorf("replace endpoints: %v", err)
+	var loadAssignments []*envoy_config_endpoint_v3.ClusterLoadAssignment
+	var included []*discoveryv1.EndpointSlice
+	for key, svcESs := range serviceEps {
+		slices := maps.Values(svcESs)
+		loadAssignments = append(loadAssignments, s.serviceLoadAssignments(key, slices)...)
+		if !s.linkedAs(key).excluded {
+			included = append(included, slices...)
+		}
+	}
+	for _, a := range s.cfg.aggregates {
+		loadAssignments = append(loadAssignments, a.loadAssignment(s.cfg, s.nodeStore, included))
+	}
+	loadAssignments = withoutStatic(s.static.ownsEndpoints, loadAssignments)
+	if err := s.srv.Endpoints.ReplaceMatching(ctx, asResources(loadAssignments), s.owns); err != nil {
+		return err
 	}
 	s.serverESs = serviceEps
 	return nil
@@ -1,23 +1,48 @@
 package glue
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	envoy_config_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	envoy_config_route_v3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	envoy_extensions_filters_network_tcp_proxy_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
+	envoy_extensions_transport_sockets_tls_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
 	envoy_type_v3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/jrockway/ekglue/pkg/cds"
+	"github.com/jrockway/ekglue/pkg/xds"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/testing/protocmp"
 	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
+	admissionv1 "k8s.io/api/admission/v1"
 	v1 "k8s.io/api/core/v1"
 	discoveryv1 "k8s.io/api/discovery/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/tools/cache"
 	"sigs.k8s.io/yaml"
 )
@@ -241,6 +266,82 @@ func TestClustersFromService(t *testing.T) {
 			},
 			want: nil,
 		},
+		{
+			name: "namespace defaults",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "web",
+					Namespace: "team-a",
+				},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{{Name: "http", Port: 80}},
+				},
+			},
+			want: []*envoy_config_cluster_v3.Cluster{
+				{
+					Name:                 "team-a:web:http",
+					ConnectTimeout:       durationpb.New(5 * time.Second),
+					LbPolicy:             envoy_config_cluster_v3.Cluster_LEAST_REQUEST,
+					ClusterDiscoveryType: &envoy_config_cluster_v3.Cluster_Type{Type: envoy_config_cluster_v3.Cluster_STRICT_DNS},
+					LoadAssignment:       singleTargetLoadAssignment("team-a:web:http", "web.team-a.svc.cluster.local.", 80, envoy_config_core_v3.SocketAddress_TCP),
+				},
+			},
+		},
+		{
+			name: "service override beats namespace defaults",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "api",
+					Namespace: "team-a",
+				},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{{Name: "http", Port: 80}},
+				},
+			},
+			want: []*envoy_config_cluster_v3.Cluster{
+				{
+					Name:                 "team-a:api:http",
+					ConnectTimeout:       durationpb.New(3 * time.Second),
+					LbPolicy:             envoy_config_cluster_v3.Cluster_LEAST_REQUEST,
+					ClusterDiscoveryType: &envoy_config_cluster_v3.Cluster_Type{Type: envoy_config_cluster_v3.Cluster_STRICT_DNS},
+					LoadAssignment:       singleTargetLoadAssignment("team-a:api:http", "api.team-a.svc.cluster.local.", 80, envoy_config_core_v3.SocketAddress_TCP),
+				},
+			},
+		},
+		{
+			name: "ports matched by name and number",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "mixed",
+					Namespace: "foo",
+				},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{{Name: "http", Port: 80}, {Name: "http2", Port: 9000}, {Port: 9901}},
+				},
+			},
+			want: []*envoy_config_cluster_v3.Cluster{
+				{
+					Name:                 "foo:mixed:http",
+					ConnectTimeout:       durationpb.New(time.Second),
+					ClusterDiscoveryType: &envoy_config_cluster_v3.Cluster_Type{Type: envoy_config_cluster_v3.Cluster_STRICT_DNS},
+					LoadAssignment:       singleTargetLoadAssignment("foo:mixed:http", "mixed.foo.svc.cluster.local.", 80, envoy_config_core_v3.SocketAddress_TCP),
+				},
+				{
+					Name:                 "foo:mixed:http2",
+					ConnectTimeout:       durationpb.New(time.Second),
+					ClusterDiscoveryType: &envoy_config_cluster_v3.Cluster_Type{Type: envoy_config_cluster_v3.Cluster_STRICT_DNS},
+					LoadAssignment:       singleTargetLoadAssignment("foo:mixed:http2", "mixed.foo.svc.cluster.local.", 9000, envoy_config_core_v3.SocketAddress_TCP),
+					Http2ProtocolOptions: &envoy_config_core_v3.Http2ProtocolOptions{},
+				},
+				{
+					Name:                 "foo:mixed:9901",
+					ConnectTimeout:       durationpb.New(time.Second),
+					LbPolicy:             envoy_config_cluster_v3.Cluster_MAGLEV,
+					ClusterDiscoveryType: &envoy_config_cluster_v3.Cluster_Type{Type: envoy_config_cluster_v3.Cluster_STRICT_DNS},
+					LoadAssignment:       singleTargetLoadAssignment("foo:mixed:9901", "mixed.foo.svc.cluster.local.", 9901, envoy_config_core_v3.SocketAddress_TCP),
+				},
+			},
+		},
 	}
 
 	cfg, err := LoadConfig("testdata/clusters_from_service_test.yaml")
@@ -312,6 +413,16 @@ func TestLoadConfig(t *testing.T) {
 			input:   "testdata/badcluster.yaml",
 			wantErr: true,
 		},
+		{
+			name:    "bad watch selector",
+			input:   "testdata/badwatch.yaml",
+			wantErr: true,
+		},
+		{
+			name:    "bad validation pattern",
+			input:   "testdata/badvalidation.yaml",
+			wantErr: true,
+		},
 	}
 	for _, test := range testData {
 		t.Run(test.name, func(t *testing.T) {
@@ -323,7 +434,7 @@ func TestLoadConfig(t *testing.T) {
 				t.Fatal("expected error, but got success")
 			}
 			want := test.want
-			if diff := cmp.Diff(got, want, protocmp.Transform()); diff != "" {
+			if diff := cmp.Diff(got, want, protocmp.Transform(), cmpopts.IgnoreUnexported(Config{}, ClusterConfig{}, ClusterOverride{}, EndpointConfig{})); diff != "" {
 				t.Errorf("loaded yaml:\n  got: %#v\n want: %#v\n diff: %v", got, want, diff)
 			}
 		})
@@ -426,7 +537,7 @@ func TestLoadAssignmentFromEndpoints(t *testing.T) {
 						},
 						{
 							Addresses:  []string{"10.0.0.4"},
-							Conditions: discoveryv1.EndpointConditions{Ready: ptr(false)},
+							Conditions: discoveryv1.EndpointConditions{Ready: ptr(false), Terminating: ptr(true)},
 							NodeName:   ptr("host1"),
 						},
 					},
@@ -444,7 +555,7 @@ func TestLoadAssignmentFromEndpoints(t *testing.T) {
 							},
 							LbEndpoints: []*envoy_config_endpoint_v3.LbEndpoint{
 								lbEndpoint("10.0.0.1", 8080, envoy_config_core_v3.SocketAddress_TCP, envoy_config_core_v3.HealthStatus_HEALTHY),
-								lbEndpoint("10.0.0.2", 8080, envoy_config_core_v3.SocketAddress_TCP, envoy_config_core_v3.HealthStatus_DEGRADED),
+								lbEndpoint("10.0.0.2", 8080, envoy_config_core_v3.SocketAddress_TCP, envoy_config_core_v3.HealthStatus_UNHEALTHY),
 							},
 						},
 					},
@@ -460,7 +571,7 @@ func TestLoadAssignmentFromEndpoints(t *testing.T) {
 							},
 							LbEndpoints: []*envoy_config_endpoint_v3.LbEndpoint{
 								lbEndpoint("10.0.0.1", 1234, envoy_config_core_v3.SocketAddress_TCP, envoy_config_core_v3.HealthStatus_HEALTHY),
-								lbEndpoint("10.0.0.2", 1234, envoy_config_core_v3.SocketAddress_TCP, envoy_config_core_v3.HealthStatus_DEGRADED),
+								lbEndpoint("10.0.0.2", 1234, envoy_config_core_v3.SocketAddress_TCP, envoy_config_core_v3.HealthStatus_UNHEALTHY),
 							},
 						},
 						{
@@ -471,7 +582,7 @@ func TestLoadAssignmentFromEndpoints(t *testing.T) {
 							},
 							LbEndpoints: []*envoy_config_endpoint_v3.LbEndpoint{
 								lbEndpoint("10.0.0.3", 1234, envoy_config_core_v3.SocketAddress_TCP, envoy_config_core_v3.HealthStatus_HEALTHY),
-								lbEndpoint("10.0.0.4", 1234, envoy_config_core_v3.SocketAddress_TCP, envoy_config_core_v3.HealthStatus_DEGRADED),
+								lbEndpoint("10.0.0.4", 1234, envoy_config_core_v3.SocketAddress_TCP, envoy_config_core_v3.HealthStatus_DRAINING),
 							},
 						},
 					},
@@ -487,7 +598,7 @@ func TestLoadAssignmentFromEndpoints(t *testing.T) {
 							},
 							LbEndpoints: []*envoy_config_endpoint_v3.LbEndpoint{
 								lbEndpoint("10.0.0.1", 1234, envoy_config_core_v3.SocketAddress_UDP, envoy_config_core_v3.HealthStatus_HEALTHY),
-								lbEndpoint("10.0.0.2", 1234, envoy_config_core_v3.SocketAddress_UDP, envoy_config_core_v3.HealthStatus_DEGRADED),
+								lbEndpoint("10.0.0.2", 1234, envoy_config_core_v3.SocketAddress_UDP, envoy_config_core_v3.HealthStatus_UNHEALTHY),
 							},
 						},
 					},
@@ -674,6 +785,61 @@ func TestLocality(t *testing.T) {
 	}
 }
 
+func TestDefaultLocality(t *testing.T) {
+	nodes := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	nodes.Add(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "host0",
+			Labels: map[string]string{
+				v1.LabelTopologyRegion: "region0",
+				v1.LabelTopologyZone:   "region0-zone0",
+			},
+		},
+	})
+	slices := []*discoveryv1.EndpointSlice{{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "foo",
+			Name:      "bar-abcde",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "bar"},
+		},
+		Ports: []discoveryv1.EndpointPort{{Name: ptr("http"), Port: ptr(int32(80)), Protocol: ptr(v1.ProtocolTCP)}},
+		Endpoints: []discoveryv1.Endpoint{
+			{Addresses: []string{"10.0.0.1"}, NodeName: ptr("host0"), Zone: ptr("ignored")},
+			// The node isn't cached, so the slice's zone is used.
+			{Addresses: []string{"10.0.0.2"}, NodeName: ptr("host1"), Zone: ptr("region0-zone1")},
+		},
+	}}
+	got := DefaultConfig().EndpointConfig.LoadAssignmentsFromEndpointSlices(nodes, slices)
+	want := []*envoy_config_endpoint_v3.ClusterLoadAssignment{{
+		ClusterName: "foo:bar:http",
+		Endpoints: []*envoy_config_endpoint_v3.LocalityLbEndpoints{
+			{
+				Locality:    &envoy_config_core_v3.Locality{Region: "region0", Zone: "region0-zone0"},
+				LbEndpoints: []*envoy_config_endpoint_v3.LbEndpoint{lbEndpoint("10.0.0.1", 80, envoy_config_core_v3.SocketAddress_TCP, envoy_config_core_v3.HealthStatus_HEALTHY)},
+			},
+			{
+				Locality:    &envoy_config_core_v3.Locality{Zone: "region0-zone1"},
+				LbEndpoints: []*envoy_config_endpoint_v3.LbEndpoint{lbEndpoint("10.0.0.2", 80, envoy_config_core_v3.SocketAddress_TCP, envoy_config_core_v3.HealthStatus_HEALTHY)},
+			},
+		},
+	}}
+	byZone := protocmp.SortRepeated(func(a, b *envoy_config_endpoint_v3.LocalityLbEndpoints) bool {
+		return a.GetLocality().GetZone() < b.GetLocality().GetZone()
+	})
+	if diff := cmp.Diff(got, want, protocmp.Transform(), byZone); diff != "" {
+		t.Errorf("endpoints:\n%s", diff)
+	}
+
+	// Configuring a locality replaces the default, rather than merging into it.
+	cfg := DefaultConfig()
+	if err := json.Unmarshal([]byte(`{"endpoint_config":{"locality":{"sub_zone_from":{"use_hostname":true}}}}`), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(cfg.EndpointConfig.Locality, &LocalityConfig{SubZoneFrom: &Field{UseHostname: true}}); diff != "" {
+		t.Errorf("configured locality:\n%s", diff)
+	}
+}
+
 func TestLocalitiesAsYAML(t *testing.T) {
 	s := cache.NewStore(cache.MetaNamespaceKeyFunc)
 	s.Add(&v1.Node{
@@ -721,6 +887,60 @@ func TestLocalitiesAsYAML(t *testing.T) {
 	}
 }
 
+func TestAddressRewrites(t *testing.T) {
+	var cfg EndpointConfig
+	if err := yaml.Unmarshal([]byte(`
+address_rewrites:
+  - from: 10.1.0.0/16
+    to: 192.168.0.0/16
+  - from: 10.2.3.4/32
+    to: 172.16.0.1/32
+    port_offset: 30000
+  - from: 10.0.0.0/8
+    port_offset: 1
+  - from: fd00::/64
+    to: 2001:db8::/64
+`), &cfg); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	testData := []struct {
+		addr     string
+		port     int32
+		wantAddr string
+		wantPort int32
+		wantOK   bool
+	}{
+		{addr: "10.1.2.3", port: 80, wantAddr: "192.168.2.3", wantPort: 80, wantOK: true},
+		{addr: "10.2.3.4", port: 80, wantAddr: "172.16.0.1", wantPort: 30080, wantOK: true},
+		{addr: "10.2.3.4", port: 40000, wantOK: false},
+		{addr: "10.3.0.1", port: 80, wantAddr: "10.3.0.1", wantPort: 81, wantOK: true},
+		{addr: "11.0.0.1", port: 80, wantAddr: "11.0.0.1", wantPort: 80, wantOK: true},
+		{addr: "fd00::1:2", port: 80, wantAddr: "2001:db8::1:2", wantPort: 80, wantOK: true},
+		{addr: "example.com", port: 80, wantAddr: "example.com", wantPort: 80, wantOK: true},
+	}
+	for _, test := range testData {
+		addr, port, ok := rewriteAddress(cfg.AddressRewrites, test.addr, test.port)
+		if ok != test.wantOK {
+			t.Errorf("%s:%d: ok:\n  got: %v\n want: %v", test.addr, test.port, ok, test.wantOK)
+			continue
+		}
+		if ok && (addr != test.wantAddr || port != test.wantPort) {
+			t.Errorf("%s:%d: rewritten:\n  got: %s:%d\n want: %s:%d", test.addr, test.port, addr, port, test.wantAddr, test.wantPort)
+		}
+	}
+
+	for _, bad := range []string{
+		`{"from": "10.0.0.0/33", "port_offset": 1}`,
+		`{"from": "10.0.0.0/8", "to": "192.168.0.0/16"}`,
+		`{"from": "10.0.0.0/8", "to": "fd00::/8"}`,
+		`{"from": "10.0.0.0/8"}`,
+	} {
+		if err := json.Unmarshal([]byte(bad), new(AddressRewrite)); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
+
 func TestAllCacheMethods(t *testing.T) {
 	xds := cds.NewServer("test", nil)
 	cfg := DefaultConfig()
@@ -891,3 +1111,4392 @@ func TestAllCacheMethods(t *testing.T) {
 	}
 	assertEndpoints()
 }
+
+func TestUnchangedUpdates(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "a", ResourceVersion: "1"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}},
+	}
+	status := svc.DeepCopy()
+	status.ResourceVersion = "2"
+	status.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "10.0.0.1"}}
+	moved := status.DeepCopy()
+	moved.Spec.Ports[0].Port = 8080
+	annotated := moved.DeepCopy()
+	annotated.Annotations = map[string]string{"foo": "bar"}
+	if diff := cmp.Diff(DiffServices(svc, status), ServiceDiff{}); diff != "" {
+		t.Errorf("status change:\n%s", diff)
+	}
+	if diff := cmp.Diff(DiffServices(status, moved), ServiceDiff{ChangedPorts: []string{"http"}}); diff != "" {
+		t.Errorf("port change:\n%s", diff)
+	}
+	if diff := cmp.Diff(DiffServices(moved, annotated), ServiceDiff{Annotations: true}); diff != "" {
+		t.Errorf("annotation change:\n%s", diff)
+	}
+	if diff := cmp.Diff(DiffServices(nil, svc), ServiceDiff{AddedPorts: []string{"http"}}); diff != "" {
+		t.Errorf("new service:\n%s", diff)
+	}
+
+	server := cds.NewServer("", nil)
+	cfg := DefaultConfig()
+	cs := cfg.ClusterConfig.Store(server)
+	skipped := func(reflector string) float64 {
+		return testutil.ToFloat64(k8sUnchangedEvents.WithLabelValues(reflector))
+	}
+	before := skipped("services")
+	for _, s := range []*v1.Service{svc, status, moved} {
+		if err := cs.Update(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := skipped("services")-before, 1.0; got != want {
+		t.Errorf("skipped service updates:\n  got: %v\n want: %v", got, want)
+	}
+	if got, want := server.Clusters.ListKeys(), []string{"test:a:http"}; !cmp.Equal(got, want) {
+		t.Errorf("clusters:\n  got: %v\n want: %v", got, want)
+	}
+	// Skipped updates are still remembered, for Reconfigure.
+	if got := cs.services[serviceKey(svc)]; got != moved {
+		t.Errorf("service:\n  got: %v\n want: %v", got, moved)
+	}
+
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "a-xyz",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "a"},
+		},
+		Ports: []discoveryv1.EndpointPort{
+			{Name: ptr("http"), Port: ptr(int32(80))},
+			{Name: ptr("grpc"), Port: ptr(int32(9000))},
+		},
+		Endpoints: []discoveryv1.Endpoint{
+			{Addresses: []string{"10.0.0.1"}},
+			{Addresses: []string{"10.0.0.2"}},
+		},
+	}
+	notReady := slice.DeepCopy()
+	notReady.Endpoints[1].Conditions.Ready = ptr(false)
+	renumbered := notReady.DeepCopy()
+	renumbered.Ports[1].Port = ptr(int32(9001))
+	shrunk := renumbered.DeepCopy()
+	shrunk.Ports = shrunk.Ports[:1]
+	if diff := cmp.Diff(DiffEndpointSlices(slice, notReady), EndpointSliceDiff{ChangedEndpoints: []string{"10.0.0.2"}}); diff != "" {
+		t.Errorf("endpoint change:\n%s", diff)
+	}
+	if diff := cmp.Diff(DiffEndpointSlices(notReady, renumbered), EndpointSliceDiff{ChangedPorts: []string{"grpc"}}); diff != "" {
+		t.Errorf("port change:\n%s", diff)
+	}
+	if diff := cmp.Diff(DiffEndpointSlices(renumbered, shrunk), EndpointSliceDiff{RemovedPorts: []string{"grpc"}}); diff != "" {
+		t.Errorf("port removal:\n%s", diff)
+	}
+	if diff := cmp.Diff(DiffEndpointSlices(shrunk, nil), EndpointSliceDiff{RemovedEndpoints: []string{"10.0.0.1", "10.0.0.2"}, RemovedPorts: []string{"http"}, Labels: true}); diff != "" {
+		t.Errorf("deletion:\n%s", diff)
+	}
+
+	es := cfg.EndpointConfig.Store(nil, server)
+	endpoints := func(name string) []string {
+		t.Helper()
+		cla, ok := server.Endpoints.Get(name).(*envoy_config_endpoint_v3.ClusterLoadAssignment)
+		if !ok {
+			return nil
+		}
+		var result []string
+		for _, lle := range cla.GetEndpoints() {
+			for _, lbe := range lle.GetLbEndpoints() {
+				a := lbe.GetEndpoint().GetAddress().GetSocketAddress()
+				result = append(result, fmt.Sprintf("%s:%d", a.GetAddress(), a.GetPortValue()))
+			}
+		}
+		return result
+	}
+	assert := func(step, name string, want ...string) {
+		t.Helper()
+		if diff := cmp.Diff(endpoints(name), want); diff != "" {
+			t.Errorf("%s: %s:\n%s", step, name, diff)
+		}
+	}
+	before = skipped("endpointslice")
+	if err := es.Add(slice); err != nil {
+		t.Fatal(err)
+	}
+	assert("add", "test:a:http", "10.0.0.1:80", "10.0.0.2:80")
+	assert("add", "test:a:grpc", "10.0.0.1:9000", "10.0.0.2:9000")
+	if err := es.Update(slice.DeepCopy()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := skipped("endpointslice")-before, 1.0; got != want {
+		t.Errorf("skipped endpointslice updates:\n  got: %v\n want: %v", got, want)
+	}
+	if err := es.Update(notReady); err != nil {
+		t.Fatal(err)
+	}
+	assert("not ready", "test:a:http", "10.0.0.1:80")
+	assert("not ready", "test:a:grpc", "10.0.0.1:9000")
+	if err := es.Update(renumbered); err != nil {
+		t.Fatal(err)
+	}
+	assert("renumbered", "test:a:http", "10.0.0.1:80")
+	assert("renumbered", "test:a:grpc", "10.0.0.1:9001")
+	if err := es.Update(shrunk); err != nil {
+		t.Fatal(err)
+	}
+	assert("shrunk", "test:a:http", "10.0.0.1:80")
+	assert("shrunk", "test:a:grpc")
+	if err := es.Delete(shrunk); err != nil {
+		t.Fatal(err)
+	}
+	assert("deleted", "test:a:http")
+}
+
+func TestNameCollisions(t *testing.T) {
+	a := types.NamespacedName{Namespace: "foo", Name: "a"}
+	b := types.NamespacedName{Namespace: "foo", Name: "b"}
+	cs := func(names ...string) []*envoy_config_cluster_v3.Cluster {
+		var result []*envoy_config_cluster_v3.Cluster
+		for _, n := range names {
+			result = append(result, &envoy_config_cluster_v3.Cluster{Name: n})
+		}
+		return result
+	}
+	names := func(cs []*envoy_config_cluster_v3.Cluster) []string {
+		var result []string
+		for _, c := range cs {
+			result = append(result, c.GetName())
+		}
+		return result
+	}
+	testData := []struct {
+		policy    CollisionPolicy
+		want      []string
+		wantOwner types.NamespacedName
+		wantErr   bool
+	}{
+		{policy: "", want: []string{"x", "y"}, wantOwner: b},
+		{policy: CollisionOverwrite, want: []string{"x", "y"}, wantOwner: b},
+		{policy: CollisionPreferFirst, want: []string{"y"}, wantOwner: a},
+		{policy: CollisionReject, want: []string{"y"}, wantOwner: a, wantErr: true},
+		{policy: CollisionSuffix, want: []string{"x" + collisionSuffix(b), "y"}, wantOwner: a},
+	}
+	for _, test := range testData {
+		t.Run(string(test.policy), func(t *testing.T) {
+			o := newNameOwners()
+			if _, _, err := o.claim(test.policy, a, cs("x")); err != nil {
+				t.Fatalf("claim a: %v", err)
+			}
+			got, stale, err := o.claim(test.policy, b, cs("x", "y"))
+			if err != nil && !test.wantErr {
+				t.Fatalf("claim b: %v", err)
+			} else if err == nil && test.wantErr {
+				t.Fatal("claim b: expected error")
+			}
+			if diff := cmp.Diff(names(got), test.want); diff != "" {
+				t.Errorf("clusters:\n%s", diff)
+			}
+			if len(stale) > 0 {
+				t.Errorf("unexpected stale clusters: %v", stale)
+			}
+			if got, want := o.owners["x"], test.wantOwner; got != want {
+				t.Errorf("owner of x:\n  got: %v\n want: %v", got, want)
+			}
+
+			// b dropping y should report y as stale.
+			if _, stale, _ := o.claim(test.policy, b, cs("x")); !cmp.Equal(stale, []string{"y"}) {
+				t.Errorf("stale clusters after update:\n  got: %v\n want: [y]", stale)
+			}
+		})
+	}
+}
+
+func TestSameNamedServices(t *testing.T) {
+	cfg, err := parseConfig([]byte(`apiVersion: v1alpha
+naming:
+  sanitize: true
+  max_length: 24
+cluster_config:
+  base:
+    connect_timeout: 1s
+  grpc:
+    listener_name: "{{.Name}}:{{.PortNumber}}"
+    match:
+      - port_name: grpc
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := func(ns string, created int64) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:         ns,
+				Name:              "web-frontend",
+				CreationTimestamp: metav1.Unix(created, 0),
+			},
+			Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "grpc", Port: 9000}}},
+		}
+	}
+	a, b := svc("tenant-a", 1), svc("tenant-b", 2)
+	server := cds.NewServer("", nil)
+	cs := cfg.ClusterConfig.Store(server)
+	nameCluster := cfg.ClusterConfig.naming.nameCluster
+	nameA, _ := nameCluster("tenant-a", "web-frontend", "grpc", 9000, v1.ProtocolTCP)
+	nameB, _ := nameCluster("tenant-b", "web-frontend", "grpc", 9000, v1.ProtocolTCP)
+	if nameA == nameB {
+		t.Fatalf("cluster names collide: %v", nameA)
+	}
+	assert := func(step string, wantTarget string) {
+		t.Helper()
+		if got, want := server.Clusters.ListKeys(), []string{nameA, nameB}; !cmp.Equal(got, want, cmpopts.SortSlices(func(x, y string) bool { return x < y })) {
+			t.Errorf("%s: clusters:\n  got: %v\n want: %v", step, got, want)
+		}
+		var target string
+		if r, ok := server.Routes.Get("web-frontend:9000").(*envoy_config_route_v3.RouteConfiguration); ok {
+			target = r.GetVirtualHosts()[0].GetRoutes()[0].GetRoute().GetCluster()
+		}
+		if target != wantTarget {
+			t.Errorf("%s: route target:\n  got: %v\n want: %v", step, target, wantTarget)
+		}
+	}
+
+	if err := cs.Add(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.Add(b); err != nil {
+		t.Fatal(err)
+	}
+	assert("add", nameA)
+	if err := cs.Update(b); err != nil {
+		t.Fatal(err)
+	}
+	assert("update newer service", nameA)
+
+	// Replace must pick the same owner regardless of the order services arrive in.
+	for i, objs := range [][]interface{}{{a, b}, {b, a}} {
+		if err := cs.Replace(objs, ""); err != nil {
+			t.Fatal(err)
+		}
+		assert(fmt.Sprintf("replace %d", i), nameA)
+	}
+
+	// Deleting the service that lost the name must not delete the other's listener.
+	if err := cs.Delete(b); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := server.Listeners.ListKeys(), []string{"web-frontend:9000"}; !cmp.Equal(got, want) {
+		t.Errorf("listeners after deleting b:\n  got: %v\n want: %v", got, want)
+	}
+	if err := cs.Add(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.Delete(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.Update(b); err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := server.Routes.Get("web-frontend:9000").(*envoy_config_route_v3.RouteConfiguration); !ok {
+		t.Error("route missing after a was deleted")
+	} else if got, want := r.GetVirtualHosts()[0].GetRoutes()[0].GetRoute().GetCluster(), nameB; got != want {
+		t.Errorf("route target after a was deleted:\n  got: %v\n want: %v", got, want)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Limits = &LimitsConfig{MaxClusters: 3, MaxClustersPerNamespace: 2}
+	cfg.link()
+	s := cds.NewServer("", nil)
+	cfg.Limits.Apply(s)
+	cs := cfg.ClusterConfig.Store(s)
+	svc := func(ns, name string, ports ...string) *v1.Service {
+		result := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name}}
+		for i, p := range ports {
+			result.Spec.Ports = append(result.Spec.Ports, v1.ServicePort{Name: p, Port: int32(80 + i)})
+		}
+		return result
+	}
+
+	if err := cs.Add(svc("foo", "a", "http", "grpc")); err != nil {
+		t.Fatalf("add foo/a: %v", err)
+	}
+	if err := cs.Add(svc("foo", "b", "http")); !errors.Is(err, xds.ErrQuotaExceeded) {
+		t.Errorf("add foo/b: expected ErrQuotaExceeded, got %v", err)
+	}
+	// Shrinking a service within a full namespace is always allowed.
+	if err := cs.Update(svc("foo", "a", "http")); err != nil {
+		t.Errorf("update foo/a: %v", err)
+	}
+	if err := cs.Add(svc("bar", "c", "http", "grpc")); err != nil {
+		t.Errorf("add bar/c: %v", err)
+	}
+	if err := cs.Add(svc("bar", "d", "http")); !errors.Is(err, xds.ErrQuotaExceeded) {
+		t.Errorf("add bar/d: expected ErrQuotaExceeded, got %v", err)
+	}
+	if diff := cmp.Diff(s.Clusters.ListKeys(), []string{"bar:c:grpc", "bar:c:http", "foo:a:http"}); diff != "" {
+		t.Errorf("clusters:\n%s", diff)
+	}
+
+	// Replace keeps the oldest services in each namespace.
+	if err := cs.Replace([]interface{}{svc("foo", "a", "http"), svc("foo", "b", "http"), svc("foo", "e", "http")}, ""); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	if diff := cmp.Diff(s.Clusters.ListKeys(), []string{"foo:a:http", "foo:b:http"}); diff != "" {
+		t.Errorf("clusters after replace:\n%s", diff)
+	}
+}
+
+func TestDirectory(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.link()
+	cs := cfg.ClusterConfig.Store(cds.NewServer("", nil))
+	svc := func(ns, name string, ports ...int32) *v1.Service {
+		result := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name}}
+		for _, p := range ports {
+			result.Spec.Ports = append(result.Spec.Ports, v1.ServicePort{Port: p})
+		}
+		return result
+	}
+	entry := func(ns, name string, port int32) *ClusterDirectoryEntry {
+		return &ClusterDirectoryEntry{
+			Cluster:   fmt.Sprintf("%s:%s:%d", ns, name, port),
+			Namespace: ns,
+			Service:   name,
+			Port:      port,
+			DNSName:   name + "." + ns + ".svc.cluster.local",
+		}
+	}
+
+	if err := cs.Add(svc("foo", "a", 80, 443)); err != nil {
+		t.Fatalf("add foo/a: %v", err)
+	}
+	if err := cs.Add(svc("foo", "b", 80)); err != nil {
+		t.Fatalf("add foo/b: %v", err)
+	}
+	if diff := cmp.Diff(cs.Directory(), []*ClusterDirectoryEntry{entry("foo", "a", 443), entry("foo", "a", 80), entry("foo", "b", 80)}); diff != "" {
+		t.Errorf("directory after add:\n%s", diff)
+	}
+	if err := cs.Update(svc("foo", "a", 80)); err != nil {
+		t.Fatalf("update foo/a: %v", err)
+	}
+	if err := cs.Delete(svc("foo", "b")); err != nil {
+		t.Fatalf("delete foo/b: %v", err)
+	}
+	if diff := cmp.Diff(cs.Directory(), []*ClusterDirectoryEntry{entry("foo", "a", 80)}); diff != "" {
+		t.Errorf("directory after update and delete:\n%s", diff)
+	}
+	if err := cs.Replace([]interface{}{svc("bar", "c", 8080)}, ""); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	if diff := cmp.Diff(cs.Directory(), []*ClusterDirectoryEntry{entry("bar", "c", 8080)}); diff != "" {
+		t.Errorf("directory after replace:\n%s", diff)
+	}
+}
+
+func TestNaming(t *testing.T) {
+	long := "a-very-long-namespace-name:a-service-with-an-even-longer-name:http"
+	testData := []struct {
+		name   string
+		naming *NamingConfig
+		input  string
+		want   string
+	}{
+		{
+			name:  "nil config",
+			input: "foo:bar.baz:http",
+			want:  "foo:bar.baz:http",
+		},
+		{
+			name:   "sanitize",
+			naming: &NamingConfig{Sanitize: true},
+			input:  "foo:bar.baz/quux:http",
+			want:   "foo:bar_baz_quux:http",
+		},
+		{
+			name:   "short enough",
+			naming: &NamingConfig{MaxLength: 60},
+			input:  "foo:bar:http",
+			want:   "foo:bar:http",
+		},
+		{
+			name:   "truncate",
+			naming: &NamingConfig{MaxLength: 40},
+			input:  long,
+			want:   long[:31] + "-faa89dfd",
+		},
+		{
+			name:   "truncate multibyte",
+			naming: &NamingConfig{MaxLength: 14},
+			input:  "ns:aüber-service:http",
+			want:   "ns:a-a286036f",
+		},
+	}
+	for _, test := range testData {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.naming.Apply(test.input)
+			if got != test.want {
+				t.Errorf("name:\n  got: %v\n want: %v", got, test.want)
+			}
+			if n := test.naming; n != nil && n.MaxLength > 0 && len(got) > n.MaxLength {
+				t.Errorf("name %q exceeds max length %d", got, n.MaxLength)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("name %q is not valid UTF-8", got)
+			}
+		})
+	}
+
+	// Names that share a long prefix must remain distinct after truncation.
+	n := &NamingConfig{MaxLength: 40}
+	if a, b := n.Apply(long+"-a"), n.Apply(long+"-b"); a == b {
+		t.Errorf("truncated names collide: %v", a)
+	}
+	if err := (&NamingConfig{MaxLength: 5}).Validate(); err == nil {
+		t.Error("expected error for max_length too short to hold a hash")
+	}
+}
+
+func TestNamingTemplate(t *testing.T) {
+	cfg, err := parseConfig([]byte(`apiVersion: v1alpha
+naming:
+  template: "{{.Namespace}}_{{.Name}}_{{.PortName}}"
+cluster_config:
+  base:
+    connect_timeout: 1s
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{
+				{Name: "http", Port: 80},
+				{Port: 443},
+				{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP},
+			},
+		},
+	}
+	var got []string
+	for _, cl := range cfg.ClusterConfig.ClustersFromService(svc) {
+		got = append(got, cl.GetName())
+	}
+	want := []string{"foo_bar_http", "foo_bar_443", "foo_bar_dns:udp"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("cluster names:\n%s", diff)
+	}
+	name, _ := cfg.ClusterConfig.naming.nameCluster("foo", "bar", "http", 80, v1.ProtocolTCP)
+	if want := "foo_bar_http"; name != want {
+		t.Errorf("load assignment name:\n  got: %v\n want: %v", name, want)
+	}
+
+	for _, template := range []string{
+		"{{.Namespace}}_{{.Name}}_{{.PortName}}_{{.Protocol}}",
+		"{{.Name}}.{{.Namespace}}:{{.PortNumber}}",
+	} {
+		if _, err := parseConfig([]byte("apiVersion: v1alpha\nnaming:\n  template: \"" + template + "\"\n")); err != nil {
+			t.Errorf("template %q: unexpected error: %v", template, err)
+		}
+	}
+	for _, template := range []string{
+		"{{.Name}}_{{.PortName}}",
+		"{{.Namespace}}_{{.PortName}}",
+		"{{.Namespace}}_{{.Name}}",
+		"{{.Nope}}",
+		"{{.Name",
+	} {
+		if _, err := parseConfig([]byte("apiVersion: v1alpha\nnaming:\n  template: \"" + template + "\"\n")); err == nil {
+			t.Errorf("template %q: expected error", template)
+		}
+	}
+}
+
+func TestAltStatName(t *testing.T) {
+	js, err := yaml.YAMLToJSON([]byte(`
+base:
+    connect_timeout: 1s
+alt_stat_name: "{{.Namespace}}_{{.Name}}_{{.PortName}}"
+overrides:
+    - match:
+          - port_name: custom
+      override:
+          alt_stat_name: custom_stats
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := new(ClusterConfig)
+	if err := json.Unmarshal(js, cfg); err != nil {
+		t.Fatal(err)
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "foo",
+			Name:      "bar.baz",
+		},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{
+				{Name: "http", Port: 80},
+				{Port: 443},
+				{Name: "custom", Port: 8080},
+			},
+		},
+	}
+	var got []string
+	for _, cl := range cfg.ClustersFromService(svc) {
+		got = append(got, cl.GetAltStatName())
+	}
+	want := []string{"foo_bar_baz_http", "foo_bar_baz_443", "custom_stats"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("alt_stat_name:\n%s", diff)
+	}
+
+	if err := json.Unmarshal([]byte(`{"base":{},"alt_stat_name":"{{.Nope"}`), new(ClusterConfig)); err == nil {
+		t.Error("expected error for invalid template")
+	}
+}
+
+func TestServiceAnnotations(t *testing.T) {
+	js, err := yaml.YAMLToJSON([]byte(`
+base:
+    connect_timeout: 1s
+    http2_protocol_options: {}
+service_annotations: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := new(ClusterConfig)
+	if err := json.Unmarshal(js, cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.naming = new(NamingConfig)
+	svc := func(annotations map[string]string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar", Annotations: annotations},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}},
+		}
+	}
+	testData := []struct {
+		name        string
+		annotations map[string]string
+		want        *envoy_config_cluster_v3.Cluster
+	}{
+		{
+			name: "none",
+			want: &envoy_config_cluster_v3.Cluster{
+				ConnectTimeout:       durationpb.New(time.Second),
+				Http2ProtocolOptions: &envoy_config_core_v3.Http2ProtocolOptions{},
+			},
+		},
+		{
+			name: "all",
+			annotations: map[string]string{
+				ConnectTimeoutAnnotation: "250ms",
+				LbPolicyAnnotation:       "least_request",
+				HTTP2Annotation:          "false",
+			},
+			want: &envoy_config_cluster_v3.Cluster{
+				ConnectTimeout: durationpb.New(250 * time.Millisecond),
+				LbPolicy:       envoy_config_cluster_v3.Cluster_LEAST_REQUEST,
+			},
+		},
+		{
+			name: "invalid values are ignored",
+			annotations: map[string]string{
+				ConnectTimeoutAnnotation: "-1s",
+				LbPolicyAnnotation:       "fastest",
+				HTTP2Annotation:          "maybe",
+			},
+			want: &envoy_config_cluster_v3.Cluster{
+				ConnectTimeout:       durationpb.New(time.Second),
+				Http2ProtocolOptions: &envoy_config_core_v3.Http2ProtocolOptions{},
+			},
+		},
+	}
+	opts := []cmp.Option{
+		protocmp.Transform(),
+		protocmp.IgnoreFields(&envoy_config_cluster_v3.Cluster{}, "name", "type", "load_assignment"),
+	}
+	for _, test := range testData {
+		t.Run(test.name, func(t *testing.T) {
+			got := cfg.ClustersFromService(svc(test.annotations))
+			if len(got) != 1 {
+				t.Fatalf("expected 1 cluster, got %d", len(got))
+			}
+			if diff := cmp.Diff(got[0], test.want, opts...); diff != "" {
+				t.Errorf("cluster:\n%s", diff)
+			}
+		})
+	}
+
+	cfg.ServiceAnnotations = false
+	got := cfg.ClustersFromService(svc(map[string]string{LbPolicyAnnotation: "RANDOM"}))
+	if p := got[0].GetLbPolicy(); p != envoy_config_cluster_v3.Cluster_ROUND_ROBIN {
+		t.Errorf("annotations applied while disabled: lb_policy %v", p)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	v := &ValidationConfig{RequireCircuitBreakers: true, ClusterNamePattern: "^team-"}
+	if err := v.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	breakers := &envoy_config_cluster_v3.CircuitBreakers{
+		Thresholds: []*envoy_config_cluster_v3.CircuitBreakers_Thresholds{{}},
+	}
+	testData := []struct {
+		cluster    *envoy_config_cluster_v3.Cluster
+		violations int
+	}{
+		{&envoy_config_cluster_v3.Cluster{Name: "team-a", CircuitBreakers: breakers}, 0},
+		{&envoy_config_cluster_v3.Cluster{Name: "team-a"}, 1},
+		{&envoy_config_cluster_v3.Cluster{Name: "rogue", CircuitBreakers: breakers}, 1},
+		{&envoy_config_cluster_v3.Cluster{Name: "rogue"}, 2},
+	}
+	for _, test := range testData {
+		var violations int
+		for _, validate := range v.ClusterValidators() {
+			if err := validate(test.cluster); err != nil {
+				violations++
+			}
+		}
+		if violations != test.violations {
+			t.Errorf("%v: violations:\n  got: %v\n want: %v", test.cluster, violations, test.violations)
+		}
+	}
+
+	s := cds.NewServer("test", nil)
+	v.Apply(s)
+	if err := s.Clusters.Add(context.Background(), []xds.Resource{&envoy_config_cluster_v3.Cluster{Name: "rogue"}}); err == nil {
+		t.Error("server accepted a cluster that breaks the rules")
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	js, err := yaml.YAMLToJSON([]byte(`
+base:
+    connect_timeout: 1s
+grpc:
+    match:
+        - port_name: grpc
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := new(ClusterConfig)
+	if err := json.Unmarshal(js, cfg); err != nil {
+		t.Fatal(err)
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "foo",
+			Name:      "bar",
+		},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{
+				{Name: "http", Port: 80},
+				{Name: "grpc", Port: 9000},
+			},
+		},
+	}
+	server := cds.NewServer("", nil)
+	store := cfg.Store(server)
+	if err := store.Add(svc); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if got, want := server.Listeners.ListKeys(), []string{"bar.foo:9000"}; !cmp.Equal(got, want) {
+		t.Errorf("listeners:\n  got: %v\n want: %v", got, want)
+	}
+	rs := server.Routes.List()
+	if got, want := len(rs), 1; got != want {
+		t.Fatalf("route count:\n  got: %v\n want: %v", got, want)
+	}
+	route := rs[0].(*envoy_config_route_v3.RouteConfiguration)
+	if got, want := route.GetVirtualHosts()[0].GetRoutes()[0].GetRoute().GetCluster(), "foo:bar:grpc"; got != want {
+		t.Errorf("route target:\n  got: %v\n want: %v", got, want)
+	}
+
+	if err := store.Delete(svc); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if got := server.Listeners.ListKeys(); len(got) > 0 {
+		t.Errorf("listeners after delete: %v", got)
+	}
+	if got := server.Routes.ListKeys(); len(got) > 0 {
+		t.Errorf("routes after delete: %v", got)
+	}
+
+	if err := json.Unmarshal([]byte(`{"base":{},"grpc":{}}`), new(ClusterConfig)); err == nil {
+		t.Error("expected error for grpc config without matches")
+	}
+}
+
+func TestListenerTemplates(t *testing.T) {
+	js, err := yaml.YAMLToJSON([]byte(`
+base:
+    connect_timeout: 1s
+listeners:
+    - match:
+          - port_name: postgres
+      name: "{{.Name}}.{{.Namespace}}:{{.PortNumber}}"
+      listener:
+          address: {socket_address: {address: 0.0.0.0, port_value: "{{.PortNumber}}"}}
+          filter_chains:
+              - filters:
+                    - name: envoy.filters.network.tcp_proxy
+                      typed_config:
+                          "@type": type.googleapis.com/envoy.extensions.filters.network.tcp_proxy.v3.TcpProxy
+                          stat_prefix: "{{.Namespace}}_{{.Name}}"
+                          cluster: "{{.ClusterName}}"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := new(ClusterConfig)
+	if err := json.Unmarshal(js, cfg); err != nil {
+		t.Fatal(err)
+	}
+	svc := func(name string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: name},
+			Spec: v1.ServiceSpec{
+				Ports: []v1.ServicePort{
+					{Name: "http", Port: 80},
+					{Name: "postgres", Port: 5432},
+				},
+			},
+		}
+	}
+	server := cds.NewServer("", nil)
+	store := cfg.Store(server)
+	if err := store.Add(svc("db")); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if got, want := server.Listeners.ListKeys(), []string{"db.foo:5432"}; !cmp.Equal(got, want) {
+		t.Errorf("listeners:\n  got: %v\n want: %v", got, want)
+	}
+	l := server.Listeners.List()[0].(*envoy_config_listener_v3.Listener)
+	if got, want := l.GetAddress().GetSocketAddress().GetPortValue(), uint32(5432); got != want {
+		t.Errorf("listener port:\n  got: %v\n want: %v", got, want)
+	}
+	proxy := new(envoy_extensions_filters_network_tcp_proxy_v3.TcpProxy)
+	if err := l.GetFilterChains()[0].GetFilters()[0].GetTypedConfig().UnmarshalTo(proxy); err != nil {
+		t.Fatalf("unmarshal tcp proxy: %v", err)
+	}
+	if got, want := proxy.GetCluster(), "foo:db:postgres"; got != want {
+		t.Errorf("tcp proxy cluster:\n  got: %v\n want: %v", got, want)
+	}
+
+	if err := store.Replace([]interface{}{svc("db2")}, ""); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	if got, want := server.Listeners.ListKeys(), []string{"db2.foo:5432"}; !cmp.Equal(got, want) {
+		t.Errorf("listeners after replace:\n  got: %v\n want: %v", got, want)
+	}
+	if err := store.Delete(svc("db2")); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if got := server.Listeners.ListKeys(); len(got) > 0 {
+		t.Errorf("listeners after delete: %v", got)
+	}
+
+	for _, bad := range []string{
+		`{"listener": {}}`,
+		`{"match": [{"port_name": "x"}]}`,
+		`{"match": [{"port_name": "x"}], "listener": {"address": "{{.Nope}}"}}`,
+		`{"match": [{"port_name": "x"}], "listener": {"no_such_field": true}}`,
+	} {
+		if err := json.Unmarshal([]byte(bad), new(ListenerTemplate)); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
+
+func TestTLSPassthrough(t *testing.T) {
+	cfg := new(ClusterConfig)
+	if err := json.Unmarshal([]byte(`{"base":{"connect_timeout":"1s"},"tls_passthrough":{"port":8443}}`), cfg); err != nil {
+		t.Fatal(err)
+	}
+	svc := func(name, names string, annotations ...string) *v1.Service {
+		s := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "foo",
+				Name:        name,
+				Annotations: map[string]string{TLSPassthroughAnnotation: names},
+			},
+			Spec: v1.ServiceSpec{
+				Ports: []v1.ServicePort{
+					{Name: "http", Port: 80},
+					{Name: "https", Port: 443},
+					{Name: "admin", Port: 9443},
+				},
+			},
+		}
+		for i := 0; i+1 < len(annotations); i += 2 {
+			s.Annotations[annotations[i]] = annotations[i+1]
+		}
+		return s
+	}
+	type chain struct {
+		Names   []string
+		Cluster string
+	}
+	chains := func(server *cds.Server) []chain {
+		t.Helper()
+		ls := server.Listeners.List()
+		if len(ls) == 0 {
+			return nil
+		}
+		l := ls[0].(*envoy_config_listener_v3.Listener)
+		if got, want := l.GetName(), DefaultTLSPassthroughListenerName; got != want {
+			t.Errorf("listener name:\n  got: %v\n want: %v", got, want)
+		}
+		if got, want := l.GetAddress().GetSocketAddress().GetPortValue(), uint32(8443); got != want {
+			t.Errorf("listener port:\n  got: %v\n want: %v", got, want)
+		}
+		if got, want := l.GetListenerFilters()[0].GetName(), "envoy.filters.listener.tls_inspector"; got != want {
+			t.Errorf("listener filter:\n  got: %v\n want: %v", got, want)
+		}
+		var result []chain
+		for _, fc := range l.GetFilterChains() {
+			proxy := new(envoy_extensions_filters_network_tcp_proxy_v3.TcpProxy)
+			if err := fc.GetFilters()[0].GetTypedConfig().UnmarshalTo(proxy); err != nil {
+				t.Fatalf("unmarshal tcp proxy: %v", err)
+			}
+			result = append(result, chain{Names: fc.GetFilterChainMatch().GetServerNames(), Cluster: proxy.GetCluster()})
+		}
+		return result
+	}
+
+	server := cds.NewServer("", nil)
+	store := cfg.Store(server)
+	if err := store.Add(svc("plain", "")); err != nil {
+		t.Fatalf("add plain: %v", err)
+	}
+	if got := server.Listeners.ListKeys(); len(got) > 0 {
+		t.Errorf("listeners without passthrough services: %v", got)
+	}
+	// The older service keeps a contested server name, even though its name sorts later.
+	admin := svc("admin", "admin.example.com,example.com", TLSPassthroughPortAnnotation, "admin")
+	admin.CreationTimestamp = metav1.NewTime(time.Unix(2, 0))
+	if err := store.Add(admin); err != nil {
+		t.Fatalf("add admin: %v", err)
+	}
+	web := svc("web", "www.example.com, Example.com")
+	web.CreationTimestamp = metav1.NewTime(time.Unix(1, 0))
+	if err := store.Add(web); err != nil {
+		t.Fatalf("add web: %v", err)
+	}
+	want := []chain{
+		{Names: []string{"www.example.com", "example.com"}, Cluster: "foo:web:https"},
+		{Names: []string{"admin.example.com"}, Cluster: "foo:admin:admin"},
+	}
+	if diff := cmp.Diff(chains(server), want); diff != "" {
+		t.Errorf("filter chains:\n%s", diff)
+	}
+
+	// A broken annotation drops the service's chain instead of leaving the old one in place.
+	if err := store.Update(svc("admin", "admin.example.com", TLSPassthroughPortAnnotation, "nope")); err != nil {
+		t.Fatalf("update admin: %v", err)
+	}
+	want = []chain{{Names: []string{"www.example.com", "example.com"}, Cluster: "foo:web:https"}}
+	if diff := cmp.Diff(chains(server), want); diff != "" {
+		t.Errorf("filter chains after bad update:\n%s", diff)
+	}
+	if err := store.Update(admin); err != nil {
+		t.Fatalf("update admin: %v", err)
+	}
+
+	if err := store.Delete(svc("admin", "")); err != nil {
+		t.Fatalf("delete admin: %v", err)
+	}
+	want = []chain{{Names: []string{"www.example.com", "example.com"}, Cluster: "foo:web:https"}}
+	if diff := cmp.Diff(chains(server), want); diff != "" {
+		t.Errorf("filter chains after delete:\n%s", diff)
+	}
+
+	if err := store.Replace([]interface{}{svc("web", ""), svc("db", "db.example.com", TLSPassthroughPortAnnotation, "9443")}, ""); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	want = []chain{{Names: []string{"db.example.com"}, Cluster: "foo:db:admin"}}
+	if diff := cmp.Diff(chains(server), want); diff != "" {
+		t.Errorf("filter chains after replace:\n%s", diff)
+	}
+	if err := store.Update(svc("db", "")); err != nil {
+		t.Fatalf("update db: %v", err)
+	}
+	if got := server.Listeners.ListKeys(); len(got) > 0 {
+		t.Errorf("listeners after removing annotation: %v", got)
+	}
+
+	if err := json.Unmarshal([]byte(`{"listener_name":"x"}`), new(TLSPassthroughConfig)); err == nil {
+		t.Error("expected error for passthrough config without port")
+	}
+}
+
+func TestServiceTypeFiltering(t *testing.T) {
+	svc := func(t v1.ServiceType) *v1.Service {
+		return &v1.Service{Spec: v1.ServiceSpec{Type: t}}
+	}
+	testData := []struct {
+		name     string
+		include  []v1.ServiceType
+		exclude  []v1.ServiceType
+		services map[v1.ServiceType]bool
+	}{
+		{
+			name: "no filters",
+			services: map[v1.ServiceType]bool{
+				"":                         true,
+				v1.ServiceTypeClusterIP:    true,
+				v1.ServiceTypeExternalName: true,
+			},
+		},
+		{
+			name:    "pod-backed only",
+			exclude: []v1.ServiceType{v1.ServiceTypeExternalName},
+			services: map[v1.ServiceType]bool{
+				"":                         true,
+				v1.ServiceTypeNodePort:     true,
+				v1.ServiceTypeExternalName: false,
+			},
+		},
+		{
+			name:    "external-facing only",
+			include: []v1.ServiceType{v1.ServiceTypeNodePort, v1.ServiceTypeLoadBalancer},
+			services: map[v1.ServiceType]bool{
+				"":                         false,
+				v1.ServiceTypeClusterIP:    false,
+				v1.ServiceTypeNodePort:     true,
+				v1.ServiceTypeLoadBalancer: true,
+				v1.ServiceTypeExternalName: false,
+			},
+		},
+		{
+			name:    "include and exclude",
+			include: []v1.ServiceType{v1.ServiceTypeClusterIP, v1.ServiceTypeNodePort},
+			exclude: []v1.ServiceType{v1.ServiceTypeNodePort},
+			services: map[v1.ServiceType]bool{
+				v1.ServiceTypeClusterIP: true,
+				v1.ServiceTypeNodePort:  false,
+			},
+		},
+	}
+	for _, test := range testData {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &ClusterConfig{IncludeServiceTypes: test.include, ExcludeServiceTypes: test.exclude}
+			for st, want := range test.services {
+				if got := cfg.IncludesService(svc(st)); got != want {
+					t.Errorf("type %q: included:\n  got: %v\n want: %v", st, got, want)
+				}
+			}
+		})
+	}
+
+	if err := json.Unmarshal([]byte(`{"base":{},"exclude_service_types":["Headless"]}`), new(ClusterConfig)); err == nil {
+		t.Error("expected error for unknown service type")
+	}
+}
+
+func TestServiceSelectors(t *testing.T) {
+	cfg := new(ClusterConfig)
+	if err := json.Unmarshal([]byte(`{
+		"base": {},
+		"include_services": [
+			{"namespace": "team-*"},
+			{"annotation": "ekglue.io/enabled", "annotation_value": "true"}
+		],
+		"exclude_services": [
+			{"name_regex": "(canary|debug)-.*"},
+			{"namespace": "team-b", "name": "secret"}
+		]
+	}`), cfg); err != nil {
+		t.Fatal(err)
+	}
+	svc := func(namespace, name string, annotations map[string]string) *v1.Service {
+		return &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Annotations: annotations}}
+	}
+	testData := []struct {
+		svc  *v1.Service
+		want bool
+	}{
+		{svc("team-a", "web", nil), true},
+		{svc("team-b", "secret", nil), false},
+		{svc("team-a", "secret", nil), true},
+		{svc("team-a", "canary-web", nil), false},
+		{svc("team-a", "web-canary-1", nil), true},
+		{svc("default", "web", nil), false},
+		{svc("default", "web", map[string]string{EnabledAnnotation: "true"}), true},
+		{svc("default", "web", map[string]string{EnabledAnnotation: "false"}), false},
+		{svc("default", "debug-web", map[string]string{EnabledAnnotation: "true"}), false},
+	}
+	for _, test := range testData {
+		if got := cfg.IncludesService(test.svc); got != test.want {
+			t.Errorf("%s/%s %v: included:\n  got: %v\n want: %v", test.svc.Namespace, test.svc.Name, test.svc.Annotations, got, test.want)
+		}
+	}
+
+	// Selectors built in Go work without being unmarshaled.
+	if !(&ServiceSelector{NameRegex: "web|api"}).Selects(svc("default", "api", nil)) {
+		t.Error("selector built in go should select default/api")
+	}
+
+	for _, bad := range []string{`{}`, `{"name": "["}`, `{"namespace_regex": "("}`, `{"annotation_value": "true"}`} {
+		if err := json.Unmarshal([]byte(bad), new(ServiceSelector)); err == nil {
+			t.Errorf("expected error for selector %s", bad)
+		}
+	}
+}
+
+func TestLinkedEndpointsSkipExcludedServices(t *testing.T) {
+	cfg, err := parseConfig([]byte(`apiVersion: v1alpha
+cluster_config:
+  base:
+    connect_timeout: 1s
+  exclude_services:
+    - annotation: ekglue.io/skip
+      annotation_value: "true"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := cds.NewServer("", nil)
+	stores := &Stores{Clusters: cfg.ClusterConfig.Store(server), Endpoints: cfg.EndpointConfig.Store(nil, server)}
+	stores.Link()
+	svc := func(name string, skip bool) *v1.Service {
+		s := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: name},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}},
+		}
+		if skip {
+			s.Annotations = map[string]string{"ekglue.io/skip": "true"}
+		}
+		return s
+	}
+	slice := func(name, addr string) *discoveryv1.EndpointSlice {
+		return &discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: name + "-abcde", Labels: map[string]string{discoveryv1.LabelServiceName: name}},
+			Ports:      []discoveryv1.EndpointPort{{Name: ptr("http"), Port: ptr[int32](80)}},
+			Endpoints:  []discoveryv1.Endpoint{{Addresses: []string{addr}}},
+		}
+	}
+	check := func(desc string, want []string) {
+		t.Helper()
+		if diff := cmp.Diff(server.Endpoints.ListKeys(), want, cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("%s: endpoints:\n%s", desc, diff)
+		}
+	}
+
+	// Until the service is known, its endpoints are served.
+	for _, es := range []*discoveryv1.EndpointSlice{slice("web", "10.0.0.1"), slice("debug", "10.0.0.2")} {
+		if err := stores.Endpoints.Add(es); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("before services", []string{"foo:debug:http", "foo:web:http"})
+
+	if err := stores.Clusters.Replace([]interface{}{svc("web", false), svc("debug", true)}, ""); err != nil {
+		t.Fatal(err)
+	}
+	check("after services", []string{"foo:web:http"})
+	if err := stores.Endpoints.Update(slice("debug", "10.0.0.3")); err != nil {
+		t.Fatal(err)
+	}
+	check("after excluded slice update", []string{"foo:web:http"})
+	if err := stores.Endpoints.Replace([]interface{}{slice("web", "10.0.0.1"), slice("debug", "10.0.0.3")}, ""); err != nil {
+		t.Fatal(err)
+	}
+	check("after endpoints replace", []string{"foo:web:http"})
+
+	if err := stores.Clusters.Update(svc("debug", false)); err != nil {
+		t.Fatal(err)
+	}
+	check("after including", []string{"foo:debug:http", "foo:web:http"})
+	if err := stores.Clusters.Update(svc("web", true)); err != nil {
+		t.Fatal(err)
+	}
+	check("after excluding", []string{"foo:debug:http"})
+}
+
+func TestLinkedEndpointsFollowCollisionPolicy(t *testing.T) {
+	for _, test := range []struct {
+		policy CollisionPolicy
+		want   map[string][]string
+	}{
+		{
+			policy: CollisionPreferFirst,
+			want:   map[string][]string{"foo-bar-baz-http": {"10.0.0.1"}},
+		},
+		{
+			policy: CollisionOverwrite,
+			want:   map[string][]string{"foo-bar-baz-http": {"10.0.0.2"}},
+		},
+		{
+			policy: CollisionSuffix,
+			want: map[string][]string{
+				"foo-bar-baz-http": {"10.0.0.1"},
+				"foo-bar-baz-http" + collisionSuffix(types.NamespacedName{Namespace: "foo", Name: "bar-baz"}): {"10.0.0.2"},
+			},
+		},
+	} {
+		t.Run(string(test.policy), func(t *testing.T) {
+			cfg, err := parseConfig([]byte(`apiVersion: v1alpha
+naming:
+  template: "{{.Namespace}}-{{.Name}}-{{.PortName}}"
+cluster_config:
+  base:
+    connect_timeout: 1s
+  collision_policy: ` + string(test.policy) + `
+`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := cds.NewServer("", nil)
+			stores := &Stores{Clusters: cfg.ClusterConfig.Store(server), Endpoints: cfg.EndpointConfig.Store(nil, server)}
+			stores.Link()
+			// "foo-bar/baz" and "foo/bar-baz" generate the same name.
+			svc := func(ns, name string, created int64) *v1.Service {
+				return &v1.Service{
+					ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name, CreationTimestamp: metav1.Unix(created, 0)},
+					Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}},
+				}
+			}
+			slice := func(ns, name, addr string) *discoveryv1.EndpointSlice {
+				return &discoveryv1.EndpointSlice{
+					ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name + "-abcde", Labels: map[string]string{discoveryv1.LabelServiceName: name}},
+					Ports:      []discoveryv1.EndpointPort{{Name: ptr("http"), Port: ptr[int32](80)}},
+					Endpoints:  []discoveryv1.Endpoint{{Addresses: []string{addr}}},
+				}
+			}
+			check := func(desc string) {
+				t.Helper()
+				got := make(map[string][]string)
+				for _, r := range server.Endpoints.List() {
+					cla := r.(*envoy_config_endpoint_v3.ClusterLoadAssignment)
+					for _, lle := range cla.GetEndpoints() {
+						for _, lbe := range lle.GetLbEndpoints() {
+							got[cla.GetClusterName()] = append(got[cla.GetClusterName()], lbe.GetEndpoint().GetAddress().GetSocketAddress().GetAddress())
+						}
+					}
+				}
+				if diff := cmp.Diff(got, test.want); diff != "" {
+					t.Errorf("%s: endpoints:\n%s", desc, diff)
+				}
+			}
+
+			for _, es := range []*discoveryv1.EndpointSlice{slice("foo-bar", "baz", "10.0.0.1"), slice("foo", "bar-baz", "10.0.0.2")} {
+				if err := stores.Endpoints.Add(es); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := stores.Clusters.Add(svc("foo-bar", "baz", 1)); err != nil {
+				t.Fatal(err)
+			}
+			if err := stores.Clusters.Add(svc("foo", "bar-baz", 2)); err != nil {
+				t.Fatal(err)
+			}
+			check("after adds")
+			// Deleting either service's slice doesn't delete the other's load assignment.
+			for _, es := range []*discoveryv1.EndpointSlice{slice("foo", "bar-baz", "10.0.0.2"), slice("foo-bar", "baz", "10.0.0.1")} {
+				if err := stores.Endpoints.Delete(es); err != nil {
+					t.Fatal(err)
+				}
+				if err := stores.Endpoints.Add(es); err != nil {
+					t.Fatal(err)
+				}
+			}
+			check("after slices are recreated")
+			if err := stores.Clusters.Replace([]interface{}{svc("foo-bar", "baz", 1), svc("foo", "bar-baz", 2)}, ""); err != nil {
+				t.Fatal(err)
+			}
+			check("after replace")
+		})
+	}
+}
+
+func TestLinkedEndpointsMatchServicePorts(t *testing.T) {
+	cfg, err := parseConfig([]byte(`apiVersion: v1alpha
+endpoint_config:
+  locality:
+    zone_from:
+      label: zone
+zone_clusters:
+  match:
+    - port: 80
+  zones:
+    - us-east-1a
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	nodes.Add(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "a", Labels: map[string]string{"zone": "us-east-1a"}}})
+	server := cds.NewServer("", nil)
+	stores := &Stores{Clusters: cfg.ClusterConfig.Store(server), Endpoints: cfg.EndpointConfig.Store(nodes, server)}
+	stores.Link()
+	// The service port is 80, but the EndpointSlice has the target port, 8080.
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}, {Name: "admin", Port: 9090}}},
+	}
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar-abcde", Labels: map[string]string{discoveryv1.LabelServiceName: "bar"}},
+		Ports:      []discoveryv1.EndpointPort{{Name: ptr("http"), Port: ptr[int32](8080)}, {Name: ptr("admin"), Port: ptr[int32](80)}},
+		Endpoints:  []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.1"}, NodeName: ptr("a")}},
+	}
+	if err := stores.Clusters.Add(svc); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores.Endpoints.Add(slice); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"foo:bar:admin", "foo:bar:http", "foo:bar:http-us-east-1a"}
+	if diff := cmp.Diff(server.Clusters.ListKeys(), want); diff != "" {
+		t.Errorf("clusters:\n%s", diff)
+	}
+	if diff := cmp.Diff(server.Endpoints.ListKeys(), want); diff != "" {
+		t.Errorf("endpoints:\n%s", diff)
+	}
+}
+
+func TestAggregates(t *testing.T) {
+	js, err := yaml.YAMLToJSON([]byte(`
+apiVersion: v1alpha
+aggregates:
+    - name: ingestion
+      selector:
+          app: ingestion
+      port_name: grpc
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	if err := json.Unmarshal(js, cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.link()
+
+	svc := func(namespace, name, app string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      name,
+				Labels:    map[string]string{"app": app},
+			},
+			Spec: v1.ServiceSpec{
+				Ports: []v1.ServicePort{{Name: "grpc", Port: 9000}},
+			},
+		}
+	}
+	slice := func(namespace, name, app, addr string) *discoveryv1.EndpointSlice {
+		return &discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      name + "-abcde",
+				Labels:    map[string]string{"app": app, discoveryv1.LabelServiceName: name},
+			},
+			Ports:     []discoveryv1.EndpointPort{{Name: ptr("grpc"), Port: ptr[int32](9000)}},
+			Endpoints: []discoveryv1.Endpoint{{Addresses: []string{addr}}},
+		}
+	}
+	a, b, other := svc("a", "writer", "ingestion"), svc("b", "reader", "ingestion"), svc("a", "other", "web")
+
+	server := cds.NewServer("", nil)
+	cs := cfg.ClusterConfig.Store(server)
+	es := cfg.EndpointConfig.Store(nil, server)
+	hasCluster := func() bool {
+		for _, name := range server.Clusters.ListKeys() {
+			if name == "ingestion" {
+				return true
+			}
+		}
+		return false
+	}
+	addresses := func() []string {
+		var result []string
+		for _, r := range server.Endpoints.List() {
+			cla := r.(*envoy_config_endpoint_v3.ClusterLoadAssignment)
+			if cla.GetClusterName() != "ingestion" {
+				continue
+			}
+			for _, lle := range cla.GetEndpoints() {
+				for _, lbe := range lle.GetLbEndpoints() {
+					result = append(result, lbe.GetEndpoint().GetAddress().GetSocketAddress().GetAddress())
+				}
+			}
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	if err := cs.Add(other); err != nil {
+		t.Fatal(err)
+	}
+	if hasCluster() {
+		t.Error("aggregate cluster exists without members")
+	}
+	for _, s := range []*v1.Service{a, b} {
+		if err := cs.Add(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !hasCluster() {
+		t.Error("aggregate cluster missing")
+	}
+	for _, s := range []*discoveryv1.EndpointSlice{slice("a", "writer", "ingestion", "10.0.0.1"), slice("b", "reader", "ingestion", "10.0.0.2"), slice("a", "other", "web", "10.0.0.3")} {
+		if err := es.Add(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if diff := cmp.Diff(addresses(), []string{"10.0.0.1", "10.0.0.2"}); diff != "" {
+		t.Errorf("aggregate endpoints:\n%s", diff)
+	}
+	if err := es.Delete(slice("b", "reader", "ingestion", "10.0.0.2")); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(addresses(), []string{"10.0.0.1"}); diff != "" {
+		t.Errorf("aggregate endpoints after delete:\n%s", diff)
+	}
+
+	if err := cs.Delete(a); err != nil {
+		t.Fatal(err)
+	}
+	if !hasCluster() {
+		t.Error("aggregate cluster deleted while it still has members")
+	}
+	if err := cs.Delete(b); err != nil {
+		t.Fatal(err)
+	}
+	if hasCluster() {
+		t.Error("aggregate cluster exists after all members were deleted")
+	}
+
+	if err := cs.Replace([]interface{}{a, other}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !hasCluster() {
+		t.Error("aggregate cluster missing after replace")
+	}
+
+	if err := json.Unmarshal([]byte(`{"name":"x"}`), new(Aggregate)); err == nil {
+		t.Error("expected error for aggregate without selector")
+	}
+}
+
+func TestZoneClusters(t *testing.T) {
+	js, err := yaml.YAMLToJSON([]byte(`
+apiVersion: v1alpha
+endpoint_config:
+    locality:
+        zone_from:
+            label: zone
+zone_clusters:
+    match:
+        - port_name: http
+    zones:
+        - us-east-1a
+        - us-east-1b
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	if err := json.Unmarshal(js, cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.link()
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{{Name: "http", Port: 80}, {Name: "admin", Port: 9090}},
+		},
+	}
+	var names []string
+	for _, cl := range cfg.ClusterConfig.ClustersFromService(svc) {
+		names = append(names, cl.GetName())
+		if strings.HasPrefix(cl.GetName(), "foo:bar:http-") && cl.GetType() != envoy_config_cluster_v3.Cluster_EDS {
+			t.Errorf("zone cluster %s: type:\n  got: %v\n want: EDS", cl.GetName(), cl.GetType())
+		}
+	}
+	sort.Strings(names)
+	if diff := cmp.Diff(names, []string{"foo:bar:admin", "foo:bar:http", "foo:bar:http-us-east-1a", "foo:bar:http-us-east-1b"}); diff != "" {
+		t.Errorf("cluster names:\n%s", diff)
+	}
+
+	nodes := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	for _, n := range []struct{ name, zone string }{{"a", "us-east-1a"}, {"b", "us-east-1b"}} {
+		nodes.Add(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: n.name, Labels: map[string]string{"zone": n.zone}}})
+	}
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "foo",
+			Name:      "bar-abcde",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "bar"},
+		},
+		Ports: []discoveryv1.EndpointPort{{Name: ptr("http"), Port: ptr[int32](80)}},
+		Endpoints: []discoveryv1.Endpoint{
+			{Addresses: []string{"10.0.0.1"}, NodeName: ptr("a")},
+			{Addresses: []string{"10.0.0.2"}, NodeName: ptr("b")},
+			{Addresses: []string{"10.0.0.3"}, NodeName: ptr("b")},
+		},
+	}
+	got := make(map[string]int)
+	for _, cla := range cfg.EndpointConfig.LoadAssignmentsFromEndpointSlices(nodes, []*discoveryv1.EndpointSlice{slice}) {
+		for _, lle := range cla.GetEndpoints() {
+			got[cla.GetClusterName()] += len(lle.GetLbEndpoints())
+		}
+	}
+	want := map[string]int{"foo:bar:http": 3, "foo:bar:http-us-east-1a": 1, "foo:bar:http-us-east-1b": 2}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("endpoint counts:\n%s", diff)
+	}
+}
+
+func TestZoneFailover(t *testing.T) {
+	js, err := yaml.YAMLToJSON([]byte(`
+apiVersion: v1alpha
+endpoint_config:
+    locality:
+        region_from:
+            label: region
+        zone_from:
+            label: zone
+zone_clusters:
+    match:
+        - port_name: http
+    zones:
+        - r1-a
+        - r2-a
+        - r3-a
+    failover: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	if err := json.Unmarshal(js, cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.link()
+
+	nodes := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	for _, n := range []struct{ name, region, zone string }{{"a", "r1", "r1-a"}, {"b", "r1", "r1-b"}, {"c", "r2", "r2-a"}} {
+		nodes.Add(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: n.name, Labels: map[string]string{"region": n.region, "zone": n.zone}}})
+	}
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "foo",
+			Name:      "bar-abcde",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "bar"},
+		},
+		Ports: []discoveryv1.EndpointPort{{Name: ptr("http"), Port: ptr[int32](80)}},
+		Endpoints: []discoveryv1.Endpoint{
+			{Addresses: []string{"10.0.0.1"}, NodeName: ptr("a")},
+			{Addresses: []string{"10.0.0.2"}, NodeName: ptr("b")},
+			{Addresses: []string{"10.0.0.3"}, NodeName: ptr("c")},
+		},
+	}
+	got := make(map[string]map[string]uint32)
+	for _, cla := range cfg.EndpointConfig.LoadAssignmentsFromEndpointSlices(nodes, []*discoveryv1.EndpointSlice{slice}) {
+		priorities := make(map[string]uint32)
+		for _, lle := range cla.GetEndpoints() {
+			priorities[lle.GetLocality().GetZone()] = lle.GetPriority()
+		}
+		got[cla.GetClusterName()] = priorities
+	}
+	want := map[string]map[string]uint32{
+		"foo:bar:http": {"r1-a": 0, "r1-b": 0, "r2-a": 0},
+		// Same zone, then same region, then everything else.
+		"foo:bar:http-r1-a": {"r1-a": 0, "r1-b": 1, "r2-a": 2},
+		// No other zones in the region, so priority 1 is skipped.
+		"foo:bar:http-r2-a": {"r2-a": 0, "r1-a": 1, "r1-b": 1},
+		// No endpoints in the zone, so everything is equally far away.
+		"foo:bar:http-r3-a": {"r1-a": 0, "r1-b": 0, "r2-a": 0},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("priorities:\n%s", diff)
+	}
+}
+
+func TestCiliumIdentities(t *testing.T) {
+	cfg := &EndpointConfig{CiliumIdentityMetadata: true}
+	ids := cfg.IdentityStore()
+	cep := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"namespace": "foo", "name": "bar-1234"},
+		"status": map[string]interface{}{
+			"identity": map[string]interface{}{
+				"id":     int64(4242),
+				"labels": []interface{}{"k8s:app=bar", "k8s:io.kubernetes.pod.namespace=foo"},
+			},
+			"networking": map[string]interface{}{
+				"addressing": []interface{}{map[string]interface{}{"ipv4": "10.0.0.1"}},
+			},
+		},
+	}}
+	if err := ids.Add(cep); err != nil {
+		t.Fatal(err)
+	}
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "foo",
+			Name:      "bar-abcde",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "bar"},
+		},
+		Ports:     []discoveryv1.EndpointPort{{Name: ptr("http"), Port: ptr[int32](80)}},
+		Endpoints: []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.1", "10.0.0.2"}}},
+	}
+	got := make(map[string]string)
+	for _, cla := range cfg.LoadAssignmentsFromEndpointSlices(nil, []*discoveryv1.EndpointSlice{slice}) {
+		for _, lle := range cla.GetEndpoints() {
+			for _, lbe := range lle.GetLbEndpoints() {
+				md := lbe.GetMetadata().GetFilterMetadata()[CiliumMetadataNamespace].GetFields()
+				got[lbe.GetEndpoint().GetAddress().GetSocketAddress().GetAddress()] = md["labels"].GetStructValue().GetFields()["k8s:app"].GetStringValue()
+			}
+		}
+	}
+	if diff := cmp.Diff(got, map[string]string{"10.0.0.1": "bar", "10.0.0.2": ""}); diff != "" {
+		t.Errorf("identity labels:\n%s", diff)
+	}
+
+	if err := ids.Delete(cep); err != nil {
+		t.Fatal(err)
+	}
+	if got := ids.ListKeys(); len(got) > 0 {
+		t.Errorf("identities after delete: %v", got)
+	}
+
+	// Identities that change after a load assignment is generated regenerate it.
+	server := cds.NewServer("", nil)
+	es := cfg.Store(nil, server)
+	idStore := es.IdentityStore(ids)
+	if err := es.Add(slice); err != nil {
+		t.Fatal(err)
+	}
+	identity := func() int64 {
+		t.Helper()
+		for _, r := range server.Endpoints.List() {
+			for _, lle := range r.(*envoy_config_endpoint_v3.ClusterLoadAssignment).GetEndpoints() {
+				for _, lbe := range lle.GetLbEndpoints() {
+					if lbe.GetEndpoint().GetAddress().GetSocketAddress().GetAddress() == "10.0.0.1" {
+						return int64(lbe.GetMetadata().GetFilterMetadata()[CiliumMetadataNamespace].GetFields()["identity"].GetNumberValue())
+					}
+				}
+			}
+		}
+		t.Fatal("no endpoint for 10.0.0.1")
+		return 0
+	}
+	if got := identity(); got != 0 {
+		t.Errorf("identity before cilium endpoint:\n  got: %v\n want: 0", got)
+	}
+	if err := idStore.Add(cep); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := identity(), int64(4242); got != want {
+		t.Errorf("identity after cilium endpoint:\n  got: %v\n want: %v", got, want)
+	}
+	if err := idStore.Delete(cep); err != nil {
+		t.Fatal(err)
+	}
+	if got := identity(); got != 0 {
+		t.Errorf("identity after deleting cilium endpoint:\n  got: %v\n want: 0", got)
+	}
+}
+
+func TestOpenShiftRoutes(t *testing.T) {
+	route := func(name, host, path string, port interface{}, backends ...interface{}) *unstructured.Unstructured {
+		spec := map[string]interface{}{
+			"host": host,
+			"path": path,
+			"to":   backends[0],
+		}
+		if port != nil {
+			spec["port"] = map[string]interface{}{"targetPort": port}
+		}
+		if len(backends) > 1 {
+			spec["alternateBackends"] = backends[1:]
+		}
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"metadata": map[string]interface{}{"namespace": "foo", "name": name},
+			"spec":     spec,
+		}}
+	}
+	backend := func(name string, weight int64) interface{} {
+		return map[string]interface{}{"kind": "Service", "name": name, "weight": weight}
+	}
+
+	cfg := &OpenShiftRouteConfig{ListenerPort: 8080}
+	server := cds.NewServer("", nil)
+	store := cfg.Store(server)
+	objs := []interface{}{
+		route("root", "example.com", "", "http", backend("web", 100)),
+		route("api", "example.com", "/api", int64(8080), backend("api", 90), backend("api-canary", 10)),
+		route("noport", "example.com", "/noport", nil, backend("web", 100)),
+		route("drained", "other.example.com", "", "http", backend("web", 0)),
+	}
+	if err := store.Replace(objs, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := server.Listeners.ListKeys(), []string{DefaultOpenShiftRouteConfigName}; !cmp.Equal(got, want) {
+		t.Errorf("listeners:\n  got: %v\n want: %v", got, want)
+	}
+	rs := server.Routes.List()
+	if len(rs) != 1 {
+		t.Fatalf("expected 1 route configuration, got %d", len(rs))
+	}
+	got := rs[0].(*envoy_config_route_v3.RouteConfiguration)
+	want := &envoy_config_route_v3.RouteConfiguration{
+		Name: DefaultOpenShiftRouteConfigName,
+		VirtualHosts: []*envoy_config_route_v3.VirtualHost{
+			{
+				Name:    "example.com",
+				Domains: []string{"example.com"},
+				Routes: []*envoy_config_route_v3.Route{
+					{
+						Name:  "foo/api",
+						Match: &envoy_config_route_v3.RouteMatch{PathSpecifier: &envoy_config_route_v3.RouteMatch_Prefix{Prefix: "/api"}},
+						Action: &envoy_config_route_v3.Route_Route{Route: &envoy_config_route_v3.RouteAction{
+							ClusterSpecifier: &envoy_config_route_v3.RouteAction_WeightedClusters{WeightedClusters: &envoy_config_route_v3.WeightedCluster{
+								Clusters: []*envoy_config_route_v3.WeightedCluster_ClusterWeight{
+									{Name: "foo:api:8080", Weight: wrapperspb.UInt32(90)},
+									{Name: "foo:api-canary:8080", Weight: wrapperspb.UInt32(10)},
+								},
+							}},
+						}},
+					},
+					{
+						Name:  "foo/root",
+						Match: &envoy_config_route_v3.RouteMatch{PathSpecifier: &envoy_config_route_v3.RouteMatch_Prefix{Prefix: "/"}},
+						Action: &envoy_config_route_v3.Route_Route{Route: &envoy_config_route_v3.RouteAction{
+							ClusterSpecifier: &envoy_config_route_v3.RouteAction_Cluster{Cluster: "foo:web:http"},
+						}},
+					},
+				},
+			},
+			{
+				Name:    "other.example.com",
+				Domains: []string{"other.example.com"},
+				Routes: []*envoy_config_route_v3.Route{
+					{
+						Name:   "foo/drained",
+						Match:  &envoy_config_route_v3.RouteMatch{PathSpecifier: &envoy_config_route_v3.RouteMatch_Prefix{Prefix: "/"}},
+						Action: &envoy_config_route_v3.Route_DirectResponse{DirectResponse: &envoy_config_route_v3.DirectResponseAction{Status: 503}},
+					},
+				},
+			},
+		},
+	}
+	if diff := cmp.Diff(got, want, protocmp.Transform()); diff != "" {
+		t.Errorf("route configuration:\n%s", diff)
+	}
+
+	if err := store.Delete(objs[1]); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := store.ListKeys(), []string{"foo/drained", "foo/noport", "foo/root"}; !cmp.Equal(got, want) {
+		t.Errorf("routes after delete:\n  got: %v\n want: %v", got, want)
+	}
+}
+
+func TestEnvoyClusters(t *testing.T) {
+	envoyCluster := func(namespace, name string, spec map[string]interface{}) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"metadata": map[string]interface{}{"namespace": namespace, "name": name},
+			"spec":     spec,
+		}}
+	}
+	server := cds.NewServer("", nil)
+	ctx := context.Background()
+	if err := server.AddClusters(ctx, []*envoy_config_cluster_v3.Cluster{{Name: "default:web:http"}}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &EnvoyClusterConfig{Namespaces: []string{"payments", "data"}}
+	store := cfg.Store(server)
+	objs := []interface{}{
+		envoyCluster("payments", "stripe", map[string]interface{}{"name": "ignored", "type": "LOGICAL_DNS", "connectTimeout": "5s"}),
+		envoyCluster("data", "typo", map[string]interface{}{"tyep": "STATIC"}),
+		envoyCluster("data", "invalid", map[string]interface{}{"connectTimeout": "-1s"}),
+		envoyCluster("other", "sneaky", map[string]interface{}{}),
+	}
+	if err := store.Replace(objs, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := server.Clusters.ListKeys(), []string{"crd:payments:stripe", "default:web:http"}; !cmp.Equal(got, want) {
+		t.Errorf("clusters:\n  got: %v\n want: %v", got, want)
+	}
+	want := &envoy_config_cluster_v3.Cluster{
+		Name:                 "crd:payments:stripe",
+		ClusterDiscoveryType: &envoy_config_cluster_v3.Cluster_Type{Type: envoy_config_cluster_v3.Cluster_LOGICAL_DNS},
+		ConnectTimeout:       durationpb.New(5 * time.Second),
+	}
+	if diff := cmp.Diff(server.Clusters.Get("crd:payments:stripe"), want, protocmp.Transform()); diff != "" {
+		t.Errorf("cluster:\n%s", diff)
+	}
+	var invalid []string
+	for key := range store.Invalid() {
+		invalid = append(invalid, key)
+	}
+	sort.Strings(invalid)
+	if want := []string{"data/invalid", "data/typo", "other/sneaky"}; !cmp.Equal(invalid, want) {
+		t.Errorf("invalid envoy clusters:\n  got: %v\n want: %v", invalid, want)
+	}
+
+	if err := store.Add(envoyCluster("data", "postgres", map[string]interface{}{"type": "STRICT_DNS"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(objs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := server.Clusters.ListKeys(), []string{"crd:data:postgres", "default:web:http"}; !cmp.Equal(got, want) {
+		t.Errorf("clusters after add and delete:\n  got: %v\n want: %v", got, want)
+	}
+}
+
+func TestIngresses(t *testing.T) {
+	cfg := DefaultConfig()
+	if err := json.Unmarshal([]byte(`{"ingresses": {"ingress_class": "envoy", "listener_port": 8080}}`), cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.link()
+	pathType := func(t networkingv1.PathType) *networkingv1.PathType { return &t }
+	backend := func(name string, port networkingv1.ServiceBackendPort) networkingv1.IngressBackend {
+		return networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{Name: name, Port: port}}
+	}
+	ingress := func(name, class string, spec networkingv1.IngressSpec) *networkingv1.Ingress {
+		ing := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: name}, Spec: spec}
+		if class != "" {
+			ing.Spec.IngressClassName = &class
+		}
+		return ing
+	}
+	objs := []interface{}{
+		ingress("web", "envoy", networkingv1.IngressSpec{
+			DefaultBackend: &networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{Name: "fallback", Port: networkingv1.ServiceBackendPort{Number: 80}}},
+			Rules: []networkingv1.IngressRule{{
+				Host: "example.com",
+				IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{
+					Paths: []networkingv1.HTTPIngressPath{
+						{Path: "/", PathType: pathType(networkingv1.PathTypePrefix), Backend: backend("web", networkingv1.ServiceBackendPort{Name: "http"})},
+						{Path: "/api/", PathType: pathType(networkingv1.PathTypePrefix), Backend: backend("api", networkingv1.ServiceBackendPort{Name: "http"})},
+						{Path: "/healthz", PathType: pathType(networkingv1.PathTypeExact), Backend: backend("web", networkingv1.ServiceBackendPort{Name: "admin"})},
+						{Path: "/bucket", Backend: networkingv1.IngressBackend{Resource: &v1.TypedLocalObjectReference{Kind: "Bucket", Name: "b"}}},
+					},
+				}},
+			}},
+		}),
+		ingress("legacy", "", networkingv1.IngressSpec{
+			Rules: []networkingv1.IngressRule{{
+				IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{
+					Paths: []networkingv1.HTTPIngressPath{
+						{Path: "/legacy", PathType: pathType(networkingv1.PathTypeImplementationSpecific), Backend: backend("legacy", networkingv1.ServiceBackendPort{Number: 8080})},
+					},
+				}},
+			}},
+		}),
+		ingress("other", "nginx", networkingv1.IngressSpec{
+			DefaultBackend: &networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{Name: "nginx", Port: networkingv1.ServiceBackendPort{Number: 80}}},
+		}),
+	}
+	objs[1].(*networkingv1.Ingress).SetAnnotations(map[string]string{ingressClassAnnotation: "envoy"})
+
+	server := cds.NewServer("", nil)
+	store := cfg.Ingresses.Store(server)
+	if err := store.Replace(objs, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := server.Listeners.ListKeys(), []string{"ingresses"}; !cmp.Equal(got, want) {
+		t.Errorf("listeners:\n  got: %v\n want: %v", got, want)
+	}
+	rcs := server.Routes.List()
+	if got, want := len(rcs), 1; got != want {
+		t.Fatalf("route configuration count:\n  got: %v\n want: %v", got, want)
+	}
+	route := func(key string, match *envoy_config_route_v3.RouteMatch, cluster string) *envoy_config_route_v3.Route {
+		return &envoy_config_route_v3.Route{
+			Name:  key,
+			Match: match,
+			Action: &envoy_config_route_v3.Route_Route{Route: &envoy_config_route_v3.RouteAction{
+				ClusterSpecifier: &envoy_config_route_v3.RouteAction_Cluster{Cluster: cluster},
+			}},
+		}
+	}
+	want := &envoy_config_route_v3.RouteConfiguration{
+		Name: "ingresses",
+		VirtualHosts: []*envoy_config_route_v3.VirtualHost{
+			{
+				Name:    "example.com",
+				Domains: []string{"example.com"},
+				Routes: []*envoy_config_route_v3.Route{
+					route("foo/web", &envoy_config_route_v3.RouteMatch{PathSpecifier: &envoy_config_route_v3.RouteMatch_Path{Path: "/healthz"}}, "foo:web:admin"),
+					route("foo/web", &envoy_config_route_v3.RouteMatch{PathSpecifier: &envoy_config_route_v3.RouteMatch_PathSeparatedPrefix{PathSeparatedPrefix: "/api"}}, "foo:api:http"),
+					route("foo/web", &envoy_config_route_v3.RouteMatch{PathSpecifier: &envoy_config_route_v3.RouteMatch_Prefix{Prefix: "/"}}, "foo:web:http"),
+				},
+			},
+			{
+				Name:    "*",
+				Domains: []string{"*"},
+				Routes: []*envoy_config_route_v3.Route{
+					route("foo/legacy", &envoy_config_route_v3.RouteMatch{PathSpecifier: &envoy_config_route_v3.RouteMatch_Prefix{Prefix: "/legacy"}}, "foo:legacy:8080"),
+					route("foo/web", &envoy_config_route_v3.RouteMatch{PathSpecifier: &envoy_config_route_v3.RouteMatch_Prefix{Prefix: "/"}}, "foo:fallback:80"),
+				},
+			},
+		},
+	}
+	if diff := cmp.Diff(rcs[0], want, protocmp.Transform()); diff != "" {
+		t.Errorf("route configuration:\n%s", diff)
+	}
+
+	// Once linked, a backend that refers to a port by number gets the cluster of the named port.
+	cs := cfg.ClusterConfig.Store(server)
+	(&Stores{Clusters: cs, Ingresses: store}).Link()
+	if err := cs.Add(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "fallback"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	fallback := func() string {
+		rc := server.Routes.List()[0].(*envoy_config_route_v3.RouteConfiguration)
+		return rc.GetVirtualHosts()[1].GetRoutes()[1].GetRoute().GetCluster()
+	}
+	if got, want := fallback(), "foo:fallback:http"; got != want {
+		t.Errorf("default backend after adding its service:\n  got: %v\n want: %v", got, want)
+	}
+	if err := cs.Delete(&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "fallback"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fallback(), "foo:fallback:80"; got != want {
+		t.Errorf("default backend after deleting its service:\n  got: %v\n want: %v", got, want)
+	}
+
+	if err := store.Delete(objs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := store.ListKeys(), []string{"foo/legacy", "foo/other"}; !cmp.Equal(got, want) {
+		t.Errorf("ingresses after delete:\n  got: %v\n want: %v", got, want)
+	}
+}
+
+func TestDestinationMetadata(t *testing.T) {
+	destination := func(r *envoy_config_route_v3.Route) string {
+		md := r.GetMetadata().GetFilterMetadata()[DestinationMetadataNamespace].GetFields()
+		var tags []string
+		for _, tag := range r.GetTracing().GetCustomTags() {
+			tags = append(tags, tag.GetTag()+"="+tag.GetLiteral().GetValue())
+		}
+		return fmt.Sprintf("%s/%s %v", md["namespace"].GetStringValue(), md["service"].GetStringValue(), tags)
+	}
+
+	ic := &IngressConfig{DestinationMetadata: true}
+	ing := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "web"},
+		Spec: networkingv1.IngressSpec{
+			DefaultBackend: &networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{Name: "web", Port: networkingv1.ServiceBackendPort{Number: 80}}},
+		},
+	}
+	routes := ic.routes(ing, nil)
+	if len(routes) != 1 {
+		t.Fatalf("expected 1 ingress route, got %d", len(routes))
+	}
+	if got, want := destination(routes[0].route), "foo/web [k8s.namespace.name=foo k8s.service.name=web]"; got != want {
+		t.Errorf("ingress route destination:\n  got: %v\n want: %v", got, want)
+	}
+
+	oc := &OpenShiftRouteConfig{DestinationMetadata: true}
+	r := oc.route(&openShiftRoute{
+		key:       "foo/web",
+		namespace: "foo",
+		portName:  "http",
+		backends:  []openShiftBackend{{name: "web", weight: 90}, {name: "off", weight: 0}, {name: "web-canary", weight: 10}},
+	})
+	if got, want := destination(r), "foo/web,web-canary [k8s.namespace.name=foo k8s.service.name=web,web-canary]"; got != want {
+		t.Errorf("openshift route destination:\n  got: %v\n want: %v", got, want)
+	}
+
+	oc.DestinationMetadata = false
+	if r := oc.route(&openShiftRoute{key: "foo/web", namespace: "foo", portName: "http", backends: []openShiftBackend{{name: "web", weight: 1}}}); r.GetMetadata() != nil || r.GetTracing() != nil {
+		t.Errorf("destination recorded while disabled: %v", r)
+	}
+}
+
+func TestRequestTimeouts(t *testing.T) {
+	ic := new(IngressConfig)
+	if err := json.Unmarshal([]byte(`{"request_timeout":"30s"}`), ic); err != nil {
+		t.Fatal(err)
+	}
+	ing := func(timeout string) *networkingv1.Ingress {
+		ing := &networkingv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "web"},
+			Spec: networkingv1.IngressSpec{
+				DefaultBackend: &networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{Name: "web", Port: networkingv1.ServiceBackendPort{Number: 80}}},
+			},
+		}
+		if timeout != "" {
+			ing.Annotations = map[string]string{RequestTimeoutAnnotation: timeout}
+		}
+		return ing
+	}
+	for _, test := range []struct {
+		annotation string
+		want       time.Duration
+	}{
+		{"", 30 * time.Second},
+		{"5s", 5 * time.Second},
+		{"0s", 0},
+		{"-1s", 30 * time.Second},
+		{"bogus", 30 * time.Second},
+	} {
+		routes := ic.routes(ing(test.annotation), nil)
+		if got := routes[0].route.GetRoute().GetTimeout().AsDuration(); got != test.want {
+			t.Errorf("ingress timeout with annotation %q:\n  got: %v\n want: %v", test.annotation, got, test.want)
+		}
+	}
+	if r := new(IngressConfig).routes(ing(""), nil); r[0].route.GetRoute().GetTimeout() != nil {
+		t.Errorf("ingress timeout without config: %v", r[0].route.GetRoute().GetTimeout())
+	}
+
+	oc := new(OpenShiftRouteConfig)
+	if err := json.Unmarshal([]byte(`{"request_timeout":"1m"}`), oc); err != nil {
+		t.Fatal(err)
+	}
+	for _, backends := range [][]openShiftBackend{{{name: "web", weight: 1}}, {{name: "web", weight: 1}, {name: "canary", weight: 1}}} {
+		r := oc.route(&openShiftRoute{key: "foo/web", namespace: "foo", portName: "http", backends: backends})
+		if got, want := r.GetRoute().GetTimeout().AsDuration(), time.Minute; got != want {
+			t.Errorf("openshift timeout for %d backends:\n  got: %v\n want: %v", len(backends), got, want)
+		}
+		r = oc.route(&openShiftRoute{key: "foo/web", namespace: "foo", portName: "http", backends: backends, annotations: map[string]string{RequestTimeoutAnnotation: "2s"}})
+		if got, want := r.GetRoute().GetTimeout().AsDuration(), 2*time.Second; got != want {
+			t.Errorf("annotated openshift timeout for %d backends:\n  got: %v\n want: %v", len(backends), got, want)
+		}
+	}
+
+	gc := new(GRPCConfig)
+	if err := json.Unmarshal([]byte(`{"match":[{"port_name":"grpc"}],"request_timeout":"10s"}`), gc); err != nil {
+		t.Fatal(err)
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar", Annotations: map[string]string{RequestTimeoutAnnotation: "3s"}},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "grpc", Port: 9000}}},
+	}
+	_, rc, err := gc.Resources(&envoy_config_cluster_v3.Cluster{Name: "foo:bar:grpc"}, svc, &svc.Spec.Ports[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	action := rc.GetVirtualHosts()[0].GetRoutes()[0].GetRoute()
+	if got, want := action.GetMaxStreamDuration().GetMaxStreamDuration().AsDuration(), 3*time.Second; got != want {
+		t.Errorf("grpc max stream duration:\n  got: %v\n want: %v", got, want)
+	}
+
+	for _, bad := range []string{`{"request_timeout":"soon"}`, `{"request_timeout":"-5s"}`, `{"request_timeout":5}`} {
+		if err := json.Unmarshal([]byte(bad), new(IngressConfig)); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
+
+type fakeSource struct {
+	snapshots [][]*SourceService
+}
+
+func (s *fakeSource) Name() string { return "fake" }
+
+func (s *fakeSource) Watch(ctx context.Context, update func([]*SourceService) error) error {
+	for _, svcs := range s.snapshots {
+		if err := update(svcs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestRunSource(t *testing.T) {
+	cfg := DefaultConfig()
+	server := cds.NewServer("", nil)
+	ep := func(addr string) *SourceEndpoint { return &SourceEndpoint{Address: addr, Port: 80} }
+	src := &fakeSource{snapshots: [][]*SourceService{
+		{
+			{Namespace: "default", Name: "a", Endpoints: []*SourceEndpoint{ep("10.0.0.1")}},
+			{Namespace: "default", Name: "b", Endpoints: []*SourceEndpoint{ep("10.0.0.2")}},
+		},
+		{
+			{Namespace: "default", Name: "a", Endpoints: []*SourceEndpoint{ep("10.0.0.1"), ep("10.0.0.3")}},
+		},
+	}}
+	stores := &Stores{Clusters: cfg.ClusterConfig.Store(server), Endpoints: cfg.EndpointConfig.Store(nil, server)}
+	stores.Exclude(src.Name() + ":")
+	if err := cfg.RunSource(context.Background(), src, server); err != nil {
+		t.Fatal(err)
+	}
+	// Relisting Kubernetes leaves the source's clusters alone.
+	if err := stores.Clusters.Replace(nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores.Endpoints.Replace(nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := server.Clusters.ListKeys(), []string{"fake:default:a"}; !cmp.Equal(got, want) {
+		t.Errorf("clusters:\n  got: %v\n want: %v", got, want)
+	}
+	if got, want := server.Endpoints.ListKeys(), []string{"fake:default:a"}; !cmp.Equal(got, want) {
+		t.Errorf("endpoints:\n  got: %v\n want: %v", got, want)
+	}
+	cla := server.Endpoints.List()[0].(*envoy_config_endpoint_v3.ClusterLoadAssignment)
+	if got, want := len(cla.GetEndpoints()[0].GetLbEndpoints()), 2; got != want {
+		t.Errorf("endpoint count:\n  got: %v\n want: %v", got, want)
+	}
+}
+
+func TestPodWeights(t *testing.T) {
+	cfg := &Config{
+		EndpointConfig: &EndpointConfig{
+			PodWeights:    true,
+			DefaultWeight: 100,
+			Capacity:      &CapacityConfig{NodeAnnotation: "weight"},
+		},
+	}
+	cfg.link()
+	if got := cfg.PodLabelSelector(); got != "" {
+		t.Errorf("pod label selector:\n  got: %v\n want: everything", got)
+	}
+	nodes := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	nodes.Add(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "big", Annotations: map[string]string{"weight": "200"}}})
+	pods := cfg.EndpointConfig.PodStore()
+	for name, weight := range map[string]string{"canary": "10", "bogus": "-1", "big-canary": "20"} {
+		pods.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: name, Annotations: map[string]string{EndpointWeightAnnotation: weight}}})
+	}
+	endpoint := func(pod, node string) discoveryv1.Endpoint {
+		return discoveryv1.Endpoint{NodeName: ptr(node), TargetRef: &v1.ObjectReference{Kind: "Pod", Namespace: "a", Name: pod}}
+	}
+	testData := []struct {
+		ep   discoveryv1.Endpoint
+		want uint32
+	}{
+		{endpoint("stable", "small"), 100},
+		{endpoint("canary", "small"), 10},
+		{endpoint("bogus", "small"), 100},
+		{endpoint("stable", "big"), 200},
+		{endpoint("big-canary", "big"), 20},
+	}
+	for _, test := range testData {
+		lbe := new(envoy_config_endpoint_v3.LbEndpoint)
+		cfg.EndpointConfig.setWeight(lbe, nodes, test.ep)
+		if got := lbe.GetLoadBalancingWeight().GetValue(); got != test.want {
+			t.Errorf("%s on %s: weight:\n  got: %v\n want: %v", test.ep.TargetRef.Name, *test.ep.NodeName, got, test.want)
+		}
+	}
+}
+
+func TestPodLabelMetadata(t *testing.T) {
+	cfg, err := parseConfig([]byte(`apiVersion: v1alpha
+endpoint_config:
+  pod_label_metadata: [version, app.kubernetes.io/component]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.PodLabelSelector(); got != "" {
+		t.Errorf("pod label selector:\n  got: %v\n want: everything", got)
+	}
+	pods := cfg.EndpointConfig.PodStore()
+	pods.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "canary", Labels: map[string]string{"version": "v2", "app.kubernetes.io/component": "api", "team": "x"}}})
+	pods.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "stable", Labels: map[string]string{"version": "v1"}}})
+	pods.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "unlabeled"}})
+	endpoint := func(pod, addr string) discoveryv1.Endpoint {
+		return discoveryv1.Endpoint{Addresses: []string{addr}, TargetRef: &v1.ObjectReference{Kind: "Pod", Namespace: "a", Name: pod}}
+	}
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "svc-xyz", Labels: map[string]string{discoveryv1.LabelServiceName: "svc"}},
+		Ports:      []discoveryv1.EndpointPort{{Name: ptr("http"), Port: ptr(int32(80))}},
+		Endpoints: []discoveryv1.Endpoint{
+			endpoint("canary", "10.0.0.1"),
+			endpoint("stable", "10.0.0.2"),
+			endpoint("unlabeled", "10.0.0.3"),
+			endpoint("missing", "10.0.0.4"),
+		},
+	}
+	got := make(map[string]map[string]any)
+	for _, cla := range cfg.EndpointConfig.LoadAssignmentsFromEndpointSlices(nil, []*discoveryv1.EndpointSlice{slice}) {
+		for _, lle := range cla.GetEndpoints() {
+			for _, lbe := range lle.GetLbEndpoints() {
+				addr := lbe.GetEndpoint().GetAddress().GetSocketAddress().GetAddress()
+				if md, ok := lbe.GetMetadata().GetFilterMetadata()[LbMetadataNamespace]; ok {
+					got[addr] = md.AsMap()
+				}
+			}
+		}
+	}
+	want := map[string]map[string]any{
+		"10.0.0.1": {"version": "v2", "app.kubernetes.io/component": "api"},
+		"10.0.0.2": {"version": "v1"},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("endpoint metadata:\n%s", diff)
+	}
+
+	for _, labels := range []string{"[not a label]", "[version, version]"} {
+		if _, err := parseConfig([]byte("apiVersion: v1alpha\nendpoint_config:\n  pod_label_metadata: " + labels + "\n")); err == nil {
+			t.Errorf("pod_label_metadata %s: expected error", labels)
+		}
+	}
+}
+
+func TestEndpointPodStore(t *testing.T) {
+	cfg, err := parseConfig([]byte(`apiVersion: v1alpha
+endpoint_config:
+  pod_weights: true
+  pod_label_metadata: [version]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := cds.NewServer("", nil)
+	es := cfg.EndpointConfig.Store(nil, server)
+	pods := es.PodStore(cfg.EndpointConfig.PodStore())
+	pod := func(name, weight, version string) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "a",
+			Name:        name,
+			Labels:      map[string]string{"version": version},
+			Annotations: map[string]string{EndpointWeightAnnotation: weight},
+		}}
+	}
+	endpoint := func(pod, addr string) discoveryv1.Endpoint {
+		return discoveryv1.Endpoint{Addresses: []string{addr}, TargetRef: &v1.ObjectReference{Kind: "Pod", Namespace: "a", Name: pod}}
+	}
+	if err := es.Add(&discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "svc-xyz", Labels: map[string]string{discoveryv1.LabelServiceName: "svc"}},
+		Ports:      []discoveryv1.EndpointPort{{Name: ptr("http"), Port: ptr(int32(80))}},
+		Endpoints:  []discoveryv1.Endpoint{endpoint("canary", "10.0.0.1"), endpoint("stable", "10.0.0.2")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	check := func(desc string, want map[string]string) {
+		t.Helper()
+		got := make(map[string]string)
+		for _, r := range server.Endpoints.List() {
+			for _, lle := range r.(*envoy_config_endpoint_v3.ClusterLoadAssignment).GetEndpoints() {
+				for _, lbe := range lle.GetLbEndpoints() {
+					addr := lbe.GetEndpoint().GetAddress().GetSocketAddress().GetAddress()
+					version := lbe.GetMetadata().GetFilterMetadata()[LbMetadataNamespace].GetFields()["version"].GetStringValue()
+					got[addr] = fmt.Sprintf("%d/%s", lbe.GetLoadBalancingWeight().GetValue(), version)
+				}
+			}
+		}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("%s: weight/version by address:\n%s", desc, diff)
+		}
+	}
+	check("before pods", map[string]string{"10.0.0.1": "0/", "10.0.0.2": "0/"})
+
+	if err := pods.Replace([]interface{}{pod("canary", "10", "v2"), pod("stable", "100", "v1")}, ""); err != nil {
+		t.Fatal(err)
+	}
+	check("after listing pods", map[string]string{"10.0.0.1": "10/v2", "10.0.0.2": "100/v1"})
+	if err := pods.Update(pod("canary", "50", "v2")); err != nil {
+		t.Fatal(err)
+	}
+	check("after reweighting", map[string]string{"10.0.0.1": "50/v2", "10.0.0.2": "100/v1"})
+	if err := pods.Update(pod("stable", "100", "v2")); err != nil {
+		t.Fatal(err)
+	}
+	check("after relabeling", map[string]string{"10.0.0.1": "50/v2", "10.0.0.2": "100/v2"})
+	if err := pods.Delete(pod("canary", "50", "v2")); err != nil {
+		t.Fatal(err)
+	}
+	check("after deleting", map[string]string{"10.0.0.1": "0/", "10.0.0.2": "100/v2"})
+}
+
+func TestEDSProxy(t *testing.T) {
+	cfg, err := parseConfig([]byte(`apiVersion: v1alpha
+eds_proxy:
+  cluster_name_pattern: '(?P<service>[^.]+)\.(?P<namespace>[^.]+)\.(?P<port>[^.]+)'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type watch struct {
+		ctx     context.Context
+		service string
+		store   cache.Store
+	}
+	watches := make(chan watch, 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server := cds.NewServer("", nil)
+	proxy := cfg.EDSProxy.Proxy(ctx, nil, server, func(ctx context.Context, namespace, service string, s cache.Store) error {
+		watches <- watch{ctx: ctx, service: namespace + "/" + service, store: s}
+		<-ctx.Done()
+		return nil
+	})
+	nextWatch := func() watch {
+		t.Helper()
+		select {
+		case w := <-watches:
+			return w
+		case <-ctx.Done():
+			t.Fatal("timeout waiting for watch")
+		}
+		return watch{}
+	}
+	endpoints := func() map[string][]string {
+		result := make(map[string][]string)
+		for _, cla := range server.ListEndpoints() {
+			addrs := []string{}
+			for _, lle := range cla.GetEndpoints() {
+				for _, lbe := range lle.GetLbEndpoints() {
+					sa := lbe.GetEndpoint().GetAddress().GetSocketAddress()
+					addrs = append(addrs, fmt.Sprintf("%s:%d", sa.GetAddress(), sa.GetPortValue()))
+				}
+			}
+			result[cla.GetClusterName()] = addrs
+		}
+		return result
+	}
+
+	proxy.Subscribe([]string{"api.prod.http", "not-proxied", "web.prod.80"})
+	started := map[string]watch{}
+	for i := 0; i < 2; i++ {
+		w := nextWatch()
+		started[w.service] = w
+	}
+	api, web := started["prod/api"], started["prod/web"]
+	if api.store == nil || web.store == nil {
+		t.Fatalf("watched services:\n  got: %v\n want: prod/api and prod/web", started)
+	}
+	if err := api.store.Replace([]interface{}{&discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "api-abc"},
+		Ports:      []discoveryv1.EndpointPort{{Name: ptr("http"), Port: ptr(int32(8080))}, {Name: ptr("grpc"), Port: ptr(int32(9090))}},
+		Endpoints:  []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.1"}}},
+	}}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(endpoints(), map[string][]string{"api.prod.http": {"10.0.0.1:8080"}}); diff != "" {
+		t.Errorf("after api sync:\n%s", diff)
+	}
+	if err := web.store.Replace(nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(endpoints(), map[string][]string{"api.prod.http": {"10.0.0.1:8080"}, "web.prod.80": {}}); diff != "" {
+		t.Errorf("after web sync:\n%s", diff)
+	}
+
+	proxy.Subscribe([]string{"api.prod.grpc", "api.prod.http"})
+	if diff := cmp.Diff(endpoints(), map[string][]string{"api.prod.grpc": {"10.0.0.1:9090"}, "api.prod.http": {"10.0.0.1:8080"}}); diff != "" {
+		t.Errorf("after unsubscribing from web:\n%s", diff)
+	}
+	if web.ctx.Err() == nil {
+		t.Error("web is still watched")
+	}
+	if err := web.store.Add(&discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "web-abc"},
+		Ports:      []discoveryv1.EndpointPort{{Port: ptr(int32(80))}},
+		Endpoints:  []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.2"}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := endpoints()["web.prod.80"]; ok {
+		t.Error("stale watch served web.prod.80")
+	}
+
+	proxy.Subscribe(nil)
+	if got := endpoints(); len(got) != 0 {
+		t.Errorf("after unsubscribing from everything:\n  got: %v\n want: nothing", got)
+	}
+	if api.ctx.Err() == nil {
+		t.Error("api is still watched")
+	}
+
+	for _, pattern := range []string{"(?P<service>.*)", "[", ""} {
+		if _, err := parseConfig([]byte("apiVersion: v1alpha\neds_proxy:\n  cluster_name_pattern: '" + pattern + "'\n")); err == nil {
+			t.Errorf("cluster_name_pattern %q: expected error", pattern)
+		}
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	cfg := &Config{
+		EndpointConfig: &EndpointConfig{
+			Capacity: &CapacityConfig{
+				PodAnnotation:  "example.com/capacity",
+				NodeAnnotation: "example.com/size",
+				Classes:        map[string]uint32{"small": 1, "large": 4},
+			},
+		},
+		Tracks: []*TrackConfig{{Label: "track"}},
+	}
+	cfg.link()
+	if got := cfg.PodLabelSelector(); got != "" {
+		t.Errorf("pod label selector:\n  got: %v\n want: everything", got)
+	}
+	nodes := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	for name, size := range map[string]string{"small-node": "small", "large-node": "large"} {
+		nodes.Add(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{"example.com/size": size}}})
+	}
+	pods := cfg.EndpointConfig.PodStore()
+	pods.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "web-3", Annotations: map[string]string{"example.com/capacity": "large"}}})
+	endpoint := func(pod, addr, node string) discoveryv1.Endpoint {
+		return discoveryv1.Endpoint{
+			Addresses: []string{addr},
+			NodeName:  ptr(node),
+			TargetRef: &v1.ObjectReference{Kind: "Pod", Namespace: "a", Name: pod},
+		}
+	}
+	slices := []*discoveryv1.EndpointSlice{{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "a",
+			Name:      "web-abcde",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "web"},
+		},
+		Ports: []discoveryv1.EndpointPort{{Name: ptr("http"), Port: ptr[int32](80)}},
+		Endpoints: []discoveryv1.Endpoint{
+			endpoint("web-1", "10.0.0.1", "small-node"),
+			endpoint("web-2", "10.0.0.2", "large-node"),
+			endpoint("web-3", "10.0.0.3", "small-node"),
+			endpoint("web-4", "10.0.0.4", "unknown-node"),
+		},
+	}}
+	got := make(map[string]uint32)
+	for _, cla := range cfg.EndpointConfig.LoadAssignmentsFromEndpointSlices(nodes, slices) {
+		for _, lle := range cla.GetEndpoints() {
+			for _, e := range lle.GetLbEndpoints() {
+				got[e.GetEndpoint().GetAddress().GetSocketAddress().GetAddress()] = e.GetLoadBalancingWeight().GetValue()
+			}
+		}
+	}
+	want := map[string]uint32{
+		"10.0.0.1": 1, // small node
+		"10.0.0.2": 4, // large node
+		"10.0.0.3": 4, // annotated pod on a small node
+		"10.0.0.4": 0, // unknown
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("weights:\n%s", diff)
+	}
+
+	// Without classes, the annotation is the weight.
+	c := &CapacityConfig{NodeAnnotation: "weight"}
+	nodes.Add(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "weighted", Annotations: map[string]string{"weight": "7"}}})
+	nodes.Add(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "bogus", Annotations: map[string]string{"weight": "lots"}}})
+	if got, want := c.weight(nil, nodes, endpoint("", "", "weighted")), uint32(7); got != want {
+		t.Errorf("numeric weight:\n  got: %v\n want: %v", got, want)
+	}
+	if got := c.weight(nil, nodes, endpoint("", "", "bogus")); got != 0 {
+		t.Errorf("invalid weight:\n  got: %v\n want: 0", got)
+	}
+}
+
+func TestTracks(t *testing.T) {
+	js, err := yaml.YAMLToJSON([]byte(`
+apiVersion: v1alpha
+tracks:
+    - match:
+          - cluster_name: a:web:http
+      label: track
+      weights:
+          blue: 90
+          green: 10
+          red: 0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	if err := json.Unmarshal(js, cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.link()
+	if got, want := cfg.PodLabelSelector(), "track"; got != want {
+		t.Errorf("pod label selector:\n  got: %v\n want: %v", got, want)
+	}
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "web"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}},
+	}
+	var names []string
+	for _, cl := range cfg.ClusterConfig.ClustersFromService(svc) {
+		names = append(names, cl.GetName())
+		if cl.GetType() != envoy_config_cluster_v3.Cluster_EDS {
+			t.Errorf("cluster %s: expected EDS, got %v", cl.GetName(), cl.GetType())
+		}
+		weighted := cl.GetCommonLbConfig().GetLocalityWeightedLbConfig() != nil
+		if want := cl.GetName() == "a:web:http"; weighted != want {
+			t.Errorf("cluster %s: locality weighted:\n  got: %v\n want: %v", cl.GetName(), weighted, want)
+		}
+	}
+	if diff := cmp.Diff(names, []string{"a:web:http", "a:web:http-blue", "a:web:http-green", "a:web:http-red"}); diff != "" {
+		t.Errorf("cluster names:\n%s", diff)
+	}
+
+	pods := cfg.EndpointConfig.PodStore()
+	for name, track := range map[string]string{"web-1": "blue", "web-2": "blue", "web-3": "green", "web-4": "yellow"} {
+		if err := pods.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: name, Labels: map[string]string{"track": track}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	endpoint := func(pod, addr string) discoveryv1.Endpoint {
+		return discoveryv1.Endpoint{
+			Addresses: []string{addr},
+			TargetRef: &v1.ObjectReference{Kind: "Pod", Namespace: "a", Name: pod},
+		}
+	}
+	slices := []*discoveryv1.EndpointSlice{{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "a",
+			Name:      "web-abcde",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "web"},
+		},
+		Ports: []discoveryv1.EndpointPort{{Name: ptr("http"), Port: ptr[int32](80)}},
+		Endpoints: []discoveryv1.Endpoint{
+			endpoint("web-1", "10.0.0.1"),
+			endpoint("web-2", "10.0.0.2"),
+			endpoint("web-3", "10.0.0.3"),
+			endpoint("web-4", "10.0.0.4"),
+			endpoint("web-5", "10.0.0.5"),
+		},
+	}}
+	addrs := func(endpoints []*envoy_config_endpoint_v3.LbEndpoint) []string {
+		var result []string
+		for _, e := range endpoints {
+			result = append(result, e.GetEndpoint().GetAddress().GetSocketAddress().GetAddress())
+		}
+		sort.Strings(result)
+		return result
+	}
+	got := make(map[string][]string)
+	for _, cla := range cfg.EndpointConfig.LoadAssignmentsFromEndpointSlices(nil, slices) {
+		for _, lle := range cla.GetEndpoints() {
+			key := cla.GetClusterName()
+			if sz := lle.GetLocality().GetSubZone(); sz != "" {
+				key = fmt.Sprintf("%s/%s/%d", key, sz, lle.GetLoadBalancingWeight().GetValue())
+			}
+			got[key] = append(got[key], addrs(lle.GetLbEndpoints())...)
+		}
+		if len(cla.GetEndpoints()) == 0 {
+			got[cla.GetClusterName()] = nil
+		}
+	}
+	want := map[string][]string{
+		"a:web:http/blue/90":  {"10.0.0.1", "10.0.0.2"},
+		"a:web:http/green/10": {"10.0.0.3"},
+		"a:web:http-blue":     {"10.0.0.1", "10.0.0.2"},
+		"a:web:http-green":    {"10.0.0.3"},
+		"a:web:http-red":      nil,
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("load assignments:\n%s", diff)
+	}
+
+	for _, bad := range []string{
+		`{"label": "track", "weights": {"blue": 1}}`,
+		`{"match": [{"cluster_name": "x"}], "weights": {"blue": 1}}`,
+		`{"match": [{"cluster_name": "x"}], "label": "track"}`,
+	} {
+		if err := json.Unmarshal([]byte(bad), new(TrackConfig)); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	cfg := DefaultConfig()
+	if err := json.Unmarshal([]byte(`{"provenance": true}`), cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.link()
+	check := func(what string, md *envoy_config_core_v3.Metadata, kind, name, uid, rv string) {
+		t.Helper()
+		got := md.GetFilterMetadata()[ProvenanceMetadataNamespace].AsMap()
+		if _, err := time.Parse(time.RFC3339, fmt.Sprint(got["generated_at"])); err != nil {
+			t.Errorf("%s: generated_at: %v", what, err)
+		}
+		delete(got, "generated_at")
+		want := map[string]interface{}{
+			"kind":             kind,
+			"namespace":        "foo",
+			"name":             name,
+			"uid":              uid,
+			"resource_version": rv,
+			"ekglue_version":   Version,
+		}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("%s: provenance:\n%s", what, diff)
+		}
+	}
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar", UID: "svc-uid", ResourceVersion: "42"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}},
+	}
+	clusters := cfg.ClusterConfig.ClustersFromService(svc)
+	if got, want := len(clusters), 1; got != want {
+		t.Fatalf("cluster count:\n  got: %v\n want: %v", got, want)
+	}
+	check("cluster", clusters[0].GetMetadata(), "Service", "bar", "svc-uid", "42")
+
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "foo",
+			Name:            "bar-abcde",
+			UID:             "slice-uid",
+			ResourceVersion: "43",
+			Labels:          map[string]string{discoveryv1.LabelServiceName: "bar"},
+		},
+		Ports:     []discoveryv1.EndpointPort{{Name: ptr("http"), Port: ptr[int32](80)}},
+		Endpoints: []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.1"}}},
+	}
+	clas := cfg.EndpointConfig.LoadAssignmentsFromEndpointSlices(nil, []*discoveryv1.EndpointSlice{slice})
+	if got, want := len(clas), 1; got != want {
+		t.Fatalf("load assignment count:\n  got: %v\n want: %v", got, want)
+	}
+	check("endpoint", clas[0].GetEndpoints()[0].GetLbEndpoints()[0].GetMetadata(), "EndpointSlice", "bar-abcde", "slice-uid", "43")
+}
+
+func TestAllowlist(t *testing.T) {
+	cfg := DefaultConfig()
+	if err := json.Unmarshal([]byte(`{
+		"ingresses": {},
+		"openshift_routes": {},
+		"allowlist": [
+			{"namespaces": ["foo"], "source_ranges": ["10.0.0.0/8"]},
+			{"match": [{"port_name": "admin"}], "source_ranges": ["192.168.0.0/16", "10.0.0.0/8"]},
+			{"match": [{"cluster_name": "other:web:http"}], "source_ranges": ["172.16.0.0/12"]}
+		]
+	}`), cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.link()
+	ranges := func(md *envoy_config_core_v3.Metadata) []interface{} {
+		v, _ := md.GetFilterMetadata()[AllowlistMetadataNamespace].AsMap()["source_ranges"].([]interface{})
+		return v
+	}
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}, {Name: "admin", Port: 8080}}},
+	}
+	got := make(map[string][]interface{})
+	for _, cl := range cfg.ClusterConfig.ClustersFromService(svc) {
+		got[cl.GetName()] = ranges(cl.GetMetadata())
+	}
+	want := map[string][]interface{}{
+		"foo:bar:http":  {"10.0.0.0/8"},
+		"foo:bar:admin": {"10.0.0.0/8", "192.168.0.0/16"},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("cluster source ranges:\n%s", diff)
+	}
+	other := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "api"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}},
+	}
+	if md := cfg.ClusterConfig.ClustersFromService(other)[0].GetMetadata(); md.GetFilterMetadata()[AllowlistMetadataNamespace] != nil {
+		t.Errorf("unselected cluster has allowlist metadata: %v", md)
+	}
+
+	ing := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "web"},
+		Spec: networkingv1.IngressSpec{
+			DefaultBackend: &networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{Name: "web", Port: networkingv1.ServiceBackendPort{Name: "http"}}},
+		},
+	}
+	routes := cfg.Ingresses.routes(ing, nil)
+	if diff := cmp.Diff(ranges(routes[0].route.GetMetadata()), []interface{}{"172.16.0.0/12"}); diff != "" {
+		t.Errorf("ingress source ranges:\n%s", diff)
+	}
+
+	r := cfg.OpenShiftRoutes.route(&openShiftRoute{key: "other/web", namespace: "other", portName: "http", backends: []openShiftBackend{{name: "web", weight: 1}, {name: "canary", weight: 1}}})
+	if diff := cmp.Diff(ranges(r.GetMetadata()), []interface{}{"172.16.0.0/12"}); diff != "" {
+		t.Errorf("openshift source ranges:\n%s", diff)
+	}
+	r = cfg.OpenShiftRoutes.route(&openShiftRoute{key: "foo/web", namespace: "foo", portName: "admin", backends: []openShiftBackend{{name: "web", weight: 1}}})
+	if diff := cmp.Diff(ranges(r.GetMetadata()), []interface{}{"10.0.0.0/8", "192.168.0.0/16"}); diff != "" {
+		t.Errorf("openshift admin source ranges:\n%s", diff)
+	}
+
+	for _, bad := range []string{
+		`{"source_ranges": ["10.0.0.0/8"]}`,
+		`{"namespaces": ["foo"]}`,
+		`{"namespaces": ["foo"], "source_ranges": ["10.0.0.1"]}`,
+	} {
+		if err := json.Unmarshal([]byte(bad), new(AllowlistRule)); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	load := func(config string) *Config {
+		t.Helper()
+		cfg, err := parseConfig([]byte("apiVersion: v1alpha\n" + config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	before := load(`
+cluster_config:
+  base:
+    connect_timeout: 1s
+  grpc:
+    match:
+      - port_name: grpc
+ingresses:
+  listener_port: 8080
+`)
+	after := load(`
+cluster_config:
+  base:
+    connect_timeout: 5s
+endpoint_config:
+  default_weight: 100
+ingresses:
+  route_config_name: web
+`)
+
+	server := cds.NewServer("", nil)
+	stores := &Stores{
+		Clusters:  before.ClusterConfig.Store(server),
+		Endpoints: before.EndpointConfig.Store(nil, server),
+		Ingresses: before.Ingresses.Store(server),
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}, {Name: "grpc", Port: 9000}}},
+	}
+	if err := stores.Clusters.Add(svc); err != nil {
+		t.Fatal(err)
+	}
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar-abcde", Labels: map[string]string{discoveryv1.LabelServiceName: "bar"}},
+		Ports:      []discoveryv1.EndpointPort{{Name: ptr("http"), Port: ptr[int32](80)}},
+		Endpoints:  []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.1"}}},
+	}
+	if err := stores.Endpoints.Add(slice); err != nil {
+		t.Fatal(err)
+	}
+	ing := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "web"},
+		Spec: networkingv1.IngressSpec{
+			DefaultBackend: &networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{Name: "bar", Port: networkingv1.ServiceBackendPort{Name: "http"}}},
+		},
+	}
+	if err := stores.Ingresses.Add(ing); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := server.Listeners.ListKeys(), []string{"bar.foo:9000", "ingresses"}; !cmp.Equal(got, want) {
+		t.Fatalf("listeners before reconfigure:\n  got: %v\n want: %v", got, want)
+	}
+
+	if err := stores.Reconfigure(context.Background(), after); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(server.Clusters.ListKeys(), []string{"foo:bar:grpc", "foo:bar:http"}); diff != "" {
+		t.Errorf("clusters:\n%s", diff)
+	}
+	for _, cl := range server.ListClusters() {
+		if got, want := cl.GetConnectTimeout().AsDuration(), 5*time.Second; got != want {
+			t.Errorf("cluster %s: connect timeout:\n  got: %v\n want: %v", cl.GetName(), got, want)
+		}
+	}
+	clas := server.ListEndpoints()
+	if got, want := len(clas), 1; got != want {
+		t.Fatalf("load assignment count:\n  got: %v\n want: %v", got, want)
+	}
+	for _, cla := range clas {
+		if got, want := cla.GetEndpoints()[0].GetLbEndpoints()[0].GetLoadBalancingWeight().GetValue(), uint32(100); got != want {
+			t.Errorf("load assignment %s: weight:\n  got: %v\n want: %v", cla.GetClusterName(), got, want)
+		}
+	}
+	if got := server.Listeners.ListKeys(); len(got) > 0 {
+		t.Errorf("listeners: expected none, got %v", got)
+	}
+	if diff := cmp.Diff(server.Routes.ListKeys(), []string{"web"}); diff != "" {
+		t.Errorf("routes:\n%s", diff)
+	}
+	rc := server.Routes.List()[0].(*envoy_config_route_v3.RouteConfiguration)
+	if got, want := rc.GetVirtualHosts()[0].GetRoutes()[0].GetRoute().GetCluster(), "foo:bar:http"; got != want {
+		t.Errorf("ingress route cluster:\n  got: %v\n want: %v", got, want)
+	}
+
+	// A config whose clusters are rejected changes nothing.
+	server.Clusters.Validators = append(server.Clusters.Validators, func(xds.Resource) error { return errors.New("no") })
+	if err := stores.Reconfigure(context.Background(), before); err == nil {
+		t.Error("expected error")
+	}
+	if got, want := server.ListClusters()[0].GetConnectTimeout().AsDuration(), 5*time.Second; got != want {
+		t.Errorf("connect timeout after rejected reconfigure:\n  got: %v\n want: %v", got, want)
+	}
+
+	if got, want := before.RestartRequired(after), []string(nil); !cmp.Equal(got, want) {
+		t.Errorf("restart required:\n  got: %v\n want: %v", got, want)
+	}
+	restart := load(`
+watch:
+  namespaces: [foo]
+openshift_routes: {}
+ingresses: {}
+`)
+	if got, want := before.RestartRequired(restart), []string{"watch", "openshift_routes"}; !cmp.Equal(got, want) {
+		t.Errorf("restart required:\n  got: %v\n want: %v", got, want)
+	}
+}
+
+func TestWatchConfigFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(filename, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("apiVersion: v1alpha\n")
+	running, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	applied := make(chan *Config)
+	errCh := make(chan error)
+	go func() {
+		errCh <- WatchConfigFile(ctx, filename, running, time.Millisecond, func(cfg *Config) error {
+			applied <- cfg
+			return nil
+		})
+	}()
+
+	write("apiVersion: v2\n")
+	write("apiVersion: v1alpha\nprovenance: true\n")
+	select {
+	case cfg := <-applied:
+		if !cfg.Provenance {
+			t.Errorf("applied config: expected provenance, got %#v", cfg)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the changed config")
+	}
+	cancel()
+	if err := <-errCh; !errors.Is(err, context.Canceled) {
+		t.Errorf("watch: expected context.Canceled, got %v", err)
+	}
+}
+
+func TestDNSRecords(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.link()
+	cs := cfg.ClusterConfig.Store(cds.NewServer("", nil))
+	for _, svc := range []*v1.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "web", Annotations: map[string]string{ExternalDNSHostnameAnnotation: "WWW.example.com., example.com"}},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}, {Name: "https", Port: 443}}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "api", Annotations: map[string]string{ExternalDNSHostnameAnnotation: "api.example.com"}},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "internal"},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}},
+		},
+	} {
+		if err := cs.Add(svc); err != nil {
+			t.Fatalf("add %s: %v", svc.GetName(), err)
+		}
+	}
+	want := []*DNSRecord{
+		{DNSName: "_ekglue.api.example.com", RecordType: "TXT", Targets: []string{"ekglue-cluster=foo:api:http"}},
+		{DNSName: "_ekglue.example.com", RecordType: "TXT", Targets: []string{"ekglue-cluster=foo:web:http", "ekglue-cluster=foo:web:https"}},
+		{DNSName: "_ekglue.www.example.com", RecordType: "TXT", Targets: []string{"ekglue-cluster=foo:web:http", "ekglue-cluster=foo:web:https"}},
+	}
+	if diff := cmp.Diff(cs.DNSRecords(DefaultDNSRecordPrefix), want); diff != "" {
+		t.Errorf("dns records:\n%s", diff)
+	}
+	for _, e := range cs.Directory() {
+		if e.Service == "web" {
+			if diff := cmp.Diff(e.Hostnames, []string{"example.com", "www.example.com"}); diff != "" {
+				t.Errorf("directory entry %s: hostnames:\n%s", e.Cluster, diff)
+			}
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	svcs, slices := ExampleServices()
+	for _, test := range []struct {
+		name, config string
+		wantErr      string
+	}{
+		{name: "default"},
+		{
+			name:    "validation rule",
+			config:  "validation:\n  cluster_name_pattern: ^team-\n",
+			wantErr: "service default/example: clusters:",
+		},
+		{
+			name:    "collision",
+			config:  "cluster_config:\n  base:\n    connect_timeout: 1s\naggregates:\n  - name: default:example:http\n    selector: {app: example}\n    port_name: http\n",
+			wantErr: "default:example:http",
+		},
+		{
+			name:   "grpc",
+			config: "cluster_config:\n  base:\n    connect_timeout: 1s\n  grpc:\n    match:\n      - port_name: grpc\n",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := parseConfig([]byte("apiVersion: v1alpha\n" + test.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = cfg.Check(svcs, slices)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("error:\n  got: %v\n want: error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigIncludes(t *testing.T) {
+	cfg, err := LoadConfig("testdata/include/main.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ClusterConfig{
+		BaseConfig: &envoy_config_cluster_v3.Cluster{
+			ConnectTimeout: durationpb.New(2 * time.Second),
+			LbPolicy:       envoy_config_cluster_v3.Cluster_RANDOM,
+		},
+		Overrides: []*ClusterOverride{
+			{
+				Match:    []*Matcher{{ClusterName: "team-a:api:http"}},
+				Override: &envoy_config_cluster_v3.Cluster{ConnectTimeout: durationpb.New(3 * time.Second)},
+			},
+			{
+				Match:    []*Matcher{{ClusterName: "team-b:api:http"}},
+				Override: &envoy_config_cluster_v3.Cluster{ConnectTimeout: durationpb.New(4 * time.Second)},
+			},
+			{
+				Match: []*Matcher{{ClusterName: "foo:bar:h2"}},
+				Override: &envoy_config_cluster_v3.Cluster{
+					Http2ProtocolOptions: &envoy_config_core_v3.Http2ProtocolOptions{},
+					LbPolicy:             envoy_config_cluster_v3.Cluster_LEAST_REQUEST,
+				},
+			},
+		},
+	}
+	if diff := cmp.Diff(cfg.ClusterConfig, want, protocmp.Transform(), cmpopts.IgnoreUnexported(ClusterConfig{}, ClusterOverride{})); diff != "" {
+		t.Errorf("cluster config:\n%s", diff)
+	}
+
+	_, err = LoadConfig("testdata/includecycle/main.yaml")
+	if err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Errorf("cycle: expected include cycle error, got %v", err)
+	}
+
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing.yaml")
+	if err := os.WriteFile(missing, []byte("apiVersion: v1alpha\ninclude: [nope.yaml]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(missing); err == nil {
+		t.Error("missing include: expected error")
+	}
+	notList := filepath.Join(dir, "notlist.yaml")
+	if err := os.WriteFile(notList, []byte("apiVersion: v1alpha\ninclude: base.yaml\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(notList); err == nil {
+		t.Error("include that isn't a list: expected error")
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	testData := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name:   "known fields",
+			config: "cluster_config:\n  base: {connect_timeout: 1s}\n  overrides:\n    - match: [{port_name: http}]\n      suppress: true\n",
+		},
+		{
+			name:    "typo at top level",
+			config:  "provenence: true\n",
+			wantErr: "unknown fields provenence;",
+		},
+		{
+			name:    "typos in nested sections",
+			config:  "cluster_config:\n  base: {}\n  overides: []\n  grpc:\n    match: [{port_nmae: grpc}]\nendpoint_config:\n  locality:\n    zone_from: {lable: zone}\n",
+			wantErr: "unknown fields cluster_config.grpc.match[0].port_nmae, cluster_config.overides, endpoint_config.locality.zone_from.lable;",
+		},
+		{
+			name:   "extension fields",
+			config: "x-defaults: &d {connect_timeout: 1s}\ncluster_config:\n  base: *d\n",
+		},
+		{
+			name:   "escape hatch",
+			config: "allow_unknown_fields: true\nprovenence: true\n",
+		},
+	}
+	for _, test := range testData {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseConfig([]byte("apiVersion: v1alpha\n" + test.config))
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("parse: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("parse:\n  got: %v\n want: %s", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestJSONSchema(t *testing.T) {
+	js, err := JSONSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema struct {
+		Properties map[string]struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"properties"`
+		AdditionalProperties bool `json:"additionalProperties"`
+	}
+	if err := json.Unmarshal(js, &schema); err != nil {
+		t.Fatalf("unmarshal schema: %v", err)
+	}
+	if schema.AdditionalProperties {
+		t.Error("schema allows additional properties")
+	}
+	for _, p := range []string{"apiVersion", "cluster_config", "endpoint_config", IncludeKey, "allow_unknown_fields"} {
+		if _, ok := schema.Properties[p]; !ok {
+			t.Errorf("schema is missing property %q", p)
+		}
+	}
+	if _, ok := schema.Properties["cluster_config"].Properties["base"]; !ok {
+		t.Error("schema is missing cluster_config.base")
+	}
+}
+
+// TestConfigJSONTags ensures that every config field is named in the JSON Schema and by the unknown
+// field check the same way that it's named in config files.
+func TestConfigJSONTags(t *testing.T) {
+	seen := make(map[reflect.Type]bool)
+	var check func(reflect.Type)
+	check = func(typ reflect.Type) {
+		for typ.Kind() == reflect.Pointer || typ.Kind() == reflect.Slice || typ.Kind() == reflect.Map {
+			typ = typ.Elem()
+		}
+		if typ.Kind() != reflect.Struct || seen[typ] || protoMessageName(typ) != "" || typ.PkgPath() != reflect.TypeOf(Config{}).PkgPath() {
+			return
+		}
+		seen[typ] = true
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			if f.Tag.Get("json") == "" {
+				t.Errorf("%s.%s has no json tag", typ.Name(), f.Name)
+			}
+			check(f.Type)
+		}
+	}
+	check(reflect.TypeOf(Config{}))
+}
+
+func TestInvalidClusters(t *testing.T) {
+	cfg, err := parseConfig([]byte("apiVersion: v1alpha\ncluster_config:\n  base: {connect_timeout: 1s}\n  service_annotations: true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := cds.NewServer("", nil)
+	var reject bool
+	server.Clusters.Validators = append(server.Clusters.Validators, func(r xds.Resource) error {
+		if reject && r.(*envoy_config_cluster_v3.Cluster).GetConnectTimeout().AsDuration() > time.Second {
+			return errors.New("connect timeout too long")
+		}
+		return nil
+	})
+	cs := cfg.ClusterConfig.Store(server)
+	service := func(timeout string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar", Annotations: map[string]string{ConnectTimeoutAnnotation: timeout}},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}, {Name: "grpc", Port: 9000}}},
+		}
+	}
+	timeouts := func() map[string]time.Duration {
+		result := make(map[string]time.Duration)
+		for _, c := range server.ListClusters() {
+			result[c.GetName()] = c.GetConnectTimeout().AsDuration()
+		}
+		return result
+	}
+	check := func(desc string, wantTimeouts map[string]time.Duration, wantInvalid []*InvalidCluster) {
+		t.Helper()
+		if diff := cmp.Diff(timeouts(), wantTimeouts); diff != "" {
+			t.Errorf("%s: served clusters:\n%s", desc, diff)
+		}
+		if diff := cmp.Diff(cs.InvalidClusters(), wantInvalid, cmpopts.IgnoreFields(InvalidCluster{}, "Since"), cmpopts.IgnoreUnexported(InvalidCluster{}), cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("%s: invalid clusters:\n%s", desc, diff)
+		}
+	}
+
+	// With no valid version to fall back on, an invalid cluster isn't served.
+	reject = true
+	if err := cs.Add(service("2s")); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	invalid := func(stale bool) []*InvalidCluster {
+		var result []*InvalidCluster
+		for _, name := range []string{"foo:bar:grpc", "foo:bar:http"} {
+			result = append(result, &InvalidCluster{Cluster: name, Service: "foo/bar", Error: fmt.Sprintf("%q: validate: connect timeout too long", name), Stale: stale})
+		}
+		return result
+	}
+	check("invalid at first", map[string]time.Duration{}, invalid(false))
+
+	// A retry picks up the change in the validator.
+	reject = false
+	cs.retryInvalid(context.Background(), time.Now().Add(time.Hour))
+	check("retried", map[string]time.Duration{"foo:bar:grpc": 2 * time.Second, "foo:bar:http": 2 * time.Second}, nil)
+
+	// A change that makes the clusters invalid leaves the last valid version in place.
+	if err := cs.Update(service("1s")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	reject = true
+	if err := cs.Update(service("3s")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	check("stale", map[string]time.Duration{"foo:bar:grpc": time.Second, "foo:bar:http": time.Second}, invalid(true))
+
+	// Retries aren't attempted before they're due.
+	reject = false
+	cs.retryInvalid(context.Background(), time.Now())
+	check("not due", map[string]time.Duration{"foo:bar:grpc": time.Second, "foo:bar:http": time.Second}, invalid(true))
+
+	// ...but a change is handled right away.
+	if err := cs.Update(service("3s")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	check("fixed", map[string]time.Duration{"foo:bar:grpc": 3 * time.Second, "foo:bar:http": 3 * time.Second}, nil)
+
+	reject = true
+	if err := cs.Update(service("4s")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := cs.Delete(service("4s")); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	check("deleted", map[string]time.Duration{}, nil)
+
+	// An invalid service doesn't fail a relist.
+	if err := cs.Replace([]interface{}{service("5s")}, ""); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	check("replaced", map[string]time.Duration{}, invalid(false))
+}
+
+func TestScoping(t *testing.T) {
+	cfg, err := parseConfig([]byte(`apiVersion: v1alpha
+scoping:
+  rules:
+    - namespace_from_metadata: ekglue.namespace
+      namespaces: [shared]
+    - namespace_from_locality: sub_zone
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := cds.NewServer("", nil)
+	cs := cfg.ClusterConfig.Store(server)
+	cfg.Scoping.Apply(server, cs)
+	for _, ns := range []string{"a", "b", "shared"} {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "web"},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}},
+		}
+		if err := cs.Add(svc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	metadata := func(v *structpb.Value) *envoy_config_core_v3.Node {
+		return &envoy_config_core_v3.Node{Metadata: &structpb.Struct{Fields: map[string]*structpb.Value{
+			"ekglue": structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{"namespace": v}}),
+		}}}
+	}
+	list, err := structpb.NewList([]interface{}{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testData := []struct {
+		name string
+		node *envoy_config_core_v3.Node
+		want []string
+	}{
+		{name: "unscoped", node: &envoy_config_core_v3.Node{Id: "x"}, want: []string{"a:web:http", "b:web:http", "shared:web:http", "unknown"}},
+		{name: "metadata", node: metadata(structpb.NewStringValue("a")), want: []string{"a:web:http", "shared:web:http"}},
+		{name: "metadata list", node: metadata(structpb.NewListValue(list)), want: []string{"a:web:http", "b:web:http", "shared:web:http"}},
+		{name: "locality", node: &envoy_config_core_v3.Node{Locality: &envoy_config_core_v3.Locality{SubZone: "b"}}, want: []string{"b:web:http"}},
+	}
+	for _, test := range testData {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for _, name := range []string{"a:web:http", "b:web:http", "shared:web:http", "unknown"} {
+				if server.Clusters.Scope(test.node, name) {
+					got = append(got, name)
+				}
+				if got, want := server.Endpoints.Scope(test.node, name), server.Clusters.Scope(test.node, name); got != want {
+					t.Errorf("%s: endpoints scope %v, clusters scope %v", name, got, want)
+				}
+			}
+			if diff := cmp.Diff(got, test.want); diff != "" {
+				t.Errorf("visible resources:\n%s", diff)
+			}
+		})
+	}
+
+	if err := cs.Delete(&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "web"}}); err != nil {
+		t.Fatal(err)
+	}
+	if server.Clusters.Scope(metadata(structpb.NewStringValue("a")), "a:web:http") {
+		t.Error("deleted cluster still in scope")
+	}
+
+	for _, bad := range []string{
+		"scoping:\n  rules:\n    - namespaces: [a]\n",
+		"scoping:\n  rules:\n    - namespace_from_metadata: ns\n      namespace_from_locality: zone\n",
+		"scoping:\n  rules:\n    - namespace_from_locality: planet\n",
+	} {
+		if _, err := parseConfig([]byte("apiVersion: v1alpha\n" + bad)); err == nil {
+			t.Errorf("expected error for config:\n%s", bad)
+		}
+	}
+}
+
+func TestAdmissionHandler(t *testing.T) {
+	cfg, err := parseConfig([]byte("apiVersion: v1alpha\ncluster_config:\n  service_annotations: true\n  base:\n    connect_timeout: 1s\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := AdmissionHandler(func() *Config { return cfg })
+	svc := func(annotations map[string]string) []byte {
+		js, err := json.Marshal(&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "bar", Annotations: annotations},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return js
+	}
+	testData := []struct {
+		name        string
+		kind        string
+		operation   admissionv1.Operation
+		object      []byte
+		wantAllowed bool
+		wantMessage string
+	}{
+		{
+			name:        "valid service",
+			kind:        "Service",
+			operation:   admissionv1.Create,
+			object:      svc(map[string]string{ConnectTimeoutAnnotation: "250ms"}),
+			wantAllowed: true,
+		},
+		{
+			name:        "bad connect timeout",
+			kind:        "Service",
+			operation:   admissionv1.Update,
+			object:      svc(map[string]string{ConnectTimeoutAnnotation: "soon"}),
+			wantMessage: "service foo/bar: invalid annotations: " + ConnectTimeoutAnnotation,
+		},
+		{
+			name:        "bad request timeout",
+			kind:        "Service",
+			operation:   admissionv1.Create,
+			object:      svc(map[string]string{RequestTimeoutAnnotation: "-1s"}),
+			wantMessage: "service foo/bar: " + RequestTimeoutAnnotation + ": must not be negative",
+		},
+		{
+			name:        "delete",
+			kind:        "Service",
+			operation:   admissionv1.Delete,
+			object:      svc(map[string]string{ConnectTimeoutAnnotation: "soon"}),
+			wantAllowed: true,
+		},
+		{
+			name:        "not a service",
+			kind:        "ConfigMap",
+			operation:   admissionv1.Create,
+			object:      []byte(`{"data":{"foo":"bar"}}`),
+			wantAllowed: true,
+		},
+	}
+	for _, test := range testData {
+		t.Run(test.name, func(t *testing.T) {
+			review := &admissionv1.AdmissionReview{
+				Request: &admissionv1.AdmissionRequest{
+					UID:       types.UID(test.name),
+					Kind:      metav1.GroupVersionKind{Version: "v1", Kind: test.kind},
+					Namespace: "foo",
+					Name:      "bar",
+					Operation: test.operation,
+					Object:    runtime.RawExtension{Raw: test.object},
+				},
+			}
+			body, err := json.Marshal(review)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("POST", "/validate", strings.NewReader(string(body))))
+			if got, want := rec.Code, http.StatusOK; got != want {
+				t.Fatalf("status:\n  got: %v\n want: %v", got, want)
+			}
+			got := new(admissionv1.AdmissionReview)
+			if err := json.Unmarshal(rec.Body.Bytes(), got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Response == nil {
+				t.Fatal("no response")
+			}
+			if got, want := got.Response.UID, types.UID(test.name); got != want {
+				t.Errorf("uid:\n  got: %v\n want: %v", got, want)
+			}
+			if got, want := got.Response.Allowed, test.wantAllowed; got != want {
+				t.Errorf("allowed:\n  got: %v\n want: %v", got, want)
+			}
+			var msg string
+			if got.Response.Result != nil {
+				msg = got.Response.Result.Message
+			}
+			if !strings.HasPrefix(msg, test.wantMessage) {
+				t.Errorf("message:\n  got: %v\n want prefix: %v", msg, test.wantMessage)
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/validate", strings.NewReader("{")))
+	if got, want := rec.Code, http.StatusBadRequest; got != want {
+		t.Errorf("bad body status:\n  got: %v\n want: %v", got, want)
+	}
+}
+
+func TestRemoteClusters(t *testing.T) {
+	cfg, err := parseConfig([]byte("apiVersion: v1alpha\ncluster_config:\n  base:\n    connect_timeout: 1s\n  grpc:\n    match:\n      - port_name: grpc\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.ForCluster("east.1:"); err == nil {
+		t.Error("expected an error for a prefix that isn't stat-safe")
+	}
+	east, err := cfg.ForCluster("east:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := cds.NewServer("", nil)
+	stores := &Stores{Clusters: cfg.ClusterConfig.Store(server), Endpoints: cfg.EndpointConfig.Store(nil, server)}
+	remote := &Stores{Clusters: east.ClusterConfig.Store(server), Endpoints: east.EndpointConfig.Store(nil, server)}
+	if err := stores.AddRemote("east:", remote); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores.AddRemote("east:2:", remote); err == nil {
+		t.Error("expected an error for an overlapping prefix")
+	}
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}, {Name: "grpc", Port: 9000}}},
+	}
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar-abcde", Labels: map[string]string{discoveryv1.LabelServiceName: "bar"}},
+		Ports:      []discoveryv1.EndpointPort{{Name: ptr("http"), Port: ptr[int32](80)}},
+		Endpoints:  []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.1"}}},
+	}
+	for _, s := range []*Stores{stores, remote} {
+		if err := s.Clusters.Replace([]interface{}{svc}, ""); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Endpoints.Replace([]interface{}{slice}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if diff := cmp.Diff(server.Clusters.ListKeys(), []string{"east:foo:bar:grpc", "east:foo:bar:http", "foo:bar:grpc", "foo:bar:http"}); diff != "" {
+		t.Errorf("clusters:\n%s", diff)
+	}
+	if diff := cmp.Diff(server.Endpoints.ListKeys(), []string{"east:foo:bar:http", "foo:bar:http"}); diff != "" {
+		t.Errorf("endpoints:\n%s", diff)
+	}
+	if diff := cmp.Diff(server.Listeners.ListKeys(), []string{"bar.foo:9000"}); diff != "" {
+		t.Errorf("listeners:\n%s", diff)
+	}
+
+	// Each cluster's relists only replace what was generated from it.
+	if err := stores.Clusters.Replace(nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Endpoints.Replace(nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(server.Clusters.ListKeys(), []string{"east:foo:bar:grpc", "east:foo:bar:http"}); diff != "" {
+		t.Errorf("clusters after replace:\n%s", diff)
+	}
+	if diff := cmp.Diff(server.Endpoints.ListKeys(), []string{"foo:bar:http"}); diff != "" {
+		t.Errorf("endpoints after replace:\n%s", diff)
+	}
+
+	next, err := parseConfig([]byte("apiVersion: v1alpha\ncluster_config:\n  base:\n    connect_timeout: 5s\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stores.Reconfigure(context.Background(), next); err != nil {
+		t.Fatal(err)
+	}
+	for _, cl := range server.ListClusters() {
+		if got, want := cl.GetConnectTimeout().AsDuration(), 5*time.Second; got != want {
+			t.Errorf("cluster %s: connect timeout:\n  got: %v\n want: %v", cl.GetName(), got, want)
+		}
+	}
+}
+
+func TestStatic(t *testing.T) {
+	if _, err := parseConfig([]byte("apiVersion: v1alpha\nstatic:\n  clusters:\n    - name: db\n    - name: db\n")); err == nil {
+		t.Error("expected an error for duplicate static clusters")
+	}
+	if _, err := parseConfig([]byte("apiVersion: v1alpha\nstatic:\n  clusters:\n    - name: db\n      connect_timeout: -1s\n")); err == nil {
+		t.Error("expected an error for an invalid static cluster")
+	}
+	cfg, err := parseConfig([]byte(`apiVersion: v1alpha
+static:
+  clusters:
+    - name: legacy-db
+      type: STRICT_DNS
+    - name: foo:bar:http
+  load_assignments:
+    - cluster_name: legacy-db
+      endpoints:
+        - lb_endpoints:
+            - endpoint:
+                address:
+                  socket_address:
+                    address: db.example.com
+                    port_value: 5432
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := cds.NewServer("", nil)
+	stores := &Stores{Clusters: cfg.ClusterConfig.Store(server), Endpoints: cfg.EndpointConfig.Store(nil, server)}
+	stores.AddStatic(NewStaticStore(server))
+	ctx := context.Background()
+	if err := stores.Static.Reconfigure(ctx, cfg.Static); err != nil {
+		t.Fatal(err)
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}, {Name: "grpc", Port: 9000}}},
+	}
+	if err := stores.Clusters.Replace([]interface{}{svc}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores.Endpoints.Replace(nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(server.Clusters.ListKeys(), []string{"foo:bar:grpc", "foo:bar:http", "legacy-db"}); diff != "" {
+		t.Errorf("clusters:\n%s", diff)
+	}
+	if diff := cmp.Diff(server.Endpoints.ListKeys(), []string{"legacy-db"}); diff != "" {
+		t.Errorf("endpoints:\n%s", diff)
+	}
+	// The static cluster wins over the generated one with the same name.
+	if diff := cmp.Diff(server.Clusters.Get("foo:bar:http"), &envoy_config_cluster_v3.Cluster{Name: "foo:bar:http"}, protocmp.Transform()); diff != "" {
+		t.Errorf("static cluster:\n%s", diff)
+	}
+
+	next, err := parseConfig([]byte("apiVersion: v1alpha\nstatic:\n  clusters:\n    - name: partner-api\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stores.Reconfigure(ctx, next); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(server.Clusters.ListKeys(), []string{"foo:bar:grpc", "foo:bar:http", "partner-api"}); diff != "" {
+		t.Errorf("clusters after reconfigure:\n%s", diff)
+	}
+	if got := server.Endpoints.ListKeys(); len(got) != 0 {
+		t.Errorf("endpoints after reconfigure: got %v, want none", got)
+	}
+	if got := server.Clusters.Get("foo:bar:http").(*envoy_config_cluster_v3.Cluster); got.GetConnectTimeout() == nil {
+		t.Errorf("cluster foo:bar:http was not regenerated after it stopped being static: %v", got)
+	}
+
+	// A reload whose clusters are rejected leaves the static resources alone too.
+	server.Clusters.Validators = append(server.Clusters.Validators, func(r xds.Resource) error {
+		if r.(*envoy_config_cluster_v3.Cluster).GetConnectTimeout().AsDuration() == 7*time.Second {
+			return errors.New("no")
+		}
+		return nil
+	})
+	rejected, err := parseConfig([]byte(`apiVersion: v1alpha
+cluster_config:
+  base:
+    connect_timeout: 7s
+static:
+  clusters:
+    - name: foo:bar:grpc
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stores.Reconfigure(ctx, rejected); err == nil {
+		t.Error("expected an error")
+	}
+	if diff := cmp.Diff(server.Clusters.ListKeys(), []string{"foo:bar:grpc", "foo:bar:http", "partner-api"}); diff != "" {
+		t.Errorf("clusters after rejected reconfigure:\n%s", diff)
+	}
+	if got := server.Clusters.Get("foo:bar:grpc").(*envoy_config_cluster_v3.Cluster); got.GetConnectTimeout() == nil {
+		t.Errorf("cluster foo:bar:grpc was not regenerated after the rejected static cluster was removed: %v", got)
+	}
+}
+
+func TestLoadWeights(t *testing.T) {
+	cfg, err := parseConfig([]byte("apiVersion: v1alpha\ncluster_config:\n  base:\n    connect_timeout: 1s\n    type: EDS\n    eds_cluster_config:\n      eds_config:\n        ads: {}\nendpoint_config:\n  load_weights:\n    damping: 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseConfig([]byte("apiVersion: v1alpha\nendpoint_config:\n  load_weights:\n    max_factor: 0.5\n")); err == nil {
+		t.Error("expected an error for a max factor below 1")
+	}
+	server := cds.NewServer("", nil)
+	cs := cfg.ClusterConfig.Store(server)
+	es := cfg.EndpointConfig.Store(nil, server)
+	if err := cs.Add(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.ListClusters()[0].GetCommonLbConfig().GetLocalityWeightedLbConfig(); got == nil {
+		t.Error("cluster does not use locality weighted load balancing")
+	}
+	if err := es.Add(&discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar-abcde", Labels: map[string]string{discoveryv1.LabelServiceName: "bar"}},
+		Ports:      []discoveryv1.EndpointPort{{Name: ptr("http"), Port: ptr[int32](80)}},
+		Endpoints: []discoveryv1.Endpoint{
+			{Addresses: []string{"10.0.0.1"}, Zone: ptr("a")},
+			{Addresses: []string{"10.0.0.2"}, Zone: ptr("b")},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	weights := func() map[string]uint32 {
+		result := make(map[string]uint32)
+		for _, lle := range server.ListEndpoints()[0].GetEndpoints() {
+			result[lle.GetLocality().GetZone()] = lle.GetLoadBalancingWeight().GetValue()
+		}
+		return result
+	}
+	if diff := cmp.Diff(weights(), map[string]uint32{"a": 100, "b": 100}); diff != "" {
+		t.Errorf("initial weights:\n%s", diff)
+	}
+
+	report := func(node string, a, b uint64) {
+		cfg.EndpointConfig.LoadTracker().Record(&envoy_config_core_v3.Node{Id: node}, []*envoy_config_endpoint_v3.ClusterStats{{
+			ClusterName: "foo:bar:http",
+			UpstreamLocalityStats: []*envoy_config_endpoint_v3.UpstreamLocalityStats{
+				{Locality: &envoy_config_core_v3.Locality{Zone: "a"}, TotalRequestsInProgress: a},
+				{Locality: &envoy_config_core_v3.Locality{Zone: "b"}, TotalRequestsInProgress: b},
+			},
+		}})
+	}
+	report("envoy-1", 20, 5)
+	report("envoy-2", 10, 5)
+	if err := es.balanceLoad(context.Background(), time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	// Zone a has 30 requests in progress to zone b's 10, so it should get a third as much.
+	if diff := cmp.Diff(weights(), map[string]uint32{"a": 67, "b": 200}); diff != "" {
+		t.Errorf("weights after load report:\n%s", diff)
+	}
+
+	// Once the reports are stale, the weights stay where they are.
+	if err := es.balanceLoad(context.Background(), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(weights(), map[string]uint32{"a": 67, "b": 200}); diff != "" {
+		t.Errorf("weights after stale reports:\n%s", diff)
+	}
+}
+
+func TestExternalNames(t *testing.T) {
+	const base = "apiVersion: v1alpha\ncluster_config:\n  base:\n    connect_timeout: 1s\n    type: EDS\n    eds_cluster_config:\n      eds_config:\n        ads: {}\n"
+	if _, err := parseConfig([]byte(base + "  external_names:\n    dns_type: EDS\n")); err == nil {
+		t.Error("expected an error for an unknown dns type")
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "db"},
+		Spec: v1.ServiceSpec{
+			Type:         v1.ServiceTypeExternalName,
+			ExternalName: "db.example.com",
+			Ports:        []v1.ServicePort{{Name: "postgres", Port: 5432}},
+		},
+	}
+	testData := []struct {
+		name, config string
+		want         *envoy_config_cluster_v3.Cluster
+	}{
+		{
+			name:   "disabled",
+			config: "",
+			want: &envoy_config_cluster_v3.Cluster{
+				Name:                 "foo:db:postgres",
+				ConnectTimeout:       durationpb.New(time.Second),
+				ClusterDiscoveryType: &envoy_config_cluster_v3.Cluster_Type{Type: envoy_config_cluster_v3.Cluster_EDS},
+				EdsClusterConfig: &envoy_config_cluster_v3.Cluster_EdsClusterConfig{
+					EdsConfig: &envoy_config_core_v3.ConfigSource{ConfigSourceSpecifier: &envoy_config_core_v3.ConfigSource_Ads{Ads: new(envoy_config_core_v3.AggregatedConfigSource)}},
+				},
+			},
+		},
+		{
+			name:   "strict dns",
+			config: "  external_names: {}\n",
+			want: &envoy_config_cluster_v3.Cluster{
+				Name:                 "foo:db:postgres",
+				ConnectTimeout:       durationpb.New(time.Second),
+				ClusterDiscoveryType: &envoy_config_cluster_v3.Cluster_Type{Type: envoy_config_cluster_v3.Cluster_STRICT_DNS},
+				LoadAssignment:       singleTargetLoadAssignment("foo:db:postgres", "db.example.com", 5432, envoy_config_core_v3.SocketAddress_TCP),
+			},
+		},
+		{
+			name:   "logical dns",
+			config: "  external_names:\n    dns_type: LOGICAL_DNS\n",
+			want: &envoy_config_cluster_v3.Cluster{
+				Name:                 "foo:db:postgres",
+				ConnectTimeout:       durationpb.New(time.Second),
+				ClusterDiscoveryType: &envoy_config_cluster_v3.Cluster_Type{Type: envoy_config_cluster_v3.Cluster_LOGICAL_DNS},
+				LoadAssignment:       singleTargetLoadAssignment("foo:db:postgres", "db.example.com", 5432, envoy_config_core_v3.SocketAddress_TCP),
+			},
+		},
+	}
+	for _, test := range testData {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := parseConfig([]byte(base + test.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := cfg.ClusterConfig.ClustersFromService(svc)
+			if diff := cmp.Diff(got, []*envoy_config_cluster_v3.Cluster{test.want}, protocmp.Transform()); diff != "" {
+				t.Errorf("clusters:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHeadlessDNS(t *testing.T) {
+	const base = "apiVersion: v1alpha\ncluster_config:\n  base:\n    connect_timeout: 1s\n    type: EDS\n    eds_cluster_config:\n      eds_config:\n        ads: {}\n"
+	eds := func(name string) *envoy_config_cluster_v3.Cluster {
+		return &envoy_config_cluster_v3.Cluster{
+			Name:                 name,
+			ConnectTimeout:       durationpb.New(time.Second),
+			ClusterDiscoveryType: &envoy_config_cluster_v3.Cluster_Type{Type: envoy_config_cluster_v3.Cluster_EDS},
+			EdsClusterConfig: &envoy_config_cluster_v3.Cluster_EdsClusterConfig{
+				EdsConfig: &envoy_config_core_v3.ConfigSource{ConfigSourceSpecifier: &envoy_config_core_v3.ConfigSource_Ads{Ads: new(envoy_config_core_v3.AggregatedConfigSource)}},
+			},
+		}
+	}
+	dns := func(name string, port int32) *envoy_config_cluster_v3.Cluster {
+		return &envoy_config_cluster_v3.Cluster{
+			Name:                 name,
+			ConnectTimeout:       durationpb.New(time.Second),
+			ClusterDiscoveryType: &envoy_config_cluster_v3.Cluster_Type{Type: envoy_config_cluster_v3.Cluster_STRICT_DNS},
+			LoadAssignment:       singleTargetLoadAssignment(name, "db.foo.svc.cluster.local.", port, envoy_config_core_v3.SocketAddress_TCP),
+		}
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "db"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: v1.ClusterIPNone,
+			Ports:     []v1.ServicePort{{Name: "postgres", Port: 5432}, {Name: "metrics", Port: 9090}},
+		},
+	}
+	normal := svc.DeepCopy()
+	normal.Spec.ClusterIP = "10.0.0.1"
+	testData := []struct {
+		name, config string
+		svc          *v1.Service
+		want         []*envoy_config_cluster_v3.Cluster
+	}{
+		{
+			name: "disabled",
+			svc:  svc,
+			want: []*envoy_config_cluster_v3.Cluster{eds("foo:db:postgres"), eds("foo:db:metrics")},
+		},
+		{
+			name:   "all ports",
+			config: "  headless_dns:\n    - cluster_name: foo:db:postgres\n    - cluster_name: foo:db:metrics\n",
+			svc:    svc,
+			want:   []*envoy_config_cluster_v3.Cluster{dns("foo:db:postgres", 5432), dns("foo:db:metrics", 9090)},
+		},
+		{
+			name:   "one port",
+			config: "  headless_dns:\n    - port_name: postgres\n",
+			svc:    svc,
+			want:   []*envoy_config_cluster_v3.Cluster{dns("foo:db:postgres", 5432), eds("foo:db:metrics")},
+		},
+		{
+			name:   "not headless",
+			config: "  headless_dns:\n    - port_name: postgres\n",
+			svc:    normal,
+			want:   []*envoy_config_cluster_v3.Cluster{eds("foo:db:postgres"), eds("foo:db:metrics")},
+		},
+	}
+	for _, test := range testData {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := parseConfig([]byte(base + test.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := cfg.ClusterConfig.ClustersFromService(test.svc)
+			if diff := cmp.Diff(got, test.want, protocmp.Transform()); diff != "" {
+				t.Errorf("clusters:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTenantTracker(t *testing.T) {
+	cfg, err := parseConfig([]byte("apiVersion: v1alpha\ncluster_config:\n  base:\n    connect_timeout: 1s\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := cds.NewServer("", nil)
+	stores := &Stores{Clusters: cfg.ClusterConfig.Store(server), Endpoints: cfg.EndpointConfig.Store(nil, server)}
+	tenants := NewTenantTracker(stores.ClusterNamespace)
+	tenants.Watch(server)
+
+	type stat struct {
+		Namespace, Type     string
+		Resources, Changes  int
+		HasBytes, HasPushed bool
+	}
+	report := func() []stat {
+		var result []stat
+		for _, s := range tenants.Report() {
+			result = append(result, stat{s.Namespace, s.Type, s.Resources, s.Changes, s.Bytes > 0, s.PushedBytes > 0})
+		}
+		sort.Slice(result, func(i, j int) bool {
+			return result[i].Namespace+result[i].Type < result[j].Namespace+result[j].Type
+		})
+		return result
+	}
+
+	// Endpoints arrive before their service, so they can't be attributed yet.
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar-abcde", Labels: map[string]string{discoveryv1.LabelServiceName: "bar"}},
+		Ports:      []discoveryv1.EndpointPort{{Name: ptr("http"), Port: ptr[int32](80)}},
+		Endpoints:  []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.1"}}},
+	}
+	if err := stores.Endpoints.Add(slice); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(report(), []stat(nil)); diff != "" {
+		t.Errorf("report before services:\n%s", diff)
+	}
+
+	for _, svc := range []*v1.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}, {Name: "grpc", Port: 9000}}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "quux", Name: "bar"},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}},
+		},
+	} {
+		if err := stores.Clusters.Add(svc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	slice = slice.DeepCopy()
+	slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{Addresses: []string{"10.0.0.2"}})
+	if err := stores.Endpoints.Update(slice); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores.Clusters.Delete(&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "quux", Name: "bar"}}); err != nil {
+		t.Fatal(err)
+	}
+	want := []stat{
+		{Namespace: "foo", Type: "clusters", Resources: 2, Changes: 2, HasBytes: true, HasPushed: true},
+		{Namespace: "foo", Type: "endpoints", Resources: 1, Changes: 1, HasBytes: true, HasPushed: true},
+		{Namespace: "quux", Type: "clusters", Resources: 0, Changes: 2, HasPushed: true},
+	}
+	if diff := cmp.Diff(report(), want); diff != "" {
+		t.Errorf("report:\n%s", diff)
+	}
+	if got := tenants.Report()[0].ChangesPerMinute; got <= 0 {
+		t.Errorf("busiest tenant's change rate: got %v, want > 0", got)
+	}
+}
+
+func TestAppProtocol(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar", Annotations: map[string]string{HTTP2Annotation: "false"}},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{
+				{Name: "grpc", Port: 9000, AppProtocol: ptr("grpc")},
+				{Name: "h2c", Port: 8080, AppProtocol: ptr("kubernetes.io/h2c")},
+				{Name: "http", Port: 80, AppProtocol: ptr("http")},
+			},
+		},
+	}
+	testData := []struct {
+		name, config string
+		want         []string
+	}{
+		{
+			name: "detected",
+			want: []string{"foo:bar:grpc", "foo:bar:h2c"},
+		},
+		{
+			name:   "ignored",
+			config: "  ignore_app_protocol: true\n",
+		},
+		{
+			name:   "annotations win",
+			config: "  service_annotations: true\n",
+		},
+	}
+	for _, test := range testData {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := parseConfig([]byte("apiVersion: v1alpha\ncluster_config:\n  base:\n    connect_timeout: 1s\n" + test.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, cl := range cfg.ClusterConfig.ClustersFromService(svc) {
+				if cl.GetHttp2ProtocolOptions() != nil {
+					got = append(got, cl.GetName())
+				}
+			}
+			if diff := cmp.Diff(got, test.want); diff != "" {
+				t.Errorf("http/2 clusters:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTopology(t *testing.T) {
+	cfg, err := parseConfig([]byte("apiVersion: v1alpha\ncluster_config:\n  base:\n    connect_timeout: 1s\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := cds.NewServer("", nil)
+	stores := &Stores{Clusters: cfg.ClusterConfig.Store(server), Endpoints: cfg.EndpointConfig.Store(nil, server)}
+	if err := stores.Clusters.Add(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores.Endpoints.Add(&discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar-abcde", Labels: map[string]string{discoveryv1.LabelServiceName: "bar"}},
+		Ports:      []discoveryv1.EndpointPort{{Name: ptr("http"), Port: ptr[int32](8080)}},
+		Endpoints:  []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.1"}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := stores.Topology(server)
+	want := &Topology{
+		Nodes: []*TopologyNode{
+			{ID: "cluster:foo:bar:http", Kind: "cluster", Name: "foo:bar:http"},
+			{ID: "endpoint:10.0.0.1:8080", Kind: "endpoint", Name: "10.0.0.1:8080"},
+			{ID: "service:foo/bar", Kind: "service", Name: "foo/bar"},
+		},
+		Edges: []*TopologyEdge{
+			{From: "cluster:foo:bar:http", To: "endpoint:10.0.0.1:8080"},
+			{From: "service:foo/bar", To: "cluster:foo:bar:http"},
+		},
+	}
+	if diff := cmp.Diff(got, want, cmpopts.IgnoreUnexported(Topology{})); diff != "" {
+		t.Errorf("topology:\n%s", diff)
+	}
+
+	w := httptest.NewRecorder()
+	TopologyHandler(server, stores).ServeHTTP(w, httptest.NewRequest("GET", "/topology?format=dot", nil))
+	if got, want := w.Body.String(), "\t\"service:foo/bar\" -> \"cluster:foo:bar:http\";\n"; !strings.Contains(got, want) {
+		t.Errorf("dot output:\n%s\ndoes not contain:\n%s", got, want)
+	}
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	const base = "apiVersion: v1alpha\ncluster_config:\n  base:\n    connect_timeout: 1s\n"
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "api"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "https", Port: 443}, {Name: "http", Port: 80}}},
+	}
+	fileSource := func(name string) *envoy_config_core_v3.DataSource {
+		return &envoy_config_core_v3.DataSource{Specifier: &envoy_config_core_v3.DataSource_Filename{Filename: name}}
+	}
+	sds := func(name string, source *envoy_config_core_v3.ConfigSource) *envoy_extensions_transport_sockets_tls_v3.SdsSecretConfig {
+		source.ResourceApiVersion = envoy_config_core_v3.ApiVersion_V3
+		return &envoy_extensions_transport_sockets_tls_v3.SdsSecretConfig{Name: name, SdsConfig: source}
+	}
+	testData := []struct {
+		name, config string
+		want         map[string]*envoy_extensions_transport_sockets_tls_v3.UpstreamTlsContext
+		wantErr      bool
+	}{
+		{
+			name: "disabled",
+			want: map[string]*envoy_extensions_transport_sockets_tls_v3.UpstreamTlsContext{},
+		},
+		{
+			name:   "ca file",
+			config: "  upstream_tls:\n    - match:\n        - port_name: https\n      ca_file: /etc/ssl/ca.pem\n",
+			want: map[string]*envoy_extensions_transport_sockets_tls_v3.UpstreamTlsContext{
+				"foo:api:https": {
+					Sni: "api.foo.svc.cluster.local",
+					CommonTlsContext: &envoy_extensions_transport_sockets_tls_v3.CommonTlsContext{
+						ValidationContextType: &envoy_extensions_transport_sockets_tls_v3.CommonTlsContext_ValidationContext{
+							ValidationContext: &envoy_extensions_transport_sockets_tls_v3.CertificateValidationContext{TrustedCa: fileSource("/etc/ssl/ca.pem")},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:   "mutual tls with files",
+			config: "  upstream_tls:\n    - match:\n        - port: 443\n      server_name: '{{.Name}}.example.com'\n      ca_file: /etc/ssl/ca.pem\n      client_cert_file: /etc/ssl/client.pem\n      client_key_file: /etc/ssl/client.key\n",
+			want: map[string]*envoy_extensions_transport_sockets_tls_v3.UpstreamTlsContext{
+				"foo:api:https": {
+					Sni: "api.example.com",
+					CommonTlsContext: &envoy_extensions_transport_sockets_tls_v3.CommonTlsContext{
+						ValidationContextType: &envoy_extensions_transport_sockets_tls_v3.CommonTlsContext_ValidationContext{
+							ValidationContext: &envoy_extensions_transport_sockets_tls_v3.CertificateValidationContext{TrustedCa: fileSource("/etc/ssl/ca.pem")},
+						},
+						TlsCertificates: []*envoy_extensions_transport_sockets_tls_v3.TlsCertificate{{
+							CertificateChain: fileSource("/etc/ssl/client.pem"),
+							PrivateKey:       fileSource("/etc/ssl/client.key"),
+						}},
+					},
+				},
+			},
+		},
+		{
+			name:   "sds",
+			config: "  upstream_tls:\n    - match:\n        - cluster_name: foo:api:http\n      ca_secret: ROOTCA\n      client_cert_secret: default\n      sds_cluster: spire\n",
+			want: map[string]*envoy_extensions_transport_sockets_tls_v3.UpstreamTlsContext{
+				"foo:api:http": {
+					Sni: "api.foo.svc.cluster.local",
+					CommonTlsContext: &envoy_extensions_transport_sockets_tls_v3.CommonTlsContext{
+						ValidationContextType: &envoy_extensions_transport_sockets_tls_v3.CommonTlsContext_ValidationContextSdsSecretConfig{
+							ValidationContextSdsSecretConfig: sds("ROOTCA", &envoy_config_core_v3.ConfigSource{
+								ConfigSourceSpecifier: &envoy_config_core_v3.ConfigSource_ApiConfigSource{
+									ApiConfigSource: &envoy_config_core_v3.ApiConfigSource{
+										ApiType:             envoy_config_core_v3.ApiConfigSource_GRPC,
+										TransportApiVersion: envoy_config_core_v3.ApiVersion_V3,
+										GrpcServices: []*envoy_config_core_v3.GrpcService{{
+											TargetSpecifier: &envoy_config_core_v3.GrpcService_EnvoyGrpc_{
+												EnvoyGrpc: &envoy_config_core_v3.GrpcService_EnvoyGrpc{ClusterName: "spire"},
+											},
+										}},
+									},
+								},
+							}),
+						},
+						TlsCertificateSdsSecretConfigs: []*envoy_extensions_transport_sockets_tls_v3.SdsSecretConfig{
+							sds("default", &envoy_config_core_v3.ConfigSource{
+								ConfigSourceSpecifier: &envoy_config_core_v3.ConfigSource_ApiConfigSource{
+									ApiConfigSource: &envoy_config_core_v3.ApiConfigSource{
+										ApiType:             envoy_config_core_v3.ApiConfigSource_GRPC,
+										TransportApiVersion: envoy_config_core_v3.ApiVersion_V3,
+										GrpcServices: []*envoy_config_core_v3.GrpcService{{
+											TargetSpecifier: &envoy_config_core_v3.GrpcService_EnvoyGrpc_{
+												EnvoyGrpc: &envoy_config_core_v3.GrpcService_EnvoyGrpc{ClusterName: "spire"},
+											},
+										}},
+									},
+								},
+							}),
+						},
+					},
+				},
+			},
+		},
+		{
+			name:   "sds over ads",
+			config: "  upstream_tls:\n    - match:\n        - port_name: https\n      ca_secret: ROOTCA\n",
+			want: map[string]*envoy_extensions_transport_sockets_tls_v3.UpstreamTlsContext{
+				"foo:api:https": {
+					Sni: "api.foo.svc.cluster.local",
+					CommonTlsContext: &envoy_extensions_transport_sockets_tls_v3.CommonTlsContext{
+						ValidationContextType: &envoy_extensions_transport_sockets_tls_v3.CommonTlsContext_ValidationContextSdsSecretConfig{
+							ValidationContextSdsSecretConfig: sds("ROOTCA", &envoy_config_core_v3.ConfigSource{
+								ConfigSourceSpecifier: &envoy_config_core_v3.ConfigSource_Ads{Ads: &envoy_config_core_v3.AggregatedConfigSource{}},
+							}),
+						},
+					},
+				},
+			},
+		},
+		{
+			name:    "no ca",
+			config:  "  upstream_tls:\n    - match:\n        - port_name: https\n",
+			wantErr: true,
+		},
+		{
+			name:    "two cas",
+			config:  "  upstream_tls:\n    - match:\n        - port_name: https\n      ca_file: /ca.pem\n      ca_secret: ROOTCA\n",
+			wantErr: true,
+		},
+		{
+			name:    "cert without key",
+			config:  "  upstream_tls:\n    - match:\n        - port_name: https\n      ca_file: /ca.pem\n      client_cert_file: /client.pem\n",
+			wantErr: true,
+		},
+		{
+			name:    "no match",
+			config:  "  upstream_tls:\n    - ca_file: /ca.pem\n",
+			wantErr: true,
+		},
+	}
+	for _, test := range testData {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := parseConfig([]byte(base + test.config))
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]*envoy_extensions_transport_sockets_tls_v3.UpstreamTlsContext)
+			for _, cl := range cfg.ClusterConfig.ClustersFromService(svc) {
+				ts := cl.GetTransportSocket()
+				if ts == nil {
+					continue
+				}
+				if got, want := ts.GetName(), "envoy.transport_sockets.tls"; got != want {
+					t.Errorf("%s: transport socket name:\n  got: %v\n want: %v", cl.GetName(), got, want)
+				}
+				tc := new(envoy_extensions_transport_sockets_tls_v3.UpstreamTlsContext)
+				if err := ts.GetTypedConfig().UnmarshalTo(tc); err != nil {
+					t.Fatalf("%s: unmarshal tls context: %v", cl.GetName(), err)
+				}
+				got[cl.GetName()] = tc
+			}
+			if diff := cmp.Diff(got, test.want, protocmp.Transform()); diff != "" {
+				t.Errorf("tls contexts:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestResilienceDefaults(t *testing.T) {
+	cfg, err := parseConfig([]byte(`apiVersion: v1alpha
+cluster_config:
+  base:
+    connect_timeout: 1s
+  outlier_detection:
+    consecutive_5xx: 5
+    base_ejection_time: 30s
+  circuit_breakers:
+    thresholds:
+      - max_connections: 1000
+        max_requests: 1000
+      - priority: HIGH
+        max_connections: 100
+  namespace_defaults:
+    - namespaces: [batch]
+      defaults:
+        circuit_breakers:
+          thresholds:
+            - max_requests: 50
+  overrides:
+    - match:
+        - port_name: grpc
+      override:
+        outlier_detection:
+          consecutive_5xx: 2
+        circuit_breakers:
+          thresholds:
+            - priority: HIGH
+              max_connections: 10
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	breakers := func(def, defRequests, high uint32) *envoy_config_cluster_v3.CircuitBreakers {
+		return &envoy_config_cluster_v3.CircuitBreakers{
+			Thresholds: []*envoy_config_cluster_v3.CircuitBreakers_Thresholds{
+				{MaxConnections: wrapperspb.UInt32(def), MaxRequests: wrapperspb.UInt32(defRequests)},
+				{Priority: envoy_config_core_v3.RoutingPriority_HIGH, MaxConnections: wrapperspb.UInt32(high)},
+			},
+		}
+	}
+	outliers := func(consecutive5xx uint32) *envoy_config_cluster_v3.OutlierDetection {
+		return &envoy_config_cluster_v3.OutlierDetection{
+			Consecutive_5Xx:  wrapperspb.UInt32(consecutive5xx),
+			BaseEjectionTime: durationpb.New(30 * time.Second),
+		}
+	}
+	testData := []struct {
+		namespace, port string
+		wantBreakers    *envoy_config_cluster_v3.CircuitBreakers
+		wantOutliers    *envoy_config_cluster_v3.OutlierDetection
+	}{
+		{"default", "http", breakers(1000, 1000, 100), outliers(5)},
+		{"batch", "http", breakers(1000, 50, 100), outliers(5)},
+		{"default", "grpc", breakers(1000, 1000, 10), outliers(2)},
+		{"batch", "grpc", breakers(1000, 50, 10), outliers(2)},
+	}
+	for _, test := range testData {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: test.namespace, Name: "foo"},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: test.port, Port: 80}}},
+		}
+		clusters := cfg.ClusterConfig.ClustersFromService(svc)
+		if len(clusters) != 1 {
+			t.Fatalf("%s/%s: expected 1 cluster, got %d", test.namespace, test.port, len(clusters))
+		}
+		if diff := cmp.Diff(clusters[0].GetCircuitBreakers(), test.wantBreakers, protocmp.Transform()); diff != "" {
+			t.Errorf("%s/%s: circuit breakers:\n%s", test.namespace, test.port, diff)
+		}
+		if diff := cmp.Diff(clusters[0].GetOutlierDetection(), test.wantOutliers, protocmp.Transform()); diff != "" {
+			t.Errorf("%s/%s: outlier detection:\n%s", test.namespace, test.port, diff)
+		}
+	}
+	if got := cfg.ClusterConfig.BaseConfig.GetCircuitBreakers(); got != nil {
+		t.Errorf("base config was modified: %v", got)
+	}
+}
+
+func TestStrategicOverride(t *testing.T) {
+	cfg, err := parseConfig([]byte(`apiVersion: v1alpha
+cluster_config:
+  base:
+    connect_timeout: 1.5s
+    lb_policy: LEAST_REQUEST
+    respect_dns_ttl: true
+    common_lb_config:
+      healthy_panic_threshold: {value: 50}
+    health_checks:
+      - timeout: 1s
+        interval: 10s
+        unhealthy_threshold: 3
+        healthy_threshold: 1
+        tcp_health_check: {}
+    circuit_breakers:
+      thresholds:
+        - max_connections: 1000
+          max_requests: 1000
+  overrides:
+    - match:
+        - port_name: http
+      strategy: strategic
+      override:
+        connect_timeout: 2s
+        lb_policy: ROUND_ROBIN
+        respectDnsTtl: false
+        common_lb_config:
+          update_merge_window: 0s
+        health_checks: null
+        circuit_breakers:
+          thresholds:
+            - max_requests: 50
+            - priority: HIGH
+              max_connections: 10
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}},
+	}
+	clusters := cfg.ClusterConfig.ClustersFromService(svc)
+	if len(clusters) != 1 {
+		t.Fatalf("expected 1 cluster, got %d", len(clusters))
+	}
+	got := clusters[0]
+	want := proto.Clone(got).(*envoy_config_cluster_v3.Cluster)
+	want.ConnectTimeout = durationpb.New(2 * time.Second)
+	want.LbPolicy = envoy_config_cluster_v3.Cluster_ROUND_ROBIN
+	want.RespectDnsTtl = false
+	want.CommonLbConfig = &envoy_config_cluster_v3.Cluster_CommonLbConfig{
+		HealthyPanicThreshold: &envoy_type_v3.Percent{Value: 50},
+		UpdateMergeWindow:     durationpb.New(0),
+	}
+	want.HealthChecks = nil
+	want.CircuitBreakers = &envoy_config_cluster_v3.CircuitBreakers{
+		Thresholds: []*envoy_config_cluster_v3.CircuitBreakers_Thresholds{
+			{MaxConnections: wrapperspb.UInt32(1000), MaxRequests: wrapperspb.UInt32(50)},
+			{Priority: envoy_config_core_v3.RoutingPriority_HIGH, MaxConnections: wrapperspb.UInt32(10)},
+		},
+	}
+	if diff := cmp.Diff(got, want, protocmp.Transform()); diff != "" {
+		t.Errorf("cluster:\n%s", diff)
+	}
+	if got.GetConnectTimeout().AsDuration() != 2*time.Second {
+		t.Errorf("connect timeout:\n  got: %v\n want: 2s", got.GetConnectTimeout().AsDuration())
+	}
+	if len(got.GetHealthChecks()) != 0 || got.GetLbPolicy() != envoy_config_cluster_v3.Cluster_ROUND_ROBIN || got.GetRespectDnsTtl() {
+		t.Errorf("fields set to their zero value were not overridden: %v", got)
+	}
+	if n := len(cfg.ClusterConfig.BaseConfig.GetHealthChecks()); n != 1 {
+		t.Errorf("base config was modified: %d health checks", n)
+	}
+
+	if _, err := parseConfig([]byte("apiVersion: v1alpha\ncluster_config:\n  overrides:\n    - match: [{port_name: http}]\n      strategy: replace\n      override: {lb_policy: RANDOM}\n")); err == nil {
+		t.Error("unknown strategy: expected error")
+	}
+}
+
+func TestReadinessHealthChecks(t *testing.T) {
+	cfg, err := parseConfig([]byte("apiVersion: v1alpha\ncluster_config:\n  base:\n    connect_timeout: 1s\n  readiness_health_checks:\n    match:\n      - port_name: http\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := cds.NewServer("", nil)
+	cs := cfg.ClusterConfig.Store(server)
+	pods := cs.PodStore(cfg.EndpointConfig.PodStore())
+	if pods == nil {
+		t.Fatal("expected a pod store")
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "app"},
+		Spec: v1.ServiceSpec{
+			Selector: map[string]string{"app": "app"},
+			Ports: []v1.ServicePort{
+				{Name: "http", Port: 80, TargetPort: intstr.FromString("web")},
+				{Name: "metrics", Port: 9090},
+			},
+		},
+	}
+	if err := cs.Add(svc); err != nil {
+		t.Fatalf("add service: %v", err)
+	}
+	pod := func(name string, created time.Duration, probe *v1.Probe) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:         "foo",
+				Name:              name,
+				Labels:            map[string]string{"app": "app"},
+				CreationTimestamp: metav1.NewTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).Add(created)),
+			},
+			Spec: v1.PodSpec{Containers: []v1.Container{{
+				Name:           "app",
+				Ports:          []v1.ContainerPort{{Name: "web", ContainerPort: 8080}, {ContainerPort: 9090}},
+				ReadinessProbe: probe,
+			}}},
+		}
+	}
+	healthChecks := func() map[string][]*envoy_config_core_v3.HealthCheck {
+		result := make(map[string][]*envoy_config_core_v3.HealthCheck)
+		for _, cl := range server.ListClusters() {
+			if len(cl.GetHealthChecks()) > 0 {
+				result[cl.GetName()] = cl.GetHealthChecks()
+			}
+		}
+		return result
+	}
+	timing := func(hc *envoy_config_core_v3.HealthCheck, timeout, interval time.Duration, unhealthy, healthy uint32) *envoy_config_core_v3.HealthCheck {
+		hc.Timeout, hc.Interval = durationpb.New(timeout), durationpb.New(interval)
+		hc.UnhealthyThreshold, hc.HealthyThreshold = wrapperspb.UInt32(unhealthy), wrapperspb.UInt32(healthy)
+		return hc
+	}
+
+	if diff := cmp.Diff(healthChecks(), map[string][]*envoy_config_core_v3.HealthCheck{}, protocmp.Transform()); diff != "" {
+		t.Errorf("without pods:\n%s", diff)
+	}
+
+	httpProbe := &v1.Probe{
+		ProbeHandler: v1.ProbeHandler{HTTPGet: &v1.HTTPGetAction{
+			Path:        "/healthz",
+			Port:        intstr.FromString("web"),
+			HTTPHeaders: []v1.HTTPHeader{{Name: "Host", Value: "app.example.com"}, {Name: "X-Probe", Value: "1"}},
+		}},
+		TimeoutSeconds:   2,
+		PeriodSeconds:    5,
+		FailureThreshold: 2,
+	}
+	if err := pods.Add(pod("app-1", 0, httpProbe)); err != nil {
+		t.Fatalf("add pod: %v", err)
+	}
+	want := map[string][]*envoy_config_core_v3.HealthCheck{
+		"foo:app:http": {timing(&envoy_config_core_v3.HealthCheck{
+			HealthChecker: &envoy_config_core_v3.HealthCheck_HttpHealthCheck_{HttpHealthCheck: &envoy_config_core_v3.HealthCheck_HttpHealthCheck{
+				Host:             "app.example.com",
+				Path:             "/healthz",
+				ExpectedStatuses: []*envoy_type_v3.Int64Range{{Start: 200, End: 400}},
+				RequestHeadersToAdd: []*envoy_config_core_v3.HeaderValueOption{
+					{Header: &envoy_config_core_v3.HeaderValue{Key: "X-Probe", Value: "1"}},
+				},
+			}},
+		}, 2*time.Second, 5*time.Second, 2, 1)},
+	}
+	if diff := cmp.Diff(healthChecks(), want, protocmp.Transform()); diff != "" {
+		t.Errorf("after adding a pod with an http probe:\n%s", diff)
+	}
+
+	// A rollout that switches to a tcp probe; the newest pod's probe wins.
+	tcpProbe := &v1.Probe{ProbeHandler: v1.ProbeHandler{TCPSocket: &v1.TCPSocketAction{Port: intstr.FromInt32(8080)}}}
+	if err := pods.Add(pod("app-2", time.Hour, tcpProbe)); err != nil {
+		t.Fatalf("add pod: %v", err)
+	}
+	want = map[string][]*envoy_config_core_v3.HealthCheck{
+		"foo:app:http": {timing(&envoy_config_core_v3.HealthCheck{
+			HealthChecker: &envoy_config_core_v3.HealthCheck_TcpHealthCheck_{TcpHealthCheck: &envoy_config_core_v3.HealthCheck_TcpHealthCheck{}},
+		}, time.Second, 10*time.Second, 3, 1)},
+	}
+	if diff := cmp.Diff(healthChecks(), want, protocmp.Transform()); diff != "" {
+		t.Errorf("after rollout:\n%s", diff)
+	}
+
+	// A probe of another port can't be translated.
+	if err := pods.Update(pod("app-2", time.Hour, &v1.Probe{ProbeHandler: v1.ProbeHandler{TCPSocket: &v1.TCPSocketAction{Port: intstr.FromInt32(9090)}}})); err != nil {
+		t.Fatalf("update pod: %v", err)
+	}
+	if diff := cmp.Diff(healthChecks(), map[string][]*envoy_config_core_v3.HealthCheck{}, protocmp.Transform()); diff != "" {
+		t.Errorf("probe of another port:\n%s", diff)
+	}
+
+	// Deleting the newest pod goes back to the older pod's probe.
+	if err := pods.Delete(pod("app-2", time.Hour, nil)); err != nil {
+		t.Fatalf("delete pod: %v", err)
+	}
+	if got := healthChecks()["foo:app:http"]; len(got) != 1 || got[0].GetHttpHealthCheck() == nil {
+		t.Errorf("after deleting the newest pod: expected an http health check, got %v", got)
+	}
+
+	// Annotations opt services in or out.
+	svc = svc.DeepCopy()
+	svc.Annotations = map[string]string{ReadinessHealthCheckAnnotation: "false"}
+	if err := cs.Update(svc); err != nil {
+		t.Fatalf("update service: %v", err)
+	}
+	if diff := cmp.Diff(healthChecks(), map[string][]*envoy_config_core_v3.HealthCheck{}, protocmp.Transform()); diff != "" {
+		t.Errorf("opted out:\n%s", diff)
+	}
+	svc = svc.DeepCopy()
+	svc.Annotations = map[string]string{ReadinessHealthCheckAnnotation: "true"}
+	svc.Spec.Ports[1].TargetPort = intstr.FromString("web")
+	if err := cs.Update(svc); err != nil {
+		t.Fatalf("update service: %v", err)
+	}
+	got := healthChecks()
+	if len(got) != 2 || got["foo:app:metrics"] == nil {
+		t.Errorf("opted in: expected health checks on both ports, got %v", got)
+	}
+}
+
+func TestSubsets(t *testing.T) {
+	cfg, err := parseConfig([]byte("apiVersion: v1alpha\ncluster_config:\n  base:\n    connect_timeout: 1s\nsubsets:\n  labels: [version, stage]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.PodLabelSelector(); got != "" {
+		t.Errorf("pod label selector:\n  got: %v\n want: everything", got)
+	}
+	server := cds.NewServer("", nil)
+	cs := cfg.ClusterConfig.Store(server)
+	pods := cs.PodStore(cfg.EndpointConfig.PodStore())
+	for _, name := range []string{"app", "plain"} {
+		if err := cs.Add(&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: name},
+			Spec: v1.ServiceSpec{
+				Selector: map[string]string{"app": name},
+				Ports:    []v1.ServicePort{{Name: "http", Port: 80}},
+			},
+		}); err != nil {
+			t.Fatalf("add service %s: %v", name, err)
+		}
+	}
+	pod := func(name, app string, labels map[string]string) *v1.Pod {
+		p := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: name, Labels: map[string]string{"app": app}}}
+		for k, v := range labels {
+			p.Labels[k] = v
+		}
+		return p
+	}
+	subsets := func() map[string]*envoy_config_cluster_v3.Cluster_LbSubsetConfig {
+		result := make(map[string]*envoy_config_cluster_v3.Cluster_LbSubsetConfig)
+		for _, cl := range server.ListClusters() {
+			if sc := cl.GetLbSubsetConfig(); sc != nil {
+				result[cl.GetName()] = sc
+			}
+		}
+		return result
+	}
+	selectors := func(keys ...string) *envoy_config_cluster_v3.Cluster_LbSubsetConfig {
+		sc := &envoy_config_cluster_v3.Cluster_LbSubsetConfig{FallbackPolicy: envoy_config_cluster_v3.Cluster_LbSubsetConfig_ANY_ENDPOINT}
+		for _, k := range keys {
+			sc.SubsetSelectors = append(sc.SubsetSelectors, &envoy_config_cluster_v3.Cluster_LbSubsetConfig_LbSubsetSelector{Keys: []string{k}})
+		}
+		return sc
+	}
+
+	if err := pods.Add(pod("app-1", "app", map[string]string{"version": "v1"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := pods.Add(pod("plain-1", "plain", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(subsets(), map[string]*envoy_config_cluster_v3.Cluster_LbSubsetConfig{"foo:app:http": selectors("version")}, protocmp.Transform()); diff != "" {
+		t.Errorf("after adding pods:\n%s", diff)
+	}
+	if err := pods.Add(pod("app-2", "app", map[string]string{"version": "v2", "stage": "canary"})); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(subsets(), map[string]*envoy_config_cluster_v3.Cluster_LbSubsetConfig{"foo:app:http": selectors("version", "stage")}, protocmp.Transform()); diff != "" {
+		t.Errorf("after adding a canary:\n%s", diff)
+	}
+	for _, name := range []string{"app-1", "app-2"} {
+		if err := pods.Delete(pod(name, "app", nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if diff := cmp.Diff(subsets(), map[string]*envoy_config_cluster_v3.Cluster_LbSubsetConfig{}, protocmp.Transform()); diff != "" {
+		t.Errorf("after deleting labeled pods:\n%s", diff)
+	}
+
+	// The labels are also endpoint metadata.
+	if err := pods.Add(pod("app-3", "app", map[string]string{"version": "v3"})); err != nil {
+		t.Fatal(err)
+	}
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "app-xyz", Labels: map[string]string{discoveryv1.LabelServiceName: "app"}},
+		Ports:      []discoveryv1.EndpointPort{{Name: ptr("http"), Port: ptr(int32(80))}},
+		Endpoints:  []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.3"}, TargetRef: &v1.ObjectReference{Kind: "Pod", Namespace: "foo", Name: "app-3"}}},
+	}
+	clas := cfg.EndpointConfig.LoadAssignmentsFromEndpointSlices(nil, []*discoveryv1.EndpointSlice{slice})
+	if got, want := clas[0].GetEndpoints()[0].GetLbEndpoints()[0].GetMetadata().GetFilterMetadata()[LbMetadataNamespace].AsMap(), map[string]any{"version": "v3"}; !cmp.Equal(got, want) {
+		t.Errorf("endpoint metadata:\n  got: %v\n want: %v", got, want)
+	}
+
+	for _, stanza := range []string{"{labels: []}", "{labels: ['not a label']}", "{labels: [version], fallback_policy: DEFAULT_SUBSET}"} {
+		if _, err := parseConfig([]byte("apiVersion: v1alpha\nsubsets: " + stanza + "\n")); err == nil {
+			t.Errorf("subsets %s: expected error", stanza)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package glue
+
+import (
+	"encoding/json"
+	"fmt"
+	"text/template"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_config_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	envoy_config_route_v3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	envoy_extensions_filters_http_router_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
+	envoy_extensions_filters_network_http_connection_manager_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	"google.golang.org/protobuf/types/known/anypb"
+	v1 "k8s.io/api/core/v1"
+)
+
+// DefaultGRPCListenerName is the default template for the names of listeners generated for gRPC
+// clients.  A gRPC client dials "xds:///<listener name>".
+const DefaultGRPCListenerName = "{{.Name}}.{{.Namespace}}:{{.PortNumber}}"
+
+// GRPCConfig configures generation of the listeners and routes that gRPC's xDS resolver needs to
+// resolve a target to a cluster.  gRPC clients only speak ADS, and only support EDS (not STRICT_DNS)
+// clusters, so the clusters selected here should be EDS clusters with "eds_config: {ads: {}}".
+type GRPCConfig struct {
+	// Match selects the service ports to generate gRPC resources for; multiple items are OR'd.
+	Match []*Matcher `json:"match"`
+	// ListenerName is a text/template, executed with a TemplateData, that names the listener
+	// and route configuration for a port.  It defaults to DefaultGRPCListenerName.  A template
+	// without {{.Namespace}} gives same-named services in different namespaces the same name;
+	// the older service keeps it.
+	ListenerName string `json:"listener_name"`
+	// RequestTimeout, if set, limits the duration of every call, like "30s"; "0s" means no
+	// limit.  A service's RequestTimeoutAnnotation overrides it for that service.  gRPC reads
+	// the limit from the route's max_stream_duration, not its timeout, which it ignores.
+	RequestTimeout *Duration `json:"request_timeout"`
+
+	listenerName *template.Template
+}
+
+func (g *GRPCConfig) UnmarshalJSON(b []byte) error {
+	tmp := struct {
+		Match          []*Matcher `json:"match"`
+		ListenerName   string     `json:"listener_name"`
+		RequestTimeout *Duration  `json:"request_timeout"`
+	}{}
+	if err := json.Unmarshal(b, &tmp); err != nil {
+		return fmt.Errorf("GRPCConfig: unmarshal into temporary structure: %w", err)
+	}
+	if len(tmp.Match) == 0 {
+		return fmt.Errorf("GRPCConfig: no matching rules provided")
+	}
+	g.Match = tmp.Match
+	g.ListenerName = tmp.ListenerName
+	g.RequestTimeout = tmp.RequestTimeout
+	if g.ListenerName == "" {
+		g.ListenerName = DefaultGRPCListenerName
+	}
+	t, err := template.New("listener_name").Option("missingkey=error").Parse(g.ListenerName)
+	if err != nil {
+		return fmt.Errorf("GRPCConfig: parse listener_name template: %w", err)
+	}
+	g.listenerName = t
+	return nil
+}
+
+// Resources returns the listener and route configuration that direct a gRPC client to the provided
+// cluster, or nils if the port is not selected by the config.
+func (g *GRPCConfig) Resources(cluster *envoy_config_cluster_v3.Cluster, svc *v1.Service, port *v1.ServicePort) (*envoy_config_listener_v3.Listener, *envoy_config_route_v3.RouteConfiguration, error) {
+	if g == nil {
+		return nil, nil, nil
+	}
+	var match bool
+	for _, m := range g.Match {
+		if m.Evaluate(cluster, svc, port) {
+			match = true
+			break
+		}
+	}
+	if !match {
+		return nil, nil, nil
+	}
+	t := g.listenerName
+	if t == nil {
+		var err error
+		t, err = template.New("listener_name").Parse(DefaultGRPCListenerName)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse default listener_name template: %w", err)
+		}
+	}
+	name, err := executeTemplate(t, newTemplateData(svc, port))
+	if err != nil {
+		return nil, nil, fmt.Errorf("execute listener_name template: %w", err)
+	}
+
+	hcm, err := rdsConnectionManager(name, "")
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshal http connection manager: %w", err)
+	}
+	listener := &envoy_config_listener_v3.Listener{
+		Name:        name,
+		ApiListener: &envoy_config_listener_v3.ApiListener{ApiListener: hcm},
+	}
+	action := &envoy_config_route_v3.RouteAction{
+		ClusterSpecifier: &envoy_config_route_v3.RouteAction_Cluster{Cluster: cluster.GetName()},
+	}
+	if d := requestTimeout(svc.GetNamespace()+"/"+svc.GetName(), svc.GetAnnotations(), g.RequestTimeout); d != nil {
+		action.MaxStreamDuration = &envoy_config_route_v3.RouteAction_MaxStreamDuration{MaxStreamDuration: d}
+	}
+	route := &envoy_config_route_v3.RouteConfiguration{
+		Name: name,
+		VirtualHosts: []*envoy_config_route_v3.VirtualHost{{
+			Name:    name,
+			Domains: []string{"*"},
+			Routes: []*envoy_config_route_v3.Route{{
+				Match: &envoy_config_route_v3.RouteMatch{
+					PathSpecifier: &envoy_config_route_v3.RouteMatch_Prefix{Prefix: ""},
+				},
+				Action: &envoy_config_route_v3.Route_Route{
+					Route: action,
+				},
+			}},
+		}},
+	}
+	return listener, route, nil
+}
+
+// rdsConnectionManager returns an HTTP connection manager that gets the named route configuration
+// via RDS over ADS.
+func rdsConnectionManager(routeConfigName, statPrefix string) (*anypb.Any, error) {
+	return anypb.New(&envoy_extensions_filters_network_http_connection_manager_v3.HttpConnectionManager{
+		StatPrefix: statPrefix,
+		RouteSpecifier: &envoy_extensions_filters_network_http_connection_manager_v3.HttpConnectionManager_Rds{
+			Rds: &envoy_extensions_filters_network_http_connection_manager_v3.Rds{
+				ConfigSource: &envoy_config_core_v3.ConfigSource{
+					ResourceApiVersion:    envoy_config_core_v3.ApiVersion_V3,
+					ConfigSourceSpecifier: &envoy_config_core_v3.ConfigSource_Ads{Ads: &envoy_config_core_v3.AggregatedConfigSource{}},
+				},
+				RouteConfigName: routeConfigName,
+			},
+		},
+		HttpFilters: []*envoy_extensions_filters_network_http_connection_manager_v3.HttpFilter{routerFilter()},
+	})
+}
+
+// rdsListener returns a listener on the provided port that serves the named route configuration,
+// fetched via RDS over ADS.
+func rdsListener(name string, port uint32) (*envoy_config_listener_v3.Listener, error) {
+	hcm, err := rdsConnectionManager(name, name)
+	if err != nil {
+		return nil, fmt.Errorf("marshal http connection manager: %w", err)
+	}
+	return &envoy_config_listener_v3.Listener{
+		Name: name,
+		Address: &envoy_config_core_v3.Address{
+			Address: &envoy_config_core_v3.Address_SocketAddress{
+				SocketAddress: &envoy_config_core_v3.SocketAddress{
+					Address:       "0.0.0.0",
+					PortSpecifier: &envoy_config_core_v3.SocketAddress_PortValue{PortValue: port},
+				},
+			},
+		},
+		FilterChains: []*envoy_config_listener_v3.FilterChain{{
+			Filters: []*envoy_config_listener_v3.Filter{{
+				Name:       "envoy.filters.network.http_connection_manager",
+				ConfigType: &envoy_config_listener_v3.Filter_TypedConfig{TypedConfig: hcm},
+			}},
+		}},
+	}, nil
+}
+
+// routerFilter returns the router HTTP filter, which must be the last filter in an HTTP connection
+// manager.
+func routerFilter() *envoy_extensions_filters_network_http_connection_manager_v3.HttpFilter {
+	router, err := anypb.New(&envoy_extensions_filters_http_router_v3.Router{})
+	if err != nil {
+		// This cannot fail; the message is empty.
+		panic(fmt.Sprintf("marshal router: %v", err))
+	}
+	return &envoy_extensions_filters_network_http_connection_manager_v3.HttpFilter{
+		Name:       "envoy.filters.http.router",
+		ConfigType: &envoy_extensions_filters_network_http_connection_manager_v3.HttpFilter_TypedConfig{TypedConfig: router},
+	}
+}
@@ -0,0 +1,345 @@
+package glue
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_type_v3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ReadinessHealthCheckAnnotation, set to "true" on a service, generates active health checks from
+// its pods' readiness probes when ClusterConfig.ReadinessHealthChecks is configured; "false" opts
+// the service out, even if its ports are matched.
+const ReadinessHealthCheckAnnotation = "ekglue.io/readiness-health-check"
+
+// ReadinessHealthCheckConfig translates the readiness probes of a service's pods into active health
+// checks on its clusters, so that Envoy stops sending traffic to an endpoint as soon as it fails
+// its probe, instead of after the kubelet marks the pod unready and the change propagates through
+// EndpointSlices.  The probe's period, timeout, and thresholds are copied.  HTTP probes (but not
+// HTTPS), TCP probes, and, for clusters that speak HTTP/2, gRPC probes are translated; probes on a
+// different port than the one the service targets are not, because Envoy checks the port that it
+// sends traffic to.  Clusters that already have health checks, from the base config or namespace
+// defaults, are left alone.  Configuring this makes ekglue watch every pod.
+type ReadinessHealthCheckConfig struct {
+	// Match selects the ports whose clusters get health checks; multiple items are OR'd.
+	// Services annotated with ReadinessHealthCheckAnnotation opt in all of their ports.
+	Match []*Matcher `json:"match"`
+}
+
+// enabled returns true if the cluster for port of svc should get health checks.
+func (c *ReadinessHealthCheckConfig) enabled(cluster *envoy_config_cluster_v3.Cluster, svc *v1.Service, port *v1.ServicePort) bool {
+	if c == nil {
+		return false
+	}
+	if v, ok := svc.GetAnnotations()[ReadinessHealthCheckAnnotation]; ok {
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			zap.L().Error("invalid annotation", zap.String("service", svc.GetNamespace()+"/"+svc.GetName()), zap.String("annotation", ReadinessHealthCheckAnnotation), zap.Error(err))
+		}
+		return on
+	}
+	for _, m := range c.Match {
+		if m.Evaluate(cluster, svc, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// newPodStore returns a store for pods that can be searched by namespace.
+func newPodStore() cache.Store {
+	return cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+}
+
+// selectedPods returns the pods in podStore that svc selects, newest first, so that the pods of a
+// rollout in progress take precedence.
+func selectedPods(podStore cache.Store, svc *v1.Service) []*v1.Pod {
+	if podStore == nil || len(svc.Spec.Selector) == 0 {
+		return nil
+	}
+	var objs []interface{}
+	if i, ok := podStore.(cache.Indexer); ok {
+		objs, _ = i.ByIndex(cache.NamespaceIndex, svc.GetNamespace())
+	} else {
+		objs = podStore.List()
+	}
+	selector := labels.SelectorFromSet(svc.Spec.Selector)
+	var result []*v1.Pod
+	for _, obj := range objs {
+		pod, ok := obj.(*v1.Pod)
+		if !ok || pod.GetNamespace() != svc.GetNamespace() || !selector.Matches(labels.Set(pod.GetLabels())) {
+			continue
+		}
+		result = append(result, pod)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i].GetCreationTimestamp(), result[j].GetCreationTimestamp()
+		if !a.Equal(&b) {
+			return b.Before(&a)
+		}
+		return result[i].GetName() < result[j].GetName()
+	})
+	return result
+}
+
+// targetContainer returns the container of pod that serves port, and the number of the container
+// port.
+func targetContainer(pod *v1.Pod, port *v1.ServicePort) (*v1.Container, int32) {
+	target := port.TargetPort
+	if target.Type == intstr.Int && target.IntVal == 0 {
+		target = intstr.FromInt32(port.Port)
+	}
+	for i := range pod.Spec.Containers {
+		c := &pod.Spec.Containers[i]
+		for _, p := range c.Ports {
+			if target.Type == intstr.String && p.Name == target.StrVal {
+				return c, p.ContainerPort
+			}
+			if target.Type == intstr.Int && p.ContainerPort == target.IntVal {
+				return c, p.ContainerPort
+			}
+		}
+	}
+	if target.Type == intstr.Int {
+		// Containers needn't declare the ports they listen on.
+		for i := range pod.Spec.Containers {
+			if pod.Spec.Containers[i].ReadinessProbe != nil {
+				return &pod.Spec.Containers[i], target.IntVal
+			}
+		}
+	}
+	return nil, 0
+}
+
+// probePort returns the port number that a probe of container c checks.
+func probePort(c *v1.Container, port intstr.IntOrString) int32 {
+	if port.Type == intstr.Int {
+		return port.IntVal
+	}
+	for _, p := range c.Ports {
+		if p.Name == port.StrVal {
+			return p.ContainerPort
+		}
+	}
+	return 0
+}
+
+// orDefault returns v, or def if v is zero.
+func orDefault(v, def int32) int32 {
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+// healthCheck translates a readiness probe of container c, which serves traffic on port, into an
+// Envoy health check.  It returns an error if the probe can't be translated.
+func healthCheck(cl *envoy_config_cluster_v3.Cluster, c *v1.Container, port int32) (*envoy_config_core_v3.HealthCheck, error) {
+	p := c.ReadinessProbe
+	if p == nil {
+		return nil, fmt.Errorf("container %s has no readiness probe", c.Name)
+	}
+	hc := &envoy_config_core_v3.HealthCheck{
+		Timeout:            durationpb.New(time.Duration(orDefault(p.TimeoutSeconds, 1)) * time.Second),
+		Interval:           durationpb.New(time.Duration(orDefault(p.PeriodSeconds, 10)) * time.Second),
+		UnhealthyThreshold: wrapperspb.UInt32(uint32(orDefault(p.FailureThreshold, 3))),
+		HealthyThreshold:   wrapperspb.UInt32(uint32(orDefault(p.SuccessThreshold, 1))),
+	}
+	var checked int32
+	switch {
+	case p.HTTPGet != nil:
+		if p.HTTPGet.Scheme == v1.URISchemeHTTPS {
+			return nil, fmt.Errorf("container %s: https probes are not supported", c.Name)
+		}
+		checked = probePort(c, p.HTTPGet.Port)
+		path := p.HTTPGet.Path
+		if path == "" {
+			path = "/"
+		}
+		check := &envoy_config_core_v3.HealthCheck_HttpHealthCheck{
+			Host: p.HTTPGet.Host,
+			Path: path,
+			// The kubelet considers any status from 200 to 399 a success.
+			ExpectedStatuses: []*envoy_type_v3.Int64Range{{Start: 200, End: 400}},
+		}
+		for _, h := range p.HTTPGet.HTTPHeaders {
+			if h.Name == "Host" || h.Name == "host" {
+				check.Host = h.Value
+				continue
+			}
+			check.RequestHeadersToAdd = append(check.RequestHeadersToAdd, &envoy_config_core_v3.HeaderValueOption{
+				Header: &envoy_config_core_v3.HeaderValue{Key: h.Name, Value: h.Value},
+			})
+		}
+		hc.HealthChecker = &envoy_config_core_v3.HealthCheck_HttpHealthCheck_{HttpHealthCheck: check}
+	case p.TCPSocket != nil:
+		checked = probePort(c, p.TCPSocket.Port)
+		hc.HealthChecker = &envoy_config_core_v3.HealthCheck_TcpHealthCheck_{TcpHealthCheck: &envoy_config_core_v3.HealthCheck_TcpHealthCheck{}}
+	case p.GRPC != nil:
+		if cl.GetHttp2ProtocolOptions() == nil {
+			return nil, fmt.Errorf("container %s: grpc probes need a cluster that speaks http/2", c.Name)
+		}
+		checked = p.GRPC.Port
+		check := new(envoy_config_core_v3.HealthCheck_GrpcHealthCheck)
+		if p.GRPC.Service != nil {
+			check.ServiceName = *p.GRPC.Service
+		}
+		hc.HealthChecker = &envoy_config_core_v3.HealthCheck_GrpcHealthCheck_{GrpcHealthCheck: check}
+	default:
+		return nil, fmt.Errorf("container %s: only http, tcp, and grpc probes are supported", c.Name)
+	}
+	if checked != port {
+		return nil, fmt.Errorf("container %s: probe checks port %d, not the service's target port %d", c.Name, checked, port)
+	}
+	return hc, nil
+}
+
+// readinessHealthCheck returns the health check generated from the readiness probe of the newest
+// pod that svc selects, for the cluster of port, or nil if there is none.
+func (c *ClusterConfig) readinessHealthCheck(cl *envoy_config_cluster_v3.Cluster, svc *v1.Service, port *v1.ServicePort) (*envoy_config_core_v3.HealthCheck, error) {
+	if !c.ReadinessHealthChecks.enabled(cl, svc, port) {
+		return nil, nil
+	}
+	for _, pod := range selectedPods(c.pods, svc) {
+		container, n := targetContainer(pod, port)
+		if container == nil {
+			continue
+		}
+		if container.ReadinessProbe == nil {
+			return nil, nil
+		}
+		return healthCheck(cl, container, n)
+	}
+	return nil, nil
+}
+
+// podProbes returns the readiness probes of a pod's containers.
+func podProbes(pod *v1.Pod) []*v1.Probe {
+	var result []*v1.Probe
+	for _, c := range pod.Spec.Containers {
+		result = append(result, c.ReadinessProbe)
+	}
+	return result
+}
+
+// probeWatcher is a cache.Store of pods that regenerates the clusters of the services that select
+// a pod whenever a pod appears, disappears, or changes its labels or readiness probes, so that
+// health checks follow rollouts that change probes, and subset selectors follow pod labels.
+type probeWatcher struct {
+	cache.Store
+	cs *ClusterStore
+
+	mu sync.Mutex // serializes changes, so that the previous version of a pod can be compared
+}
+
+// PodStore returns a cache.Store that sends pods to pods, and keeps the health checks that
+// ReadinessHealthChecks generates from them, and the subset configs of Config.Subsets, up to date.
+// It returns pods unchanged if neither is configured.
+func (cs *ClusterStore) PodStore(pods cache.Store) cache.Store {
+	if cs.cfg.ReadinessHealthChecks == nil && cs.cfg.subsets == nil {
+		return pods
+	}
+	return &probeWatcher{Store: pods, cs: cs}
+}
+
+// refresh regenerates the clusters of the services in the pods' namespaces that select them.
+func (w *probeWatcher) refresh(pods ...*v1.Pod) {
+	ctx, c := startOp("pods", "refresh")
+	defer c()
+	w.cs.mu.Lock()
+	defer w.cs.mu.Unlock()
+	for key, svc := range w.cs.services {
+		for _, pod := range pods {
+			if pod == nil || key.Namespace != pod.GetNamespace() || len(svc.Spec.Selector) == 0 {
+				continue
+			}
+			if !labels.SelectorFromSet(svc.Spec.Selector).Matches(labels.Set(pod.GetLabels())) {
+				continue
+			}
+			if err := w.cs.update(ctx, svc); err != nil {
+				logError(ctx)
+				zap.L().Warn("problem regenerating clusters after a pod change", zap.String("service", key.String()), zap.Error(err))
+			}
+			break
+		}
+	}
+}
+
+// old returns the version of pod in the store, if any.
+func (w *probeWatcher) old(pod *v1.Pod) *v1.Pod {
+	obj, ok, err := w.Store.Get(pod)
+	if err != nil || !ok {
+		return nil
+	}
+	old, _ := obj.(*v1.Pod)
+	return old
+}
+
+func (w *probeWatcher) Add(obj interface{}) error {
+	return w.Update(obj)
+}
+
+func (w *probeWatcher) Update(obj interface{}) error {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return w.Store.Update(obj)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	old := w.old(pod)
+	if err := w.Store.Update(pod); err != nil {
+		return err
+	}
+	if old != nil && equality.Semantic.DeepEqual(old.GetLabels(), pod.GetLabels()) && equality.Semantic.DeepEqual(podProbes(old), podProbes(pod)) {
+		return nil
+	}
+	w.refresh(old, pod)
+	return nil
+}
+
+func (w *probeWatcher) Delete(obj interface{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.Store.Delete(obj); err != nil {
+		return err
+	}
+	if pod, ok := obj.(*v1.Pod); ok {
+		w.refresh(pod)
+	}
+	return nil
+}
+
+func (w *probeWatcher) Replace(objs []interface{}, resourceVersion string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.Store.Replace(objs, resourceVersion); err != nil {
+		return err
+	}
+	ctx, c := startOp("pods", "replace")
+	defer c()
+	w.cs.mu.Lock()
+	defer w.cs.mu.Unlock()
+	for key, svc := range w.cs.services {
+		if len(svc.Spec.Selector) == 0 {
+			continue
+		}
+		if err := w.cs.update(ctx, svc); err != nil {
+			logError(ctx)
+			zap.L().Warn("problem regenerating clusters after listing pods", zap.String("service", key.String()), zap.Error(err))
+		}
+	}
+	return nil
+}
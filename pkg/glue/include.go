@@ -0,0 +1,124 @@
+package glue
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// IncludeKey is the top-level key of a config file that lists other config files to merge into it,
+// so that a large config, like one with overrides for many teams, can be split up.  Paths are
+// relative to the including file, and may be glob patterns, like "teams/*.yaml"; matches are
+// included in lexical order.  Included files may include other files, but not, directly or
+// indirectly, themselves.
+//
+// Included files are merged in order, and then the including file is merged on top of them:
+// objects are merged key by key, lists are concatenated, and any other value replaces the value
+// from the files before it.  Included files don't need an apiVersion.
+//
+// YAML anchors, aliases, and merge keys ("<<: *defaults") work within a single file.
+const IncludeKey = "include"
+
+// readConfigFile reads the named config file, and the files it includes, and returns the merged
+// result as JSON.  stack is the chain of files that included this one.
+func readConfigFile(filename string, stack []string) (map[string]interface{}, error) {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	for _, f := range stack {
+		if f == abs {
+			return nil, fmt.Errorf("include cycle: %s", strings.Join(append(stack, abs), " -> "))
+		}
+	}
+	stack = append(stack, abs)
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	js, err := yaml.YAMLToJSON(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: converting YAML to JSON: %w", filename, err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(js, &doc); err != nil {
+		return nil, fmt.Errorf("%s: config must be an object: %w", filename, err)
+	}
+	includes, err := includePaths(filepath.Dir(filename), doc[IncludeKey])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	delete(doc, IncludeKey)
+	result := make(map[string]interface{})
+	for _, path := range includes {
+		included, err := readConfigFile(path, stack)
+		if err != nil {
+			return nil, fmt.Errorf("include %s: %w", path, err)
+		}
+		result = mergeJSON(result, included).(map[string]interface{})
+	}
+	return mergeJSON(result, doc).(map[string]interface{}), nil
+}
+
+// includePaths returns the files named by the value of an IncludeKey, relative to dir.
+func includePaths(dir string, value interface{}) ([]string, error) {
+	if value == nil {
+		return nil, nil
+	}
+	patterns, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be a list of paths", IncludeKey)
+	}
+	var result []string
+	for _, p := range patterns {
+		pattern, ok := p.(string)
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("%s: %v is not a path", IncludeKey, p)
+		}
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		if !strings.ContainsAny(pattern, "*?[") {
+			// A missing file is an error, rather than a pattern that matches nothing.
+			result = append(result, pattern)
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", IncludeKey, err)
+		}
+		result = append(result, matches...) // Glob sorts its matches.
+	}
+	return result, nil
+}
+
+// mergeJSON merges src on top of dst, as described in the IncludeKey documentation.
+func mergeJSON(dst, src interface{}) interface{} {
+	switch s := src.(type) {
+	case map[string]interface{}:
+		d, ok := dst.(map[string]interface{})
+		if !ok {
+			return s
+		}
+		for k, v := range s {
+			if old, ok := d[k]; ok {
+				d[k] = mergeJSON(old, v)
+			} else {
+				d[k] = v
+			}
+		}
+		return d
+	case []interface{}:
+		d, ok := dst.([]interface{})
+		if !ok {
+			return s
+		}
+		return append(d, s...)
+	default:
+		return src
+	}
+}
@@ -0,0 +1,322 @@
+package glue
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	envoy_config_route_v3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/jrockway/ekglue/pkg/cds"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// DefaultIngressRouteConfigName is the default name of the route configuration generated from
+// Ingresses.
+const DefaultIngressRouteConfigName = "ingresses"
+
+// ingressClassAnnotation is the annotation that selected an Ingress's class before
+// spec.ingressClassName existed.
+const ingressClassAnnotation = "kubernetes.io/ingress.class"
+
+// IngressConfig configures translation of networking.k8s.io/v1 Ingresses into a single Envoy route
+// configuration, so that edge Envoys can get their route tables from the cluster.  Each path's
+// backend is the cluster that ekglue generates for the referenced service port.
+//
+// A backend that refers to a service port by number is resolved to the named service port with that
+// number, since a named port's cluster is named after the port's name, which the Ingress doesn't
+// know; that takes the store to be linked to a ClusterStore with Stores.Link.  Otherwise, or if the
+// service is unknown, the port is assumed to be unnamed.  Resource backends are skipped, and TLS
+// settings are ignored; terminate TLS in the listener.
+type IngressConfig struct {
+	// RouteConfigName names the generated route configuration.  It defaults to
+	// DefaultIngressRouteConfigName.
+	RouteConfigName string `json:"route_config_name"`
+	// ListenerPort, if non-zero, additionally generates a listener (with the same name as the
+	// route configuration) that serves the routes on this port.
+	ListenerPort uint32 `json:"listener_port"`
+	// IngressClass, if set, limits translation to Ingresses of this class (by
+	// spec.ingressClassName, or the older kubernetes.io/ingress.class annotation).
+	IngressClass string `json:"ingress_class"`
+	// DestinationMetadata, if true, records the backend service of each route in the route's
+	// metadata (under DestinationMetadataNamespace) and tracing tags, so that access logs and
+	// traces identify the Kubernetes destination.
+	DestinationMetadata bool `json:"destination_metadata"`
+	// RequestTimeout, if set, is the timeout of every generated route, like "30s"; "0s" disables
+	// it.  An Ingress's RequestTimeoutAnnotation overrides it for that Ingress's routes.  Without
+	// either, Envoy's default applies.
+	RequestTimeout *Duration `json:"request_timeout"`
+
+	naming    *NamingConfig    // from Config.Naming
+	allowlist []*AllowlistRule // from Config.Allowlist
+}
+
+// routeConfigName returns the name of the route configuration.
+func (c *IngressConfig) routeConfigName() string {
+	if c.RouteConfigName == "" {
+		return DefaultIngressRouteConfigName
+	}
+	return c.RouteConfigName
+}
+
+// ingressRoute is a single translated path of an Ingress.
+type ingressRoute struct {
+	key   string // namespace/name of the Ingress
+	host  string // "*" for rules without a host
+	route *envoy_config_route_v3.Route
+	exact bool // whether the path must match exactly
+	path  string
+	// isDefault is set for the Ingress's default backend, which matches after every path.
+	isDefault bool
+}
+
+// selects returns true if the Ingress is of the configured class.
+func (c *IngressConfig) selects(ing *networkingv1.Ingress) bool {
+	if c.IngressClass == "" {
+		return true
+	}
+	if class := ing.Spec.IngressClassName; class != nil {
+		return *class == c.IngressClass
+	}
+	return ing.GetAnnotations()[ingressClassAnnotation] == c.IngressClass
+}
+
+// backend returns the name of the cluster for an Ingress backend, and the service port that it
+// refers to, or "" if it can't be translated.  services holds the ports of every known service, for
+// backends that refer to a port by number.
+func (c *IngressConfig) backend(key, namespace string, b *networkingv1.IngressBackend, services map[types.NamespacedName][]v1.ServicePort) (string, v1.ServicePort) {
+	svc := b.Service
+	if svc == nil {
+		zap.L().Warn("skipping ingress backend that is not a service", zap.String("ingress", key))
+		return "", v1.ServicePort{}
+	}
+	port := v1.ServicePort{Name: svc.Port.Name, Port: svc.Port.Number, Protocol: v1.ProtocolTCP}
+	if port.Name == "" {
+		for _, p := range services[types.NamespacedName{Namespace: namespace, Name: svc.Name}] {
+			if p.Port == port.Port {
+				port = p
+				break
+			}
+		}
+	}
+	name, _ := c.naming.nameCluster(namespace, svc.Name, port.Name, port.Port, port.Protocol)
+	return name, port
+}
+
+// routes translates an Ingress into routes, or returns nil if the Ingress is not selected.  services
+// is passed to backend.
+func (c *IngressConfig) routes(ing *networkingv1.Ingress, services map[types.NamespacedName][]v1.ServicePort) []*ingressRoute {
+	if !c.selects(ing) {
+		return nil
+	}
+	key := ing.GetNamespace() + "/" + ing.GetName()
+	timeout := requestTimeout(key, ing.GetAnnotations(), c.RequestTimeout)
+	route := func(cluster string, b *networkingv1.IngressBackend, port v1.ServicePort) *envoy_config_route_v3.Route {
+		r := &envoy_config_route_v3.Route{
+			Name: key,
+			Action: &envoy_config_route_v3.Route_Route{
+				Route: &envoy_config_route_v3.RouteAction{
+					ClusterSpecifier: &envoy_config_route_v3.RouteAction_Cluster{Cluster: cluster},
+					Timeout:          timeout,
+				},
+			},
+		}
+		if c.DestinationMetadata {
+			setDestination(r, ing.GetNamespace(), []string{b.Service.Name})
+		}
+		if md := allowlistMetadata(allowedSources(c.allowlist, allowlistTarget{ing.GetNamespace(), cluster, port.Name, port.Port})); md != nil {
+			setFilterMetadata(&r.Metadata, AllowlistMetadataNamespace, md)
+		}
+		return r
+	}
+	var result []*ingressRoute
+	for _, rule := range ing.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		host := rule.Host
+		if host == "" {
+			host = "*"
+		}
+		for i := range rule.HTTP.Paths {
+			p := &rule.HTTP.Paths[i]
+			cluster, port := c.backend(key, ing.GetNamespace(), &p.Backend, services)
+			if cluster == "" {
+				continue
+			}
+			r := &ingressRoute{key: key, host: host, route: route(cluster, &p.Backend, port), path: p.Path}
+			if r.path == "" {
+				r.path = "/"
+			}
+			match := new(envoy_config_route_v3.RouteMatch)
+			switch {
+			case p.PathType != nil && *p.PathType == networkingv1.PathTypeExact:
+				r.exact = true
+				match.PathSpecifier = &envoy_config_route_v3.RouteMatch_Path{Path: r.path}
+			case p.PathType != nil && *p.PathType == networkingv1.PathTypePrefix && r.path != "/":
+				// Prefix matches whole path elements, so /foo matches /foo/bar but not
+				// /foobar.
+				match.PathSpecifier = &envoy_config_route_v3.RouteMatch_PathSeparatedPrefix{PathSeparatedPrefix: trimTrailingSlash(r.path)}
+			default:
+				// ImplementationSpecific is a plain string prefix.
+				match.PathSpecifier = &envoy_config_route_v3.RouteMatch_Prefix{Prefix: r.path}
+			}
+			r.route.Match = match
+			result = append(result, r)
+		}
+	}
+	if b := ing.Spec.DefaultBackend; b != nil {
+		if cluster, port := c.backend(key, ing.GetNamespace(), b, services); cluster != "" {
+			r := &ingressRoute{key: key, host: "*", route: route(cluster, b, port), path: "/", isDefault: true}
+			r.route.Match = &envoy_config_route_v3.RouteMatch{
+				PathSpecifier: &envoy_config_route_v3.RouteMatch_Prefix{Prefix: "/"},
+			}
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// trimTrailingSlash removes trailing slashes from a path other than "/"; Envoy rejects a
+// path_separated_prefix that ends in a slash.
+func trimTrailingSlash(path string) string {
+	for len(path) > 1 && path[len(path)-1] == '/' {
+		path = path[:len(path)-1]
+	}
+	return path
+}
+
+// RouteConfiguration translates the provided Ingresses into a route configuration with one virtual
+// host per hostname, plus a "*" virtual host for rules without a host and default backends.  Within
+// a host, exact paths are matched first, then longer paths before shorter ones, then default
+// backends.  Backends that refer to a service port by number are assumed to be unnamed ports.
+func (c *IngressConfig) RouteConfiguration(ings []*networkingv1.Ingress) *envoy_config_route_v3.RouteConfiguration {
+	var routes []*ingressRoute
+	for _, ing := range ings {
+		routes = append(routes, c.routes(ing, nil)...)
+	}
+	return c.routeConfiguration(routes)
+}
+
+func (c *IngressConfig) routeConfiguration(routes []*ingressRoute) *envoy_config_route_v3.RouteConfiguration {
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if a.host != b.host {
+			// The wildcard host sorts last, though Envoy matches it last regardless.
+			if a.host == "*" || b.host == "*" {
+				return b.host == "*"
+			}
+			return a.host < b.host
+		}
+		if a.isDefault != b.isDefault {
+			return b.isDefault
+		}
+		if a.exact != b.exact {
+			return a.exact
+		}
+		if len(a.path) != len(b.path) {
+			return len(a.path) > len(b.path)
+		}
+		return a.key < b.key
+	})
+	result := &envoy_config_route_v3.RouteConfiguration{Name: c.routeConfigName()}
+	var vhost *envoy_config_route_v3.VirtualHost
+	for _, r := range routes {
+		if vhost == nil || vhost.GetName() != r.host {
+			vhost = &envoy_config_route_v3.VirtualHost{Name: r.host, Domains: []string{r.host}}
+			result.VirtualHosts = append(result.VirtualHosts, vhost)
+		}
+		vhost.Routes = append(vhost.Routes, r.route)
+	}
+	return result
+}
+
+// IngressStore is a cache.Store that receives Ingresses and keeps the generated route
+// configuration up to date on the xDS server.
+type IngressStore struct {
+	*routeTable[*networkingv1.Ingress]
+	// The following fields are protected by the route table's lock.
+	cfg      *IngressConfig
+	services map[types.NamespacedName][]v1.ServicePort // from the linked ClusterStore; see Stores.Link
+}
+
+// Store returns a cache.Store that allows a Kubernetes reflector to sync Ingress changes to an RDS
+// server.
+func (c *IngressConfig) Store(s *cds.Server) *IngressStore {
+	is := &IngressStore{cfg: c}
+	is.routeTable = newRouteTable(s, "ingress", "ingresses", func(obj interface{}) (string, *networkingv1.Ingress, error) {
+		ing, ok := obj.(*networkingv1.Ingress)
+		if !ok {
+			return "", nil, fmt.Errorf("got non-ingress object %#v", obj)
+		}
+		return ing.GetNamespace() + "/" + ing.GetName(), ing, nil
+	}, is.generate)
+	return is
+}
+
+// generate returns the route configuration generated from ingresses.  You must hold the lock.
+func (is *IngressStore) generate(ingresses map[string]*networkingv1.Ingress) (*envoy_config_route_v3.RouteConfiguration, uint32) {
+	var routes []*ingressRoute
+	for _, ing := range ingresses {
+		routes = append(routes, is.cfg.routes(ing, is.services)...)
+	}
+	return is.cfg.routeConfiguration(routes), is.cfg.ListenerPort
+}
+
+// link records the ports of each of services, as decided by the linked ClusterStore; a nil entry
+// means the service is gone.  If an Ingress refers to a service whose ports changed, the route
+// configuration is regenerated.
+func (is *IngressStore) link(ctx context.Context, services map[types.NamespacedName]*linkedService) error {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	changed := make(map[types.NamespacedName]struct{})
+	for key, l := range services {
+		var ports []v1.ServicePort
+		if l != nil {
+			ports = l.ports
+		}
+		if equality.Semantic.DeepEqual(is.services[key], ports) {
+			continue
+		}
+		changed[key] = struct{}{}
+		if l == nil {
+			delete(is.services, key)
+		} else {
+			is.services[key] = ports
+		}
+	}
+	for _, ing := range is.objects {
+		if refersTo(ing, changed) {
+			return is.push(ctx)
+		}
+	}
+	return nil
+}
+
+// refersTo returns true if any backend of ing is one of services.
+func refersTo(ing *networkingv1.Ingress, services map[types.NamespacedName]struct{}) bool {
+	refers := func(b *networkingv1.IngressBackend) bool {
+		if b == nil || b.Service == nil {
+			return false
+		}
+		_, ok := services[types.NamespacedName{Namespace: ing.GetNamespace(), Name: b.Service.Name}]
+		return ok
+	}
+	if refers(ing.Spec.DefaultBackend) {
+		return true
+	}
+	for _, rule := range ing.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for i := range rule.HTTP.Paths {
+			if refers(&rule.HTTP.Paths[i].Backend) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package glue
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	"github.com/jrockway/ekglue/pkg/xds"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
+)
+
+var invalidClusters = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "ekglue_invalid_clusters",
+		Help: "The number of generated clusters that fail validation, by whether their last valid version is still served (stale) or they aren't served at all (missing).",
+	},
+	[]string{"state"},
+)
+
+const (
+	// minInvalidRetry and maxInvalidRetry bound the delay between retries of a service whose
+	// clusters are invalid; the delay doubles after each failed retry.
+	minInvalidRetry = time.Second
+	maxInvalidRetry = 5 * time.Minute
+)
+
+// InvalidCluster is a generated cluster that failed validation.  Rather than rejecting every
+// cluster generated from the service along with it, the last valid version of the cluster keeps
+// being served, and the service is retried, immediately when it changes and otherwise with
+// exponential backoff, until a regenerated version is valid.
+type InvalidCluster struct {
+	// Cluster is the name of the cluster.
+	Cluster string `json:"cluster"`
+	// Service is the service that the cluster was generated from, as namespace/name.
+	Service string `json:"service"`
+	// Error is why the cluster is invalid.
+	Error string `json:"error"`
+	// Since is when the cluster first failed validation.
+	Since time.Time `json:"since"`
+	// Stale is true if the last valid version of the cluster is being served; otherwise the
+	// cluster is not served at all.
+	Stale bool `json:"stale"`
+
+	err      error
+	owner    types.NamespacedName
+	attempts int       // failed retries since the service last changed
+	retry    time.Time // when to retry the service next
+}
+
+// checkClusters validates each of the clusters that owner generated on its own, returning the
+// valid ones.  An invalid cluster is replaced by the version being served, if there is one, and
+// dropped otherwise, so that one bad cluster doesn't block the rest of the change, and is recorded
+// in invalid.  Entries are carried over from cs.invalid so that retries keep backing off;
+// retrying is true if the service hasn't changed since the clusters were last checked.  You must
+// hold the lock.
+func (cs *ClusterStore) checkClusters(owner types.NamespacedName, clusters []*envoy_config_cluster_v3.Cluster, ports map[*envoy_config_cluster_v3.Cluster]*v1.ServicePort, invalid map[string]*InvalidCluster, retrying bool) []*envoy_config_cluster_v3.Cluster {
+	result := make([]*envoy_config_cluster_v3.Cluster, 0, len(clusters))
+	for _, c := range clusters {
+		name := c.GetName()
+		err := cs.s.Clusters.Validate([]xds.Resource{c})
+		if err == nil {
+			delete(invalid, name)
+			result = append(result, c)
+			continue
+		}
+		e, ok := cs.invalid[name]
+		if !ok || e.owner != owner {
+			e = &InvalidCluster{Cluster: name, Service: owner.String(), Since: time.Now(), owner: owner}
+			zap.L().Warn("generated cluster is invalid; serving its last valid version, if any", zap.String("cluster", name), zap.String("service", owner.String()), zap.Error(err))
+		}
+		e.Error, e.err = err.Error(), err
+		if retrying {
+			e.attempts++
+		} else {
+			e.attempts = 0
+		}
+		delay := minInvalidRetry << e.attempts
+		if delay <= 0 || delay > maxInvalidRetry {
+			delay = maxInvalidRetry
+		}
+		e.retry = time.Now().Add(delay)
+		invalid[name] = e
+		served, ok := cs.s.Clusters.Get(name).(*envoy_config_cluster_v3.Cluster)
+		e.Stale = ok
+		if ok {
+			ports[served] = ports[c]
+			result = append(result, served)
+		}
+	}
+	return result
+}
+
+// forgetInvalid forgets about the invalid clusters that owner generated.  You must hold the lock.
+func (cs *ClusterStore) forgetInvalid(owner types.NamespacedName) {
+	for name, e := range cs.invalid {
+		if e.owner == owner {
+			delete(cs.invalid, name)
+		}
+	}
+}
+
+// countInvalid updates the invalid cluster metric.  You must hold the lock.
+func (cs *ClusterStore) countInvalid() {
+	var stale, missing int
+	for _, e := range cs.invalid {
+		if e.Stale {
+			stale++
+		} else {
+			missing++
+		}
+	}
+	invalidClusters.WithLabelValues("stale").Set(float64(stale))
+	invalidClusters.WithLabelValues("missing").Set(float64(missing))
+}
+
+// InvalidClusters returns the generated clusters that currently fail validation, sorted by name.
+func (cs *ClusterStore) InvalidClusters() []*InvalidCluster {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	result := make([]*InvalidCluster, 0, len(cs.invalid))
+	for _, e := range cs.invalid {
+		c := *e
+		result = append(result, &c)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Cluster < result[j].Cluster })
+	return result
+}
+
+// ServeInvalidClusters is an http.Handler that serves InvalidClusters as YAML.
+func (cs *ClusterStore) ServeInvalidClusters(w http.ResponseWriter, req *http.Request) {
+	ya, err := yaml.Marshal(cs.InvalidClusters())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(ya)
+}
+
+// retryInvalid regenerates the clusters of every service with an invalid cluster that is due for
+// a retry.
+func (cs *ClusterStore) retryInvalid(ctx context.Context, now time.Time) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	due := make(map[types.NamespacedName]*v1.Service)
+	for _, e := range cs.invalid {
+		if svc, ok := cs.services[e.owner]; ok && !now.Before(e.retry) {
+			due[e.owner] = svc
+		}
+	}
+	for key, svc := range due {
+		if err := cs.update(ctx, svc); err != nil {
+			zap.L().Warn("problem retrying service with invalid clusters", zap.String("service", key.String()), zap.Error(err))
+		}
+	}
+}
+
+// RetryInvalid retries services whose clusters are invalid, until the context is done.  Each
+// service is retried with exponential backoff, from minInvalidRetry up to maxInvalidRetry, so that
+// a problem that clears up on its own, like a validator that consults outside state, is noticed
+// without the service changing.
+func (cs *ClusterStore) RetryInvalid(ctx context.Context) error {
+	t := time.NewTicker(minInvalidRetry)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-t.C:
+			rctx, c := startOp("services", "retry")
+			cs.retryInvalid(rctx, now)
+			c()
+		}
+	}
+}
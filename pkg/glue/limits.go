@@ -0,0 +1,77 @@
+package glue
+
+import (
+	"fmt"
+
+	"github.com/jrockway/ekglue/pkg/cds"
+	"github.com/jrockway/ekglue/pkg/xds"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var namespaceQuotaRejections = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "ekglue_namespace_quota_rejections",
+		Help: "A count of services whose clusters were not published because their namespace was over its cluster limit.",
+	},
+	[]string{"namespace"},
+)
+
+// LimitsConfig bounds the number of resources ekglue publishes, so that a runaway controller
+// creating thousands of services can't exhaust the control plane's memory or overwhelm Envoy.
+// Zero means unlimited.
+type LimitsConfig struct {
+	// MaxClusters is the maximum number of clusters served over CDS.
+	MaxClusters int `json:"max_clusters"`
+	// MaxLoadAssignments is the maximum number of load assignments served over EDS.
+	MaxLoadAssignments int `json:"max_load_assignments"`
+	// MaxClustersPerNamespace is the maximum number of clusters generated from the services in
+	// a single namespace.  A service that would push its namespace over the limit keeps the
+	// clusters it already had, if any.
+	MaxClustersPerNamespace int `json:"max_clusters_per_namespace"`
+}
+
+// Validate returns an error if any limit is negative.
+func (l *LimitsConfig) Validate() error {
+	if l == nil {
+		return nil
+	}
+	if l.MaxClusters < 0 || l.MaxLoadAssignments < 0 || l.MaxClustersPerNamespace < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+// Apply sets the server-wide limits on the xDS server's managers.
+func (l *LimitsConfig) Apply(s *cds.Server) {
+	if l == nil {
+		return
+	}
+	s.Clusters.MaxResources = l.MaxClusters
+	s.Endpoints.MaxResources = l.MaxLoadAssignments
+}
+
+// checkNamespace returns an error if owner adding n clusters to a namespace that already has
+// existing clusters would exceed the per-namespace limit.
+func (l *LimitsConfig) checkNamespace(owner types.NamespacedName, existing, n int) error {
+	if l == nil || l.MaxClustersPerNamespace <= 0 || n == 0 || existing+n <= l.MaxClustersPerNamespace {
+		return nil
+	}
+	namespaceQuotaRejections.WithLabelValues(owner.Namespace).Inc()
+	zap.L().Warn("namespace cluster quota exceeded", zap.Stringer("service", owner), zap.Int("clusters", existing+n), zap.Int("max_clusters_per_namespace", l.MaxClustersPerNamespace))
+	return fmt.Errorf("namespace %q: %d clusters would exceed the limit of %d: %w", owner.Namespace, existing+n, l.MaxClustersPerNamespace, xds.ErrQuotaExceeded)
+}
+
+// namespaceCount returns the number of clusters owned by services in namespace ns, other than
+// except.
+func (o *nameOwners) namespaceCount(ns string, except types.NamespacedName) int {
+	var n int
+	for owner, names := range o.names {
+		if owner.Namespace == ns && owner != except {
+			n += len(names)
+		}
+	}
+	return n
+}
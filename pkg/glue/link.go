@@ -0,0 +1,238 @@
+package glue
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"golang.org/x/exp/maps"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// linkedService is what the ClusterStore that an EndpointStore is linked to decided about a
+// service; see Stores.Link.
+type linkedService struct {
+	excluded bool // ClusterConfig.IncludesService skips the service
+	// names maps the name of each cluster generated from the service to the name it is served as
+	// after collisions are resolved, or "" if another service owns the name.  Clusters that are
+	// served as generated are left out.
+	names map[string]string
+	ports []v1.ServicePort // the service's ports, which its EndpointSlices' ports are resolved to
+}
+
+// rename returns the name that the cluster named name is served as, or "" if it isn't served.
+func (l *linkedService) rename(name string) string {
+	if l == nil {
+		return name
+	}
+	if served, ok := l.names[name]; ok {
+		return served
+	}
+	return name
+}
+
+// servicePort returns the service port that port, which belongs to one of the service's
+// EndpointSlices, was generated from, so that matchers see the same port on both sides.
+// EndpointSlice ports carry the service port's name, but the number of its target port; if the
+// service port is unknown, a port with that name and number is returned.
+func (l *linkedService) servicePort(port discoveryv1.EndpointPort) *v1.ServicePort {
+	name := withDefault(port.Name, "")
+	if l != nil {
+		for i, sp := range l.ports {
+			// Port names are unique within a service, and only a service's only port can be
+			// unnamed.
+			if sp.Name == name {
+				return &l.ports[i]
+			}
+		}
+	}
+	return &v1.ServicePort{Name: name, Port: *port.Port}
+}
+
+// Link makes s.Endpoints generate load assignments to match the clusters that s.Clusters generates,
+// so that the services that ClusterConfig.IncludesService skips get no load assignments, and only
+// the service that owns a cluster name according to ClusterConfig.CollisionPolicy gets a load
+// assignment with that name.  Without it, load assignments are generated from every EndpointSlice,
+// whether or not its service has clusters.  It must be called before either store receives
+// objects.
+//
+// Link also lets s.Ingresses resolve backends that refer to a service port by number.  Unlike the
+// endpoints, the Ingresses can be linked after s.Clusters has received services, by calling Link
+// again once s.Ingresses is set.
+func (s *Stores) Link() {
+	if s.Clusters == nil {
+		return
+	}
+	s.Clusters.mu.Lock()
+	defer s.Clusters.mu.Unlock()
+	if s.Endpoints != nil && s.Clusters.endpoints != s.Endpoints {
+		s.Clusters.endpoints = s.Endpoints
+		s.Endpoints.mu.Lock()
+		s.Endpoints.linked = make(map[types.NamespacedName]*linkedService)
+		s.Endpoints.mu.Unlock()
+	}
+	if s.Ingresses != nil && s.Clusters.ingresses != s.Ingresses {
+		s.Clusters.ingresses = s.Ingresses
+		s.Ingresses.mu.Lock()
+		s.Ingresses.services = make(map[types.NamespacedName][]v1.ServicePort)
+		for key, svc := range s.Clusters.services {
+			s.Ingresses.services[key] = svc.Spec.Ports
+		}
+		s.Ingresses.mu.Unlock()
+	}
+}
+
+// linkedService returns what the linked EndpointStore needs to know about svc.  You must hold the
+// lock.
+func (cs *ClusterStore) linkedService(svc *v1.Service) *linkedService {
+	key := serviceKey(svc)
+	l := &linkedService{excluded: !cs.cfg.IncludesService(svc), ports: svc.Spec.Ports}
+	for generated, claimed := range cs.claimed[key] {
+		if owner, ok := cs.owners.owners[claimed]; !ok || owner != key {
+			claimed = ""
+		}
+		if claimed == generated {
+			continue
+		}
+		if l.names == nil {
+			l.names = make(map[string]string)
+		}
+		l.names[generated] = claimed
+	}
+	return l
+}
+
+// generatedNames returns the names of clusters, which nameOwners.claim may change.
+func generatedNames(clusters []*envoy_config_cluster_v3.Cluster) []string {
+	result := make([]string, len(clusters))
+	for i, cl := range clusters {
+		result[i] = cl.GetName()
+	}
+	return result
+}
+
+// claimedNames returns the name that each of clusters was claimed as, by the name it was generated
+// with; generated holds those names, as returned by generatedNames before the clusters were
+// claimed.
+func claimedNames(generated []string, clusters []*envoy_config_cluster_v3.Cluster) map[string]string {
+	result := make(map[string]string)
+	for i, cl := range clusters {
+		result[generated[i]] = cl.GetName()
+	}
+	return result
+}
+
+// link tells the linked EndpointStore and IngressStore, if any, what was generated from each of
+// services; a nil entry means the service is gone.  You must hold the lock.
+func (cs *ClusterStore) link(ctx context.Context, services map[types.NamespacedName]*linkedService) error {
+	if cs.endpoints != nil {
+		if err := cs.endpoints.link(ctx, cs.owners, services); err != nil {
+			return fmt.Errorf("endpoints: %w", err)
+		}
+	}
+	if cs.ingresses != nil {
+		if err := cs.ingresses.link(ctx, services); err != nil {
+			return fmt.Errorf("ingresses: %w", err)
+		}
+	}
+	return nil
+}
+
+// link records what the linked ClusterStore decided about each of services, and regenerates the
+// load assignments of those whose entry changed.  A nil entry forgets the service without
+// regenerating anything, since its EndpointSlices are about to be deleted too.  Load assignments
+// that a service no longer gets are deleted, unless owners says that another service owns the
+// name, in which case that service's load assignments are regenerated instead.
+func (s *EndpointStore) link(ctx context.Context, owners *nameOwners, services map[types.NamespacedName]*linkedService) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := maps.Keys(services)
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	var changed []*discoveryv1.EndpointSlice
+	var loadAssignments []*envoy_config_endpoint_v3.ClusterLoadAssignment
+	regenerated := make(map[types.NamespacedName]struct{})
+	refresh := make(map[types.NamespacedName]struct{})
+	for _, key := range keys {
+		l := services[key]
+		if l == nil {
+			delete(s.linked, key)
+			continue
+		}
+		if reflect.DeepEqual(s.linkedAs(key), l) {
+			s.linked[key] = l
+			continue
+		}
+		svcESs := s.serverESs[key]
+		stale := s.serviceClusterNames(key, svcESs)
+		s.linked[key] = l
+		if len(svcESs) == 0 {
+			continue
+		}
+		for name := range s.serviceClusterNames(key, svcESs) {
+			delete(stale, name)
+		}
+		names := maps.Keys(stale)
+		sort.Strings(names)
+		for _, name := range names {
+			if owner, ok := owners.owners[name]; ok && owner != key {
+				refresh[owner] = struct{}{}
+				continue
+			}
+			s.srv.DeleteEndpoints(ctx, name)
+		}
+		slices := maps.Values(svcESs)
+		loadAssignments = append(loadAssignments, s.serviceLoadAssignments(key, slices)...)
+		changed = append(changed, slices...)
+		regenerated[key] = struct{}{}
+	}
+	refreshKeys := maps.Keys(refresh)
+	sort.Slice(refreshKeys, func(i, j int) bool { return refreshKeys[i].String() < refreshKeys[j].String() })
+	for _, key := range refreshKeys {
+		if _, ok := regenerated[key]; ok {
+			continue
+		}
+		loadAssignments = append(loadAssignments, s.serviceLoadAssignments(key, maps.Values(s.serverESs[key]))...)
+	}
+	loadAssignments = append(loadAssignments, s.aggregateLoadAssignments(changed...)...)
+	return s.srv.AddEndpoints(ctx, loadAssignments)
+}
+
+// linkedAs returns what the linked ClusterStore decided about the service key; services that it
+// hasn't seen, and those of a store that isn't linked, are treated like included services.  You
+// must hold the lock.
+func (s *EndpointStore) linkedAs(key types.NamespacedName) *linkedService {
+	if l, ok := s.linked[key]; ok {
+		return l
+	}
+	return new(linkedService)
+}
+
+// serviceLoadAssignments returns the load assignments generated from slices, which belong to the
+// service key.  You must hold the lock.
+func (s *EndpointStore) serviceLoadAssignments(key types.NamespacedName, slices []*discoveryv1.EndpointSlice) []*envoy_config_endpoint_v3.ClusterLoadAssignment {
+	if s.linkedAs(key).excluded {
+		return nil
+	}
+	return s.cfg.linkedLoadAssignments(s.nodeStore, slices, s.linkedAs(key))
+}
+
+// serviceClusterNames returns the names of the load assignments generated from slices, which
+// belong to the service key.  You must hold the lock.
+func (s *EndpointStore) serviceClusterNames(key types.NamespacedName, slices map[string]*discoveryv1.EndpointSlice) map[string]struct{} {
+	l := s.linkedAs(key)
+	if l.excluded {
+		return make(map[string]struct{})
+	}
+	result := make(map[string]struct{})
+	for name := range s.cfg.clusterNames(slices, l) {
+		if served := l.rename(name); served != "" {
+			result[served] = struct{}{}
+		}
+	}
+	return result
+}
@@ -0,0 +1,145 @@
+package glue
+
+import (
+	"encoding/json"
+	"fmt"
+	"text/template"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3" // for ListenerTemplate's typed_config
+	"google.golang.org/protobuf/encoding/protojson"
+	v1 "k8s.io/api/core/v1"
+)
+
+// ListenerTemplateData is the data available to a ListenerTemplate.
+type ListenerTemplateData struct {
+	*TemplateData
+	ClusterName string // The name of the cluster generated for the port.
+}
+
+// ListenerTemplate generates an Envoy listener for each service port it matches, so that ekglue
+// can serve listeners alongside the clusters and endpoints they send traffic to.
+//
+// The listener is written as it would be in Envoy's config, and the whole thing is a text/template
+// executed with a ListenerTemplateData.  For example, a TCP proxy in front of every port named
+// "postgres":
+//
+//	match:
+//	  - port_name: postgres
+//	listener:
+//	  address: {socket_address: {address: 0.0.0.0, port_value: "{{.PortNumber}}"}}
+//	  filter_chains:
+//	    - filters:
+//	        - name: envoy.filters.network.tcp_proxy
+//	          typed_config:
+//	            "@type": type.googleapis.com/envoy.extensions.filters.network.tcp_proxy.v3.TcpProxy
+//	            stat_prefix: "{{.Namespace}}_{{.Name}}"
+//	            cluster: "{{.ClusterName}}"
+//
+// Templates are expanded inside JSON strings, so numeric fields must be quoted, which protobuf's
+// JSON encoding allows.  Only filters whose config types are linked into ekglue (currently the HTTP
+// connection manager, the router, and the TCP proxy) can appear in typed_config.
+type ListenerTemplate struct {
+	// Match selects the service ports to generate a listener for; multiple items are OR'd.
+	Match []*Matcher `json:"match"`
+	// Name is a text/template, executed with a ListenerTemplateData, that names the listener.
+	// It defaults to the name of the cluster.  Names must be unique across all templates; when
+	// two services generate the same name, the older service keeps it.
+	Name string `json:"name"`
+	// Listener is the listener to generate.
+	Listener json.RawMessage `json:"listener"`
+
+	name, listener *template.Template
+}
+
+func (t *ListenerTemplate) UnmarshalJSON(b []byte) error {
+	tmp := struct {
+		Match    []*Matcher      `json:"match"`
+		Name     string          `json:"name"`
+		Listener json.RawMessage `json:"listener"`
+	}{}
+	if err := json.Unmarshal(b, &tmp); err != nil {
+		return fmt.Errorf("ListenerTemplate: unmarshal into temporary structure: %w", err)
+	}
+	if len(tmp.Match) == 0 {
+		return fmt.Errorf("ListenerTemplate: no matching rules provided")
+	}
+	if len(tmp.Listener) == 0 {
+		return fmt.Errorf("ListenerTemplate: no listener provided")
+	}
+	t.Match, t.Name, t.Listener = tmp.Match, tmp.Name, tmp.Listener
+	if t.Name == "" {
+		t.Name = "{{.ClusterName}}"
+	}
+	var err error
+	if t.name, err = template.New("name").Option("missingkey=error").Parse(t.Name); err != nil {
+		return fmt.Errorf("ListenerTemplate: parse name template: %w", err)
+	}
+	if t.listener, err = template.New("listener").Option("missingkey=error").Parse(string(t.Listener)); err != nil {
+		return fmt.Errorf("ListenerTemplate: parse listener template: %w", err)
+	}
+	// Catch mistakes now, rather than when the first matching service shows up.
+	example := &v1.Service{}
+	example.SetNamespace("example")
+	example.SetName("example")
+	if _, err := t.execute("example:example:http", example, &v1.ServicePort{Name: "http", Port: 80}); err != nil {
+		return fmt.Errorf("ListenerTemplate: %w", err)
+	}
+	return nil
+}
+
+// execute generates the listener for the provided cluster.
+func (t *ListenerTemplate) execute(cluster string, svc *v1.Service, port *v1.ServicePort) (*envoy_config_listener_v3.Listener, error) {
+	data := &ListenerTemplateData{TemplateData: newTemplateData(svc, port), ClusterName: cluster}
+	name, err := executeTemplate(t.name, data)
+	if err != nil {
+		return nil, fmt.Errorf("execute name template: %w", err)
+	}
+	js, err := executeTemplate(t.listener, data)
+	if err != nil {
+		return nil, fmt.Errorf("execute listener template: %w", err)
+	}
+	l := new(envoy_config_listener_v3.Listener)
+	if err := protojson.Unmarshal([]byte(js), l); err != nil {
+		return nil, fmt.Errorf("unmarshal listener %q: %w", name, err)
+	}
+	l.Name = name
+	if err := l.Validate(); err != nil {
+		return nil, fmt.Errorf("validate listener %q: %w", name, err)
+	}
+	return l, nil
+}
+
+// Resource returns the listener for the provided cluster, or nil if the port is not selected by
+// the template.
+func (t *ListenerTemplate) Resource(cluster *envoy_config_cluster_v3.Cluster, svc *v1.Service, port *v1.ServicePort) (*envoy_config_listener_v3.Listener, error) {
+	var match bool
+	for _, m := range t.Match {
+		if m.Evaluate(cluster, svc, port) {
+			match = true
+			break
+		}
+	}
+	if !match {
+		return nil, nil
+	}
+	return t.execute(cluster.GetName(), svc, port)
+}
+
+// templatedListeners generates listeners for the provided clusters.
+func (c *ClusterConfig) templatedListeners(svc *v1.Service, clusters []*envoy_config_cluster_v3.Cluster, ports map[*envoy_config_cluster_v3.Cluster]*v1.ServicePort) ([]*envoy_config_listener_v3.Listener, error) {
+	var result []*envoy_config_listener_v3.Listener
+	for _, cl := range clusters {
+		for _, t := range c.Listeners {
+			l, err := t.Resource(cl, svc, ports[cl])
+			if err != nil {
+				return nil, fmt.Errorf("cluster %q: %w", cl.GetName(), err)
+			}
+			if l != nil {
+				result = append(result, l)
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,312 @@
+package glue
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	discoveryv1 "k8s.io/api/discovery/v1"
+)
+
+var loadWeightAdjustments = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "ekglue_load_weight_adjustments",
+	Help: "The number of times locality weights were changed because of reported load.",
+})
+
+// LoadWeightConfig adjusts the weights of the localities in generated load assignments by the load
+// that clients report over LRS, so that traffic shifts away from localities whose endpoints are
+// busier than the rest, usually because they are slower.  A locality's busyness is the number of
+// requests in progress to it per endpoint, summed over every client that reports load.
+//
+// Each locality starts with a weight of 100 per endpoint (or per unit of endpoint weight), and
+// generated EDS clusters use locality weighted load balancing, unless their config chooses zone
+// aware load balancing instead.  Load assignments whose localities are already weighted, like
+// those of tracks, are left alone.  Clients must be configured to send load reports to ekglue.
+type LoadWeightConfig struct {
+	// Interval is how often clients are asked to report load, and how often weights are
+	// adjusted.  Defaults to 30s.
+	Interval Duration `json:"interval"`
+	// Damping is the fraction of the change that a locality's reported load calls for that is
+	// made at each adjustment, between 0 and 1; lower values converge more slowly, but are less
+	// prone to oscillating.  Defaults to 0.5.
+	Damping float64 `json:"damping"`
+	// MaxFactor limits how far reported load can move a locality's weight from its starting
+	// weight, up or down.  Defaults to 4.
+	MaxFactor float64 `json:"max_factor"`
+}
+
+// Validate returns an error if the damping or max factor is out of range.
+func (c *LoadWeightConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Damping < 0 || c.Damping > 1 {
+		return fmt.Errorf("damping must be between 0 and 1")
+	}
+	if c.MaxFactor != 0 && c.MaxFactor < 1 {
+		return fmt.Errorf("max_factor must be at least 1")
+	}
+	return nil
+}
+
+// ReportInterval returns how often clients should report load.
+func (c *LoadWeightConfig) ReportInterval() time.Duration {
+	if c == nil || c.Interval == 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(c.Interval)
+}
+
+func (c *LoadWeightConfig) damping() float64 {
+	if c.Damping == 0 {
+		return 0.5
+	}
+	return c.Damping
+}
+
+func (c *LoadWeightConfig) maxFactor() float64 {
+	if c.MaxFactor == 0 {
+		return 4
+	}
+	return c.MaxFactor
+}
+
+// localityKey identifies a locality within a load assignment.
+func localityKey(l *envoy_config_core_v3.Locality) string {
+	return l.GetRegion() + "/" + l.GetZone() + "/" + l.GetSubZone()
+}
+
+// nodeLoad is the last load report from one client.
+type nodeLoad struct {
+	at         time.Time
+	inProgress map[string]map[string]uint64 // by cluster, then locality key
+}
+
+// LoadTracker receives load reports from clients, and keeps the locality weight adjustments that
+// they call for; see LoadWeightConfig.
+type LoadTracker struct {
+	mu      sync.Mutex
+	nodes   map[string]*nodeLoad          // by node id
+	factors map[string]map[string]float64 // by cluster, then locality key
+}
+
+// NewLoadTracker returns an empty LoadTracker.
+func NewLoadTracker() *LoadTracker {
+	return &LoadTracker{
+		nodes:   make(map[string]*nodeLoad),
+		factors: make(map[string]map[string]float64),
+	}
+}
+
+// Record records a load report from node.  It is suitable for cds.LoadReports.Record.
+func (t *LoadTracker) Record(node *envoy_config_core_v3.Node, stats []*envoy_config_endpoint_v3.ClusterStats) {
+	load := &nodeLoad{at: time.Now(), inProgress: make(map[string]map[string]uint64)}
+	for _, cs := range stats {
+		cluster := cs.GetClusterServiceName()
+		if cluster == "" {
+			cluster = cs.GetClusterName()
+		}
+		byLocality := make(map[string]uint64)
+		for _, ls := range cs.GetUpstreamLocalityStats() {
+			byLocality[localityKey(ls.GetLocality())] += ls.GetTotalRequestsInProgress()
+		}
+		load.inProgress[cluster] = byLocality
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nodes[node.GetId()] = load
+}
+
+// factor returns the adjustment to the weight of the locality of the cluster.
+func (t *LoadTracker) factor(cluster string, l *envoy_config_core_v3.Locality) float64 {
+	if t == nil {
+		return 1
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if f, ok := t.factors[cluster][localityKey(l)]; ok {
+		return f
+	}
+	return 1
+}
+
+// localityBase returns the starting weight of a locality, before any adjustment.
+func localityBase(lle *envoy_config_endpoint_v3.LocalityLbEndpoints) float64 {
+	var base float64
+	for _, lbe := range lle.GetLbEndpoints() {
+		if w := lbe.GetLoadBalancingWeight(); w != nil {
+			base += float64(w.GetValue())
+		} else {
+			base++
+		}
+	}
+	return base
+}
+
+// adjust moves the weight adjustment of each locality of the load assignments toward what the
+// load reported since stale calls for, and returns true if any changed enough to be worth pushing.
+// Adjustments for clusters that own returns true for, but that aren't in clas, are forgotten.
+func (t *LoadTracker) adjust(c *LoadWeightConfig, clas []*envoy_config_endpoint_v3.ClusterLoadAssignment, own func(string) bool, stale time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, n := range t.nodes {
+		if n.at.Before(stale) {
+			delete(t.nodes, id)
+		}
+	}
+	seen := make(map[string]struct{})
+	changed := false
+	for _, cla := range clas {
+		cluster := cla.GetClusterName()
+		if !own(cluster) {
+			continue
+		}
+		seen[cluster] = struct{}{}
+		load := make(map[string]float64)
+		var totalLoad, totalBase float64
+		for _, n := range t.nodes {
+			for key, x := range n.inProgress[cluster] {
+				load[key] += float64(x)
+				totalLoad += float64(x)
+			}
+		}
+		for _, lle := range cla.GetEndpoints() {
+			totalBase += localityBase(lle)
+		}
+		if totalLoad == 0 || totalBase == 0 || len(cla.GetEndpoints()) < 2 {
+			continue
+		}
+		mean := totalLoad / totalBase
+		factors, ok := t.factors[cluster]
+		if !ok {
+			factors = make(map[string]float64)
+			t.factors[cluster] = factors
+		}
+		max := c.maxFactor()
+		for _, lle := range cla.GetEndpoints() {
+			key := localityKey(lle.GetLocality())
+			base := localityBase(lle)
+			if base == 0 {
+				continue
+			}
+			target := max
+			if busy := load[key] / base; busy > 0 {
+				target = mean / busy
+			}
+			old, ok := factors[key]
+			if !ok {
+				old = 1
+			}
+			f := old * (1 + c.damping()*(target-1))
+			f = math.Min(math.Max(f, 1/max), max)
+			factors[key] = f
+			if math.Abs(f-old) > 0.01*old {
+				changed = true
+			}
+		}
+	}
+	for cluster := range t.factors {
+		if _, ok := seen[cluster]; !ok && own(cluster) {
+			delete(t.factors, cluster)
+		}
+	}
+	return changed
+}
+
+// LoadTracker returns the tracker that load reports should be sent to, if load weights are
+// configured, or nil otherwise.
+func (c *EndpointConfig) LoadTracker() *LoadTracker {
+	if c == nil || c.LoadWeights == nil {
+		return nil
+	}
+	if c.loads == nil {
+		c.loads = NewLoadTracker()
+	}
+	return c.loads
+}
+
+// weighLocalities sets the weight of each locality of the load assignments, as described in
+// LoadWeightConfig.
+func (c *EndpointConfig) weighLocalities(clas []*envoy_config_endpoint_v3.ClusterLoadAssignment) {
+	if c.LoadWeights == nil {
+		return
+	}
+outer:
+	for _, cla := range clas {
+		for _, lle := range cla.GetEndpoints() {
+			if lle.GetLoadBalancingWeight() != nil {
+				continue outer
+			}
+		}
+		for _, lle := range cla.GetEndpoints() {
+			w := math.Round(localityBase(lle) * c.loads.factor(cla.GetClusterName(), lle.GetLocality()) * 100)
+			lle.LoadBalancingWeight = wrapperspb.UInt32(uint32(math.Max(w, 1)))
+		}
+	}
+}
+
+// localityWeighted makes cluster use locality weighted load balancing, unless it already chooses
+// a kind of locality-aware load balancing.
+func localityWeighted(cluster *envoy_config_cluster_v3.Cluster) {
+	if cluster.GetCommonLbConfig().GetLocalityConfigSpecifier() != nil {
+		return
+	}
+	if cluster.CommonLbConfig == nil {
+		cluster.CommonLbConfig = new(envoy_config_cluster_v3.Cluster_CommonLbConfig)
+	}
+	cluster.CommonLbConfig.LocalityConfigSpecifier = &envoy_config_cluster_v3.Cluster_CommonLbConfig_LocalityWeightedLbConfig_{
+		LocalityWeightedLbConfig: new(envoy_config_cluster_v3.Cluster_CommonLbConfig_LocalityWeightedLbConfig),
+	}
+}
+
+// BalanceLoad adjusts locality weights by reported load, as described in LoadWeightConfig, until
+// the context is done.  It does nothing while load weights aren't configured.
+func (s *EndpointStore) BalanceLoad(ctx context.Context) error {
+	s.mu.Lock()
+	interval := s.cfg.LoadWeights.ReportInterval()
+	s.mu.Unlock()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-t.C:
+			rctx, c := startOp("endpointslice", "balance")
+			if err := s.balanceLoad(rctx, now.Add(-3*interval)); err != nil {
+				logError(rctx)
+				zap.L().Error("problem adjusting locality weights", zap.Error(err))
+			}
+			c()
+		}
+	}
+}
+
+// balanceLoad adjusts locality weights by the load reported since stale, and regenerates every load
+// assignment if they changed.
+func (s *EndpointStore) balanceLoad(ctx context.Context, stale time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cfg.LoadWeights == nil || s.cfg.loads == nil {
+		return nil
+	}
+	if !s.cfg.loads.adjust(s.cfg.LoadWeights, s.srv.ListEndpoints(), s.owns, stale) {
+		return nil
+	}
+	loadWeightAdjustments.Inc()
+	var endpoints []*discoveryv1.EndpointSlice
+	for _, svcESs := range s.serverESs {
+		endpoints = append(endpoints, maps.Values(svcESs)...)
+	}
+	return s.replace(ctx, endpoints)
+}
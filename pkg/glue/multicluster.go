@@ -0,0 +1,138 @@
+package glue
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ForCluster returns a copy of the config for translating the services and endpoints of an
+// additional Kubernetes cluster, whose stores share an xDS server with those of the first one; see
+// Stores.AddRemote.  The names of the clusters and load assignments generated from the additional
+// cluster start with prefix, like "east:default:foo:http", so that they can't collide with those
+// of same-named services in other clusters.
+//
+// Only clusters and load assignments are generated from additional clusters.  Aggregates, gRPC,
+// templated, and TLS passthrough listeners, Ingresses, OpenShift Routes, EnvoyClusters, and static
+// resources come only from the first cluster, since they aren't named after a single service.
+func (c *Config) ForCluster(prefix string) (*Config, error) {
+	if prefix == "" {
+		return nil, fmt.Errorf("cluster name prefix must not be empty")
+	}
+	if strings.IndexFunc(prefix, func(r rune) bool { return !isStatSafe(r) }) >= 0 {
+		return nil, fmt.Errorf("cluster name prefix %q may only contain letters, digits, '_', ':', and '-'", prefix)
+	}
+	result := *c
+	naming := new(NamingConfig)
+	if c.Naming != nil {
+		*naming = *c.Naming
+	}
+	if naming.MaxLength > 0 && len(prefix) >= naming.MaxLength-hashSuffixLength {
+		return nil, fmt.Errorf("cluster name prefix %q leaves no room for the rest of the name within naming.max_length", prefix)
+	}
+	naming.prefix = prefix
+	result.Naming = naming
+	result.Aggregates = nil
+	result.OpenShiftRoutes = nil
+	result.Ingresses = nil
+	result.EnvoyClusters = nil
+	result.Static = nil
+	if c.ClusterConfig != nil {
+		cc := *c.ClusterConfig
+		cc.GRPC, cc.Listeners, cc.TLSPassthrough = nil, nil, nil
+		cc.pods = nil
+		result.ClusterConfig = &cc
+	}
+	if c.EndpointConfig != nil {
+		ec := *c.EndpointConfig
+		// The additional cluster has its own pods and Cilium identities.
+		ec.pods, ec.identities = nil, nil
+		result.EndpointConfig = &ec
+	}
+	result.link()
+	return &result, nil
+}
+
+// ownsName returns true if name is the name of a resource generated by a store whose generated
+// names start with prefix, or, if prefix is empty, that doesn't start with any prefix in exclude.
+func ownsName(prefix string, exclude []string, name string) bool {
+	if prefix != "" {
+		return strings.HasPrefix(name, prefix)
+	}
+	for _, p := range exclude {
+		if strings.HasPrefix(name, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// owns returns true if the named cluster is one that the store generates, rather than one from
+// another Kubernetes cluster or a static one.  You must hold the lock.
+func (cs *ClusterStore) owns(name string) bool {
+	return ownsName(cs.cfg.naming.clusterPrefix(), cs.exclude, name) && !cs.static.ownsCluster(name)
+}
+
+// owns returns true if the named load assignment is one that the store generates, rather than one
+// from another Kubernetes cluster or a static one.  You must hold the lock.
+func (s *EndpointStore) owns(name string) bool {
+	return ownsName(s.cfg.naming.clusterPrefix(), s.exclude, name) && !s.static.ownsEndpoints(name)
+}
+
+// AddRemote adds the stores of an additional Kubernetes cluster, created from the config returned
+// by ForCluster(prefix), so that Reconfigure reconfigures them too, and so that s leaves the
+// clusters and load assignments they generate alone when it replaces its own.  It must be called
+// before any of the stores receive objects.
+func (s *Stores) AddRemote(prefix string, remote *Stores) error {
+	for p := range s.Remotes {
+		if strings.HasPrefix(p, prefix) || strings.HasPrefix(prefix, p) {
+			return fmt.Errorf("cluster name prefix %q overlaps %q", prefix, p)
+		}
+	}
+	if s.Remotes == nil {
+		s.Remotes = make(map[string]*Stores)
+	}
+	s.Remotes[prefix] = remote
+	s.Exclude(prefix)
+	remote.setStatic(s.Static)
+	return nil
+}
+
+// Exclude makes s leave clusters and load assignments whose names start with prefix alone when it
+// replaces its own, because something else, like another Kubernetes cluster or the inject API,
+// manages them.  It must be called before any of the stores receive objects.
+func (s *Stores) Exclude(prefix string) {
+	if s.Clusters != nil {
+		s.Clusters.mu.Lock()
+		s.Clusters.exclude = append(s.Clusters.exclude, prefix)
+		s.Clusters.mu.Unlock()
+	}
+	if s.Endpoints != nil {
+		s.Endpoints.mu.Lock()
+		s.Endpoints.exclude = append(s.Endpoints.exclude, prefix)
+		s.Endpoints.mu.Unlock()
+	}
+}
+
+// AddStatic makes ss serve the static clusters and load assignments when Reconfigure is called, and
+// makes s, and its remotes, leave resources with the same names alone.  It must be called before
+// any of the stores receive objects.
+func (s *Stores) AddStatic(ss *StaticStore) {
+	s.Static = ss
+	s.setStatic(ss)
+	for _, remote := range s.Remotes {
+		remote.setStatic(ss)
+	}
+}
+
+func (s *Stores) setStatic(ss *StaticStore) {
+	if s.Clusters != nil {
+		s.Clusters.mu.Lock()
+		s.Clusters.static = ss
+		s.Clusters.mu.Unlock()
+	}
+	if s.Endpoints != nil {
+		s.Endpoints.mu.Lock()
+		s.Endpoints.static = ss
+		s.Endpoints.mu.Unlock()
+	}
+}
@@ -0,0 +1,211 @@
+package glue
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+// NamingConfig configures how generated cluster names are made safe for use in Envoy stats.  The
+// same rules are applied to clusters and load assignments, so EDS continues to work.
+type NamingConfig struct {
+	// Sanitize replaces any character that is not a letter, digit, '_', ':' or '-' with '_'.
+	// Envoy uses '.' to separate the components of a stat name, so a cluster name containing '.'
+	// produces confusing stats.
+	Sanitize bool `json:"sanitize"`
+	// MaxLength, if non-zero, truncates names longer than this many bytes.  Truncated names end
+	// with a hash of the full name, so two long names that share a prefix remain distinct.
+	MaxLength int `json:"max_length"`
+	// Template, if set, is a text/template that generates the name of each cluster, and of its
+	// load assignment, from a TemplateData, like "{{.Namespace}}_{{.Name}}_{{.PortName}}", so that
+	// ekglue can follow a fleet's existing naming convention instead of
+	// "<namespace>:<service>:<port name or number>".  It must generate different names for
+	// different namespaces, services, and ports, which is checked when the config is loaded;
+	// ":udp" is appended to the names of UDP ports unless it uses .Protocol.  The result is
+	// prefixed, sanitized, and truncated like any other name.
+	Template string `json:"template"`
+
+	prefix    string             // from Config.ForCluster
+	template  *template.Template // parsed Template
+	udpSuffix bool               // whether template needs ":udp" appended; see checkTemplate
+}
+
+func (n *NamingConfig) UnmarshalJSON(b []byte) error {
+	tmp := struct {
+		Sanitize  bool   `json:"sanitize"`
+		MaxLength int    `json:"max_length"`
+		Template  string `json:"template"`
+	}{}
+	if err := json.Unmarshal(b, &tmp); err != nil {
+		return fmt.Errorf("NamingConfig: unmarshal into temporary structure: %w", err)
+	}
+	n.Sanitize, n.MaxLength, n.Template, n.template = tmp.Sanitize, tmp.MaxLength, tmp.Template, nil
+	if tmp.Template != "" {
+		t, err := parseNameTemplate(tmp.Template)
+		if err != nil {
+			return fmt.Errorf("NamingConfig: %w", err)
+		}
+		// Any problem with the names it generates is reported by Validate.
+		n.template = t
+		n.udpSuffix, _ = checkTemplate(t)
+	}
+	return nil
+}
+
+// parseNameTemplate parses a NamingConfig.Template.
+func parseNameTemplate(text string) (*template.Template, error) {
+	t, err := template.New("naming").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse template: %w", err)
+	}
+	return t, nil
+}
+
+// checkTemplate returns an error if t fails to generate a name, or generates the same name for
+// ports that the default scheme names differently.  Because nothing else in a name is checked, it
+// also returns whether the names of UDP ports need a suffix.
+func checkTemplate(t *template.Template) (udpSuffix bool, err error) {
+	base := TemplateData{Namespace: "namespace", Name: "service", PortName: "http", PortNumber: 80, Protocol: "tcp"}
+	name, err := executeTemplate(t, &base)
+	if err != nil {
+		return false, fmt.Errorf("execute template: %w", err)
+	}
+	if name == "" {
+		return false, fmt.Errorf("template generates empty names")
+	}
+	distinct := func(what string, change func(d *TemplateData)) error {
+		d := base
+		change(&d)
+		other, err := executeTemplate(t, &d)
+		if err != nil {
+			return fmt.Errorf("execute template: %w", err)
+		}
+		if other == name {
+			return fmt.Errorf("template generates the same name for different %s", what)
+		}
+		return nil
+	}
+	if err := distinct("namespaces", func(d *TemplateData) { d.Namespace = "other" }); err != nil {
+		return false, err
+	}
+	if err := distinct("services", func(d *TemplateData) { d.Name = "other" }); err != nil {
+		return false, err
+	}
+	if err := distinct("ports", func(d *TemplateData) { d.PortName, d.PortNumber = "grpc", 9000 }); err != nil {
+		return false, err
+	}
+	return distinct("protocols", func(d *TemplateData) { d.Protocol = "udp" }) != nil, nil
+}
+
+// hashSuffixLength is the length of the suffix added to truncated names.
+const hashSuffixLength = 9 // "-" + 8 hex digits
+
+// Validate checks the naming config for errors.
+func (n *NamingConfig) Validate() error {
+	if n == nil {
+		return nil
+	}
+	if n.MaxLength < 0 {
+		return fmt.Errorf("max_length must not be negative")
+	}
+	if n.MaxLength > 0 && n.MaxLength <= hashSuffixLength {
+		return fmt.Errorf("max_length must be greater than %d to leave room for a hash suffix", hashSuffixLength)
+	}
+	if n.Template != "" {
+		t, _, err := n.nameTemplate()
+		if err != nil {
+			return fmt.Errorf("template: %w", err)
+		}
+		if _, err := checkTemplate(t); err != nil {
+			return fmt.Errorf("template: %w", err)
+		}
+	}
+	return nil
+}
+
+// nameTemplate returns the parsed Template, and whether it needs ":udp" appended to the names of
+// UDP ports.  Configs that weren't unmarshaled parse and check it every time.
+func (n *NamingConfig) nameTemplate() (*template.Template, bool, error) {
+	if n.template != nil {
+		return n.template, n.udpSuffix, nil
+	}
+	t, err := parseNameTemplate(n.Template)
+	if err != nil {
+		return nil, false, err
+	}
+	udpSuffix, _ := checkTemplate(t)
+	return t, udpSuffix, nil
+}
+
+// baseName returns the name of the cluster for a port, before it is prefixed and passed through
+// Apply.
+func (n *NamingConfig) baseName(d *TemplateData) string {
+	var suffix string
+	if d.Protocol == "udp" {
+		suffix = ":udp"
+	}
+	if n == nil || n.Template == "" {
+		return fmt.Sprintf("%s:%s:%s%s", d.Namespace, d.Name, d.PortName, suffix)
+	}
+	t, udpSuffix, err := n.nameTemplate()
+	var name string
+	if err == nil {
+		name, err = executeTemplate(t, d)
+	}
+	if err != nil || name == "" {
+		// Validate rules this out for configs that were loaded, so this is a bug.
+		zap.L().Error("problem executing naming template; using the default name", zap.Any("port", d), zap.Error(err))
+		return fmt.Sprintf("%s:%s:%s%s", d.Namespace, d.Name, d.PortName, suffix)
+	}
+	if udpSuffix {
+		name += suffix
+	}
+	return name
+}
+
+// isStatSafe returns true if r can appear in a sanitized cluster name.
+func isStatSafe(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == ':' || r == '-'
+}
+
+// clusterPrefix returns the prefix of the names of clusters generated from services.
+func (n *NamingConfig) clusterPrefix() string {
+	if n == nil {
+		return ""
+	}
+	return n.prefix
+}
+
+// Apply returns the stat-safe version of name.
+func (n *NamingConfig) Apply(name string) string {
+	if n == nil || name == "" {
+		return name
+	}
+	full := name
+	if n.Sanitize {
+		name = strings.Map(func(r rune) rune {
+			if isStatSafe(r) {
+				return r
+			}
+			return '_'
+		}, name)
+	}
+	if n.MaxLength > 0 && len(name) > n.MaxLength {
+		// Hash the original name, not the sanitized one, since sanitization can map two
+		// different names to the same string.
+		h := fnv.New32a()
+		h.Write([]byte(full))
+		// Cut on a rune boundary, so that an unsanitized name remains valid UTF-8.
+		cut := n.MaxLength - hashSuffixLength
+		for cut > 0 && !utf8.RuneStart(name[cut]) {
+			cut--
+		}
+		name = fmt.Sprintf("%s-%08x", name[:cut], h.Sum32())
+	}
+	return name
+}
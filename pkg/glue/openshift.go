@@ -0,0 +1,247 @@
+package glue
+
+import (
+	"fmt"
+	"sort"
+
+	envoy_config_route_v3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/jrockway/ekglue/pkg/cds"
+	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// DefaultOpenShiftRouteConfigName is the default name of the route configuration generated from
+// OpenShift Routes.
+const DefaultOpenShiftRouteConfigName = "openshift_routes"
+
+// OpenShiftRouteConfig configures translation of OpenShift Route objects into a single Envoy route
+// configuration, so that edge Envoys can share OpenShift's routing definitions.  Each Route's
+// backends are the clusters that ekglue generates for the referenced services.
+//
+// OpenShift Routes refer to a target port, which is a port on the pods, not on the service.  ekglue
+// assumes that a named target port has the same name as the service port, and that a numbered
+// target port is an unnamed service port with the same number.  Routes without a target port are
+// skipped.
+type OpenShiftRouteConfig struct {
+	// RouteConfigName names the generated route configuration.  It defaults to
+	// DefaultOpenShiftRouteConfigName.
+	RouteConfigName string `json:"route_config_name"`
+	// ListenerPort, if non-zero, additionally generates a listener (with the same name as the
+	// route configuration) that serves the routes on this port.
+	ListenerPort uint32 `json:"listener_port"`
+	// DestinationMetadata, if true, records the backend services of each route in the route's
+	// metadata (under DestinationMetadataNamespace) and tracing tags, so that access logs and
+	// traces identify the Kubernetes destination.
+	DestinationMetadata bool `json:"destination_metadata"`
+	// RequestTimeout, if set, is the timeout of every generated route, like "30s"; "0s" disables
+	// it.  A Route's RequestTimeoutAnnotation overrides it for that Route.  Without either,
+	// Envoy's default applies.
+	RequestTimeout *Duration `json:"request_timeout"`
+
+	naming    *NamingConfig    // from Config.Naming
+	allowlist []*AllowlistRule // from Config.Allowlist
+}
+
+// routeConfigName returns the name of the route configuration.
+func (c *OpenShiftRouteConfig) routeConfigName() string {
+	if c.RouteConfigName == "" {
+		return DefaultOpenShiftRouteConfigName
+	}
+	return c.RouteConfigName
+}
+
+// openShiftBackend is a service that an OpenShift Route sends traffic to.
+type openShiftBackend struct {
+	name   string
+	weight int64
+}
+
+// openShiftRoute is the subset of an OpenShift Route that we translate.
+type openShiftRoute struct {
+	key, namespace, host, path string
+	portName                   string
+	portNumber                 int32
+	backends                   []openShiftBackend
+	annotations                map[string]string
+}
+
+// parseOpenShiftRoute extracts the fields we need from an unstructured Route.
+func parseOpenShiftRoute(obj interface{}) (*openShiftRoute, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("got non-unstructured object %#v", obj)
+	}
+	r := &openShiftRoute{
+		key:         u.GetNamespace() + "/" + u.GetName(),
+		namespace:   u.GetNamespace(),
+		annotations: u.GetAnnotations(),
+	}
+	r.host, _, _ = unstructured.NestedString(u.Object, "spec", "host")
+	r.path, _, _ = unstructured.NestedString(u.Object, "spec", "path")
+	switch port, _, _ := unstructured.NestedFieldNoCopy(u.Object, "spec", "port", "targetPort"); p := port.(type) {
+	case string:
+		r.portName = p
+	case int64:
+		r.portNumber = int32(p)
+	case float64:
+		r.portNumber = int32(p)
+	}
+	backend := func(m map[string]interface{}) {
+		name, _, _ := unstructured.NestedString(m, "name")
+		weight, ok, _ := unstructured.NestedInt64(m, "weight")
+		if !ok {
+			weight = 100
+		}
+		if name != "" {
+			r.backends = append(r.backends, openShiftBackend{name: name, weight: weight})
+		}
+	}
+	if to, ok, _ := unstructured.NestedMap(u.Object, "spec", "to"); ok {
+		backend(to)
+	}
+	alts, _, _ := unstructured.NestedSlice(u.Object, "spec", "alternateBackends")
+	for _, raw := range alts {
+		if m, ok := raw.(map[string]interface{}); ok {
+			backend(m)
+		}
+	}
+	return r, nil
+}
+
+// route translates r into an Envoy route, or returns nil if r can't be translated.
+func (c *OpenShiftRouteConfig) route(r *openShiftRoute) *envoy_config_route_v3.Route {
+	if r.portName == "" && r.portNumber == 0 {
+		zap.L().Warn("skipping openshift route without a target port", zap.String("route", r.key))
+		return nil
+	}
+	path := r.path
+	if path == "" {
+		path = "/"
+	}
+	result := &envoy_config_route_v3.Route{
+		Name: r.key,
+		Match: &envoy_config_route_v3.RouteMatch{
+			PathSpecifier: &envoy_config_route_v3.RouteMatch_Prefix{Prefix: path},
+		},
+	}
+	var clusters []*envoy_config_route_v3.WeightedCluster_ClusterWeight
+	var services []string
+	var targets []allowlistTarget
+	for _, b := range r.backends {
+		if b.weight <= 0 {
+			continue
+		}
+		services = append(services, b.name)
+		name, _ := c.naming.nameCluster(r.namespace, b.name, r.portName, r.portNumber, v1.ProtocolTCP)
+		targets = append(targets, allowlistTarget{r.namespace, name, r.portName, r.portNumber})
+		clusters = append(clusters, &envoy_config_route_v3.WeightedCluster_ClusterWeight{
+			Name:   name,
+			Weight: wrapperspb.UInt32(uint32(b.weight)),
+		})
+	}
+	switch len(clusters) {
+	case 0:
+		// OpenShift returns 503 when every backend has zero weight.
+		result.Action = &envoy_config_route_v3.Route_DirectResponse{
+			DirectResponse: &envoy_config_route_v3.DirectResponseAction{Status: 503},
+		}
+	case 1:
+		result.Action = &envoy_config_route_v3.Route_Route{
+			Route: &envoy_config_route_v3.RouteAction{
+				ClusterSpecifier: &envoy_config_route_v3.RouteAction_Cluster{Cluster: clusters[0].GetName()},
+				Timeout:          requestTimeout(r.key, r.annotations, c.RequestTimeout),
+			},
+		}
+	default:
+		result.Action = &envoy_config_route_v3.Route_Route{
+			Route: &envoy_config_route_v3.RouteAction{
+				ClusterSpecifier: &envoy_config_route_v3.RouteAction_WeightedClusters{
+					WeightedClusters: &envoy_config_route_v3.WeightedCluster{Clusters: clusters},
+				},
+				Timeout: requestTimeout(r.key, r.annotations, c.RequestTimeout),
+			},
+		}
+	}
+	if c.DestinationMetadata && len(services) > 0 {
+		setDestination(result, r.namespace, services)
+	}
+	if md := allowlistMetadata(allowedSources(c.allowlist, targets...)); md != nil {
+		setFilterMetadata(&result.Metadata, AllowlistMetadataNamespace, md)
+	}
+	return result
+}
+
+// RouteConfiguration translates the provided OpenShift Routes into a route configuration with one
+// virtual host per hostname.  Within a host, longer paths are matched first.
+func (c *OpenShiftRouteConfig) RouteConfiguration(objs []interface{}) (*envoy_config_route_v3.RouteConfiguration, error) {
+	var routes []*openShiftRoute
+	for _, obj := range objs {
+		r, err := parseOpenShiftRoute(obj)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, r)
+	}
+	return c.routeConfiguration(routes), nil
+}
+
+func (c *OpenShiftRouteConfig) routeConfiguration(routes []*openShiftRoute) *envoy_config_route_v3.RouteConfiguration {
+	sort.Slice(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if a.host != b.host {
+			return a.host < b.host
+		}
+		if len(a.path) != len(b.path) {
+			return len(a.path) > len(b.path)
+		}
+		return a.key < b.key
+	})
+	result := &envoy_config_route_v3.RouteConfiguration{Name: c.routeConfigName()}
+	var vhost *envoy_config_route_v3.VirtualHost
+	for _, r := range routes {
+		if r.host == "" {
+			zap.L().Warn("skipping openshift route without a host", zap.String("route", r.key))
+			continue
+		}
+		route := c.route(r)
+		if route == nil {
+			continue
+		}
+		if vhost == nil || vhost.GetName() != r.host {
+			vhost = &envoy_config_route_v3.VirtualHost{Name: r.host, Domains: []string{r.host}}
+			result.VirtualHosts = append(result.VirtualHosts, vhost)
+		}
+		vhost.Routes = append(vhost.Routes, route)
+	}
+	return result
+}
+
+// OpenShiftRouteStore is a cache.Store that receives OpenShift Routes (as
+// *unstructured.Unstructured) and keeps the generated route configuration up to date on the xDS
+// server.
+type OpenShiftRouteStore struct {
+	*routeTable[*openShiftRoute]
+	cfg *OpenShiftRouteConfig // protected by the route table's lock
+}
+
+// Store returns a cache.Store that allows a Kubernetes reflector to sync OpenShift Route changes to
+// an RDS server.
+func (c *OpenShiftRouteConfig) Store(s *cds.Server) *OpenShiftRouteStore {
+	rs := &OpenShiftRouteStore{cfg: c}
+	rs.routeTable = newRouteTable(s, "openshift route", "openshift routes", func(obj interface{}) (string, *openShiftRoute, error) {
+		r, err := parseOpenShiftRoute(obj)
+		if err != nil {
+			return "", nil, err
+		}
+		return r.key, r, nil
+	}, rs.generate)
+	return rs
+}
+
+// generate returns the route configuration generated from routes.  You must hold the lock.
+func (rs *OpenShiftRouteStore) generate(routes map[string]*openShiftRoute) (*envoy_config_route_v3.RouteConfiguration, uint32) {
+	return rs.cfg.routeConfiguration(maps.Values(routes)), rs.cfg.ListenerPort
+}
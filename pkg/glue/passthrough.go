@@ -0,0 +1,208 @@
+package glue
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_config_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	envoy_extensions_filters_listener_tls_inspector_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/listener/tls_inspector/v3"
+	envoy_extensions_filters_network_tcp_proxy_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/anypb"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// TLSPassthroughAnnotation is a comma-separated list of server names (SNI) that the
+	// TLS passthrough listener should forward, undecrypted, to the service.
+	TLSPassthroughAnnotation = "ekglue.io/tls-passthrough"
+	// TLSPassthroughPortAnnotation selects the service port, by name or number, that passthrough
+	// traffic is sent to.  Without it, a service's only port, its port named "https", or its port
+	// 443 is used, in that order.
+	TLSPassthroughPortAnnotation = "ekglue.io/tls-passthrough-port"
+)
+
+// DefaultTLSPassthroughListenerName is the default name of the TLS passthrough listener.
+const DefaultTLSPassthroughListenerName = "tls-passthrough"
+
+// TLSPassthroughConfig configures a listener that inspects the SNI of incoming TLS connections and
+// proxies the raw connection to the cluster of the service that claims that name with the
+// TLSPassthroughAnnotation.  This lets an edge Envoy route TLS to backends that terminate it
+// themselves.
+type TLSPassthroughConfig struct {
+	// ListenerName is the name of the generated listener; it defaults to
+	// DefaultTLSPassthroughListenerName.
+	ListenerName string `json:"listener_name"`
+	// Port is the port that the listener listens on.  It is required.
+	Port uint32 `json:"port"`
+}
+
+func (t *TLSPassthroughConfig) UnmarshalJSON(b []byte) error {
+	tmp := struct {
+		ListenerName string `json:"listener_name"`
+		Port         uint32 `json:"port"`
+	}{}
+	if err := json.Unmarshal(b, &tmp); err != nil {
+		return fmt.Errorf("TLSPassthroughConfig: unmarshal into temporary structure: %w", err)
+	}
+	if tmp.Port == 0 {
+		return fmt.Errorf("TLSPassthroughConfig: port is required")
+	}
+	t.ListenerName, t.Port = tmp.ListenerName, tmp.Port
+	if t.ListenerName == "" {
+		t.ListenerName = DefaultTLSPassthroughListenerName
+	}
+	return nil
+}
+
+// name returns the name of the passthrough listener.
+func (t *TLSPassthroughConfig) name() string {
+	if t.ListenerName == "" {
+		return DefaultTLSPassthroughListenerName
+	}
+	return t.ListenerName
+}
+
+// passthroughPort returns the service port that passthrough traffic for svc should be sent to, or
+// nil if there isn't one.
+func passthroughPort(svc *v1.Service) *v1.ServicePort {
+	ports := svc.Spec.Ports
+	if want, ok := svc.GetAnnotations()[TLSPassthroughPortAnnotation]; ok {
+		for i, p := range ports {
+			if p.Name == want || strconv.Itoa(int(p.Port)) == want {
+				return &ports[i]
+			}
+		}
+		return nil
+	}
+	if len(ports) == 1 {
+		return &ports[0]
+	}
+	for i, p := range ports {
+		if p.Name == "https" {
+			return &ports[i]
+		}
+	}
+	for i, p := range ports {
+		if p.Port == 443 {
+			return &ports[i]
+		}
+	}
+	return nil
+}
+
+// filterChain returns the filter chain that forwards svc's passthrough server names to one of the
+// provided clusters, or nil if svc doesn't ask for passthrough.
+func (t *TLSPassthroughConfig) filterChain(svc *v1.Service, clusters []*envoy_config_cluster_v3.Cluster, ports map[*envoy_config_cluster_v3.Cluster]*v1.ServicePort) (*envoy_config_listener_v3.FilterChain, error) {
+	if t == nil {
+		return nil, nil
+	}
+	var names []string
+	for _, n := range strings.Split(svc.GetAnnotations()[TLSPassthroughAnnotation], ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			names = append(names, strings.ToLower(n))
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	want := passthroughPort(svc)
+	if want == nil {
+		return nil, fmt.Errorf("service %s: no port for tls passthrough", serviceKey(svc))
+	}
+	var cluster string
+	for _, cl := range clusters {
+		if p := ports[cl]; p != nil && p.Name == want.Name && p.Port == want.Port {
+			cluster = cl.GetName()
+			break
+		}
+	}
+	if cluster == "" {
+		return nil, fmt.Errorf("service %s: no cluster for port %d", serviceKey(svc), want.Port)
+	}
+	proxy, err := anypb.New(&envoy_extensions_filters_network_tcp_proxy_v3.TcpProxy{
+		StatPrefix:       strings.ReplaceAll(cluster, ".", "_"),
+		ClusterSpecifier: &envoy_extensions_filters_network_tcp_proxy_v3.TcpProxy_Cluster{Cluster: cluster},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshal tcp proxy: %w", err)
+	}
+	return &envoy_config_listener_v3.FilterChain{
+		Name:             serviceKey(svc).String(),
+		FilterChainMatch: &envoy_config_listener_v3.FilterChainMatch{ServerNames: names},
+		Filters: []*envoy_config_listener_v3.Filter{{
+			Name:       "envoy.filters.network.tcp_proxy",
+			ConfigType: &envoy_config_listener_v3.Filter_TypedConfig{TypedConfig: proxy},
+		}},
+	}, nil
+}
+
+// listener returns the passthrough listener containing the provided filter chains, or nil if there
+// are none.  Chains are ordered by the age of the service they came from, looked up in services;
+// if two services claim the same server name, the older one keeps it, like CollisionPreferFirst.
+func (t *TLSPassthroughConfig) listener(chains map[types.NamespacedName]*envoy_config_listener_v3.FilterChain, services map[types.NamespacedName]*v1.Service) (*envoy_config_listener_v3.Listener, error) {
+	svcs := make([]*v1.Service, 0, len(chains))
+	for k := range chains {
+		svc, ok := services[k]
+		if !ok {
+			svc = &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: k.Namespace, Name: k.Name}}
+		}
+		svcs = append(svcs, svc)
+	}
+	sortServicesByAge(svcs)
+	claimed := make(map[string]types.NamespacedName)
+	var result []*envoy_config_listener_v3.FilterChain
+	for _, svc := range svcs {
+		k := serviceKey(svc)
+		fc := chains[k]
+		var names []string
+		for _, n := range fc.GetFilterChainMatch().GetServerNames() {
+			if owner, ok := claimed[n]; ok {
+				zap.L().Warn("tls passthrough server name claimed by multiple services", zap.String("server_name", n), zap.Stringer("owner", owner), zap.Stringer("service", k))
+				continue
+			}
+			claimed[n] = k
+			names = append(names, n)
+		}
+		if len(names) == 0 {
+			continue
+		}
+		if len(names) != len(fc.GetFilterChainMatch().GetServerNames()) {
+			fc = &envoy_config_listener_v3.FilterChain{
+				Name:             fc.GetName(),
+				FilterChainMatch: &envoy_config_listener_v3.FilterChainMatch{ServerNames: names},
+				Filters:          fc.GetFilters(),
+			}
+		}
+		result = append(result, fc)
+	}
+	if len(result) == 0 {
+		return nil, nil
+	}
+	inspector, err := anypb.New(&envoy_extensions_filters_listener_tls_inspector_v3.TlsInspector{})
+	if err != nil {
+		return nil, fmt.Errorf("marshal tls inspector: %w", err)
+	}
+	return &envoy_config_listener_v3.Listener{
+		Name: t.name(),
+		Address: &envoy_config_core_v3.Address{
+			Address: &envoy_config_core_v3.Address_SocketAddress{
+				SocketAddress: &envoy_config_core_v3.SocketAddress{
+					Address:       "0.0.0.0",
+					PortSpecifier: &envoy_config_core_v3.SocketAddress_PortValue{PortValue: t.Port},
+				},
+			},
+		},
+		ListenerFilters: []*envoy_config_listener_v3.ListenerFilter{{
+			Name:       "envoy.filters.listener.tls_inspector",
+			ConfigType: &envoy_config_listener_v3.ListenerFilter_TypedConfig{TypedConfig: inspector},
+		}},
+		FilterChains: result,
+	}, nil
+}
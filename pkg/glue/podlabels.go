@@ -0,0 +1,53 @@
+package glue
+
+import (
+	"fmt"
+	"strings"
+
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"google.golang.org/protobuf/types/known/structpb"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// LbMetadataNamespace is the filter metadata namespace that Envoy's subset load balancer selects
+// endpoints by; see EndpointConfig.PodLabelMetadata.
+const LbMetadataNamespace = "envoy.lb"
+
+// validatePodLabelMetadata checks that every key in keys is a valid label key.
+func validatePodLabelMetadata(keys []string) error {
+	seen := make(map[string]struct{})
+	for _, key := range keys {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("label %q: %s", key, strings.Join(errs, "; "))
+		}
+		if _, ok := seen[key]; ok {
+			return fmt.Errorf("duplicate label %q", key)
+		}
+		seen[key] = struct{}{}
+	}
+	return nil
+}
+
+// addPodLabelMetadata copies the labels in PodLabelMetadata, and those that subsets are selected
+// by, from the pod behind ep to the metadata of lbe, under LbMetadataNamespace.
+func (c *EndpointConfig) addPodLabelMetadata(lbe *envoy_config_endpoint_v3.LbEndpoint, ep discoveryv1.Endpoint) {
+	if len(c.PodLabelMetadata) == 0 && len(c.subsetLabels) == 0 {
+		return
+	}
+	pod, ok := endpointPod(c.pods, ep.TargetRef)
+	if !ok {
+		return
+	}
+	keys := append(append([]string{}, c.PodLabelMetadata...), c.subsetLabels...)
+	fields := make(map[string]*structpb.Value)
+	for _, key := range keys {
+		if value, ok := pod.GetLabels()[key]; ok {
+			fields[key] = structpb.NewStringValue(value)
+		}
+	}
+	if len(fields) == 0 {
+		return
+	}
+	setFilterMetadata(&lbe.Metadata, LbMetadataNamespace, &structpb.Struct{Fields: fields})
+}
@@ -0,0 +1,57 @@
+package glue
+
+import (
+	"runtime/debug"
+	"time"
+
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"google.golang.org/protobuf/types/known/structpb"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ProvenanceMetadataNamespace is the filter metadata namespace that provenance information is
+// stored under, when Config.Provenance is enabled.
+const ProvenanceMetadataNamespace = "ekglue.provenance"
+
+// Version identifies the build of ekglue, for provenance metadata.  It is the VCS revision the
+// binary was built from, if known, or the module version otherwise.
+var Version = buildVersion()
+
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" {
+			return s.Value
+		}
+	}
+	return info.Main.Version
+}
+
+// provenance returns provenance metadata for a resource generated from obj, of the provided kind
+// ("Service", "EndpointSlice"), at time now.
+func provenance(kind string, obj metav1.Object, now time.Time) *structpb.Struct {
+	return &structpb.Struct{Fields: map[string]*structpb.Value{
+		"kind":             structpb.NewStringValue(kind),
+		"namespace":        structpb.NewStringValue(obj.GetNamespace()),
+		"name":             structpb.NewStringValue(obj.GetName()),
+		"uid":              structpb.NewStringValue(string(obj.GetUID())),
+		"resource_version": structpb.NewStringValue(obj.GetResourceVersion()),
+		"ekglue_version":   structpb.NewStringValue(Version),
+		"generated_at":     structpb.NewStringValue(now.UTC().Format(time.RFC3339)),
+	}}
+}
+
+// setFilterMetadata sets the filter metadata namespace ns of *md to s, creating *md if necessary
+// and leaving other namespaces alone.
+func setFilterMetadata(md **envoy_config_core_v3.Metadata, ns string, s *structpb.Struct) {
+	if *md == nil {
+		*md = new(envoy_config_core_v3.Metadata)
+	}
+	if (*md).FilterMetadata == nil {
+		(*md).FilterMetadata = make(map[string]*structpb.Struct)
+	}
+	(*md).FilterMetadata[ns] = s
+}
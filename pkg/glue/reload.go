@@ -0,0 +1,306 @@
+package glue
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	envoy_config_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	"github.com/jrockway/ekglue/pkg/cds"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var configReloads = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "ekglue_config_reloads",
+		Help: "A count of attempts to apply a changed config file, by result.",
+	},
+	[]string{"result"},
+)
+
+// Reconfigure regenerates every cluster, and the gRPC and templated listeners and routes, from the
+// services received so far, with cfg instead of the config the store was created with.  If the
+// regenerated clusters are rejected, including any that are invalid but weren't before, the old
+// config stays in effect.
+func (cs *ClusterStore) Reconfigure(ctx context.Context, cfg *ClusterConfig) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	old := cs.cfg
+	// The pod store is filled by a watch that was started with the old config.
+	cfg.pods = old.pods
+	cs.cfg = cfg
+	if err := cs.replace(ctx, maps.Values(cs.services), true); err != nil {
+		cs.cfg = old
+		return fmt.Errorf("reconfigure services: %w", err)
+	}
+	// replace only replaces the kinds of resources that the new config generates; delete the
+	// kinds that only the old config did.
+	if cfg.GRPC == nil {
+		for _, names := range cs.grpcNames {
+			for _, name := range names {
+				cs.s.DeleteListener(ctx, name)
+				cs.s.DeleteRoute(ctx, name)
+			}
+		}
+		cs.grpcNames = make(map[types.NamespacedName][]string)
+	}
+	if len(cfg.Listeners) == 0 {
+		for _, names := range cs.listenerNames {
+			for _, name := range names {
+				cs.s.DeleteListener(ctx, name)
+			}
+		}
+		cs.listenerNames = make(map[types.NamespacedName][]string)
+	}
+	if cfg.TLSPassthrough == nil && old.TLSPassthrough != nil {
+		cs.s.DeleteListener(ctx, old.TLSPassthrough.name())
+		cs.passthrough = make(map[types.NamespacedName]*envoy_config_listener_v3.FilterChain)
+	}
+	return nil
+}
+
+// Reconfigure regenerates every load assignment from the EndpointSlices received so far, with cfg
+// instead of the config the store was created with.
+func (s *EndpointStore) Reconfigure(ctx context.Context, cfg *EndpointConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.cfg
+	// The pod and identity stores are filled by watches that were started with the old config.
+	cfg.pods, cfg.identities, cfg.loads = old.pods, old.identities, old.loads
+	s.cfg = cfg
+	var endpoints []*discoveryv1.EndpointSlice
+	for _, svcESs := range s.serverESs {
+		endpoints = append(endpoints, maps.Values(svcESs)...)
+	}
+	if err := s.replace(ctx, endpoints); err != nil {
+		s.cfg = old
+		return fmt.Errorf("reconfigure endpoints: %w", err)
+	}
+	return nil
+}
+
+// retireRDS deletes the route configuration and listener that an old Ingress or OpenShift Route
+// config generated, but a new one doesn't.  The listener is named after the route configuration.
+func retireRDS(ctx context.Context, s *cds.Server, oldName string, oldPort uint32, newName string, newPort uint32) {
+	if oldName != newName {
+		s.DeleteRoute(ctx, oldName)
+	}
+	if oldPort != 0 && (oldName != newName || newPort == 0) {
+		s.DeleteListener(ctx, oldName)
+	}
+}
+
+// Reconfigure regenerates the route configuration from the Ingresses received so far, with cfg
+// instead of the config the store was created with.
+func (is *IngressStore) Reconfigure(ctx context.Context, cfg *IngressConfig) error {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	old := is.cfg
+	is.cfg = cfg
+	if err := is.push(ctx); err != nil {
+		is.cfg = old
+		return fmt.Errorf("reconfigure ingresses: %w", err)
+	}
+	retireRDS(ctx, is.s, old.routeConfigName(), old.ListenerPort, cfg.routeConfigName(), cfg.ListenerPort)
+	return nil
+}
+
+// Reconfigure regenerates the route configuration from the Routes received so far, with cfg
+// instead of the config the store was created with.
+func (rs *OpenShiftRouteStore) Reconfigure(ctx context.Context, cfg *OpenShiftRouteConfig) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	old := rs.cfg
+	rs.cfg = cfg
+	if err := rs.push(ctx); err != nil {
+		rs.cfg = old
+		return fmt.Errorf("reconfigure openshift routes: %w", err)
+	}
+	retireRDS(ctx, rs.s, old.routeConfigName(), old.ListenerPort, cfg.routeConfigName(), cfg.ListenerPort)
+	return nil
+}
+
+// Stores are the stores that translate Kubernetes objects with a Config, so that a changed config
+// can be applied to all of them together.  Nil stores are skipped.
+type Stores struct {
+	Clusters        *ClusterStore
+	Endpoints       *EndpointStore
+	Ingresses       *IngressStore
+	OpenShiftRoutes *OpenShiftRouteStore
+	// Static serves the static clusters and load assignments; see AddStatic.
+	Static *StaticStore
+	// Remotes are the stores of additional Kubernetes clusters, by the prefix of the names
+	// generated from them; see AddRemote.
+	Remotes map[string]*Stores
+}
+
+// Reconfigure regenerates every resource from the objects that the stores have already received,
+// with cfg, so that config changes take effect without restarting ekglue and dropping every xDS
+// stream.  Clusters are regenerated first, since Envoy waits for the endpoints of a new cluster
+// before using it, but forgets a deleted cluster right away; if the new clusters are rejected,
+// nothing changes, including the static resources.  Changes that RestartRequired reports are not
+// applied.
+func (s *Stores) Reconfigure(ctx context.Context, cfg *Config) error {
+	// Static resources are replaced first, so that generated resources whose names stop being
+	// static are generated again.
+	var oldStatic *StaticConfig
+	if s.Static != nil {
+		oldStatic = s.Static.config()
+		if err := s.Static.Reconfigure(ctx, cfg.Static); err != nil {
+			return err
+		}
+	}
+	if s.Clusters != nil && cfg.ClusterConfig != nil {
+		if err := s.Clusters.Reconfigure(ctx, cfg.ClusterConfig); err != nil {
+			if s.Static != nil {
+				if rerr := s.restoreStatic(ctx, oldStatic); rerr != nil {
+					return errors.Join(err, fmt.Errorf("restore static resources: %w", rerr))
+				}
+			}
+			return err
+		}
+	}
+	// The remaining stores are independent of each other, so one failing shouldn't stop the
+	// rest from being updated.
+	var errs []error
+	if s.Endpoints != nil && cfg.EndpointConfig != nil {
+		errs = append(errs, s.Endpoints.Reconfigure(ctx, cfg.EndpointConfig))
+	}
+	if s.OpenShiftRoutes != nil && cfg.OpenShiftRoutes != nil {
+		errs = append(errs, s.OpenShiftRoutes.Reconfigure(ctx, cfg.OpenShiftRoutes))
+	}
+	if s.Ingresses != nil && cfg.Ingresses != nil {
+		errs = append(errs, s.Ingresses.Reconfigure(ctx, cfg.Ingresses))
+	}
+	prefixes := maps.Keys(s.Remotes)
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		rc, err := cfg.ForCluster(prefix)
+		if err == nil {
+			err = s.Remotes[prefix].Reconfigure(ctx, rc)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cluster %q: %w", prefix, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// restoreStatic serves the static resources of old again after a rejected Reconfigure, and
+// regenerates the clusters and load assignments whose names the rejected static resources took.
+func (s *Stores) restoreStatic(ctx context.Context, old *StaticConfig) error {
+	if err := s.Static.Reconfigure(ctx, old); err != nil {
+		return err
+	}
+	var errs []error
+	if s.Clusters != nil {
+		s.Clusters.mu.Lock()
+		cfg := s.Clusters.cfg
+		s.Clusters.mu.Unlock()
+		errs = append(errs, s.Clusters.Reconfigure(ctx, cfg))
+	}
+	if s.Endpoints != nil {
+		s.Endpoints.mu.Lock()
+		cfg := s.Endpoints.cfg
+		s.Endpoints.mu.Unlock()
+		errs = append(errs, s.Endpoints.Reconfigure(ctx, cfg))
+	}
+	return errors.Join(errs...)
+}
+
+// RestartRequired returns the config sections whose changes from c to next can't be applied by
+// Reconfigure, because they determine what is watched or were applied to the xDS server at
+// startup.
+func (c *Config) RestartRequired(next *Config) []string {
+	var result []string
+	if !reflect.DeepEqual(c.Watch, next.Watch) {
+		result = append(result, "watch")
+	}
+	if !reflect.DeepEqual(c.Validation, next.Validation) {
+		result = append(result, "validation")
+	}
+	if !reflect.DeepEqual(c.Scoping, next.Scoping) {
+		result = append(result, "scoping")
+	}
+	var oldLimits, newLimits LimitsConfig
+	if c.Limits != nil {
+		oldLimits = *c.Limits
+	}
+	if next.Limits != nil {
+		newLimits = *next.Limits
+	}
+	if oldLimits.MaxClusters != newLimits.MaxClusters || oldLimits.MaxLoadAssignments != newLimits.MaxLoadAssignments {
+		result = append(result, "limits")
+	}
+	if (c.OpenShiftRoutes == nil) != (next.OpenShiftRoutes == nil) {
+		result = append(result, "openshift_routes")
+	}
+	if (c.Ingresses == nil) != (next.Ingresses == nil) {
+		result = append(result, "ingresses")
+	}
+	if !reflect.DeepEqual(c.EnvoyClusters, next.EnvoyClusters) {
+		result = append(result, "envoy_clusters")
+	}
+	if oldEC, newEC := c.EndpointConfig, next.EndpointConfig; oldEC != nil && newEC != nil {
+		if oldEC.CiliumIdentityMetadata != newEC.CiliumIdentityMetadata {
+			result = append(result, "endpoint_config.cilium_identity_metadata")
+		}
+		if (oldEC.LoadWeights == nil) != (newEC.LoadWeights == nil) || oldEC.LoadWeights.ReportInterval() != newEC.LoadWeights.ReportInterval() {
+			result = append(result, "endpoint_config.load_weights")
+		}
+		needsPods := func(cfg *Config) bool { return len(cfg.Tracks) > 0 || cfg.EndpointConfig.needsAllPods() }
+		if needsPods(c) != needsPods(next) || c.PodLabelSelector() != next.PodLabelSelector() {
+			result = append(result, "pods")
+		}
+	}
+	return result
+}
+
+// WatchConfigFile checks filename, and the files it includes, every interval, and calls apply with
+// the new config whenever it changes, until the context is done.  A config that fails to load is
+// logged and skipped, so a typo leaves the running config in place.  running is the config that
+// is in effect, as returned by LoadConfig.
+func WatchConfigFile(ctx context.Context, filename string, running *Config, interval time.Duration, apply func(*Config) error) error {
+	last := running.source
+	var lastErr string
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+		cfg, err := LoadConfig(filename)
+		if err != nil {
+			// The file stays broken until someone fixes it; only log each problem once.
+			if err.Error() != lastErr {
+				configReloads.WithLabelValues("invalid").Inc()
+				zap.L().Error("ignoring invalid config file", zap.String("filename", filename), zap.Error(err))
+				lastErr = err.Error()
+			}
+			continue
+		}
+		lastErr = ""
+		if bytes.Equal(cfg.source, last) {
+			continue
+		}
+		last = cfg.source
+		if err := apply(cfg); err != nil {
+			configReloads.WithLabelValues("rejected").Inc()
+			zap.L().Error("problem applying config file", zap.String("filename", filename), zap.Error(err))
+			continue
+		}
+		configReloads.WithLabelValues("applied").Inc()
+		zap.L().Info("applied config file", zap.String("filename", filename))
+	}
+}
@@ -0,0 +1,42 @@
+package glue
+
+import (
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	"google.golang.org/protobuf/proto"
+)
+
+// mergeCluster merges src into dst like proto.Merge, except that circuit breaker thresholds in src
+// are merged into the thresholds in dst with the same priority instead of being appended to them,
+// so that an override can change one limit without duplicating the thresholds of a priority.
+func mergeCluster(dst, src *envoy_config_cluster_v3.Cluster) {
+	old, changes := dst.GetCircuitBreakers(), src.GetCircuitBreakers()
+	if old == nil || changes == nil {
+		proto.Merge(dst, src)
+		return
+	}
+	thresholds := mergeThresholds(old.GetThresholds(), changes.GetThresholds())
+	perHost := mergeThresholds(old.GetPerHostThresholds(), changes.GetPerHostThresholds())
+	proto.Merge(dst, src)
+	dst.CircuitBreakers.Thresholds = thresholds
+	dst.CircuitBreakers.PerHostThresholds = perHost
+}
+
+// mergeThresholds returns a copy of dst with each threshold in src merged into the threshold in dst
+// with the same priority, or appended if dst has none.
+func mergeThresholds(dst, src []*envoy_config_cluster_v3.CircuitBreakers_Thresholds) []*envoy_config_cluster_v3.CircuitBreakers_Thresholds {
+	var result []*envoy_config_cluster_v3.CircuitBreakers_Thresholds
+	for _, t := range dst {
+		result = append(result, proto.Clone(t).(*envoy_config_cluster_v3.CircuitBreakers_Thresholds))
+	}
+next:
+	for _, s := range src {
+		for _, t := range result {
+			if t.GetPriority() == s.GetPriority() {
+				proto.Merge(t, s)
+				continue next
+			}
+		}
+		result = append(result, proto.Clone(s).(*envoy_config_cluster_v3.CircuitBreakers_Thresholds))
+	}
+	return result
+}
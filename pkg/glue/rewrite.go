@@ -0,0 +1,102 @@
+package glue
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+
+	"go.uber.org/zap"
+)
+
+// AddressRewrite rewrites the address and port of endpoints in a CIDR range before they are
+// served, for topologies where Envoy reaches pods through a NAT or gateway rather than directly.
+type AddressRewrite struct {
+	// From is the CIDR range of endpoint addresses that the rule applies to.
+	From string `json:"from"`
+	// To, if set, is a CIDR range with the same prefix length as From.  Matching addresses keep
+	// their host bits, and take their network bits from To; 10.1.2.3 rewritten from 10.1.0.0/16
+	// to 192.168.0.0/16 becomes 192.168.2.3.  A /32 (or /128) maps a single address.
+	To string `json:"to"`
+	// PortOffset is added to the port of matching endpoints.
+	PortOffset int32 `json:"port_offset"`
+
+	from, to netip.Prefix
+}
+
+func (r *AddressRewrite) UnmarshalJSON(b []byte) error {
+	type raw AddressRewrite
+	tmp := (*raw)(r)
+	if err := json.Unmarshal(b, tmp); err != nil {
+		return fmt.Errorf("AddressRewrite: %w", err)
+	}
+	var err error
+	if r.from, err = netip.ParsePrefix(r.From); err != nil {
+		return fmt.Errorf("AddressRewrite: parse from: %w", err)
+	}
+	r.from = r.from.Masked()
+	if r.To != "" {
+		if r.to, err = netip.ParsePrefix(r.To); err != nil {
+			return fmt.Errorf("AddressRewrite: parse to: %w", err)
+		}
+		r.to = r.to.Masked()
+		if r.from.Addr().Is4() != r.to.Addr().Is4() || r.from.Bits() != r.to.Bits() {
+			return fmt.Errorf("AddressRewrite: from %v and to %v must be the same address family and prefix length", r.from, r.to)
+		}
+	}
+	if r.To == "" && r.PortOffset == 0 {
+		return fmt.Errorf("AddressRewrite: rule for %v has neither to nor port_offset", r.from)
+	}
+	return nil
+}
+
+// apply rewrites addr and port according to the rule.
+func (r *AddressRewrite) apply(addr netip.Addr, port int32) (netip.Addr, int32) {
+	if r.to.IsValid() {
+		a, t := addr.AsSlice(), r.to.Addr().AsSlice()
+		for i := range a {
+			switch keep := r.to.Bits() - i*8; {
+			case keep >= 8:
+				a[i] = t[i]
+			case keep > 0:
+				m := byte(0xff << (8 - keep))
+				a[i] = t[i]&m | a[i]&^m
+			}
+		}
+		addr, _ = netip.AddrFromSlice(a)
+	}
+	return addr, port + r.PortOffset
+}
+
+// rewriteAddress applies the first rule whose From range contains addr.  Addresses that aren't IPs
+// (like hostnames) and addresses that no rule matches are returned unchanged.  ok is false if the
+// rewritten port is out of range, in which case the endpoint should be dropped.
+func rewriteAddress(rules []*AddressRewrite, addr string, port int32) (string, int32, bool) {
+	if len(rules) == 0 {
+		return addr, port, true
+	}
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return addr, port, true
+	}
+	ip = ip.Unmap()
+	for _, r := range rules {
+		if !r.from.Contains(ip) {
+			continue
+		}
+		newIP, newPort := r.apply(ip, port)
+		if newPort <= 0 || newPort > 65535 {
+			zap.L().Warn("address rewrite produced an invalid port; dropping endpoint", zap.String("address", addr), zap.Int32("port", port), zap.Int32("rewritten_port", newPort))
+			return "", 0, false
+		}
+		return newIP.String(), newPort, true
+	}
+	return addr, port, true
+}
+
+// addressRewrites returns the configured rewrite rules; it is safe to call on a nil config.
+func (c *EndpointConfig) addressRewrites() []*AddressRewrite {
+	if c == nil {
+		return nil
+	}
+	return c.AddressRewrites
+}
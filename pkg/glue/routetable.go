@@ -0,0 +1,145 @@
+package glue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	envoy_config_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	envoy_config_route_v3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/jrockway/ekglue/pkg/cds"
+	"golang.org/x/exp/maps"
+)
+
+// routeTable is a cache.Store that translates every object it receives into a single route
+// configuration, and keeps that route configuration (and the listener that serves it, if any) up
+// to date on the xDS server.  IngressStore and OpenShiftRouteStore are route tables.
+type routeTable[T any] struct {
+	s           *cds.Server
+	kind, kinds string // singular and plural names of the objects, like "ingress" and "ingresses"
+	// parse extracts the namespace/name and translatable form of a received object.
+	parse func(obj interface{}) (string, T, error)
+	// generate returns the route configuration generated from objects, and the port of the
+	// listener that serves it, or 0 for none.  It's called with the lock held.
+	generate func(objects map[string]T) (*envoy_config_route_v3.RouteConfiguration, uint32)
+
+	mu      sync.Mutex
+	objects map[string]T // by namespace/name
+}
+
+// newRouteTable returns an empty route table.
+func newRouteTable[T any](s *cds.Server, kind, kinds string, parse func(interface{}) (string, T, error), generate func(map[string]T) (*envoy_config_route_v3.RouteConfiguration, uint32)) *routeTable[T] {
+	return &routeTable[T]{
+		s:        s,
+		kind:     kind,
+		kinds:    kinds,
+		parse:    parse,
+		generate: generate,
+		objects:  make(map[string]T),
+	}
+}
+
+// push sends the current route configuration, and the listener if configured.  You must hold the
+// lock.
+func (t *routeTable[T]) push(ctx context.Context) error {
+	rc, port := t.generate(t.objects)
+	if err := t.s.AddRoutes(ctx, []*envoy_config_route_v3.RouteConfiguration{rc}); err != nil {
+		return fmt.Errorf("add routes: %w", err)
+	}
+	if port == 0 {
+		return nil
+	}
+	l, err := rdsListener(rc.GetName(), port)
+	if err != nil {
+		return fmt.Errorf("generate listener: %w", err)
+	}
+	if err := t.s.AddListeners(ctx, []*envoy_config_listener_v3.Listener{l}); err != nil {
+		return fmt.Errorf("add listeners: %w", err)
+	}
+	return nil
+}
+
+func (t *routeTable[T]) update(op string, obj interface{}, deleted bool) error {
+	ctx, c := startOp(strings.ReplaceAll(t.kinds, " ", "_"), op)
+	defer c()
+	key, v, err := t.parse(obj)
+	if err != nil {
+		logError(ctx)
+		return fmt.Errorf("%s %s: %w", op, t.kind, err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if deleted {
+		delete(t.objects, key)
+	} else {
+		t.objects[key] = v
+	}
+	if err := t.push(ctx); err != nil {
+		logError(ctx)
+		return fmt.Errorf("%s %s: %w", op, t.kind, err)
+	}
+	return nil
+}
+
+func (t *routeTable[T]) Add(obj interface{}) error {
+	return t.update("add", obj, false)
+}
+
+func (t *routeTable[T]) Update(obj interface{}) error {
+	return t.update("update", obj, false)
+}
+
+func (t *routeTable[T]) Delete(obj interface{}) error {
+	return t.update("delete", obj, true)
+}
+
+func (t *routeTable[T]) List() []interface{} {
+	return nil
+}
+
+// ListKeys returns the namespace/name of every known object.
+func (t *routeTable[T]) ListKeys() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result := maps.Keys(t.objects)
+	sort.Strings(result)
+	return result
+}
+
+func (t *routeTable[T]) Get(obj interface{}) (item interface{}, exists bool, err error) {
+	return nil, false, errors.New("routeTable.Get unimplemented")
+}
+
+func (t *routeTable[T]) GetByKey(key string) (item interface{}, exists bool, err error) {
+	return nil, false, errors.New("routeTable.GetByKey unimplemented")
+}
+
+func (t *routeTable[T]) Replace(objs []interface{}, _ string) error {
+	ctx, c := startOp(strings.ReplaceAll(t.kinds, " ", "_"), "replace")
+	defer c()
+	objects := make(map[string]T)
+	for _, obj := range objs {
+		key, v, err := t.parse(obj)
+		if err != nil {
+			logError(ctx)
+			return fmt.Errorf("replace %s: %w", t.kinds, err)
+		}
+		objects[key] = v
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.objects = objects
+	if err := t.push(ctx); err != nil {
+		logError(ctx)
+		return fmt.Errorf("replace %s: %w", t.kinds, err)
+	}
+	return nil
+}
+
+func (t *routeTable[T]) Resync() error {
+	// Nothing to do.
+	return nil
+}
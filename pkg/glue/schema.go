@@ -0,0 +1,177 @@
+package glue
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	protoMessageType = reflect.TypeOf((*proto.Message)(nil)).Elem()
+	durationType     = reflect.TypeOf(Duration(0))
+	rawMessageType   = reflect.TypeOf(json.RawMessage(nil))
+)
+
+// jsonFields returns the fields of a config struct type, by their JSON names.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	result := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		result[name] = f.Type
+	}
+	return result
+}
+
+// protoMessageName returns the full name of the protobuf message that t is, or "" if it isn't one.
+func protoMessageName(t reflect.Type) string {
+	if t.Kind() != reflect.Pointer {
+		t = reflect.PointerTo(t)
+	}
+	if !t.Implements(protoMessageType) {
+		return ""
+	}
+	return string(reflect.Zero(t).Interface().(proto.Message).ProtoReflect().Descriptor().FullName())
+}
+
+// typeSchema returns the JSON Schema of values of type t.  Protobuf messages are only described,
+// since they are parsed, strictly, by protojson.
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if name := protoMessageName(t); name != "" {
+		return map[string]interface{}{"type": "object", "description": name + ", in protobuf's JSON mapping"}
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case durationType:
+		return map[string]interface{}{"type": "string", "description": `a duration, like "30s"`}
+	case rawMessageType:
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		for name, ft := range jsonFields(t) {
+			properties[name] = typeSchema(ft)
+		}
+		return map[string]interface{}{"type": "object", "properties": properties, "additionalProperties": false}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// JSONSchema returns a JSON Schema describing the config file, for editors and linters.
+func JSONSchema() ([]byte, error) {
+	schema := typeSchema(reflect.TypeOf(Config{}))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "ekglue config"
+	schema["properties"].(map[string]interface{})[IncludeKey] = map[string]interface{}{
+		"type":  "array",
+		"items": map[string]interface{}{"type": "string"},
+	}
+	schema["patternProperties"] = map[string]interface{}{"^x-": map[string]interface{}{}}
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+// unknownFields returns the paths of the fields in v, a value decoded from JSON, that are not
+// fields of type t.  Type mismatches are left for unmarshaling to report.
+func unknownFields(v interface{}, t reflect.Type, path string) []string {
+	if protoMessageName(t) != "" {
+		return nil
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == durationType || t == rawMessageType {
+		return nil
+	}
+	var result []string
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		fields := jsonFields(t)
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			ft, ok := fields[k]
+			if !ok {
+				result = append(result, p)
+				continue
+			}
+			result = append(result, unknownFields(obj[k], ft, p)...)
+		}
+	case reflect.Slice, reflect.Array:
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, x := range list {
+			result = append(result, unknownFields(x, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case reflect.Map:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for k, x := range obj {
+			result = append(result, unknownFields(x, t.Elem(), path+"."+k)...)
+		}
+		sort.Strings(result)
+	}
+	return result
+}
+
+// checkUnknownFields returns an error naming every field of the config in js that ekglue doesn't
+// know about, which is usually a typo.  Top-level keys starting with "x-" are allowed, so that they
+// can hold YAML anchors.
+func checkUnknownFields(js []byte) error {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(js, &doc); err != nil {
+		return err
+	}
+	for k := range doc {
+		if strings.HasPrefix(k, "x-") {
+			delete(doc, k)
+		}
+	}
+	if unknown := unknownFields(doc, reflect.TypeOf(Config{}), ""); len(unknown) > 0 {
+		return fmt.Errorf("unknown fields %s; set allow_unknown_fields to ignore them", strings.Join(unknown, ", "))
+	}
+	return nil
+}
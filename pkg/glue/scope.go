@@ -0,0 +1,178 @@
+package glue
+
+import (
+	"fmt"
+	"strings"
+
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/jrockway/ekglue/pkg/cds"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// ScopeRule lets the Envoys it applies to see the clusters and load assignments generated from
+// services in certain namespaces.
+type ScopeRule struct {
+	// NamespaceFromMetadata is a key of the node's metadata, with "." separating nested fields,
+	// like "ekglue.namespace".  The rule applies to nodes whose metadata has the key, and lets
+	// them see the namespace its value names, or the namespaces a list of strings names.
+	NamespaceFromMetadata string `json:"namespace_from_metadata"`
+	// NamespaceFromLocality is "region", "zone", or "sub_zone".  The rule applies to nodes whose
+	// locality has that field, and lets them see the namespace it names.
+	NamespaceFromLocality string `json:"namespace_from_locality"`
+	// Namespaces are more namespaces that the nodes the rule applies to may see, like one that
+	// holds shared infrastructure.
+	Namespaces []string `json:"namespaces"`
+}
+
+// ScopingConfig restricts which clusters and load assignments are sent to each Envoy, based on
+// how it identifies itself, so that, for example, a sidecar only learns about the services in its
+// own namespace.  A node that no rule applies to sees everything; one that rules apply to sees
+// only what they let it see.  Clusters that weren't generated from a single service, like
+// aggregates, can't be attributed to a namespace, and are only sent to nodes that no rule applies
+// to.
+type ScopingConfig struct {
+	Rules []*ScopeRule `json:"rules"`
+}
+
+// Validate returns an error if a rule doesn't say where to find a node's namespace.
+func (c *ScopingConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	for i, r := range c.Rules {
+		switch {
+		case r.NamespaceFromMetadata == "" && r.NamespaceFromLocality == "":
+			return fmt.Errorf("scoping rule %d: one of namespace_from_metadata or namespace_from_locality is required", i)
+		case r.NamespaceFromMetadata != "" && r.NamespaceFromLocality != "":
+			return fmt.Errorf("scoping rule %d: only one of namespace_from_metadata or namespace_from_locality may be set", i)
+		}
+		switch r.NamespaceFromLocality {
+		case "", "region", "zone", "sub_zone":
+		default:
+			return fmt.Errorf("scoping rule %d: unknown locality field %q", i, r.NamespaceFromLocality)
+		}
+	}
+	return nil
+}
+
+// metadataStrings returns the string, or list of strings, at the dotted path key in md.
+func metadataStrings(md *structpb.Struct, key string) ([]string, bool) {
+	fields := strings.Split(key, ".")
+	for _, f := range fields[:len(fields)-1] {
+		md = md.GetFields()[f].GetStructValue()
+	}
+	v, ok := md.GetFields()[fields[len(fields)-1]]
+	if !ok {
+		return nil, false
+	}
+	if s, ok := v.GetKind().(*structpb.Value_StringValue); ok {
+		return []string{s.StringValue}, true
+	}
+	var result []string
+	for _, x := range v.GetListValue().GetValues() {
+		if s, ok := x.GetKind().(*structpb.Value_StringValue); ok {
+			result = append(result, s.StringValue)
+		}
+	}
+	return result, len(result) > 0
+}
+
+// namespaces returns the namespaces that node may see, or false if no rule applies to it.
+func (r *ScopeRule) namespaces(node *envoy_config_core_v3.Node) ([]string, bool) {
+	var result []string
+	if key := r.NamespaceFromMetadata; key != "" {
+		ns, ok := metadataStrings(node.GetMetadata(), key)
+		if !ok {
+			return nil, false
+		}
+		result = ns
+	} else {
+		var ns string
+		switch r.NamespaceFromLocality {
+		case "region":
+			ns = node.GetLocality().GetRegion()
+		case "zone":
+			ns = node.GetLocality().GetZone()
+		case "sub_zone":
+			ns = node.GetLocality().GetSubZone()
+		}
+		if ns == "" {
+			return nil, false
+		}
+		result = []string{ns}
+	}
+	return append(result, r.Namespaces...), true
+}
+
+// inScope returns true if node may see a resource generated from a service in namespace ns, which
+// is "" if the resource wasn't generated from a single service.
+func (c *ScopingConfig) inScope(node *envoy_config_core_v3.Node, ns string) bool {
+	scoped := false
+	for _, r := range c.Rules {
+		allowed, ok := r.namespaces(node)
+		if !ok {
+			continue
+		}
+		scoped = true
+		for _, a := range allowed {
+			if a == ns && ns != "" {
+				return true
+			}
+		}
+	}
+	return !scoped
+}
+
+// Apply scopes the clusters and load assignments that the xDS server sends to each node, using the
+// cluster stores, one per Kubernetes cluster, to find the namespace that each was generated from.
+func (c *ScopingConfig) Apply(s *cds.Server, stores ...*ClusterStore) {
+	if c == nil || len(c.Rules) == 0 {
+		return
+	}
+	scope := func(node *envoy_config_core_v3.Node, name string) bool {
+		var ns string
+		for _, cs := range stores {
+			var ok bool
+			if ns, ok = cs.clusterNamespace(name); ok {
+				break
+			}
+		}
+		return c.inScope(node, ns)
+	}
+	s.Clusters.Scope = scope
+	s.Endpoints.Scope = scope
+}
+
+// clusterNamespace returns the namespace of the service that the named cluster was generated from.
+// It doesn't need the store's lock, since the xDS server calls it with its own lock held.
+func (cs *ClusterStore) clusterNamespace(name string) (string, bool) {
+	cs.namespacesMu.Lock()
+	defer cs.namespacesMu.Unlock()
+	ns, ok := cs.namespaces[name]
+	return ns, ok
+}
+
+// setDirectory adds e to the cluster directory, or deletes the named cluster from it if e is nil.
+// You must hold the lock.
+func (cs *ClusterStore) setDirectory(name string, e *ClusterDirectoryEntry) {
+	cs.namespacesMu.Lock()
+	defer cs.namespacesMu.Unlock()
+	if e == nil {
+		delete(cs.directory, name)
+		delete(cs.namespaces, name)
+		return
+	}
+	cs.directory[name] = e
+	cs.namespaces[name] = e.Namespace
+}
+
+// replaceDirectory replaces the cluster directory.  You must hold the lock.
+func (cs *ClusterStore) replaceDirectory(directory map[string]*ClusterDirectoryEntry) {
+	namespaces := make(map[string]string, len(directory))
+	for name, e := range directory {
+		namespaces[name] = e.Namespace
+	}
+	cs.namespacesMu.Lock()
+	defer cs.namespacesMu.Unlock()
+	cs.directory, cs.namespaces = directory, namespaces
+}
@@ -0,0 +1,139 @@
+package glue
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// EnabledAnnotation is the conventional annotation for services to opt in to becoming clusters,
+// with a ServiceSelector like {annotation: ekglue.io/enabled, annotation_value: "true"} in
+// ClusterConfig.IncludeServices.
+const EnabledAnnotation = "ekglue.io/enabled"
+
+// ServiceSelector selects services by namespace, name, and annotation.  A service is selected if
+// it matches every field that is set; an empty selector selects nothing.
+type ServiceSelector struct {
+	// Namespace is a glob, like "team-*", that the service's namespace must match.  See path.Match
+	// for the syntax.
+	Namespace string `json:"namespace"`
+	// Name is a glob that the service's name must match.
+	Name string `json:"name"`
+	// NamespaceRegex is a regular expression that the service's entire namespace must match.
+	NamespaceRegex string `json:"namespace_regex"`
+	// NameRegex is a regular expression that the service's entire name must match.
+	NameRegex string `json:"name_regex"`
+	// Annotation is an annotation that the service must have.
+	Annotation string `json:"annotation"`
+	// AnnotationValue, if set, is the value that Annotation must have.
+	AnnotationValue string `json:"annotation_value"`
+
+	namespaceRegex, nameRegex *regexp.Regexp
+}
+
+func (s *ServiceSelector) UnmarshalJSON(b []byte) error {
+	tmp := struct {
+		Namespace       string `json:"namespace"`
+		Name            string `json:"name"`
+		NamespaceRegex  string `json:"namespace_regex"`
+		NameRegex       string `json:"name_regex"`
+		Annotation      string `json:"annotation"`
+		AnnotationValue string `json:"annotation_value"`
+	}{}
+	if err := json.Unmarshal(b, &tmp); err != nil {
+		return fmt.Errorf("ServiceSelector: unmarshal into temporary structure: %w", err)
+	}
+	if tmp.Namespace == "" && tmp.Name == "" && tmp.NamespaceRegex == "" && tmp.NameRegex == "" && tmp.Annotation == "" {
+		return fmt.Errorf("ServiceSelector: no namespace, name, or annotation provided")
+	}
+	if tmp.AnnotationValue != "" && tmp.Annotation == "" {
+		return fmt.Errorf("ServiceSelector: annotation_value provided without annotation")
+	}
+	for _, glob := range []string{tmp.Namespace, tmp.Name} {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("ServiceSelector: glob %q: %w", glob, err)
+		}
+	}
+	var err error
+	if s.namespaceRegex, err = compileSelectorRegex(tmp.NamespaceRegex); err != nil {
+		return fmt.Errorf("ServiceSelector: namespace_regex: %w", err)
+	}
+	if s.nameRegex, err = compileSelectorRegex(tmp.NameRegex); err != nil {
+		return fmt.Errorf("ServiceSelector: name_regex: %w", err)
+	}
+	s.Namespace, s.Name = tmp.Namespace, tmp.Name
+	s.NamespaceRegex, s.NameRegex = tmp.NamespaceRegex, tmp.NameRegex
+	s.Annotation, s.AnnotationValue = tmp.Annotation, tmp.AnnotationValue
+	return nil
+}
+
+// compileSelectorRegex compiles re so that it must match an entire string, or returns nil if re is
+// empty.
+func compileSelectorRegex(re string) (*regexp.Regexp, error) {
+	if re == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + re + ")$")
+}
+
+// matchSelectorRegex returns true if value entirely matches the regular expression re, or if re is
+// empty.  compiled is re, compiled when the selector was unmarshaled; selectors built in Go have
+// to compile it every time.
+func matchSelectorRegex(compiled *regexp.Regexp, re, value string) bool {
+	if re == "" {
+		return true
+	}
+	if compiled == nil {
+		var err error
+		if compiled, err = compileSelectorRegex(re); err != nil {
+			return false
+		}
+	}
+	return compiled.MatchString(value)
+}
+
+// Selects returns true if the selector selects svc.
+func (s *ServiceSelector) Selects(svc *v1.Service) bool {
+	if s == nil {
+		return false
+	}
+	if s.Namespace == "" && s.Name == "" && s.NamespaceRegex == "" && s.NameRegex == "" && s.Annotation == "" {
+		return false
+	}
+	if s.Namespace != "" {
+		if ok, _ := path.Match(s.Namespace, svc.GetNamespace()); !ok {
+			return false
+		}
+	}
+	if s.Name != "" {
+		if ok, _ := path.Match(s.Name, svc.GetName()); !ok {
+			return false
+		}
+	}
+	if !matchSelectorRegex(s.namespaceRegex, s.NamespaceRegex, svc.GetNamespace()) {
+		return false
+	}
+	if !matchSelectorRegex(s.nameRegex, s.NameRegex, svc.GetName()) {
+		return false
+	}
+	if s.Annotation != "" {
+		v, ok := svc.GetAnnotations()[s.Annotation]
+		if !ok || (s.AnnotationValue != "" && v != s.AnnotationValue) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectsAny returns true if any of the selectors selects svc.
+func selectsAny(selectors []*ServiceSelector, svc *v1.Service) bool {
+	for _, s := range selectors {
+		if s.Selects(svc) {
+			return true
+		}
+	}
+	return false
+}
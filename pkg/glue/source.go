@@ -0,0 +1,142 @@
+package glue
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/jrockway/ekglue/pkg/cds"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// A Source is a service discovery system other than Kubernetes that ekglue can publish clusters
+// from.
+type Source interface {
+	// Name identifies the source.  It prefixes the names of the source's clusters, so that they
+	// can't collide with clusters from Kubernetes or other sources.
+	Name() string
+	// Watch calls update with a complete snapshot of the source's services every time they
+	// change, until the context is done or an unrecoverable error occurs.
+	Watch(ctx context.Context, update func([]*SourceService) error) error
+}
+
+// SourceService is a service discovered by a Source.
+type SourceService struct {
+	// Namespace and Name identify the service within the source.
+	Namespace, Name string
+	// Endpoints are the instances of the service.
+	Endpoints []*SourceEndpoint
+}
+
+// SourceEndpoint is an instance of a SourceService.
+type SourceEndpoint struct {
+	Address string
+	Port    int32
+	// Locality is the locality of the endpoint, if known.
+	Locality *envoy_config_core_v3.Locality
+}
+
+// sourceSink translates snapshots from a Source into EDS clusters.
+type sourceSink struct {
+	cfg   *Config
+	s     *cds.Server
+	name  string
+	names map[string]struct{} // clusters published by the last snapshot
+}
+
+// clusterName returns the name of the cluster for svc.
+func (ss *sourceSink) clusterName(svc *SourceService) string {
+	return ss.cfg.Naming.Apply(fmt.Sprintf("%s:%s:%s", ss.name, svc.Namespace, svc.Name))
+}
+
+// update publishes a snapshot, deleting clusters for services that have disappeared.
+func (ss *sourceSink) update(svcs []*SourceService) error {
+	ctx, c := startOp(ss.name, "update")
+	defer c()
+
+	var clusters []*envoy_config_cluster_v3.Cluster
+	var assignments []*envoy_config_endpoint_v3.ClusterLoadAssignment
+	names := make(map[string]struct{})
+	for _, svc := range svcs {
+		name := ss.clusterName(svc)
+		cl := ss.cfg.ClusterConfig.GetBaseConfig()
+		cl.Name = name
+		// Overrides can match these clusters by cluster_name.
+		cl = ss.cfg.ClusterConfig.ApplyOverride(cl, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: svc.Namespace, Name: svc.Name}}, &v1.ServicePort{})
+		if cl == nil {
+			continue
+		}
+		clusters = append(clusters, edsCluster(cl))
+		assignments = append(assignments, sourceLoadAssignment(name, svc.Endpoints, ss.cfg.EndpointConfig.addressRewrites()))
+		names[name] = struct{}{}
+	}
+	var stale []string
+	for name := range ss.names {
+		if _, ok := names[name]; !ok {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+	// Send clusters and their endpoints together, so that no client sees a new cluster before
+	// its endpoints or loses endpoints before their cluster.
+	txn := ss.s.Begin()
+	for _, name := range stale {
+		txn.DeleteCluster(name)
+		txn.DeleteEndpoints(name)
+	}
+	txn.AddEndpoints(assignments...)
+	txn.AddClusters(clusters...)
+	if err := txn.Commit(ctx); err != nil {
+		logError(ctx)
+		return fmt.Errorf("%s: %w", ss.name, err)
+	}
+	ss.names = names
+	return nil
+}
+
+// sourceLoadAssignment builds a load assignment from a source's endpoints, grouped by locality,
+// after applying any address rewrites.
+func sourceLoadAssignment(cluster string, endpoints []*SourceEndpoint, rewrites []*AddressRewrite) *envoy_config_endpoint_v3.ClusterLoadAssignment {
+	byLocality := make(map[string]*envoy_config_endpoint_v3.LocalityLbEndpoints)
+	for _, ep := range endpoints {
+		addr, port, ok := rewriteAddress(rewrites, ep.Address, ep.Port)
+		if !ok {
+			continue
+		}
+		locality := ep.Locality
+		if locality == nil {
+			locality = new(envoy_config_core_v3.Locality)
+		}
+		key := locality.String()
+		lle, ok := byLocality[key]
+		if !ok {
+			lle = &envoy_config_endpoint_v3.LocalityLbEndpoints{Locality: locality}
+			byLocality[key] = lle
+		}
+		lle.LbEndpoints = append(lle.LbEndpoints, lbEndpoint(addr, port, envoy_config_core_v3.SocketAddress_TCP, envoy_config_core_v3.HealthStatus_HEALTHY))
+	}
+	result := &envoy_config_endpoint_v3.ClusterLoadAssignment{ClusterName: cluster}
+	for _, lle := range byLocality {
+		sort.Slice(lle.LbEndpoints, func(i, j int) bool {
+			return lle.LbEndpoints[i].String() < lle.LbEndpoints[j].String()
+		})
+		result.Endpoints = append(result.Endpoints, lle)
+	}
+	sort.Slice(result.Endpoints, func(i, j int) bool {
+		return result.Endpoints[i].GetLocality().String() < result.Endpoints[j].GetLocality().String()
+	})
+	return result
+}
+
+// RunSource publishes the services discovered by src to the xDS server as EDS clusters named
+// "<source name>:<namespace>:<service name>", until the context is done.  The clusters are built
+// from the cluster config's base and overrides.  Stores that share the server must be told to leave
+// them alone with Exclude(src.Name()+":"), or their relists delete them.
+func (c *Config) RunSource(ctx context.Context, src Source, s *cds.Server) error {
+	sink := &sourceSink{cfg: c, s: s, name: src.Name()}
+	return src.Watch(ctx, sink.update)
+}
@@ -0,0 +1,196 @@
+package glue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/jrockway/ekglue/pkg/cds"
+	"github.com/jrockway/ekglue/pkg/xds"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// StaticConfig declares clusters and load assignments that are served alongside the generated
+// ones, for the handful of upstreams that aren't in Kubernetes, so that Envoy doesn't need static
+// clusters of its own that fight with CDS.  They are served exactly as written, and their names
+// must not be the names of generated resources.  Unlike generated clusters, they are not changed
+// by cluster_config.
+type StaticConfig struct {
+	Clusters        []*envoy_config_cluster_v3.Cluster                `json:"clusters"`
+	LoadAssignments []*envoy_config_endpoint_v3.ClusterLoadAssignment `json:"load_assignments"`
+}
+
+func (c *StaticConfig) UnmarshalJSON(b []byte) error {
+	tmp := struct {
+		Clusters        []json.RawMessage `json:"clusters"`
+		LoadAssignments []json.RawMessage `json:"load_assignments"`
+	}{}
+	if err := json.Unmarshal(b, &tmp); err != nil {
+		return fmt.Errorf("StaticConfig: unmarshal into temporary structure: %w", err)
+	}
+	c.Clusters, c.LoadAssignments = nil, nil
+	for i, js := range tmp.Clusters {
+		cluster := new(envoy_config_cluster_v3.Cluster)
+		if err := protojson.Unmarshal(js, cluster); err != nil {
+			return fmt.Errorf("StaticConfig: unmarshal cluster %d: %w", i, err)
+		}
+		c.Clusters = append(c.Clusters, cluster)
+	}
+	for i, js := range tmp.LoadAssignments {
+		cla := new(envoy_config_endpoint_v3.ClusterLoadAssignment)
+		if err := protojson.Unmarshal(js, cla); err != nil {
+			return fmt.Errorf("StaticConfig: unmarshal load assignment %d: %w", i, err)
+		}
+		c.LoadAssignments = append(c.LoadAssignments, cla)
+	}
+	return nil
+}
+
+// Validate checks that every resource is valid and uniquely named.
+func (c *StaticConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	names := make(map[string]struct{})
+	for i, cluster := range c.Clusters {
+		if err := cluster.ValidateAll(); err != nil {
+			return fmt.Errorf("cluster %d (%q): %w", i, cluster.GetName(), err)
+		}
+		if _, ok := names[cluster.GetName()]; ok {
+			return fmt.Errorf("cluster %d: duplicate name %q", i, cluster.GetName())
+		}
+		names[cluster.GetName()] = struct{}{}
+	}
+	names = make(map[string]struct{})
+	for i, cla := range c.LoadAssignments {
+		if err := cla.ValidateAll(); err != nil {
+			return fmt.Errorf("load assignment %d (%q): %w", i, cla.GetClusterName(), err)
+		}
+		if _, ok := names[cla.GetClusterName()]; ok {
+			return fmt.Errorf("load assignment %d: duplicate cluster name %q", i, cla.GetClusterName())
+		}
+		names[cla.GetClusterName()] = struct{}{}
+	}
+	return nil
+}
+
+// StaticStore serves the resources declared in a StaticConfig.  The other stores leave resources
+// with the same names alone; see Stores.AddStatic.
+type StaticStore struct {
+	s *cds.Server
+
+	mu        sync.Mutex    // serializes Reconfigure
+	cfg       *StaticConfig // the config of the served resources; protected by mu
+	clusters  atomic.Pointer[map[string]struct{}]
+	endpoints atomic.Pointer[map[string]struct{}]
+}
+
+// NewStaticStore returns a StaticStore that serves static resources from s.  It serves nothing
+// until Reconfigure is called, so that static resources can be added to a running config.
+func NewStaticStore(s *cds.Server) *StaticStore {
+	ss := &StaticStore{s: s}
+	ss.clusters.Store(&map[string]struct{}{})
+	ss.endpoints.Store(&map[string]struct{}{})
+	return ss
+}
+
+// ownsCluster returns true if the named cluster is a static one.  It never blocks, since the
+// other stores call it with their own locks, and the manager's, held.
+func (ss *StaticStore) ownsCluster(name string) bool {
+	if ss == nil {
+		return false
+	}
+	_, ok := (*ss.clusters.Load())[name]
+	return ok
+}
+
+// ownsEndpoints returns true if the named load assignment is a static one.
+func (ss *StaticStore) ownsEndpoints(name string) bool {
+	if ss == nil {
+		return false
+	}
+	_, ok := (*ss.endpoints.Load())[name]
+	return ok
+}
+
+// Reconfigure replaces the static resources with those declared in c.
+func (ss *StaticStore) Reconfigure(ctx context.Context, c *StaticConfig) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if c == nil {
+		c = new(StaticConfig)
+	}
+	var clusters, endpoints []xds.Resource
+	clusterNames, endpointNames := make(map[string]struct{}), make(map[string]struct{})
+	for _, cluster := range c.Clusters {
+		clusters = append(clusters, cluster)
+		clusterNames[cluster.GetName()] = struct{}{}
+	}
+	for _, cla := range c.LoadAssignments {
+		endpoints = append(endpoints, cla)
+		endpointNames[cla.GetClusterName()] = struct{}{}
+	}
+	// While the resources are replaced, both the old and new names are static, so that the
+	// other stores don't touch either.
+	replace := func(m *xds.Manager, owned *atomic.Pointer[map[string]struct{}], names map[string]struct{}, rs []xds.Resource) error {
+		both := make(map[string]struct{}, len(names))
+		for name := range *owned.Load() {
+			both[name] = struct{}{}
+		}
+		for name := range names {
+			both[name] = struct{}{}
+		}
+		owned.Store(&both)
+		err := m.ReplaceMatching(ctx, rs, func(name string) bool {
+			_, ok := both[name]
+			return ok
+		})
+		if err != nil {
+			return err
+		}
+		owned.Store(&names)
+		return nil
+	}
+	if err := replace(ss.s.Clusters, &ss.clusters, clusterNames, clusters); err != nil {
+		return fmt.Errorf("replace static clusters: %w", err)
+	}
+	if err := replace(ss.s.Endpoints, &ss.endpoints, endpointNames, endpoints); err != nil {
+		return fmt.Errorf("replace static load assignments: %w", err)
+	}
+	ss.cfg = c
+	return nil
+}
+
+// config returns the config of the static resources being served.
+func (ss *StaticStore) config() *StaticConfig {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.cfg
+}
+
+// withoutStatic returns the generated resources in rs, leaving out those that static says are
+// static ones, so that a static resource that takes the name of a generated one doesn't stop
+// everything else from being generated.
+func withoutStatic[T xds.Resource](static func(string) bool, rs []T) []T {
+	result := rs[:0:0]
+	for _, r := range rs {
+		var name string
+		switch x := xds.Resource(r).(type) {
+		case *envoy_config_cluster_v3.Cluster:
+			name = x.GetName()
+		case *envoy_config_endpoint_v3.ClusterLoadAssignment:
+			name = x.GetClusterName()
+		}
+		if static(name) {
+			zap.L().Warn("static resource takes the name of a generated one; not generating it", zap.String("name", name))
+			continue
+		}
+		result = append(result, r)
+	}
+	return result
+}
@@ -0,0 +1,140 @@
+package glue
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Strategies for merging a ClusterOverride into a generated cluster.
+const (
+	// OverrideStrategyMerge merges the override like proto.Merge: fields set to their zero value
+	// are ignored, and repeated fields are appended to.  This is the default.
+	OverrideStrategyMerge = "merge"
+	// OverrideStrategyStrategic merges only the fields that the override mentions, including ones
+	// set to their zero value or null (which clears them).  Messages are merged field by field,
+	// well-known types like durations are replaced, maps are merged by key, and lists are replaced,
+	// except lists of messages with a merge key ("name", or "priority" for circuit breaker
+	// thresholds), whose elements are merged with the element of the same key, or appended.
+	OverrideStrategyStrategic = "strategic"
+)
+
+// presence records the fields of a message that an override mentions.  A presence with neither
+// fields nor elems is a field that is replaced wholesale.
+type presence struct {
+	fields map[protoreflect.FieldNumber]*presence // for messages that are merged field by field
+	elems  []*presence                            // for lists that are merged by key
+}
+
+// wellKnown returns true if md is one of the well-known types, which are replaced rather than
+// merged; merging a duration's seconds and nanos separately is never what anyone wants.
+func wellKnown(md protoreflect.MessageDescriptor) bool {
+	return strings.HasPrefix(string(md.FullName()), "google.protobuf.")
+}
+
+// mergeKey returns the field that identifies the elements of a list of md, or nil if the list
+// can't be merged by key.
+func mergeKey(md protoreflect.MessageDescriptor) protoreflect.FieldDescriptor {
+	for _, name := range []protoreflect.Name{"name", "priority"} {
+		if fd := md.Fields().ByName(name); fd != nil && !fd.IsList() && !fd.IsMap() && fd.Message() == nil {
+			return fd
+		}
+	}
+	return nil
+}
+
+// parsePresence returns the fields of md that the JSON object in raw mentions.  raw must already
+// be known to unmarshal into md.
+func parsePresence(md protoreflect.MessageDescriptor, raw json.RawMessage) (*presence, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, fmt.Errorf("%s: %w", md.FullName(), err)
+	}
+	p := &presence{fields: make(map[protoreflect.FieldNumber]*presence)}
+	for key, value := range obj {
+		fd := md.Fields().ByJSONName(key)
+		if fd == nil {
+			fd = md.Fields().ByName(protoreflect.Name(key))
+		}
+		if fd == nil {
+			return nil, fmt.Errorf("%s: unknown field %q", md.FullName(), key)
+		}
+		child := new(presence)
+		isNull := string(value) == "null"
+		switch {
+		case isNull || fd.IsMap() || fd.Message() == nil || wellKnown(fd.Message()):
+		case fd.IsList():
+			if mergeKey(fd.Message()) == nil {
+				break
+			}
+			var elems []json.RawMessage
+			if err := json.Unmarshal(value, &elems); err != nil {
+				return nil, fmt.Errorf("%s.%s: %w", md.FullName(), fd.Name(), err)
+			}
+			child.elems = []*presence{}
+			for _, e := range elems {
+				ep, err := parsePresence(fd.Message(), e)
+				if err != nil {
+					return nil, fmt.Errorf("%s.%s: %w", md.FullName(), fd.Name(), err)
+				}
+				child.elems = append(child.elems, ep)
+			}
+		default:
+			var err error
+			child, err = parsePresence(fd.Message(), value)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %w", md.FullName(), fd.Name(), err)
+			}
+		}
+		p.fields[fd.Number()] = child
+	}
+	return p, nil
+}
+
+// mergeStrategic merges the fields of src that p mentions into dst, as described by
+// OverrideStrategyStrategic.  src is cloned, so it can be shared between clusters.
+func mergeStrategic(dst, src proto.Message, p *presence) {
+	mergePresent(dst.ProtoReflect(), proto.Clone(src).ProtoReflect(), p)
+}
+
+func mergePresent(dst, src protoreflect.Message, p *presence) {
+	for num, fp := range p.fields {
+		fd := dst.Descriptor().Fields().ByNumber(num)
+		switch {
+		case !src.Has(fd):
+			dst.Clear(fd)
+		case fd.IsMap():
+			dm := dst.Mutable(fd).Map()
+			src.Get(fd).Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+				dm.Set(k, v)
+				return true
+			})
+		case fd.IsList() && fp.elems != nil:
+			mergeKeyedList(dst.Mutable(fd).List(), src.Get(fd).List(), mergeKey(fd.Message()), fp.elems)
+		case fp.fields != nil && dst.Has(fd):
+			mergePresent(dst.Mutable(fd).Message(), src.Get(fd).Message(), fp)
+		default:
+			dst.Set(fd, src.Get(fd))
+		}
+	}
+}
+
+// mergeKeyedList merges each element of src into the element of dst with the same key, or appends
+// it if there is none.
+func mergeKeyedList(dst, src protoreflect.List, key protoreflect.FieldDescriptor, elems []*presence) {
+next:
+	for i := 0; i < src.Len(); i++ {
+		s := src.Get(i).Message()
+		for j := 0; j < dst.Len(); j++ {
+			d := dst.Get(j).Message()
+			if d.Get(key).Interface() == s.Get(key).Interface() {
+				mergePresent(d, s, elems[i])
+				continue next
+			}
+		}
+		dst.Append(src.Get(i))
+	}
+}
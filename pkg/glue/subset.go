@@ -0,0 +1,77 @@
+package glue
+
+import (
+	"fmt"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	v1 "k8s.io/api/core/v1"
+)
+
+// SubsetConfig configures subset load balancing by pod label, so that a route's metadata_match,
+// like {"envoy.lb": {"version": "v2"}}, sends requests to the pods of one version.  Each label is
+// copied to endpoint metadata as if it were in EndpointConfig.PodLabelMetadata.  Clusters whose
+// pods carry any of the labels receive an lb_subset_config that selects endpoints by each label
+// they carry; clusters that already have one, from the base config or namespace defaults, are
+// left alone.  Configuring this makes ekglue watch every pod.
+type SubsetConfig struct {
+	// Labels are the keys of the pod labels to select subsets by, like "version".
+	Labels []string `json:"labels"`
+	// FallbackPolicy is what Envoy does with requests that no subset matches, including those
+	// whose route has no metadata_match: "ANY_ENDPOINT", the default, picks any endpoint of the
+	// cluster, and "NO_FALLBACK" fails the request.
+	FallbackPolicy string `json:"fallback_policy"`
+}
+
+// Validate returns an error if a label key is invalid or the fallback policy is unknown.
+func (c *SubsetConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if len(c.Labels) == 0 {
+		return fmt.Errorf("labels: at least one label is required")
+	}
+	if err := validatePodLabelMetadata(c.Labels); err != nil {
+		return fmt.Errorf("labels: %w", err)
+	}
+	if _, err := c.fallbackPolicy(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// fallbackPolicy returns the Envoy fallback policy named by FallbackPolicy.
+func (c *SubsetConfig) fallbackPolicy() (envoy_config_cluster_v3.Cluster_LbSubsetConfig_LbSubsetFallbackPolicy, error) {
+	switch c.FallbackPolicy {
+	case "", "ANY_ENDPOINT":
+		return envoy_config_cluster_v3.Cluster_LbSubsetConfig_ANY_ENDPOINT, nil
+	case "NO_FALLBACK":
+		return envoy_config_cluster_v3.Cluster_LbSubsetConfig_NO_FALLBACK, nil
+	default:
+		return 0, fmt.Errorf("fallback_policy: unknown policy %q; expected ANY_ENDPOINT or NO_FALLBACK", c.FallbackPolicy)
+	}
+}
+
+// lbSubsetConfig returns the subset config for a cluster whose endpoints are pods, or nil if none
+// of them carry any of the configured labels.
+func (c *SubsetConfig) lbSubsetConfig(pods []*v1.Pod) *envoy_config_cluster_v3.Cluster_LbSubsetConfig {
+	if c == nil {
+		return nil
+	}
+	var selectors []*envoy_config_cluster_v3.Cluster_LbSubsetConfig_LbSubsetSelector
+	for _, key := range c.Labels {
+		for _, pod := range pods {
+			if _, ok := pod.GetLabels()[key]; ok {
+				selectors = append(selectors, &envoy_config_cluster_v3.Cluster_LbSubsetConfig_LbSubsetSelector{Keys: []string{key}})
+				break
+			}
+		}
+	}
+	if len(selectors) == 0 {
+		return nil
+	}
+	policy, _ := c.fallbackPolicy()
+	return &envoy_config_cluster_v3.Cluster_LbSubsetConfig{
+		FallbackPolicy:  policy,
+		SubsetSelectors: selectors,
+	}
+}
@@ -0,0 +1,44 @@
+package glue
+
+import (
+	"strconv"
+	"strings"
+	"text/template"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// TemplateData is the data available to templates in the config, like ClusterConfig.AltStatName.
+type TemplateData struct {
+	Namespace  string // The namespace of the service.
+	Name       string // The name of the service.
+	PortName   string // The name of the port, or its number if it is unnamed.
+	PortNumber int32  // The port number.
+	Protocol   string // The protocol of the port, in lowercase; "tcp" or "udp".
+}
+
+func newTemplateData(svc *v1.Service, port *v1.ServicePort) *TemplateData {
+	d := &TemplateData{
+		Namespace:  svc.GetNamespace(),
+		Name:       svc.GetName(),
+		PortName:   port.Name,
+		PortNumber: port.Port,
+		Protocol:   strings.ToLower(string(port.Protocol)),
+	}
+	if d.PortName == "" {
+		d.PortName = strconv.Itoa(int(port.Port))
+	}
+	if d.Protocol == "" {
+		d.Protocol = "tcp"
+	}
+	return d
+}
+
+// executeTemplate executes t with data (usually a *TemplateData) and returns the result as a string.
+func executeTemplate(t *template.Template, data interface{}) (string, error) {
+	b := new(strings.Builder)
+	if err := t.Execute(b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,248 @@
+package glue
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jrockway/ekglue/pkg/cds"
+	"github.com/jrockway/ekglue/pkg/xds"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/protobuf/proto"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	tenantResources = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ekglue_tenant_resources",
+		Help: "The number of resources served that were generated from each namespace's services, by resource type.",
+	}, []string{"namespace", "type"})
+	tenantResourceBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ekglue_tenant_resource_bytes",
+		Help: "The encoded size of the resources served that were generated from each namespace's services, by resource type.",
+	}, []string{"namespace", "type"})
+	tenantChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ekglue_tenant_changes",
+		Help: "The number of changes to resources generated from each namespace's services, by resource type.",
+	}, []string{"namespace", "type"})
+	tenantPushedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ekglue_tenant_pushed_bytes",
+		Help: "The encoded size of the changed resources generated from each namespace's services, by resource type.",
+	}, []string{"namespace", "type"})
+)
+
+// tenantRateWindow is the time constant of the exponentially weighted change rate in TenantStats.
+const tenantRateWindow = 5 * time.Minute
+
+// TenantStats describes the resources generated from the services in one namespace, of one type.
+type TenantStats struct {
+	Namespace string `json:"namespace"`
+	// Type is "clusters" or "endpoints".
+	Type string `json:"type"`
+	// Resources is the number of resources being served.
+	Resources int `json:"resources"`
+	// Bytes is the encoded size of the resources being served.
+	Bytes int `json:"bytes"`
+	// Changes is the number of times a resource was added, changed, or deleted.
+	Changes int `json:"changes"`
+	// PushedBytes is the encoded size of every added or changed resource.  Clients download
+	// roughly this much, each, because of the namespace.
+	PushedBytes int `json:"pushed_bytes"`
+	// ChangesPerMinute is the recent rate of changes, averaged over about 5 minutes.
+	ChangesPerMinute float64 `json:"changes_per_minute"`
+	// LastChange is when a resource last changed.
+	LastChange time.Time `json:"last_change"`
+
+	rate   float64   // ChangesPerMinute as of rateAt
+	rateAt time.Time // when rate was last decayed
+}
+
+// decay returns the change rate at now.
+func (s *TenantStats) decay(now time.Time) float64 {
+	return s.rate * math.Exp(-float64(now.Sub(s.rateAt))/float64(tenantRateWindow))
+}
+
+// tenantResource is a served resource generated from a namespace's services.
+type tenantResource struct {
+	namespace string // empty until the resource's namespace is known
+	size      int
+}
+
+type tenantKey struct{ namespace, typ string }
+
+// TenantTracker attributes the clusters and load assignments that ekglue serves, and changes to
+// them, to the namespaces whose services they were generated from, so that the tenants whose churn
+// costs the control plane and its clients the most can be identified, and then limited with
+// limits.max_clusters_per_namespace or excluded with a watch config.  Resources that aren't
+// generated from a single service, like aggregate clusters, aren't attributed to any namespace.
+type TenantTracker struct {
+	namespace func(cluster string) (string, bool)
+
+	mu        sync.Mutex
+	resources map[string]map[string]*tenantResource // by type, then name
+	stats     map[tenantKey]*TenantStats
+}
+
+// NewTenantTracker returns a tracker that attributes a resource to the namespace that namespace
+// returns for its name; load assignments are named after their clusters.
+func NewTenantTracker(namespace func(cluster string) (string, bool)) *TenantTracker {
+	return &TenantTracker{
+		namespace: namespace,
+		resources: make(map[string]map[string]*tenantResource),
+		stats:     make(map[tenantKey]*TenantStats),
+	}
+}
+
+// Watch makes the tracker observe changes to the server's clusters and load assignments.  The
+// resources already being served, like those restored from a snapshot, are tracked without
+// counting as changes.  It must be called before the server's resources can change.
+func (t *TenantTracker) Watch(s *cds.Server) {
+	for typ, m := range map[string]*xds.Manager{"clusters": s.Clusters, "endpoints": s.Endpoints} {
+		typ := typ
+		current := make(map[string]xds.Resource)
+		for _, r := range m.List() {
+			if x, ok := r.(interface{ GetName() string }); ok {
+				current[x.GetName()] = r
+			} else if x, ok := r.(interface{ GetClusterName() string }); ok {
+				current[x.GetClusterName()] = r
+			}
+		}
+		t.observe(typ, current, time.Time{})
+		m.OnChange = func(changed map[string]xds.Resource) { t.observe(typ, changed, time.Now()) }
+	}
+}
+
+// ClusterNamespace returns the namespace of the service that the named cluster was generated from,
+// by any of the stores.  It is suitable for NewTenantTracker.
+func (s *Stores) ClusterNamespace(name string) (string, bool) {
+	if s.Clusters != nil {
+		if ns, ok := s.Clusters.clusterNamespace(name); ok {
+			return ns, true
+		}
+	}
+	for _, r := range s.Remotes {
+		if ns, ok := r.ClusterNamespace(name); ok {
+			return ns, true
+		}
+	}
+	return "", false
+}
+
+// stat returns the stats of the namespace's resources of type typ.  You must hold the lock.
+func (t *TenantTracker) stat(namespace, typ string) *TenantStats {
+	k := tenantKey{namespace, typ}
+	s, ok := t.stats[k]
+	if !ok {
+		s = &TenantStats{Namespace: namespace, Type: typ}
+		t.stats[k] = s
+	}
+	return s
+}
+
+// observe records changes to resources of type typ, made at now.  If now is zero, the resources
+// are recorded without counting any changes.
+func (t *TenantTracker) observe(typ string, changed map[string]xds.Resource, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	resources, ok := t.resources[typ]
+	if !ok {
+		resources = make(map[string]*tenantResource)
+		t.resources[typ] = resources
+	}
+	// Load assignments often arrive before the services whose clusters name them, so resources
+	// whose namespace wasn't known yet are attributed as soon as it is.
+	for name, r := range resources {
+		if _, ok := changed[name]; ok || r.namespace != "" {
+			continue
+		}
+		if ns, ok := t.namespace(name); ok {
+			r.namespace = ns
+			t.account(typ, r, 1)
+		}
+	}
+	for name, res := range changed {
+		r, ok := resources[name]
+		if !ok {
+			r = new(tenantResource)
+		}
+		if ns, ok := t.namespace(name); ok && r.namespace == "" {
+			r.namespace = ns
+		} else if ok {
+			t.account(typ, r, -1)
+			r.namespace = ns
+		} else {
+			t.account(typ, r, -1)
+		}
+		if res == nil {
+			delete(resources, name)
+		} else {
+			r.size = proto.Size(res)
+			resources[name] = r
+			t.account(typ, r, 1)
+		}
+		if r.namespace == "" || now.IsZero() {
+			continue
+		}
+		s := t.stat(r.namespace, typ)
+		s.Changes++
+		s.rate = s.decay(now) + float64(time.Minute)/float64(tenantRateWindow)
+		s.rateAt = now
+		s.LastChange = now
+		tenantChanges.WithLabelValues(r.namespace, typ).Inc()
+		if res != nil {
+			s.PushedBytes += r.size
+			tenantPushedBytes.WithLabelValues(r.namespace, typ).Add(float64(r.size))
+		}
+	}
+}
+
+// account adds (sign 1) or removes (sign -1) r from the totals of its namespace, if it has one.
+// You must hold the lock.
+func (t *TenantTracker) account(typ string, r *tenantResource, sign int) {
+	if r.namespace == "" {
+		return
+	}
+	s := t.stat(r.namespace, typ)
+	s.Resources += sign
+	s.Bytes += sign * r.size
+	tenantResources.WithLabelValues(r.namespace, typ).Set(float64(s.Resources))
+	tenantResourceBytes.WithLabelValues(r.namespace, typ).Set(float64(s.Bytes))
+}
+
+// Report returns the stats of every namespace that has had resources, busiest first.
+func (t *TenantTracker) Report() []*TenantStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	result := make([]*TenantStats, 0, len(t.stats))
+	for _, s := range t.stats {
+		r := *s
+		r.ChangesPerMinute = math.Round(s.decay(now)*100) / 100
+		result = append(result, &r)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.ChangesPerMinute != b.ChangesPerMinute {
+			return a.ChangesPerMinute > b.ChangesPerMinute
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Type < b.Type
+	})
+	return result
+}
+
+// ServeHTTP serves Report as YAML.
+func (t *TenantTracker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ya, err := yaml.Marshal(t.Report())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(ya)
+}
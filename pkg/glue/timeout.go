@@ -0,0 +1,61 @@
+package glue
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// RequestTimeoutAnnotation sets the request timeout of the routes generated from the annotated
+// object, as a Go duration like "30s"; "0s" disables the timeout.  It is read from Ingresses,
+// OpenShift Routes, and, for gRPC routes, Services, and takes precedence over the configured
+// request_timeout.
+const RequestTimeoutAnnotation = "ekglue.io/request-timeout"
+
+// Duration is a time.Duration that is written in the config file as a string, like "30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration: %w", err)
+	}
+	x, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("duration: %w", err)
+	}
+	if x < 0 {
+		return fmt.Errorf("duration: %q is negative", s)
+	}
+	*d = Duration(x)
+	return nil
+}
+
+// requestTimeout returns the request timeout for the routes generated from the object identified
+// by key: its RequestTimeoutAnnotation, or def if it doesn't have one.  An invalid annotation is
+// logged and ignored.  nil leaves the timeout at Envoy's default.
+func requestTimeout(key string, annotations map[string]string, def *Duration) *durationpb.Duration {
+	if v, ok := annotations[RequestTimeoutAnnotation]; ok {
+		d, err := parseRequestTimeout(v)
+		if err == nil {
+			return durationpb.New(d)
+		}
+		zap.L().Warn("ignoring invalid request timeout annotation", zap.String("object", key), zap.String("value", v), zap.Error(err))
+	}
+	if def == nil {
+		return nil
+	}
+	return durationpb.New(time.Duration(*def))
+}
+
+// parseRequestTimeout parses the value of a RequestTimeoutAnnotation.
+func parseRequestTimeout(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("must not be negative")
+	}
+	return d, err
+}
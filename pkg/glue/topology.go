@@ -0,0 +1,166 @@
+package glue
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/jrockway/ekglue/pkg/cds"
+)
+
+// TopologyNode is a node of a Topology.
+type TopologyNode struct {
+	// ID identifies the node within the graph, like "cluster:default:foo:http".
+	ID string `json:"id"`
+	// Kind is "service", "cluster", "endpoint", "locality", or "proxy".
+	Kind string `json:"kind"`
+	// Name is the node's name, without its kind.
+	Name string `json:"name"`
+}
+
+// TopologyEdge is a directed edge of a Topology.
+type TopologyEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Topology is a graph of what ekglue knows about the mesh: services point to the clusters
+// generated from them, clusters to their endpoints, endpoints to their localities, and connected
+// proxies to the clusters they explicitly subscribed to.  Proxies with wildcard subscriptions,
+// which see every cluster in their scope, have no edges.
+type Topology struct {
+	Nodes []*TopologyNode `json:"nodes"`
+	Edges []*TopologyEdge `json:"edges"`
+
+	ids   map[string]struct{}
+	edges map[TopologyEdge]struct{}
+}
+
+// node adds a node, if it isn't already in the graph, and returns its ID.
+func (t *Topology) node(kind, name string) string {
+	id := kind + ":" + name
+	if _, ok := t.ids[id]; !ok {
+		t.ids[id] = struct{}{}
+		t.Nodes = append(t.Nodes, &TopologyNode{ID: id, Kind: kind, Name: name})
+	}
+	return id
+}
+
+// edge adds an edge, if it isn't already in the graph.
+func (t *Topology) edge(from, to string) {
+	e := TopologyEdge{From: from, To: to}
+	if _, ok := t.edges[e]; !ok {
+		t.edges[e] = struct{}{}
+		t.Edges = append(t.Edges, &e)
+	}
+}
+
+// Topology returns the current topology of the resources that s serves, using the stores to find
+// the services that clusters were generated from.
+func (s *Stores) Topology(srv *cds.Server) *Topology {
+	t := &Topology{ids: make(map[string]struct{}), edges: make(map[TopologyEdge]struct{})}
+	var directory []*ClusterDirectoryEntry
+	if s.Clusters != nil {
+		directory = s.Clusters.Directory()
+	}
+	for _, r := range s.Remotes {
+		if r.Clusters != nil {
+			directory = append(directory, r.Clusters.Directory()...)
+		}
+	}
+	for _, e := range directory {
+		t.edge(t.node("service", e.Namespace+"/"+e.Service), t.node("cluster", e.Cluster))
+	}
+	for _, c := range srv.ListClusters() {
+		t.node("cluster", c.GetName())
+	}
+	for _, cla := range srv.ListEndpoints() {
+		cluster := t.node("cluster", cla.GetClusterName())
+		for _, lle := range cla.GetEndpoints() {
+			var locality string
+			if l := lle.GetLocality(); l.GetRegion() != "" || l.GetZone() != "" || l.GetSubZone() != "" {
+				locality = t.node("locality", localityKey(l))
+			}
+			for _, lbe := range lle.GetLbEndpoints() {
+				sa := lbe.GetEndpoint().GetAddress().GetSocketAddress()
+				endpoint := t.node("endpoint", fmt.Sprintf("%s:%d", sa.GetAddress(), sa.GetPortValue()))
+				t.edge(cluster, endpoint)
+				if locality != "" {
+					t.edge(endpoint, locality)
+				}
+			}
+		}
+	}
+	sessions := srv.Sessions()
+	types := make([]string, 0, len(sessions))
+	for typ := range sessions {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	for _, typ := range types {
+		for _, ss := range sessions[typ] {
+			if ss.Node == "" {
+				continue
+			}
+			proxy := t.node("proxy", ss.Node)
+			if typ != "clusters" && typ != "endpoints" {
+				continue
+			}
+			for _, name := range ss.Subscribed {
+				if name == "*" {
+					continue
+				}
+				if _, ok := t.ids["cluster:"+name]; ok {
+					t.edge(proxy, "cluster:"+name)
+				}
+			}
+		}
+	}
+	sort.Slice(t.Nodes, func(i, j int) bool { return t.Nodes[i].ID < t.Nodes[j].ID })
+	sort.Slice(t.Edges, func(i, j int) bool {
+		if t.Edges[i].From != t.Edges[j].From {
+			return t.Edges[i].From < t.Edges[j].From
+		}
+		return t.Edges[i].To < t.Edges[j].To
+	})
+	return t
+}
+
+// WriteDOT writes the topology in GraphViz's DOT language.
+func (t *Topology) WriteDOT(w io.Writer) error {
+	shapes := map[string]string{"service": "box", "cluster": "ellipse", "endpoint": "point", "locality": "folder", "proxy": "diamond"}
+	var b strings.Builder
+	b.WriteString("digraph ekglue {\n")
+	for _, n := range t.Nodes {
+		fmt.Fprintf(&b, "\t%q [label=%q, shape=%s];\n", n.ID, n.Name, shapes[n.Kind])
+	}
+	for _, e := range t.Edges {
+		fmt.Fprintf(&b, "\t%q -> %q;\n", e.From, e.To)
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// TopologyHandler returns an http.Handler that serves the stores' Topology as JSON, or, with
+// "format=dot", in GraphViz's DOT language.
+func TopologyHandler(srv *cds.Server, stores *Stores) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t := stores.Topology(srv)
+		switch req.FormValue("format") {
+		case "", "json":
+			w.Header().Set("content-type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			enc.Encode(t)
+		case "dot":
+			w.Header().Set("content-type", "text/vnd.graphviz")
+			t.WriteDOT(w)
+		default:
+			http.Error(w, fmt.Sprintf("unknown format %q; want json or dot", req.FormValue("format")), http.StatusBadRequest)
+		}
+	})
+}
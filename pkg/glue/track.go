@@ -0,0 +1,223 @@
+package glue
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// TrackConfig splits the endpoints of selected service ports into "tracks" (blue/green, stable/
+// canary, etc.) by the value of a label on the pods behind them, which is typically set by each
+// track's Deployment.  Traffic is shifted between tracks by adjusting their weights.
+//
+// Each track gets an EDS cluster named "<cluster name>-<track>" containing only that track's
+// endpoints, for routes that need to pin a track.  The original cluster becomes an EDS cluster
+// with locality-weighted load balancing, and its load assignment has one locality per track
+// (with sub_zone set to the track name), weighted as configured.  This replaces the usual
+// node-based localities for that cluster.  Tracks with a weight of 0, or with no endpoints, get no
+// traffic through the original cluster.
+//
+// Pod labels are read when endpoints change; relabeling a running pod takes effect the next time
+// the service's EndpointSlices change.
+type TrackConfig struct {
+	// Match selects the clusters to split into tracks; multiple items are OR'd.
+	Match []*Matcher `json:"match"`
+	// Label is the pod label whose value names the track, like "track".
+	Label string `json:"label"`
+	// Weights is the weight of each track.  Pods in tracks not listed here are ignored.
+	Weights map[string]uint32 `json:"weights"`
+}
+
+func (t *TrackConfig) UnmarshalJSON(b []byte) error {
+	type raw TrackConfig
+	tmp := new(raw)
+	if err := json.Unmarshal(b, tmp); err != nil {
+		return fmt.Errorf("TrackConfig: unmarshal into temporary structure: %w", err)
+	}
+	if len(tmp.Match) == 0 {
+		return fmt.Errorf("TrackConfig: no matching rules provided")
+	}
+	if tmp.Label == "" {
+		return fmt.Errorf("TrackConfig: no label provided")
+	}
+	if len(tmp.Weights) == 0 {
+		return fmt.Errorf("TrackConfig: no tracks provided")
+	}
+	for track := range tmp.Weights {
+		if track == "" {
+			return fmt.Errorf("TrackConfig: empty track name")
+		}
+	}
+	*t = TrackConfig(*tmp)
+	return nil
+}
+
+// tracks returns the configured track names, sorted.
+func (t *TrackConfig) tracks() []string {
+	result := make([]string, 0, len(t.Weights))
+	for track := range t.Weights {
+		result = append(result, track)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// matches returns true if the provided cluster is split into tracks.
+func (t *TrackConfig) matches(cluster string, port *v1.ServicePort) bool {
+	for _, m := range t.Match {
+		if m.Evaluate(&envoy_config_cluster_v3.Cluster{Name: cluster}, nil, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// trackFor returns the first track config that splits the provided cluster, or nil.
+func trackFor(tracks []*TrackConfig, cluster string, port *v1.ServicePort) *TrackConfig {
+	for _, t := range tracks {
+		if t.matches(cluster, port) {
+			return t
+		}
+	}
+	return nil
+}
+
+// names returns the name of each track's cluster, keyed by track.
+func (t *TrackConfig) names(naming *NamingConfig, cluster string) map[string]string {
+	result := make(map[string]string, len(t.Weights))
+	for track := range t.Weights {
+		result[track] = naming.Apply(cluster + "-" + track)
+	}
+	return result
+}
+
+// clusters converts cluster to a locality-weighted EDS cluster, and returns it followed by a
+// cluster for each track.
+func (t *TrackConfig) clusters(naming *NamingConfig, cluster *envoy_config_cluster_v3.Cluster) []*envoy_config_cluster_v3.Cluster {
+	names := t.names(naming, cluster.GetName())
+	var result []*envoy_config_cluster_v3.Cluster
+	for _, track := range t.tracks() {
+		cl := proto.Clone(cluster).(*envoy_config_cluster_v3.Cluster)
+		cl.Name = names[track]
+		if cl.GetAltStatName() != "" {
+			cl.AltStatName += "_" + track
+		}
+		result = append(result, edsCluster(cl))
+	}
+	cluster = edsCluster(cluster)
+	if cluster.CommonLbConfig == nil {
+		cluster.CommonLbConfig = new(envoy_config_cluster_v3.Cluster_CommonLbConfig)
+	}
+	cluster.CommonLbConfig.LocalityConfigSpecifier = &envoy_config_cluster_v3.Cluster_CommonLbConfig_LocalityWeightedLbConfig_{
+		LocalityWeightedLbConfig: new(envoy_config_cluster_v3.Cluster_CommonLbConfig_LocalityWeightedLbConfig),
+	}
+	return append([]*envoy_config_cluster_v3.Cluster{cluster}, result...)
+}
+
+// filterSlices returns copies of slices containing only the endpoints whose pod is in track.
+func (t *TrackConfig) filterSlices(podStore cache.Store, slices []*discoveryv1.EndpointSlice, track string) []*discoveryv1.EndpointSlice {
+	result := make([]*discoveryv1.EndpointSlice, 0, len(slices))
+	for _, es := range slices {
+		filtered := *es
+		filtered.Endpoints = nil
+		for _, ep := range es.Endpoints {
+			if podLabel(podStore, ep.TargetRef, t.Label) == track {
+				filtered.Endpoints = append(filtered.Endpoints, ep)
+			}
+		}
+		result = append(result, &filtered)
+	}
+	return result
+}
+
+// podLabel returns the value of the named label on the pod that ref refers to, or "" if the pod
+// is unknown.
+func podLabel(podStore cache.Store, ref *v1.ObjectReference, label string) string {
+	if podStore == nil || ref == nil || ref.Kind != "Pod" {
+		return ""
+	}
+	obj, ok, err := podStore.GetByKey(ref.Namespace + "/" + ref.Name)
+	if err != nil || !ok {
+		return ""
+	}
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return ""
+	}
+	return pod.GetLabels()[label]
+}
+
+// loadAssignments returns the weighted load assignment for cluster and one assignment per track.
+// Every track gets an assignment, even if it has no endpoints, so that endpoints leaving a track
+// are removed.
+func (t *TrackConfig) loadAssignments(c *EndpointConfig, nodeStore cache.Store, slices []*discoveryv1.EndpointSlice, cluster string, port *v1.ServicePort) []*envoy_config_endpoint_v3.ClusterLoadAssignment {
+	names := t.names(c.naming, cluster)
+	weighted := &envoy_config_endpoint_v3.ClusterLoadAssignment{ClusterName: cluster}
+	result := []*envoy_config_endpoint_v3.ClusterLoadAssignment{weighted}
+	for _, track := range t.tracks() {
+		var endpoints []*envoy_config_endpoint_v3.LocalityLbEndpoints
+		for _, cla := range c.loadAssignments(nodeStore, t.filterSlices(c.pods, slices, track), func(es *discoveryv1.EndpointSlice, p discoveryv1.EndpointPort) (string, envoy_config_core_v3.SocketAddress_Protocol) {
+			svc := esService(es)
+			name, protocol := c.naming.nameCluster(svc.Namespace, svc.Name, withDefault(p.Name, ""), *p.Port, withDefault(p.Protocol, "TCP"))
+			if name != cluster {
+				return "", 0
+			}
+			return name, protocol
+		}) {
+			endpoints = cla.GetEndpoints()
+		}
+		result = append(result, &envoy_config_endpoint_v3.ClusterLoadAssignment{ClusterName: names[track], Endpoints: endpoints})
+
+		w := t.Weights[track]
+		if w == 0 || len(endpoints) == 0 {
+			continue
+		}
+		lle := &envoy_config_endpoint_v3.LocalityLbEndpoints{
+			Locality:            &envoy_config_core_v3.Locality{SubZone: track},
+			LoadBalancingWeight: wrapperspb.UInt32(w),
+		}
+		for _, e := range endpoints {
+			lle.LbEndpoints = append(lle.LbEndpoints, e.GetLbEndpoints()...)
+		}
+		weighted.Endpoints = append(weighted.Endpoints, lle)
+	}
+	return result
+}
+
+// PodStore returns the store that pods should be sent to, if any tracks or pod weights are
+// configured, or nil otherwise.  Only the pods' labels, annotations, and readiness probes are used.
+func (c *EndpointConfig) PodStore() cache.Store {
+	if len(c.tracks) == 0 && !c.needsAllPods() {
+		return nil
+	}
+	if c.pods == nil {
+		c.pods = newPodStore()
+	}
+	return c.pods
+}
+
+// PodLabelSelector returns a label selector that matches the pods that tracks need, so that
+// ekglue doesn't have to watch every pod in the cluster.  It is empty if there is no single label
+// to select on, or if pod weights are configured, since they need every pod.
+func (c *Config) PodLabelSelector() string {
+	if ec := c.EndpointConfig; ec != nil && ec.needsAllPods() {
+		return ""
+	}
+	var label string
+	for _, t := range c.Tracks {
+		if label != "" && t.Label != label {
+			return ""
+		}
+		label = t.Label
+	}
+	return label
+}
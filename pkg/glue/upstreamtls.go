@@ -0,0 +1,168 @@
+package glue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"text/template"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_extensions_transport_sockets_tls_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"google.golang.org/protobuf/types/known/anypb"
+	v1 "k8s.io/api/core/v1"
+)
+
+// DefaultUpstreamTLSServerName is the default template of the server name (SNI) that clusters
+// using upstream TLS send.
+const DefaultUpstreamTLSServerName = "{{.Name}}.{{.Namespace}}.svc.cluster.local"
+
+// UpstreamTLSConfig makes matching clusters connect to their endpoints over TLS, for services that
+// terminate TLS themselves.  The first config that matches a cluster applies.  Clusters that
+// already have a transport socket, from the base config or namespace defaults, are left alone, and
+// overrides and annotations apply afterwards, so they can still replace the transport socket.
+type UpstreamTLSConfig struct {
+	// Match selects the clusters to connect over TLS; multiple items are OR'd.
+	Match []*Matcher `json:"match"`
+	// ServerName is a text/template that generates the server name (SNI) to send, executed with a
+	// TemplateData.  The default is DefaultUpstreamTLSServerName.
+	ServerName string `json:"server_name"`
+	// CAFile is the path, on the proxy, of the CA certificates that upstream certificates are
+	// verified against.
+	CAFile string `json:"ca_file"`
+	// CASecret names an SDS secret holding the validation context to verify upstream
+	// certificates with.  Exactly one of CAFile and CASecret must be set.
+	CASecret string `json:"ca_secret"`
+	// ClientCertFile and ClientKeyFile are the paths, on the proxy, of the client certificate and
+	// its key to present to the upstream for mutual TLS.  Either both or neither must be set.
+	ClientCertFile string `json:"client_cert_file"`
+	ClientKeyFile  string `json:"client_key_file"`
+	// ClientCertSecret names an SDS secret holding the client certificate to present for mutual
+	// TLS, as an alternative to ClientCertFile.
+	ClientCertSecret string `json:"client_cert_secret"`
+	// SDSCluster is the name of the gRPC cluster, like a node-local SPIFFE agent, that serves the
+	// SDS secrets.  If empty, secrets are requested over ADS.
+	SDSCluster string `json:"sds_cluster"`
+
+	serverName *template.Template
+}
+
+func (c *UpstreamTLSConfig) UnmarshalJSON(b []byte) error {
+	type raw UpstreamTLSConfig
+	tmp := new(raw)
+	if err := json.Unmarshal(b, tmp); err != nil {
+		return fmt.Errorf("UpstreamTLSConfig: %w", err)
+	}
+	*c = UpstreamTLSConfig(*tmp)
+	if len(c.Match) == 0 {
+		return errors.New("UpstreamTLSConfig: match must not be empty")
+	}
+	if (c.CAFile == "") == (c.CASecret == "") {
+		return errors.New("UpstreamTLSConfig: exactly one of ca_file and ca_secret must be set")
+	}
+	if (c.ClientCertFile == "") != (c.ClientKeyFile == "") {
+		return errors.New("UpstreamTLSConfig: client_cert_file and client_key_file must be set together")
+	}
+	if c.ClientCertFile != "" && c.ClientCertSecret != "" {
+		return errors.New("UpstreamTLSConfig: client_cert_file and client_cert_secret are mutually exclusive")
+	}
+	serverName := c.ServerName
+	if serverName == "" {
+		serverName = DefaultUpstreamTLSServerName
+	}
+	t, err := template.New("server_name").Option("missingkey=error").Parse(serverName)
+	if err != nil {
+		return fmt.Errorf("UpstreamTLSConfig: parse server_name template: %w", err)
+	}
+	c.serverName = t
+	return nil
+}
+
+// matches returns true if the config applies to the cluster for port of svc.
+func (c *UpstreamTLSConfig) matches(cluster *envoy_config_cluster_v3.Cluster, svc *v1.Service, port *v1.ServicePort) bool {
+	for _, m := range c.Match {
+		if m.Evaluate(cluster, svc, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// sdsSecret returns a reference to the named SDS secret.
+func (c *UpstreamTLSConfig) sdsSecret(name string) *envoy_extensions_transport_sockets_tls_v3.SdsSecretConfig {
+	source := &envoy_config_core_v3.ConfigSource{
+		ResourceApiVersion:    envoy_config_core_v3.ApiVersion_V3,
+		ConfigSourceSpecifier: &envoy_config_core_v3.ConfigSource_Ads{Ads: &envoy_config_core_v3.AggregatedConfigSource{}},
+	}
+	if c.SDSCluster != "" {
+		source.ConfigSourceSpecifier = &envoy_config_core_v3.ConfigSource_ApiConfigSource{
+			ApiConfigSource: &envoy_config_core_v3.ApiConfigSource{
+				ApiType:             envoy_config_core_v3.ApiConfigSource_GRPC,
+				TransportApiVersion: envoy_config_core_v3.ApiVersion_V3,
+				GrpcServices: []*envoy_config_core_v3.GrpcService{{
+					TargetSpecifier: &envoy_config_core_v3.GrpcService_EnvoyGrpc_{
+						EnvoyGrpc: &envoy_config_core_v3.GrpcService_EnvoyGrpc{ClusterName: c.SDSCluster},
+					},
+				}},
+			},
+		}
+	}
+	return &envoy_extensions_transport_sockets_tls_v3.SdsSecretConfig{Name: name, SdsConfig: source}
+}
+
+// transportSocket returns the TLS transport socket for the cluster for port of svc.
+func (c *UpstreamTLSConfig) transportSocket(svc *v1.Service, port *v1.ServicePort) (*envoy_config_core_v3.TransportSocket, error) {
+	sni, err := executeTemplate(c.serverName, newTemplateData(svc, port))
+	if err != nil {
+		return nil, fmt.Errorf("server name: %w", err)
+	}
+	common := new(envoy_extensions_transport_sockets_tls_v3.CommonTlsContext)
+	if c.CAFile != "" {
+		common.ValidationContextType = &envoy_extensions_transport_sockets_tls_v3.CommonTlsContext_ValidationContext{
+			ValidationContext: &envoy_extensions_transport_sockets_tls_v3.CertificateValidationContext{
+				TrustedCa: &envoy_config_core_v3.DataSource{
+					Specifier: &envoy_config_core_v3.DataSource_Filename{Filename: c.CAFile},
+				},
+			},
+		}
+	} else {
+		common.ValidationContextType = &envoy_extensions_transport_sockets_tls_v3.CommonTlsContext_ValidationContextSdsSecretConfig{
+			ValidationContextSdsSecretConfig: c.sdsSecret(c.CASecret),
+		}
+	}
+	if c.ClientCertFile != "" {
+		common.TlsCertificates = []*envoy_extensions_transport_sockets_tls_v3.TlsCertificate{{
+			CertificateChain: &envoy_config_core_v3.DataSource{
+				Specifier: &envoy_config_core_v3.DataSource_Filename{Filename: c.ClientCertFile},
+			},
+			PrivateKey: &envoy_config_core_v3.DataSource{
+				Specifier: &envoy_config_core_v3.DataSource_Filename{Filename: c.ClientKeyFile},
+			},
+		}}
+	}
+	if c.ClientCertSecret != "" {
+		common.TlsCertificateSdsSecretConfigs = []*envoy_extensions_transport_sockets_tls_v3.SdsSecretConfig{c.sdsSecret(c.ClientCertSecret)}
+	}
+	tc, err := anypb.New(&envoy_extensions_transport_sockets_tls_v3.UpstreamTlsContext{
+		Sni:              sni,
+		CommonTlsContext: common,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshal tls context: %w", err)
+	}
+	return &envoy_config_core_v3.TransportSocket{
+		Name:       "envoy.transport_sockets.tls",
+		ConfigType: &envoy_config_core_v3.TransportSocket_TypedConfig{TypedConfig: tc},
+	}, nil
+}
+
+// upstreamTLS returns the transport socket that the first matching UpstreamTLS config generates for
+// the cluster for port of svc, or nil if none match.
+func (c *ClusterConfig) upstreamTLS(cluster *envoy_config_cluster_v3.Cluster, svc *v1.Service, port *v1.ServicePort) (*envoy_config_core_v3.TransportSocket, error) {
+	for _, t := range c.UpstreamTLS {
+		if t.matches(cluster, svc, port) {
+			return t.transportSocket(svc, port)
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,64 @@
+package glue
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	"github.com/jrockway/ekglue/pkg/cds"
+	"github.com/jrockway/ekglue/pkg/xds"
+)
+
+// ValidationConfig adds rules that every generated cluster must follow.  A change that contains a
+// cluster breaking one of them is rejected, just like a change containing a cluster that Envoy
+// would reject, and counted in the ekglue_xds_validator_rejections metric.
+type ValidationConfig struct {
+	// RequireCircuitBreakers requires every cluster to set at least one circuit breaker
+	// threshold.
+	RequireCircuitBreakers bool `json:"require_circuit_breakers"`
+	// ClusterNamePattern, if set, is a regular expression that every cluster name must match.
+	ClusterNamePattern string `json:"cluster_name_pattern"`
+}
+
+// Validate returns an error if the ClusterNamePattern doesn't compile.
+func (v *ValidationConfig) Validate() error {
+	if v == nil {
+		return nil
+	}
+	if _, err := regexp.Compile(v.ClusterNamePattern); err != nil {
+		return fmt.Errorf("cluster_name_pattern: %w", err)
+	}
+	return nil
+}
+
+// ClusterValidators returns the configured rules as validators for the clusters manager.
+func (v *ValidationConfig) ClusterValidators() []xds.Validator {
+	if v == nil {
+		return nil
+	}
+	var result []xds.Validator
+	if v.RequireCircuitBreakers {
+		result = append(result, func(r xds.Resource) error {
+			if len(r.(*envoy_config_cluster_v3.Cluster).GetCircuitBreakers().GetThresholds()) == 0 {
+				return errors.New("cluster has no circuit breakers")
+			}
+			return nil
+		})
+	}
+	if v.ClusterNamePattern != "" {
+		re := regexp.MustCompile(v.ClusterNamePattern)
+		result = append(result, func(r xds.Resource) error {
+			if name := r.(*envoy_config_cluster_v3.Cluster).GetName(); !re.MatchString(name) {
+				return fmt.Errorf("cluster name does not match %q", v.ClusterNamePattern)
+			}
+			return nil
+		})
+	}
+	return result
+}
+
+// Apply adds the configured validators to the xDS server's managers.
+func (v *ValidationConfig) Apply(s *cds.Server) {
+	s.Clusters.Validators = append(s.Clusters.Validators, v.ClusterValidators()...)
+}
@@ -0,0 +1,44 @@
+package glue
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// WatchConfig restricts which services (and their endpoints) are watched, so that a multi-tenant
+// cluster can run one ekglue per tenant without publishing every tenant's cluster names to all of
+// them.  The restrictions are applied by the API server, so ekglue only needs permission to read
+// the selected namespaces.
+type WatchConfig struct {
+	// Namespaces, if not empty, are the only namespaces whose services and EndpointSlices are
+	// watched.
+	Namespaces []string `json:"namespaces"`
+	// LabelSelector, if set, selects the services to watch, like "tenant=a".  The EndpointSlice
+	// controller copies a service's labels onto its EndpointSlices, so the same selector is
+	// applied to EndpointSlices.
+	LabelSelector string `json:"label_selector"`
+	// FieldSelector, if set, further selects the services to watch, like
+	// "metadata.name!=kubernetes".  It is not applied to EndpointSlices.
+	FieldSelector string `json:"field_selector"`
+}
+
+// Validate returns an error if a selector doesn't parse.
+func (w *WatchConfig) Validate() error {
+	if w == nil {
+		return nil
+	}
+	if _, err := labels.Parse(w.LabelSelector); err != nil {
+		return fmt.Errorf("label selector: %w", err)
+	}
+	if _, err := fields.ParseSelector(w.FieldSelector); err != nil {
+		return fmt.Errorf("field selector: %w", err)
+	}
+	for _, ns := range w.Namespaces {
+		if ns == "" {
+			return fmt.Errorf("empty namespace")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package glue
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"google.golang.org/protobuf/proto"
+	v1 "k8s.io/api/core/v1"
+)
+
+// ZoneClusterConfig configures the generation of one cluster per zone for selected service ports,
+// in addition to the usual cluster that spans all zones.  This lets route configs pin
+// latency-sensitive callers to a zone explicitly.
+//
+// Zone clusters are EDS clusters named "<cluster name>-<zone>", and contain the endpoints whose
+// locality (as determined by endpoint_config.locality) is in that zone.  Zones must be listed in
+// advance, because clusters are generated from services, which know nothing about zones.
+//
+// With Failover, zone clusters also contain the endpoints outside their zone, at lower priorities:
+// endpoints in the zone have priority 0, endpoints in other zones of the same region have priority
+// 1, and the rest have priority 2, so that Envoy only sends traffic out of the zone (and then out
+// of the region) when there aren't enough healthy endpoints closer by.  A zone's region is taken
+// from the localities of its endpoints.  Priorities that no endpoint has are skipped, because
+// Envoy requires them to be contiguous.
+type ZoneClusterConfig struct {
+	// Match selects the clusters to split by zone; multiple items are OR'd.
+	Match []*Matcher `json:"match"`
+	// Zones is the list of zones to generate clusters for.
+	Zones []string `json:"zones"`
+	// Failover includes endpoints outside each zone at lower priorities.
+	Failover bool `json:"failover"`
+}
+
+func (z *ZoneClusterConfig) UnmarshalJSON(b []byte) error {
+	tmp := struct {
+		Match    []*Matcher `json:"match"`
+		Zones    []string   `json:"zones"`
+		Failover bool       `json:"failover"`
+	}{}
+	if err := json.Unmarshal(b, &tmp); err != nil {
+		return fmt.Errorf("ZoneClusterConfig: unmarshal into temporary structure: %w", err)
+	}
+	if len(tmp.Match) == 0 {
+		return fmt.Errorf("ZoneClusterConfig: no matching rules provided")
+	}
+	if len(tmp.Zones) == 0 {
+		return fmt.Errorf("ZoneClusterConfig: no zones provided")
+	}
+	for _, zone := range tmp.Zones {
+		if zone == "" {
+			return fmt.Errorf("ZoneClusterConfig: empty zone name")
+		}
+	}
+	z.Match, z.Zones, z.Failover = tmp.Match, tmp.Zones, tmp.Failover
+	return nil
+}
+
+// names returns the name of each zone cluster for the provided cluster, keyed by zone, or nil if
+// the cluster is not split by zone.
+func (z *ZoneClusterConfig) names(naming *NamingConfig, cluster *envoy_config_cluster_v3.Cluster, port *v1.ServicePort) map[string]string {
+	if z == nil {
+		return nil
+	}
+	var match bool
+	for _, m := range z.Match {
+		if m.Evaluate(cluster, nil, port) {
+			match = true
+			break
+		}
+	}
+	if !match {
+		return nil
+	}
+	result := make(map[string]string, len(z.Zones))
+	for _, zone := range z.Zones {
+		result[zone] = naming.Apply(cluster.GetName() + "-" + zone)
+	}
+	return result
+}
+
+// clusters returns the zone clusters for cluster.
+func (z *ZoneClusterConfig) clusters(naming *NamingConfig, cluster *envoy_config_cluster_v3.Cluster, port *v1.ServicePort) []*envoy_config_cluster_v3.Cluster {
+	var result []*envoy_config_cluster_v3.Cluster
+	names := z.names(naming, cluster, port)
+	if names == nil {
+		return nil
+	}
+	for _, zone := range z.Zones {
+		name, ok := names[zone]
+		if !ok {
+			continue
+		}
+		cl := proto.Clone(cluster).(*envoy_config_cluster_v3.Cluster)
+		cl.Name = name
+		if cl.GetAltStatName() != "" {
+			cl.AltStatName += "_" + zone
+		}
+		result = append(result, edsCluster(cl))
+	}
+	return result
+}
+
+// loadAssignments splits cla by zone, returning one load assignment for each zone cluster.  Every
+// zone gets an assignment, even if it has no endpoints, so that endpoints leaving a zone are
+// removed.
+func (z *ZoneClusterConfig) loadAssignments(naming *NamingConfig, cla *envoy_config_endpoint_v3.ClusterLoadAssignment, port *v1.ServicePort) []*envoy_config_endpoint_v3.ClusterLoadAssignment {
+	names := z.names(naming, &envoy_config_cluster_v3.Cluster{Name: cla.GetClusterName()}, port)
+	if names == nil {
+		return nil
+	}
+	byZone := make(map[string]*envoy_config_endpoint_v3.ClusterLoadAssignment, len(names))
+	var result []*envoy_config_endpoint_v3.ClusterLoadAssignment
+	for _, zone := range z.Zones {
+		zcla := &envoy_config_endpoint_v3.ClusterLoadAssignment{ClusterName: names[zone]}
+		if z.Failover {
+			zcla.Endpoints = failoverEndpoints(cla.GetEndpoints(), zone)
+		}
+		byZone[zone] = zcla
+		result = append(result, zcla)
+	}
+	if z.Failover {
+		return result
+	}
+	for _, lle := range cla.GetEndpoints() {
+		if zcla, ok := byZone[lle.GetLocality().GetZone()]; ok {
+			zcla.Endpoints = append(zcla.Endpoints, lle)
+		}
+	}
+	return result
+}
+
+// failoverEndpoints returns copies of endpoints, prioritized by their distance from zone.
+func failoverEndpoints(endpoints []*envoy_config_endpoint_v3.LocalityLbEndpoints, zone string) []*envoy_config_endpoint_v3.LocalityLbEndpoints {
+	var region string
+	for _, lle := range endpoints {
+		if l := lle.GetLocality(); l.GetZone() == zone && l.GetRegion() != "" {
+			region = l.GetRegion()
+			break
+		}
+	}
+	priority := func(l *envoy_config_core_v3.Locality) uint32 {
+		switch {
+		case l.GetZone() == zone:
+			return 0
+		case region != "" && l.GetRegion() == region:
+			return 1
+		default:
+			return 2
+		}
+	}
+	var used [3]bool
+	for _, lle := range endpoints {
+		used[priority(lle.GetLocality())] = true
+	}
+	// Renumber the priorities that are in use, so that they are contiguous.
+	var dense [3]uint32
+	var next uint32
+	for p, ok := range used {
+		if ok {
+			dense[p] = next
+			next++
+		}
+	}
+	result := make([]*envoy_config_endpoint_v3.LocalityLbEndpoints, 0, len(endpoints))
+	for _, lle := range endpoints {
+		lle = proto.Clone(lle).(*envoy_config_endpoint_v3.LocalityLbEndpoints)
+		lle.Priority = dense[priority(lle.GetLocality())]
+		result = append(result, lle)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].GetPriority() < result[j].GetPriority()
+	})
+	return result
+}
+
+// edsCluster converts cl to an EDS cluster, using EDS over ADS if cl doesn't already specify an
+// EDS config source.
+func edsCluster(cl *envoy_config_cluster_v3.Cluster) *envoy_config_cluster_v3.Cluster {
+	cl.LoadAssignment = nil
+	cl.ClusterDiscoveryType = &envoy_config_cluster_v3.Cluster_Type{Type: envoy_config_cluster_v3.Cluster_EDS}
+	if cl.GetEdsClusterConfig().GetEdsConfig() == nil {
+		cl.EdsClusterConfig = &envoy_config_cluster_v3.Cluster_EdsClusterConfig{
+			EdsConfig: &envoy_config_core_v3.ConfigSource{
+				ResourceApiVersion:    envoy_config_core_v3.ApiVersion_V3,
+				ConfigSourceSpecifier: &envoy_config_core_v3.ConfigSource_Ads{Ads: &envoy_config_core_v3.AggregatedConfigSource{}},
+			},
+		}
+	}
+	return cl
+}
@@ -0,0 +1,330 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/cache"
+)
+
+// DirectoryWatcher reads Services, Endpoints, EndpointSlices, and Nodes from YAML or JSON files in
+// a local directory instead of from a cluster, for developing configs on a laptop.  Endpoints are
+// converted to EndpointSlices, since that's what ekglue consumes.  Files may contain several
+// documents separated by "---".
+//
+// Kubernetes truncates Endpoints objects to EndpointsCapacity addresses, so an Endpoints object
+// that is at or near that size is probably missing backends.  Such objects are reported in
+// DirectoryContents.Warnings, and if the directory also has EndpointSlices for the service, those
+// are used instead.
+type DirectoryWatcher struct {
+	// Dir is the directory to read.  Subdirectories are not read.
+	Dir string
+	// Interval is how often to check the directory for changes; 1 second if zero.
+	Interval time.Duration
+}
+
+// EndpointsCapacity is the number of addresses that Kubernetes keeps in an Endpoints object; the
+// rest are dropped, and the object is annotated with v1.EndpointsOverCapacity.  EndpointSlices
+// have no such limit.
+const EndpointsCapacity = 1000
+
+// endpointsNearCapacity is the number of addresses at which an Endpoints object is large enough
+// that it may soon be truncated, if it hasn't been already.
+const endpointsNearCapacity = EndpointsCapacity * 9 / 10
+
+// DirectoryContents are the objects read from a directory.
+type DirectoryContents struct {
+	Services       []*v1.Service
+	EndpointSlices []*discoveryv1.EndpointSlice
+	Nodes          []*v1.Node
+	// Warnings describe problems with the objects that didn't prevent them from being read.
+	Warnings []string
+
+	endpoints []*v1.Endpoints // converted to EndpointSlices once every file has been read
+}
+
+// files returns the names of the files in the directory that might contain objects.
+func (dw *DirectoryWatcher) files() ([]string, error) {
+	entries, err := os.ReadDir(dw.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("read directory: %w", err)
+	}
+	var result []string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		switch filepath.Ext(e.Name()) {
+		case ".yaml", ".yml", ".json":
+			result = append(result, filepath.Join(dw.Dir, e.Name()))
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// fingerprint returns a value that changes when any file in the directory changes.
+func (dw *DirectoryWatcher) fingerprint() (uint64, error) {
+	files, err := dw.files()
+	if err != nil {
+		return 0, err
+	}
+	h := fnv.New64a()
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return 0, fmt.Errorf("stat %s: %w", f, err)
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00%d\x00", f, info.Size(), info.ModTime().UnixNano())
+	}
+	return h.Sum64(), nil
+}
+
+// Load reads every object in the directory.
+func (dw *DirectoryWatcher) Load() (*DirectoryContents, error) {
+	files, err := dw.files()
+	if err != nil {
+		return nil, err
+	}
+	result := new(DirectoryContents)
+	for _, f := range files {
+		if err := result.readFile(f); err != nil {
+			return nil, err
+		}
+	}
+	result.convertEndpoints()
+	return result, nil
+}
+
+// LoadFile reads every object in a single file, in the same formats that a DirectoryWatcher reads.
+func LoadFile(filename string) (*DirectoryContents, error) {
+	result := new(DirectoryContents)
+	if err := result.readFile(filename); err != nil {
+		return nil, err
+	}
+	result.convertEndpoints()
+	return result, nil
+}
+
+// readFile adds every object in the named file to the directory contents.
+func (c *DirectoryContents) readFile(f string) error {
+	raw, err := os.ReadFile(f)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", f, err)
+	}
+	decoder := scheme.Codecs.UniversalDeserializer()
+	for i, doc := range bytes.Split(raw, []byte("\n---")) {
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+		obj, _, err := decoder.Decode(doc, nil, nil)
+		if err != nil {
+			return fmt.Errorf("decode %s (document %d): %w", f, i, err)
+		}
+		if err := c.add(obj); err != nil {
+			return fmt.Errorf("%s (document %d): %w", f, i, err)
+		}
+	}
+	return nil
+}
+
+// add adds a decoded object to the directory contents.
+func (c *DirectoryContents) add(obj interface{}) error {
+	defaultNamespace := func(m *metav1.ObjectMeta) {
+		if m.Namespace == "" {
+			m.Namespace = "default"
+		}
+	}
+	switch x := obj.(type) {
+	case *v1.Service:
+		defaultNamespace(&x.ObjectMeta)
+		c.Services = append(c.Services, x)
+	case *discoveryv1.EndpointSlice:
+		defaultNamespace(&x.ObjectMeta)
+		c.EndpointSlices = append(c.EndpointSlices, x)
+	case *v1.Endpoints:
+		defaultNamespace(&x.ObjectMeta)
+		c.endpoints = append(c.endpoints, x)
+	case *v1.Node:
+		c.Nodes = append(c.Nodes, x)
+	case *v1.List:
+		for _, item := range x.Items {
+			obj, _, err := scheme.Codecs.UniversalDeserializer().Decode(item.Raw, nil, nil)
+			if err != nil {
+				return fmt.Errorf("decode list item: %w", err)
+			}
+			if err := c.add(obj); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported object type %T", obj)
+	}
+	return nil
+}
+
+// convertEndpoints adds an EndpointSlice for each Endpoints object that was read, except for large
+// ones whose service has EndpointSlices of its own.
+func (c *DirectoryContents) convertEndpoints() {
+	haveSlices := make(map[string]struct{})
+	for _, es := range c.EndpointSlices {
+		haveSlices[es.Namespace+"/"+es.Labels[discoveryv1.LabelServiceName]] = struct{}{}
+	}
+	for _, eps := range c.endpoints {
+		key := eps.Namespace + "/" + eps.Name
+		var n int
+		for _, subset := range eps.Subsets {
+			n += len(subset.Addresses) + len(subset.NotReadyAddresses)
+		}
+		truncated := eps.Annotations[v1.EndpointsOverCapacity] != ""
+		if truncated || n >= endpointsNearCapacity {
+			problem := fmt.Sprintf("endpoints %s has %d addresses, near the %d that kubernetes keeps", key, n, EndpointsCapacity)
+			if truncated {
+				problem = fmt.Sprintf("endpoints %s was truncated to %d addresses by kubernetes", key, n)
+			}
+			if _, ok := haveSlices[key]; ok {
+				c.Warnings = append(c.Warnings, problem+"; using its endpointslices instead")
+				continue
+			}
+			c.Warnings = append(c.Warnings, problem+"; some backends may be missing unless its endpointslices are provided instead")
+		}
+		c.EndpointSlices = append(c.EndpointSlices, EndpointSliceFromEndpoints(eps))
+	}
+	c.endpoints = nil
+}
+
+// EndpointSliceFromEndpoints converts a legacy Endpoints object into an equivalent EndpointSlice.
+func EndpointSliceFromEndpoints(eps *v1.Endpoints) *discoveryv1.EndpointSlice {
+	result := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: eps.Namespace,
+			Name:      eps.Name,
+			Labels:    map[string]string{discoveryv1.LabelServiceName: eps.Name},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+	}
+	for k, v := range eps.Labels {
+		result.Labels[k] = v
+	}
+	seen := make(map[string]struct{})
+	for _, subset := range eps.Subsets {
+		for _, p := range subset.Ports {
+			p := p
+			if _, ok := seen[p.Name]; ok {
+				continue
+			}
+			seen[p.Name] = struct{}{}
+			result.Ports = append(result.Ports, discoveryv1.EndpointPort{Name: &p.Name, Port: &p.Port, Protocol: &p.Protocol})
+		}
+		add := func(addrs []v1.EndpointAddress, ready bool) {
+			for _, a := range addrs {
+				ep := discoveryv1.Endpoint{
+					Addresses:  []string{a.IP},
+					Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+					NodeName:   a.NodeName,
+				}
+				if a.Hostname != "" {
+					ep.Hostname = &a.Hostname
+				}
+				if strings.Contains(a.IP, ":") {
+					result.AddressType = discoveryv1.AddressTypeIPv6
+				}
+				result.Endpoints = append(result.Endpoints, ep)
+			}
+		}
+		add(subset.Addresses, true)
+		add(subset.NotReadyAddresses, false)
+	}
+	return result
+}
+
+// sync replaces the contents of each store with the contents of the directory, logging any
+// warnings to l.
+func (dw *DirectoryWatcher) sync(l *zap.Logger, services, endpointSlices, nodes cache.Store) error {
+	c, err := dw.Load()
+	if err != nil {
+		return err
+	}
+	for _, w := range c.Warnings {
+		l.Warn(w, zap.String("dir", dw.Dir))
+	}
+	toInterfaces := func(n int, get func(int) interface{}) []interface{} {
+		result := make([]interface{}, n)
+		for i := range result {
+			result[i] = get(i)
+		}
+		return result
+	}
+	// Nodes first, since endpoints need them to determine their locality.
+	if nodes != nil {
+		if err := nodes.Replace(toInterfaces(len(c.Nodes), func(i int) interface{} { return c.Nodes[i] }), ""); err != nil {
+			return fmt.Errorf("replace nodes: %w", err)
+		}
+	}
+	if err := endpointSlices.Replace(toInterfaces(len(c.EndpointSlices), func(i int) interface{} { return c.EndpointSlices[i] }), ""); err != nil {
+		return fmt.Errorf("replace endpointslices: %w", err)
+	}
+	if err := services.Replace(toInterfaces(len(c.Services), func(i int) interface{} { return c.Services[i] }), ""); err != nil {
+		return fmt.Errorf("replace services: %w", err)
+	}
+	return nil
+}
+
+// LoadInto loads the directory into the provided stores once, replacing their contents.  nodes may
+// be nil.
+func (dw *DirectoryWatcher) LoadInto(services, endpointSlices, nodes cache.Store) error {
+	return dw.sync(zap.L(), services, endpointSlices, nodes)
+}
+
+// Watch loads the directory into the provided stores, and reloads it whenever a file changes, until
+// the context is done.  The initial load must succeed; errors in later loads are logged, and the
+// previous contents are kept until the files are fixed.  nodes may be nil.
+func (dw *DirectoryWatcher) Watch(ctx context.Context, services, endpointSlices, nodes cache.Store) error {
+	l := ctxzap.Extract(ctx)
+	interval := dw.Interval
+	if interval == 0 {
+		interval = time.Second
+	}
+	last, err := dw.fingerprint()
+	if err != nil {
+		return err
+	}
+	if err := dw.sync(l, services, endpointSlices, nodes); err != nil {
+		return fmt.Errorf("initial load: %w", err)
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+		fp, err := dw.fingerprint()
+		if err != nil {
+			l.Warn("problem checking directory for changes", zap.String("dir", dw.Dir), zap.Error(err))
+			continue
+		}
+		if fp == last {
+			continue
+		}
+		last = fp
+		l.Info("directory changed; reloading", zap.String("dir", dw.Dir))
+		if err := dw.sync(l, services, endpointSlices, nodes); err != nil {
+			l.Error("problem reloading directory; keeping previous contents", zap.String("dir", dw.Dir), zap.Error(err))
+		}
+	}
+}
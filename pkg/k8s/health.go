@@ -0,0 +1,119 @@
+package k8s
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Watch health, by resource and namespace; the namespace is "*" for a watch of every namespace.
+var (
+	watchSynced = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ekglue_k8s_watch_synced",
+		Help: "1 if the watch of a resource in a namespace has finished its initial list, 0 otherwise.",
+	}, []string{"resource", "namespace"})
+	watchLastEvent = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ekglue_k8s_watch_last_event_timestamp_seconds",
+		Help: "When the watch of a resource in a namespace last delivered a change or a list.",
+	}, []string{"resource", "namespace"})
+	watchErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ekglue_k8s_watch_errors",
+		Help: "The number of times a list or watch of a resource in a namespace failed to start, not counting routine expirations.",
+	}, []string{"resource", "namespace"})
+)
+
+// namespacedListWatch is a ListerWatcher for one namespace, or every namespace if namespace is
+// metav1.NamespaceAll.
+type namespacedListWatch struct {
+	cache.ListerWatcher
+	namespace string
+}
+
+// namespaceLabel returns the value of the namespace label of the watch health metrics.
+func namespaceLabel(namespace string) string {
+	if namespace == metav1.NamespaceAll {
+		return "*"
+	}
+	return namespace
+}
+
+// newReflector returns a reflector that feeds s from lw, and reports the health of its watch of
+// resource in lw's namespace.
+func newReflector(resource string, lw namespacedListWatch, expectedType interface{}, s cache.Store) *cache.Reflector {
+	ns := namespaceLabel(lw.namespace)
+	watchSynced.WithLabelValues(resource, ns).Set(0)
+	hlw := &healthListWatch{ListerWatcher: lw.ListerWatcher, errors: watchErrors.WithLabelValues(resource, ns)}
+	return cache.NewReflector(hlw, expectedType, &healthStore{Store: s, resource: resource, namespace: ns}, 0)
+}
+
+// healthListWatch is a ListerWatcher that counts the lists and watches that fail, like because
+// ekglue isn't allowed to watch the namespace.  Errors in the middle of a watch are almost always
+// expirations, and are not counted.
+type healthListWatch struct {
+	cache.ListerWatcher
+	errors prometheus.Counter
+}
+
+// count counts err, unless it's nil or routine: expired resource versions and closed connections
+// are part of every long-running watch.
+func (lw *healthListWatch) count(err error) {
+	if err == nil || apierrors.IsResourceExpired(err) || apierrors.IsGone(err) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return
+	}
+	lw.errors.Inc()
+}
+
+func (lw *healthListWatch) List(opts metav1.ListOptions) (runtime.Object, error) {
+	obj, err := lw.ListerWatcher.List(opts)
+	lw.count(err)
+	return obj, err
+}
+
+func (lw *healthListWatch) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	w, err := lw.ListerWatcher.Watch(opts)
+	lw.count(err)
+	return w, err
+}
+
+// healthStore is a cache.Store that records the events that a reflector delivers to it in the
+// watch health metrics.
+type healthStore struct {
+	cache.Store
+	resource, namespace string
+}
+
+func (s *healthStore) event() {
+	watchLastEvent.WithLabelValues(s.resource, s.namespace).Set(float64(time.Now().UnixNano()) / 1e9)
+}
+
+func (s *healthStore) Add(obj interface{}) error {
+	s.event()
+	return s.Store.Add(obj)
+}
+
+func (s *healthStore) Update(obj interface{}) error {
+	s.event()
+	return s.Store.Update(obj)
+}
+
+func (s *healthStore) Delete(obj interface{}) error {
+	s.event()
+	return s.Store.Delete(obj)
+}
+
+func (s *healthStore) Replace(objs []interface{}, resourceVersion string) error {
+	s.event()
+	if err := s.Store.Replace(objs, resourceVersion); err != nil {
+		return err
+	}
+	watchSynced.WithLabelValues(s.resource, s.namespace).Set(1)
+	return nil
+}
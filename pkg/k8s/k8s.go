@@ -2,24 +2,75 @@ package k8s
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/jrockway/opinionated-server/client"
+	authorizationv1 "k8s.io/api/authorization/v1"
 	v1 "k8s.io/api/core/v1"
 	discoveryv1 "k8s.io/api/discovery/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	authorizationv1client "k8s.io/client-go/kubernetes/typed/authorization/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+// The built-in resources that ekglue watches.
+var (
+	ServiceResource       = schema.GroupVersionResource{Version: "v1", Resource: "services"}
+	EndpointSliceResource = schema.GroupVersionResource{Group: "discovery.k8s.io", Version: "v1", Resource: "endpointslices"}
+	NodeResource          = schema.GroupVersionResource{Version: "v1", Resource: "nodes"}
+	PodResource           = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	IngressResource       = schema.GroupVersionResource{Group: "networking.k8s.io", Version: "v1", Resource: "ingresses"}
+)
+
+// CiliumEndpointResource is the CiliumEndpoint custom resource, which Cilium creates for every pod
+// it manages.
+var CiliumEndpointResource = schema.GroupVersionResource{Group: "cilium.io", Version: "v2", Resource: "ciliumendpoints"}
+
+// OpenShiftRouteResource is OpenShift's Route resource.
+var OpenShiftRouteResource = schema.GroupVersionResource{Group: "route.openshift.io", Version: "v1", Resource: "routes"}
+
+// DNSEndpointResource is external-dns's DNSEndpoint custom resource, whose endpoints external-dns
+// publishes as DNS records when its CRD source is enabled.
+var DNSEndpointResource = schema.GroupVersionResource{Group: "externaldns.k8s.io", Version: "v1alpha1", Resource: "dnsendpoints"}
+
+// EnvoyClusterResource is ekglue's EnvoyCluster custom resource, whose spec is an Envoy Cluster
+// that users declare in-cluster; see deploy/base/envoycluster-crd.yaml.
+var EnvoyClusterResource = schema.GroupVersionResource{Group: "ekglue.io", Version: "v1alpha1", Resource: "envoyclusters"}
+
 // ClusterWatcher watches services and endpoints inside of a cluster.
 type ClusterWatcher struct {
 	coreV1Client     rest.Interface
 	discoverV1Client rest.Interface
+	networkingClient rest.Interface
+	dynamicClient    dynamic.Interface
+	discoveryClient  discovery.DiscoveryInterface
+	configMaps       corev1client.ConfigMapsGetter
+	accessReviews    authorizationv1client.SelfSubjectAccessReviewsGetter
+
+	// Namespaces, if not empty, restricts watches of services and EndpointSlices to these
+	// namespaces.
+	Namespaces []string
+	// ServiceLabelSelector, if set, restricts watches of services and EndpointSlices to those
+	// with matching labels.
+	ServiceLabelSelector string
+	// ServiceFieldSelector, if set, restricts watches of services to those with matching fields.
+	ServiceFieldSelector string
 
 	// For tests, a ListerWatcher that will be used instead of the client-based ListerWatcher.
 	testLW cache.ListerWatcher
@@ -32,9 +83,18 @@ func New(config *rest.Config) (*ClusterWatcher, error) {
 	if err != nil {
 		return nil, fmt.Errorf("kubernetes: new client: %w", err)
 	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: new dynamic client: %w", err)
+	}
 	return &ClusterWatcher{
 		coreV1Client:     clientset.CoreV1().RESTClient(),
 		discoverV1Client: clientset.DiscoveryV1().RESTClient(),
+		networkingClient: clientset.NetworkingV1().RESTClient(),
+		dynamicClient:    dynamicClient,
+		discoveryClient:  clientset.Discovery(),
+		configMaps:       clientset.CoreV1(),
+		accessReviews:    clientset.AuthorizationV1(),
 	}, nil
 }
 
@@ -47,6 +107,19 @@ func ConnectOutOfCluster(kubeconfig, master string) (*ClusterWatcher, error) {
 	return New(config)
 }
 
+// ConnectContext connects to the API server of the named context in a kubeconfig file, or of its
+// current context if context is empty, so that several clusters can be watched with one file.
+func ConnectContext(kubeconfig, context string) (*ClusterWatcher, error) {
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfig},
+		&clientcmd.ConfigOverrides{CurrentContext: context},
+	).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: build config for context %q: %w", context, err)
+	}
+	return New(config)
+}
+
 // ConnectInCluster connects to the API server from a pod inside the cluster.
 func ConnectInCluster() (*ClusterWatcher, error) {
 	config, err := rest.InClusterConfig()
@@ -65,58 +138,224 @@ func (cw *ClusterWatcher) newListWatch(getter cache.Getter, resource, namespace
 	return cache.NewListWatchFromClient(getter, resource, namespace, fieldSelector)
 }
 
-// WatchServices notifes the provided ServiceReceiver of changes to services, in all namespaces.
+// newFilteredListWatches returns a ListerWatcher for each namespace in cw.Namespaces (or one for
+// all namespaces, if there are none) that watches the configured k8s API object with the built-in
+// client, restricted to objects matching the provided selectors.
+func (cw *ClusterWatcher) newFilteredListWatches(getter cache.Getter, resource, labelSelector, fieldSelector string) []namespacedListWatch {
+	namespaces := cw.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	result := make([]namespacedListWatch, 0, len(namespaces))
+	for _, ns := range namespaces {
+		if cw.testLW != nil {
+			result = append(result, namespacedListWatch{ListerWatcher: cw.testLW, namespace: ns})
+			continue
+		}
+		result = append(result, namespacedListWatch{
+			ListerWatcher: cache.NewFilteredListWatchFromClient(getter, resource, ns, func(opts *metav1.ListOptions) {
+				opts.LabelSelector = labelSelector
+				opts.FieldSelector = fieldSelector
+			}),
+			namespace: ns,
+		})
+	}
+	return result
+}
+
+// runReflectors runs a reflector for each ListerWatcher, feeding s, until the context is done.
+// When there is more than one, each reflector only replaces the objects it added itself, and a
+// tracked store is synced once every reflector has finished its initial list.  The health of each
+// reflector's watch of resource is reported by the ekglue_k8s_watch_* metrics.
+func runReflectors(ctx context.Context, resource string, lws []namespacedListWatch, expectedType interface{}, s cache.Store) {
+	if len(lws) == 1 {
+		newReflector(resource, lws[0], expectedType, s).Run(ctx.Done())
+		return
+	}
+	var syncMu sync.Mutex
+	unsynced := len(lws)
+	var wg sync.WaitGroup
+	for _, lw := range lws {
+		wg.Add(1)
+		go func(lw namespacedListWatch) {
+			defer wg.Done()
+			var once sync.Once
+			ns := &partialStore{Store: s, objs: make(map[string]interface{}), onReplace: func() {
+				once.Do(func() {
+					syncMu.Lock()
+					defer syncMu.Unlock()
+					if unsynced--; unsynced == 0 {
+						if ts, ok := s.(*trackedStore); ok {
+							ts.t.synced(ts.name)
+						}
+					}
+				})
+			}}
+			newReflector(resource, lw, expectedType, ns).Run(ctx.Done())
+		}(lw)
+	}
+	wg.Wait()
+}
+
+// partialStore is a cache.Store that is one of several feeding a shared underlying store, like one
+// of the per-namespace reflectors of a multi-namespace watch.  Replace only adds, updates, and
+// deletes the objects that went through this store, rather than replacing everything.
+type partialStore struct {
+	cache.Store
+	mu        sync.Mutex
+	objs      map[string]interface{}
+	onReplace func() // if non-nil, called after each successful Replace
+}
+
+func (s *partialStore) Add(obj interface{}) error {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.objs[key] = obj
+	s.mu.Unlock()
+	return s.Store.Add(obj)
+}
+
+func (s *partialStore) Update(obj interface{}) error {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.objs[key] = obj
+	s.mu.Unlock()
+	return s.Store.Update(obj)
+}
+
+func (s *partialStore) Delete(obj interface{}) error {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.objs, key)
+	s.mu.Unlock()
+	return s.Store.Delete(obj)
+}
+
+func (s *partialStore) Replace(objs []interface{}, _ string) error {
+	s.mu.Lock()
+	old := s.objs
+	s.objs = make(map[string]interface{})
+	s.mu.Unlock()
+	for _, obj := range objs {
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			return err
+		}
+		if _, ok := old[key]; ok {
+			delete(old, key)
+			if err := s.Update(obj); err != nil {
+				return err
+			}
+		} else if err := s.Add(obj); err != nil {
+			return err
+		}
+	}
+	for _, obj := range old {
+		if err := s.Delete(obj); err != nil {
+			return err
+		}
+	}
+	if s.onReplace != nil {
+		s.onReplace()
+	}
+	return nil
+}
+
+// newDynamicListWatch returns a ListerWatcher that watches a custom resource with the dynamic
+// client.  Objects are returned as *unstructured.Unstructured.
+func (cw *ClusterWatcher) newDynamicListWatch(resource schema.GroupVersionResource) cache.ListerWatcher {
+	if cw.testLW != nil {
+		return cw.testLW
+	}
+	ri := cw.dynamicClient.Resource(resource)
+	return &cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			return ri.List(context.Background(), opts)
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			return ri.Watch(context.Background(), opts)
+		},
+	}
+}
+
+// WatchServices notifes the provided ServiceReceiver of changes to services, in all namespaces
+// (or cw.Namespaces), that match the configured selectors.
 func (cw *ClusterWatcher) WatchServices(ctx context.Context, s cache.Store) error {
-	lw := cw.newListWatch(cw.coreV1Client, "services", "", fields.Everything())
-	r := cache.NewReflector(lw, &v1.Service{}, s, 0)
-	r.Run(ctx.Done())
+	lws := cw.newFilteredListWatches(cw.coreV1Client, "services", cw.ServiceLabelSelector, cw.ServiceFieldSelector)
+	runReflectors(ctx, "services", lws, &v1.Service{}, s)
 	return nil
 }
 
-// ListServices sends all services to the provided cache.Store.
+// ListServices sends all services that WatchServices would watch to the provided cache.Store.
 func (cw *ClusterWatcher) ListServices(s cache.Store) error {
-	lw := cw.newListWatch(cw.coreV1Client, "services", "", fields.Everything())
-	raw, err := lw.List(metav1.ListOptions{})
-	if err != nil {
-		return fmt.Errorf("list: %v", err)
-	}
-	for _, rawSvc := range raw.(*v1.ServiceList).Items {
-		svc := rawSvc
-		if err := s.Add(&svc); err != nil {
-			return fmt.Errorf("add service: %v", err)
+	for _, lw := range cw.newFilteredListWatches(cw.coreV1Client, "services", cw.ServiceLabelSelector, cw.ServiceFieldSelector) {
+		raw, err := lw.List(metav1.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("list: %v", err)
+		}
+		for _, rawSvc := range raw.(*v1.ServiceList).Items {
+			svc := rawSvc
+			if err := s.Add(&svc); err != nil {
+				return fmt.Errorf("add service: %v", err)
+			}
 		}
 	}
 	return nil
 }
 
-// WatchEndpointSlices notifes the provided cache.Store of changes to EndpointSlices, in all namespaces.
+// WatchEndpointSlices notifes the provided cache.Store of changes to EndpointSlices, in all
+// namespaces (or cw.Namespaces), that match cw.ServiceLabelSelector.
 func (cw *ClusterWatcher) WatchEndpointSlices(ctx context.Context, s cache.Store) error {
-	lw := cw.newListWatch(cw.discoverV1Client, "endpointslices", "", fields.Everything())
-	r := cache.NewReflector(lw, &discoveryv1.EndpointSlice{}, s, 0)
-	r.Run(ctx.Done())
+	lws := cw.newFilteredListWatches(cw.discoverV1Client, "endpointslices", cw.ServiceLabelSelector, "")
+	runReflectors(ctx, "endpointslices", lws, &discoveryv1.EndpointSlice{}, s)
 	return nil
 }
 
-// ListEndpointSlices sends all EndpointSlices to the provided cache.Store.
+// ListEndpointSlices sends all EndpointSlices that WatchEndpointSlices would watch to the provided
+// cache.Store.
 func (cw *ClusterWatcher) ListEndpointSlices(s cache.Store) error {
-	lw := cw.newListWatch(cw.discoverV1Client, "endpointslices", "", fields.Everything())
-	raw, err := lw.List(metav1.ListOptions{})
-	if err != nil {
-		return fmt.Errorf("list: %v", err)
-	}
-	list, ok := raw.(*discoveryv1.EndpointSliceList)
-	if !ok {
-		return fmt.Errorf("unexpected type: %T", raw)
-	}
-	for _, rawEp := range list.Items {
-		ep := rawEp
-		if err := s.Add(&ep); err != nil {
-			return fmt.Errorf("add endpoint: %v", err)
+	for _, lw := range cw.newFilteredListWatches(cw.discoverV1Client, "endpointslices", cw.ServiceLabelSelector, "") {
+		raw, err := lw.List(metav1.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("list: %v", err)
+		}
+		list, ok := raw.(*discoveryv1.EndpointSliceList)
+		if !ok {
+			return fmt.Errorf("unexpected type: %T", raw)
+		}
+		for _, rawEp := range list.Items {
+			ep := rawEp
+			if err := s.Add(&ep); err != nil {
+				return fmt.Errorf("add endpoint: %v", err)
+			}
 		}
 	}
 	return nil
 }
 
+// WatchServiceEndpointSlices notifies the provided cache.Store of changes to the EndpointSlices of
+// one service, regardless of cw.Namespaces and cw.ServiceLabelSelector, for watching services on
+// demand.
+func (cw *ClusterWatcher) WatchServiceEndpointSlices(ctx context.Context, namespace, service string, s cache.Store) error {
+	lw := namespacedListWatch{ListerWatcher: cw.testLW, namespace: namespace}
+	if cw.testLW == nil {
+		lw.ListerWatcher = cache.NewFilteredListWatchFromClient(cw.discoverV1Client, "endpointslices", namespace, func(opts *metav1.ListOptions) {
+			opts.LabelSelector = discoveryv1.LabelServiceName + "=" + service
+		})
+	}
+	runReflectors(ctx, "endpointslices", []namespacedListWatch{lw}, &discoveryv1.EndpointSlice{}, s)
+	return nil
+}
+
 // WatchNodes notifes the provided cache.Store of changes to nodes.
 func (cw *ClusterWatcher) WatchNodes(ctx context.Context, s cache.Store) error {
 	lw := cw.newListWatch(cw.coreV1Client, "nodes", "", fields.Everything())
@@ -140,3 +379,266 @@ func (cw *ClusterWatcher) ListNodes(s cache.Store) error {
 	}
 	return nil
 }
+
+// newPodListWatch returns a ListerWatcher for pods, in all namespaces, that match labelSelector.
+func (cw *ClusterWatcher) newPodListWatch(labelSelector string) cache.ListerWatcher {
+	if cw.testLW != nil {
+		return cw.testLW
+	}
+	return cache.NewFilteredListWatchFromClient(cw.coreV1Client, "pods", "", func(opts *metav1.ListOptions) {
+		opts.LabelSelector = labelSelector
+	})
+}
+
+// WatchPods notifies the provided cache.Store of changes to pods matching labelSelector (which may
+// be empty to watch every pod), in all namespaces.
+func (cw *ClusterWatcher) WatchPods(ctx context.Context, s cache.Store, labelSelector string) error {
+	r := cache.NewReflector(cw.newPodListWatch(labelSelector), &v1.Pod{}, s, 0)
+	r.Run(ctx.Done())
+	return nil
+}
+
+// ListPods sends all pods matching labelSelector to the provided cache.Store.
+func (cw *ClusterWatcher) ListPods(s cache.Store, labelSelector string) error {
+	raw, err := cw.newPodListWatch(labelSelector).List(metav1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return fmt.Errorf("list: %v", err)
+	}
+	for _, rawPod := range raw.(*v1.PodList).Items {
+		pod := rawPod
+		if err := s.Add(&pod); err != nil {
+			return fmt.Errorf("add pod: %v", err)
+		}
+	}
+	return nil
+}
+
+// WatchCiliumEndpoints notifies the provided cache.Store of changes to CiliumEndpoints, in all
+// namespaces.  The objects are *unstructured.Unstructured, so that ekglue doesn't need to depend on
+// Cilium.
+func (cw *ClusterWatcher) WatchCiliumEndpoints(ctx context.Context, s cache.Store) error {
+	lw := cw.newDynamicListWatch(CiliumEndpointResource)
+	r := cache.NewReflector(lw, &unstructured.Unstructured{}, s, 0)
+	r.Run(ctx.Done())
+	return nil
+}
+
+// ListCiliumEndpoints sends all CiliumEndpoints to the provided cache.Store.
+func (cw *ClusterWatcher) ListCiliumEndpoints(s cache.Store) error {
+	lw := cw.newDynamicListWatch(CiliumEndpointResource)
+	raw, err := lw.List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("list: %v", err)
+	}
+	list, ok := raw.(*unstructured.UnstructuredList)
+	if !ok {
+		return fmt.Errorf("unexpected type: %T", raw)
+	}
+	for i := range list.Items {
+		if err := s.Add(&list.Items[i]); err != nil {
+			return fmt.Errorf("add cilium endpoint: %v", err)
+		}
+	}
+	return nil
+}
+
+// HasResource returns true if the API server serves the provided resource, for optional APIs like
+// OpenShift's.
+func (cw *ClusterWatcher) HasResource(resource schema.GroupVersionResource) (bool, error) {
+	list, err := cw.discoveryClient.ServerResourcesForGroupVersion(resource.GroupVersion().String())
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("discover resources for %s: %w", resource.GroupVersion(), err)
+	}
+	for _, r := range list.APIResources {
+		if r.Name == resource.Resource {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ServerVersion returns the API server's version, which also checks that it can be reached with
+// the watcher's credentials.
+func (cw *ClusterWatcher) ServerVersion() (string, error) {
+	v, err := cw.discoveryClient.ServerVersion()
+	if err != nil {
+		return "", fmt.Errorf("get server version: %w", err)
+	}
+	return v.GitVersion, nil
+}
+
+// CanI returns true if the watcher's credentials allow verb on resource in namespace, or in every
+// namespace if namespace is empty.  If not, the reason is the API server's explanation, if any.
+func (cw *ClusterWatcher) CanI(ctx context.Context, verb string, resource schema.GroupVersionResource, namespace string) (allowed bool, reason string, err error) {
+	review, err := cw.accessReviews.SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      verb,
+				Group:     resource.Group,
+				Version:   resource.Version,
+				Resource:  resource.Resource,
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, "", fmt.Errorf("review access to %s %s: %w", verb, resource.GroupResource(), err)
+	}
+	return review.Status.Allowed, review.Status.Reason, nil
+}
+
+// WatchOpenShiftRoutes notifies the provided cache.Store of changes to OpenShift Routes, in all
+// namespaces.  The objects are *unstructured.Unstructured.
+func (cw *ClusterWatcher) WatchOpenShiftRoutes(ctx context.Context, s cache.Store) error {
+	lw := cw.newDynamicListWatch(OpenShiftRouteResource)
+	r := cache.NewReflector(lw, &unstructured.Unstructured{}, s, 0)
+	r.Run(ctx.Done())
+	return nil
+}
+
+// WatchEnvoyClusters notifies the provided cache.Store of changes to EnvoyClusters, in all
+// namespaces.  The objects are *unstructured.Unstructured.
+func (cw *ClusterWatcher) WatchEnvoyClusters(ctx context.Context, s cache.Store) error {
+	lw := cw.newDynamicListWatch(EnvoyClusterResource)
+	r := cache.NewReflector(lw, &unstructured.Unstructured{}, s, 0)
+	r.Run(ctx.Done())
+	return nil
+}
+
+// WatchIngresses notifies the provided cache.Store of changes to networking.k8s.io/v1 Ingresses, in
+// all namespaces.
+func (cw *ClusterWatcher) WatchIngresses(ctx context.Context, s cache.Store) error {
+	lw := cw.newListWatch(cw.networkingClient, "ingresses", "", fields.Everything())
+	r := cache.NewReflector(lw, &networkingv1.Ingress{}, s, 0)
+	r.Run(ctx.Done())
+	return nil
+}
+
+// PublishConfigMap creates or updates the named ConfigMap so that its data is exactly data.
+func (cw *ClusterWatcher) PublishConfigMap(ctx context.Context, namespace, name string, data map[string]string) error {
+	client := cw.configMaps.ConfigMaps(namespace)
+	cm, err := client.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Data:       data,
+		}
+		if _, err := client.Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("create configmap %s/%s: %w", namespace, name, err)
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("get configmap %s/%s: %w", namespace, name, err)
+	}
+	cm.Data = data
+	if _, err := client.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("update configmap %s/%s: %w", namespace, name, err)
+	}
+	return nil
+}
+
+// PublishDNSEndpoint creates or updates a DNSEndpoint, replacing its endpoints.  endpoints is
+// marshaled to JSON, and must marshal to a list of objects in the format of external-dns's
+// Endpoint, like {"dnsName": "...", "recordType": "TXT", "targets": ["..."]}.
+func (cw *ClusterWatcher) PublishDNSEndpoint(ctx context.Context, namespace, name string, endpoints interface{}) error {
+	js, err := json.Marshal(endpoints)
+	if err != nil {
+		return fmt.Errorf("marshal endpoints: %w", err)
+	}
+	var list []interface{}
+	if err := json.Unmarshal(js, &list); err != nil {
+		return fmt.Errorf("unmarshal endpoints: %w", err)
+	}
+	if list == nil {
+		list = []interface{}{}
+	}
+	client := cw.dynamicClient.Resource(DNSEndpointResource).Namespace(namespace)
+	obj, err := client.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		obj = &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": DNSEndpointResource.GroupVersion().String(),
+			"kind":       "DNSEndpoint",
+			"metadata":   map[string]interface{}{"namespace": namespace, "name": name},
+		}}
+		if err := unstructured.SetNestedSlice(obj.Object, list, "spec", "endpoints"); err != nil {
+			return fmt.Errorf("set endpoints: %w", err)
+		}
+		if _, err := client.Create(ctx, obj, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("create dnsendpoint %s/%s: %w", namespace, name, err)
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("get dnsendpoint %s/%s: %w", namespace, name, err)
+	}
+	if err := unstructured.SetNestedSlice(obj.Object, list, "spec", "endpoints"); err != nil {
+		return fmt.Errorf("set endpoints: %w", err)
+	}
+	if _, err := client.Update(ctx, obj, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("update dnsendpoint %s/%s: %w", namespace, name, err)
+	}
+	return nil
+}
+
+// ConfigMapSnapshot is an xds.SnapshotStore that keeps each manager's snapshot in its own key of a
+// ConfigMap.  A ConfigMap holds at most 1MiB, so larger configurations should use an
+// xds.FileSnapshot on a persistent volume instead.
+type ConfigMapSnapshot struct {
+	Watcher   *ClusterWatcher
+	Namespace string
+	Name      string
+
+	mu sync.Mutex // serializes updates, which read, modify, and write the whole ConfigMap
+}
+
+func (s *ConfigMapSnapshot) key(manager string) string {
+	return manager + ".json"
+}
+
+// Save implements xds.SnapshotStore.
+func (s *ConfigMapSnapshot) Save(manager string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ctx, c := context.WithTimeout(context.Background(), 10*time.Second)
+	defer c()
+	client := s.Watcher.configMaps.ConfigMaps(s.Namespace)
+	cm, err := client.Get(ctx, s.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: s.Namespace, Name: s.Name},
+			Data:       map[string]string{s.key(manager): string(data)},
+		}
+		if _, err := client.Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("create configmap %s/%s: %w", s.Namespace, s.Name, err)
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("get configmap %s/%s: %w", s.Namespace, s.Name, err)
+	}
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	cm.Data[s.key(manager)] = string(data)
+	if _, err := client.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("update configmap %s/%s: %w", s.Namespace, s.Name, err)
+	}
+	return nil
+}
+
+// Load implements xds.SnapshotStore.
+func (s *ConfigMapSnapshot) Load(manager string) ([]byte, error) {
+	ctx, c := context.WithTimeout(context.Background(), 10*time.Second)
+	defer c()
+	cm, err := s.Watcher.configMaps.ConfigMaps(s.Namespace).Get(ctx, s.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("get configmap %s/%s: %w", s.Namespace, s.Name, err)
+	}
+	data, ok := cm.Data[s.key(manager)]
+	if !ok {
+		return nil, nil
+	}
+	return []byte(data), nil
+}
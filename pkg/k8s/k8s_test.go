@@ -2,17 +2,28 @@ package k8s
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"sort"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	authorizationv1 "k8s.io/api/authorization/v1"
 	v1 "k8s.io/api/core/v1"
 	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
@@ -67,6 +78,12 @@ func TestListers(t *testing.T) {
 	if err := cw.ListNodes(store); err != nil {
 		t.Errorf("ListNodes: %v", err)
 	}
+	list = &unstructured.UnstructuredList{
+		Items: []unstructured.Unstructured{{Object: map[string]interface{}{"metadata": map[string]interface{}{"name": "a"}}}},
+	}
+	if err := cw.ListCiliumEndpoints(store); err != nil {
+		t.Errorf("ListCiliumEndpoints: %v", err)
+	}
 }
 
 type watcher struct {
@@ -185,3 +202,370 @@ func TestWatchers(t *testing.T) {
 		}
 	}
 }
+
+func TestPartialStore(t *testing.T) {
+	s := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	svc := func(ns, name string) *v1.Service {
+		return &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name}}
+	}
+	a := &partialStore{Store: s, objs: make(map[string]interface{})}
+	b := &partialStore{Store: s, objs: make(map[string]interface{})}
+	if err := a.Replace([]interface{}{svc("a", "one"), svc("a", "two")}, ""); err != nil {
+		t.Fatalf("replace a: %v", err)
+	}
+	if err := b.Add(svc("b", "one")); err != nil {
+		t.Fatalf("add b: %v", err)
+	}
+	// Relisting one namespace leaves the other alone.
+	if err := a.Replace([]interface{}{svc("a", "two"), svc("a", "three")}, ""); err != nil {
+		t.Fatalf("replace a again: %v", err)
+	}
+	got := s.ListKeys()
+	sort.Strings(got)
+	if diff := cmp.Diff(got, []string{"a/three", "a/two", "b/one"}); diff != "" {
+		t.Errorf("keys:\n%s", diff)
+	}
+}
+
+func TestSyncTracker(t *testing.T) {
+	tracker := NewSyncTracker()
+	services := tracker.Track("services", cache.NewStore(cache.MetaNamespaceKeyFunc))
+	nodes := tracker.Track("nodes", cache.NewStore(cache.MetaNamespaceKeyFunc))
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		tracker.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code
+	}
+	if got, want := ready(), http.StatusServiceUnavailable; got != want {
+		t.Errorf("status before sync:\n  got: %v\n want: %v", got, want)
+	}
+
+	if err := nodes.Replace(nil, ""); err != nil {
+		t.Fatalf("replace nodes: %v", err)
+	}
+	if diff := cmp.Diff(tracker.Pending(), []string{"services"}); diff != "" {
+		t.Errorf("pending after nodes sync:\n%s", diff)
+	}
+
+	// With several namespaces, the store is synced once every reflector has listed.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lw := func(ns string, failures int) namespacedListWatch {
+		return namespacedListWatch{
+			ListerWatcher: &cache.ListWatch{
+				ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+					if failures > 0 {
+						failures--
+						return nil, apierrors.NewForbidden(schema.GroupResource{Resource: "services"}, "", errors.New("no"))
+					}
+					return &v1.ServiceList{}, nil
+				},
+				WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+					return watch.NewFake(), nil
+				},
+			},
+			namespace: ns,
+		}
+	}
+	go runReflectors(ctx, "services", []namespacedListWatch{lw("a", 0), lw("b", 1)}, &v1.Service{}, services)
+	select {
+	case <-tracker.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for sync; pending: %v", tracker.Pending())
+	}
+	if got, want := ready(), http.StatusOK; got != want {
+		t.Errorf("status after sync:\n  got: %v\n want: %v", got, want)
+	}
+	for ns, want := range map[string]float64{"a": 0, "b": 1} {
+		if got := testutil.ToFloat64(watchSynced.WithLabelValues("services", ns)); got != 1 {
+			t.Errorf("namespace %s: synced:\n  got: %v\n want: 1", ns, got)
+		}
+		if got := testutil.ToFloat64(watchErrors.WithLabelValues("services", ns)); got != want {
+			t.Errorf("namespace %s: errors:\n  got: %v\n want: %v", ns, got, want)
+		}
+	}
+	// Later relists don't matter.
+	if err := nodes.Replace(nil, ""); err != nil {
+		t.Fatalf("replace nodes again: %v", err)
+	}
+}
+
+func TestDirectoryWatcher(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("objects.yaml", `
+apiVersion: v1
+kind: Service
+metadata:
+    name: foo
+spec:
+    ports:
+        - name: http
+          port: 80
+---
+apiVersion: v1
+kind: Endpoints
+metadata:
+    name: foo
+subsets:
+    - addresses:
+          - ip: 10.0.0.1
+      notReadyAddresses:
+          - ip: 10.0.0.2
+      ports:
+          - name: http
+            port: 8080
+`)
+	write("README.md", "not an object")
+
+	services := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	slices := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	dw := &DirectoryWatcher{Dir: dir, Interval: time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	doneCh := make(chan error)
+	go func() { doneCh <- dw.Watch(ctx, services, slices, nil) }()
+
+	waitFor := func(what string, f func() bool) {
+		t.Helper()
+		for !f() {
+			select {
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for %s", what)
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+	waitFor("initial load", func() bool { return len(slices.ListKeys()) == 1 })
+	if got, want := services.ListKeys(), []string{"default/foo"}; !cmp.Equal(got, want) {
+		t.Errorf("services:\n  got: %v\n want: %v", got, want)
+	}
+	obj, _, _ := slices.GetByKey("default/foo")
+	es := obj.(*discoveryv1.EndpointSlice)
+	if got, want := len(es.Endpoints), 2; got != want {
+		t.Errorf("endpoint count:\n  got: %v\n want: %v", got, want)
+	}
+	if got, want := es.Labels[discoveryv1.LabelServiceName], "foo"; got != want {
+		t.Errorf("service name label:\n  got: %v\n want: %v", got, want)
+	}
+
+	write("more.json", `{"apiVersion": "v1", "kind": "Service", "metadata": {"namespace": "bar", "name": "baz"}}`)
+	waitFor("reload", func() bool { return len(services.ListKeys()) == 2 })
+
+	// A broken file keeps the previous contents.
+	write("broken.yaml", "kind: Nonsense")
+	time.Sleep(10 * time.Millisecond)
+	if got := len(services.ListKeys()); got != 2 {
+		t.Errorf("services after broken file: got %d, want 2", got)
+	}
+
+	cancel()
+	if err := <-doneCh; !errors.Is(err, context.Canceled) {
+		t.Errorf("watch: unexpected error: %v", err)
+	}
+}
+
+func TestLargeEndpoints(t *testing.T) {
+	endpoints := func(name string, n int, annotations map[string]string) *v1.Endpoints {
+		result := &v1.Endpoints{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Endpoints"},
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Annotations: annotations},
+			Subsets:    []v1.EndpointSubset{{Ports: []v1.EndpointPort{{Name: "http", Port: 8080}}}},
+		}
+		for i := 0; i < n; i++ {
+			result.Subsets[0].Addresses = append(result.Subsets[0].Addresses, v1.EndpointAddress{IP: fmt.Sprintf("10.0.%d.%d", i/256, i%256)})
+		}
+		return result
+	}
+	slice := &discoveryv1.EndpointSlice{
+		TypeMeta: metav1.TypeMeta{APIVersion: "discovery.k8s.io/v1", Kind: "EndpointSlice"},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "big-abcde",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "big"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+	}
+	dir := t.TempDir()
+	for i, obj := range []interface{}{
+		endpoints("small", 3, nil),
+		endpoints("big", 950, nil),
+		slice,
+		endpoints("truncated", EndpointsCapacity, map[string]string{v1.EndpointsOverCapacity: "truncated"}),
+	} {
+		js, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.json", i)), js, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := (&DirectoryWatcher{Dir: dir}).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, es := range c.EndpointSlices {
+		got = append(got, fmt.Sprintf("%s/%d", es.Name, len(es.Endpoints)))
+	}
+	want := []string{"big-abcde/0", "small/3", "truncated/1000"}
+	if diff := cmp.Diff(got, want, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+		t.Errorf("endpoint slices:\n%s", diff)
+	}
+	want = []string{
+		"endpoints default/big has 950 addresses, near the 1000 that kubernetes keeps; using its endpointslices instead",
+		"endpoints default/truncated was truncated to 1000 addresses by kubernetes; some backends may be missing unless its endpointslices are provided instead",
+	}
+	if diff := cmp.Diff(c.Warnings, want); diff != "" {
+		t.Errorf("warnings:\n%s", diff)
+	}
+}
+
+func TestPublishConfigMap(t *testing.T) {
+	// A minimal API server that stores one ConfigMap.
+	var stored *v1.ConfigMap
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch req.Method {
+		case http.MethodGet:
+			if stored == nil {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(&metav1.Status{TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}, Status: metav1.StatusFailure, Reason: metav1.StatusReasonNotFound, Code: http.StatusNotFound})
+				return
+			}
+		case http.MethodPost, http.MethodPut:
+			if req.Method == http.MethodPost && stored != nil {
+				t.Error("create called for an existing configmap")
+			}
+			stored = new(v1.ConfigMap)
+			if err := json.NewDecoder(req.Body).Decode(stored); err != nil {
+				t.Errorf("decode configmap: %v", err)
+			}
+		}
+		json.NewEncoder(w).Encode(stored)
+	}))
+	defer srv.Close()
+	cw, err := New(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	for _, data := range []map[string]string{{"a": "1"}, {"b": "2"}} {
+		if err := cw.PublishConfigMap(context.Background(), "ekglue", "clusters", data); err != nil {
+			t.Fatalf("publish %v: %v", data, err)
+		}
+		if diff := cmp.Diff(stored.Data, data); diff != "" {
+			t.Errorf("configmap data:\n%s", diff)
+		}
+	}
+}
+
+func TestPublishDNSEndpoint(t *testing.T) {
+	// A minimal API server that stores one DNSEndpoint.
+	var stored map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch req.Method {
+		case http.MethodGet:
+			if stored == nil {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(&metav1.Status{TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}, Status: metav1.StatusFailure, Reason: metav1.StatusReasonNotFound, Code: http.StatusNotFound})
+				return
+			}
+		case http.MethodPost, http.MethodPut:
+			if req.Method == http.MethodPost && stored != nil {
+				t.Error("create called for an existing dnsendpoint")
+			}
+			stored = nil
+			if err := json.NewDecoder(req.Body).Decode(&stored); err != nil {
+				t.Errorf("decode dnsendpoint: %v", err)
+			}
+		}
+		json.NewEncoder(w).Encode(stored)
+	}))
+	defer srv.Close()
+	cw, err := New(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	type record struct {
+		DNSName    string   `json:"dnsName"`
+		RecordType string   `json:"recordType"`
+		Targets    []string `json:"targets"`
+	}
+	for _, records := range [][]record{
+		{{DNSName: "_ekglue.example.com", RecordType: "TXT", Targets: []string{"ekglue-cluster=foo:web:http"}}},
+		{},
+	} {
+		if err := cw.PublishDNSEndpoint(context.Background(), "ekglue", "clusters", records); err != nil {
+			t.Fatalf("publish %v: %v", records, err)
+		}
+		if got, want := stored["kind"], "DNSEndpoint"; got != want {
+			t.Errorf("kind:\n  got: %v\n want: %v", got, want)
+		}
+		endpoints, _, err := unstructured.NestedSlice(stored, "spec", "endpoints")
+		if err != nil {
+			t.Fatalf("endpoints: %v", err)
+		}
+		js, err := json.Marshal(endpoints)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []record
+		if err := json.Unmarshal(js, &got); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(got, records, cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("dnsendpoint endpoints:\n%s", diff)
+		}
+	}
+}
+
+func TestCanI(t *testing.T) {
+	// A minimal API server that only lets ekglue list services.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/version":
+			json.NewEncoder(w).Encode(map[string]string{"gitVersion": "v1.28.3"})
+		case "/apis/authorization.k8s.io/v1/selfsubjectaccessreviews":
+			review := new(authorizationv1.SelfSubjectAccessReview)
+			if err := json.NewDecoder(req.Body).Decode(review); err != nil {
+				t.Errorf("decode access review: %v", err)
+			}
+			a := review.Spec.ResourceAttributes
+			if a.Resource == "services" && a.Verb == "list" {
+				review.Status.Allowed = true
+			} else {
+				review.Status.Reason = "no RBAC policy matched"
+			}
+			json.NewEncoder(w).Encode(review)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer srv.Close()
+	cw, err := New(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	if v, err := cw.ServerVersion(); err != nil || v != "v1.28.3" {
+		t.Errorf("server version: got %q, %v; want v1.28.3", v, err)
+	}
+	ctx := context.Background()
+	if ok, _, err := cw.CanI(ctx, "list", ServiceResource, ""); err != nil || !ok {
+		t.Errorf("list services: got %v, %v; want allowed", ok, err)
+	}
+	ok, reason, err := cw.CanI(ctx, "watch", EndpointSliceResource, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || reason != "no RBAC policy matched" {
+		t.Errorf("watch endpointslices: got %v (%q); want denied with a reason", ok, reason)
+	}
+}
@@ -0,0 +1,98 @@
+package k8s
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+// SyncTracker tracks whether the stores fed by watches have received their initial list of
+// objects.  A reflector calls Replace on its store once its initial List completes, so a tracked
+// store is synced after its first successful Replace.  Until every tracked store is synced, the
+// resources generated from them are incomplete, and serving them would make clients delete
+// everything that's missing.
+type SyncTracker struct {
+	mu      sync.Mutex
+	pending map[string]struct{}
+	done    chan struct{}
+}
+
+// NewSyncTracker returns a SyncTracker with no tracked stores.
+func NewSyncTracker() *SyncTracker {
+	return &SyncTracker{
+		pending: make(map[string]struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Track returns a cache.Store that passes everything through to s, and that is pending, under the
+// provided name, until its first Replace succeeds.  Every store should be tracked before any of
+// them are synced, since the tracker is done as soon as nothing is pending.
+func (t *SyncTracker) Track(name string, s cache.Store) cache.Store {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[name] = struct{}{}
+	return &trackedStore{Store: s, t: t, name: name}
+}
+
+// synced marks the named store as synced.
+func (t *SyncTracker) synced(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.pending[name]; !ok {
+		return
+	}
+	delete(t.pending, name)
+	if len(t.pending) == 0 {
+		close(t.done)
+	}
+}
+
+// Done returns a channel that is closed once every tracked store is synced.
+func (t *SyncTracker) Done() <-chan struct{} {
+	return t.done
+}
+
+// Pending returns the sorted names of the tracked stores that are not yet synced.
+func (t *SyncTracker) Pending() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result := make([]string, 0, len(t.pending))
+	for name := range t.pending {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// ServeHTTP implements http.Handler, for use as a readiness probe.  It responds with 200 OK once
+// every tracked store is synced, and 503 Service Unavailable, naming the pending stores, until
+// then.
+func (t *SyncTracker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	select {
+	case <-t.done:
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+	default:
+		http.Error(w, fmt.Sprintf("waiting for initial sync of: %s", strings.Join(t.Pending(), ", ")), http.StatusServiceUnavailable)
+	}
+}
+
+// trackedStore is a cache.Store that reports its first successful Replace to a SyncTracker.
+type trackedStore struct {
+	cache.Store
+	t    *SyncTracker
+	name string
+}
+
+func (s *trackedStore) Replace(objs []interface{}, resourceVersion string) error {
+	if err := s.Store.Replace(objs, resourceVersion); err != nil {
+		return err
+	}
+	s.t.synced(s.name)
+	return nil
+}
@@ -0,0 +1,176 @@
+// Package nomad implements a glue.Source that discovers services registered with Nomad's native
+// service discovery.
+package nomad
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"github.com/jrockway/ekglue/pkg/glue"
+	"go.uber.org/zap"
+)
+
+// Source watches Nomad's services API.
+type Source struct {
+	// Address is the base URL of the Nomad HTTP API, like "http://nomad.service.consul:4646".
+	Address string
+	// Namespace is the Nomad namespace to watch; "*" (the default) watches all namespaces.
+	Namespace string
+	// Token is the Nomad ACL token to send, if any.
+	Token string
+	// Client is the HTTP client to use; http.DefaultClient if nil.
+	Client *http.Client
+	// WaitTime is how long each blocking query waits for changes; Nomad's default if zero.
+	WaitTime time.Duration
+	// RetryInterval is how long to wait after a failed query; 5 seconds if zero.
+	RetryInterval time.Duration
+}
+
+var _ glue.Source = (*Source)(nil)
+
+// Name implements glue.Source.
+func (s *Source) Name() string {
+	return "nomad"
+}
+
+// serviceList is an element of the response from /v1/services.
+type serviceList struct {
+	Namespace string
+	Services  []struct {
+		ServiceName string
+	}
+}
+
+// registration is an element of the response from /v1/service/:name.
+type registration struct {
+	Namespace   string
+	ServiceName string
+	Datacenter  string
+	Address     string
+	Port        int32
+}
+
+// get performs a GET request against the Nomad API, decoding the response into result and
+// returning the response's index.
+func (s *Source) get(ctx context.Context, path string, query url.Values, result any) (uint64, error) {
+	u, err := url.Parse(s.Address)
+	if err != nil {
+		return 0, fmt.Errorf("parse address: %w", err)
+	}
+	u = u.JoinPath(path)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return 0, fmt.Errorf("new request: %w", err)
+	}
+	if s.Token != "" {
+		req.Header.Set("X-Nomad-Token", s.Token)
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("get %s: %w", path, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("get %s: unexpected status %s", path, res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+		return 0, fmt.Errorf("get %s: decode response: %w", path, err)
+	}
+	index, _ := strconv.ParseUint(res.Header.Get("X-Nomad-Index"), 10, 64)
+	return index, nil
+}
+
+// snapshot lists every service and its registrations.  If index is non-zero, the list blocks
+// until the services have changed since index.
+func (s *Source) snapshot(ctx context.Context, index uint64) ([]*glue.SourceService, uint64, error) {
+	ns := s.Namespace
+	if ns == "" {
+		ns = "*"
+	}
+	q := url.Values{"namespace": {ns}}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		if s.WaitTime > 0 {
+			q.Set("wait", s.WaitTime.String())
+		}
+	}
+	var lists []serviceList
+	newIndex, err := s.get(ctx, "/v1/services", q, &lists)
+	if err != nil {
+		return nil, 0, err
+	}
+	var result []*glue.SourceService
+	for _, list := range lists {
+		for _, svc := range list.Services {
+			var regs []registration
+			if _, err := s.get(ctx, "/v1/service/"+url.PathEscape(svc.ServiceName), url.Values{"namespace": {list.Namespace}}, &regs); err != nil {
+				return nil, 0, err
+			}
+			ss := &glue.SourceService{Namespace: list.Namespace, Name: svc.ServiceName}
+			for _, r := range regs {
+				ss.Endpoints = append(ss.Endpoints, &glue.SourceEndpoint{
+					Address:  r.Address,
+					Port:     r.Port,
+					Locality: &envoy_config_core_v3.Locality{Region: r.Datacenter},
+				})
+			}
+			result = append(result, ss)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Namespace != result[j].Namespace {
+			return result[i].Namespace < result[j].Namespace
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result, newIndex, nil
+}
+
+// Watch implements glue.Source.  Errors talking to Nomad are logged and retried; Watch only
+// returns when the context is done or update fails.
+func (s *Source) Watch(ctx context.Context, update func([]*glue.SourceService) error) error {
+	l := ctxzap.Extract(ctx)
+	retry := s.RetryInterval
+	if retry == 0 {
+		retry = 5 * time.Second
+	}
+	var index uint64
+	for {
+		svcs, newIndex, err := s.snapshot(ctx, index)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			l.Warn("problem reading services from nomad; will retry", zap.Error(err), zap.Duration("retry_in", retry))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(retry):
+			}
+			continue
+		}
+		// Nomad recommends resetting the index if it goes backwards, and treating 0 as 1.
+		if newIndex < index || newIndex == 0 {
+			newIndex = 1
+		}
+		if index == 0 || newIndex != index {
+			if err := update(svcs); err != nil {
+				return fmt.Errorf("update: %w", err)
+			}
+		}
+		index = newIndex
+	}
+}
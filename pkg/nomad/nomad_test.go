@@ -0,0 +1,93 @@
+package nomad
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/google/go-cmp/cmp"
+	"github.com/jrockway/ekglue/pkg/glue"
+	"google.golang.org/protobuf/testing/protocmp"
+)
+
+func TestWatch(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/services", func(w http.ResponseWriter, req *http.Request) {
+		if got, want := req.Header.Get("X-Nomad-Token"), "secret"; got != want {
+			t.Errorf("token:\n  got: %v\n want: %v", got, want)
+		}
+		w.Header().Set("X-Nomad-Index", "42")
+		json.NewEncoder(w).Encode([]map[string]any{{
+			"Namespace": "default",
+			"Services":  []map[string]any{{"ServiceName": "web"}},
+		}})
+	})
+	mux.HandleFunc("/v1/service/web", func(w http.ResponseWriter, req *http.Request) {
+		if got, want := req.URL.Query().Get("namespace"), "default"; got != want {
+			t.Errorf("namespace:\n  got: %v\n want: %v", got, want)
+		}
+		json.NewEncoder(w).Encode([]map[string]any{
+			{"Namespace": "default", "ServiceName": "web", "Datacenter": "dc1", "Address": "10.0.0.1", "Port": 8080},
+			{"Namespace": "default", "ServiceName": "web", "Datacenter": "dc1", "Address": "10.0.0.2", "Port": 8081},
+		})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s := &Source{Address: server.URL, Token: "secret"}
+	errDone := errors.New("done")
+	var got []*glue.SourceService
+	err := s.Watch(ctx, func(svcs []*glue.SourceService) error {
+		got = svcs
+		return errDone
+	})
+	if !errors.Is(err, errDone) {
+		t.Fatalf("watch: unexpected error: %v", err)
+	}
+	dc1 := &envoy_config_core_v3.Locality{Region: "dc1"}
+	want := []*glue.SourceService{{
+		Namespace: "default",
+		Name:      "web",
+		Endpoints: []*glue.SourceEndpoint{
+			{Address: "10.0.0.1", Port: 8080, Locality: dc1},
+			{Address: "10.0.0.2", Port: 8081, Locality: dc1},
+		},
+	}}
+	if diff := cmp.Diff(got, want, protocmp.Transform()); diff != "" {
+		t.Errorf("services:\n%s", diff)
+	}
+}
+
+func TestWatchRetries(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if calls.Add(1) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s := &Source{Address: server.URL, RetryInterval: time.Millisecond}
+	err := s.Watch(ctx, func(svcs []*glue.SourceService) error {
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("watch: unexpected error: %v", err)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("expected 2 calls, got %d", got)
+	}
+}
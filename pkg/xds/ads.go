@@ -0,0 +1,240 @@
+package xds
+
+import (
+	"context"
+	"errors"
+
+	discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// StreamAggregated serves an Aggregated Discovery Service stream.  Requests are dispatched to the
+// manager that handles the requested type; each type gets its own Manager.Stream, and responses
+// from all of them are multiplexed onto the provided stream.  The stream ends when any of the
+// per-type streams end.
+//
+// Some clients, notably gRPC's xDS resolver, only speak ADS.
+//
+// Requests for a disabled manager's type are ignored, so the other types keep working.  A type
+// that is disabled while the stream is open stays ignored for the life of the stream, even if it
+// is enabled again; the client picks it up when it reconnects.
+func StreamAggregated(stream Stream, managers ...*Manager) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	l := ctxzap.Extract(ctx)
+
+	byType := make(map[string]*Manager, len(managers))
+	for _, m := range managers {
+		byType[m.Type] = m
+	}
+
+	errCh := make(chan error, len(managers)+2)
+	resCh := make(chan *discovery_v3.DiscoveryResponse)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case res := <-resCh:
+				if err := stream.Send(res); err != nil {
+					l.Debug("error writing message to stream", zap.Error(err))
+					errCh <- err
+					return
+				}
+			}
+		}
+	}()
+
+	recvCh := make(chan *discovery_v3.DiscoveryRequest)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case recvCh <- req:
+			}
+		}
+	}()
+
+	// The node is only required to be sent in the first request on the stream, but each
+	// Manager.Stream expects to see it in its first request.
+	var node *discovery_v3.DiscoveryRequest
+	reqChs := make(map[string]chan *discovery_v3.DiscoveryRequest)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errCh:
+			return err
+		case req := <-recvCh:
+			if node == nil {
+				if req.GetNode() == nil {
+					return status.Error(codes.InvalidArgument, "first request on an aggregated stream must include the node")
+				}
+				node = req
+			}
+			if req.GetNode() == nil {
+				req = proto.Clone(req).(*discovery_v3.DiscoveryRequest)
+				req.Node = node.GetNode()
+			}
+			t := req.GetTypeUrl()
+			m, ok := byType[t]
+			if !ok {
+				l.Error("aggregated request for unknown resource type", zap.String("requested_type", t))
+				return status.Errorf(codes.InvalidArgument, "resource type %q is not served", t)
+			}
+			if !m.Enabled() {
+				// Requests for disabled types go unanswered, rather than ending the stream
+				// and taking the enabled types down with it.
+				l.Debug("ignoring aggregated request for disabled resource type", zap.String("requested_type", t))
+				continue
+			}
+			reqCh, ok := reqChs[t]
+			if !ok {
+				reqCh = make(chan *discovery_v3.DiscoveryRequest)
+				reqChs[t] = reqCh
+				go func() {
+					err := m.Stream(ctx, reqCh, resCh)
+					if !m.Enabled() && ctx.Err() == nil {
+						ignoreDisabled(ctx, reqCh)
+						return
+					}
+					if err == nil {
+						err = errors.New("stream exited without error")
+					}
+					errCh <- err
+				}()
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case err := <-errCh:
+				return err
+			case reqCh <- req:
+			}
+		}
+	}
+}
+
+// ignoreDisabled discards requests sent to the stream of a manager that was disabled while an
+// aggregated stream was open, until the aggregated stream ends.
+func ignoreDisabled[T any](ctx context.Context, reqCh chan T) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reqCh:
+		}
+	}
+}
+
+// StreamDeltaAggregated is StreamAggregated for the incremental variant of the protocol.
+func StreamDeltaAggregated(stream DeltaStream, managers ...*Manager) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	l := ctxzap.Extract(ctx)
+
+	byType := make(map[string]*Manager, len(managers))
+	for _, m := range managers {
+		byType[m.Type] = m
+	}
+
+	errCh := make(chan error, len(managers)+2)
+	resCh := make(chan *discovery_v3.DeltaDiscoveryResponse)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case res := <-resCh:
+				if err := stream.Send(res); err != nil {
+					l.Debug("error writing message to stream", zap.Error(err))
+					errCh <- err
+					return
+				}
+			}
+		}
+	}()
+
+	recvCh := make(chan *discovery_v3.DeltaDiscoveryRequest)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case recvCh <- req:
+			}
+		}
+	}()
+
+	var node *discovery_v3.DeltaDiscoveryRequest
+	reqChs := make(map[string]chan *discovery_v3.DeltaDiscoveryRequest)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errCh:
+			return err
+		case req := <-recvCh:
+			if node == nil {
+				if req.GetNode() == nil {
+					return status.Error(codes.InvalidArgument, "first request on an aggregated stream must include the node")
+				}
+				node = req
+			}
+			if req.GetNode() == nil {
+				req = proto.Clone(req).(*discovery_v3.DeltaDiscoveryRequest)
+				req.Node = node.GetNode()
+			}
+			t := req.GetTypeUrl()
+			m, ok := byType[t]
+			if !ok {
+				l.Error("aggregated request for unknown resource type", zap.String("requested_type", t))
+				return status.Errorf(codes.InvalidArgument, "resource type %q is not served", t)
+			}
+			if !m.Enabled() {
+				// Requests for disabled types go unanswered, rather than ending the stream
+				// and taking the enabled types down with it.
+				l.Debug("ignoring aggregated request for disabled resource type", zap.String("requested_type", t))
+				continue
+			}
+			reqCh, ok := reqChs[t]
+			if !ok {
+				reqCh = make(chan *discovery_v3.DeltaDiscoveryRequest)
+				reqChs[t] = reqCh
+				go func() {
+					err := m.DeltaStream(ctx, reqCh, resCh)
+					if !m.Enabled() && ctx.Err() == nil {
+						ignoreDisabled(ctx, reqCh)
+						return
+					}
+					if err == nil {
+						err = errors.New("stream exited without error")
+					}
+					errCh <- err
+				}()
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case err := <-errCh:
+				return err
+			case reqCh <- req:
+			}
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package xds
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var xdsStreamsExpired = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ekglue_xds_streams_expired",
+	Help: "The number of streams closed because they reached the manager's maximum stream age.",
+}, []string{"manager_name", "config_type"})
+
+// errStreamExpired is returned from a stream that reached its maximum age.  Unavailable tells the
+// client to reconnect, which it does immediately.
+var errStreamExpired = status.Error(codes.Unavailable, "stream reached its maximum age; please reconnect")
+
+// expiry returns a channel that receives when a newly-opened stream has reached its maximum age, or
+// nil if streams don't expire.  Ages are spread out by up to 10% so that streams opened at the same
+// time (after a restart, say) don't all reconnect at once.
+func (m *Manager) expiry() <-chan time.Time {
+	if m.MaxStreamAge <= 0 {
+		return nil
+	}
+	jitter := time.Duration(rand.Int63n(int64(m.MaxStreamAge)/10 + 1))
+	return time.After(m.MaxStreamAge + jitter)
+}
+
+// expire decides what to do with a stream that has reached its maximum age.  A stream with
+// responses awaiting acknowledgement is given a chance to finish them, so that the client doesn't
+// have to re-fetch a response it was in the middle of applying; expire returns the channel to wait
+// on before checking again.  Otherwise, it returns errStreamExpired, which the stream should return.
+func (m *Manager) expire(inFlight int) (<-chan time.Time, error) {
+	if inFlight > 0 {
+		return time.After(time.Second), nil
+	}
+	xdsStreamsExpired.WithLabelValues(m.Name, m.Type).Inc()
+	return nil, errStreamExpired
+}
@@ -0,0 +1,258 @@
+package xds
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"sigs.k8s.io/yaml"
+)
+
+// ErrNotArchived is returned when an Archive has no config for the requested time or version.
+var ErrNotArchived = errors.New("not archived")
+
+// Archive keeps a bounded history of the complete set of resources served by one or more managers,
+// compressed in memory, so that operators can see exactly what clients were being served at the
+// time of an incident.  A snapshot is archived after every change.  The newest snapshot of each
+// manager is always kept, however old, because it is still being served.
+type Archive struct {
+	// MaxSnapshots is the number of snapshots to keep for each manager; less than 1 keeps 1.
+	MaxSnapshots int
+	// MaxAge, if non-zero, is how long to keep snapshots after they were superseded.
+	MaxAge time.Duration
+
+	now func() time.Time // for tests
+
+	mu        sync.Mutex
+	snapshots map[string][]*archivedSnapshot // by manager, oldest first
+}
+
+// archivedSnapshot is a compressed snapshot of a manager's resources.
+type archivedSnapshot struct {
+	time            time.Time
+	version         string // the manager's version
+	responseVersion string // the version of wildcard responses, which differs with DigestVersions
+	data            []byte // a gzipped DiscoveryResponse
+}
+
+// NewArchive returns an Archive that keeps up to maxSnapshots snapshots per manager, for up to
+// maxAge (0 for no limit).
+func NewArchive(maxSnapshots int, maxAge time.Duration) *Archive {
+	return &Archive{MaxSnapshots: maxSnapshots, MaxAge: maxAge}
+}
+
+func (a *Archive) clock() time.Time {
+	if a.now != nil {
+		return a.now()
+	}
+	return time.Now()
+}
+
+// add archives a snapshot of the named manager's resources.
+func (a *Archive) add(manager, responseVersion string, res *discovery_v3.DiscoveryResponse) error {
+	raw, err := proto.Marshal(res)
+	if err != nil {
+		return fmt.Errorf("marshal snapshot: %w", err)
+	}
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(raw); err != nil {
+		return fmt.Errorf("compress snapshot: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("compress snapshot: %w", err)
+	}
+	now := a.clock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.snapshots == nil {
+		a.snapshots = make(map[string][]*archivedSnapshot)
+	}
+	ss := a.snapshots[manager]
+	if n := len(ss); n > 0 && ss[n-1].version == res.GetVersionInfo() {
+		// A concurrent change already archived this version.
+		return nil
+	}
+	ss = append(ss, &archivedSnapshot{
+		time:            now,
+		version:         res.GetVersionInfo(),
+		responseVersion: responseVersion,
+		data:            buf.Bytes(),
+	})
+	max := a.MaxSnapshots
+	if max < 1 {
+		max = 1
+	}
+	if len(ss) > max {
+		ss = ss[len(ss)-max:]
+	}
+	if a.MaxAge > 0 {
+		// A snapshot stops being served when the next one is archived.
+		for len(ss) > 1 && now.Sub(ss[1].time) > a.MaxAge {
+			ss = ss[1:]
+		}
+	}
+	a.snapshots[manager] = ss
+	return nil
+}
+
+// ArchivedConfig is the set of resources that a manager was serving, from Time until the next
+// change.
+type ArchivedConfig struct {
+	Manager string    `json:"manager"`
+	Time    time.Time `json:"time"`
+	// Version is the manager's version of the config.
+	Version string `json:"version"`
+	// ResponseVersion is the version that clients subscribed to every resource received, if it
+	// differs from Version because of DigestVersions.
+	ResponseVersion string     `json:"response_version,omitempty"`
+	Resources       []Resource `json:"-"`
+}
+
+// decode returns the archived config of the snapshot.
+func (s *archivedSnapshot) decode(manager string) (*ArchivedConfig, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(s.data))
+	if err != nil {
+		return nil, fmt.Errorf("decompress snapshot: %w", err)
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("decompress snapshot: %w", err)
+	}
+	res := new(discovery_v3.DiscoveryResponse)
+	if err := proto.Unmarshal(raw, res); err != nil {
+		return nil, fmt.Errorf("unmarshal snapshot: %w", err)
+	}
+	result := &ArchivedConfig{Manager: manager, Time: s.time, Version: s.version}
+	if s.responseVersion != s.version {
+		result.ResponseVersion = s.responseVersion
+	}
+	for i, any := range res.GetResources() {
+		msg, err := any.UnmarshalNew()
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal snapshot resource %d: %w", i, err)
+		}
+		r, ok := msg.(Resource)
+		if !ok {
+			return nil, fmt.Errorf("snapshot resource %d: %T is not a resource", i, msg)
+		}
+		result.Resources = append(result.Resources, r)
+	}
+	return result, nil
+}
+
+// At returns the config that each manager was serving at t, sorted by manager name.  Managers
+// whose archived history doesn't reach back to t are left out; if none do, ErrNotArchived is
+// returned.
+func (a *Archive) At(t time.Time) ([]*ArchivedConfig, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var result []*ArchivedConfig
+	for manager, ss := range a.snapshots {
+		i := sort.Search(len(ss), func(i int) bool { return ss[i].time.After(t) }) - 1
+		if i < 0 {
+			continue
+		}
+		c, err := ss[i].decode(manager)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", manager, err)
+		}
+		result = append(result, c)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no config at %s: %w", t.Format(time.RFC3339), ErrNotArchived)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Manager < result[j].Manager })
+	return result, nil
+}
+
+// AtVersion returns the config that each manager was serving when the named manager started
+// serving version, which may be either the manager's version or a response version.  If manager is
+// empty, the version must identify a snapshot of exactly one manager.
+func (a *Archive) AtVersion(manager, version string) ([]*ArchivedConfig, error) {
+	a.mu.Lock()
+	var found *archivedSnapshot
+	var managers []string
+	for name, ss := range a.snapshots {
+		if manager != "" && name != manager {
+			continue
+		}
+		for _, s := range ss {
+			if s.version == version || s.responseVersion == version {
+				found = s
+				managers = append(managers, name)
+				break
+			}
+		}
+	}
+	a.mu.Unlock()
+	switch len(managers) {
+	case 0:
+		return nil, fmt.Errorf("no config with version %q: %w", version, ErrNotArchived)
+	case 1:
+		return a.At(found.time)
+	}
+	sort.Strings(managers)
+	return nil, fmt.Errorf("version %q was served by %s; specify a manager", version, strings.Join(managers, " and "))
+}
+
+// ServeHTTP serves archived configs as YAML.  The "at" query parameter selects the time (RFC 3339)
+// or version of the config to show, defaulting to the current config, and "manager" limits the
+// output to one manager; it also disambiguates versions that more than one manager has served.
+func (a *Archive) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	at, manager := req.FormValue("at"), req.FormValue("manager")
+	var configs []*ArchivedConfig
+	var err error
+	if at == "" {
+		configs, err = a.At(a.clock())
+	} else if t, terr := time.Parse(time.RFC3339Nano, at); terr == nil {
+		configs, err = a.At(t)
+	} else {
+		configs, err = a.AtVersion(manager, at)
+	}
+	if errors.Is(err, ErrNotArchived) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	type dump struct {
+		*ArchivedConfig
+		Resources []json.RawMessage `json:"resources"`
+	}
+	var result []*dump
+	for _, c := range configs {
+		if manager != "" && c.Manager != manager {
+			continue
+		}
+		d := &dump{ArchivedConfig: c}
+		for _, r := range c.Resources {
+			js, err := protojson.Marshal(r)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("marshal resource: %v", err), http.StatusInternalServerError)
+				return
+			}
+			d.Resources = append(d.Resources, js)
+		}
+		result = append(result, d)
+	}
+	ya, err := yaml.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(ya)
+}
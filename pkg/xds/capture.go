@@ -0,0 +1,162 @@
+package xds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var xdsAdminCaptures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ekglue_xds_admin_captures",
+	Help: "The number of times the admin interface of a client that kept rejecting configuration was captured, by result: ok or error.",
+}, []string{"manager_name", "config_type", "result"})
+
+// DefaultAdminAddressKey is the default AdminCapture.AddressKey.
+const DefaultAdminAddressKey = "admin_address"
+
+// adminCapturePaths are the admin interface pages that an AdminCapture fetches.
+var adminCapturePaths = []string{"/config_dump", "/stats"}
+
+// AdminCapture captures the first things anyone debugging a rejection loop looks at, a client's
+// /config_dump and /stats, from the admin interface of a client that rejects several versions in a
+// row, and attaches them to the manager's History.  The address of the admin interface comes from
+// the node's metadata, which the client controls, so only enable this for trusted clients.  One
+// AdminCapture may be shared among managers.
+type AdminCapture struct {
+	// Threshold is the number of consecutive rejections by a node that trigger a capture.  If
+	// zero, nothing is captured.
+	Threshold int
+	// AddressKey names the string field of the node's metadata that holds the address of its admin
+	// interface, like "10.1.2.3:9901" or "http://10.1.2.3:9901".  It defaults to
+	// DefaultAdminAddressKey.  Nodes without one aren't captured.
+	AddressKey string
+	// Interval is the minimum time between two captures of the same node.  It defaults to 10
+	// minutes.
+	Interval time.Duration
+	// MaxBytes is the size at which each captured page is truncated.  It defaults to 1MiB.
+	MaxBytes int64
+	// Client is the HTTP client used to fetch the pages.  It defaults to one with a 10 second
+	// timeout.
+	Client *http.Client
+
+	mu   sync.Mutex
+	last map[string]time.Time // when each node was last captured
+}
+
+// address returns the base URL of node's admin interface, or "" if it didn't advertise one.
+func (c *AdminCapture) address(node *envoy_config_core_v3.Node) string {
+	key := c.AddressKey
+	if key == "" {
+		key = DefaultAdminAddressKey
+	}
+	addr := node.GetMetadata().GetFields()[key].GetStringValue()
+	if addr == "" {
+		return ""
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return strings.TrimSuffix(addr, "/")
+}
+
+// due returns true, and records the capture, if node hasn't been captured within Interval.
+func (c *AdminCapture) due(node string, now time.Time) bool {
+	interval := c.Interval
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if last, ok := c.last[node]; ok && now.Sub(last) < interval {
+		return false
+	}
+	if c.last == nil {
+		c.last = make(map[string]time.Time)
+	}
+	c.last[node] = now
+	return true
+}
+
+// Capture fetches the admin pages of node, by path.  Pages that couldn't be fetched are left out,
+// and the errors are joined.
+func (c *AdminCapture) Capture(ctx context.Context, node *envoy_config_core_v3.Node) (map[string]string, error) {
+	addr := c.address(node)
+	if addr == "" {
+		return nil, fmt.Errorf("node %q has no admin address in its metadata", node.GetId())
+	}
+	client := c.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	maxBytes := c.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = 1 << 20
+	}
+	result := make(map[string]string)
+	var errs []error
+	for _, path := range adminCapturePaths {
+		page, err := fetchAdminPage(ctx, client, addr+path, maxBytes)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			continue
+		}
+		result[path] = page
+	}
+	return result, errors.Join(errs...)
+}
+
+// fetchAdminPage returns the first maxBytes of the page at url.
+func fetchAdminPage(ctx context.Context, client *http.Client, url string, maxBytes int64) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", fmt.Errorf("new request: %w", err)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", res.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(res.Body, maxBytes))
+	if err != nil {
+		return "", fmt.Errorf("read response: %w", err)
+	}
+	return string(b), nil
+}
+
+// captureAdmin captures node's admin interface in the background, if the AdminCapture is
+// configured, nacks has reached its threshold, and node is due for a capture.
+func (m *Manager) captureAdmin(node *envoy_config_core_v3.Node, version string, nacks int) {
+	c := m.AdminCapture
+	if c == nil || c.Threshold <= 0 || nacks < c.Threshold || c.address(node) == "" || !c.due(node.GetId(), time.Now()) {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		l := m.Logger.With(zap.String("envoy.node.id", node.GetId()), zap.Int("consecutive_nacks", nacks))
+		pages, err := c.Capture(ctx, node)
+		r := &HistoryRecord{Event: "capture", Node: node.GetId(), Version: version, Capture: pages}
+		if err != nil {
+			xdsAdminCaptures.WithLabelValues(m.Name, m.Type, "error").Inc()
+			l.Warn("problem capturing admin interface of client in a rejection loop", zap.Error(err))
+			r.Error = err.Error()
+		} else {
+			xdsAdminCaptures.WithLabelValues(m.Name, m.Type, "ok").Inc()
+			l.Info("captured admin interface of client in a rejection loop")
+		}
+		m.record(r)
+	}()
+}
@@ -0,0 +1,59 @@
+package xds
+
+import (
+	"context"
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// The number of open streams, including each type requested over ADS.
+	xdsActiveStreams = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ekglue_xds_active_streams",
+		Help: "The number of open xDS streams, counting each type requested over an aggregated stream separately.",
+	}, []string{"manager_name", "config_type"})
+
+	// The version that each connected node last accepted.
+	xdsNodeAcceptedVersion = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ekglue_xds_node_accepted_version_info",
+		Help: "Always 1; the version label is the version that the connected node last accepted.",
+	}, []string{"manager_name", "config_type", "node", "version"})
+
+	// A count of streams that ended, by why they ended.
+	xdsStreamTerminations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ekglue_xds_stream_terminations",
+		Help: "The number of xDS streams that ended, by cause.",
+	}, []string{"manager_name", "config_type", "cause"})
+)
+
+var (
+	// errRequestsClosed is returned from streams whose client went away.
+	errRequestsClosed = errors.New("request channel closed")
+)
+
+// terminationCause classifies the error that ended a stream, for xdsStreamTerminations.
+func terminationCause(ctx context.Context, err error) string {
+	switch {
+	case errors.Is(err, errStreamExpired):
+		return "max_age"
+	case errors.Is(err, errDraining):
+		return "draining"
+	case errors.Is(err, errRequestsClosed), ctx.Err() != nil:
+		return "client_closed"
+	case status.Code(err) == codes.Unavailable:
+		return "disabled"
+	case status.Code(err) == codes.InvalidArgument:
+		return "protocol_error"
+	default:
+		return "push_failed"
+	}
+}
+
+// streamEnded records that a stream ended with err.
+func (m *Manager) streamEnded(ctx context.Context, err error) {
+	xdsStreamTerminations.WithLabelValues(m.Name, m.Type, terminationCause(ctx, err)).Inc()
+}
@@ -0,0 +1,121 @@
+package xds
+
+import (
+	"net/url"
+	"strings"
+
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// VariantName returns the name under which to store the variant of the named resource that is
+// served to clients that ask for it with exactly the given context parameters, like
+// "listener?shard=1"; see Manager.ContextParams.  Without parameters, it is the name itself.
+func VariantName(name string, params map[string]string) string {
+	if len(params) == 0 {
+		return name
+	}
+	v := make(url.Values, len(params))
+	for k, p := range params {
+		v.Set(k, p)
+	}
+	return name + "?" + v.Encode()
+}
+
+// isVariantName returns true if name is the name of a variant made by VariantName.
+func isVariantName(name string) bool {
+	return strings.Contains(name, "?")
+}
+
+// parseResourceName returns the id of the resource named by a client, and the context parameters
+// in the name.  For an xdstp:// name, like
+// "xdstp://example.com/envoy.config.listener.v3.Listener/foo?shard=1", that is the part of the
+// path after the resource type ("foo") and the query ({shard: 1}); other names have no parameters.
+func parseResourceName(name string) (string, map[string]string) {
+	if !strings.HasPrefix(name, "xdstp://") {
+		return name, nil
+	}
+	u, err := url.Parse(name)
+	if err != nil {
+		return name, nil
+	}
+	_, id, ok := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	if !ok || id == "" {
+		return name, nil
+	}
+	var params map[string]string
+	for k, v := range u.Query() {
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[k] = v[0]
+	}
+	return id, params
+}
+
+// candidates returns the names of the stored resources that may be served to node for the named
+// resource, most specific first: an xdstp:// name itself, the variant for the context parameters
+// of the name and of node's dynamic parameters for the manager's type, and the plain id.
+func (m *Manager) candidates(name string, node *envoy_config_core_v3.Node) []string {
+	if !m.ContextParams {
+		return []string{name}
+	}
+	id, params := parseResourceName(name)
+	merged := make(map[string]string)
+	for k, v := range node.GetDynamicParameters()[m.Type].GetParams() {
+		merged[k] = v
+	}
+	for k, v := range params {
+		merged[k] = v
+	}
+	var result []string
+	if id != name {
+		result = append(result, name)
+	}
+	if len(merged) > 0 {
+		result = append(result, VariantName(id, merged))
+	}
+	return append(result, id)
+}
+
+// lookup returns the resource to serve to node for the named resource, and the name under which
+// it is stored.  A resource stored under another name is returned with its name changed to the one
+// the client asked for.  You must hold the resource lock.
+func (m *Manager) lookup(name string, node *envoy_config_core_v3.Node) (Resource, string, bool) {
+	for _, c := range m.candidates(name, node) {
+		r, ok := m.resources[c]
+		if !ok {
+			continue
+		}
+		if c != name {
+			r = renamed(r, name)
+		}
+		return r, c, true
+	}
+	return nil, "", false
+}
+
+// affected returns true if a change to any of the named stored resources changes what node
+// receives for the named resource.
+func (m *Manager) affected(name string, node *envoy_config_core_v3.Node, changed map[string]struct{}) bool {
+	for _, c := range m.candidates(name, node) {
+		if _, ok := changed[c]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// renamed returns a copy of r named name.
+func renamed(r Resource, name string) Resource {
+	c := proto.Clone(r).(Resource)
+	msg := c.ProtoReflect()
+	for _, field := range []protoreflect.Name{"name", "cluster_name"} {
+		if fd := msg.Descriptor().Fields().ByName(field); fd != nil && fd.Kind() == protoreflect.StringKind {
+			msg.Set(fd, protoreflect.ValueOfString(name))
+			break
+		}
+	}
+	return c
+}
@@ -0,0 +1,452 @@
+package xds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// resourceVersion returns a version for a single marshaled resource, derived from its content, so
+// that a client reconnecting to another replica can report versions that this replica recognizes.
+func resourceVersion(a *anypb.Any) string {
+	h := fnv.New64a()
+	h.Write(a.GetValue())
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// deltaTx is an in-flight incremental response.
+type deltaTx struct {
+	tx
+	// prev is the version of each resource in the response that the client had before, or ""
+	// if it didn't have the resource, so that a rejected response can be forgotten.
+	prev map[string]string
+}
+
+// deltaState is what an incremental stream knows about its client.
+type deltaState struct {
+	node       *envoy_config_core_v3.Node // the node as it identified itself, for Scope
+	wildcard   bool
+	subscribed map[string]struct{}
+	known      map[string]string // resource name -> version the client has
+}
+
+// interested returns true if the client wants updates to the named resource.
+func (s *deltaState) interested(name string) bool {
+	if s.wildcard {
+		return true
+	}
+	_, ok := s.subscribed[name]
+	return ok
+}
+
+// names returns the sorted names of the resources the client is subscribed to, including "*" if
+// it has a wildcard subscription.
+func (s *deltaState) names() []string {
+	result := make([]string, 0, len(s.subscribed)+1)
+	if s.wildcard {
+		result = append(result, "*")
+	}
+	for n := range s.subscribed {
+		result = append(result, n)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// buildDeltaResponse returns a response containing the resources among names (or every resource,
+// if names is nil) that the client is interested in and doesn't already have, and the removal of
+// those it has that no longer exist.  Names in missing that don't exist are also reported as
+// removed, which is how the incremental protocol tells a client that a resource it asked for
+// doesn't exist.  The client's state is updated as though the response were accepted.  The
+// response is nil if there is nothing to send.
+func (m *Manager) buildDeltaResponse(st *deltaState, names []string, missing map[string]struct{}) (*discovery_v3.DeltaDiscoveryResponse, map[string]string, error) {
+	m.resourcesMu.Lock()
+	defer m.resourcesMu.Unlock()
+	if names == nil {
+		all := make(map[string]struct{})
+		for n := range m.resources {
+			if !m.ContextParams || !isVariantName(n) {
+				all[n] = struct{}{}
+			}
+		}
+		for n := range st.subscribed {
+			all[n] = struct{}{}
+		}
+		for n := range st.known {
+			all[n] = struct{}{}
+		}
+		for n := range all {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+
+	res := &discovery_v3.DeltaDiscoveryResponse{
+		TypeUrl:           m.Type,
+		SystemVersionInfo: m.versionString(),
+	}
+	prev := make(map[string]string)
+	for _, n := range names {
+		if !st.interested(n) {
+			continue
+		}
+		if _, ok := st.subscribed[n]; !ok && m.ContextParams && isVariantName(n) {
+			// Variants are only sent to clients that ask for them.
+			continue
+		}
+		have, had := st.known[n]
+		r, stored, ok := m.lookup(n, st.node)
+		if !ok || !m.inScope(st.node, stored) {
+			_, asked := missing[n]
+			if had || asked {
+				res.RemovedResources = append(res.RemovedResources, n)
+				prev[n] = have
+				delete(st.known, n)
+			}
+			continue
+		}
+		a, err := marshalAny(r)
+		if err != nil {
+			return nil, nil, &MarshalError{Name: n, Err: err}
+		}
+		v := resourceVersion(a)
+		if have == v {
+			continue
+		}
+		res.Resources = append(res.Resources, &discovery_v3.Resource{Name: n, Version: v, Resource: a})
+		prev[n] = have
+		st.known[n] = v
+	}
+	if len(res.GetResources()) == 0 && len(res.GetRemovedResources()) == 0 {
+		return nil, nil, nil
+	}
+	return res, prev, nil
+}
+
+// DeltaStream manages a client connection that uses the incremental ("delta") variant of the xDS
+// protocol.  Unlike Stream, only resources that changed are sent to the client, each with its own
+// version.  Requests from the client are read from reqCh, responses are written to resCh, and the
+// function returns when no further progress can be made.
+func (m *Manager) DeltaStream(ctx context.Context, reqCh chan *discovery_v3.DeltaDiscoveryRequest, resCh chan *discovery_v3.DeltaDiscoveryResponse) (retErr error) {
+	l := ctxzap.Extract(ctx).With(zap.String("xds_type", m.Type), zap.Bool("delta", true))
+	defer func() { m.streamEnded(ctx, retErr) }()
+
+	disabled, ok := m.watchEnabled()
+	if !ok {
+		return m.disabledError()
+	}
+
+	rCh := m.openSession(true)
+	txs := map[string]*deltaTx{}
+	defer func() {
+		m.closeSession(rCh)
+		for _, t := range txs {
+			t.span.Finish()
+		}
+	}()
+
+	var node string
+	defer func() {
+		if node != "" {
+			m.rolloutDisconnect(node)
+		}
+	}()
+	st := &deltaState{subscribed: make(map[string]struct{}), known: make(map[string]string)}
+	var seq int
+
+	// sendUpdate sends the changes to the named resources, or all resources if names is nil.
+	sendUpdate := func(ctx context.Context, names []string, missing map[string]struct{}) error {
+		res, prev, err := m.buildDeltaResponse(st, names, missing)
+		if err != nil {
+			l.Error("problem building delta response", zap.Error(err))
+			return fmt.Errorf("problem building response: %w", err)
+		}
+		if res == nil {
+			if len(txs) == 0 {
+				m.rolloutCurrent(node)
+			}
+			return nil
+		}
+		seq++
+		res.Nonce = fmt.Sprintf("delta-%s-%d", res.GetSystemVersionInfo(), seq)
+
+		span, ctx := opentracing.StartSpanFromContext(ctx, "xds.delta_push", ext.SpanKindConsumer)
+		ext.PeerService.Set(span, node)
+		span.SetTag("xds_type", m.Type)
+		span.SetTag("xds_version", res.GetSystemVersionInfo())
+		t := &deltaTx{tx: tx{start: time.Now(), span: span, nonce: res.GetNonce(), version: res.GetSystemVersionInfo(), generation: res.GetSystemVersionInfo()}, prev: prev}
+		var updated []string
+		for _, r := range res.GetResources() {
+			updated = append(updated, r.GetName())
+		}
+		l.Info("pushing changed resources", zap.Object("tx", &t.tx), zap.Strings("resources", updated), zap.Strings("removed_resources", res.GetRemovedResources()))
+
+		select {
+		case resCh <- res:
+			for _, n := range updated {
+				xdsResourcePushCount.WithLabelValues(m.Name, m.Type, n).Inc()
+				xdsResourcePushAge.WithLabelValues(m.Name, m.Type, n).SetToCurrentTime()
+			}
+			txs[res.GetNonce()] = t
+			span.LogFields(log.Event("pushed resources"))
+			m.publish(PushCompleted{Node: node, Version: t.version, Resources: updated, RemovedResources: res.GetRemovedResources()})
+			return nil
+		case <-ctx.Done():
+			err := ctx.Err()
+			l.Info("push timed out", zap.Object("tx", &t.tx), zap.Error(err))
+			ext.LogError(span, fmt.Errorf("push timed out: %w", err))
+			span.Finish()
+			return fmt.Errorf("push timed out: %v", err)
+		}
+	}
+
+	// handleTx handles an acknowledgement.  A rejected response is forgotten, so that the
+	// resources in it are sent again when they next change.
+	handleTx := func(t *deltaTx, req *discovery_v3.DeltaDiscoveryRequest) {
+		t.span.LogFields(log.Event("got response"))
+		ack := true
+		if err := req.GetErrorDetail(); err != nil {
+			ack = false
+			ext.LogError(t.span, fmt.Errorf("envoy rejected configuration: %v", err.GetMessage()))
+			l.Error("envoy rejected configuration", zap.Any("error", err), zap.String("version.rejected", t.version), zap.Object("tx", &t.tx))
+			xdsConfigAcceptanceStatus.WithLabelValues(m.Name, m.Type, "NACK").Inc()
+			for n, v := range t.prev {
+				if v == "" {
+					delete(st.known, n)
+				} else {
+					st.known[n] = v
+				}
+			}
+			t.span.SetTag("status", "NACK")
+		} else {
+			l.Info("envoy accepted configuration", zap.String("version.sent", t.version), zap.Object("tx", &t.tx))
+			xdsConfigAcceptanceStatus.WithLabelValues(m.Name, m.Type, "ACK").Inc()
+			t.span.SetTag("status", "ACK")
+		}
+		nacks := m.rolloutAck(node, t.generation, ack)
+		if ack {
+			rCh.acked(t.version)
+			m.record(&HistoryRecord{Event: "ack", Node: node, Version: t.version})
+		} else {
+			rCh.rejected(t.version)
+			m.record(&HistoryRecord{Event: "nack", Node: node, Version: t.version, Error: req.GetErrorDetail().GetMessage()})
+			m.captureAdmin(st.node, t.version, nacks)
+		}
+		rolledBack := m.checkRollback(ctx, node, t.generation, ack)
+		m.acknowledged(Acknowledgment{Ack: ack, Node: node, Version: t.version, Error: req.GetErrorDetail().GetMessage(), RolledBack: rolledBack})
+		t.span.Finish()
+		delete(txs, t.nonce)
+	}
+
+	cleanupTicker := time.NewTicker(time.Minute)
+	defer cleanupTicker.Stop()
+
+	expire := m.expiry()
+	var handoff <-chan struct{} = rCh.handoff
+
+	// pushChanges pushes the resources named by an update from the session.
+	pushChanges := func(u update) error {
+		names := make([]string, 0, len(u.resources))
+		for n := range u.resources {
+			names = append(names, n)
+		}
+		if m.ContextParams {
+			// Subscriptions to other names may be served by the changed resources.
+			for n := range st.subscribed {
+				if _, ok := u.resources[n]; !ok && m.affected(n, st.node, u.resources) {
+					names = append(names, n)
+				}
+			}
+		}
+		tctx, c := context.WithTimeout(ctx, 5*time.Second)
+		defer c()
+		if err := sendUpdate(opentracing.ContextWithSpan(tctx, u.span), names, nil); err != nil {
+			return fmt.Errorf("pushing resources: %w", err)
+		}
+		return nil
+	}
+
+	// See Stream.
+	ready := rCh.ready
+	var throttled <-chan time.Time
+	draining := m.Draining
+	var drainCheck <-chan time.Time
+	var drainDeadline time.Time
+
+	for {
+		select {
+		case <-draining:
+			draining, ready, throttled = nil, nil, nil
+			drainDeadline = time.Now().Add(m.DrainTimeout)
+			var err error
+			if drainCheck, err = m.drain(rCh, len(txs), drainDeadline); err != nil {
+				l.Info("closing stream because the server is draining")
+				return err
+			}
+		case <-drainCheck:
+			var err error
+			if drainCheck, err = m.drain(rCh, len(txs), drainDeadline); err != nil {
+				l.Info("closing stream because the server is draining")
+				return err
+			}
+		case <-disabled:
+			return m.disabledError()
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-expire:
+			var err error
+			if expire, err = m.expire(len(txs)); err != nil {
+				l.Info("closing stream that reached its maximum age")
+				return err
+			}
+		case <-handoff:
+			var err error
+			if handoff, err = m.handOff(len(txs)); err != nil {
+				l.Info("closing stream to hand the client off to another server")
+				return err
+			}
+		case <-cleanupTicker.C:
+			for key, t := range txs {
+				if time.Since(t.start) > time.Minute {
+					l.Debug("cleaning up stale transaction", zap.Object("tx", &t.tx))
+					ext.LogError(t.span, errors.New("transaction went stale"))
+					t.span.Finish()
+					delete(txs, key)
+				}
+			}
+		case req, ok := <-reqCh:
+			if !ok {
+				return errRequestsClosed
+			}
+			if t := req.GetTypeUrl(); t != m.Type {
+				l.Error("ignoring wrong-type discovery request", zap.String("manager_type", m.Type), zap.String("requested_type", t))
+				return status.Error(codes.InvalidArgument, "wrong resource type requested")
+			}
+			first := node == ""
+			if first {
+				node, st.node = req.GetNode().GetId(), req.GetNode()
+				m.rolloutConnect(req.GetNode())
+				l = l.With(zap.String("envoy.node.id", node))
+				ctx = ctxzap.ToContext(ctx, l)
+				// A client reconnecting after a restart tells us what it already has.
+				for n, v := range req.GetInitialResourceVersions() {
+					st.known[n] = v
+				}
+				st.wildcard = len(req.GetResourceNamesSubscribe()) == 0
+				rCh.connected(node)
+			}
+			missing := make(map[string]struct{})
+			for _, n := range req.GetResourceNamesSubscribe() {
+				if n == "*" {
+					st.wildcard = true
+					continue
+				}
+				if _, ok := st.subscribed[n]; !ok {
+					st.subscribed[n] = struct{}{}
+					missing[n] = struct{}{}
+				}
+			}
+			for _, n := range req.GetResourceNamesUnsubscribe() {
+				if n == "*" {
+					st.wildcard = false
+					continue
+				}
+				delete(st.subscribed, n)
+				delete(st.known, n)
+			}
+			if nonce := req.GetResponseNonce(); nonce != "" {
+				if t, ok := txs[nonce]; ok {
+					handleTx(t, req)
+				} else {
+					l.Info("envoy sent acknowledgement of unrecognized nonce", zap.String("nonce", nonce))
+				}
+			}
+			changed := len(req.GetResourceNamesSubscribe()) > 0 || len(req.GetResourceNamesUnsubscribe()) > 0
+			if first || changed {
+				m.subscribe(rCh, st.names())
+			}
+			if !first && !changed {
+				break
+			}
+			tctx, c := context.WithTimeout(ctx, 5*time.Second)
+			if err := sendUpdate(tctx, nil, missing); err != nil {
+				c()
+				return fmt.Errorf("pushing resources: %w", err)
+			}
+			c()
+		case <-ready:
+			if d := rCh.throttle(m.MinPushInterval); d > 0 {
+				ready, throttled = nil, time.After(d)
+				break
+			}
+			if err := pushChanges(rCh.take()); err != nil {
+				return err
+			}
+		case <-throttled:
+			ready, throttled = rCh.ready, nil
+			if err := pushChanges(rCh.take()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// DeltaStream is the API shared among all incremental xDS gRPC streams.
+type DeltaStream interface {
+	Context() context.Context
+	Recv() (*discovery_v3.DeltaDiscoveryRequest, error)
+	Send(*discovery_v3.DeltaDiscoveryResponse) error
+}
+
+// DeltaStreamGRPC adapts a gRPC stream of DeltaDiscoveryRequest -> DeltaDiscoveryResponse to the
+// API required by the DeltaStream function.
+func (m *Manager) DeltaStreamGRPC(stream DeltaStream) error {
+	ctx := stream.Context()
+	l := ctxzap.Extract(ctx)
+	reqCh := make(chan *discovery_v3.DeltaDiscoveryRequest)
+	resCh := make(chan *discovery_v3.DeltaDiscoveryResponse)
+	errCh := make(chan error)
+
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				close(reqCh)
+				return
+			}
+			reqCh <- req
+		}
+	}()
+
+	go func() {
+		for {
+			res, ok := <-resCh
+			if !ok {
+				return
+			}
+			if err := stream.Send(res); err != nil {
+				l.Debug("error writing message to stream", zap.Error(err))
+			}
+		}
+	}()
+
+	go func() { errCh <- m.DeltaStream(ctx, reqCh, resCh) }()
+	err := <-errCh
+	close(resCh)
+	close(errCh)
+	return err
+}
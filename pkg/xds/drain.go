@@ -0,0 +1,77 @@
+package xds
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var xdsStreamsDrained = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ekglue_xds_streams_drained",
+	Help: "The number of streams closed because the server is draining, by whether their clients had acknowledged every response or DrainTimeout passed first.",
+}, []string{"manager_name", "config_type", "result"})
+
+// errDraining is returned from streams that were closed because the server is draining.
+// Unavailable tells the client to reconnect, to another server, which it does immediately.
+var errDraining = status.Error(codes.Unavailable, "server draining; please reconnect")
+
+// drainPollInterval is how often a draining stream checks whether its client has acknowledged
+// every response.
+const drainPollInterval = 100 * time.Millisecond
+
+// DrainStatus describes the progress of a manager's streams towards closing while the server
+// drains; see DrainTimeout.
+type DrainStatus struct {
+	// Draining is true once the server has started draining.
+	Draining bool `json:"draining"`
+	// OpenStreams is the number of streams that haven't closed yet.
+	OpenStreams int `json:"open_streams"`
+	// AwaitingAck is the number of open streams that are waiting for their client to accept or
+	// reject a response before closing.
+	AwaitingAck int `json:"awaiting_ack"`
+}
+
+// DrainStatus returns the progress of the manager's streams towards closing while the server
+// drains.
+func (m *Manager) DrainStatus() *DrainStatus {
+	result := new(DrainStatus)
+	select {
+	case <-m.Draining:
+		result.Draining = true
+	default:
+	}
+	m.sessionsMu.Lock()
+	defer m.sessionsMu.Unlock()
+	for s := range m.sessions {
+		result.OpenStreams++
+		s.mu.Lock()
+		if s.awaitingAck {
+			result.AwaitingAck++
+		}
+		s.mu.Unlock()
+	}
+	return result
+}
+
+// drain decides what to do with a stream while the server is draining, like expire does for
+// streams that reached their maximum age.  A stream with responses awaiting acknowledgement is
+// given until deadline to finish them, so that a client isn't cut off in the middle of applying a
+// push and made to fetch it again from another server; drain returns the channel to wait on
+// before checking again.  Otherwise, it returns errDraining, which the stream should return.
+func (m *Manager) drain(s *session, inFlight int, deadline time.Time) (<-chan time.Time, error) {
+	if inFlight > 0 && time.Now().Before(deadline) {
+		s.mu.Lock()
+		s.awaitingAck = true
+		s.mu.Unlock()
+		return time.After(drainPollInterval), nil
+	}
+	result := "acknowledged"
+	if inFlight > 0 {
+		result = "timed_out"
+	}
+	xdsStreamsDrained.WithLabelValues(m.Name, m.Type, result).Inc()
+	return nil, errDraining
+}
@@ -0,0 +1,45 @@
+package xds
+
+import (
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SetEnabled enables or disables the manager.  A disabled manager keeps tracking its resources,
+// but doesn't serve them; open streams are closed with status UNAVAILABLE, and new streams fail
+// with the same error.  Managers start enabled.
+func (m *Manager) SetEnabled(enabled bool) {
+	m.enabledMu.Lock()
+	defer m.enabledMu.Unlock()
+	if enabled != m.disabled {
+		return
+	}
+	m.disabled = !enabled
+	if enabled {
+		m.disabledCh = make(chan struct{})
+	} else {
+		close(m.disabledCh)
+	}
+	m.Logger.Info("manager enabled state changed", zap.Bool("enabled", enabled))
+}
+
+// Enabled returns true if the manager is serving its resources.
+func (m *Manager) Enabled() bool {
+	m.enabledMu.Lock()
+	defer m.enabledMu.Unlock()
+	return !m.disabled
+}
+
+// watchEnabled returns a channel that is closed when the manager is disabled, or false if the
+// manager is already disabled.
+func (m *Manager) watchEnabled() (<-chan struct{}, bool) {
+	m.enabledMu.Lock()
+	defer m.enabledMu.Unlock()
+	return m.disabledCh, !m.disabled
+}
+
+// disabledError is the error returned by streams of a disabled manager.
+func (m *Manager) disabledError() error {
+	return status.Errorf(codes.Unavailable, "%s are not being served by this server", m.Name)
+}
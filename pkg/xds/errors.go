@@ -0,0 +1,65 @@
+package xds
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ValidationError is returned when a resource fails its protoc-gen-validate rules, or one of a
+// manager's Validators.
+type ValidationError struct {
+	// Name is the name of the invalid resource.
+	Name string
+	// Err is the error returned by the resource's Validate method or the failing Validator.
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%q: validate: %v", e.Name, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+// NameConflictError is returned when a single change contains more than one resource with the
+// same name, so that it's ambiguous which one should be served.
+type NameConflictError struct {
+	// Name is the name that appears more than once.
+	Name string
+}
+
+func (e *NameConflictError) Error() string {
+	return fmt.Sprintf("%q: more than one resource with this name", e.Name)
+}
+
+// MarshalError is returned when a resource can't be serialized for clients, for example because a
+// string field contains invalid UTF-8.
+type MarshalError struct {
+	// Name is the name of the resource that couldn't be marshaled.
+	Name string
+	// Err is the error from the protobuf library.
+	Err error
+}
+
+func (e *MarshalError) Error() string {
+	return fmt.Sprintf("%q: marshal: %v", e.Name, e.Err)
+}
+
+func (e *MarshalError) Unwrap() error { return e.Err }
+
+// ResourceName returns the name of the resource that caused err, if err is or wraps a
+// ValidationError, NameConflictError, or MarshalError.
+func ResourceName(err error) (string, bool) {
+	var v *ValidationError
+	if errors.As(err, &v) {
+		return v.Name, true
+	}
+	var c *NameConflictError
+	if errors.As(err, &c) {
+		return c.Name, true
+	}
+	var m *MarshalError
+	if errors.As(err, &m) {
+		return m.Name, true
+	}
+	return "", false
+}
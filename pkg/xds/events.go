@@ -0,0 +1,165 @@
+package xds
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var xdsEventsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ekglue_xds_events_dropped",
+	Help: "The number of events not delivered to a subscriber because its buffer was full.",
+}, []string{"manager_name", "config_type"})
+
+// Event is something that happened to a manager's resources or clients, delivered to
+// subscribers; see Subscribe.  It is one of ResourceAdded, ResourceUpdated, ResourceDeleted,
+// PushCompleted, or AckReceived.
+type Event interface {
+	event()
+}
+
+// ResourceAdded is an Event for a resource that clients are told about for the first time.
+type ResourceAdded struct {
+	Version  string // The version in which it was added.
+	Name     string
+	Resource Resource
+}
+
+// ResourceUpdated is an Event for a resource whose new value clients are told about.
+type ResourceUpdated struct {
+	Version  string // The version in which it was updated.
+	Name     string
+	Resource Resource
+	Previous Resource
+}
+
+// ResourceDeleted is an Event for a resource that clients are told no longer exists.
+type ResourceDeleted struct {
+	Version  string // The version in which it was deleted.
+	Name     string
+	Previous Resource
+}
+
+// PushCompleted is an Event for a response handed to a client's stream.  An AckReceived follows
+// when the client accepts or rejects it.
+type PushCompleted struct {
+	Node    string // The id of the node.
+	Version string // The version of the response.
+	// Resources are the names of the resources in the response.
+	Resources []string
+	// RemovedResources are, for an incremental stream, the names of the resources that the
+	// response removed.
+	RemovedResources []string
+}
+
+// AckReceived is an Event for a client accepting or rejecting a response; it's the same
+// Acknowledgment that OnAck receives.
+type AckReceived struct {
+	Acknowledgment
+}
+
+func (ResourceAdded) event()   {}
+func (ResourceUpdated) event() {}
+func (ResourceDeleted) event() {}
+func (PushCompleted) event()   {}
+func (AckReceived) event()     {}
+
+// Subscription receives the events of a manager; see Subscribe.
+type Subscription struct {
+	m  *Manager
+	ch chan Event
+}
+
+// Subscribe returns a subscription to the manager's events, so that programs embedding ekglue
+// can react to changes and acknowledgements, like by invalidating a cache, without polling List.
+// Events are delivered in the order they happen, but the manager never waits for a subscriber:
+// events that don't fit in the subscription's buffer of the given size are dropped, and counted by
+// the ekglue_xds_events_dropped metric.  Resource events describe what clients are told, so
+// changes held back by a pin are reported when the pin ends.  Call Close when done.
+func (m *Manager) Subscribe(buffer int) *Subscription {
+	s := &Subscription{m: m, ch: make(chan Event, buffer)}
+	m.eventsMu.Lock()
+	defer m.eventsMu.Unlock()
+	if m.subscriptions == nil {
+		m.subscriptions = make(map[*Subscription]struct{})
+	}
+	m.subscriptions[s] = struct{}{}
+	return s
+}
+
+// Events returns the channel that receives the subscription's events.  It is closed by Close.
+func (s *Subscription) Events() <-chan Event {
+	return s.ch
+}
+
+// Close ends the subscription.  It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.m.eventsMu.Lock()
+	defer s.m.eventsMu.Unlock()
+	if _, ok := s.m.subscriptions[s]; !ok {
+		return
+	}
+	delete(s.m.subscriptions, s)
+	close(s.ch)
+}
+
+// hasSubscribers returns true if anyone is subscribed to the manager's events.
+func (m *Manager) hasSubscribers() bool {
+	m.eventsMu.Lock()
+	defer m.eventsMu.Unlock()
+	return len(m.subscriptions) > 0
+}
+
+// publish delivers events to every subscriber that has room for them.  It never blocks, so it may
+// be called with the resource lock held.
+func (m *Manager) publish(events ...Event) {
+	m.eventsMu.Lock()
+	defer m.eventsMu.Unlock()
+	for s := range m.subscriptions {
+		for _, e := range events {
+			select {
+			case s.ch <- e:
+			default:
+				xdsEventsDropped.WithLabelValues(m.Name, m.Type).Inc()
+			}
+		}
+	}
+}
+
+// resourceEvents returns the events for the named resources, which changed in version, and
+// records their values as the ones clients were last told about.  You must hold the resource lock.
+func (m *Manager) resourceEvents(version string, names []string) []Event {
+	if m.notified == nil {
+		m.notified = make(map[string]Resource)
+	}
+	report := m.hasSubscribers()
+	var result []Event
+	for _, name := range names {
+		prev, existed := m.notified[name]
+		r, exists := m.resources[name]
+		if exists {
+			m.notified[name] = r
+		} else {
+			delete(m.notified, name)
+		}
+		if !report {
+			continue
+		}
+		switch {
+		case exists && existed:
+			result = append(result, ResourceUpdated{Version: version, Name: name, Resource: r, Previous: prev})
+		case exists:
+			result = append(result, ResourceAdded{Version: version, Name: name, Resource: r})
+		case existed:
+			result = append(result, ResourceDeleted{Version: version, Name: name, Previous: prev})
+		}
+	}
+	return result
+}
+
+// acknowledged reports an acknowledgement to OnAck and subscribers.
+func (m *Manager) acknowledged(a Acknowledgment) {
+	if f := m.OnAck; f != nil {
+		f(a)
+	}
+	m.publish(AckReceived{Acknowledgment: a})
+}
@@ -0,0 +1,50 @@
+package xds
+
+import (
+	"context"
+	"errors"
+
+	discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var xdsFetches = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ekglue_xds_fetches",
+	Help: "The number of unary (REST or gRPC Fetch) discovery requests, by result: ok, not_modified, or error.",
+}, []string{"manager_name", "config_type", "result"})
+
+// ErrNotModified is returned by Fetch when the client already has the current version of the
+// resources it asked for.  Over REST, it's a 304 Not Modified.
+var ErrNotModified = errors.New("not modified: version is current")
+
+// Fetch answers a single state-of-the-world discovery request, for clients that poll instead of
+// streaming, like Envoy with api_type REST, or scripts.  The response is the same one that a
+// stream subscribed to the same resources, from the same node, would receive.  If the request's
+// version_info is the current version, ErrNotModified is returned instead.  There are no ACKs; a
+// client that rejects a response just asks again with its old version.
+func (m *Manager) Fetch(ctx context.Context, req *discovery_v3.DiscoveryRequest) (*discovery_v3.DiscoveryResponse, error) {
+	result := "error"
+	defer func() { xdsFetches.WithLabelValues(m.Name, m.Type, result).Inc() }()
+	if !m.Enabled() {
+		return nil, m.disabledError()
+	}
+	if t := req.GetTypeUrl(); t != "" && t != m.Type {
+		return nil, status.Errorf(codes.InvalidArgument, "type %q is not served by %s", t, m.Name)
+	}
+	res, _, _, err := m.buildDiscoveryResponse(req.GetResourceNames(), req.GetNode())
+	if err != nil {
+		ctxzap.Extract(ctx).Error("problem building response for fetch", zap.String("xds_type", m.Type), zap.String("node", req.GetNode().GetId()), zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "build response: %v", err)
+	}
+	if v := req.GetVersionInfo(); v != "" && v == res.GetVersionInfo() {
+		result = "not_modified"
+		return nil, ErrNotModified
+	}
+	result = "ok"
+	return res, nil
+}
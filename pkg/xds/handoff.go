@@ -0,0 +1,87 @@
+package xds
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var xdsStreamsHandedOff = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ekglue_xds_streams_handed_off",
+	Help: "The number of streams closed so that their clients reconnect to another server taking over from this one.",
+}, []string{"manager_name", "config_type"})
+
+// errHandedOff is returned from a stream that was closed by HandOff.  Unavailable tells the client
+// to reconnect, which it does immediately.
+var errHandedOff = status.Error(codes.Unavailable, "this server is handing its clients off to another one; please reconnect")
+
+// HandOff closes up to n open streams, so that their clients reconnect, to another server that is
+// taking over from this one, and returns the number of streams it closed.  Like streams that reach
+// MaxStreamAge, a stream with responses awaiting acknowledgement is closed once they are answered.
+// Calling it repeatedly moves clients over gradually.
+func (m *Manager) HandOff(n int) int {
+	m.sessionsMu.Lock()
+	defer m.sessionsMu.Unlock()
+	var closed int
+	for s := range m.sessions {
+		if closed >= n {
+			break
+		}
+		if s.handOff() {
+			closed++
+		}
+	}
+	return closed
+}
+
+// OpenStreams returns the number of open streams that HandOff hasn't closed yet.
+func (m *Manager) OpenStreams() int {
+	m.sessionsMu.Lock()
+	defer m.sessionsMu.Unlock()
+	var result int
+	for s := range m.sessions {
+		if !s.handingOff() {
+			result++
+		}
+	}
+	return result
+}
+
+// handOff tells the session's stream to close, returning false if it has already been told.
+func (s *session) handOff() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.handoff:
+		return false
+	default:
+		close(s.handoff)
+		return true
+	}
+}
+
+// handingOff returns true if the session's stream has been told to close.
+func (s *session) handingOff() bool {
+	select {
+	case <-s.handoff:
+		return true
+	default:
+		return false
+	}
+}
+
+// handOff decides what to do with a stream that HandOff closed, like expire does for streams that
+// reached their maximum age.  It returns a channel to wait on before checking again, or
+// errHandedOff, which the stream should return.
+func (m *Manager) handOff(inFlight int) (<-chan struct{}, error) {
+	if inFlight > 0 {
+		ch := make(chan struct{})
+		time.AfterFunc(time.Second, func() { close(ch) })
+		return ch, nil
+	}
+	xdsStreamsHandedOff.WithLabelValues(m.Name, m.Type).Inc()
+	return nil, errHandedOff
+}
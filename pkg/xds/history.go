@@ -0,0 +1,216 @@
+package xds
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"sigs.k8s.io/yaml"
+)
+
+// HistoryRecord is an entry in a manager's history: either a change to the managed resources, or a
+// client accepting or rejecting a version.
+type HistoryRecord struct {
+	Time    time.Time `json:"time"`
+	Manager string    `json:"manager"`
+	// Event is "change", "ack", "nack", "rollback", "pin", "unpin", "pin_expired", or "capture".
+	Event string `json:"event"`
+	// Version is the version that was generated, accepted, rejected, or rolled back.
+	Version string `json:"version"`
+	// Node is the ID of the node that accepted or rejected the version.
+	Node string `json:"node,omitempty"`
+	// Resources are the names of the resources that changed.
+	Resources []string `json:"resources,omitempty"`
+	// Error is the reason a node gave for rejecting a version, why it was rolled back, why a
+	// resource was pinned, or why capturing a node's admin interface failed.
+	Error string `json:"error,omitempty"`
+	// Capture holds the pages captured from the admin interface of a node that kept rejecting
+	// versions, by path; see AdminCapture.
+	Capture map[string]string `json:"capture,omitempty"`
+}
+
+// HistoryStore stores HistoryRecords.  Implementations must be safe for concurrent use, and should
+// bound the amount of history they retain.  RingHistory and FileHistory are provided; stores backed
+// by a database can be implemented outside of this package, so that ekglue itself doesn't need to
+// link in any database drivers.
+type HistoryStore interface {
+	// Record stores a record.
+	Record(r *HistoryRecord) error
+	// Recent returns up to n of the most recent records, oldest first.
+	Recent(n int) ([]*HistoryRecord, error)
+}
+
+// RingHistory is a HistoryStore that keeps a fixed number of records in memory.
+type RingHistory struct {
+	mu      sync.Mutex
+	records []*HistoryRecord
+	next    int
+	full    bool
+}
+
+// NewRingHistory returns a RingHistory that keeps the size most recent records.
+func NewRingHistory(size int) *RingHistory {
+	if size < 1 {
+		size = 1
+	}
+	return &RingHistory{records: make([]*HistoryRecord, size)}
+}
+
+// Record implements HistoryStore.
+func (h *RingHistory) Record(r *HistoryRecord) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records[h.next] = r
+	h.next = (h.next + 1) % len(h.records)
+	if h.next == 0 {
+		h.full = true
+	}
+	return nil
+}
+
+// Recent implements HistoryStore.
+func (h *RingHistory) Recent(n int) ([]*HistoryRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var all []*HistoryRecord
+	if h.full {
+		all = append(all, h.records[h.next:]...)
+	}
+	all = append(all, h.records[:h.next]...)
+	if n < len(all) {
+		all = all[len(all)-n:]
+	}
+	return all, nil
+}
+
+// FileHistory is a HistoryStore that appends records to a file, one JSON object per line, so that
+// history survives restarts.  When the file reaches MaxBytes, it is renamed to Path + ".1"
+// (replacing any previous one) and a new file is started, so at most twice MaxBytes is retained.
+type FileHistory struct {
+	Path     string
+	MaxBytes int64
+
+	mu sync.Mutex
+}
+
+// NewFileHistory returns a FileHistory that writes to path.
+func NewFileHistory(path string, maxBytes int64) *FileHistory {
+	return &FileHistory{Path: path, MaxBytes: maxBytes}
+}
+
+// Record implements HistoryStore.
+func (h *FileHistory) Record(r *HistoryRecord) error {
+	js, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("marshal record: %w", err)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if st, err := os.Stat(h.Path); err == nil && h.MaxBytes > 0 && st.Size()+int64(len(js)) >= h.MaxBytes {
+		if err := os.Rename(h.Path, h.Path+".1"); err != nil {
+			return fmt.Errorf("rotate history file: %w", err)
+		}
+	}
+	f, err := os.OpenFile(h.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("open history file: %w", err)
+	}
+	if _, err := f.Write(append(js, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("write history file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close history file: %w", err)
+	}
+	return nil
+}
+
+// readHistoryFile reads every record in a history file; a missing file has no records.
+func readHistoryFile(path string) ([]*HistoryRecord, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open history file: %w", err)
+	}
+	defer f.Close()
+	var result []*HistoryRecord
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1024*1024)
+	for s.Scan() {
+		r := new(HistoryRecord)
+		if err := json.Unmarshal(s.Bytes(), r); err != nil {
+			// A partially-written last line, probably from a crash.
+			continue
+		}
+		result = append(result, r)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("read history file: %w", err)
+	}
+	return result, nil
+}
+
+// Recent implements HistoryStore.
+func (h *FileHistory) Recent(n int) ([]*HistoryRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var all []*HistoryRecord
+	for _, path := range []string{h.Path + ".1", h.Path} {
+		rs, err := readHistoryFile(path)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, rs...)
+	}
+	if n < len(all) {
+		all = all[len(all)-n:]
+	}
+	return all, nil
+}
+
+// record adds a record to the manager's history, if it has one.
+func (m *Manager) record(r *HistoryRecord) {
+	if m.History == nil {
+		return
+	}
+	r.Time = time.Now()
+	r.Manager = m.Name
+	if err := m.History.Record(r); err != nil {
+		m.Logger.Warn("problem recording history", zap.Error(err))
+	}
+}
+
+// HistoryHandler returns an http.Handler that serves the most recent records in h as YAML.  The
+// number of records is controlled by the "n" query parameter, which defaults to 100.
+func HistoryHandler(h HistoryStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := 100
+		if s := req.FormValue("n"); s != "" {
+			var err error
+			if n, err = strconv.Atoi(s); err != nil {
+				http.Error(w, fmt.Sprintf("parse n: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		rs, err := h.Recent(n)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ya, err := yaml.Marshal(rs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(ya)
+	})
+}
@@ -0,0 +1,77 @@
+package xds
+
+import (
+	"slices"
+	"strings"
+
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultMaxResponseBytes is the largest message that gRPC clients accept by default.  Envoy's own
+// gRPC client has no limit, but proxyless gRPC clients and Envoys using the Google gRPC client do.
+const DefaultMaxResponseBytes = 4 * 1024 * 1024
+
+// FullStateClientFeature is a client feature that clients list in their node's client_features if
+// they need every response to contain every resource they subscribed to, even if it is larger than
+// MaxResponseBytes, like Mirror does.
+const FullStateClientFeature = "ekglue.io.full_state_responses"
+
+var xdsOversizedResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ekglue_xds_oversized_responses",
+	Help: "The number of responses larger than the manager's response size limit, by whether they were split into smaller responses or sent anyway.",
+}, []string{"manager_name", "config_type", "action"})
+
+// partialResponses returns true if state-of-the-world responses of the manager's type may contain
+// only some of the subscribed resources.  Clients keep the resources that a response leaves out for
+// load assignments and route configurations, but treat missing clusters and listeners as deleted.
+func (m *Manager) partialResponses() bool {
+	return strings.HasSuffix(m.Type, ".ClusterLoadAssignment") || strings.HasSuffix(m.Type, ".RouteConfiguration")
+}
+
+// splitResponse splits res, which contains the named resources, into responses no larger than
+// MaxResponseBytes, if it is larger and the protocol and node allow it.  Every part has the same
+// version, and its own nonce.  A single resource larger than the limit is sent on its own.
+func (m *Manager) splitResponse(res *discovery_v3.DiscoveryResponse, names []string, node *envoy_config_core_v3.Node) ([]*discovery_v3.DiscoveryResponse, [][]string) {
+	size := proto.Size(res)
+	if m.MaxResponseBytes <= 0 || size <= m.MaxResponseBytes {
+		return []*discovery_v3.DiscoveryResponse{res}, [][]string{names}
+	}
+	if !m.partialResponses() || len(names) < 2 || slices.Contains(node.GetClientFeatures(), FullStateClientFeature) {
+		xdsOversizedResponses.WithLabelValues(m.Name, m.Type, "sent").Inc()
+		m.Logger.Error("response exceeds the response size limit and cannot be split; clients with a smaller receive limit will fail to receive it",
+			zap.Int("bytes", size), zap.Int("limit", m.MaxResponseBytes), zap.Int("resources", len(names)))
+		return []*discovery_v3.DiscoveryResponse{res}, [][]string{names}
+	}
+	xdsOversizedResponses.WithLabelValues(m.Name, m.Type, "split").Inc()
+	overhead := proto.Size(&discovery_v3.DiscoveryResponse{VersionInfo: res.GetVersionInfo(), TypeUrl: res.GetTypeUrl(), Nonce: res.GetNonce()})
+	var parts []*discovery_v3.DiscoveryResponse
+	var partNames [][]string
+	start, partSize := 0, overhead
+	flush := func(end int) {
+		part := &discovery_v3.DiscoveryResponse{
+			VersionInfo: res.GetVersionInfo(),
+			TypeUrl:     res.GetTypeUrl(),
+			Resources:   res.GetResources()[start:end],
+			Nonce:       nonceFor(res.GetVersionInfo(), names[start:end]),
+		}
+		parts = append(parts, part)
+		partNames = append(partNames, names[start:end])
+		start, partSize = end, overhead
+	}
+	for i, r := range res.GetResources() {
+		// Each resource costs its size, plus a tag and a length prefix of up to 5 bytes.
+		n := proto.Size(r) + 6
+		if i > start && partSize+n > m.MaxResponseBytes {
+			flush(i)
+		}
+		partSize += n
+	}
+	flush(len(names))
+	m.Logger.Warn("split a response that exceeds the response size limit", zap.Int("bytes", size), zap.Int("limit", m.MaxResponseBytes), zap.Int("resources", len(names)), zap.Int("parts", len(parts)))
+	return parts, partNames
+}
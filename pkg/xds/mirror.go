@@ -0,0 +1,102 @@
+package xds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+)
+
+var xdsMirroredResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ekglue_xds_mirrored_responses",
+	Help: "The number of responses received from the server being mirrored, by whether they were applied or rejected.",
+}, []string{"manager_name", "config_type", "result"})
+
+// Mirror makes the managers replicas of another xDS server, usually another ekglue, until the
+// context is done or the stream fails.  It subscribes to every resource of each manager's type
+// over ADS, identifying itself as node, and replaces the manager's resources with each response it
+// receives, so that a standby server has the same resources as its primary and can take over its
+// clients without having to relearn anything.  Responses that a manager rejects are NACKed, and the
+// manager keeps the resources it had.  The node advertises FullStateClientFeature, so the primary
+// never splits responses; the client must accept messages as large as the primary sends.
+//
+// Resources are compared by content, so a mirror only pushes real changes to its own clients.
+// Versions are only the same on both servers if both use DigestVersions.  The primary must not
+// scope node out of any resources.
+func Mirror(ctx context.Context, client discovery_v3.AggregatedDiscoveryServiceClient, node *envoy_config_core_v3.Node, managers ...*Manager) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.StreamAggregatedResources(ctx)
+	if err != nil {
+		return fmt.Errorf("start stream: %w", err)
+	}
+	// Replace needs every resource in every response.
+	node = proto.Clone(node).(*envoy_config_core_v3.Node)
+	node.ClientFeatures = append(node.ClientFeatures, FullStateClientFeature)
+	byType := make(map[string]*Manager, len(managers))
+	versions := make(map[string]string, len(managers)) // the last version applied, by type
+	for _, m := range managers {
+		byType[m.Type] = m
+		if err := stream.Send(&discovery_v3.DiscoveryRequest{Node: node, TypeUrl: m.Type}); err != nil {
+			return fmt.Errorf("subscribe to %s: %w", m.Type, err)
+		}
+	}
+	for {
+		res, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return errors.New("server closed stream")
+		}
+		if err != nil {
+			return fmt.Errorf("receive: %w", err)
+		}
+		m, ok := byType[res.GetTypeUrl()]
+		if !ok {
+			// Not something we asked for; there is nothing useful to say back.
+			continue
+		}
+		req := &discovery_v3.DiscoveryRequest{TypeUrl: m.Type, ResponseNonce: res.GetNonce()}
+		if err := m.ReplaceWithResponse(ctx, res); err != nil {
+			xdsMirroredResponses.WithLabelValues(m.Name, m.Type, "rejected").Inc()
+			m.Logger.Error("rejecting mirrored response", zap.String("version", res.GetVersionInfo()), zap.Error(err))
+			req.VersionInfo = versions[m.Type]
+			req.ErrorDetail = &status.Status{Code: int32(codes.InvalidArgument), Message: err.Error()}
+		} else {
+			xdsMirroredResponses.WithLabelValues(m.Name, m.Type, "applied").Inc()
+			req.VersionInfo = res.GetVersionInfo()
+			versions[m.Type] = req.VersionInfo
+		}
+		if err := stream.Send(req); err != nil {
+			return fmt.Errorf("acknowledge %s: %w", m.Type, err)
+		}
+	}
+}
+
+// ReplaceWithResponse replaces the manager's resources with those in res, a complete
+// state-of-the-world response of the manager's type from another server.
+func (m *Manager) ReplaceWithResponse(ctx context.Context, res *discovery_v3.DiscoveryResponse) error {
+	rs := make([]Resource, 0, len(res.GetResources()))
+	for i, a := range res.GetResources() {
+		if a.GetTypeUrl() != m.Type {
+			return fmt.Errorf("resource %d: type %s is not %s", i, a.GetTypeUrl(), m.Type)
+		}
+		msg, err := a.UnmarshalNew()
+		if err != nil {
+			return fmt.Errorf("resource %d: %w", i, err)
+		}
+		r, ok := msg.(Resource)
+		if !ok {
+			return fmt.Errorf("resource %d: %T is not an xDS resource", i, msg)
+		}
+		rs = append(rs, r)
+	}
+	return m.Replace(ctx, rs)
+}
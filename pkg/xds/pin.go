@@ -0,0 +1,193 @@
+package xds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	xdsPinnedResources = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ekglue_xds_pinned_resources",
+		Help: "The number of resources pinned at their current value.",
+	}, []string{"manager_name", "config_type"})
+	xdsHeldChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ekglue_xds_held_changes",
+		Help: "The number of changes to pinned resources that were held back until the pin ends.",
+	}, []string{"manager_name", "config_type"})
+	xdsPinsExpired = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ekglue_xds_pins_expired",
+		Help: "The number of pins that ended because they expired, rather than being removed.",
+	}, []string{"manager_name", "config_type"})
+)
+
+// ErrNotPinned is returned by Unpin when the resource isn't pinned.
+var ErrNotPinned = errors.New("not pinned")
+
+// pin holds a resource at the value it had when it was pinned.
+type pin struct {
+	value   Resource // the value being served
+	desired Resource // the latest value from the manager's sources; nil if they deleted it
+	since   time.Time
+	expires time.Time
+	reason  string
+	timer   *time.Timer
+}
+
+// PinStatus describes a pinned resource.
+type PinStatus struct {
+	Name    string    `json:"name"`
+	Reason  string    `json:"reason,omitempty"`
+	Since   time.Time `json:"since"`
+	Expires time.Time `json:"expires"`
+	// Held is true if the resource has been changed or deleted since it was pinned; the change
+	// is applied when the pin ends.
+	Held bool `json:"held"`
+}
+
+// Pin holds the named resource at its current value for ttl, during delicate operations.  Changes
+// to the resource, from any source, are held back while it is pinned; the latest one is applied
+// when the pin expires or is removed with Unpin.  Pinning a pinned resource changes its expiry and
+// reason.  Rollbacks (see RollbackThreshold) ignore pins.
+func (m *Manager) Pin(name string, ttl time.Duration, reason string) error {
+	if ttl <= 0 {
+		return fmt.Errorf("pin %q: ttl must be positive", name)
+	}
+	m.resourcesMu.Lock()
+	defer m.resourcesMu.Unlock()
+	now := time.Now()
+	p, ok := m.pins[name]
+	if ok {
+		p.timer.Stop()
+	} else {
+		r, ok := m.resources[name]
+		if !ok {
+			return fmt.Errorf("pin %q: no such resource", name)
+		}
+		p = &pin{value: r, desired: r, since: now}
+		if m.pins == nil {
+			m.pins = make(map[string]*pin)
+		}
+		m.pins[name] = p
+	}
+	p.expires, p.reason = now.Add(ttl), reason
+	p.timer = time.AfterFunc(ttl, func() { m.expirePin(name, p) })
+	xdsPinnedResources.WithLabelValues(m.Name, m.Type).Set(float64(len(m.pins)))
+	m.Logger.Info("resource pinned", zap.String("name", name), zap.Duration("ttl", ttl), zap.String("reason", reason))
+	m.record(&HistoryRecord{Event: "pin", Version: m.versionString(), Resources: []string{name}, Error: reason})
+	return nil
+}
+
+// Unpin removes the pin on the named resource, and applies any change that was held back.
+func (m *Manager) Unpin(ctx context.Context, name string) error {
+	m.resourcesMu.Lock()
+	p, ok := m.pins[name]
+	if !ok {
+		m.resourcesMu.Unlock()
+		return fmt.Errorf("unpin %q: %w", name, ErrNotPinned)
+	}
+	p.timer.Stop()
+	m.releasePin(ctx, name, p, "unpin")
+	return nil
+}
+
+// expirePin removes p, if it's still the pin on the named resource.
+func (m *Manager) expirePin(name string, p *pin) {
+	m.resourcesMu.Lock()
+	if m.pins[name] != p {
+		m.resourcesMu.Unlock()
+		return
+	}
+	xdsPinsExpired.WithLabelValues(m.Name, m.Type).Inc()
+	m.releasePin(context.Background(), name, p, "pin_expired")
+}
+
+// releasePin removes the pin on the named resource, applies its held change, and notifies clients.
+// You must hold the resource lock; it is released.
+func (m *Manager) releasePin(ctx context.Context, name string, p *pin, event string) {
+	delete(m.pins, name)
+	xdsPinnedResources.WithLabelValues(m.Name, m.Type).Set(float64(len(m.pins)))
+	held := p.held()
+	if held {
+		if p.desired == nil {
+			delete(m.resources, name)
+		} else {
+			m.resources[name] = p.desired
+		}
+	}
+	version := m.versionString()
+	m.resourcesMu.Unlock()
+	m.Logger.Info("resource unpinned", zap.String("name", name), zap.String("event", event), zap.Bool("held_change", held))
+	m.record(&HistoryRecord{Event: event, Version: version, Resources: []string{name}})
+	if held {
+		m.notify(ctx, []string{name})
+	}
+}
+
+// held returns true if the pinned resource has changed since it was pinned.
+func (p *pin) held() bool {
+	return p.desired == nil || !proto.Equal(p.value, p.desired)
+}
+
+// Pins returns the pinned resources, sorted by name.
+func (m *Manager) Pins() []*PinStatus {
+	m.resourcesMu.Lock()
+	defer m.resourcesMu.Unlock()
+	result := make([]*PinStatus, 0, len(m.pins))
+	for name, p := range m.pins {
+		result = append(result, &PinStatus{
+			Name:    name,
+			Reason:  p.reason,
+			Since:   p.since,
+			Expires: p.expires,
+			Held:    p.held(),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// beginChange locks the resources for a change, and puts the latest desired value of each pinned
+// resource in place, so that the change is computed against what the sources last asked for,
+// rather than what is being served.  Call endChange when done.
+func (m *Manager) beginChange() {
+	m.resourcesMu.Lock()
+	for name, p := range m.pins {
+		if p.desired == nil {
+			delete(m.resources, name)
+		} else {
+			m.resources[name] = p.desired
+		}
+	}
+}
+
+// endChange records the new desired value of each pinned resource, puts its pinned value back,
+// and releases the resource lock.  It returns the changed resources that aren't pinned, which are
+// the ones to notify clients about.
+func (m *Manager) endChange(changed []string) []string {
+	defer m.resourcesMu.Unlock()
+	if len(m.pins) == 0 {
+		return changed
+	}
+	for name, p := range m.pins {
+		p.desired = m.resources[name]
+		m.resources[name] = p.value
+	}
+	result := make([]string, 0, len(changed))
+	for _, name := range changed {
+		if _, ok := m.pins[name]; ok {
+			xdsHeldChanges.WithLabelValues(m.Name, m.Type).Inc()
+			m.Logger.Info("holding back change to pinned resource", zap.String("name", name))
+			continue
+		}
+		result = append(result, name)
+	}
+	return result
+}
@@ -0,0 +1,89 @@
+package xds
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
+	"google.golang.org/protobuf/proto"
+)
+
+var xdsRollbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ekglue_xds_rollbacks",
+	Help: "The number of times a manager restored the last version every node accepted, because too many nodes rejected the current one.",
+}, []string{"manager_name", "config_type"})
+
+// checkRollback updates the manager's last good resources after node accepted or rejected version,
+// and rolls the resources changed since then back to them if enough nodes have rejected it; see
+// RollbackThreshold.
+// It returns the version whose resources were restored, or "" if nothing was rolled back.
+func (m *Manager) checkRollback(ctx context.Context, node, version string, ack bool) string {
+	if m.RollbackThreshold <= 0 {
+		return ""
+	}
+	s := m.RolloutStatus()
+	if s.Version != version || s.Nodes == 0 {
+		// Only the current version is good or bad; older ones have already been replaced.
+		return ""
+	}
+	m.resourcesMu.Lock()
+	if m.versionString() != version {
+		// Changed since RolloutStatus looked.
+		m.resourcesMu.Unlock()
+		return ""
+	}
+	if ack {
+		if s.Converged() {
+			m.good, m.goodVersion = maps.Clone(m.resources), version
+			m.sinceGood = make(map[string]struct{})
+		}
+		m.resourcesMu.Unlock()
+		return ""
+	}
+	if float64(s.Nacked)/float64(s.Nodes) < m.RollbackThreshold || m.good == nil {
+		m.resourcesMu.Unlock()
+		return ""
+	}
+	// Every change since the good version is rolled back, not just the current version's: the
+	// nodes may be rejecting a change made in an earlier version, whose rejections stopped
+	// counting when a newer version replaced it.
+	names := maps.Keys(m.sinceGood)
+	sort.Strings(names)
+	var changed []string
+	for _, n := range names {
+		old, wasGood := m.good[n]
+		cur, ok := m.resources[n]
+		switch {
+		case wasGood && (!ok || !proto.Equal(old, cur)):
+			m.resources[n] = old
+		case !wasGood && ok:
+			delete(m.resources, n)
+		default:
+			continue
+		}
+		changed = append(changed, n)
+	}
+	if len(changed) == 0 {
+		// Whatever the nodes are rejecting, it's not something a rollback would fix.
+		m.resourcesMu.Unlock()
+		return ""
+	}
+	restored := m.goodVersion
+	m.resourcesMu.Unlock()
+
+	xdsRollbacks.WithLabelValues(m.Name, m.Type).Inc()
+	m.Logger.Error("rolling back to the last version every node accepted", zap.String("version.rejected", version), zap.String("version.restored", restored), zap.Int("nodes", s.Nodes), zap.Int("nacked", s.Nacked), zap.Strings("resources", changed))
+	m.record(&HistoryRecord{
+		Event:     "rollback",
+		Version:   version,
+		Node:      node,
+		Resources: changed,
+		Error:     fmt.Sprintf("rejected by %d of %d nodes; restored %s", s.Nacked, s.Nodes, restored),
+	})
+	m.notify(ctx, changed)
+	return restored
+}
@@ -0,0 +1,230 @@
+package xds
+
+import (
+	"net/http"
+	"sort"
+
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"google.golang.org/protobuf/proto"
+	"sigs.k8s.io/yaml"
+)
+
+// nodeRollout is what a manager knows about the configuration a node is using.
+type nodeRollout struct {
+	node     *envoy_config_core_v3.Node // the node, as it identified itself when it connected
+	streams  int                        // number of open streams from the node
+	accepted string                     // the last version the node accepted
+	rejected string                     // the last version the node rejected, if it hasn't accepted anything since
+	nacks    int                        // the number of versions the node has rejected since it last accepted one
+}
+
+// RolloutStatus summarizes which configuration versions the connected nodes are using, so that
+// tooling can wait for every proxy to converge on a version before proceeding.
+type RolloutStatus struct {
+	// Version is the manager's current configuration version.
+	Version string `json:"version"`
+	// Nodes is the number of connected nodes.
+	Nodes int `json:"nodes"`
+	// Acked is the number of nodes that have accepted the current version.
+	Acked int `json:"acked"`
+	// Nacked is the number of nodes that rejected the current version.
+	Nacked int `json:"nacked"`
+	// Pending is the number of nodes that have not yet responded to the current version.
+	Pending int `json:"pending"`
+	// Accepted is the number of nodes using each version, by the last version they accepted.
+	Accepted map[string]int `json:"accepted,omitempty"`
+	// Rejected is the number of nodes whose last response rejected each version.
+	Rejected map[string]int `json:"rejected,omitempty"`
+}
+
+// Converged returns true if every connected node has accepted the current version.
+func (s *RolloutStatus) Converged() bool {
+	return s.Acked == s.Nodes
+}
+
+// rolloutConnect records that a stream from node has started.
+func (m *Manager) rolloutConnect(node *envoy_config_core_v3.Node) {
+	m.nodesMu.Lock()
+	defer m.nodesMu.Unlock()
+	n, ok := m.nodes[node.GetId()]
+	if !ok {
+		n = new(nodeRollout)
+		if e, ok := m.imported[node.GetId()]; ok {
+			n.accepted, n.rejected = e.Accepted, e.Rejected
+			delete(m.imported, node.GetId())
+		}
+		m.nodes[node.GetId()] = n
+	}
+	n.node = node
+	n.streams++
+}
+
+// Node returns the connected node with the provided ID, as it identified itself when it connected,
+// or nil if no such node is connected.
+func (m *Manager) Node(id string) *envoy_config_core_v3.Node {
+	m.nodesMu.Lock()
+	defer m.nodesMu.Unlock()
+	n, ok := m.nodes[id]
+	if !ok || n.node == nil {
+		return nil
+	}
+	return proto.Clone(n.node).(*envoy_config_core_v3.Node)
+}
+
+// rolloutDisconnect records that a stream from node has ended.  The node is forgotten when its
+// last stream ends.
+func (m *Manager) rolloutDisconnect(node string) {
+	m.nodesMu.Lock()
+	defer m.nodesMu.Unlock()
+	n, ok := m.nodes[node]
+	if !ok {
+		return
+	}
+	if n.streams--; n.streams <= 0 {
+		delete(m.nodes, node)
+		if n.accepted != "" {
+			xdsNodeAcceptedVersion.DeleteLabelValues(m.Name, m.Type, node, n.accepted)
+		}
+	}
+}
+
+// rolloutAck records that node accepted or rejected a version, and returns the number of versions
+// it has rejected in a row.
+func (m *Manager) rolloutAck(node, version string, ack bool) int {
+	m.nodesMu.Lock()
+	defer m.nodesMu.Unlock()
+	n, ok := m.nodes[node]
+	if !ok {
+		return 0
+	}
+	if ack {
+		m.rolloutAccept(node, n, version)
+	} else {
+		n.rejected = version
+		n.nacks++
+	}
+	return n.nacks
+}
+
+// rolloutAccept records that node accepted version.  You must hold nodesMu.
+func (m *Manager) rolloutAccept(node string, n *nodeRollout, version string) {
+	if n.accepted != version {
+		if n.accepted != "" {
+			xdsNodeAcceptedVersion.DeleteLabelValues(m.Name, m.Type, node, n.accepted)
+		}
+		xdsNodeAcceptedVersion.WithLabelValues(m.Name, m.Type, node, version).Set(1)
+	}
+	n.accepted, n.rejected, n.nacks = version, "", 0
+}
+
+// rolloutCurrent records that node has every change it is interested in as of the current
+// version, even though nothing was sent to it.  This is how incremental clients converge on
+// versions that didn't change any resources they are subscribed to.  A node whose last response
+// was a NACK is still using the config it rejected an update to, so it stays rejected until it
+// accepts a version that it was actually sent.
+func (m *Manager) rolloutCurrent(node string) {
+	m.resourcesMu.Lock()
+	version := m.versionString()
+	m.resourcesMu.Unlock()
+
+	m.nodesMu.Lock()
+	defer m.nodesMu.Unlock()
+	n, ok := m.nodes[node]
+	if !ok || n.rejected != "" {
+		return
+	}
+	m.rolloutAccept(node, n, version)
+}
+
+// RolloutStatus returns the rollout status of the current version.
+func (m *Manager) RolloutStatus() *RolloutStatus {
+	m.resourcesMu.Lock()
+	version := m.versionString()
+	m.resourcesMu.Unlock()
+
+	m.nodesMu.Lock()
+	defer m.nodesMu.Unlock()
+	s := &RolloutStatus{
+		Version:  version,
+		Nodes:    len(m.nodes),
+		Accepted: make(map[string]int),
+		Rejected: make(map[string]int),
+	}
+	for _, n := range m.nodes {
+		switch {
+		case n.accepted == version:
+			s.Acked++
+		case n.rejected == version:
+			s.Nacked++
+		default:
+			s.Pending++
+		}
+		if n.accepted != "" {
+			s.Accepted[n.accepted]++
+		}
+		if n.rejected != "" {
+			s.Rejected[n.rejected]++
+		}
+	}
+	return s
+}
+
+// RolloutStatusAsYAML returns the rollout status, marshaled as YAML.
+func (m *Manager) RolloutStatusAsYAML() ([]byte, error) {
+	return yaml.Marshal(m.RolloutStatus())
+}
+
+// ServeRolloutStatus is an http.Handler that serves the rollout status as YAML.
+func (m *Manager) ServeRolloutStatus(w http.ResponseWriter, req *http.Request) {
+	ya, err := m.RolloutStatusAsYAML()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(ya)
+}
+
+// LedgerEntry is what a manager knows about the configuration a node is using.
+type LedgerEntry struct {
+	Node string `json:"node"`
+	// Accepted is the last version the node accepted.
+	Accepted string `json:"accepted,omitempty"`
+	// Rejected is the last version the node rejected, if it hasn't accepted anything since.
+	Rejected string `json:"rejected,omitempty"`
+}
+
+// Ledger returns the versions that each connected node last accepted and rejected, sorted by node,
+// along with any imported entries of nodes that haven't connected yet.
+func (m *Manager) Ledger() []*LedgerEntry {
+	m.nodesMu.Lock()
+	defer m.nodesMu.Unlock()
+	result := make([]*LedgerEntry, 0, len(m.nodes)+len(m.imported))
+	for id, n := range m.nodes {
+		result = append(result, &LedgerEntry{Node: id, Accepted: n.accepted, Rejected: n.rejected})
+	}
+	for _, e := range m.imported {
+		result = append(result, e)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Node < result[j].Node })
+	return result
+}
+
+// ImportLedger imports the ledger of another server that is handing its clients off to this one.
+// When one of the nodes connects, it starts out with the imported versions, so RolloutStatus and
+// RollbackThreshold know what it is running before it acknowledges anything.  The versions are
+// only meaningful if both servers use DigestVersions.  Entries of nodes that are already connected
+// are ignored.
+func (m *Manager) ImportLedger(entries []*LedgerEntry) {
+	m.nodesMu.Lock()
+	defer m.nodesMu.Unlock()
+	if m.imported == nil {
+		m.imported = make(map[string]*LedgerEntry)
+	}
+	for _, e := range entries {
+		if _, ok := m.nodes[e.Node]; ok || e.Node == "" {
+			continue
+		}
+		m.imported[e.Node] = e
+	}
+}
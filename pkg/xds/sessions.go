@@ -0,0 +1,143 @@
+package xds
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+)
+
+// SessionStatus describes an open xDS stream, for debugging why a client doesn't see a resource.
+type SessionStatus struct {
+	// Node is the ID of the node, or "" if it hasn't sent a request yet.
+	Node string `json:"node"`
+	// Incremental is true for an incremental (delta) stream.
+	Incremental bool `json:"incremental,omitempty"`
+	// Connected is when the stream was opened.
+	Connected time.Time `json:"connected"`
+	// Subscribed is the sorted names of the resources the client subscribed to.  An empty list,
+	// or one containing "*", subscribes to every resource.
+	Subscribed []string `json:"subscribed"`
+	// Acked is the last version the client accepted.
+	Acked string `json:"acked,omitempty"`
+	// Rejected is the last version the client rejected, if it hasn't accepted one since.
+	Rejected string `json:"rejected,omitempty"`
+}
+
+// connected records the node that opened the stream.
+func (s *session) connected(node string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Node = node
+}
+
+// subscribed records the client's current subscriptions.
+func (s *session) subscribed(names []string) {
+	names = append([]string{}, names...)
+	sort.Strings(names)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Subscribed = names
+}
+
+// subscribe records a stream's current subscriptions, and reports any change to the names that
+// every stream subscribes to to OnSubscribe.
+func (m *Manager) subscribe(s *session, names []string) {
+	s.subscribed(names)
+	m.reportSubscriptions()
+}
+
+// reportSubscriptions calls OnSubscribe if the names of the resources subscribed to by open streams
+// changed since it was last called.
+func (m *Manager) reportSubscriptions() {
+	if m.OnSubscribe == nil {
+		return
+	}
+	m.subscribedMu.Lock()
+	defer m.subscribedMu.Unlock()
+	set := make(map[string]struct{})
+	m.sessionsMu.Lock()
+	for s := range m.sessions {
+		s.mu.Lock()
+		for _, name := range s.status.Subscribed {
+			if name != "*" {
+				set[name] = struct{}{}
+			}
+		}
+		s.mu.Unlock()
+	}
+	m.sessionsMu.Unlock()
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if m.subscribed != nil && slices.Equal(names, m.subscribed) {
+		return
+	}
+	m.subscribed = names
+	m.OnSubscribe(names)
+}
+
+// acked records that the client accepted a version.
+func (s *session) acked(version string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Acked, s.status.Rejected = version, ""
+}
+
+// rejected records that the client rejected a version.
+func (s *session) rejected(version string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Rejected = version
+}
+
+// Sessions returns the status of every open stream, sorted by node and then connection time.
+func (m *Manager) Sessions() []*SessionStatus {
+	m.sessionsMu.Lock()
+	result := make([]*SessionStatus, 0, len(m.sessions))
+	for s := range m.sessions {
+		s.mu.Lock()
+		status := s.status
+		s.mu.Unlock()
+		result = append(result, &status)
+	}
+	m.sessionsMu.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Node != result[j].Node {
+			return result[i].Node < result[j].Node
+		}
+		return result[i].Connected.Before(result[j].Connected)
+	})
+	return result
+}
+
+// ResourceVersion is the name and version of a managed resource.
+type ResourceVersion struct {
+	Name string `json:"name"`
+	// Version is derived from the resource's content, as in incremental responses, so it only
+	// changes when the resource does.
+	Version string `json:"version"`
+}
+
+// Versions returns the name and version of every managed resource, sorted by name.
+func (m *Manager) Versions() ([]*ResourceVersion, error) {
+	rs := m.List()
+	result := make([]*ResourceVersion, 0, len(rs))
+	for _, r := range rs {
+		a, err := marshalAny(r)
+		if err != nil {
+			return nil, fmt.Errorf("marshal resource %q: %w", resourceName(r), err)
+		}
+		result = append(result, &ResourceVersion{Name: resourceName(r), Version: resourceVersion(a)})
+	}
+	return result, nil
+}
+
+// Get returns the named resource, or nil if the manager has no such resource.
+func (m *Manager) Get(name string) Resource {
+	m.resourcesMu.Lock()
+	defer m.resourcesMu.Unlock()
+	return m.resources[name]
+}
@@ -0,0 +1,315 @@
+package xds
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+var xdsSnapshotsFollowed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ekglue_xds_snapshots_followed",
+	Help: "The number of new snapshots read from a shared snapshot store by a follower, by result: applied, rejected, or error (the store could not be read).",
+}, []string{"manager_name", "config_type", "result"})
+
+// SnapshotStore persists the last-known resources of each manager, so that a restarting server can
+// serve them immediately, instead of serving nothing until it has relearned them.  Envoy treats an
+// empty CDS response as "delete every cluster", so without a snapshot, a restart drops all traffic
+// until the Kubernetes reflectors finish their initial sync.  FileSnapshot is provided here; the
+// k8s package provides a store backed by a ConfigMap.
+type SnapshotStore interface {
+	// Save replaces the snapshot stored for the named manager.
+	Save(manager string, data []byte) error
+	// Load returns the snapshot stored for the named manager, or nil if there isn't one.
+	Load(manager string) ([]byte, error)
+}
+
+// FileSnapshot is a SnapshotStore that keeps each manager's snapshot in a file named after the
+// manager, in Dir.
+type FileSnapshot struct {
+	Dir string
+}
+
+// NewFileSnapshot returns a FileSnapshot that stores snapshots in dir.
+func NewFileSnapshot(dir string) *FileSnapshot {
+	return &FileSnapshot{Dir: dir}
+}
+
+func (s *FileSnapshot) path(manager string) string {
+	return filepath.Join(s.Dir, manager+".json")
+}
+
+// Save implements SnapshotStore.  The file is replaced atomically, so a crash never leaves a
+// partially-written snapshot.
+func (s *FileSnapshot) Save(manager string, data []byte) error {
+	f, err := os.CreateTemp(s.Dir, manager+".json.tmp*")
+	if err != nil {
+		return fmt.Errorf("create snapshot file: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("write snapshot file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("close snapshot file: %w", err)
+	}
+	if err := os.Rename(f.Name(), s.path(manager)); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("rename snapshot file: %w", err)
+	}
+	return nil
+}
+
+// Load implements SnapshotStore.
+func (s *FileSnapshot) Load(manager string) ([]byte, error) {
+	data, err := os.ReadFile(s.path(manager))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read snapshot file: %w", err)
+	}
+	return data, nil
+}
+
+// DefaultSnapshotInterval is the minimum time between snapshot saves of a manager whose
+// SnapshotInterval is zero.
+const DefaultSnapshotInterval = time.Second
+
+// snapshotResponse returns the current resources as a response, and the version that clients
+// receive them as.  The resource lock is only held long enough to copy the resources, since
+// marshaling every one of them is slow.
+func (m *Manager) snapshotResponse() (*discovery_v3.DiscoveryResponse, string, error) {
+	m.resourcesMu.Lock()
+	resources := maps.Clone(m.resources)
+	version := m.versionString()
+	m.resourcesMu.Unlock()
+	names := maps.Keys(resources)
+	sort.Strings(names)
+	anys := make([]*anypb.Any, len(names))
+	for i, n := range names {
+		any, err := marshalAny(resources[n])
+		if err != nil {
+			return nil, "", fmt.Errorf("marshal resource %s to any: %w", n, err)
+		}
+		anys[i] = any
+	}
+	responseVersion := version
+	if m.DigestVersions {
+		responseVersion = digestVersion(names, anys)
+	}
+	res := &discovery_v3.DiscoveryResponse{
+		VersionInfo: version,
+		TypeUrl:     m.Type,
+		Resources:   anys,
+	}
+	return res, responseVersion, nil
+}
+
+// archiveSnapshot adds the current resources to the manager's archive, if it has one.
+func (m *Manager) archiveSnapshot() {
+	if m.Archive == nil {
+		return
+	}
+	m.archiveMu.Lock()
+	defer m.archiveMu.Unlock()
+	res, responseVersion, err := m.snapshotResponse()
+	if err != nil {
+		m.Logger.Warn("problem building snapshot", zap.Error(err))
+		return
+	}
+	if err := m.Archive.add(m.Name, responseVersion, res); err != nil {
+		m.Logger.Warn("problem archiving snapshot", zap.Error(err))
+	}
+}
+
+// markSnapshot tells the goroutine that saves the manager's snapshots, starting it if necessary,
+// that the resources changed.  It never blocks.
+func (m *Manager) markSnapshot() {
+	if m.Snapshot == nil {
+		return
+	}
+	m.snapshotOnce.Do(func() {
+		m.snapshotDirty = make(chan struct{}, 1)
+		m.snapshotStop = make(chan struct{})
+		m.snapshotDone = make(chan struct{})
+		go m.saveSnapshots()
+	})
+	select {
+	case m.snapshotDirty <- struct{}{}:
+	default:
+		// Already marked, or closed; the pending save will include this change.
+	}
+}
+
+// saveSnapshots saves a snapshot whenever markSnapshot marks one dirty, waiting SnapshotInterval
+// between saves, so that a burst of changes is saved once.  It runs until Close, saving any change
+// that hasn't been saved yet before it returns.
+func (m *Manager) saveSnapshots() {
+	defer close(m.snapshotDone)
+	interval := m.SnapshotInterval
+	if interval <= 0 {
+		interval = DefaultSnapshotInterval
+	}
+	flush := func() {
+		select {
+		case <-m.snapshotDirty:
+			m.saveSnapshot()
+		default:
+		}
+	}
+	for {
+		select {
+		case <-m.snapshotDirty:
+		case <-m.snapshotStop:
+			flush()
+			return
+		}
+		m.saveSnapshot()
+		select {
+		case <-time.After(interval):
+		case <-m.snapshotStop:
+			flush()
+			return
+		}
+	}
+}
+
+// Close stops saving snapshots, after saving any change that hasn't been saved yet, so that a
+// server that is shutting down leaves its latest resources for the next one to restore.  Changes
+// made after Close are served, but not saved.  It waits for the last save to finish.
+func (m *Manager) Close() {
+	m.closeOnce.Do(func() {
+		// Once Close has been called, markSnapshot never starts saveSnapshots.
+		m.snapshotOnce.Do(func() {})
+		if m.snapshotStop != nil {
+			close(m.snapshotStop)
+			<-m.snapshotDone
+		}
+	})
+}
+
+// saveSnapshot writes the current resources to the manager's snapshot store.  Only saveSnapshots
+// calls it, so saves never race.
+func (m *Manager) saveSnapshot() {
+	res, _, err := m.snapshotResponse()
+	if err != nil {
+		m.Logger.Warn("problem building snapshot", zap.Error(err))
+		return
+	}
+	data, err := protojson.Marshal(res)
+	if err != nil {
+		m.Logger.Warn("problem marshaling snapshot", zap.Error(err))
+		return
+	}
+	if err := m.Snapshot.Save(m.Name, data); err != nil {
+		m.Logger.Warn("problem saving snapshot", zap.Error(err))
+	}
+}
+
+// Restore replaces the managed resources with those in the manager's snapshot store, if it has one
+// and it contains a snapshot for this manager.  It is meant to be called once, at startup, before
+// the manager's resources are populated from their real source; the source's first Replace then
+// supersedes the restored resources.  Restored resources are validated like any others.
+func (m *Manager) Restore(ctx context.Context) error {
+	if m.Snapshot == nil {
+		return nil
+	}
+	data, err := m.Snapshot.Load(m.Name)
+	if err != nil {
+		return fmt.Errorf("%s: load snapshot: %w", m.Name, err)
+	}
+	if len(data) == 0 {
+		m.Logger.Info("no snapshot to restore")
+		return nil
+	}
+	res, rs, err := m.parseSnapshot(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", m.Name, err)
+	}
+	if err := m.Replace(ctx, rs); err != nil {
+		return fmt.Errorf("%s: restore snapshot: %w", m.Name, err)
+	}
+	m.Logger.Info("restored snapshot", zap.String("snapshot_version", res.GetVersionInfo()), zap.Int("resources", len(rs)))
+	return nil
+}
+
+// parseSnapshot unmarshals a snapshot of this manager's resources.
+func (m *Manager) parseSnapshot(data []byte) (*discovery_v3.DiscoveryResponse, []Resource, error) {
+	res := new(discovery_v3.DiscoveryResponse)
+	if err := protojson.Unmarshal(data, res); err != nil {
+		return nil, nil, fmt.Errorf("unmarshal snapshot: %w", err)
+	}
+	if res.GetTypeUrl() != m.Type {
+		return nil, nil, fmt.Errorf("snapshot contains %s, not %s", res.GetTypeUrl(), m.Type)
+	}
+	rs := make([]Resource, 0, len(res.GetResources()))
+	for i, any := range res.GetResources() {
+		msg, err := anypb.UnmarshalNew(any, proto.UnmarshalOptions{})
+		if err != nil {
+			return nil, nil, fmt.Errorf("unmarshal snapshot resource %d: %w", i, err)
+		}
+		r, ok := msg.(Resource)
+		if !ok {
+			return nil, nil, fmt.Errorf("snapshot resource %d: %T is not a resource", i, msg)
+		}
+		rs = append(rs, r)
+	}
+	return res, rs, nil
+}
+
+// Follow keeps the manager's resources the same as the snapshot that another server, the writer,
+// saves to store, checking for a new one every interval until the context is done.  Replicas that
+// follow a shared store (a FileSnapshot on a shared volume, or a ConfigMap) all serve exactly what
+// the writer generated, so an Envoy whose stream moves between them sees the same resources,
+// instead of whatever each replica happened to generate from its own sources.  Versions are only
+// the same on every replica, including the writer, if they all use DigestVersions.
+//
+// The manager's own Snapshot must not be the store it follows; followers only read.  A snapshot
+// that fails validation is logged and skipped, and the manager keeps serving what it had.
+func (m *Manager) Follow(ctx context.Context, store SnapshotStore, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	var last []byte
+	for {
+		data, err := store.Load(m.Name)
+		switch {
+		case err != nil:
+			xdsSnapshotsFollowed.WithLabelValues(m.Name, m.Type, "error").Inc()
+			m.Logger.Warn("problem loading shared snapshot", zap.Error(err))
+		case len(data) == 0 || bytes.Equal(data, last):
+		default:
+			last = data
+			res, rs, err := m.parseSnapshot(data)
+			if err == nil {
+				err = m.Replace(ctx, rs)
+			}
+			if err != nil {
+				xdsSnapshotsFollowed.WithLabelValues(m.Name, m.Type, "rejected").Inc()
+				m.Logger.Error("rejecting shared snapshot", zap.Error(err))
+				break
+			}
+			xdsSnapshotsFollowed.WithLabelValues(m.Name, m.Type, "applied").Inc()
+			m.Logger.Debug("applied shared snapshot", zap.String("snapshot_version", res.GetVersionInfo()), zap.Int("resources", len(rs)))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
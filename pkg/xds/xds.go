@@ -2,16 +2,17 @@ package xds
 
 import (
 	"context"
-	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"net/http"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	"github.com/google/go-cmp/cmp"
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
@@ -55,8 +56,30 @@ var (
 		Name: "ekglue_xds_resource_push_age",
 		Help: "The time when the named resource was last pushed.",
 	}, []string{"manager_name", "config_type", "resource_name"})
+
+	// A count of change notifications merged into one that a busy session hadn't picked up yet.
+	xdsCoalescedUpdates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ekglue_xds_coalesced_updates",
+		Help: "The number of change notifications merged into an earlier one that a busy stream had not yet handled.",
+	}, []string{"manager_name", "config_type"})
+
+	// A count of changes rejected because a resource failed one of the manager's validators.
+	xdsValidatorRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ekglue_xds_validator_rejections",
+		Help: "The number of changes rejected because a resource failed one of the manager's additional validators.",
+	}, []string{"manager_name", "config_type"})
+
+	// A count of changes rejected because they would exceed the manager's resource limit.
+	xdsQuotaRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ekglue_xds_quota_rejections",
+		Help: "The number of changes rejected because they would exceed the manager's resource limit.",
+	}, []string{"manager_name", "config_type"})
 )
 
+// ErrQuotaExceeded is returned (wrapped) when a change would leave a manager with more than
+// MaxResources resources.
+var ErrQuotaExceeded = errors.New("resource quota exceeded")
+
 // Resource is an xDS resource, like envoy_config_cluster_v3.Cluster, etc.
 type Resource interface {
 	proto.Message
@@ -79,14 +102,89 @@ type update struct {
 	resources map[string]struct{} // set of resources that changed; must not be written to
 }
 
-// Session is a channel that receives notifications when the managed resources change.
-type session chan update
+// session receives notifications when the managed resources change.  Changes that arrive while
+// the stream is busy are merged into a single pending update, so that a slow or stuck client never
+// delays notify (and with it, whoever is applying changes to the manager); the stream catches up
+// with everything that changed the next time it looks.
+type session struct {
+	ready   chan struct{} // receives a value when an update becomes pending
+	handoff chan struct{} // closed by Manager.HandOff
+
+	mu          sync.Mutex
+	pending     *update
+	lastTake    time.Time
+	status      SessionStatus // what the stream has told us about its client, for Sessions
+	awaitingAck bool          // draining, but waiting for the client to answer; see DrainStatus
+}
+
+func newSession(incremental bool) *session {
+	return &session{
+		ready:   make(chan struct{}, 1),
+		handoff: make(chan struct{}),
+		status:  SessionStatus{Incremental: incremental, Connected: time.Now()},
+	}
+}
+
+// mark merges u into the pending update, returning true if an update was already pending.
+func (s *session) mark(u update) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	coalesced := s.pending != nil
+	if !coalesced {
+		s.pending = &update{resources: make(map[string]struct{}, len(u.resources))}
+	}
+	for n := range u.resources {
+		s.pending.resources[n] = struct{}{}
+	}
+	// Attribute the push to the most recent change.
+	s.pending.span = u.span
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	return coalesced
+}
+
+// take returns and clears the pending update.  Call it after receiving from ready, or after
+// waiting out the delay returned by throttle.
+func (s *session) take() update {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.pending
+	s.pending = nil
+	s.lastTake = time.Now()
+	// Anything signalled so far is part of this update.
+	select {
+	case <-s.ready:
+	default:
+	}
+	if u == nil {
+		return update{resources: map[string]struct{}{}}
+	}
+	return *u
+}
+
+// throttle returns how much longer the stream must wait before taking another update, so that it
+// takes at most one per interval.  Updates that arrive in the meantime are merged into the pending
+// one.
+func (s *session) throttle(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return interval - time.Since(s.lastTake)
+}
 
 // Acknowledgment is an event that represents the client accepting or rejecting a configuration.
 type Acknowledgment struct {
 	Node    string // The id of the node.
 	Version string // The full version.
 	Ack     bool   // Whether this is an ack or nack.
+	Error   string // For a nack, the reason the client gave for rejecting the config.
+	// RolledBack is, if this nack made the manager roll back, the version whose resources it
+	// restored.  See Manager.RollbackThreshold.
+	RolledBack string
 }
 
 // Manager consumes a stream of resource change, and notifies connected xDS clients of the change.
@@ -98,20 +196,163 @@ type Manager struct {
 	VersionPrefix string
 	// Type is the type of xDS resource being managed, like "type.googleapis.com/envoy.config.cluster.v3.Cluster".
 	Type string
-	// OnAck is a function that will be called when a config is accepted or rejected.
+	// OnAck is a function that will be called when a config is accepted or rejected.  It's a
+	// good place to alert on rejections.
 	OnAck func(Acknowledgment)
+	// RollbackThreshold, if non-zero, is the fraction of connected nodes that must reject the
+	// current version for the manager to roll back the resources changed since the last version
+	// that every connected node accepted to what they were in that version, so that one bad
+	// change can't break the whole fleet until someone intervenes.  Every change since that
+	// version is rolled back, since any of them could be the one being rejected; resources that
+	// didn't change since then are kept.  The restored resources are sent to clients as a new
+	// version.
+	// Sources aren't told about the rollback, so it only lasts until the resources that were
+	// rolled back change again, and the source of the bad change still needs fixing.
+	RollbackThreshold float64
 	// Logger is a zap logger to use to log manager events.  Per-connection events are logged
 	// via the logger stored in the request context.
 	Logger *zap.Logger
-	// Draining is a channel that, when closed, will drain client connections.
+	// Draining is a channel that, when closed, will drain client connections.  Draining streams
+	// stop pushing changes, and close once their client has acknowledged every response it was
+	// sent, or DrainTimeout has passed.
 	Draining chan struct{}
+	// DrainTimeout is how long a draining stream waits for its client to acknowledge the
+	// responses it was sent before closing anyway.  If zero, streams close as soon as the
+	// server starts draining.
+	DrainTimeout time.Duration
+	// MaxResources, if non-zero, is the maximum number of resources the manager will hold.
+	// Changes that would exceed it are rejected in their entirety with ErrQuotaExceeded.
+	MaxResources int
+	// MaxStreamAge, if non-zero, is how long a client's stream may stay open before the manager
+	// closes it (with status UNAVAILABLE) so that the client reconnects, possibly to another
+	// replica.  Without it, clients stay connected to whichever replica they first found, so
+	// replicas added by a scale-up never get any clients.  Streams are only closed between
+	// pushes, never while a response is awaiting acknowledgement.
+	//
+	// Clients reconnect over the same HTTP/2 connection if they can, so this only moves clients
+	// between replicas when something between them balances individual streams (an L7 load
+	// balancer, or Envoy itself with a multi-host xDS cluster).
+	MaxStreamAge time.Duration
+	// DigestVersions, if true, versions each state-of-the-world response with a digest of the
+	// resources it contains, instead of VersionPrefix and a counter.  The same resources then
+	// get the same version from every replica, and across restarts, so a client reconnecting to
+	// another replica can tell that nothing changed, and versions in logs can be compared
+	// between replicas.  Each resource is versioned by its content, not the version of the
+	// Kubernetes objects it was generated from, because a resource is often generated from
+	// several objects (endpoints from many EndpointSlices), and changes when ekglue's
+	// configuration does.  Incremental streams already version each resource this way, and
+	// RolloutStatus always reports the manager's own counter-based versions.
+	DigestVersions bool
+	// Strict, if true, makes state-of-the-world streams follow the xDS protocol specification
+	// exactly, instead of being lenient with clients in the ways ekglue normally is:
+	//
+	//   - Requests whose nonce isn't that of the most recent response are stale, and ignored,
+	//     rather than answered with the current config.
+	//   - A client acknowledging a version other than the one it was sent, rejecting a response
+	//     without saying which, or not identifying its node, is a protocol error that ends the
+	//     stream with INVALID_ARGUMENT.
+	//   - An empty list of resource names is only a wildcard subscription if the client hasn't
+	//     named any resources on the stream; afterwards it unsubscribes from everything.
+	//
+	// It is meant for checking that clients interoperate with a spec-conformant server.
+	Strict bool
+	// MinPushInterval, if non-zero, is the minimum time between two pushes of changed resources
+	// to the same client.  Changes that happen sooner are merged, and the client receives only the
+	// result, which spares clients on slow or unreliable links from downloading versions that
+	// are about to be replaced.  Responses to a client's own requests are never delayed.
+	MinPushInterval time.Duration
+	// MarshalWorkers, if greater than 1, is the number of goroutines that marshal the resources of
+	// responses containing at least parallelMarshalThreshold resources, which cuts the latency of
+	// the first response to a client when there are thousands of resources.
+	MarshalWorkers int
+	// MaxResponseBytes, if positive, is the size of the largest response that clients can receive;
+	// see DefaultMaxResponseBytes.  Larger state-of-the-world load assignment and route
+	// configuration responses are split into several smaller ones, which the protocol allows for
+	// those types.  Larger responses of other types are sent anyway, and logged and counted as
+	// errors.
+	MaxResponseBytes int
+	// Validators are checked against every added resource, in addition to the resource's own
+	// Validate method; a change containing a resource that fails any of them is rejected with a
+	// *ValidationError.  They enforce rules specific to an organization, like requiring every
+	// cluster to have circuit breakers.
+	Validators []Validator
+	// History, if non-nil, records every change to the managed resources, and every version
+	// clients accept or reject.  One store may be shared among managers.
+	History HistoryStore
+	// Snapshot, if non-nil, receives a copy of the managed resources after every change, which
+	// Restore reads back at startup.  Copies are saved in the background, at most once per
+	// SnapshotInterval, so a burst of changes is saved as one copy.
+	Snapshot SnapshotStore
+	// SnapshotInterval is the minimum time between saves to Snapshot.  If zero,
+	// DefaultSnapshotInterval is used.
+	SnapshotInterval time.Duration
+	// AdminCapture, if non-nil, captures the admin interface of clients that keep rejecting
+	// versions, and records it in History.
+	AdminCapture *AdminCapture
+	// Archive, if non-nil, keeps a history of the managed resources, with a snapshot archived
+	// after every change.  One archive may be shared among managers.  Every resource is marshaled
+	// for each archived snapshot, by the goroutine making the change (though not under the
+	// resource lock), so an archive makes changes to large managers noticeably slower.
+	Archive *Archive
+	// Scope, if non-nil, reports whether the named resource may be sent to node, as it identified
+	// itself on its stream.  To a node, resources out of its scope don't exist: wildcard
+	// subscriptions leave them out, and explicit subscriptions to them are answered as for a
+	// missing resource.  Scope is called with the resource lock held, so it must not call back
+	// into the manager.  Responses are then no longer the same for every client subscribed to
+	// the same resources, only for clients that have the same scope.
+	Scope func(node *envoy_config_core_v3.Node, name string) bool
+	// OnChange, if non-nil, is called after every change with the resources that changed, by
+	// name; deleted resources map to nil.  It is called before clients are notified, without the
+	// resource lock held, and must not modify the resources.
+	OnChange func(changed map[string]Resource)
+	// ContextParams, if true, serves variants of resources selected by context parameters, like
+	// a listener per shard.  A client asks for a variant with an xdstp:// name, like
+	// "xdstp://example.com/envoy.config.listener.v3.Listener/foo?shard=1", or with its node's
+	// dynamic_parameters for the manager's type, which apply to every name it asks for; the
+	// parameters in a name take precedence.  It receives the resource stored under the name it
+	// asked for, or else the variant stored under VariantName("foo", params), or else "foo", named
+	// as it asked.  Variants are only sent to clients that ask for them, not to wildcard
+	// subscribers.
+	ContextParams bool
+	// OnSubscribe, if non-nil, is called with the sorted names of every resource that an open
+	// stream has subscribed to by name, whenever that set changes, so that resources can be
+	// generated on demand; wildcard subscriptions aren't included.  Calls are serialized, and
+	// made from the stream whose request changed the set before it responds, so a resource added
+	// by OnSubscribe is in the response.  It must not block.
+	OnSubscribe func(names []string)
+
+	archiveMu     sync.Mutex    // serializes archiveSnapshot, so that an older snapshot never wins
+	snapshotOnce  sync.Once     // starts saveSnapshots, or prevents it after Close
+	snapshotDirty chan struct{} // marked by notify when Snapshot needs saving
+	snapshotStop  chan struct{} // closed by Close to stop saveSnapshots
+	snapshotDone  chan struct{} // closed when saveSnapshots returns
+	closeOnce     sync.Once
 
 	resourcesMu sync.Mutex
 	resources   map[string]Resource
 	version     int
+	good        map[string]Resource // the resources of goodVersion, for RollbackThreshold
+	goodVersion string              // the last version every connected node accepted
+	sinceGood   map[string]struct{} // the resources changed since goodVersion
+	pins        map[string]*pin     // pinned resources, by name
+	notified    map[string]Resource // the resources clients were last told about, for Subscribe
 
 	sessionsMu sync.Mutex
-	sessions   map[session]struct{}
+	sessions   map[*session]struct{}
+
+	subscribedMu sync.Mutex // serializes calls to OnSubscribe; held before sessionsMu
+	subscribed   []string   // the names OnSubscribe was last called with
+
+	eventsMu      sync.Mutex
+	subscriptions map[*Subscription]struct{}
+
+	nodesMu  sync.Mutex
+	nodes    map[string]*nodeRollout // connected nodes, for RolloutStatus
+	imported map[string]*LedgerEntry // see ImportLedger
+
+	enabledMu  sync.Mutex
+	disabled   bool
+	disabledCh chan struct{} // closed when the manager is disabled
 }
 
 // NewManager creates a new manager.  resource is an instance of the type to manage.
@@ -123,7 +364,9 @@ func NewManager(name, versionPrefix string, resource Resource, drainCh chan stru
 		Logger:        zap.L().Named(name),
 		Draining:      drainCh,
 		resources:     make(map[string]Resource),
-		sessions:      make(map[session]struct{}),
+		sessions:      make(map[*session]struct{}),
+		nodes:         make(map[string]*nodeRollout),
+		disabledCh:    make(chan struct{}),
 	}
 	return m
 }
@@ -133,31 +376,172 @@ func (m *Manager) versionString() string {
 	return fmt.Sprintf("%s%d", m.VersionPrefix, m.version)
 }
 
-// snapshotAll returns the current list of managed resources.  You must hold the resource lock.
-func (m *Manager) snapshotAll() ([]*anypb.Any, []string, string, error) {
-	result := make([]*anypb.Any, 0, len(m.resources))
+// responseVersion returns the version of a state-of-the-world response containing the provided
+// resources.  You must hold the resource lock.
+func (m *Manager) responseVersion(names []string, resources []*anypb.Any) string {
+	if !m.DigestVersions {
+		return m.versionString()
+	}
+	return digestVersion(names, resources)
+}
+
+// digestVersion returns a version derived from the names and versions of resources, for
+// DigestVersions.
+func digestVersion(names []string, resources []*anypb.Any) string {
+	h := fnv.New64a()
+	for i, n := range names {
+		h.Write([]byte(n))
+		h.Write([]byte{0})
+		h.Write([]byte(resourceVersion(resources[i])))
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// sameSubscriptions returns true if two lists of subscribed resource names refer to the same set of
+// resources.
+func sameSubscriptions(a, b []string) bool {
+	if isWildcard(a) || isWildcard(b) {
+		return isWildcard(a) == isWildcard(b)
+	}
+	set := func(names []string) map[string]struct{} {
+		result := make(map[string]struct{}, len(names))
+		for _, n := range names {
+			result[n] = struct{}{}
+		}
+		return result
+	}
+	return cmp.Equal(set(a), set(b))
+}
+
+// marshalAny deterministically marshals a resource into an Any.
+func marshalAny(r Resource) (*anypb.Any, error) {
+	any := new(anypb.Any)
+	if err := anypb.MarshalFrom(any, r, proto.MarshalOptions{Deterministic: true}); err != nil {
+		return nil, err
+	}
+	return any, nil
+}
+
+// isWildcard returns true if a list of subscribed resource names refers to all resources.  The
+// legacy form of a wildcard subscription is an empty list, and the current form is "*".
+func isWildcard(names []string) bool {
+	if len(names) == 0 {
+		return true
+	}
+	for _, n := range names {
+		if n == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// inScope returns true if the named resource may be sent to node, according to Scope.  A nil node
+// is not scoped.
+func (m *Manager) inScope(node *envoy_config_core_v3.Node, name string) bool {
+	return m.Scope == nil || node == nil || m.Scope(node, name)
+}
+
+// parallelMarshalThreshold is the number of resources at which MarshalWorkers takes effect; below
+// it, starting goroutines costs more than it saves.
+const parallelMarshalThreshold = 256
+
+// marshalResources marshals the named resources, which must exist, in order; resolved holds those
+// that aren't stored under their own names (see ContextParams).  You must hold the resource lock.
+func (m *Manager) marshalResources(names []string, resolved map[string]Resource) ([]*anypb.Any, error) {
+	get := func(n string) Resource {
+		if r, ok := resolved[n]; ok {
+			return r
+		}
+		return m.resources[n]
+	}
+	result := make([]*anypb.Any, len(names))
+	workers := m.MarshalWorkers
+	if workers < 2 || len(names) < parallelMarshalThreshold {
+		for i, n := range names {
+			any, err := marshalAny(get(n))
+			if err != nil {
+				return nil, fmt.Errorf("marshal resource %s to any: %w", n, err)
+			}
+			result[i] = any
+		}
+		return result, nil
+	}
+	// Each worker marshals a contiguous chunk; the resource lock keeps the map from changing
+	// underneath them.
+	chunk := (len(names) + workers - 1) / workers
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		start, end := w*chunk, (w+1)*chunk
+		if start >= len(names) {
+			break
+		}
+		if end > len(names) {
+			end = len(names)
+		}
+		wg.Add(1)
+		go func(w, start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				any, err := marshalAny(get(names[i]))
+				if err != nil {
+					errs[w] = fmt.Errorf("marshal resource %s to any: %w", names[i], err)
+					return
+				}
+				result[i] = any
+			}
+		}(w, start, end)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// snapshotAll returns the current list of managed resources in node's scope, sorted by name.  You
+// must hold the resource lock.
+func (m *Manager) snapshotAll(node *envoy_config_core_v3.Node) ([]*anypb.Any, []string, string, error) {
 	names := make([]string, 0, len(m.resources))
-	for n, r := range m.resources {
-		any, err := anypb.New(r)
-		if err != nil {
-			return nil, nil, "", fmt.Errorf("marshal resource %s to any: %w", n, err)
+	for n := range m.resources {
+		if m.ContextParams && node != nil && isVariantName(n) {
+			// Snapshots (node == nil) keep variants, but clients only get them by asking.
+			continue
 		}
-		names = append(names, n)
-		result = append(result, any)
+		if m.inScope(node, n) {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	result, err := m.marshalResources(names, nil)
+	if err != nil {
+		return nil, nil, "", err
 	}
-	return result, names, m.versionString(), nil
+	return result, names, m.responseVersion(names, result), nil
 }
 
-// snapshot returns a subset of managed resources.  You must hold the Manager's lock.
-func (m *Manager) snapshot(want []string) ([]*anypb.Any, []string, string, error) {
-	if len(want) == 0 {
-		return m.snapshotAll()
+// snapshot returns a subset of the managed resources in node's scope, sorted by name.  You must
+// hold the Manager's lock.
+//
+// The result depends only on the managed resources, the set of names requested, and node's scope,
+// so that every client subscribed to the same resources receives a byte-identical response; this
+// allows an xDS caching relay to serve many clients from a single upstream stream.
+func (m *Manager) snapshot(want []string, node *envoy_config_core_v3.Node) ([]*anypb.Any, []string, string, error) {
+	if isWildcard(want) {
+		return m.snapshotAll(node)
 	}
-	result := make([]*anypb.Any, 0, len(want))
+	want = append([]string(nil), want...)
+	sort.Strings(want)
 	names := make([]string, 0, len(want))
-	for _, name := range want {
-		r, ok := m.resources[name]
-		if !ok {
+	var resolved map[string]Resource
+	for i, name := range want {
+		if i > 0 && want[i-1] == name {
+			continue
+		}
+		r, stored, ok := m.lookup(name, node)
+		if !ok || !m.inScope(node, stored) {
 			// NOTE(jrockway): Because discovery is "eventually consistent", this is OK.
 			// A service might exist without any endpoints, so when Envoy loads that
 			// cluster it will subscribe to those endpoints, there just won't be any
@@ -166,26 +550,53 @@ func (m *Manager) snapshot(want []string) ([]*anypb.Any, []string, string, error
 			m.Logger.Debug("requested resource is not available", zap.String("resource_name", name))
 			continue
 		}
-		any, err := anypb.New(r)
-		if err != nil {
-			return nil, nil, "", fmt.Errorf("marshal resource %s to any: %w", name, err)
-		}
 		names = append(names, name)
-		result = append(result, any)
+		if stored != name {
+			if resolved == nil {
+				resolved = make(map[string]Resource)
+			}
+			resolved[name] = r
+		}
+	}
+	result, err := m.marshalResources(names, resolved)
+	if err != nil {
+		return nil, nil, "", err
 	}
-	// TODO(jrockway): Return a better version string, probably max(resource[].version) (which
-	// we don't track right now, but is available in the k8s api objects).
-	return result, names, m.versionString(), nil
+	return result, names, m.responseVersion(names, result), nil
 }
 
-// notify notifies connected clients of the change.
+// notify notifies connected clients of the change.  It never waits for them; see session.
 func (m *Manager) notify(ctx context.Context, resources []string) error {
 	if len(resources) < 1 {
 		return nil
 	}
 	m.resourcesMu.Lock()
 	m.version++
+	version := m.versionString()
+	if m.RollbackThreshold > 0 {
+		if m.sinceGood == nil {
+			m.sinceGood = make(map[string]struct{})
+		}
+		for _, name := range resources {
+			m.sinceGood[name] = struct{}{}
+		}
+	}
+	var changed map[string]Resource
+	if m.OnChange != nil {
+		changed = make(map[string]Resource, len(resources))
+		for _, name := range resources {
+			changed[name] = m.resources[name]
+		}
+	}
+	// Published with the resource lock held, so that concurrent changes are reported in order.
+	m.publish(m.resourceEvents(version, resources)...)
 	m.resourcesMu.Unlock()
+	if changed != nil {
+		m.OnChange(changed)
+	}
+	m.record(&HistoryRecord{Event: "change", Version: version, Resources: resources})
+	m.archiveSnapshot()
+	m.markSnapshot()
 	xdsConfigLastUpdated.WithLabelValues(m.Name, m.Type).SetToCurrentTime()
 
 	u := update{span: opentracing.SpanFromContext(ctx), resources: make(map[string]struct{})}
@@ -195,100 +606,254 @@ func (m *Manager) notify(ctx context.Context, resources []string) error {
 
 	m.Logger.Debug("new resource version", zap.Int("version", m.version), zap.Strings("resources", resources))
 
-	// First try sending to sessions that aren't busy.
-	blocked := make(map[session]struct{})
 	m.sessionsMu.Lock()
 	defer m.sessionsMu.Unlock()
 	for session := range m.sessions {
-		select {
-		case session <- u:
-		default:
-			blocked[session] = struct{}{}
-		}
-	}
-	// Then use the context to wait on busy sessions.
-	for len(blocked) > 0 {
-		for session := range blocked {
-			timer := time.NewTimer(100 * time.Millisecond)
-			select {
-			case session <- u:
-				delete(blocked, session)
-			case <-timer.C: // Don't spend the whole time interval on one slow session.
-			case <-ctx.Done():
-				m.Logger.Error("change notification timed out", zap.Int("sessions_missed", len(blocked)))
-				return ctx.Err()
-			}
+		if session.mark(u) {
+			xdsCoalescedUpdates.WithLabelValues(m.Name, m.Type).Inc()
 		}
 	}
 	return nil
 }
 
 // Add adds or replaces (by name) managed resources, and notifies connected clients of the change.
+// Resources that are equal to the ones they replace are not considered changed, so adding only
+// unchanged resources (as a resync does) doesn't push anything to clients.  If any resource is
+// invalid, nothing is changed and the error is a *ValidationError,
+// *NameConflictError, or *MarshalError.
 func (m *Manager) Add(ctx context.Context, rs []Resource) error {
+	if err := m.Validate(rs); err != nil {
+		return err
+	}
+	m.beginChange()
+	if err := m.checkQuota(rs, nil); err != nil {
+		m.endChange(nil)
+		return err
+	}
 	var changed []string
 	for _, r := range rs {
 		n := resourceName(r)
-		if err := r.Validate(); err != nil {
-			return fmt.Errorf("%q: %w", n, err)
-		}
-		m.resourcesMu.Lock()
-		if _, overwrote := m.resources[n]; overwrote {
-			// TODO(jrockway): Check that this resource actually changed.
+		if old, overwrote := m.resources[n]; overwrote {
+			if proto.Equal(old, r) {
+				m.Logger.Debug("resource unchanged", zap.String("name", n))
+				continue
+			}
 			m.Logger.Info("resource updated", zap.String("name", n))
 		} else {
 			m.Logger.Info("resource added", zap.String("name", n))
 		}
 		changed = append(changed, n)
 		m.resources[n] = r
-		m.resourcesMu.Unlock()
 	}
+	changed = m.endChange(changed)
 	m.notify(ctx, changed)
 	return nil
 }
 
-// Replace repaces the entire set of managed resources with the provided argument, and notifies
-// connected clients of the change.
-func (m *Manager) Replace(ctx context.Context, rs []Resource) error {
+// checkQuota returns an error if adding the resources in add and deleting the resources named in
+// remove would leave more than MaxResources resources.  You must hold the resource lock.
+func (m *Manager) checkQuota(add []Resource, remove []string) error {
+	if m.MaxResources <= 0 {
+		return nil
+	}
+	removed := make(map[string]struct{}, len(remove))
+	for _, n := range remove {
+		if _, ok := m.resources[n]; ok {
+			removed[n] = struct{}{}
+		}
+	}
+	n := len(m.resources) - len(removed)
+	added := make(map[string]struct{})
+	for _, r := range add {
+		name := resourceName(r)
+		if _, ok := added[name]; ok {
+			continue
+		}
+		added[name] = struct{}{}
+		_, exists := m.resources[name]
+		_, deleted := removed[name]
+		if !exists || deleted {
+			n++
+		}
+	}
+	return m.quotaError(n)
+}
+
+// CheckQuota returns an error wrapping ErrQuotaExceeded if Apply(add, remove) would leave more
+// than MaxResources resources, without changing anything, so that callers applying related changes
+// to several managers can check them all first.  The answer is only good until the lock is
+// released; another change can use up the quota before the caller's Apply, which then fails on its
+// own.
+func (m *Manager) CheckQuota(add []Resource, remove []string) error {
+	m.beginChange()
+	defer m.endChange(nil)
+	return m.checkQuota(add, remove)
+}
+
+// quotaError returns an error if n resources would exceed MaxResources.
+func (m *Manager) quotaError(n int) error {
+	if m.MaxResources <= 0 || n <= m.MaxResources {
+		return nil
+	}
+	xdsQuotaRejections.WithLabelValues(m.Name, m.Type).Inc()
+	m.Logger.Error("rejecting change that exceeds resource quota", zap.Int("resources", n), zap.Int("max_resources", m.MaxResources))
+	return fmt.Errorf("%s: %d resources would exceed the limit of %d: %w", m.Name, n, m.MaxResources, ErrQuotaExceeded)
+}
+
+// Validate checks that each resource is valid, that it can be marshaled, and that no two resources
+// have the same name.  The returned error is a *ValidationError, *NameConflictError, or
+// *MarshalError identifying the first problem.
+func Validate(rs []Resource) error {
+	names := make(map[string]struct{}, len(rs))
 	for _, r := range rs {
+		n := resourceName(r)
+		if _, ok := names[n]; ok {
+			return &NameConflictError{Name: n}
+		}
+		names[n] = struct{}{}
 		if err := r.Validate(); err != nil {
-			return fmt.Errorf("%q: %w", resourceName(r), err)
+			return &ValidationError{Name: n, Err: err}
+		}
+		if _, err := marshalAny(r); err != nil {
+			return &MarshalError{Name: n, Err: err}
 		}
 	}
-	m.resourcesMu.Lock()
+	return nil
+}
+
+// Validator checks a resource against a rule beyond its protoc-gen-validate rules.  It returns an
+// error describing the violation, if any.
+type Validator func(Resource) error
+
+// Validate checks resources as the package-level Validate does, and then against the manager's
+// Validators.
+func (m *Manager) Validate(rs []Resource) error {
+	if err := Validate(rs); err != nil {
+		return err
+	}
+	for _, r := range rs {
+		for _, v := range m.Validators {
+			if err := v(r); err != nil {
+				xdsValidatorRejections.WithLabelValues(m.Name, m.Type).Inc()
+				return &ValidationError{Name: resourceName(r), Err: err}
+			}
+		}
+	}
+	return nil
+}
+
+// Apply adds or replaces the resources in add and deletes the resources named in remove, as a
+// single change.  Nothing is changed if any resource fails validation.  Clients see one new
+// version containing every change.
+func (m *Manager) Apply(ctx context.Context, add []Resource, remove []string) error {
+	if err := m.Validate(add); err != nil {
+		return err
+	}
+	m.beginChange()
+	if err := m.checkQuota(add, remove); err != nil {
+		m.endChange(nil)
+		return err
+	}
+	var changed []string
+	for _, r := range add {
+		n := resourceName(r)
+		if old, overwrote := m.resources[n]; overwrote {
+			if proto.Equal(old, r) {
+				m.Logger.Debug("resource unchanged", zap.String("name", n))
+				continue
+			}
+			m.Logger.Info("resource updated", zap.String("name", n))
+		} else {
+			m.Logger.Info("resource added", zap.String("name", n))
+		}
+		changed = append(changed, n)
+		m.resources[n] = r
+	}
+	for _, n := range remove {
+		if _, ok := m.resources[n]; ok {
+			delete(m.resources, n)
+			m.Logger.Info("resource deleted", zap.String("name", n))
+			changed = append(changed, n)
+		}
+	}
+	changed = m.endChange(changed)
+	return m.notify(ctx, changed)
+}
+
+// Replace repaces the entire set of managed resources with the provided argument, and notifies
+// connected clients of the change.  Errors are classified as in Add.
+func (m *Manager) Replace(ctx context.Context, rs []Resource) error {
+	return m.ReplaceMatching(ctx, rs, nil)
+}
+
+// ReplaceMatching is like Replace, but only replaces the resources whose names match, leaving the
+// rest alone, so that several sources can share a manager without deleting each other's
+// resources.  Every resource in rs must match.  A nil match matches everything.
+func (m *Manager) ReplaceMatching(ctx context.Context, rs []Resource, match func(name string) bool) error {
+	if err := m.Validate(rs); err != nil {
+		return err
+	}
+	if match != nil {
+		for _, r := range rs {
+			if n := resourceName(r); !match(n) {
+				return fmt.Errorf("%s: resource %q is not one of the resources being replaced", m.Name, n)
+			}
+		}
+	}
+	m.beginChange()
+	kept := 0
+	if match != nil {
+		for n := range m.resources {
+			if !match(n) {
+				kept++
+			}
+		}
+	}
+	if err := m.quotaError(len(rs) + kept); err != nil {
+		m.endChange(nil)
+		return err
+	}
 	var changed []string
 	old := m.resources
 	m.resources = make(map[string]Resource)
 	for _, r := range rs {
 		n := resourceName(r)
-		if _, overwrote := old[n]; overwrote {
-			m.Logger.Info("resource updated", zap.String("name", n))
+		m.resources[n] = r
+		if prev, overwrote := old[n]; overwrote {
 			delete(old, n)
+			if proto.Equal(prev, r) {
+				continue
+			}
+			m.Logger.Info("resource updated", zap.String("name", n))
 		} else {
 			m.Logger.Info("resource added", zap.String("name", n))
 		}
 		changed = append(changed, n)
-		m.resources[n] = r
 	}
-	for n := range old {
+	for n, r := range old {
+		if match != nil && !match(n) {
+			m.resources[n] = r
+			continue
+		}
 		changed = append(changed, n)
 		m.Logger.Info("resource deleted", zap.String("name", n))
 	}
-	m.resourcesMu.Unlock()
+	changed = m.endChange(changed)
 	m.notify(ctx, changed)
 	return nil
 }
 
 // Delete deletes a single resource by name and notifies clients of the change.
 func (m *Manager) Delete(ctx context.Context, n string) {
-	m.resourcesMu.Lock()
+	m.beginChange()
+	var changed []string
 	if _, ok := m.resources[n]; ok {
 		delete(m.resources, n)
 		m.Logger.Info("resource deleted", zap.String("name", n))
-		m.resourcesMu.Unlock()
-		m.notify(ctx, []string{n})
-		return
+		changed = append(changed, n)
 	}
-	m.resourcesMu.Unlock()
+	changed = m.endChange(changed)
+	m.notify(ctx, changed)
 }
 
 // ListKeys returns the sorted names of managed resources.
@@ -318,10 +883,11 @@ func (m *Manager) List() []Resource {
 }
 
 type tx struct {
-	start   time.Time
-	span    opentracing.Span
-	nonce   string
-	version string
+	start      time.Time
+	span       opentracing.Span
+	nonce      string
+	version    string
+	generation string // the manager's version when the response was built, for RolloutStatus
 }
 
 type loggableSpan struct{ opentracing.Span }
@@ -362,65 +928,83 @@ func (s *loggableSpan) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 	return nil
 }
 
-func randomString() string {
-	hash := [8]byte{'x', 'x', 'x', 'x', 'x', 'x', 'x', 'x'}
-	if n, err := rand.Read(hash[0:8]); n >= 8 && err == nil {
-		for i := 0; i < len(hash); i++ {
-			hash[i] = hash[i]%26 + 'a'
-		}
+// nonceFor returns a nonce for a response containing the named resources at the given version.
+// Nonces are deterministic, so that identical responses sent on different streams (or by different
+// replicas of a relay) are byte-identical.
+func nonceFor(version string, names []string) string {
+	h := fnv.New32a()
+	for _, n := range names {
+		h.Write([]byte(n))
+		h.Write([]byte{0})
 	}
-	return string(hash[0:8])
+	return fmt.Sprintf("nonce-%s-%08x", version, h.Sum32())
 }
 
 func (m *Manager) BuildDiscoveryResponse(subscribed []string) (*discovery_v3.DiscoveryResponse, []string, error) {
+	res, names, _, err := m.buildDiscoveryResponse(subscribed, nil)
+	return res, names, err
+}
+
+// buildDiscoveryResponse builds a response for node, and also returns the manager's version at the
+// time.
+func (m *Manager) buildDiscoveryResponse(subscribed []string, node *envoy_config_core_v3.Node) (*discovery_v3.DiscoveryResponse, []string, string, error) {
 	m.resourcesMu.Lock()
 	defer m.resourcesMu.Unlock()
-	resources, names, version, err := m.snapshot(subscribed)
+	resources, names, version, err := m.snapshot(subscribed, node)
 	if err != nil {
-		return nil, nil, fmt.Errorf("snapshot resources: %w", err)
+		return nil, nil, "", fmt.Errorf("snapshot resources: %w", err)
 	}
-	hash := randomString()
 	res := &discovery_v3.DiscoveryResponse{
 		VersionInfo: version,
 		TypeUrl:     m.Type,
 		Resources:   resources,
-		Nonce:       fmt.Sprintf("nonce-%s-%s", version, hash),
+		Nonce:       nonceFor(version, names),
 	}
 	if err := res.Validate(); err != nil {
-		return nil, nil, fmt.Errorf("validate generated discovery response: %w", err)
+		return nil, nil, "", fmt.Errorf("validate generated discovery response: %w", err)
 	}
-	return res, names, nil
+	return res, names, m.versionString(), nil
+}
+
+// openSession registers a new session to receive resource change notifications.
+func (m *Manager) openSession(incremental bool) *session {
+	s := newSession(incremental)
+	m.sessionsMu.Lock()
+	m.sessions[s] = struct{}{}
+	m.sessionsMu.Unlock()
+	xdsActiveStreams.WithLabelValues(m.Name, m.Type).Inc()
+	return s
+}
+
+// closeSession unregisters a session.
+func (m *Manager) closeSession(s *session) {
+	m.sessionsMu.Lock()
+	delete(m.sessions, s)
+	m.sessionsMu.Unlock()
+	xdsActiveStreams.WithLabelValues(m.Name, m.Type).Dec()
+	m.reportSubscriptions()
 }
 
 // Stream manages a client connection.  Requests from the client are read from reqCh, responses are
 // written to resCh, and the function returns when no further progress can be made.
-func (m *Manager) Stream(ctx context.Context, reqCh chan *discovery_v3.DiscoveryRequest, resCh chan *discovery_v3.DiscoveryResponse) error {
+func (m *Manager) Stream(ctx context.Context, reqCh chan *discovery_v3.DiscoveryRequest, resCh chan *discovery_v3.DiscoveryResponse) (retErr error) {
 	l := ctxzap.Extract(ctx).With(zap.String("xds_type", m.Type))
+	defer func() { m.streamEnded(ctx, retErr) }()
+
+	disabled, ok := m.watchEnabled()
+	if !ok {
+		return m.disabledError()
+	}
 
 	// Channel for receiving resource updates.
-	rCh := make(session)
-	m.sessionsMu.Lock()
-	m.sessions[rCh] = struct{}{}
-	m.sessionsMu.Unlock()
+	rCh := m.openSession(false)
 
 	// In-flight transactions.
 	txs := map[string]*tx{}
 
 	// Cleanup.
 	defer func() {
-		go func() {
-			// Keep the channel drained while we're waiting for the sessionsMu.
-			for {
-				_, ok := <-rCh
-				if !ok {
-					return
-				}
-			}
-		}()
-		m.sessionsMu.Lock()
-		delete(m.sessions, rCh)
-		close(rCh)
-		m.sessionsMu.Unlock()
+		m.closeSession(rCh)
 		for _, t := range txs {
 			t.span.Finish()
 		}
@@ -428,17 +1012,40 @@ func (m *Manager) Stream(ctx context.Context, reqCh chan *discovery_v3.Discovery
 
 	// Node name arrives in the first request, and is used for all subsequent operations.
 	var node string
+	var nodeInfo *envoy_config_core_v3.Node // the node as it identified itself, for Scope
+	defer func() {
+		if node != "" {
+			m.rolloutDisconnect(node)
+		}
+	}()
 
 	// Resources that the client is interested in
 	var resources []string
 
+	// In strict mode, whether the client is using a legacy wildcard subscription (an empty list of
+	// names, having never named a resource), and the nonce of the most recent response.
+	var legacyWildcard bool
+	var lastNonce string
+
+	// subscribedToAll returns true if the client is interested in every resource.
+	subscribedToAll := func() bool {
+		if m.Strict {
+			return legacyWildcard || (len(resources) > 0 && isWildcard(resources))
+		}
+		return isWildcard(resources)
+	}
+
 	// sendUpdate starts a new transaction and sends the current resource list.
 	sendUpdate := func(ctx context.Context) error {
+		if m.Strict && len(resources) == 0 && !subscribedToAll() {
+			// The client unsubscribed from everything; there is nothing to send.
+			return nil
+		}
 		span, ctx := opentracing.StartSpanFromContext(ctx, "xds.push", ext.SpanKindConsumer)
 		t := &tx{start: time.Now(), span: span}
 
 		buildSpan := opentracing.StartSpan("xds.build_response", opentracing.ChildOf(span.Context()))
-		res, names, err := m.BuildDiscoveryResponse(resources)
+		res, names, generation, err := m.buildDiscoveryResponse(resources, nodeInfo)
 		buildSpan.Finish()
 		if err != nil {
 			l.Error("problem building response", zap.Error(err))
@@ -452,26 +1059,36 @@ func (m *Manager) Stream(ctx context.Context, reqCh chan *discovery_v3.Discovery
 			resourceTag = fmt.Sprintf("%s...", resourceTag[0:61])
 		}
 		span.SetTag("xds_resources", resourceTag)
-		t.version = res.GetVersionInfo()
-		t.nonce = res.GetNonce()
-		l.Info("pushing updated resources", zap.Object("tx", t), zap.Strings("resources", names))
+		parts, partNames := m.splitResponse(res, names, nodeInfo)
+		for i, res := range parts {
+			if i > 0 {
+				// Each part of a split response is acknowledged on its own.
+				t = &tx{start: time.Now(), span: opentracing.StartSpan("xds.push_part", opentracing.FollowsFrom(span.Context()))}
+			}
+			t.version = res.GetVersionInfo()
+			t.generation = generation
+			t.nonce = res.GetNonce()
+			l.Info("pushing updated resources", zap.Object("tx", t), zap.Strings("resources", partNames[i]))
 
-		select {
-		case resCh <- res:
-			for _, n := range names {
-				xdsResourcePushCount.WithLabelValues(m.Name, m.Type, n).Inc()
-				xdsResourcePushAge.WithLabelValues(m.Name, m.Type, n).SetToCurrentTime()
+			select {
+			case resCh <- res:
+				for _, n := range partNames[i] {
+					xdsResourcePushCount.WithLabelValues(m.Name, m.Type, n).Inc()
+					xdsResourcePushAge.WithLabelValues(m.Name, m.Type, n).SetToCurrentTime()
+				}
+				txs[res.GetNonce()] = t
+				lastNonce = res.GetNonce()
+				m.publish(PushCompleted{Node: node, Version: t.version, Resources: partNames[i]})
+				t.span.LogFields(log.Event("pushed resources"))
+			case <-ctx.Done():
+				err := ctx.Err()
+				l.Info("push timed out", zap.Object("tx", t), zap.Error(err))
+				ext.LogError(t.span, fmt.Errorf("push timed out: %w", err))
+				t.span.Finish()
+				return fmt.Errorf("push timed out: %v", err)
 			}
-			txs[res.GetNonce()] = t
-			span.LogFields(log.Event("pushed resources"))
-			return nil
-		case <-ctx.Done():
-			err := ctx.Err()
-			l.Info("push timed out", zap.Object("tx", t), zap.Error(err))
-			ext.LogError(span, fmt.Errorf("push timed out: %w", err))
-			t.span.Finish()
-			return fmt.Errorf("push timed out: %v", err)
 		}
+		return nil
 	}
 
 	// handleTx handles an acknowledgement
@@ -497,13 +1114,23 @@ func (m *Manager) Stream(ctx context.Context, reqCh chan *discovery_v3.Discovery
 		}
 		t.span.SetTag("status", status)
 
-		if f := m.OnAck; f != nil {
-			f(Acknowledgment{
-				Ack:     ack,
-				Node:    node,
-				Version: version,
-			})
+		nacks := m.rolloutAck(node, t.generation, ack)
+		if ack {
+			rCh.acked(version)
+			m.record(&HistoryRecord{Event: "ack", Node: node, Version: version})
+		} else {
+			rCh.rejected(origVersion)
+			m.record(&HistoryRecord{Event: "nack", Node: node, Version: origVersion, Error: req.GetErrorDetail().GetMessage()})
+			m.captureAdmin(nodeInfo, origVersion, nacks)
 		}
+		rolledBack := m.checkRollback(ctx, node, t.generation, ack)
+		m.acknowledged(Acknowledgment{
+			Ack:        ack,
+			Node:       node,
+			Version:    version,
+			Error:      req.GetErrorDetail().GetMessage(),
+			RolledBack: rolledBack,
+		})
 		t.span.Finish()
 		delete(txs, t.nonce)
 	}
@@ -512,12 +1139,74 @@ func (m *Manager) Stream(ctx context.Context, reqCh chan *discovery_v3.Discovery
 	cleanupTicker := time.NewTicker(time.Minute)
 	defer cleanupTicker.Stop()
 
+	expire := m.expiry()
+	var handoff <-chan struct{} = rCh.handoff
+
+	// pushChanges pushes an update from the session, if the client is interested in it.
+	pushChanges := func(u update) error {
+		var send bool
+		for _, name := range resources {
+			if m.affected(name, nodeInfo, u.resources) {
+				send = true
+				break
+			}
+		}
+		if subscribedToAll() || send {
+			tctx, c := context.WithTimeout(ctx, 5*time.Second)
+			defer c()
+			if err := sendUpdate(opentracing.ContextWithSpan(tctx, u.span)); err != nil {
+				return fmt.Errorf("pushing resources: %w", err)
+			}
+		} else if len(txs) == 0 {
+			// The client has nothing to learn from this version.
+			m.rolloutCurrent(node)
+		}
+		return nil
+	}
+
+	// While a push is being delayed by MinPushInterval, ready is nil and throttled fires when
+	// the session may take its pending update.
+	ready := rCh.ready
+	var throttled <-chan time.Time
+
+	// Once the server starts draining, draining is nil, nothing is pushed, and drainCheck fires
+	// when it's time to see if the stream can close.
+	draining := m.Draining
+	var drainCheck <-chan time.Time
+	var drainDeadline time.Time
+
 	for {
 		select {
-		case <-m.Draining:
-			return errors.New("server draining")
+		case <-draining:
+			draining, ready, throttled = nil, nil, nil
+			drainDeadline = time.Now().Add(m.DrainTimeout)
+			var err error
+			if drainCheck, err = m.drain(rCh, len(txs), drainDeadline); err != nil {
+				l.Info("closing stream because the server is draining")
+				return err
+			}
+		case <-drainCheck:
+			var err error
+			if drainCheck, err = m.drain(rCh, len(txs), drainDeadline); err != nil {
+				l.Info("closing stream because the server is draining")
+				return err
+			}
+		case <-disabled:
+			return m.disabledError()
 		case <-ctx.Done():
 			return ctx.Err()
+		case <-expire:
+			var err error
+			if expire, err = m.expire(len(txs)); err != nil {
+				l.Info("closing stream that reached its maximum age")
+				return err
+			}
+		case <-handoff:
+			var err error
+			if handoff, err = m.handOff(len(txs)); err != nil {
+				l.Info("closing stream to hand the client off to another server")
+				return err
+			}
 		case <-cleanupTicker.C:
 			for key, t := range txs {
 				if time.Since(t.start) > time.Minute {
@@ -529,23 +1218,58 @@ func (m *Manager) Stream(ctx context.Context, reqCh chan *discovery_v3.Discovery
 			}
 		case req, ok := <-reqCh:
 			if !ok {
-				return errors.New("request channel closed")
+				return errRequestsClosed
 			}
 			newResources := req.GetResourceNames()
-			if node == "" {
-				node = req.GetNode().GetId()
+			var resubscribed bool
+			first := node == ""
+			if first && m.Strict && req.GetNode().GetId() == "" {
+				return status.Error(codes.InvalidArgument, "the first request on a stream must identify the node")
+			}
+			if m.Strict && !first {
+				if ignore, err := m.checkStrict(req, lastNonce, txs); err != nil {
+					l.Error("client violated the xds protocol", zap.Error(err))
+					return err
+				} else if ignore {
+					l.Debug("ignoring request with stale nonce", zap.String("nonce", req.GetResponseNonce()), zap.String("last_nonce", lastNonce))
+					if t, ok := txs[req.GetResponseNonce()]; ok {
+						t.span.Finish()
+						delete(txs, t.nonce)
+					}
+					continue
+				}
+			}
+			if m.Strict {
+				if first {
+					legacyWildcard = len(newResources) == 0
+				} else if len(newResources) > 0 {
+					legacyWildcard = false
+				}
+			}
+			if first {
+				node, nodeInfo = req.GetNode().GetId(), req.GetNode()
+				m.rolloutConnect(req.GetNode())
 				l = l.With(zap.String("envoy.node.id", node))
 				ctx = ctxzap.ToContext(ctx, l)
 				resources = newResources
-				l = l.With(zap.Strings("subscribed_resources", resources))
+				rCh.connected(node)
+				l.Debug("initial resource subscriptions", zap.Strings("subscribed_resources", resources))
+			}
+			changed := !sameSubscriptions(resources, newResources)
+			if m.Strict && (len(resources) == 0) != (len(newResources) == 0) {
+				// An empty list and "*" are different subscriptions in strict mode.
+				changed = true
+			}
+			if changed {
+				// Clients are allowed to change their subscriptions on an open stream;
+				// gRPC's xDS client does this as it discovers new clusters.  The client
+				// expects a response reflecting the new set of resources.
+				l.Info("client changed resource subscriptions", zap.Strings("old_resources", resources), zap.Strings("new_resources", newResources))
+				resources = newResources
+				resubscribed = true
 			}
-			if diff := cmp.Diff(resources, newResources); diff != "" {
-				// I am pretty sure xDS doesn't allow changing the subscribed
-				// resource set, so we warn about attempting to do so.  I guess if
-				// we see this warning, it means that being "pretty sure" was
-				// incorrect.
-				l.Warn("envoy changed resource subscriptions without opening a new stream", zap.Strings("new_resources", newResources))
-				return status.Error(codes.FailedPrecondition, "resource subscriptions changed unexpectedly")
+			if first || changed {
+				m.subscribe(rCh, resources)
 			}
 
 			if t := req.GetTypeUrl(); t != m.Type {
@@ -556,9 +1280,11 @@ func (m *Manager) Stream(ctx context.Context, reqCh chan *discovery_v3.Discovery
 			nonce := req.GetResponseNonce()
 			if t, ok := txs[nonce]; ok {
 				handleTx(t, req)
-				break
-			}
-			if nonce == "" {
+				if !resubscribed {
+					break
+				}
+				l.Info("sending config for new subscriptions")
+			} else if nonce == "" {
 				l.Info("sending initial config")
 			} else {
 				// This is not that alarming.  It will happen when ekglue restarts
@@ -571,26 +1297,39 @@ func (m *Manager) Stream(ctx context.Context, reqCh chan *discovery_v3.Discovery
 				return fmt.Errorf("pushing resources: %w", err)
 			}
 			c()
-		case u := <-rCh:
-			var send bool
-			for _, name := range resources {
-				if _, ok := u.resources[name]; ok {
-					send = true
-					break
-				}
+		case <-ready:
+			if d := rCh.throttle(m.MinPushInterval); d > 0 {
+				ready, throttled = nil, time.After(d)
+				break
 			}
-			if len(resources) == 0 || send {
-				tctx, c := context.WithTimeout(ctx, 5*time.Second)
-				if err := sendUpdate(opentracing.ContextWithSpan(tctx, u.span)); err != nil {
-					c()
-					return fmt.Errorf("pushing resources: %w", err)
-				}
-				c()
+			if err := pushChanges(rCh.take()); err != nil {
+				return err
+			}
+		case <-throttled:
+			ready, throttled = rCh.ready, nil
+			if err := pushChanges(rCh.take()); err != nil {
+				return err
 			}
 		}
 	}
 }
 
+// checkStrict checks a request on an open stream for protocol violations, returning an error if
+// the request is invalid, or true if it is stale and should be ignored.
+func (m *Manager) checkStrict(req *discovery_v3.DiscoveryRequest, lastNonce string, txs map[string]*tx) (bool, error) {
+	nonce := req.GetResponseNonce()
+	if nonce == "" && req.GetErrorDetail() != nil {
+		return false, status.Error(codes.InvalidArgument, "error_detail must be accompanied by the response_nonce of the rejected response")
+	}
+	if nonce != lastNonce {
+		return true, nil
+	}
+	if t, ok := txs[nonce]; ok && req.GetErrorDetail() == nil && req.GetVersionInfo() != t.version {
+		return false, status.Errorf(codes.InvalidArgument, "acknowledged version %q, but response %q contained version %q", req.GetVersionInfo(), nonce, t.version)
+	}
+	return false, nil
+}
+
 // Stream is the API shared among all envoy_api_v2.[type]DiscoveryService_Stream[type]Server
 // streams.
 type Stream interface {
@@ -1,23 +1,60 @@
 package xds
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
 	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	envoy_api_v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	"github.com/go-test/deep"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
 	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
 	"sigs.k8s.io/yaml"
 )
 
+// newTestManager returns a Manager of v3 clusters that logs to t.
+func newTestManager(t *testing.T, name, versionPrefix string) *Manager {
+	m := NewManager(name, versionPrefix, &envoy_config_cluster_v3.Cluster{}, nil)
+	m.Logger = zaptest.NewLogger(t)
+	return m
+}
+
+// testCluster returns a cluster; tests change the timeout to change the cluster.
+func testCluster(name string, timeout time.Duration) *envoy_config_cluster_v3.Cluster {
+	return &envoy_config_cluster_v3.Cluster{Name: name, ConnectTimeout: durationpb.New(timeout)}
+}
+
 func TestManager(t *testing.T) {
 	m := NewManager("test", "test-", &envoy_api_v2.Cluster{}, nil)
 	if got, want := m.Type, "type.googleapis.com/envoy.api.v2.Cluster"; got != want {
@@ -233,6 +270,54 @@ func TestNamedSubscriptions(t *testing.T) {
 	}
 }
 
+func TestOnSubscribe(t *testing.T) {
+	m := NewManager("on-subscribe", "on-subscribe-", &envoy_api_v2.ClusterLoadAssignment{}, nil)
+	reqCh, resCh, errCh := make(chan *discovery_v3.DiscoveryRequest), make(chan *discovery_v3.DiscoveryResponse), make(chan error)
+
+	l := zaptest.NewLogger(t, zaptest.Level(zap.DebugLevel))
+	m.Logger = l.Named("manager")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var calls [][]string
+	m.OnSubscribe = func(names []string) {
+		calls = append(calls, names)
+		for _, name := range names {
+			m.Add(ctx, []Resource{&envoy_api_v2.ClusterLoadAssignment{ClusterName: name}})
+		}
+	}
+	streamCtx, streamCancel := context.WithCancel(ctxzap.ToContext(ctx, l.Named("stream")))
+	go func() { errCh <- m.Stream(streamCtx, reqCh, resCh) }()
+
+	select {
+	case reqCh <- &discovery_v3.DiscoveryRequest{
+		Node:          &envoy_config_core_v3.Node{Id: "test"},
+		TypeUrl:       m.Type,
+		ResourceNames: []string{"foo", "bar"},
+	}:
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+	var res *discovery_v3.DiscoveryResponse
+	select {
+	case res = <-resCh:
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+	if got, want := len(res.GetResources()), 2; got != want {
+		t.Errorf("resources generated on subscription:\n  got: %v\n want: %v", got, want)
+	}
+
+	streamCancel()
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("stream did not exit")
+	case <-errCh:
+	}
+	if diff := cmp.Diff(calls, [][]string{{"bar", "foo"}, {}}); diff != "" {
+		t.Errorf("subscriptions reported:\n%s", diff)
+	}
+}
+
 func TestConfigAsYAML(t *testing.T) {
 	s := NewManager("test", "", &envoy_api_v2.Cluster{}, nil)
 	err := s.Add(context.Background(), []Resource{&envoy_api_v2.Cluster{Name: "foo"}})
@@ -253,3 +338,1997 @@ func TestConfigAsYAML(t *testing.T) {
 		t.Errorf("yaml:\n  got: %v\n want: %v", got, want)
 	}
 }
+
+func TestQuota(t *testing.T) {
+	ctx := context.Background()
+	m := NewManager("test", "", &envoy_api_v2.Cluster{}, nil)
+	m.Logger = zaptest.NewLogger(t)
+	m.MaxResources = 2
+	cluster := func(name string) Resource { return &envoy_api_v2.Cluster{Name: name} }
+
+	if err := m.Add(ctx, []Resource{cluster("a"), cluster("b")}); err != nil {
+		t.Fatalf("add within quota: %v", err)
+	}
+	if err := m.Add(ctx, []Resource{cluster("a")}); err != nil {
+		t.Errorf("update within quota: %v", err)
+	}
+	if err := m.Add(ctx, []Resource{cluster("c")}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("add over quota: expected ErrQuotaExceeded, got %v", err)
+	}
+	if err := m.Replace(ctx, []Resource{cluster("a"), cluster("b"), cluster("c")}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("replace over quota: expected ErrQuotaExceeded, got %v", err)
+	}
+	if err := m.Apply(ctx, []Resource{cluster("c")}, []string{"a"}); err != nil {
+		t.Errorf("apply that stays within quota: %v", err)
+	}
+	if got, want := m.ListKeys(), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("resources:\n  got: %v\n want: %v", got, want)
+	}
+}
+
+func TestValidators(t *testing.T) {
+	ctx := context.Background()
+	m := newTestManager(t, "test", "")
+	m.Validators = []Validator{func(r Resource) error {
+		if !strings.HasPrefix(r.(*envoy_config_cluster_v3.Cluster).GetName(), "team-") {
+			return errors.New("cluster names must start with team-")
+		}
+		return nil
+	}}
+
+	if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "team-a"}}); err != nil {
+		t.Fatalf("add valid cluster: %v", err)
+	}
+	err := m.Apply(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "team-b"}, &envoy_config_cluster_v3.Cluster{Name: "rogue"}}, nil)
+	var verr *ValidationError
+	if !errors.As(err, &verr) || verr.Name != "rogue" {
+		t.Errorf("add invalid cluster: expected ValidationError for rogue, got %v", err)
+	}
+	if err := m.Replace(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "rogue"}}); err == nil {
+		t.Error("replace with invalid cluster: expected error")
+	}
+	if got, want := m.ListKeys(), []string{"team-a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("resources:\n  got: %v\n want: %v", got, want)
+	}
+}
+
+func TestErrorClassification(t *testing.T) {
+	ctx := context.Background()
+	m := newTestManager(t, "test", "")
+
+	err := m.Add(ctx, []Resource{
+		&envoy_config_cluster_v3.Cluster{Name: "ok"},
+		&envoy_config_cluster_v3.Cluster{Name: "invalid", LbPolicy: -1},
+	})
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Errorf("invalid resource: expected ValidationError, got %v", err)
+	}
+	if name, _ := ResourceName(err); name != "invalid" {
+		t.Errorf("invalid resource: name:\n  got: %v\n want: invalid", name)
+	}
+	if got := m.ListKeys(); len(got) != 0 {
+		t.Errorf("resources after failed add:\n  got: %v\n want: []", got)
+	}
+
+	err = m.Replace(ctx, []Resource{
+		&envoy_config_cluster_v3.Cluster{Name: "dup"},
+		&envoy_config_cluster_v3.Cluster{Name: "dup"},
+	})
+	var cerr *NameConflictError
+	if !errors.As(err, &cerr) || cerr.Name != "dup" {
+		t.Errorf("duplicate names: expected NameConflictError for dup, got %v", err)
+	}
+
+	err = m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "bad-utf8", AltStatName: "\xff"}})
+	var merr *MarshalError
+	if !errors.As(err, &merr) {
+		t.Errorf("invalid utf-8: expected MarshalError, got %v", err)
+	}
+	if _, ok := ResourceName(errors.New("other")); ok {
+		t.Error("unclassified error: expected no resource name")
+	}
+}
+
+func TestDeltaStream(t *testing.T) {
+	m := NewManager("test", "", &envoy_config_cluster_v3.Cluster{}, nil)
+	l := zaptest.NewLogger(t)
+	m.Logger = l.Named("manager")
+	ctx, cancel := context.WithTimeout(ctxzap.ToContext(context.Background(), l), 5*time.Second)
+	defer cancel()
+	if err := m.Add(ctx, []Resource{testCluster("a", time.Second), testCluster("b", time.Second)}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	aAny, err := marshalAny(testCluster("a", time.Second))
+	if err != nil {
+		t.Fatalf("marshal a: %v", err)
+	}
+
+	acks := make(chan bool, 10)
+	m.OnAck = func(a Acknowledgment) { acks <- a.Ack }
+	reqCh, resCh, errCh := make(chan *discovery_v3.DeltaDiscoveryRequest), make(chan *discovery_v3.DeltaDiscoveryResponse), make(chan error)
+	go func() { errCh <- m.DeltaStream(ctx, reqCh, resCh) }()
+
+	// await returns the names of updated and removed resources in the next response, and acks
+	// or nacks it.
+	await := func(nack bool) (updated, removed []string) {
+		t.Helper()
+		select {
+		case res := <-resCh:
+			for _, r := range res.GetResources() {
+				updated = append(updated, r.GetName())
+			}
+			req := &discovery_v3.DeltaDiscoveryRequest{TypeUrl: m.Type, ResponseNonce: res.GetNonce()}
+			if nack {
+				req.ErrorDetail = &status.Status{Code: int32(codes.InvalidArgument), Message: "rejected"}
+			}
+			reqCh <- req
+			if got := <-acks; got == nack {
+				t.Errorf("ack status:\n  got: %v\n want: %v", got, !nack)
+			}
+			return updated, res.GetRemovedResources()
+		case err := <-errCh:
+			t.Fatalf("stream error: %v", err)
+		case <-ctx.Done():
+			t.Fatal("timeout waiting for response")
+		}
+		return nil, nil
+	}
+	check := func(desc string, gotUpdated, gotRemoved, wantUpdated, wantRemoved []string) {
+		t.Helper()
+		if diff := cmp.Diff(gotUpdated, wantUpdated); diff != "" {
+			t.Errorf("%s: updated resources:\n%s", desc, diff)
+		}
+		if diff := cmp.Diff(gotRemoved, wantRemoved); diff != "" {
+			t.Errorf("%s: removed resources:\n%s", desc, diff)
+		}
+	}
+
+	// A reconnecting wildcard client that already has "a" only receives "b".
+	reqCh <- &discovery_v3.DeltaDiscoveryRequest{
+		Node:                    &envoy_config_core_v3.Node{Id: "test"},
+		TypeUrl:                 m.Type,
+		InitialResourceVersions: map[string]string{"a": resourceVersion(aAny)},
+	}
+	updated, removed := await(false)
+	check("initial", updated, removed, []string{"b"}, nil)
+
+	if err := m.Add(ctx, []Resource{testCluster("c", time.Second)}); err != nil {
+		t.Fatalf("add c: %v", err)
+	}
+	updated, removed = await(false)
+	check("add c", updated, removed, []string{"c"}, nil)
+
+	m.Delete(ctx, "b")
+	updated, removed = await(false)
+	check("delete b", updated, removed, nil, []string{"b"})
+
+	// A rejected resource is sent again when it next changes.
+	if err := m.Add(ctx, []Resource{testCluster("a", 2*time.Second)}); err != nil {
+		t.Fatalf("update a: %v", err)
+	}
+	updated, removed = await(true)
+	check("update a", updated, removed, []string{"a"}, nil)
+	if err := m.Replace(ctx, []Resource{testCluster("a", 3*time.Second), testCluster("c", time.Second), testCluster("d", time.Second)}); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	updated, removed = await(false)
+	check("replace after nack", updated, removed, []string{"a", "d"}, nil)
+
+	// Adding an explicit subscription to a missing resource reports it as removed.
+	reqCh <- &discovery_v3.DeltaDiscoveryRequest{TypeUrl: m.Type, ResourceNamesSubscribe: []string{"missing"}}
+	updated, removed = await(false)
+	check("subscribe to missing", updated, removed, nil, []string{"missing"})
+
+	cancel()
+	<-errCh
+}
+
+// relay simulates an xDS caching relay; it opens one upstream stream per subscription and expects
+// that every stream with the same subscription receives identical responses.
+type relay struct {
+	t     *testing.T
+	m     *Manager
+	ctx   context.Context
+	errCh chan error
+}
+
+// subscribe opens a new stream to the manager and returns a function that returns the next
+// response, serialized.
+func (r *relay) subscribe(node string, names ...string) func() []byte {
+	reqCh, resCh := make(chan *discovery_v3.DiscoveryRequest), make(chan *discovery_v3.DiscoveryResponse)
+	go func() { r.errCh <- r.m.Stream(r.ctx, reqCh, resCh) }()
+	req := &discovery_v3.DiscoveryRequest{
+		Node:          &envoy_config_core_v3.Node{Id: node},
+		TypeUrl:       r.m.Type,
+		ResourceNames: names,
+	}
+	reqCh <- req
+	return func() []byte {
+		r.t.Helper()
+		select {
+		case res := <-resCh:
+			b, err := proto.MarshalOptions{Deterministic: true}.Marshal(res)
+			if err != nil {
+				r.t.Fatalf("marshal response: %v", err)
+			}
+			// ACK so that the manager considers the push complete.
+			req.VersionInfo, req.ResponseNonce = res.GetVersionInfo(), res.GetNonce()
+			reqCh <- proto.Clone(req).(*discovery_v3.DiscoveryRequest)
+			return b
+		case err := <-r.errCh:
+			r.t.Fatalf("stream error: %v", err)
+		case <-r.ctx.Done():
+			r.t.Fatal("timeout waiting for response")
+		}
+		return nil
+	}
+}
+
+func TestRelayCompatibility(t *testing.T) {
+	m := NewManager("relay", "relay-", &envoy_api_v2.Cluster{}, nil)
+	m.Logger = zaptest.NewLogger(t, zaptest.Level(zap.DebugLevel))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = ctxzap.ToContext(ctx, m.Logger)
+	r := &relay{t: t, m: m, ctx: ctx, errCh: make(chan error, 4)}
+
+	if err := m.Add(ctx, []Resource{&envoy_api_v2.Cluster{Name: "b"}, &envoy_api_v2.Cluster{Name: "a"}, &envoy_api_v2.Cluster{Name: "c"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	legacyWildcard, wildcard := r.subscribe("node-a"), r.subscribe("node-b", "*")
+	named1, named2 := r.subscribe("node-c", "c", "a"), r.subscribe("node-d", "a", "c", "a")
+	if a, b := legacyWildcard(), wildcard(); !bytes.Equal(a, b) {
+		t.Error("wildcard subscriptions received different initial responses")
+	}
+	if a, b := named1(), named2(); !bytes.Equal(a, b) {
+		t.Error("equivalent named subscriptions received different initial responses")
+	}
+
+	if err := m.Add(ctx, []Resource{&envoy_api_v2.Cluster{Name: "a", LbPolicy: envoy_api_v2.Cluster_RANDOM}}); err != nil {
+		t.Fatal(err)
+	}
+	if a, b := legacyWildcard(), wildcard(); !bytes.Equal(a, b) {
+		t.Error("wildcard subscriptions received different pushes")
+	}
+	if a, b := named1(), named2(); !bytes.Equal(a, b) {
+		t.Error("equivalent named subscriptions received different pushes")
+	}
+}
+
+func TestRolloutStatus(t *testing.T) {
+	m := NewManager("test", "v", &envoy_config_cluster_v3.Cluster{}, nil)
+	l := zaptest.NewLogger(t)
+	m.Logger = l.Named("manager")
+	ctx, cancel := context.WithTimeout(ctxzap.ToContext(context.Background(), l), 5*time.Second)
+	defer cancel()
+	if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "a"}}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	acks := make(chan struct{}, 10)
+	m.OnAck = func(Acknowledgment) { acks <- struct{}{} }
+
+	type client struct {
+		reqCh  chan *discovery_v3.DiscoveryRequest
+		resCh  chan *discovery_v3.DiscoveryResponse
+		errCh  chan error
+		cancel func()
+	}
+	connect := func(node string) *client {
+		c := &client{
+			reqCh: make(chan *discovery_v3.DiscoveryRequest),
+			resCh: make(chan *discovery_v3.DiscoveryResponse),
+			errCh: make(chan error),
+		}
+		sctx, cancel := context.WithCancel(ctx)
+		c.cancel = cancel
+		go func() { c.errCh <- m.Stream(sctx, c.reqCh, c.resCh) }()
+		c.reqCh <- &discovery_v3.DiscoveryRequest{Node: &envoy_config_core_v3.Node{Id: node}, TypeUrl: m.Type}
+		return c
+	}
+	// respond reads the next response and acks or nacks it, returning once the manager has
+	// processed the response.
+	respond := func(c *client, inUse string, nack bool) {
+		t.Helper()
+		var res *discovery_v3.DiscoveryResponse
+		select {
+		case res = <-c.resCh:
+		case <-ctx.Done():
+			t.Fatal("timeout waiting for response")
+		}
+		req := &discovery_v3.DiscoveryRequest{TypeUrl: m.Type, ResponseNonce: res.GetNonce(), VersionInfo: res.GetVersionInfo()}
+		if nack {
+			req.VersionInfo = inUse
+			req.ErrorDetail = &status.Status{Code: int32(codes.InvalidArgument), Message: "rejected"}
+		}
+		c.reqCh <- req
+		<-acks
+	}
+	check := func(desc string, want *RolloutStatus) {
+		t.Helper()
+		if diff := cmp.Diff(m.RolloutStatus(), want, cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("%s: rollout status:\n%s", desc, diff)
+		}
+	}
+
+	a, b := connect("a"), connect("b")
+	respond(a, "", false)
+	respond(b, "", true)
+	check("initial", &RolloutStatus{Version: "v1", Nodes: 2, Acked: 1, Nacked: 1, Accepted: map[string]int{"v1": 1}, Rejected: map[string]int{"v1": 1}})
+
+	if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "b"}}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	respond(a, "v1", false)
+	check("update", &RolloutStatus{Version: "v2", Nodes: 2, Acked: 1, Pending: 1, Accepted: map[string]int{"v2": 1}, Rejected: map[string]int{"v1": 1}})
+	if m.RolloutStatus().Converged() {
+		t.Error("rollout unexpectedly converged")
+	}
+
+	b.cancel()
+	<-b.errCh
+	check("disconnect", &RolloutStatus{Version: "v2", Nodes: 1, Acked: 1, Accepted: map[string]int{"v2": 1}})
+	if !m.RolloutStatus().Converged() {
+		t.Error("rollout unexpectedly not converged")
+	}
+	a.cancel()
+	<-a.errCh
+}
+
+func TestRolloutCurrentAfterNack(t *testing.T) {
+	m := NewManager("test", "v", &envoy_config_cluster_v3.Cluster{}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "a"}}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	m.rolloutConnect(&envoy_config_core_v3.Node{Id: "a"})
+	defer m.rolloutDisconnect("a")
+	m.rolloutAck("a", "v1", false)
+
+	// A push that doesn't touch the node's resources doesn't make it look like it accepted
+	// anything.
+	if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "b"}}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	m.rolloutCurrent("a")
+	want := &RolloutStatus{Version: "v2", Nodes: 1, Pending: 1, Rejected: map[string]int{"v1": 1}}
+	if diff := cmp.Diff(m.RolloutStatus(), want, cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("after nack: rollout status:\n%s", diff)
+	}
+
+	m.rolloutAck("a", "v2", true)
+	if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "c"}}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	m.rolloutCurrent("a")
+	want = &RolloutStatus{Version: "v3", Nodes: 1, Acked: 1, Accepted: map[string]int{"v3": 1}}
+	if diff := cmp.Diff(m.RolloutStatus(), want, cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("after ack: rollout status:\n%s", diff)
+	}
+}
+
+func TestMaxStreamAge(t *testing.T) {
+	m := NewManager("test", "", &envoy_config_cluster_v3.Cluster{}, nil)
+	m.MaxStreamAge = 50 * time.Millisecond
+	l := zaptest.NewLogger(t)
+	m.Logger = l.Named("manager")
+	ctx, cancel := context.WithTimeout(ctxzap.ToContext(context.Background(), l), 5*time.Second)
+	defer cancel()
+	if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "a"}}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	reqCh, resCh, errCh := make(chan *discovery_v3.DiscoveryRequest), make(chan *discovery_v3.DiscoveryResponse), make(chan error)
+	go func() { errCh <- m.Stream(ctx, reqCh, resCh) }()
+	reqCh <- &discovery_v3.DiscoveryRequest{Node: &envoy_config_core_v3.Node{Id: "test"}, TypeUrl: m.Type}
+	res := <-resCh
+
+	// The stream stays open while the response is unacknowledged.
+	select {
+	case err := <-errCh:
+		t.Fatalf("stream closed with a response in flight: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	reqCh <- &discovery_v3.DiscoveryRequest{TypeUrl: m.Type, ResponseNonce: res.GetNonce(), VersionInfo: res.GetVersionInfo()}
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, errStreamExpired) {
+			t.Errorf("stream error:\n  got: %v\n want: %v", err, errStreamExpired)
+		}
+	case <-ctx.Done():
+		t.Fatal("stream did not expire")
+	}
+}
+
+func TestDigestVersions(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	build := func(prefix string) *Manager {
+		m := newTestManager(t, "test", prefix)
+		m.DigestVersions = true
+		if err := m.Add(ctx, []Resource{
+			&envoy_config_cluster_v3.Cluster{Name: "a"},
+			&envoy_config_cluster_v3.Cluster{Name: "b"},
+		}); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+		return m
+	}
+	version := func(m *Manager, subscribed ...string) string {
+		t.Helper()
+		res, _, err := m.BuildDiscoveryResponse(subscribed)
+		if err != nil {
+			t.Fatalf("build response: %v", err)
+		}
+		return res.GetVersionInfo()
+	}
+
+	// Replicas (or restarts) with the same resources agree on versions.
+	m1, m2 := build("one-"), build("two-")
+	all, a := version(m1, "*"), version(m1, "a")
+	if got, want := version(m2, "*"), all; got != want {
+		t.Errorf("version on another replica:\n  got: %v\n want: %v", got, want)
+	}
+	if all == a {
+		t.Errorf("subsets should have their own version, but got %v for both", all)
+	}
+
+	// Changing a resource changes the version of responses containing it, and changing it back
+	// restores the old version.
+	if err := m1.Add(ctx, []Resource{testCluster("b", time.Second)}); err != nil {
+		t.Fatalf("update b: %v", err)
+	}
+	if got := version(m1, "*"); got == all {
+		t.Errorf("version did not change after an update: %v", got)
+	}
+	if got, want := version(m1, "a"), a; got != want {
+		t.Errorf("version of unchanged subset:\n  got: %v\n want: %v", got, want)
+	}
+	if err := m1.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "b"}}); err != nil {
+		t.Fatalf("revert b: %v", err)
+	}
+	if got, want := version(m1, "*"), all; got != want {
+		t.Errorf("version after reverting:\n  got: %v\n want: %v", got, want)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	stores := map[string]HistoryStore{
+		"ring": NewRingHistory(3),
+		"file": NewFileHistory(filepath.Join(t.TempDir(), "history"), 256),
+	}
+	for name, h := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			m := newTestManager(t, "test", "test-")
+			m.History = h
+			for _, n := range []string{"a", "b", "c", "d", "e"} {
+				if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: n}}); err != nil {
+					t.Fatalf("add %s: %v", n, err)
+				}
+			}
+			rs, err := h.Recent(3)
+			if err != nil {
+				t.Fatalf("recent: %v", err)
+			}
+			want := []*HistoryRecord{
+				{Manager: "test", Event: "change", Version: "test-3", Resources: []string{"c"}},
+				{Manager: "test", Event: "change", Version: "test-4", Resources: []string{"d"}},
+				{Manager: "test", Event: "change", Version: "test-5", Resources: []string{"e"}},
+			}
+			if diff := cmp.Diff(rs, want, cmpopts.IgnoreFields(HistoryRecord{}, "Time")); diff != "" {
+				t.Errorf("recent history:\n%s", diff)
+			}
+		})
+	}
+}
+
+// countingSnapshot is a SnapshotStore that counts saves.
+type countingSnapshot struct {
+	SnapshotStore
+	saves atomic.Int32
+}
+
+func (s *countingSnapshot) Save(manager string, data []byte) error {
+	s.saves.Add(1)
+	return s.SnapshotStore.Save(manager, data)
+}
+
+func TestSnapshot(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	store := NewFileSnapshot(t.TempDir())
+	counting := &countingSnapshot{SnapshotStore: store}
+	m := newTestManager(t, "test", "test-")
+	m.Snapshot = counting
+	m.SnapshotInterval = 10 * time.Millisecond
+	if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "a"}, &envoy_config_cluster_v3.Cluster{Name: "b"}}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	const updates = 20
+	for i := 0; i < updates; i++ {
+		if err := m.Add(ctx, []Resource{testCluster("b", time.Duration(i+1)*time.Second)}); err != nil {
+			t.Fatalf("update: %v", err)
+		}
+	}
+	if err := m.Apply(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "c"}}, []string{"a"}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+
+	// Snapshots are saved in the background.
+	restarted := newTestManager(t, "test", "test-")
+	restarted.Snapshot = store
+	for {
+		if err := restarted.Restore(ctx); err != nil {
+			t.Fatalf("restore: %v", err)
+		}
+		if got, want := restarted.ListKeys(), []string{"b", "c"}; cmp.Equal(got, want) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("restored resources:\n  got: %v\n want: [b c]", restarted.ListKeys())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	// A burst of changes isn't saved one at a time.
+	if got := counting.saves.Load(); got >= updates {
+		t.Errorf("saves: got %v, want fewer than the %v updates", got, updates)
+	}
+	m.Close()
+
+	// Close saves changes that are waiting for the interval to pass.
+	slow := newTestManager(t, "slow", "test-")
+	slow.Snapshot = store
+	slow.SnapshotInterval = time.Hour
+	for _, name := range []string{"a", "b"} {
+		if err := slow.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: name}}); err != nil {
+			t.Fatalf("add %s: %v", name, err)
+		}
+	}
+	slow.Close()
+	restarted = newTestManager(t, "slow", "test-")
+	restarted.Snapshot = store
+	if err := restarted.Restore(ctx); err != nil {
+		t.Fatalf("restore after close: %v", err)
+	}
+	if diff := cmp.Diff(restarted.ListKeys(), []string{"a", "b"}); diff != "" {
+		t.Errorf("resources restored after close:\n%s", diff)
+	}
+
+	empty := NewManager("other", "test-", &envoy_config_cluster_v3.Cluster{}, nil)
+	empty.Snapshot = store
+	if err := empty.Restore(ctx); err != nil {
+		t.Errorf("restore without a snapshot: %v", err)
+	}
+	if got := empty.ListKeys(); len(got) > 0 {
+		t.Errorf("resources restored from nothing: %v", got)
+	}
+
+	wrongType := NewManager("test", "test-", &envoy_api_v2.Cluster{}, nil)
+	wrongType.Snapshot = store
+	if err := wrongType.Restore(ctx); err == nil {
+		t.Error("expected error restoring a snapshot of another type")
+	}
+}
+
+func TestFollowSnapshot(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	store := NewFileSnapshot(t.TempDir())
+	writer := newTestManager(t, "test", "writer-")
+	writer.Snapshot = store
+	writer.DigestVersions = true
+	follower := newTestManager(t, "test", "follower-")
+	follower.DigestVersions = true
+	go follower.Follow(ctx, store, 10*time.Millisecond)
+
+	// await waits for the follower to serve exactly what the writer serves.
+	await := func(desc string) {
+		t.Helper()
+		want, _, err := writer.BuildDiscoveryResponse(nil)
+		if err != nil {
+			t.Fatalf("%s: build writer response: %v", desc, err)
+		}
+		for {
+			got, _, err := follower.BuildDiscoveryResponse(nil)
+			if err != nil {
+				t.Fatalf("%s: build follower response: %v", desc, err)
+			}
+			if cmp.Equal(got.GetResources(), want.GetResources(), protocmp.Transform()) && got.GetVersionInfo() == want.GetVersionInfo() {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatalf("%s: follower did not catch up:\n  got: %v\n want: %v", desc, got, want)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+	if err := writer.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "a"}, &envoy_config_cluster_v3.Cluster{Name: "b"}}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	await("add")
+	if err := writer.Apply(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "c"}}, []string{"a"}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	await("apply")
+
+	// A snapshot that doesn't validate is skipped.
+	if err := store.Save("test", []byte("garbage")); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got, want := follower.ListKeys(), []string{"b", "c"}; !cmp.Equal(got, want) {
+		t.Errorf("resources after invalid snapshot:\n  got: %v\n want: %v", got, want)
+	}
+}
+
+func TestUnchangedResources(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m := newTestManager(t, "test", "test-")
+	version := func() string {
+		m.resourcesMu.Lock()
+		defer m.resourcesMu.Unlock()
+		return m.versionString()
+	}
+	if err := m.Add(ctx, []Resource{testCluster("a", time.Second), testCluster("b", time.Second)}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if got, want := version(), "test-1"; got != want {
+		t.Fatalf("initial version:\n  got: %v\n want: %v", got, want)
+	}
+
+	// Equal copies of existing resources don't create a new version.
+	if err := m.Add(ctx, []Resource{testCluster("a", time.Second)}); err != nil {
+		t.Fatalf("re-add: %v", err)
+	}
+	if err := m.Apply(ctx, []Resource{testCluster("b", time.Second)}, []string{"missing"}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if err := m.Replace(ctx, []Resource{testCluster("a", time.Second), testCluster("b", time.Second)}); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	if got, want := version(), "test-1"; got != want {
+		t.Errorf("version after no-op changes:\n  got: %v\n want: %v", got, want)
+	}
+
+	// Real changes still do.
+	if err := m.Replace(ctx, []Resource{testCluster("a", 2*time.Second), testCluster("b", time.Second)}); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	if got, want := version(), "test-2"; got != want {
+		t.Errorf("version after a change:\n  got: %v\n want: %v", got, want)
+	}
+
+	// Only the resources that changed are reported to OnChange.
+	var changed map[string]Resource
+	m.OnChange = func(c map[string]Resource) { changed = c }
+	if err := m.Replace(ctx, []Resource{testCluster("b", time.Second), testCluster("c", time.Second)}); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	want := map[string]Resource{"a": nil, "c": testCluster("c", time.Second)}
+	if diff := cmp.Diff(changed, want, protocmp.Transform()); diff != "" {
+		t.Errorf("changed resources:\n%s", diff)
+	}
+}
+
+func TestStrictConformance(t *testing.T) {
+	node := &envoy_config_core_v3.Node{Id: "test"}
+	type stream struct {
+		t     *testing.T
+		m     *Manager
+		ctx   context.Context
+		reqCh chan *discovery_v3.DiscoveryRequest
+		resCh chan *discovery_v3.DiscoveryResponse
+		errCh chan error
+	}
+	start := func(t *testing.T) *stream {
+		l := zaptest.NewLogger(t)
+		ctx, cancel := context.WithTimeout(ctxzap.ToContext(context.Background(), l), 5*time.Second)
+		m := NewManager("test", "v", &envoy_config_cluster_v3.Cluster{}, nil)
+		m.Logger = l.Named("manager")
+		m.Strict = true
+		if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "a"}, &envoy_config_cluster_v3.Cluster{Name: "b"}}); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+		s := &stream{
+			t:     t,
+			m:     m,
+			ctx:   ctx,
+			reqCh: make(chan *discovery_v3.DiscoveryRequest),
+			resCh: make(chan *discovery_v3.DiscoveryResponse),
+			errCh: make(chan error, 1),
+		}
+		doneCh := make(chan struct{})
+		go func() {
+			s.errCh <- m.Stream(ctx, s.reqCh, s.resCh)
+			close(doneCh)
+		}()
+		t.Cleanup(func() {
+			cancel()
+			<-doneCh
+		})
+		return s
+	}
+	send := func(s *stream, req *discovery_v3.DiscoveryRequest) {
+		s.t.Helper()
+		req.TypeUrl = s.m.Type
+		select {
+		case s.reqCh <- req:
+		case err := <-s.errCh:
+			s.t.Fatalf("stream ended unexpectedly: %v", err)
+		}
+	}
+	recv := func(s *stream) *discovery_v3.DiscoveryResponse {
+		s.t.Helper()
+		select {
+		case res := <-s.resCh:
+			return res
+		case err := <-s.errCh:
+			s.t.Fatalf("stream ended unexpectedly: %v", err)
+		case <-s.ctx.Done():
+			s.t.Fatal("timeout waiting for response")
+		}
+		return nil
+	}
+	quiet := func(s *stream) {
+		s.t.Helper()
+		select {
+		case res := <-s.resCh:
+			s.t.Fatalf("unexpected response: %v", res)
+		case err := <-s.errCh:
+			s.t.Fatalf("stream ended unexpectedly: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	invalid := func(s *stream) {
+		s.t.Helper()
+		select {
+		case err := <-s.errCh:
+			if got, want := grpcstatus.Code(err), codes.InvalidArgument; got != want {
+				s.t.Errorf("stream error code:\n  got: %v\n want: %v (%v)", got, want, err)
+			}
+		case <-s.ctx.Done():
+			s.t.Fatal("timeout waiting for the stream to end")
+		}
+	}
+	names := func(res *discovery_v3.DiscoveryResponse) []string {
+		var result []string
+		for _, a := range res.GetResources() {
+			c := new(envoy_config_cluster_v3.Cluster)
+			if err := a.UnmarshalTo(c); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			result = append(result, c.GetName())
+		}
+		return result
+	}
+
+	t.Run("missing node", func(t *testing.T) {
+		s := start(t)
+		send(s, &discovery_v3.DiscoveryRequest{})
+		invalid(s)
+	})
+
+	t.Run("stale nonce", func(t *testing.T) {
+		s := start(t)
+		send(s, &discovery_v3.DiscoveryRequest{Node: node})
+		first := recv(s)
+		if err := s.m.Add(s.ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "c"}}); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+		second := recv(s)
+		// The acknowledgement of the first response crossed paths with the second response.
+		send(s, &discovery_v3.DiscoveryRequest{VersionInfo: first.GetVersionInfo(), ResponseNonce: first.GetNonce()})
+		quiet(s)
+		send(s, &discovery_v3.DiscoveryRequest{VersionInfo: second.GetVersionInfo(), ResponseNonce: second.GetNonce()})
+		quiet(s)
+		if got, want := s.m.RolloutStatus().Acked, 1; got != want {
+			t.Errorf("acked nodes:\n  got: %v\n want: %v", got, want)
+		}
+	})
+
+	t.Run("wrong version", func(t *testing.T) {
+		s := start(t)
+		send(s, &discovery_v3.DiscoveryRequest{Node: node})
+		res := recv(s)
+		send(s, &discovery_v3.DiscoveryRequest{VersionInfo: "something-else", ResponseNonce: res.GetNonce()})
+		invalid(s)
+	})
+
+	t.Run("nack without nonce", func(t *testing.T) {
+		s := start(t)
+		send(s, &discovery_v3.DiscoveryRequest{Node: node})
+		recv(s)
+		send(s, &discovery_v3.DiscoveryRequest{ErrorDetail: &status.Status{Code: int32(codes.InvalidArgument), Message: "rejected"}})
+		invalid(s)
+	})
+
+	t.Run("legacy wildcard", func(t *testing.T) {
+		s := start(t)
+		send(s, &discovery_v3.DiscoveryRequest{Node: node})
+		res := recv(s)
+		if diff := cmp.Diff(names(res), []string{"a", "b"}); diff != "" {
+			t.Errorf("initial resources:\n%s", diff)
+		}
+		send(s, &discovery_v3.DiscoveryRequest{VersionInfo: res.GetVersionInfo(), ResponseNonce: res.GetNonce()})
+		quiet(s)
+		if err := s.m.Add(s.ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "c"}}); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+		if diff := cmp.Diff(names(recv(s)), []string{"a", "b", "c"}); diff != "" {
+			t.Errorf("resources after adding c:\n%s", diff)
+		}
+	})
+
+	t.Run("unsubscribe", func(t *testing.T) {
+		s := start(t)
+		send(s, &discovery_v3.DiscoveryRequest{Node: node, ResourceNames: []string{"a"}})
+		res := recv(s)
+		if diff := cmp.Diff(names(res), []string{"a"}); diff != "" {
+			t.Errorf("initial resources:\n%s", diff)
+		}
+		// Having named resources, an empty list unsubscribes from everything.
+		send(s, &discovery_v3.DiscoveryRequest{VersionInfo: res.GetVersionInfo(), ResponseNonce: res.GetNonce()})
+		quiet(s)
+		if err := s.m.Add(s.ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "c"}}); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+		quiet(s)
+		send(s, &discovery_v3.DiscoveryRequest{VersionInfo: res.GetVersionInfo(), ResponseNonce: res.GetNonce(), ResourceNames: []string{"*"}})
+		if diff := cmp.Diff(names(recv(s)), []string{"a", "b", "c"}); diff != "" {
+			t.Errorf("resources after subscribing to everything:\n%s", diff)
+		}
+	})
+}
+
+func TestSlowClient(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	ctx, cancel := context.WithTimeout(ctxzap.ToContext(context.Background(), l), 5*time.Second)
+	defer cancel()
+	m := NewManager("test", "v", &envoy_config_cluster_v3.Cluster{}, nil)
+	m.Logger = l.Named("manager")
+	reqCh, resCh, errCh := make(chan *discovery_v3.DiscoveryRequest), make(chan *discovery_v3.DiscoveryResponse), make(chan error, 1)
+	go func() { errCh <- m.Stream(ctx, reqCh, resCh) }()
+	reqCh <- &discovery_v3.DiscoveryRequest{Node: &envoy_config_core_v3.Node{Id: "test"}, TypeUrl: m.Type}
+	<-resCh
+
+	// The client isn't reading responses, so the stream is stuck sending the first of these
+	// changes; the rest must not wait for it.
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: fmt.Sprintf("c%d", i)}}); err != nil {
+			t.Fatalf("add %d: %v", i, err)
+		}
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("adding resources took %v, waiting for a slow client", d)
+	}
+
+	// Once the client catches up, it gets everything in at most two responses.
+	var res *discovery_v3.DiscoveryResponse
+	for i := 0; i < 2 && len(res.GetResources()) < 10; i++ {
+		select {
+		case res = <-resCh:
+		case err := <-errCh:
+			t.Fatalf("stream ended: %v", err)
+		case <-ctx.Done():
+			t.Fatal("timeout waiting for response")
+		}
+		reqCh <- &discovery_v3.DiscoveryRequest{TypeUrl: m.Type, VersionInfo: res.GetVersionInfo(), ResponseNonce: res.GetNonce()}
+	}
+	if got, want := len(res.GetResources()), 10; got != want {
+		t.Errorf("resources after catching up:\n  got: %v\n want: %v", got, want)
+	}
+	cancel()
+	<-errCh
+}
+
+func TestMinPushInterval(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	ctx, cancel := context.WithTimeout(ctxzap.ToContext(context.Background(), l), 5*time.Second)
+	defer cancel()
+	m := NewManager("test", "v", &envoy_config_cluster_v3.Cluster{}, nil)
+	m.Logger = l.Named("manager")
+	m.MinPushInterval = 200 * time.Millisecond
+	reqCh, resCh, errCh := make(chan *discovery_v3.DiscoveryRequest), make(chan *discovery_v3.DiscoveryResponse), make(chan error, 1)
+	go func() { errCh <- m.Stream(ctx, reqCh, resCh) }()
+	recv := func() *discovery_v3.DiscoveryResponse {
+		t.Helper()
+		select {
+		case res := <-resCh:
+			reqCh <- &discovery_v3.DiscoveryRequest{TypeUrl: m.Type, VersionInfo: res.GetVersionInfo(), ResponseNonce: res.GetNonce()}
+			return res
+		case err := <-errCh:
+			t.Fatalf("stream ended: %v", err)
+		case <-ctx.Done():
+			t.Fatal("timeout waiting for response")
+		}
+		return nil
+	}
+	reqCh <- &discovery_v3.DiscoveryRequest{Node: &envoy_config_core_v3.Node{Id: "test"}, TypeUrl: m.Type}
+	recv()
+
+	// The first change is pushed right away.
+	if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "c0"}}); err != nil {
+		t.Fatal(err)
+	}
+	recv()
+	pushed := time.Now()
+
+	// Changes during the interval are merged into one push at the end of it.
+	for i := 1; i < 5; i++ {
+		if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: fmt.Sprintf("c%d", i)}}); err != nil {
+			t.Fatalf("add %d: %v", i, err)
+		}
+	}
+	res := recv()
+	if d := time.Since(pushed); d < 150*time.Millisecond {
+		t.Errorf("second push only %v after the first", d)
+	}
+	if got, want := len(res.GetResources()), 5; got != want {
+		t.Errorf("resources in second push:\n  got: %v\n want: %v", got, want)
+	}
+	select {
+	case res := <-resCh:
+		t.Errorf("unexpected extra push: %v", res)
+	case <-time.After(300 * time.Millisecond):
+	}
+	cancel()
+	<-errCh
+}
+
+func TestClientMetrics(t *testing.T) {
+	m := NewManager("metrics-test", "v", &envoy_config_cluster_v3.Cluster{}, nil)
+	l := zaptest.NewLogger(t)
+	m.Logger = l.Named("manager")
+	ctx, cancel := context.WithTimeout(ctxzap.ToContext(context.Background(), l), 5*time.Second)
+	defer cancel()
+	if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "a"}}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	acks := make(chan struct{}, 10)
+	m.OnAck = func(Acknowledgment) { acks <- struct{}{} }
+
+	// accepted returns true if the info metric says that node a accepted version.  A series that
+	// doesn't exist reads as 0, and DeleteLabelValues cleans it up.
+	accepted := func(version string) bool {
+		ok := testutil.ToFloat64(xdsNodeAcceptedVersion.WithLabelValues(m.Name, m.Type, "a", version)) == 1
+		if !ok {
+			xdsNodeAcceptedVersion.DeleteLabelValues(m.Name, m.Type, "a", version)
+		}
+		return ok
+	}
+	terminations := func(cause string) float64 {
+		return testutil.ToFloat64(xdsStreamTerminations.WithLabelValues(m.Name, m.Type, cause))
+	}
+
+	reqCh, resCh, errCh := make(chan *discovery_v3.DiscoveryRequest), make(chan *discovery_v3.DiscoveryResponse), make(chan error)
+	sctx, scancel := context.WithCancel(ctx)
+	go func() { errCh <- m.Stream(sctx, reqCh, resCh) }()
+	reqCh <- &discovery_v3.DiscoveryRequest{Node: &envoy_config_core_v3.Node{Id: "a"}, TypeUrl: m.Type}
+	res := <-resCh
+	if got, want := testutil.ToFloat64(xdsActiveStreams.WithLabelValues(m.Name, m.Type)), 1.0; got != want {
+		t.Errorf("active streams:\n  got: %v\n want: %v", got, want)
+	}
+	reqCh <- &discovery_v3.DiscoveryRequest{TypeUrl: m.Type, ResponseNonce: res.GetNonce(), VersionInfo: res.GetVersionInfo()}
+	<-acks
+	if !accepted("v1") {
+		t.Error("after ack: v1 not accepted")
+	}
+
+	if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "b"}}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	res = <-resCh
+	reqCh <- &discovery_v3.DiscoveryRequest{TypeUrl: m.Type, ResponseNonce: res.GetNonce(), VersionInfo: res.GetVersionInfo()}
+	<-acks
+	if accepted("v1") || !accepted("v2") {
+		t.Error("after update: expected only v2 to be accepted")
+	}
+
+	before := terminations("client_closed")
+	scancel()
+	<-errCh
+	if got, want := terminations("client_closed")-before, 1.0; got != want {
+		t.Errorf("client_closed terminations:\n  got: %v\n want: %v", got, want)
+	}
+	if accepted("v2") {
+		t.Error("after disconnect: v2 still accepted")
+	}
+	if got, want := testutil.ToFloat64(xdsActiveStreams.WithLabelValues(m.Name, m.Type)), 0.0; got != want {
+		t.Errorf("active streams after disconnect:\n  got: %v\n want: %v", got, want)
+	}
+
+	before = terminations("protocol_error")
+	go func() { errCh <- m.Stream(ctx, reqCh, resCh) }()
+	reqCh <- &discovery_v3.DiscoveryRequest{Node: &envoy_config_core_v3.Node{Id: "a"}, TypeUrl: "type.googleapis.com/wrong"}
+	<-errCh
+	if got, want := terminations("protocol_error")-before, 1.0; got != want {
+		t.Errorf("protocol_error terminations:\n  got: %v\n want: %v", got, want)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	m := NewManager("rollback-test", "v", &envoy_config_cluster_v3.Cluster{}, nil)
+	m.RollbackThreshold = 0.6
+	l := zaptest.NewLogger(t)
+	m.Logger = l.Named("manager")
+	ctx, cancel := context.WithTimeout(ctxzap.ToContext(context.Background(), l), 5*time.Second)
+	defer cancel()
+	if err := m.Add(ctx, []Resource{testCluster("a", time.Second), &envoy_config_cluster_v3.Cluster{Name: "z"}}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	acks := make(chan Acknowledgment)
+	m.OnAck = func(a Acknowledgment) { acks <- a }
+
+	type client struct {
+		reqCh chan *discovery_v3.DiscoveryRequest
+		resCh chan *discovery_v3.DiscoveryResponse
+	}
+	var clients []*client
+	for _, id := range []string{"x", "y"} {
+		c := &client{reqCh: make(chan *discovery_v3.DiscoveryRequest), resCh: make(chan *discovery_v3.DiscoveryResponse)}
+		go m.Stream(ctx, c.reqCh, c.resCh)
+		c.reqCh <- &discovery_v3.DiscoveryRequest{Node: &envoy_config_core_v3.Node{Id: id}, TypeUrl: m.Type}
+		clients = append(clients, c)
+	}
+	// respond waits for c's next response, acks or nacks it, and returns the response's connect
+	// timeout and the resulting Acknowledgment.  The names of the response's resources are left
+	// in names.
+	var names []string
+	respond := func(c *client, nack bool) (time.Duration, Acknowledgment) {
+		t.Helper()
+		var res *discovery_v3.DiscoveryResponse
+		select {
+		case res = <-c.resCh:
+		case <-ctx.Done():
+			t.Fatal("timeout waiting for response")
+		}
+		var timeout time.Duration
+		names = nil
+		for i, r := range res.GetResources() {
+			cl := new(envoy_config_cluster_v3.Cluster)
+			if err := r.UnmarshalTo(cl); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			if i == 0 {
+				timeout = cl.GetConnectTimeout().AsDuration()
+			}
+			names = append(names, cl.GetName())
+		}
+		req := &discovery_v3.DiscoveryRequest{TypeUrl: m.Type, ResponseNonce: res.GetNonce(), VersionInfo: res.GetVersionInfo()}
+		if nack {
+			req.VersionInfo = ""
+			req.ErrorDetail = &status.Status{Code: int32(codes.InvalidArgument), Message: "bad cluster"}
+		}
+		c.reqCh <- req
+		return timeout, <-acks
+	}
+	for _, c := range clients {
+		respond(c, false)
+	}
+
+	before := testutil.ToFloat64(xdsRollbacks.WithLabelValues(m.Name, m.Type))
+	if err := m.Add(ctx, []Resource{testCluster("a", 2*time.Second)}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	// One of two nodes rejecting isn't enough.
+	_, a := respond(clients[0], true)
+	if got, want := a.Error, "bad cluster"; got != want {
+		t.Errorf("nack error:\n  got: %v\n want: %v", got, want)
+	}
+	if a.RolledBack != "" {
+		t.Errorf("first nack rolled back to %v", a.RolledBack)
+	}
+	// The second is.
+	_, a = respond(clients[1], true)
+	if got, want := a.RolledBack, "v1"; got != want {
+		t.Errorf("rolled back to:\n  got: %v\n want: %v", got, want)
+	}
+	if got, want := testutil.ToFloat64(xdsRollbacks.WithLabelValues(m.Name, m.Type))-before, 1.0; got != want {
+		t.Errorf("rollbacks:\n  got: %v\n want: %v", got, want)
+	}
+	for i, c := range clients {
+		if got, _ := respond(c, false); got != time.Second {
+			t.Errorf("client %d: connect timeout after rollback:\n  got: %v\n want: %v", i, got, time.Second)
+		}
+	}
+	if got, want := m.RolloutStatus().Version, "v3"; got != want {
+		t.Errorf("version after rollback:\n  got: %v\n want: %v", got, want)
+	}
+
+	// Every change since the last good version is rolled back, since the nodes rejecting the
+	// current version may be rejecting any of them.
+	if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "b"}}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	respond(clients[0], false)
+	respond(clients[1], true)
+	m.Delete(ctx, "z")
+	respond(clients[0], false)
+	respond(clients[1], true)
+	if err := m.Add(ctx, []Resource{testCluster("a", 3*time.Second)}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	respond(clients[0], true)
+	if _, a := respond(clients[1], true); a.RolledBack != "v3" {
+		t.Errorf("rolled back to:\n  got: %v\n want: v3", a.RolledBack)
+	}
+	for i, c := range clients {
+		if got, _ := respond(c, false); got != time.Second {
+			t.Errorf("client %d: connect timeout after second rollback:\n  got: %v\n want: %v", i, got, time.Second)
+		}
+		if diff := cmp.Diff(names, []string{"a", "z"}); diff != "" {
+			t.Errorf("client %d: clusters after second rollback:\n%s", i, diff)
+		}
+	}
+
+	// A bad change whose rejections stop counting because another version replaced it is rolled
+	// back with the rejected version, instead of the newer change alone.
+	if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "bad"}}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	respond(clients[0], true)
+	respond(clients[1], false)
+	if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "new"}}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	respond(clients[0], true)
+	if _, a := respond(clients[1], true); a.RolledBack != "v7" {
+		t.Errorf("rolled back to:\n  got: %v\n want: v7", a.RolledBack)
+	}
+	for i, c := range clients {
+		respond(c, false)
+		if diff := cmp.Diff(names, []string{"a", "z"}); diff != "" {
+			t.Errorf("client %d: clusters after third rollback:\n%s", i, diff)
+		}
+	}
+}
+
+func TestScope(t *testing.T) {
+	m := NewManager("scope-test", "", &envoy_config_cluster_v3.Cluster{}, nil)
+	m.Scope = func(node *envoy_config_core_v3.Node, name string) bool {
+		return node.GetId() != "scoped" || name == "a"
+	}
+	l := zaptest.NewLogger(t)
+	m.Logger = l.Named("manager")
+	ctx, cancel := context.WithTimeout(ctxzap.ToContext(context.Background(), l), 5*time.Second)
+	defer cancel()
+	if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "a"}, &envoy_config_cluster_v3.Cluster{Name: "b"}}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	// names returns the names of the resources that a state-of-the-world stream from node receives
+	// for a subscription.
+	names := func(node string, subscribe []string) []string {
+		t.Helper()
+		reqCh, resCh := make(chan *discovery_v3.DiscoveryRequest), make(chan *discovery_v3.DiscoveryResponse)
+		sctx, scancel := context.WithCancel(ctx)
+		defer scancel()
+		go m.Stream(sctx, reqCh, resCh)
+		reqCh <- &discovery_v3.DiscoveryRequest{Node: &envoy_config_core_v3.Node{Id: node}, TypeUrl: m.Type, ResourceNames: subscribe}
+		var result []string
+		select {
+		case res := <-resCh:
+			for _, a := range res.GetResources() {
+				cl := new(envoy_config_cluster_v3.Cluster)
+				if err := a.UnmarshalTo(cl); err != nil {
+					t.Fatalf("unmarshal: %v", err)
+				}
+				result = append(result, cl.GetName())
+			}
+		case <-ctx.Done():
+			t.Fatal("timeout waiting for response")
+		}
+		return result
+	}
+	if got, want := names("scoped", nil), []string{"a"}; !cmp.Equal(got, want) {
+		t.Errorf("scoped wildcard:\n  got: %v\n want: %v", got, want)
+	}
+	if got, want := names("scoped", []string{"a", "b"}), []string{"a"}; !cmp.Equal(got, want) {
+		t.Errorf("scoped subscription:\n  got: %v\n want: %v", got, want)
+	}
+	if got, want := names("unscoped", nil), []string{"a", "b"}; !cmp.Equal(got, want) {
+		t.Errorf("unscoped wildcard:\n  got: %v\n want: %v", got, want)
+	}
+
+	// An incremental client asking for a resource out of its scope is told that it doesn't exist.
+	reqCh, resCh := make(chan *discovery_v3.DeltaDiscoveryRequest), make(chan *discovery_v3.DeltaDiscoveryResponse)
+	go m.DeltaStream(ctx, reqCh, resCh)
+	reqCh <- &discovery_v3.DeltaDiscoveryRequest{Node: &envoy_config_core_v3.Node{Id: "scoped"}, TypeUrl: m.Type, ResourceNamesSubscribe: []string{"a", "b"}}
+	select {
+	case res := <-resCh:
+		var updated []string
+		for _, r := range res.GetResources() {
+			updated = append(updated, r.GetName())
+		}
+		if got, want := updated, []string{"a"}; !cmp.Equal(got, want) {
+			t.Errorf("delta updated:\n  got: %v\n want: %v", got, want)
+		}
+		if got, want := res.GetRemovedResources(), []string{"b"}; !cmp.Equal(got, want) {
+			t.Errorf("delta removed:\n  got: %v\n want: %v", got, want)
+		}
+	case <-ctx.Done():
+		t.Fatal("timeout waiting for delta response")
+	}
+}
+
+type adsServer struct {
+	discovery_v3.UnimplementedAggregatedDiscoveryServiceServer
+	managers []*Manager
+}
+
+func (s *adsServer) StreamAggregatedResources(stream discovery_v3.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
+	return StreamAggregated(stream, s.managers...)
+}
+
+func TestMirror(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	primary := newTestManager(t, "primary", "primary-")
+	primary.DigestVersions = true
+	mirror := newTestManager(t, "mirror", "mirror-")
+	mirror.DigestVersions = true
+	mirror.Validators = []Validator{func(r Resource) error {
+		if r.(*envoy_config_cluster_v3.Cluster).GetName() == "bad" {
+			return errors.New("bad cluster")
+		}
+		return nil
+	}}
+	if err := primary.Add(ctx, []Resource{testCluster("a", time.Second), testCluster("b", time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+
+	l := bufconn.Listen(1024 * 1024)
+	gs := grpc.NewServer()
+	discovery_v3.RegisterAggregatedDiscoveryServiceServer(gs, &adsServer{managers: []*Manager{primary}})
+	go gs.Serve(l)
+	defer gs.Stop()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return l.DialContext(ctx)
+	}), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- Mirror(ctx, discovery_v3.NewAggregatedDiscoveryServiceClient(conn), &envoy_config_core_v3.Node{Id: "standby"}, mirror)
+	}()
+
+	waitFor := func(want ...string) {
+		t.Helper()
+		for {
+			if cmp.Equal(mirror.ListKeys(), want) {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatalf("mirrored resources:\n  got: %v\n want: %v", mirror.ListKeys(), want)
+			case err := <-errCh:
+				t.Fatalf("mirror exited: %v", err)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+	waitFor("a", "b")
+	if err := primary.Replace(ctx, []Resource{testCluster("b", time.Second), testCluster("c", time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("b", "c")
+	version := func(m *Manager) string {
+		res, _, err := m.BuildDiscoveryResponse(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.GetVersionInfo()
+	}
+	if got, want := version(mirror), version(primary); got != want {
+		t.Errorf("mirror version:\n  got: %v\n want: %v", got, want)
+	}
+
+	// A response the mirror can't apply is rejected, and the mirror keeps what it had.
+	if err := primary.Add(ctx, []Resource{testCluster("bad", time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if got := testutil.ToFloat64(xdsMirroredResponses.WithLabelValues("mirror", mirror.Type, "rejected")); got > 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("mirror never rejected the bad response")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	waitFor("b", "c")
+}
+
+func TestArchive(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	archive := NewArchive(2, time.Hour)
+	archive.now = func() time.Time { return now }
+	clusters := NewManager("clusters", "", &envoy_config_cluster_v3.Cluster{}, nil)
+	others := NewManager("others", "", &envoy_config_cluster_v3.Cluster{}, nil)
+	clusters.Archive, others.Archive = archive, archive
+	ctx := ctxzap.ToContext(context.Background(), zaptest.NewLogger(t))
+	add := func(m *Manager, name string, at time.Duration) {
+		t.Helper()
+		now = start.Add(at)
+		if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: name}}); err != nil {
+			t.Fatalf("add %s: %v", name, err)
+		}
+	}
+	// summary returns manager:version=resources for each config.
+	summary := func(configs []*ArchivedConfig, err error) []string {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("lookup: %v", err)
+		}
+		var result []string
+		for _, c := range configs {
+			var names []string
+			for _, r := range c.Resources {
+				names = append(names, resourceName(r))
+			}
+			result = append(result, fmt.Sprintf("%s:%s=%s", c.Manager, c.Version, strings.Join(names, ",")))
+		}
+		return result
+	}
+
+	add(clusters, "a", time.Minute)
+	add(clusters, "b", 2*time.Minute)
+	add(others, "x", 3*time.Minute)
+	if _, err := archive.At(start); !errors.Is(err, ErrNotArchived) {
+		t.Errorf("before anything was archived: expected ErrNotArchived, got %v", err)
+	}
+	if got, want := summary(archive.At(start.Add(90*time.Second))), []string{"clusters:1=a"}; !cmp.Equal(got, want) {
+		t.Errorf("at 1m30s:\n  got: %v\n want: %v", got, want)
+	}
+	if got, want := summary(archive.At(start.Add(time.Hour))), []string{"clusters:2=a,b", "others:1=x"}; !cmp.Equal(got, want) {
+		t.Errorf("at 1h:\n  got: %v\n want: %v", got, want)
+	}
+	if got, want := summary(archive.AtVersion("", "2")), []string{"clusters:2=a,b"}; !cmp.Equal(got, want) {
+		t.Errorf("version 2:\n  got: %v\n want: %v", got, want)
+	}
+	if _, err := archive.AtVersion("", "1"); err == nil || errors.Is(err, ErrNotArchived) {
+		t.Errorf("ambiguous version: expected an error asking for a manager, got %v", err)
+	}
+	if got, want := summary(archive.AtVersion("others", "1")), []string{"clusters:2=a,b", "others:1=x"}; !cmp.Equal(got, want) {
+		t.Errorf("others version 1:\n  got: %v\n want: %v", got, want)
+	}
+
+	// Only 2 snapshots per manager are kept.
+	add(clusters, "c", 4*time.Minute)
+	if got, want := summary(archive.At(start.Add(150*time.Second))), []string{"clusters:2=a,b"}; !cmp.Equal(got, want) {
+		t.Errorf("at 2m30s, after pruning:\n  got: %v\n want: %v", got, want)
+	}
+	if _, err := archive.AtVersion("clusters", "1"); !errors.Is(err, ErrNotArchived) {
+		t.Errorf("pruned version: expected ErrNotArchived, got %v", err)
+	}
+
+	// Snapshots are kept for an hour after they're superseded, but the current one is always kept.
+	add(clusters, "d", 2*time.Hour)
+	if got, want := summary(archive.At(start.Add(3*time.Hour))), []string{"clusters:4=a,b,c,d", "others:1=x"}; !cmp.Equal(got, want) {
+		t.Errorf("at 3h:\n  got: %v\n want: %v", got, want)
+	}
+	if got, want := summary(archive.At(start.Add(5*time.Minute))), []string{"clusters:3=a,b,c", "others:1=x"}; !cmp.Equal(got, want) {
+		t.Errorf("at 5m:\n  got: %v\n want: %v", got, want)
+	}
+	if got, want := summary(archive.At(start.Add(3*time.Minute))), []string{"others:1=x"}; !cmp.Equal(got, want) {
+		t.Errorf("at 3m, after expiry:\n  got: %v\n want: %v", got, want)
+	}
+
+	w := httptest.NewRecorder()
+	archive.ServeHTTP(w, httptest.NewRequest("GET", "/config_dump?at=4&manager=clusters", nil))
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("serve version: status:\n  got: %v\n want: %v\nbody: %s", got, want, w.Body.String())
+	}
+	var dump []struct {
+		Manager   string                   `json:"manager"`
+		Version   string                   `json:"version"`
+		Resources []map[string]interface{} `json:"resources"`
+	}
+	if err := yaml.Unmarshal(w.Body.Bytes(), &dump); err != nil {
+		t.Fatalf("unmarshal dump: %v", err)
+	}
+	if len(dump) != 1 || dump[0].Manager != "clusters" || dump[0].Version != "4" || len(dump[0].Resources) != 4 || dump[0].Resources[3]["name"] != "d" {
+		t.Errorf("unexpected dump:\n%s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	archive.ServeHTTP(w, httptest.NewRequest("GET", "/config_dump?at=2019-01-01T00:00:00Z", nil))
+	if got, want := w.Code, http.StatusNotFound; got != want {
+		t.Errorf("serve old time: status:\n  got: %v\n want: %v", got, want)
+	}
+}
+
+func TestParallelMarshal(t *testing.T) {
+	ctx := ctxzap.ToContext(context.Background(), zaptest.NewLogger(t))
+	var rs []Resource
+	for i := 0; i < 3*parallelMarshalThreshold+7; i++ {
+		rs = append(rs, testCluster(fmt.Sprintf("cluster-%04d", i), time.Duration(i+1)*time.Millisecond))
+	}
+	response := func(workers int, subscribe []string) *discovery_v3.DiscoveryResponse {
+		t.Helper()
+		m := NewManager("marshal-test", "", &envoy_config_cluster_v3.Cluster{}, nil)
+		m.MarshalWorkers = workers
+		m.DigestVersions = true
+		if err := m.Replace(ctx, rs); err != nil {
+			t.Fatalf("replace: %v", err)
+		}
+		m.resourcesMu.Lock()
+		defer m.resourcesMu.Unlock()
+		resources, _, version, err := m.snapshot(subscribe, nil)
+		if err != nil {
+			t.Fatalf("snapshot: %v", err)
+		}
+		return &discovery_v3.DiscoveryResponse{VersionInfo: version, Resources: resources}
+	}
+	serial := response(1, nil)
+	if got, want := len(serial.GetResources()), len(rs); got != want {
+		t.Fatalf("resources:\n  got: %v\n want: %v", got, want)
+	}
+	for _, workers := range []int{2, 7, 64} {
+		if diff := cmp.Diff(response(workers, nil), serial, protocmp.Transform()); diff != "" {
+			t.Errorf("wildcard with %d workers:\n%s", workers, diff)
+		}
+	}
+	var subscribe []string
+	for i := len(rs) - 1; i >= 0; i -= 2 {
+		subscribe = append(subscribe, fmt.Sprintf("cluster-%04d", i), "missing")
+	}
+	if diff := cmp.Diff(response(8, subscribe), response(1, subscribe), protocmp.Transform()); diff != "" {
+		t.Errorf("explicit subscription:\n%s", diff)
+	}
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	ctx, cancel := context.WithTimeout(ctxzap.ToContext(context.Background(), l), 5*time.Second)
+	defer cancel()
+	var clas []Resource
+	var clusters []Resource
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("cluster-%d", i)
+		clusters = append(clusters, &envoy_config_cluster_v3.Cluster{Name: name, ConnectTimeout: durationpb.New(time.Second), AltStatName: strings.Repeat("x", 100)})
+		cla := &envoy_config_endpoint_v3.ClusterLoadAssignment{ClusterName: name}
+		for j := 0; j < 10; j++ {
+			cla.Endpoints = append(cla.Endpoints, &envoy_config_endpoint_v3.LocalityLbEndpoints{
+				LbEndpoints: []*envoy_config_endpoint_v3.LbEndpoint{{
+					HostIdentifier: &envoy_config_endpoint_v3.LbEndpoint_Endpoint{Endpoint: &envoy_config_endpoint_v3.Endpoint{
+						Address: &envoy_config_core_v3.Address{Address: &envoy_config_core_v3.Address_SocketAddress{SocketAddress: &envoy_config_core_v3.SocketAddress{
+							Address:       fmt.Sprintf("10.0.%d.%d", i, j),
+							PortSpecifier: &envoy_config_core_v3.SocketAddress_PortValue{PortValue: 80},
+						}}},
+					}},
+				}},
+			})
+		}
+		clas = append(clas, cla)
+	}
+
+	// responses returns the responses that a new wildcard stream from node receives, until it has
+	// received every resource.
+	responses := func(m *Manager, node *envoy_config_core_v3.Node) []*discovery_v3.DiscoveryResponse {
+		t.Helper()
+		reqCh, resCh := make(chan *discovery_v3.DiscoveryRequest), make(chan *discovery_v3.DiscoveryResponse)
+		sctx, scancel := context.WithCancel(ctx)
+		defer scancel()
+		go m.Stream(sctx, reqCh, resCh)
+		reqCh <- &discovery_v3.DiscoveryRequest{Node: node, TypeUrl: m.Type}
+		var result []*discovery_v3.DiscoveryResponse
+		var n int
+		for n < len(m.List()) {
+			select {
+			case res := <-resCh:
+				result = append(result, res)
+				n += len(res.GetResources())
+			case <-ctx.Done():
+				t.Fatalf("timeout after %d responses", len(result))
+			}
+		}
+		return result
+	}
+
+	endpoints := NewManager("endpoints", "", &envoy_config_endpoint_v3.ClusterLoadAssignment{}, nil)
+	endpoints.Logger = l.Named("endpoints")
+	if err := endpoints.Replace(ctx, clas); err != nil {
+		t.Fatalf("replace endpoints: %v", err)
+	}
+	full := proto.Size(responses(endpoints, nil)[0])
+	endpoints.MaxResponseBytes = full / 3
+	parts := responses(endpoints, &envoy_config_core_v3.Node{Id: "test"})
+	if len(parts) < 3 {
+		t.Errorf("expected the response to be split into at least 3 parts, got %d", len(parts))
+	}
+	nonces := make(map[string]struct{})
+	for i, res := range parts {
+		if got, want := res.GetVersionInfo(), parts[0].GetVersionInfo(); got != want {
+			t.Errorf("part %d: version:\n  got: %v\n want: %v", i, got, want)
+		}
+		if size := proto.Size(res); size > endpoints.MaxResponseBytes {
+			t.Errorf("part %d: size %d exceeds the limit of %d", i, size, endpoints.MaxResponseBytes)
+		}
+		nonces[res.GetNonce()] = struct{}{}
+	}
+	if got, want := len(nonces), len(parts); got != want {
+		t.Errorf("distinct nonces:\n  got: %v\n want: %v", got, want)
+	}
+	if got := responses(endpoints, &envoy_config_core_v3.Node{Id: "mirror", ClientFeatures: []string{FullStateClientFeature}}); len(got) != 1 {
+		t.Errorf("full state client: expected 1 response, got %d", len(got))
+	}
+	if got, want := testutil.ToFloat64(xdsOversizedResponses.WithLabelValues("endpoints", endpoints.Type, "split")), 1.0; got != want {
+		t.Errorf("split responses:\n  got: %v\n want: %v", got, want)
+	}
+
+	// Clusters can't be split, so they are sent anyway, and counted.
+	cds := NewManager("clusters", "", &envoy_config_cluster_v3.Cluster{}, nil)
+	cds.Logger = l.Named("clusters")
+	if err := cds.Replace(ctx, clusters); err != nil {
+		t.Fatalf("replace clusters: %v", err)
+	}
+	cds.MaxResponseBytes = 100
+	if got := responses(cds, nil); len(got) != 1 {
+		t.Errorf("clusters: expected 1 response, got %d", len(got))
+	}
+	if got, want := testutil.ToFloat64(xdsOversizedResponses.WithLabelValues("clusters", cds.Type, "sent")), 1.0; got != want {
+		t.Errorf("oversized cluster responses:\n  got: %v\n want: %v", got, want)
+	}
+}
+
+func TestPin(t *testing.T) {
+	ctx := ctxzap.ToContext(context.Background(), zaptest.NewLogger(t))
+	m := newTestManager(t, "pin-test", "")
+	version := func() string {
+		res, _, err := m.BuildDiscoveryResponse(nil)
+		if err != nil {
+			t.Fatalf("build response: %v", err)
+		}
+		return res.GetVersionInfo()
+	}
+	timeout := func(name string) time.Duration {
+		r := m.Get(name)
+		if r == nil {
+			return 0
+		}
+		return r.(*envoy_config_cluster_v3.Cluster).GetConnectTimeout().AsDuration()
+	}
+	if err := m.Add(ctx, []Resource{testCluster("a", time.Second), testCluster("b", time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Pin("c", time.Hour, ""); err == nil {
+		t.Error("pin missing resource: expected error")
+	}
+	if err := m.Unpin(ctx, "a"); !errors.Is(err, ErrNotPinned) {
+		t.Errorf("unpin unpinned resource:\n  got: %v\n want: %v", err, ErrNotPinned)
+	}
+	if err := m.Pin("a", time.Hour, "maintenance"); err != nil {
+		t.Fatalf("pin: %v", err)
+	}
+	v := version()
+
+	// Changes to the pinned resource are held back, and don't make a new version.
+	if err := m.Add(ctx, []Resource{testCluster("a", 2*time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := timeout("a"), time.Second; got != want {
+		t.Errorf("pinned resource after update:\n  got: %v\n want: %v", got, want)
+	}
+	if got, want := version(), v; got != want {
+		t.Errorf("version after held change:\n  got: %v\n want: %v", got, want)
+	}
+	if pins := m.Pins(); len(pins) != 1 || pins[0].Name != "a" || !pins[0].Held || pins[0].Reason != "maintenance" {
+		t.Errorf("pins: unexpected status %v", pins)
+	}
+	// Replacing everything neither deletes the pinned resource nor holds back other changes.
+	if err := m.Replace(ctx, []Resource{testCluster("b", 3*time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.ListKeys(), []string{"a", "b"}; !cmp.Equal(got, want) {
+		t.Errorf("resources after replace:\n  got: %v\n want: %v", got, want)
+	}
+	if got, want := timeout("b"), 3*time.Second; got != want {
+		t.Errorf("unpinned resource after replace:\n  got: %v\n want: %v", got, want)
+	}
+	// Changing it back to the pinned value means nothing is held.
+	if err := m.Add(ctx, []Resource{testCluster("a", time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if pins := m.Pins(); len(pins) != 1 || pins[0].Held {
+		t.Errorf("pins after reverting: unexpected status %v", pins)
+	}
+	v = version()
+	if err := m.Unpin(ctx, "a"); err != nil {
+		t.Fatalf("unpin: %v", err)
+	}
+	if got, want := version(), v; got != want {
+		t.Errorf("version after unpinning without a held change:\n  got: %v\n want: %v", got, want)
+	}
+
+	// A held change is applied when the pin expires.
+	if err := m.Pin("a", 50*time.Millisecond, ""); err != nil {
+		t.Fatalf("pin: %v", err)
+	}
+	if err := m.Add(ctx, []Resource{testCluster("a", 4*time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := timeout("a"), time.Second; got != want {
+		t.Errorf("pinned resource after update:\n  got: %v\n want: %v", got, want)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for timeout("a") != 4*time.Second {
+		if time.Now().After(deadline) {
+			t.Fatal("held change was not applied after the pin expired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pins := m.Pins(); len(pins) != 0 {
+		t.Errorf("pins after expiry: %v", pins)
+	}
+}
+
+func TestHandOff(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	ctx, cancel := context.WithTimeout(ctxzap.ToContext(context.Background(), l), 5*time.Second)
+	defer cancel()
+	m := NewManager("test", "", &envoy_config_cluster_v3.Cluster{}, nil)
+	m.Logger = l.Named("manager")
+	if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "a"}}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	res, _, err := m.BuildDiscoveryResponse(nil)
+	if err != nil {
+		t.Fatalf("build response: %v", err)
+	}
+	version := res.GetVersionInfo()
+
+	// Imported entries seed the rollout status of nodes when they connect.
+	m.ImportLedger([]*LedgerEntry{{Node: "a", Accepted: version}, {Node: "b", Accepted: "old", Rejected: version}, {Node: ""}})
+	if diff := cmp.Diff(m.Ledger(), []*LedgerEntry{{Node: "a", Accepted: version}, {Node: "b", Accepted: "old", Rejected: version}}); diff != "" {
+		t.Errorf("ledger after import:\n%s", diff)
+	}
+	reqCh, resCh, errCh := make(chan *discovery_v3.DiscoveryRequest), make(chan *discovery_v3.DiscoveryResponse), make(chan error)
+	go func() { errCh <- m.Stream(ctx, reqCh, resCh) }()
+	reqCh <- &discovery_v3.DiscoveryRequest{Node: &envoy_config_core_v3.Node{Id: "a"}, TypeUrl: m.Type}
+	res = <-resCh
+	want := &RolloutStatus{Version: version, Nodes: 1, Acked: 1, Accepted: map[string]int{version: 1}}
+	if diff := cmp.Diff(m.RolloutStatus(), want, cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("rollout status before ack:\n%s", diff)
+	}
+	if got, want := m.OpenStreams(), 1; got != want {
+		t.Errorf("open streams:\n  got: %v\n want: %v", got, want)
+	}
+
+	// The stream is handed off once its response is acknowledged.
+	if got, want := m.HandOff(10), 1; got != want {
+		t.Errorf("streams handed off:\n  got: %v\n want: %v", got, want)
+	}
+	if got, want := m.HandOff(10), 0; got != want {
+		t.Errorf("streams handed off again:\n  got: %v\n want: %v", got, want)
+	}
+	if got, want := m.OpenStreams(), 0; got != want {
+		t.Errorf("open streams after hand off:\n  got: %v\n want: %v", got, want)
+	}
+	reqCh <- &discovery_v3.DiscoveryRequest{TypeUrl: m.Type, ResponseNonce: res.GetNonce(), VersionInfo: res.GetVersionInfo()}
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, errHandedOff) {
+			t.Errorf("stream error:\n  got: %v\n want: %v", err, errHandedOff)
+		}
+	case <-ctx.Done():
+		t.Fatal("stream was not handed off")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	ctx, cancel := context.WithTimeout(ctxzap.ToContext(context.Background(), l), 5*time.Second)
+	defer cancel()
+	drainCh := make(chan struct{})
+	m := NewManager("drain", "", &envoy_config_cluster_v3.Cluster{}, drainCh)
+	m.Logger = l.Named("manager")
+	m.DrainTimeout = time.Minute
+	if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "a"}}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	reqCh, resCh, errCh := make(chan *discovery_v3.DiscoveryRequest), make(chan *discovery_v3.DiscoveryResponse), make(chan error)
+	go func() { errCh <- m.Stream(ctx, reqCh, resCh) }()
+	reqCh <- &discovery_v3.DiscoveryRequest{Node: &envoy_config_core_v3.Node{Id: "a"}, TypeUrl: m.Type}
+	res := <-resCh
+	if diff := cmp.Diff(m.DrainStatus(), &DrainStatus{OpenStreams: 1}); diff != "" {
+		t.Errorf("drain status before draining:\n%s", diff)
+	}
+
+	// The stream waits for its response to be acknowledged.
+	close(drainCh)
+	for m.DrainStatus().AwaitingAck == 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("stream did not start waiting for an ack")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if diff := cmp.Diff(m.DrainStatus(), &DrainStatus{Draining: true, OpenStreams: 1, AwaitingAck: 1}); diff != "" {
+		t.Errorf("drain status while waiting:\n%s", diff)
+	}
+	// Nothing more is pushed.
+	if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "b"}}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	select {
+	case res := <-resCh:
+		t.Errorf("unexpected push while draining: %v", res)
+	case <-time.After(200 * time.Millisecond):
+	}
+	reqCh <- &discovery_v3.DiscoveryRequest{TypeUrl: m.Type, ResponseNonce: res.GetNonce(), VersionInfo: res.GetVersionInfo()}
+	select {
+	case err := <-errCh:
+		if got, want := grpcstatus.Code(err), codes.Unavailable; got != want {
+			t.Errorf("stream error code:\n  got: %v\n want: %v", got, want)
+		}
+	case <-ctx.Done():
+		t.Fatal("stream did not close after its response was acknowledged")
+	}
+	if diff := cmp.Diff(m.DrainStatus(), &DrainStatus{Draining: true}); diff != "" {
+		t.Errorf("drain status after draining:\n%s", diff)
+	}
+
+	// A client that never answers is cut off after the timeout.
+	drainCh = make(chan struct{})
+	m = NewManager("drain-timeout", "", &envoy_config_cluster_v3.Cluster{}, drainCh)
+	m.Logger = l.Named("manager")
+	m.DrainTimeout = 100 * time.Millisecond
+	timedOut := xdsStreamsDrained.WithLabelValues(m.Name, m.Type, "timed_out")
+	before := testutil.ToFloat64(timedOut)
+	go func() { errCh <- m.Stream(ctx, reqCh, resCh) }()
+	reqCh <- &discovery_v3.DiscoveryRequest{Node: &envoy_config_core_v3.Node{Id: "a"}, TypeUrl: m.Type}
+	<-resCh
+	close(drainCh)
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, errDraining) {
+			t.Errorf("stream error:\n  got: %v\n want: %v", err, errDraining)
+		}
+	case <-ctx.Done():
+		t.Fatal("stream did not time out")
+	}
+	if got, want := testutil.ToFloat64(timedOut)-before, 1.0; got != want {
+		t.Errorf("streams timed out:\n  got: %v\n want: %v", got, want)
+	}
+}
+
+func TestAdminCapture(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	ctx, cancel := context.WithTimeout(ctxzap.ToContext(context.Background(), l), 5*time.Second)
+	defer cancel()
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/config_dump":
+			w.Write([]byte(`{"configs": []}`))
+		case "/stats":
+			w.Write([]byte("cluster_manager.cds.update_rejected: 2\n" + strings.Repeat("x", 100)))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer admin.Close()
+	history := NewRingHistory(100)
+	m := NewManager("test", "", &envoy_config_cluster_v3.Cluster{}, nil)
+	m.Logger = l.Named("manager")
+	m.History = history
+	m.AdminCapture = &AdminCapture{Threshold: 2, MaxBytes: 50}
+
+	if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: "a"}}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	reqCh, resCh, errCh := make(chan *discovery_v3.DiscoveryRequest), make(chan *discovery_v3.DiscoveryResponse), make(chan error)
+	go func() { errCh <- m.Stream(ctx, reqCh, resCh) }()
+	md, err := structpb.NewStruct(map[string]interface{}{DefaultAdminAddressKey: strings.TrimPrefix(admin.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqCh <- &discovery_v3.DiscoveryRequest{Node: &envoy_config_core_v3.Node{Id: "looping", Metadata: md}, TypeUrl: m.Type}
+	nack := func() {
+		t.Helper()
+		res := <-resCh
+		reqCh <- &discovery_v3.DiscoveryRequest{TypeUrl: m.Type, ResponseNonce: res.GetNonce(), ErrorDetail: &status.Status{Code: int32(codes.InvalidArgument), Message: "rejected"}}
+	}
+	nack()
+	for _, name := range []string{"b", "c"} {
+		if err := m.Add(ctx, []Resource{&envoy_config_cluster_v3.Cluster{Name: name}}); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+		nack()
+	}
+
+	// The second and third rejections are past the threshold, but only one capture is made.
+	var captures []*HistoryRecord
+	for {
+		records, err := history.Recent(100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		captures = captures[:0]
+		for _, r := range records {
+			if r.Event == "capture" {
+				captures = append(captures, r)
+			}
+		}
+		if len(captures) > 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for a capture")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	want := []*HistoryRecord{{
+		Manager: "test",
+		Event:   "capture",
+		Node:    "looping",
+		Version: "2",
+		Capture: map[string]string{
+			"/config_dump": `{"configs": []}`,
+			"/stats":       "cluster_manager.cds.update_rejected: 2\nxxxxxxxxxxx",
+		},
+	}}
+	if diff := cmp.Diff(captures, want, cmpopts.IgnoreFields(HistoryRecord{}, "Time")); diff != "" {
+		t.Errorf("captures:\n%s", diff)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	ctx, cancel := context.WithTimeout(ctxzap.ToContext(context.Background(), l), 5*time.Second)
+	defer cancel()
+	m := NewManager("test", "", &envoy_config_cluster_v3.Cluster{}, nil)
+	m.Logger = l.Named("manager")
+	if err := m.Add(ctx, []Resource{testCluster("a", time.Second)}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	sub := m.Subscribe(10)
+	defer sub.Close()
+	full := m.Subscribe(0)
+
+	next := func() Event {
+		t.Helper()
+		select {
+		case e := <-sub.Events():
+			return e
+		case <-ctx.Done():
+			t.Fatal("timeout waiting for event")
+		}
+		return nil
+	}
+	check := func(desc string, got []Event, want []Event) {
+		t.Helper()
+		if diff := cmp.Diff(got, want, protocmp.Transform(), cmpopts.IgnoreFields(ResourceAdded{}, "Version"), cmpopts.IgnoreFields(ResourceUpdated{}, "Version"), cmpopts.IgnoreFields(ResourceDeleted{}, "Version")); diff != "" {
+			t.Errorf("%s:\n%s", desc, diff)
+		}
+	}
+
+	// Resources that existed before the subscription are updated, not added.
+	if err := m.Replace(ctx, []Resource{testCluster("a", 2*time.Second), testCluster("b", time.Second)}); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	check("replace", []Event{next(), next()}, []Event{
+		ResourceUpdated{Name: "a", Resource: testCluster("a", 2*time.Second), Previous: testCluster("a", time.Second)},
+		ResourceAdded{Name: "b", Resource: testCluster("b", time.Second)},
+	})
+	m.Delete(ctx, "a")
+	check("delete", []Event{next()}, []Event{ResourceDeleted{Name: "a", Previous: testCluster("a", 2*time.Second)}})
+
+	reqCh, resCh, errCh := make(chan *discovery_v3.DiscoveryRequest), make(chan *discovery_v3.DiscoveryResponse), make(chan error)
+	go func() { errCh <- m.Stream(ctx, reqCh, resCh) }()
+	reqCh <- &discovery_v3.DiscoveryRequest{Node: &envoy_config_core_v3.Node{Id: "test"}, TypeUrl: m.Type}
+	res := <-resCh
+	check("push", []Event{next()}, []Event{PushCompleted{Node: "test", Version: res.GetVersionInfo(), Resources: []string{"b"}}})
+	reqCh <- &discovery_v3.DiscoveryRequest{TypeUrl: m.Type, VersionInfo: res.GetVersionInfo(), ResponseNonce: res.GetNonce()}
+	check("ack", []Event{next()}, []Event{AckReceived{Acknowledgment{Node: "test", Version: res.GetVersionInfo(), Ack: true}}})
+
+	// A subscriber without room for events misses them, without holding anything up.
+	select {
+	case e := <-full.Events():
+		t.Errorf("unexpected event for a full subscription: %#v", e)
+	default:
+	}
+	full.Close()
+	full.Close()
+	if _, ok := <-full.Events(); ok {
+		t.Error("events of a closed subscription should be closed")
+	}
+}
+
+func TestContextParams(t *testing.T) {
+	ctx := context.Background()
+	m := newTestManager(t, "test", "")
+	m.ContextParams = true
+	variant := VariantName("foo", map[string]string{"shard": "1"})
+	if got, want := variant, "foo?shard=1"; got != want {
+		t.Errorf("variant name:\n  got: %v\n want: %v", got, want)
+	}
+	if err := m.Add(ctx, []Resource{testCluster("foo", time.Second), testCluster(variant, 2*time.Second), testCluster("bar", time.Second)}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	plain := &envoy_config_core_v3.Node{Id: "plain"}
+	shard1 := new(envoy_config_core_v3.Node)
+	if err := protojson.Unmarshal([]byte(`{"id": "shard1", "dynamicParameters": {"`+m.Type+`": {"params": {"shard": "1"}}}}`), shard1); err != nil {
+		t.Fatal(err)
+	}
+	xdstp := func(id string) string { return "xdstp://example.com/envoy.config.cluster.v3.Cluster/" + id }
+	decode := func(resources []*anypb.Any) []Resource {
+		t.Helper()
+		var result []Resource
+		for _, a := range resources {
+			c := new(envoy_config_cluster_v3.Cluster)
+			if err := a.UnmarshalTo(c); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			result = append(result, c)
+		}
+		return result
+	}
+	testData := []struct {
+		name string
+		node *envoy_config_core_v3.Node
+		want []string
+		res  []Resource
+	}{
+		{"xdstp variant", plain, []string{xdstp("foo?shard=1")}, []Resource{testCluster(xdstp("foo?shard=1"), 2*time.Second)}},
+		{"xdstp fallback", plain, []string{xdstp("foo?shard=2")}, []Resource{testCluster(xdstp("foo?shard=2"), time.Second)}},
+		{"dynamic parameters", shard1, []string{"foo", "bar"}, []Resource{testCluster("bar", time.Second), testCluster("foo", 2*time.Second)}},
+		{"no parameters", plain, []string{"foo"}, []Resource{testCluster("foo", time.Second)}},
+		{"wildcard", shard1, nil, []Resource{testCluster("bar", time.Second), testCluster("foo", time.Second)}},
+	}
+	for _, test := range testData {
+		m.resourcesMu.Lock()
+		resources, _, _, err := m.snapshot(test.want, test.node)
+		m.resourcesMu.Unlock()
+		if err != nil {
+			t.Fatalf("%s: snapshot: %v", test.name, err)
+		}
+		if diff := cmp.Diff(decode(resources), test.res, protocmp.Transform()); diff != "" {
+			t.Errorf("%s: resources:\n%s", test.name, diff)
+		}
+	}
+
+	// A change to the variant affects the clients it is served to.
+	changed := map[string]struct{}{variant: {}}
+	if !m.affected("foo", shard1, changed) || !m.affected(xdstp("foo?shard=1"), plain, changed) {
+		t.Error("change to the variant should affect clients asking for it")
+	}
+	if m.affected("foo", plain, changed) {
+		t.Error("change to the variant should not affect other clients")
+	}
+
+	// Incremental clients get the same resources, and wildcard subscribers no variants.
+	st := &deltaState{node: plain, subscribed: map[string]struct{}{xdstp("foo?shard=1"): {}}, known: make(map[string]string)}
+	res, _, err := m.buildDeltaResponse(st, nil, nil)
+	if err != nil {
+		t.Fatalf("build delta response: %v", err)
+	}
+	if got, want := res.GetResources()[0].GetName(), xdstp("foo?shard=1"); len(res.GetResources()) != 1 || got != want {
+		t.Errorf("delta resources:\n  got: %v\n want: [%v]", res.GetResources(), want)
+	}
+	st = &deltaState{node: shard1, wildcard: true, subscribed: make(map[string]struct{}), known: make(map[string]string)}
+	res, _, err = m.buildDeltaResponse(st, []string{"bar", "foo", variant}, nil)
+	if err != nil {
+		t.Fatalf("build delta response: %v", err)
+	}
+	var names []string
+	for _, r := range res.GetResources() {
+		names = append(names, r.GetName())
+	}
+	if diff := cmp.Diff(names, []string{"bar", "foo"}); diff != "" {
+		t.Errorf("wildcard delta resources:\n%s", diff)
+	}
+}